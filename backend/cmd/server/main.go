@@ -53,12 +53,12 @@ func main() {
 	defer rdb.Close()
 	log.Info().Msg("Connected to Redis")
 
-	// Initialize MinIO storage
-	store, err := storage.NewMinIO(cfg.Storage)
+	// Initialize object storage
+	store, err := storage.New(cfg.Storage, cfg.JWT.Secret)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to initialize MinIO storage")
+		log.Fatal().Err(err).Str("backend", cfg.Storage.Backend).Msg("Failed to initialize storage")
 	}
-	log.Info().Msg("Connected to MinIO")
+	log.Info().Str("backend", store.Name()).Msg("Connected to storage")
 
 	// Create and start server
 	srv := server.New(cfg, db, rdb, store, log)
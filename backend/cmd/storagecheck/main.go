@@ -0,0 +1,139 @@
+// Command storagecheck cross-checks the database against the object store
+// and reports, and optionally repairs, what doesn't match. It runs the same
+// check as the admin API, and its report shows up there too.
+//
+// It exits with 0 when everything matches, 2 when issues were found and 1
+// when the check failed.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+
+	"github.com/tessera/tessera/internal/config"
+	"github.com/tessera/tessera/internal/database"
+	"github.com/tessera/tessera/internal/logger"
+	"github.com/tessera/tessera/internal/repository"
+	"github.com/tessera/tessera/internal/security"
+	"github.com/tessera/tessera/internal/services"
+	"github.com/tessera/tessera/internal/storage"
+)
+
+func main() {
+	var opts services.StorageCheckOptions
+	flag.Float64Var(&opts.HashSample, "hash-sample", 0, "share of stored contents to read back and compare with their hash, 0 to 1")
+	hashAll := flag.Bool("hash-all", false, "compare every stored content with its hash (same as -hash-sample 1)")
+	flag.BoolVar(&opts.Quarantine, "quarantine", false, "move orphaned objects under "+services.QuarantinePrefix)
+	flag.BoolVar(&opts.MarkBroken, "mark-broken", false, "mark files whose content is missing or damaged")
+	flag.BoolVar(&opts.FixCounts, "fix-counts", false, "fix users' storage used and blob reference counts")
+	asJSON := flag.Bool("json", false, "print the full report as JSON")
+	flag.Parse()
+	if *hashAll {
+		opts.HashSample = 1
+	}
+
+	log := logger.New()
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load configuration")
+	}
+
+	db, err := database.Connect(cfg.Database)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to connect to database")
+	}
+	defer db.Close()
+
+	backend, err := storage.New(cfg.Storage, cfg.JWT.Secret)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to initialize storage")
+	}
+
+	// Objects are read through the encryption layer, as the server does, so
+	// encrypted content is hashed as its owner uploaded it
+	var store storage.Storage = backend
+	if cfg.Encryption.MasterKey != "" {
+		encryptor, err := security.NewEncryptor(cfg.Encryption.MasterKey, cfg.Encryption.PreviousKeys...)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to initialize encryptor")
+		}
+		encryption := services.NewEncryptionService(repository.NewEncryptionRepository(db), encryptor, log)
+		store = storage.NewEncrypted(backend, encryption, cfg.Encryption.Files)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	checks := services.NewStorageCheckService(repository.NewStorageCheckRepository(db), backend, store, log)
+	report, err := checks.Check(ctx, opts)
+	if err != nil {
+		log.Error().Err(err).Msg("Storage check failed")
+		os.Exit(1)
+	}
+
+	if *asJSON {
+		out := json.NewEncoder(os.Stdout)
+		out.SetIndent("", "  ")
+		if err := out.Encode(report); err != nil {
+			os.Exit(1)
+		}
+	} else {
+		printReport(report)
+	}
+	if len(report.Counts) > 0 {
+		os.Exit(2)
+	}
+}
+
+func printReport(report *services.StorageCheckReport) {
+	fmt.Printf("Backend: %s\n", report.Backend)
+	fmt.Printf("Checked %d stored contents (%d hashed) and %d objects in %s\n",
+		report.ContentsChecked, report.ContentsHashed, report.ObjectsListed,
+		report.FinishedAt.Sub(report.StartedAt).Round(1e6))
+
+	if len(report.Counts) == 0 {
+		fmt.Println("No issues found")
+		return
+	}
+
+	kinds := make([]string, 0, len(report.Counts))
+	for kind := range report.Counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	fmt.Println("\nIssues:")
+	for _, kind := range kinds {
+		fmt.Printf("  %-16s %d\n", kind, report.Counts[kind])
+	}
+
+	fmt.Println()
+	for _, issue := range report.Issues {
+		line := issue.Kind
+		if issue.Key != "" {
+			line += " " + issue.Key
+		}
+		if issue.Detail != "" {
+			line += ": " + issue.Detail
+		}
+		if issue.Action != "" {
+			line += " [" + issue.Action + "]"
+		}
+		fmt.Println(line)
+		for _, ref := range issue.Files {
+			if ref.Version > 0 {
+				fmt.Printf("    file %s %q, version %d\n", ref.FileID, ref.Name, ref.Version)
+			} else {
+				fmt.Printf("    file %s %q\n", ref.FileID, ref.Name)
+			}
+		}
+	}
+	if report.Truncated {
+		fmt.Println("(more issues were found than are listed)")
+	}
+}
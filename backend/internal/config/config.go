@@ -20,6 +20,8 @@ type Config struct {
 	JWT        JWTConfig
 	Upload     UploadConfig
 	Encryption EncryptionConfig
+	SMTP       SMTPConfig
+	Scan       ScanConfig
 }
 
 type AppConfig struct {
@@ -62,11 +64,21 @@ func (c RedisConfig) Addr() string {
 }
 
 type StorageConfig struct {
+	// Backend is "minio" (the default) or "local"
+	Backend string
+
+	// MinIO (or any S3-compatible store)
 	Endpoint  string
 	AccessKey string
 	SecretKey string
 	Bucket    string
 	UseSSL    bool
+
+	// LocalPath is the directory the local backend keeps objects in
+	LocalPath string
+	// LocalURL is the base URL of signed URLs to local objects. They're
+	// fetched by the server's own tools, so it defaults to the API itself.
+	LocalURL string
 }
 
 type JWTConfig struct {
@@ -82,6 +94,41 @@ type UploadConfig struct {
 
 type EncryptionConfig struct {
 	MasterKey string // Base64 encoded 32-byte key for AES-256
+	// PreviousKeys are master keys being rotated out, still needed until
+	// the data keys they wrap are rewrapped
+	PreviousKeys []string
+	// Files turns on encryption at rest of file contents, thumbnails and
+	// email attachments
+	Files bool
+}
+
+// SMTPConfig is the system mail account used for notifications such as
+// calendar reminders. Mail is disabled when Host is empty.
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	TLS      bool // STARTTLS, or implicit TLS on port 465
+}
+
+func (c SMTPConfig) Enabled() bool {
+	return c.Host != "" && c.From != ""
+}
+
+// ScanConfig is the clamd daemon uploads are scanned with for malware.
+// Scanning is disabled when ClamdAddress is empty.
+type ScanConfig struct {
+	// ClamdAddress is "tcp://host:port", "unix:///path/to/clamd.sock", or
+	// a bare host:port or socket path
+	ClamdAddress string
+	// Timeout is how long clamd may go without answering
+	Timeout time.Duration
+}
+
+func (c ScanConfig) Enabled() bool {
+	return c.ClamdAddress != ""
 }
 
 // Load reads configuration from environment variables
@@ -123,11 +170,14 @@ func Load() (*Config, error) {
 			DB:       getEnvInt("REDIS_DB", 0),
 		},
 		Storage: StorageConfig{
+			Backend:   strings.ToLower(getEnv("STORAGE_BACKEND", "minio")),
 			Endpoint:  getEnv("MINIO_ENDPOINT", "localhost:9000"),
 			AccessKey: getEnv("MINIO_ACCESS_KEY", ""),
 			SecretKey: getEnvOrSecret("MINIO_SECRET_KEY", ""),
 			Bucket:    getEnv("MINIO_BUCKET", "tessera-files"),
 			UseSSL:    getEnvBool("MINIO_USE_SSL", false),
+			LocalPath: getEnv("STORAGE_LOCAL_PATH", "./data/storage"),
+			LocalURL:  getEnv("STORAGE_LOCAL_URL", ""),
 		},
 		JWT: JWTConfig{
 			Secret:        getEnvOrSecret("JWT_SECRET", "change-me-in-production"),
@@ -141,8 +191,26 @@ func Load() (*Config, error) {
 		Encryption: EncryptionConfig{
 			// ENCRYPTION_KEY should be a base64-encoded 32-byte key
 			// Generate with: openssl rand -base64 32
-			MasterKey: getEnvOrSecret("ENCRYPTION_KEY", ""),
+			MasterKey:    getEnvOrSecret("ENCRYPTION_KEY", ""),
+			PreviousKeys: splitList(getEnvOrSecret("ENCRYPTION_PREVIOUS_KEYS", "")),
+			Files:        getEnvBool("ENCRYPT_FILES", false),
+		},
+		SMTP: SMTPConfig{
+			Host:     getEnv("SMTP_HOST", ""),
+			Port:     getEnvInt("SMTP_PORT", 587),
+			Username: getEnv("SMTP_USERNAME", ""),
+			Password: getEnvOrSecret("SMTP_PASSWORD", ""),
+			From:     getEnv("SMTP_FROM", ""),
+			TLS:      getEnvBool("SMTP_TLS", true),
 		},
+		Scan: ScanConfig{
+			ClamdAddress: getEnv("CLAMD_ADDRESS", ""),
+			Timeout:      getEnvDuration("CLAMD_TIMEOUT", time.Minute),
+		},
+	}
+
+	if cfg.Storage.LocalURL == "" {
+		cfg.Storage.LocalURL = fmt.Sprintf("http://localhost:%d", cfg.Server.Port)
 	}
 
 	// In production, refuse to start with missing or placeholder secrets
@@ -171,7 +239,7 @@ func validateProduction(cfg *Config) error {
 	if cfg.Redis.Password == "" {
 		missing = append(missing, "REDIS_PASSWORD")
 	}
-	if cfg.Storage.AccessKey == "" || cfg.Storage.SecretKey == "" {
+	if cfg.Storage.Backend != "local" && (cfg.Storage.AccessKey == "" || cfg.Storage.SecretKey == "") {
 		missing = append(missing, "MINIO_ACCESS_KEY / MINIO_SECRET_KEY")
 	}
 
@@ -195,6 +263,17 @@ func getEnvOrSecret(key, fallback string) string {
 	return getEnv(key, fallback)
 }
 
+// splitList splits a comma-separated list, dropping empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 func getEnv(key, fallback string) string {
 	if value, ok := os.LookupEnv(key); ok {
 		return value
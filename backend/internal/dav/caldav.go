@@ -0,0 +1,411 @@
+package dav
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/tessera/tessera/internal/models"
+	"github.com/tessera/tessera/internal/repository"
+	"github.com/tessera/tessera/internal/services"
+)
+
+// defaultCalendar is the name of the single calendar collection each user has
+const defaultCalendar = "default"
+
+const calendarContentType = "text/calendar; charset=utf-8"
+
+var propCalendarData = xml.Name{Space: nsCalDAV, Local: "calendar-data"}
+
+// eventETag derives an entity tag from the event's modification time, which
+// every write bumps. Microseconds match the precision Postgres stores.
+func eventETag(e *models.CalendarEvent) string {
+	return fmt.Sprintf(`"%x"`, e.UpdatedAt.UnixMicro())
+}
+
+func eventHref(userID uuid.UUID, e *models.CalendarEvent) string {
+	return calendarPath(userID) + url.PathEscape(e.ResourceName)
+}
+
+// calendarResources resolves /calendars/<user>/[default/[<object>]] for PROPFIND
+func (s *Server) calendarResources(c *fiber.Ctx, req *request) ([]*resource, error) {
+	segs := req.segments
+	user := req.user
+
+	switch len(segs) {
+	case 2:
+		resources := []*resource{s.calendarHomeResource(user)}
+		if req.depth != "0" {
+			cal, err := s.calendarResource(c, user)
+			if err != nil {
+				return nil, err
+			}
+			resources = append(resources, cal)
+		}
+		return resources, nil
+
+	case 3:
+		if segs[2] != defaultCalendar {
+			return nil, errNotFound
+		}
+		cal, err := s.calendarResource(c, user)
+		if err != nil {
+			return nil, err
+		}
+		resources := []*resource{cal}
+		if req.depth != "0" {
+			events, err := s.calendarRepo.ListAll(c.Context(), user.ID)
+			if err != nil {
+				return nil, err
+			}
+			for i := range events {
+				resources = append(resources, s.eventResource(user, &events[i]))
+			}
+		}
+		return resources, nil
+
+	case 4:
+		if segs[2] != defaultCalendar {
+			return nil, errNotFound
+		}
+		event, err := s.calendarRepo.GetByResourceName(c.Context(), user.ID, segs[3])
+		if errors.Is(err, repository.ErrEventNotFound) {
+			return nil, errNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []*resource{s.eventResource(user, event)}, nil
+	}
+	return nil, errNotFound
+}
+
+func (s *Server) calendarHomeResource(user *models.User) *resource {
+	r := newResource(calendarHomePath(user.ID))
+	r.set(propResourceType, "<D:collection/>")
+	r.set(propDisplayName, "Calendars")
+	commonProps(r, user)
+	return r
+}
+
+func (s *Server) calendarResource(c *fiber.Ctx, user *models.User) (*resource, error) {
+	token, err := s.davRepo.CurrentToken(c.Context(), user.ID, models.DAVCollectionCalendar)
+	if err != nil {
+		return nil, err
+	}
+
+	r := newResource(calendarPath(user.ID))
+	r.set(propResourceType, "<D:collection/><C:calendar/>")
+	r.set(propDisplayName, "Tessera")
+	r.set(xml.Name{Space: nsCalDAV, Local: "calendar-description"}, "Tessera calendar")
+	r.set(xml.Name{Space: nsCalDAV, Local: "supported-calendar-component-set"}, `<C:comp name="VEVENT"/>`)
+	r.set(xml.Name{Space: nsCalDAV, Local: "supported-calendar-data"}, `<C:calendar-data content-type="text/calendar" version="2.0"/>`)
+	r.set(propSupportedReportSet,
+		"<D:supported-report><D:report><C:calendar-query/></D:report></D:supported-report>"+
+			"<D:supported-report><D:report><C:calendar-multiget/></D:report></D:supported-report>"+
+			"<D:supported-report><D:report><D:sync-collection/></D:report></D:supported-report>")
+	r.set(propSyncToken, formatSyncToken(token))
+	r.set(propGetCTag, formatSyncToken(token))
+	r.set(xml.Name{Space: nsAppleICal, Local: "calendar-color"}, services.DefaultEventColor)
+	commonProps(r, user)
+	return r, nil
+}
+
+func (s *Server) eventResource(user *models.User, event *models.CalendarEvent) *resource {
+	r := newResource(eventHref(user.ID, event))
+	r.set(propResourceType, "")
+	r.set(propGetETag, escapeText(eventETag(event)))
+	r.set(propGetContentType, calendarContentType)
+	r.set(propGetLastModified, event.UpdatedAt.UTC().Format(http.TimeFormat))
+	r.setFunc(propCalendarData, func() (string, error) {
+		var buf bytes.Buffer
+		if err := services.EncodeICalEvent(&buf, event, services.UserLocation(user.Timezone)); err != nil {
+			return "", err
+		}
+		return escapeText(buf.String()), nil
+	})
+	commonProps(r, user)
+	return r
+}
+
+func (s *Server) getEvent(c *fiber.Ctx, req *request, name string) error {
+	event, err := s.calendarRepo.GetByResourceName(c.Context(), req.user.ID, name)
+	if errors.Is(err, repository.ErrEventNotFound) {
+		return c.Status(404).SendString("Not Found")
+	}
+	if err != nil {
+		s.log.Error().Err(err).Msg("Failed to load calendar event")
+		return c.Status(500).SendString("Internal Server Error")
+	}
+
+	var buf bytes.Buffer
+	if err := services.EncodeICalEvent(&buf, event, services.UserLocation(req.user.Timezone)); err != nil {
+		s.log.Error().Err(err).Str("event_id", event.ID.String()).Msg("Failed to encode calendar event")
+		return c.Status(500).SendString("Internal Server Error")
+	}
+
+	c.Set("Content-Type", calendarContentType)
+	c.Set("ETag", eventETag(event))
+	c.Set("Last-Modified", event.UpdatedAt.UTC().Format(http.TimeFormat))
+	if c.Method() == "HEAD" {
+		c.Set("Content-Length", fmt.Sprintf("%d", buf.Len()))
+		return c.SendStatus(200)
+	}
+	return c.Send(buf.Bytes())
+}
+
+func (s *Server) putEvent(c *fiber.Ctx, req *request, name string) error {
+	ctx := c.Context()
+	userID := req.user.ID
+
+	existing, err := s.calendarRepo.GetByResourceName(ctx, userID, name)
+	if err != nil && !errors.Is(err, repository.ErrEventNotFound) {
+		s.log.Error().Err(err).Msg("Failed to load calendar event")
+		return c.Status(500).SendString("Internal Server Error")
+	}
+
+	currentETag := ""
+	if existing != nil {
+		currentETag = eventETag(existing)
+	}
+	if !preconditionsMet(c, currentETag) {
+		return c.SendStatus(412)
+	}
+
+	parsed, err := services.DecodeICalEvent(bytes.NewReader(c.Body()), services.UserLocation(req.user.Timezone))
+	if err != nil {
+		s.log.Debug().Err(err).Str("resource", name).Msg("Rejected calendar object")
+		if errors.Is(err, services.ErrICalNoEvent) {
+			return c.Status(403).Send(davError("<C:supported-calendar-component/>"))
+		}
+		return c.Status(403).Send(davError("<C:valid-calendar-object-resource/>"))
+	}
+	if parsed.UID == "" {
+		return c.Status(403).Send(davError("<C:valid-calendar-object-resource/>"))
+	}
+
+	other, err := s.calendarRepo.GetByUID(ctx, userID, parsed.UID)
+	if err != nil && !errors.Is(err, repository.ErrEventNotFound) {
+		s.log.Error().Err(err).Msg("Failed to look up calendar event UID")
+		return c.Status(500).SendString("Internal Server Error")
+	}
+	if other != nil && (existing == nil || other.ID != existing.ID) {
+		return c.Status(403).Send(davError("<C:no-uid-conflict>" + hrefXML(eventHref(userID, other)) + "</C:no-uid-conflict>"))
+	}
+
+	// Postgres keeps microseconds; truncating keeps the returned ETag stable
+	now := time.Now().UTC().Truncate(time.Microsecond)
+
+	if existing != nil {
+		existing.Title = parsed.Title
+		existing.Description = parsed.Description
+		existing.StartDate = parsed.StartDate
+		existing.EndDate = parsed.EndDate
+		existing.AllDay = parsed.AllDay
+		existing.Recurrence = parsed.Recurrence
+		existing.Reminders = parsed.Reminders
+		// Clients that drop the Tessera X- properties keep the stored values
+		if parsed.Color != "" {
+			existing.Color = parsed.Color
+		}
+		if parsed.LinkedTaskID != nil {
+			existing.LinkedTaskID = parsed.LinkedTaskID
+		}
+		existing.UpdatedAt = now
+
+		if err := s.calendarRepo.SetOverrides(ctx, existing, parsed.Overrides); err != nil {
+			s.log.Error().Err(err).Msg("Failed to save modified occurrences via CalDAV")
+			return c.Status(500).SendString("Internal Server Error")
+		}
+		if err := s.calendarRepo.Update(ctx, existing); err != nil {
+			s.log.Error().Err(err).Msg("Failed to update calendar event via CalDAV")
+			return c.Status(500).SendString("Internal Server Error")
+		}
+		existing.Overrides = parsed.Overrides
+		s.reminders.PlanEventReminders(ctx, existing)
+		c.Set("ETag", eventETag(existing))
+		return c.SendStatus(204)
+	}
+
+	event := parsed
+	event.ID = uuid.New()
+	event.UserID = userID
+	event.ResourceName = name
+	if event.Color == "" {
+		event.Color = services.DefaultEventColor
+	}
+	event.CreatedAt = now
+	event.UpdatedAt = now
+
+	if err := s.calendarRepo.Create(ctx, event); err != nil {
+		s.log.Error().Err(err).Msg("Failed to create calendar event via CalDAV")
+		return c.Status(500).SendString("Internal Server Error")
+	}
+	if len(event.Overrides) > 0 {
+		if err := s.calendarRepo.SetOverrides(ctx, event, event.Overrides); err != nil {
+			s.log.Error().Err(err).Msg("Failed to save modified occurrences via CalDAV")
+			return c.Status(500).SendString("Internal Server Error")
+		}
+	}
+
+	s.log.Info().
+		Str("event_id", event.ID.String()).
+		Str("title", event.Title).
+		Msg("Calendar event created via CalDAV")
+
+	s.reminders.PlanEventReminders(ctx, event)
+
+	c.Set("ETag", eventETag(event))
+	return c.SendStatus(201)
+}
+
+func (s *Server) deleteEvent(c *fiber.Ctx, req *request, name string) error {
+	event, err := s.calendarRepo.GetByResourceName(c.Context(), req.user.ID, name)
+	if errors.Is(err, repository.ErrEventNotFound) {
+		return c.Status(404).SendString("Not Found")
+	}
+	if err != nil {
+		s.log.Error().Err(err).Msg("Failed to load calendar event")
+		return c.Status(500).SendString("Internal Server Error")
+	}
+
+	if !preconditionsMet(c, eventETag(event)) {
+		return c.SendStatus(412)
+	}
+
+	if err := s.calendarRepo.Delete(c.Context(), event.ID, req.user.ID); err != nil {
+		s.log.Error().Err(err).Msg("Failed to delete calendar event via CalDAV")
+		return c.Status(500).SendString("Internal Server Error")
+	}
+	return c.SendStatus(204)
+}
+
+func (s *Server) handleCalendarReport(c *fiber.Ctx, req *request, report *reportBody) error {
+	if len(req.segments) != 3 || req.segments[2] != defaultCalendar {
+		return c.Status(403).Send(davError("<D:supported-report/>"))
+	}
+
+	switch report.XMLName {
+	case xml.Name{Space: nsCalDAV, Local: "calendar-query"}:
+		return s.calendarQuery(c, req, report)
+	case xml.Name{Space: nsCalDAV, Local: "calendar-multiget"}:
+		return s.multiget(c, s.eventCollection(c, req.user), report)
+	case xml.Name{Space: nsDAV, Local: "sync-collection"}:
+		return s.syncCollection(c, req, s.eventCollection(c, req.user), report)
+	default:
+		return c.Status(403).Send(davError("<D:supported-report/>"))
+	}
+}
+
+// eventCollection exposes the user's calendar to the shared report code
+func (s *Server) eventCollection(c *fiber.Ctx, user *models.User) *objectCollection {
+	return &objectCollection{
+		name: models.DAVCollectionCalendar,
+		href: calendarPath(user.ID),
+		all: func() ([]*resource, error) {
+			events, err := s.calendarRepo.ListAll(c.Context(), user.ID)
+			if err != nil {
+				return nil, err
+			}
+			resources := make([]*resource, 0, len(events))
+			for i := range events {
+				resources = append(resources, s.eventResource(user, &events[i]))
+			}
+			return resources, nil
+		},
+		byName: func(names []string) (map[string]*resource, error) {
+			events, err := s.calendarRepo.ListByResourceNames(c.Context(), user.ID, names)
+			if err != nil {
+				return nil, err
+			}
+			resources := make(map[string]*resource, len(events))
+			for i := range events {
+				resources[events[i].ResourceName] = s.eventResource(user, &events[i])
+			}
+			return resources, nil
+		},
+	}
+}
+
+func (s *Server) calendarQuery(c *fiber.Ctx, req *request, report *reportBody) error {
+	events, err := s.calendarRepo.ListAll(c.Context(), req.user.ID)
+	if err != nil {
+		s.log.Error().Err(err).Msg("Failed to list calendar events")
+		return c.Status(500).SendString("Internal Server Error")
+	}
+
+	loc := services.UserLocation(req.user.Timezone)
+	var resources []*resource
+	for i := range events {
+		if report.CalFilter != nil && !matchesCalendarFilter(&report.CalFilter.CompFilter, &events[i], loc) {
+			continue
+		}
+		resources = append(resources, s.eventResource(req.user, &events[i]))
+	}
+	return s.writeMultistatus(c, resources, report.propRequest(), "")
+}
+
+// matchesCalendarFilter evaluates the VCALENDAR/VEVENT comp-filter of a
+// calendar-query. Only component names and time ranges are considered.
+func matchesCalendarFilter(f *compFilter, event *models.CalendarEvent, loc *time.Location) bool {
+	if f.Name != "VCALENDAR" {
+		return false
+	}
+	for i := range f.CompFilters {
+		child := &f.CompFilters[i]
+		if child.Name != "VEVENT" {
+			// Only events are stored, so VTODO/VJOURNAL filters match when negated
+			if child.IsNotDef == nil {
+				return false
+			}
+			continue
+		}
+		if child.IsNotDef != nil {
+			return false
+		}
+		if child.TimeRange != nil && !eventInTimeRange(event, child.TimeRange, loc) {
+			return false
+		}
+	}
+	return true
+}
+
+// eventInTimeRange reports whether an event overlaps a CalDAV time-range.
+// Recurring events match when one of their occurrences does.
+func eventInTimeRange(event *models.CalendarEvent, tr *timeRange, loc *time.Location) bool {
+	if event.Recurrence != nil {
+		from, to := time.Time{}, time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+		if rangeStart, err := time.Parse("20060102T150405Z", tr.Start); err == nil {
+			from = services.InstantToWallClock(rangeStart, loc)
+		}
+		if rangeEnd, err := time.Parse("20060102T150405Z", tr.End); err == nil {
+			// The range end is exclusive
+			to = services.InstantToWallClock(rangeEnd, loc).Add(-time.Second)
+		}
+		return len(services.ExpandEvents([]models.CalendarEvent{*event}, from, to)) > 0
+	}
+
+	start := services.WallClockInstant(event.StartDate, loc)
+	end := services.WallClockInstant(event.EndDate, loc)
+	if event.AllDay {
+		end = end.Add(time.Second)
+	}
+
+	if tr.Start != "" {
+		if rangeStart, err := time.Parse("20060102T150405Z", tr.Start); err == nil && !end.After(rangeStart) {
+			return false
+		}
+	}
+	if tr.End != "" {
+		if rangeEnd, err := time.Parse("20060102T150405Z", tr.End); err == nil && !start.Before(rangeEnd) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,429 @@
+package dav
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-vcard"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/tessera/tessera/internal/models"
+	"github.com/tessera/tessera/internal/repository"
+	"github.com/tessera/tessera/internal/services"
+)
+
+// defaultAddressBook is the name of the single address book each user has
+const defaultAddressBook = "default"
+
+const vcardContentType = "text/vcard; charset=utf-8"
+
+var propAddressData = xml.Name{Space: nsCardDAV, Local: "address-data"}
+
+// contactETag derives an entity tag from the contact's modification time,
+// like eventETag
+func contactETag(c *models.Contact) string {
+	return fmt.Sprintf(`"%x"`, c.UpdatedAt.UnixMicro())
+}
+
+func contactHref(userID uuid.UUID, c *models.Contact) string {
+	return addressBookPath(userID) + url.PathEscape(c.ResourceName)
+}
+
+// addressBookResources resolves /addressbooks/<user>/[default/[<object>]] for PROPFIND
+func (s *Server) addressBookResources(c *fiber.Ctx, req *request) ([]*resource, error) {
+	segs := req.segments
+	user := req.user
+
+	switch len(segs) {
+	case 2:
+		resources := []*resource{s.addressBookHomeResource(user)}
+		if req.depth != "0" {
+			book, err := s.addressBookResource(c, user)
+			if err != nil {
+				return nil, err
+			}
+			resources = append(resources, book)
+		}
+		return resources, nil
+
+	case 3:
+		if segs[2] != defaultAddressBook {
+			return nil, errNotFound
+		}
+		book, err := s.addressBookResource(c, user)
+		if err != nil {
+			return nil, err
+		}
+		resources := []*resource{book}
+		if req.depth != "0" {
+			contacts, err := s.contactRepo.ListByUser(c.Context(), user.ID)
+			if err != nil {
+				return nil, err
+			}
+			for i := range contacts {
+				resources = append(resources, s.contactResource(user, &contacts[i]))
+			}
+		}
+		return resources, nil
+
+	case 4:
+		if segs[2] != defaultAddressBook {
+			return nil, errNotFound
+		}
+		contact, err := s.contactRepo.GetByResourceName(c.Context(), user.ID, segs[3])
+		if errors.Is(err, repository.ErrContactNotFound) {
+			return nil, errNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []*resource{s.contactResource(user, contact)}, nil
+	}
+	return nil, errNotFound
+}
+
+func (s *Server) addressBookHomeResource(user *models.User) *resource {
+	r := newResource(addressBookHomePath(user.ID))
+	r.set(propResourceType, "<D:collection/>")
+	r.set(propDisplayName, "Address Books")
+	commonProps(r, user)
+	return r
+}
+
+func (s *Server) addressBookResource(c *fiber.Ctx, user *models.User) (*resource, error) {
+	token, err := s.davRepo.CurrentToken(c.Context(), user.ID, models.DAVCollectionContacts)
+	if err != nil {
+		return nil, err
+	}
+
+	r := newResource(addressBookPath(user.ID))
+	r.set(propResourceType, "<D:collection/><CR:addressbook/>")
+	r.set(propDisplayName, "Contacts")
+	r.set(xml.Name{Space: nsCardDAV, Local: "addressbook-description"}, "Tessera contacts")
+	r.set(xml.Name{Space: nsCardDAV, Local: "supported-address-data"},
+		`<CR:address-data-type content-type="text/vcard" version="4.0"/>`+
+			`<CR:address-data-type content-type="text/vcard" version="3.0"/>`)
+	r.set(propSupportedReportSet,
+		"<D:supported-report><D:report><CR:addressbook-query/></D:report></D:supported-report>"+
+			"<D:supported-report><D:report><CR:addressbook-multiget/></D:report></D:supported-report>"+
+			"<D:supported-report><D:report><D:sync-collection/></D:report></D:supported-report>")
+	r.set(propSyncToken, formatSyncToken(token))
+	r.set(propGetCTag, formatSyncToken(token))
+	commonProps(r, user)
+	return r, nil
+}
+
+func (s *Server) contactResource(user *models.User, contact *models.Contact) *resource {
+	r := newResource(contactHref(user.ID, contact))
+	r.set(propResourceType, "")
+	r.set(propGetETag, escapeText(contactETag(contact)))
+	r.set(propGetContentType, vcardContentType)
+	r.set(propGetLastModified, contact.UpdatedAt.UTC().Format(http.TimeFormat))
+	r.setFunc(propAddressData, func() (string, error) {
+		var buf bytes.Buffer
+		if err := services.EncodeContactVCard(&buf, contact); err != nil {
+			return "", err
+		}
+		return escapeText(buf.String()), nil
+	})
+	commonProps(r, user)
+	return r
+}
+
+func (s *Server) getContact(c *fiber.Ctx, req *request, name string) error {
+	contact, err := s.contactRepo.GetByResourceName(c.Context(), req.user.ID, name)
+	if errors.Is(err, repository.ErrContactNotFound) {
+		return c.Status(404).SendString("Not Found")
+	}
+	if err != nil {
+		s.log.Error().Err(err).Msg("Failed to load contact")
+		return c.Status(500).SendString("Internal Server Error")
+	}
+
+	var buf bytes.Buffer
+	if err := services.EncodeContactVCard(&buf, contact); err != nil {
+		s.log.Error().Err(err).Str("contact_id", contact.ID.String()).Msg("Failed to encode contact")
+		return c.Status(500).SendString("Internal Server Error")
+	}
+
+	c.Set("Content-Type", vcardContentType)
+	c.Set("ETag", contactETag(contact))
+	c.Set("Last-Modified", contact.UpdatedAt.UTC().Format(http.TimeFormat))
+	if c.Method() == "HEAD" {
+		c.Set("Content-Length", fmt.Sprintf("%d", buf.Len()))
+		return c.SendStatus(200)
+	}
+	return c.Send(buf.Bytes())
+}
+
+func (s *Server) putContact(c *fiber.Ctx, req *request, name string) error {
+	ctx := c.Context()
+	userID := req.user.ID
+
+	existing, err := s.contactRepo.GetByResourceName(ctx, userID, name)
+	if err != nil && !errors.Is(err, repository.ErrContactNotFound) {
+		s.log.Error().Err(err).Msg("Failed to load contact")
+		return c.Status(500).SendString("Internal Server Error")
+	}
+
+	currentETag := ""
+	if existing != nil {
+		currentETag = contactETag(existing)
+	}
+	if !preconditionsMet(c, currentETag) {
+		return c.SendStatus(412)
+	}
+
+	parsed, err := services.DecodeContactVCard(bytes.NewReader(c.Body()))
+	if err != nil || parsed.UID == "" {
+		s.log.Debug().Err(err).Str("resource", name).Msg("Rejected address object")
+		return c.Status(403).Send(davError("<CR:valid-address-data/>"))
+	}
+
+	other, err := s.contactRepo.GetByUID(ctx, userID, parsed.UID)
+	if err != nil && !errors.Is(err, repository.ErrContactNotFound) {
+		s.log.Error().Err(err).Msg("Failed to look up contact UID")
+		return c.Status(500).SendString("Internal Server Error")
+	}
+	if other != nil && (existing == nil || other.ID != existing.ID) {
+		return c.Status(403).Send(davError("<CR:no-uid-conflict>" + hrefXML(contactHref(userID, other)) + "</CR:no-uid-conflict>"))
+	}
+
+	// Postgres keeps microseconds; truncating keeps the returned ETag stable
+	now := time.Now().UTC().Truncate(time.Microsecond)
+
+	if existing != nil {
+		existing.FirstName = parsed.FirstName
+		existing.LastName = parsed.LastName
+		existing.Email = parsed.Email
+		existing.Phone = parsed.Phone
+		existing.Company = parsed.Company
+		existing.JobTitle = parsed.JobTitle
+		existing.Birthday = parsed.Birthday
+		existing.Notes = parsed.Notes
+		existing.Avatar = parsed.Avatar
+		existing.VCard = parsed.VCard
+		// Clients that drop the Tessera X- property keep the stored flag
+		if parsed.Favorite {
+			existing.Favorite = true
+		}
+		existing.UpdatedAt = now
+
+		if err := s.contactRepo.Update(ctx, existing); err != nil {
+			s.log.Error().Err(err).Msg("Failed to update contact via CardDAV")
+			return c.Status(500).SendString("Internal Server Error")
+		}
+		c.Set("ETag", contactETag(existing))
+		return c.SendStatus(204)
+	}
+
+	contact := parsed
+	contact.ID = uuid.New()
+	contact.UserID = userID
+	contact.ResourceName = name
+	contact.CreatedAt = now
+	contact.UpdatedAt = now
+
+	if err := s.contactRepo.Create(ctx, contact); err != nil {
+		s.log.Error().Err(err).Msg("Failed to create contact via CardDAV")
+		return c.Status(500).SendString("Internal Server Error")
+	}
+
+	s.log.Info().
+		Str("contact_id", contact.ID.String()).
+		Msg("Contact created via CardDAV")
+
+	c.Set("ETag", contactETag(contact))
+	return c.SendStatus(201)
+}
+
+func (s *Server) deleteContact(c *fiber.Ctx, req *request, name string) error {
+	contact, err := s.contactRepo.GetByResourceName(c.Context(), req.user.ID, name)
+	if errors.Is(err, repository.ErrContactNotFound) {
+		return c.Status(404).SendString("Not Found")
+	}
+	if err != nil {
+		s.log.Error().Err(err).Msg("Failed to load contact")
+		return c.Status(500).SendString("Internal Server Error")
+	}
+
+	if !preconditionsMet(c, contactETag(contact)) {
+		return c.SendStatus(412)
+	}
+
+	if err := s.contactRepo.Delete(c.Context(), contact.ID, req.user.ID); err != nil {
+		s.log.Error().Err(err).Msg("Failed to delete contact via CardDAV")
+		return c.Status(500).SendString("Internal Server Error")
+	}
+	return c.SendStatus(204)
+}
+
+func (s *Server) handleAddressBookReport(c *fiber.Ctx, req *request, report *reportBody) error {
+	if len(req.segments) != 3 || req.segments[2] != defaultAddressBook {
+		return c.Status(403).Send(davError("<D:supported-report/>"))
+	}
+
+	switch report.XMLName {
+	case xml.Name{Space: nsCardDAV, Local: "addressbook-query"}:
+		return s.addressBookQuery(c, req, report)
+	case xml.Name{Space: nsCardDAV, Local: "addressbook-multiget"}:
+		return s.multiget(c, s.contactCollection(c, req.user), report)
+	case xml.Name{Space: nsDAV, Local: "sync-collection"}:
+		return s.syncCollection(c, req, s.contactCollection(c, req.user), report)
+	default:
+		return c.Status(403).Send(davError("<D:supported-report/>"))
+	}
+}
+
+// contactCollection exposes the user's address book to the shared report code
+func (s *Server) contactCollection(c *fiber.Ctx, user *models.User) *objectCollection {
+	return &objectCollection{
+		name: models.DAVCollectionContacts,
+		href: addressBookPath(user.ID),
+		all: func() ([]*resource, error) {
+			contacts, err := s.contactRepo.ListByUser(c.Context(), user.ID)
+			if err != nil {
+				return nil, err
+			}
+			resources := make([]*resource, 0, len(contacts))
+			for i := range contacts {
+				resources = append(resources, s.contactResource(user, &contacts[i]))
+			}
+			return resources, nil
+		},
+		byName: func(names []string) (map[string]*resource, error) {
+			contacts, err := s.contactRepo.ListByResourceNames(c.Context(), user.ID, names)
+			if err != nil {
+				return nil, err
+			}
+			resources := make(map[string]*resource, len(contacts))
+			for i := range contacts {
+				resources[contacts[i].ResourceName] = s.contactResource(user, &contacts[i])
+			}
+			return resources, nil
+		},
+	}
+}
+
+func (s *Server) addressBookQuery(c *fiber.Ctx, req *request, report *reportBody) error {
+	contacts, err := s.contactRepo.ListByUser(c.Context(), req.user.ID)
+	if err != nil {
+		s.log.Error().Err(err).Msg("Failed to list contacts")
+		return c.Status(500).SendString("Internal Server Error")
+	}
+
+	limit := 0
+	if report.CardLimit != nil && report.CardLimit.NResults > 0 {
+		limit = report.CardLimit.NResults
+	}
+
+	var resources []*resource
+	truncated := false
+	for i := range contacts {
+		if report.CardFilter != nil && !matchesAddressBookFilter(report.CardFilter, services.ContactToVCard(&contacts[i])) {
+			continue
+		}
+		if limit > 0 && len(resources) == limit {
+			truncated = true
+			break
+		}
+		resources = append(resources, s.contactResource(req.user, &contacts[i]))
+	}
+
+	ms, err := renderResources(resources, report.propRequest())
+	if err != nil {
+		s.log.Error().Err(err).Msg("Failed to render DAV properties")
+		return c.Status(500).SendString("Internal Server Error")
+	}
+	if truncated {
+		// RFC 6352 section 8.6.1: signal that the result set was limited
+		ms.Responses = append(ms.Responses, response{
+			Href:   addressBookPath(req.user.ID),
+			Status: statusLine(507),
+		})
+	}
+	return sendMultistatus(c, ms)
+}
+
+// matchesAddressBookFilter evaluates an addressbook-query filter against a
+// card. Property filters are combined per the test attribute (anyof by default).
+func matchesAddressBookFilter(f *addressBookFilter, card vcard.Card) bool {
+	if len(f.PropFilters) == 0 {
+		return true
+	}
+	allOf := f.Test == "allof"
+	for i := range f.PropFilters {
+		matched := matchesPropFilter(&f.PropFilters[i], card)
+		if allOf && !matched {
+			return false
+		}
+		if !allOf && matched {
+			return true
+		}
+	}
+	return allOf
+}
+
+func matchesPropFilter(f *propFilter, card vcard.Card) bool {
+	fields := card[strings.ToUpper(f.Name)]
+	if f.IsNotDef != nil {
+		return len(fields) == 0
+	}
+	if len(fields) == 0 {
+		return false
+	}
+	if len(f.TextMatches) == 0 {
+		return true
+	}
+
+	allOf := f.Test == "allof"
+	for i := range f.TextMatches {
+		matched := false
+		for _, field := range fields {
+			if textMatches(&f.TextMatches[i], field.Value) {
+				matched = true
+				break
+			}
+		}
+		if allOf && !matched {
+			return false
+		}
+		if !allOf && matched {
+			return true
+		}
+	}
+	return allOf
+}
+
+// textMatches applies a CardDAV text-match. i;unicode-casemap (the default)
+// compares case-insensitively; i;octet compares bytes.
+func textMatches(m *textMatch, value string) bool {
+	needle := strings.TrimSpace(m.Value)
+	if m.Collation != "i;octet" {
+		needle = strings.ToLower(needle)
+		value = strings.ToLower(value)
+	}
+
+	var matched bool
+	switch m.MatchType {
+	case "equals":
+		matched = value == needle
+	case "starts-with":
+		matched = strings.HasPrefix(value, needle)
+	case "ends-with":
+		matched = strings.HasSuffix(value, needle)
+	default:
+		matched = strings.Contains(value, needle)
+	}
+
+	if m.Negate == "yes" {
+		return !matched
+	}
+	return matched
+}
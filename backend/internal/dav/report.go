@@ -0,0 +1,145 @@
+package dav
+
+import (
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// objectCollection adapts a calendar or address book to the reports both
+// protocols share (multiget and sync-collection).
+type objectCollection struct {
+	// name is the change journal collection (models.DAVCollection*)
+	name string
+	// href is the collection path, with a trailing slash
+	href   string
+	all    func() ([]*resource, error)
+	byName func(names []string) (map[string]*resource, error)
+}
+
+// multiget answers calendar-multiget and addressbook-multiget; hrefs that do
+// not resolve to an object are reported as 404.
+func (s *Server) multiget(c *fiber.Ctx, col *objectCollection, report *reportBody) error {
+	names := make([]string, 0, len(report.Hrefs))
+	for _, href := range report.Hrefs {
+		if name, ok := hrefResourceName(href, col.href); ok {
+			names = append(names, name)
+		}
+	}
+
+	byName, err := col.byName(names)
+	if err != nil {
+		s.log.Error().Err(err).Str("collection", col.name).Msg("Failed to load DAV objects")
+		return c.Status(500).SendString("Internal Server Error")
+	}
+
+	ms := &multistatus{}
+	propReq := report.propRequest()
+	for _, href := range report.Hrefs {
+		name, _ := hrefResourceName(href, col.href)
+		r, ok := byName[name]
+		if !ok {
+			ms.Responses = append(ms.Responses, response{Href: href, Status: statusLine(404)})
+			continue
+		}
+		resp, err := r.response(propReq)
+		if err != nil {
+			s.log.Error().Err(err).Str("href", r.href).Msg("Failed to render DAV properties")
+			return c.Status(500).SendString("Internal Server Error")
+		}
+		ms.Responses = append(ms.Responses, resp)
+	}
+	return sendMultistatus(c, ms)
+}
+
+// syncCollection answers a sync-collection report (RFC 6578). An empty token
+// returns every object; otherwise only resources changed since the token.
+func (s *Server) syncCollection(c *fiber.Ctx, req *request, col *objectCollection, report *reportBody) error {
+	ctx := c.Context()
+	userID := req.user.ID
+
+	// Read the current token first so changes made during the report are resent next time
+	current, err := s.davRepo.CurrentToken(ctx, userID, col.name)
+	if err != nil {
+		s.log.Error().Err(err).Str("collection", col.name).Msg("Failed to read sync token")
+		return c.Status(500).SendString("Internal Server Error")
+	}
+
+	propReq := report.propRequest()
+	if report.SyncToken == "" {
+		resources, err := col.all()
+		if err != nil {
+			s.log.Error().Err(err).Str("collection", col.name).Msg("Failed to list DAV objects")
+			return c.Status(500).SendString("Internal Server Error")
+		}
+		return s.writeMultistatus(c, resources, propReq, formatSyncToken(current))
+	}
+
+	since, ok := parseSyncToken(report.SyncToken)
+	if !ok || since > current {
+		return c.Status(403).Send(davError("<D:valid-sync-token/>"))
+	}
+
+	changes, err := s.davRepo.ChangesSince(ctx, userID, col.name, since)
+	if err != nil {
+		s.log.Error().Err(err).Str("collection", col.name).Msg("Failed to read DAV changes")
+		return c.Status(500).SendString("Internal Server Error")
+	}
+
+	var names []string
+	for _, ch := range changes {
+		if !ch.Deleted {
+			names = append(names, ch.ResourceName)
+		}
+	}
+	byName, err := col.byName(names)
+	if err != nil {
+		s.log.Error().Err(err).Str("collection", col.name).Msg("Failed to load DAV objects")
+		return c.Status(500).SendString("Internal Server Error")
+	}
+
+	ms := &multistatus{SyncToken: formatSyncToken(current)}
+	for _, ch := range changes {
+		r, ok := byName[ch.ResourceName]
+		if ch.Deleted || !ok {
+			ms.Responses = append(ms.Responses, response{
+				Href:   col.href + url.PathEscape(ch.ResourceName),
+				Status: statusLine(404),
+			})
+			continue
+		}
+		resp, err := r.response(propReq)
+		if err != nil {
+			s.log.Error().Err(err).Str("href", r.href).Msg("Failed to render DAV properties")
+			return c.Status(500).SendString("Internal Server Error")
+		}
+		ms.Responses = append(ms.Responses, resp)
+	}
+	return sendMultistatus(c, ms)
+}
+
+// preconditionsMet evaluates If-Match and If-None-Match against the current
+// entity tag of an object; an empty tag means the object does not exist.
+func preconditionsMet(c *fiber.Ctx, current string) bool {
+	if header := c.Get("If-Match"); header != "" && !etagListMatches(header, current) {
+		return false
+	}
+	if header := c.Get("If-None-Match"); header != "" && etagListMatches(header, current) {
+		return false
+	}
+	return true
+}
+
+func etagListMatches(header, current string) bool {
+	if current == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == current {
+			return true
+		}
+	}
+	return false
+}
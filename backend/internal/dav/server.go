@@ -0,0 +1,443 @@
+// Package dav implements the CalDAV and CardDAV endpoints used by native
+// calendar and contacts clients.
+package dav
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/tessera/tessera/internal/models"
+	"github.com/tessera/tessera/internal/repository"
+	"github.com/tessera/tessera/internal/services"
+)
+
+// Prefix is the URL path the DAV server is mounted under
+const Prefix = "/dav"
+
+// syncTokenPrefix namespaces the change journal IDs handed out as sync tokens
+const syncTokenPrefix = "urn:tessera:sync:"
+
+// Server handles CalDAV and CardDAV requests
+type Server struct {
+	authService  *services.AuthService
+	calendarRepo *repository.CalendarRepository
+	contactRepo  *repository.ContactRepository
+	davRepo      *repository.DAVRepository
+	reminders    services.ReminderPlanner
+	log          zerolog.Logger
+}
+
+// NewServer creates a new DAV server
+func NewServer(authService *services.AuthService, calendarRepo *repository.CalendarRepository, contactRepo *repository.ContactRepository, davRepo *repository.DAVRepository, reminders services.ReminderPlanner, log zerolog.Logger) *Server {
+	return &Server{
+		authService:  authService,
+		calendarRepo: calendarRepo,
+		contactRepo:  contactRepo,
+		davRepo:      davRepo,
+		reminders:    reminders,
+		log:          log,
+	}
+}
+
+// request carries the authenticated user and the path split into segments
+type request struct {
+	user     *models.User
+	segments []string
+	depth    string
+}
+
+// Handler returns a Fiber handler for DAV requests
+func (s *Server) Handler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		method := c.Method()
+
+		// OPTIONS is answered without credentials so clients can discover capabilities
+		if method == "OPTIONS" {
+			return s.handleOptions(c)
+		}
+
+		user, err := s.authenticate(c)
+		if err != nil {
+			c.Set("WWW-Authenticate", `Basic realm="Tessera DAV"`)
+			return c.Status(401).SendString("Unauthorized")
+		}
+
+		urlPath := strings.TrimPrefix(c.Path(), Prefix)
+		var segments []string
+		for _, seg := range strings.Split(urlPath, "/") {
+			if seg != "" {
+				segments = append(segments, seg)
+			}
+		}
+
+		// Every collection below the root is scoped to a user ID, which must be the caller
+		if len(segments) >= 2 && segments[1] != user.ID.String() {
+			return c.Status(403).SendString("Forbidden")
+		}
+
+		req := &request{user: user, segments: segments, depth: c.Get("Depth", "1")}
+
+		s.log.Debug().Str("method", method).Str("path", urlPath).Str("user", user.ID.String()).Msg("DAV request")
+
+		switch method {
+		case "PROPFIND":
+			return s.handlePropfind(c, req)
+		case "PROPPATCH":
+			return s.handleProppatch(c, req)
+		case "REPORT":
+			return s.handleReport(c, req)
+		case "GET", "HEAD", "PUT", "DELETE":
+			return s.handleObject(c, req)
+		default:
+			return c.Status(405).SendString("Method Not Allowed")
+		}
+	}
+}
+
+// WellKnownHandler redirects /.well-known/caldav and /.well-known/carddav to
+// the DAV root (RFC 6764)
+func (s *Server) WellKnownHandler() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		return c.Redirect(Prefix+"/", fiber.StatusMovedPermanently)
+	}
+}
+
+func (s *Server) authenticate(c *fiber.Ctx) (*models.User, error) {
+	auth := c.Get("Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return nil, fmt.Errorf("not basic auth")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+	if err != nil {
+		return nil, err
+	}
+
+	email, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid credentials format")
+	}
+
+	return s.authService.VerifyCredentials(c.Context(), email, password)
+}
+
+func (s *Server) handleOptions(c *fiber.Ctx) error {
+	c.Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, PROPPATCH, REPORT")
+	c.Set("DAV", "1, 3, calendar-access, addressbook")
+	return c.SendStatus(200)
+}
+
+// Paths of the fixed resources in the DAV tree
+
+func principalPath(userID uuid.UUID) string {
+	return fmt.Sprintf("%s/principals/%s/", Prefix, userID)
+}
+
+func calendarHomePath(userID uuid.UUID) string {
+	return fmt.Sprintf("%s/calendars/%s/", Prefix, userID)
+}
+
+func calendarPath(userID uuid.UUID) string {
+	return calendarHomePath(userID) + defaultCalendar + "/"
+}
+
+func addressBookHomePath(userID uuid.UUID) string {
+	return fmt.Sprintf("%s/addressbooks/%s/", Prefix, userID)
+}
+
+func addressBookPath(userID uuid.UUID) string {
+	return addressBookHomePath(userID) + defaultAddressBook + "/"
+}
+
+// resource is a node in the DAV tree with lazily rendered properties
+type resource struct {
+	href  string
+	names []xml.Name
+	props map[xml.Name]func() (string, error)
+}
+
+func newResource(href string) *resource {
+	return &resource{href: href, props: map[xml.Name]func() (string, error){}}
+}
+
+// set adds a property with a fixed value
+func (r *resource) set(name xml.Name, inner string) {
+	r.setFunc(name, func() (string, error) { return inner, nil })
+}
+
+// setFunc adds a property whose value is only rendered when requested
+func (r *resource) setFunc(name xml.Name, fn func() (string, error)) {
+	if _, ok := r.props[name]; !ok {
+		r.names = append(r.names, name)
+	}
+	r.props[name] = fn
+}
+
+// response renders the requested properties of a resource
+func (r *resource) response(req *propRequest) (response, error) {
+	resp := response{Href: r.href}
+
+	if req.PropName {
+		props := make([]rawProp, 0, len(r.names))
+		for _, name := range r.names {
+			props = append(props, newRawProp(name, ""))
+		}
+		resp.Propstats = []propstat{{Props: props, Status: statusLine(200)}}
+		return resp, nil
+	}
+
+	names := req.Names
+	if req.AllProp {
+		names = r.names
+	}
+
+	var found, missing []rawProp
+	for _, name := range names {
+		fn, ok := r.props[name]
+		if !ok {
+			missing = append(missing, newRawProp(name, ""))
+			continue
+		}
+		inner, err := fn()
+		if err != nil {
+			return resp, err
+		}
+		found = append(found, newRawProp(name, inner))
+	}
+
+	if len(found) > 0 {
+		resp.Propstats = append(resp.Propstats, propstat{Props: found, Status: statusLine(200)})
+	}
+	if len(missing) > 0 {
+		resp.Propstats = append(resp.Propstats, propstat{Props: missing, Status: statusLine(404)})
+	}
+	return resp, nil
+}
+
+// commonProps adds the properties every resource owned by the user exposes
+func commonProps(r *resource, user *models.User) {
+	principal := hrefXML(principalPath(user.ID))
+	r.set(propCurrentUserPrincipal, principal)
+	r.set(propOwner, principal)
+	r.set(propCurrentUserPrivilegeSet,
+		"<D:privilege><D:read/></D:privilege>"+
+			"<D:privilege><D:write/></D:privilege>"+
+			"<D:privilege><D:write-content/></D:privilege>"+
+			"<D:privilege><D:bind/></D:privilege>"+
+			"<D:privilege><D:unbind/></D:privilege>"+
+			"<D:privilege><D:read-current-user-privilege-set/></D:privilege>")
+}
+
+func (s *Server) rootResource(user *models.User) *resource {
+	r := newResource(Prefix + "/")
+	r.set(propResourceType, "<D:collection/>")
+	r.set(propDisplayName, "Tessera")
+	r.set(propCurrentUserPrincipal, hrefXML(principalPath(user.ID)))
+	return r
+}
+
+func (s *Server) principalResource(user *models.User) *resource {
+	r := newResource(principalPath(user.ID))
+	r.set(propResourceType, "<D:principal/>")
+	r.set(propDisplayName, escapeText(user.Name))
+	r.set(propPrincipalURL, hrefXML(principalPath(user.ID)))
+	r.set(propCurrentUserPrincipal, hrefXML(principalPath(user.ID)))
+	r.set(xml.Name{Space: nsCalDAV, Local: "calendar-home-set"}, hrefXML(calendarHomePath(user.ID)))
+	r.set(xml.Name{Space: nsCalDAV, Local: "calendar-user-address-set"}, hrefXML("mailto:"+user.Email))
+	r.set(xml.Name{Space: nsCardDAV, Local: "addressbook-home-set"}, hrefXML(addressBookHomePath(user.ID)))
+	return r
+}
+
+// resourcesFor resolves a request path to the resources a PROPFIND reports on
+func (s *Server) resourcesFor(c *fiber.Ctx, req *request) ([]*resource, error) {
+	segs := req.segments
+	if len(segs) == 0 {
+		return []*resource{s.rootResource(req.user)}, nil
+	}
+
+	switch segs[0] {
+	case "principals":
+		if len(segs) == 2 {
+			return []*resource{s.principalResource(req.user)}, nil
+		}
+	case "calendars":
+		return s.calendarResources(c, req)
+	case "addressbooks":
+		return s.addressBookResources(c, req)
+	}
+	return nil, errNotFound
+}
+
+// handleObject routes GET, HEAD, PUT and DELETE on calendar and address book
+// objects; collections cannot be read or written directly.
+func (s *Server) handleObject(c *fiber.Ctx, req *request) error {
+	segs := req.segments
+	if len(segs) != 4 || len(segs[3]) > 255 {
+		if c.Method() == "DELETE" {
+			return c.Status(403).SendString("Forbidden")
+		}
+		return c.Status(405).SendString("Method Not Allowed")
+	}
+	name := segs[3]
+
+	switch {
+	case segs[0] == "calendars" && segs[2] == defaultCalendar:
+		switch c.Method() {
+		case "PUT":
+			return s.putEvent(c, req, name)
+		case "DELETE":
+			return s.deleteEvent(c, req, name)
+		default:
+			return s.getEvent(c, req, name)
+		}
+	case segs[0] == "addressbooks" && segs[2] == defaultAddressBook:
+		switch c.Method() {
+		case "PUT":
+			return s.putContact(c, req, name)
+		case "DELETE":
+			return s.deleteContact(c, req, name)
+		default:
+			return s.getContact(c, req, name)
+		}
+	}
+	return c.Status(404).SendString("Not Found")
+}
+
+var errNotFound = errors.New("resource not found")
+
+func (s *Server) handlePropfind(c *fiber.Ctx, req *request) error {
+	propReq, err := parsePropfind(c.Body())
+	if err != nil {
+		return c.Status(400).SendString("Invalid PROPFIND body")
+	}
+
+	resources, err := s.resourcesFor(c, req)
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			return c.Status(404).SendString("Not Found")
+		}
+		s.log.Error().Err(err).Msg("DAV PROPFIND failed")
+		return c.Status(500).SendString("Internal Server Error")
+	}
+
+	return s.writeMultistatus(c, resources, propReq, "")
+}
+
+// handleProppatch rejects property changes; the collections are server-managed
+func (s *Server) handleProppatch(c *fiber.Ctx, req *request) error {
+	var body struct {
+		Set []struct {
+			Prop propNames `xml:"DAV: prop"`
+		} `xml:"DAV: set"`
+		Remove []struct {
+			Prop propNames `xml:"DAV: prop"`
+		} `xml:"DAV: remove"`
+	}
+	if err := xml.Unmarshal(c.Body(), &body); err != nil {
+		return c.Status(400).SendString("Invalid PROPPATCH body")
+	}
+
+	var props []rawProp
+	for _, set := range body.Set {
+		for _, name := range set.Prop.list() {
+			props = append(props, newRawProp(name, ""))
+		}
+	}
+	for _, remove := range body.Remove {
+		for _, name := range remove.Prop.list() {
+			props = append(props, newRawProp(name, ""))
+		}
+	}
+
+	ms := &multistatus{Responses: []response{{
+		Href:      c.Path(),
+		Propstats: []propstat{{Props: props, Status: statusLine(403)}},
+	}}}
+	return sendMultistatus(c, ms)
+}
+
+func (s *Server) handleReport(c *fiber.Ctx, req *request) error {
+	report, err := parseReport(c.Body())
+	if err != nil {
+		return c.Status(400).SendString("Invalid REPORT body")
+	}
+
+	if len(req.segments) >= 1 {
+		switch req.segments[0] {
+		case "calendars":
+			return s.handleCalendarReport(c, req, report)
+		case "addressbooks":
+			return s.handleAddressBookReport(c, req, report)
+		}
+	}
+	return c.Status(403).Send(davError("<D:supported-report/>"))
+}
+
+func (s *Server) writeMultistatus(c *fiber.Ctx, resources []*resource, propReq *propRequest, syncToken string) error {
+	ms, err := renderResources(resources, propReq)
+	if err != nil {
+		s.log.Error().Err(err).Msg("Failed to render DAV properties")
+		return c.Status(500).SendString("Internal Server Error")
+	}
+	ms.SyncToken = syncToken
+	return sendMultistatus(c, ms)
+}
+
+func renderResources(resources []*resource, propReq *propRequest) (*multistatus, error) {
+	ms := &multistatus{}
+	for _, r := range resources {
+		resp, err := r.response(propReq)
+		if err != nil {
+			return nil, fmt.Errorf("render %s: %w", r.href, err)
+		}
+		ms.Responses = append(ms.Responses, resp)
+	}
+	return ms, nil
+}
+
+func sendMultistatus(c *fiber.Ctx, ms *multistatus) error {
+	xmlData, err := xml.Marshal(ms)
+	if err != nil {
+		return c.Status(500).SendString(err.Error())
+	}
+	c.Set("Content-Type", "application/xml; charset=utf-8")
+	return c.Status(207).Send(append([]byte(xml.Header), xmlData...))
+}
+
+// hrefResourceName extracts the object name from an href inside collection,
+// accepting absolute URLs and percent-encoded paths.
+func hrefResourceName(href, collection string) (string, bool) {
+	if u, err := url.Parse(href); err == nil {
+		href = u.Path
+	}
+	if !strings.HasPrefix(href, collection) {
+		return "", false
+	}
+	name := strings.TrimPrefix(href, collection)
+	if name == "" || strings.Contains(name, "/") {
+		return "", false
+	}
+	return name, true
+}
+
+func parseSyncToken(token string) (int64, bool) {
+	var id int64
+	if !strings.HasPrefix(token, syncTokenPrefix) {
+		return 0, false
+	}
+	if _, err := fmt.Sscanf(strings.TrimPrefix(token, syncTokenPrefix), "%d", &id); err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+func formatSyncToken(id int64) string {
+	return fmt.Sprintf("%s%d", syncTokenPrefix, id)
+}
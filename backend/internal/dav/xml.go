@@ -0,0 +1,254 @@
+package dav
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// XML namespaces used by the DAV endpoints
+const (
+	nsDAV       = "DAV:"
+	nsCalDAV    = "urn:ietf:params:xml:ns:caldav"
+	nsCardDAV   = "urn:ietf:params:xml:ns:carddav"
+	nsCalServer = "http://calendarserver.org/ns/"
+	nsAppleICal = "http://apple.com/ns/ical/"
+)
+
+// nsPrefixes are declared on every multistatus so property values can use them
+var nsPrefixes = []struct{ prefix, space string }{
+	{"D", nsDAV},
+	{"C", nsCalDAV},
+	{"CR", nsCardDAV},
+	{"CS", nsCalServer},
+	{"A", nsAppleICal},
+}
+
+func prefixFor(space string) string {
+	for _, ns := range nsPrefixes {
+		if ns.space == space {
+			return ns.prefix
+		}
+	}
+	return ""
+}
+
+// Frequently used property names
+var (
+	propResourceType            = xml.Name{Space: nsDAV, Local: "resourcetype"}
+	propDisplayName             = xml.Name{Space: nsDAV, Local: "displayname"}
+	propGetETag                 = xml.Name{Space: nsDAV, Local: "getetag"}
+	propGetContentType          = xml.Name{Space: nsDAV, Local: "getcontenttype"}
+	propGetLastModified         = xml.Name{Space: nsDAV, Local: "getlastmodified"}
+	propCurrentUserPrincipal    = xml.Name{Space: nsDAV, Local: "current-user-principal"}
+	propPrincipalURL            = xml.Name{Space: nsDAV, Local: "principal-URL"}
+	propOwner                   = xml.Name{Space: nsDAV, Local: "owner"}
+	propSupportedReportSet      = xml.Name{Space: nsDAV, Local: "supported-report-set"}
+	propSyncToken               = xml.Name{Space: nsDAV, Local: "sync-token"}
+	propCurrentUserPrivilegeSet = xml.Name{Space: nsDAV, Local: "current-user-privilege-set"}
+	propGetCTag                 = xml.Name{Space: nsCalServer, Local: "getctag"}
+)
+
+// multistatus is a 207 Multi-Status response body
+type multistatus struct {
+	Responses []response
+	SyncToken string
+}
+
+func (m *multistatus) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Name = xml.Name{Local: "D:multistatus"}
+	start.Attr = nil
+	for _, ns := range nsPrefixes {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "xmlns:" + ns.prefix}, Value: ns.space})
+	}
+	return e.EncodeElement(struct {
+		Responses []response `xml:"D:response"`
+		SyncToken string     `xml:"D:sync-token,omitempty"`
+	}{m.Responses, m.SyncToken}, start)
+}
+
+type response struct {
+	Href      string     `xml:"D:href"`
+	Propstats []propstat `xml:"D:propstat,omitempty"`
+	Status    string     `xml:"D:status,omitempty"`
+}
+
+type propstat struct {
+	Props  []rawProp `xml:"D:prop>any"`
+	Status string    `xml:"D:status"`
+}
+
+// rawProp is a property element whose value is pre-rendered XML
+type rawProp struct {
+	XMLName xml.Name
+	Inner   string `xml:",innerxml"`
+}
+
+func newRawProp(name xml.Name, inner string) rawProp {
+	if prefix := prefixFor(name.Space); prefix != "" {
+		return rawProp{XMLName: xml.Name{Local: prefix + ":" + name.Local}, Inner: inner}
+	}
+	return rawProp{XMLName: name, Inner: inner}
+}
+
+func statusLine(code int) string {
+	switch code {
+	case 200:
+		return "HTTP/1.1 200 OK"
+	case 403:
+		return "HTTP/1.1 403 Forbidden"
+	case 404:
+		return "HTTP/1.1 404 Not Found"
+	default:
+		return fmt.Sprintf("HTTP/1.1 %d", code)
+	}
+}
+
+// escapeText escapes a string for use as XML character data
+func escapeText(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+func hrefXML(href string) string {
+	return "<D:href>" + escapeText(href) + "</D:href>"
+}
+
+// davError renders a DAV:error body for a failed precondition
+func davError(condition string) []byte {
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString("<D:error")
+	for _, ns := range nsPrefixes {
+		fmt.Fprintf(&b, ` xmlns:%s="%s"`, ns.prefix, ns.space)
+	}
+	b.WriteString(">")
+	b.WriteString(condition)
+	b.WriteString("</D:error>")
+	return []byte(b.String())
+}
+
+// propNames lists the properties named in a DAV:prop request element
+type propNames struct {
+	Names []struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+func (p *propNames) list() []xml.Name {
+	names := make([]xml.Name, 0, len(p.Names))
+	for _, n := range p.Names {
+		names = append(names, n.XMLName)
+	}
+	return names
+}
+
+// propRequest describes which properties a PROPFIND or REPORT asks for
+type propRequest struct {
+	AllProp  bool
+	PropName bool
+	Names    []xml.Name
+}
+
+type propfindBody struct {
+	XMLName  xml.Name   `xml:"DAV: propfind"`
+	AllProp  *struct{}  `xml:"DAV: allprop"`
+	PropName *struct{}  `xml:"DAV: propname"`
+	Prop     *propNames `xml:"DAV: prop"`
+}
+
+// parsePropfind reads a PROPFIND body; an empty body means allprop
+func parsePropfind(body []byte) (*propRequest, error) {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return &propRequest{AllProp: true}, nil
+	}
+	var pf propfindBody
+	if err := xml.Unmarshal(body, &pf); err != nil {
+		return nil, err
+	}
+	switch {
+	case pf.PropName != nil:
+		return &propRequest{PropName: true}, nil
+	case pf.Prop != nil:
+		return &propRequest{Names: pf.Prop.list()}, nil
+	default:
+		return &propRequest{AllProp: true}, nil
+	}
+}
+
+type timeRange struct {
+	Start string `xml:"start,attr"`
+	End   string `xml:"end,attr"`
+}
+
+type compFilter struct {
+	Name        string       `xml:"name,attr"`
+	IsNotDef    *struct{}    `xml:"urn:ietf:params:xml:ns:caldav is-not-defined"`
+	TimeRange   *timeRange   `xml:"urn:ietf:params:xml:ns:caldav time-range"`
+	CompFilters []compFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+}
+
+type calendarFilter struct {
+	CompFilter compFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+}
+
+// reportBody covers the REPORT request bodies the server understands; the
+// root element name selects the report.
+type reportBody struct {
+	XMLName    xml.Name
+	AllProp    *struct{}          `xml:"DAV: allprop"`
+	PropName   *struct{}          `xml:"DAV: propname"`
+	Prop       *propNames         `xml:"DAV: prop"`
+	Hrefs      []string           `xml:"DAV: href"`
+	SyncToken  string             `xml:"DAV: sync-token"`
+	SyncLevel  string             `xml:"DAV: sync-level"`
+	CalFilter  *calendarFilter    `xml:"urn:ietf:params:xml:ns:caldav filter"`
+	CardFilter *addressBookFilter `xml:"urn:ietf:params:xml:ns:carddav filter"`
+	CardLimit  *queryLimit        `xml:"urn:ietf:params:xml:ns:carddav limit"`
+}
+
+func (r *reportBody) propRequest() *propRequest {
+	switch {
+	case r.PropName != nil:
+		return &propRequest{PropName: true}
+	case r.Prop != nil:
+		return &propRequest{Names: r.Prop.list()}
+	default:
+		return &propRequest{AllProp: true}
+	}
+}
+
+func parseReport(body []byte) (*reportBody, error) {
+	var r reportBody
+	if err := xml.Unmarshal(body, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// CardDAV addressbook-query filters (RFC 6352 section 10.5)
+
+type textMatch struct {
+	Value     string `xml:",chardata"`
+	Collation string `xml:"collation,attr"`
+	Negate    string `xml:"negate-condition,attr"`
+	MatchType string `xml:"match-type,attr"`
+}
+
+type propFilter struct {
+	Name        string      `xml:"name,attr"`
+	Test        string      `xml:"test,attr"`
+	IsNotDef    *struct{}   `xml:"urn:ietf:params:xml:ns:carddav is-not-defined"`
+	TextMatches []textMatch `xml:"urn:ietf:params:xml:ns:carddav text-match"`
+}
+
+type addressBookFilter struct {
+	Test        string       `xml:"test,attr"`
+	PropFilters []propFilter `xml:"urn:ietf:params:xml:ns:carddav prop-filter"`
+}
+
+type queryLimit struct {
+	NResults int `xml:"urn:ietf:params:xml:ns:carddav nresults"`
+}
@@ -16,6 +16,7 @@ import (
 	"github.com/tessera/tessera/internal/middleware"
 	"github.com/tessera/tessera/internal/models"
 	"github.com/tessera/tessera/internal/repository"
+	"github.com/tessera/tessera/internal/services"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -26,6 +27,7 @@ type AdminHandler struct {
 	fileRepo     *repository.FileRepository
 	activityRepo *repository.ActivityRepository
 	settingsRepo *repository.SettingsRepository
+	retention    *services.RetentionService
 	cfg          *config.Config
 	log          zerolog.Logger
 }
@@ -37,6 +39,7 @@ func NewAdminHandler(
 	fileRepo *repository.FileRepository,
 	activityRepo *repository.ActivityRepository,
 	settingsRepo *repository.SettingsRepository,
+	retention *services.RetentionService,
 	cfg *config.Config,
 	log zerolog.Logger,
 ) *AdminHandler {
@@ -47,6 +50,7 @@ func NewAdminHandler(
 		fileRepo:     fileRepo,
 		activityRepo: activityRepo,
 		settingsRepo: settingsRepo,
+		retention:    retention,
 		cfg:          cfg,
 		log:          log,
 	}
@@ -54,14 +58,18 @@ func NewAdminHandler(
 
 // SystemStats represents overall system statistics
 type SystemStats struct {
-	TotalUsers     int64 `json:"totalUsers"`
-	ActiveUsers    int64 `json:"activeUsers"`
-	TotalStorage   int64 `json:"totalStorage"`
-	UsedStorage    int64 `json:"usedStorage"`
-	TotalFiles     int64 `json:"totalFiles"`
-	TotalShares    int64 `json:"totalShares"`
-	UploadsToday   int64 `json:"uploadsToday"`
-	DownloadsToday int64 `json:"downloadsToday"`
+	TotalUsers   int64 `json:"totalUsers"`
+	ActiveUsers  int64 `json:"activeUsers"`
+	TotalStorage int64 `json:"totalStorage"`
+	UsedStorage  int64 `json:"usedStorage"`
+	// LogicalStorage is the size of all files and their versions, and
+	// PhysicalStorage what they take up with identical content stored once
+	LogicalStorage  int64 `json:"logicalStorage"`
+	PhysicalStorage int64 `json:"physicalStorage"`
+	TotalFiles      int64 `json:"totalFiles"`
+	TotalShares     int64 `json:"totalShares"`
+	UploadsToday    int64 `json:"uploadsToday"`
+	DownloadsToday  int64 `json:"downloadsToday"`
 }
 
 // SystemSettings represents configurable system settings
@@ -78,6 +86,14 @@ type SystemSettings struct {
 	SMTPPort                 int      `json:"smtpPort"`
 	SMTPUser                 string   `json:"smtpUser"`
 	SMTPFrom                 string   `json:"smtpFrom"`
+	// TrashRetentionDays is how long trashed files are kept before they're
+	// purged, unless a user has their own retention; 0 keeps them forever
+	TrashRetentionDays int `json:"trashRetentionDays"`
+	// VersionPolicy decides which earlier versions of files are kept
+	VersionPolicy services.VersionPolicy `json:"versionPolicy"`
+	// QuotaWarnings are the shares of their quota, in percent, at which
+	// users are warned that their storage is filling up
+	QuotaWarnings []int `json:"quotaWarnings"`
 }
 
 // defaultSystemSettings returns sensible defaults
@@ -95,6 +111,9 @@ func (h *AdminHandler) defaultSystemSettings() SystemSettings {
 		SMTPPort:                 587,
 		SMTPUser:                 "",
 		SMTPFrom:                 "",
+		TrashRetentionDays:       services.DefaultTrashRetentionDays,
+		VersionPolicy:            services.DefaultVersionPolicy,
+		QuotaWarnings:            services.DefaultQuotaWarnings,
 	}
 }
 
@@ -110,6 +129,8 @@ type AdminUserResponse struct {
 	LastLoginAt   *time.Time `json:"lastLoginAt"`
 	IsActive      bool       `json:"isActive"`
 	EmailVerified bool       `json:"emailVerified"`
+	// TrashRetentionDays overrides the system trash retention for the user
+	TrashRetentionDays *int `json:"trashRetentionDays"`
 }
 
 // GetStats returns system statistics
@@ -130,6 +151,14 @@ func (h *AdminHandler) GetStats(c *fiber.Ctx) error {
 	var usedStorage int64
 	h.db.QueryRow(ctx, "SELECT COALESCE(SUM(size), 0) FROM files").Scan(&usedStorage)
 
+	var logicalStorage, physicalStorage int64
+	if totals, err := h.fileRepo.GetStorageTotals(ctx); err == nil {
+		logicalStorage = totals.LogicalBytes()
+		physicalStorage = totals.BlobsBytes
+	} else {
+		h.log.Error().Err(err).Msg("Failed to get storage totals")
+	}
+
 	// Get today's activity
 	today := time.Now().Truncate(24 * time.Hour)
 	var uploadsToday, downloadsToday int64
@@ -139,50 +168,78 @@ func (h *AdminHandler) GetStats(c *fiber.Ctx) error {
 	totalStorage := int64(1024 * 1024 * 1024 * 1024) // 1TB
 
 	stats := SystemStats{
-		TotalUsers:     totalUsers,
-		ActiveUsers:    activeUsers,
-		TotalStorage:   totalStorage,
-		UsedStorage:    usedStorage,
-		TotalFiles:     totalFiles,
-		TotalShares:    totalShares,
-		UploadsToday:   uploadsToday,
-		DownloadsToday: downloadsToday,
+		TotalUsers:      totalUsers,
+		ActiveUsers:     activeUsers,
+		TotalStorage:    totalStorage,
+		UsedStorage:     usedStorage,
+		LogicalStorage:  logicalStorage,
+		PhysicalStorage: physicalStorage,
+		TotalFiles:      totalFiles,
+		TotalShares:     totalShares,
+		UploadsToday:    uploadsToday,
+		DownloadsToday:  downloadsToday,
 	}
 
 	return c.JSON(stats)
 }
 
-// GetSettings returns system settings (persisted in database)
-func (h *AdminHandler) GetSettings(c *fiber.Ctx) error {
+// loadSettings returns the stored system settings merged onto the defaults
+func (h *AdminHandler) loadSettings(ctx context.Context) SystemSettings {
 	defaults := h.defaultSystemSettings()
 
-	stored, err := h.settingsRepo.Get(c.Context(), "system_settings")
+	stored, err := h.settingsRepo.Get(ctx, "system_settings")
 	if err != nil {
 		// No settings saved yet, return defaults
-		return c.JSON(defaults)
+		return defaults
 	}
 
 	// Marshal/unmarshal through JSON to merge stored values onto defaults
 	raw, err := json.Marshal(stored)
 	if err != nil {
-		return c.JSON(defaults)
+		return defaults
 	}
 
 	settings := defaults
 	json.Unmarshal(raw, &settings)
+	return settings
+}
 
-	return c.JSON(settings)
+// GetSettings returns system settings (persisted in database)
+func (h *AdminHandler) GetSettings(c *fiber.Ctx) error {
+	return c.JSON(h.loadSettings(c.Context()))
 }
 
-// UpdateSettings updates system settings (persisted in database)
+// UpdateSettings updates system settings (persisted in database). Settings
+// missing from the request keep their current value.
 func (h *AdminHandler) UpdateSettings(c *fiber.Ctx) error {
-	var input SystemSettings
+	input := h.loadSettings(c.Context())
 	if err := c.BodyParser(&input); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "Invalid request body",
 		})
 	}
 
+	if input.TrashRetentionDays < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Trash retention can't be negative",
+		})
+	}
+	if !input.VersionPolicy.Valid() {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Version policy values can't be negative",
+		})
+	}
+	if input.QuotaWarnings == nil {
+		input.QuotaWarnings = []int{}
+	}
+	for _, pct := range input.QuotaWarnings {
+		if !services.ValidQuotaWarning(pct) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Quota warnings must be between 1 and 100 percent",
+			})
+		}
+	}
+
 	if err := h.settingsRepo.Set(c.Context(), "system_settings", input); err != nil {
 		h.log.Error().Err(err).Msg("Failed to save system settings")
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -219,7 +276,7 @@ func (h *AdminHandler) ListUsers(c *fiber.Ctx) error {
 		searchPattern := "%" + search + "%"
 		h.db.QueryRow(ctx, "SELECT COUNT(*) FROM users WHERE name ILIKE $1 OR email ILIKE $1", searchPattern).Scan(&total)
 		query = `
-			SELECT id, email, name, role, storage_limit, is_active, created_at, last_login_at
+			SELECT id, email, name, role, storage_limit, is_active, created_at, last_login_at, trash_retention_days
 			FROM users
 			WHERE name ILIKE $1 OR email ILIKE $1
 			ORDER BY created_at DESC
@@ -229,7 +286,7 @@ func (h *AdminHandler) ListUsers(c *fiber.Ctx) error {
 	} else {
 		h.db.QueryRow(ctx, "SELECT COUNT(*) FROM users").Scan(&total)
 		query = `
-			SELECT id, email, name, role, storage_limit, is_active, created_at, last_login_at
+			SELECT id, email, name, role, storage_limit, is_active, created_at, last_login_at, trash_retention_days
 			FROM users
 			ORDER BY created_at DESC
 			OFFSET $1 LIMIT $2
@@ -252,15 +309,14 @@ func (h *AdminHandler) ListUsers(c *fiber.Ctx) error {
 		if err := rows.Scan(
 			&user.ID, &user.Email, &user.Name, &user.Role,
 			&user.StorageQuota, &user.IsActive, &user.CreatedAt, &user.LastLoginAt,
+			&user.TrashRetentionDays,
 		); err != nil {
 			h.log.Error().Err(err).Msg("Failed to scan user")
 			continue
 		}
 		user.EmailVerified = true
 
-		var storageUsed int64
-		h.db.QueryRow(ctx, "SELECT COALESCE(SUM(size), 0) FROM files WHERE owner_id = $1", user.ID).Scan(&storageUsed)
-		user.StorageUsed = storageUsed
+		user.StorageUsed, _ = h.fileRepo.GetStorageUsed(ctx, user.ID)
 
 		users = append(users, user)
 	}
@@ -293,20 +349,21 @@ func (h *AdminHandler) GetUser(c *fiber.Ctx) error {
 		})
 	}
 
-	var storageUsed int64
-	h.db.QueryRow(ctx, "SELECT COALESCE(SUM(size), 0) FROM files WHERE owner_id = $1", user.ID).Scan(&storageUsed)
+	storageUsed, _ := h.fileRepo.GetStorageUsed(ctx, user.ID)
+	trashRetention, _ := h.userRepo.GetTrashRetention(ctx, user.ID)
 
 	response := AdminUserResponse{
-		ID:            user.ID,
-		Email:         user.Email,
-		Name:          user.Name,
-		Role:          user.Role,
-		StorageUsed:   storageUsed,
-		StorageQuota:  user.StorageLimit,
-		CreatedAt:     user.CreatedAt,
-		LastLoginAt:   user.LastLoginAt,
-		IsActive:      user.IsActive,
-		EmailVerified: true,
+		ID:                 user.ID,
+		Email:              user.Email,
+		Name:               user.Name,
+		Role:               user.Role,
+		StorageUsed:        storageUsed,
+		StorageQuota:       user.StorageLimit,
+		CreatedAt:          user.CreatedAt,
+		LastLoginAt:        user.LastLoginAt,
+		IsActive:           user.IsActive,
+		EmailVerified:      true,
+		TrashRetentionDays: trashRetention,
 	}
 
 	return c.JSON(response)
@@ -422,6 +479,9 @@ func (h *AdminHandler) UpdateUser(c *fiber.Ctx) error {
 		Role         *string `json:"role"`
 		StorageQuota *int64  `json:"storageQuota"`
 		IsActive     *bool   `json:"isActive"`
+		// TrashRetentionDays overrides the system trash retention; a
+		// negative value removes the override
+		TrashRetentionDays *int `json:"trashRetentionDays"`
 	}
 
 	if err := c.BodyParser(&input); err != nil {
@@ -474,21 +534,34 @@ func (h *AdminHandler) UpdateUser(c *fiber.Ctx) error {
 			"error": "Failed to update user",
 		})
 	}
+	if input.TrashRetentionDays != nil {
+		days := input.TrashRetentionDays
+		if *days < 0 {
+			days = nil
+		}
+		if err := h.userRepo.SetTrashRetention(ctx, user.ID, days); err != nil {
+			h.log.Error().Err(err).Msg("Failed to update trash retention")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to update user",
+			})
+		}
+	}
 
-	var storageUsed int64
-	h.db.QueryRow(ctx, "SELECT COALESCE(SUM(size), 0) FROM files WHERE owner_id = $1", user.ID).Scan(&storageUsed)
+	storageUsed, _ := h.fileRepo.GetStorageUsed(ctx, user.ID)
+	trashRetention, _ := h.userRepo.GetTrashRetention(ctx, user.ID)
 
 	response := AdminUserResponse{
-		ID:            user.ID,
-		Email:         user.Email,
-		Name:          user.Name,
-		Role:          user.Role,
-		StorageUsed:   storageUsed,
-		StorageQuota:  user.StorageLimit,
-		CreatedAt:     user.CreatedAt,
-		LastLoginAt:   user.LastLoginAt,
-		IsActive:      user.IsActive,
-		EmailVerified: true,
+		ID:                 user.ID,
+		Email:              user.Email,
+		Name:               user.Name,
+		Role:               user.Role,
+		StorageUsed:        storageUsed,
+		StorageQuota:       user.StorageLimit,
+		CreatedAt:          user.CreatedAt,
+		LastLoginAt:        user.LastLoginAt,
+		IsActive:           user.IsActive,
+		EmailVerified:      true,
+		TrashRetentionDays: trashRetention,
 	}
 
 	return c.JSON(response)
@@ -538,6 +611,17 @@ func (h *AdminHandler) DeleteUser(c *fiber.Ctx) error {
 		"DELETE FROM tasks WHERE user_id = $1",
 		"DELETE FROM task_groups WHERE user_id = $1",
 		"DELETE FROM password_reset_tokens WHERE user_id = $1",
+		// Stored content shared with other users' files stays; the rest is
+		// left unreferenced and deleted by the next cleanup
+		`UPDATE blobs b SET ref_count = b.ref_count - r.refs
+		FROM (
+			SELECT storage_key, COUNT(*) AS refs FROM (
+				SELECT storage_key FROM files WHERE owner_id = $1 AND is_folder = false
+				UNION ALL
+				SELECT v.storage_key FROM file_versions v JOIN files f ON f.id = v.file_id WHERE f.owner_id = $1
+			) keys GROUP BY storage_key
+		) r
+		WHERE b.storage_key = r.storage_key`,
 		"DELETE FROM file_versions WHERE file_id IN (SELECT id FROM files WHERE owner_id = $1)",
 		"DELETE FROM shares WHERE owner_id = $1",
 		"DELETE FROM files WHERE owner_id = $1",
@@ -684,27 +768,56 @@ func (h *AdminHandler) ClearCache(c *fiber.Ctx) error {
 	})
 }
 
-// RunCleanup runs cleanup tasks
+// RunCleanup purges expired trash and shares now rather than waiting for
+// the scheduled cleanup. With ?dry_run=true it only reports what would be
+// removed.
 func (h *AdminHandler) RunCleanup(c *fiber.Ctx) error {
-	ctx, cancel := context.WithTimeout(c.Context(), 60*time.Second)
+	ctx, cancel := context.WithTimeout(c.Context(), 5*time.Minute)
 	defer cancel()
 
-	result, err := h.db.Exec(ctx, "DELETE FROM shares WHERE expires_at IS NOT NULL AND expires_at < $1", time.Now())
+	dryRun := c.QueryBool("dry_run")
+
+	trash, err := h.retention.PurgeTrash(ctx, dryRun)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to purge trash")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to purge trash",
+		})
+	}
+	shares, err := h.retention.PurgeShares(ctx, dryRun)
 	if err != nil {
 		h.log.Error().Err(err).Msg("Failed to cleanup expired shares")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to cleanup expired shares",
+		})
 	}
 
-	sharesExpired := result.RowsAffected()
-
-	// Also clean up expired password reset tokens
-	h.db.Exec(ctx, "DELETE FROM password_reset_tokens WHERE expires_at < $1 OR used_at IS NOT NULL", time.Now())
+	if !dryRun {
+		// Also clean up expired password reset tokens
+		h.db.Exec(ctx, "DELETE FROM password_reset_tokens WHERE expires_at < $1 OR used_at IS NOT NULL", time.Now())
+	}
 
-	h.log.Info().Int64("sharesExpired", sharesExpired).Msg("Cleanup completed")
+	h.log.Info().
+		Bool("dryRun", dryRun).
+		Int("filesRemoved", len(trash.Files)).
+		Int64("bytesFreed", trash.BytesFreed).
+		Int("sharesExpired", len(shares)).
+		Str("admin_id", middleware.GetUserID(c).String()).
+		Msg("Cleanup completed")
 
+	message := "Cleanup completed"
+	if dryRun {
+		message = "Dry run: nothing was removed"
+	}
 	return c.JSON(fiber.Map{
-		"message":       "Cleanup completed",
-		"filesRemoved":  0,
-		"sharesExpired": sharesExpired,
+		"message":       message,
+		"dryRun":        dryRun,
+		"filesRemoved":  len(trash.Files),
+		"bytesFreed":    trash.BytesFreed,
+		"filesSkipped":  trash.Skipped,
+		"sharesExpired": len(shares),
+		"files":         trash.Files,
+		"shares":        shares,
 	})
 }
 
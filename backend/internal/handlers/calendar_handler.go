@@ -1,6 +1,12 @@
 package handlers
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
@@ -8,17 +14,22 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/tessera/tessera/internal/models"
 	"github.com/tessera/tessera/internal/repository"
+	"github.com/tessera/tessera/internal/services"
 )
 
 type CalendarHandler struct {
 	log          zerolog.Logger
 	calendarRepo *repository.CalendarRepository
+	userRepo     *repository.UserRepository
+	reminders    services.ReminderPlanner
 }
 
-func NewCalendarHandler(log zerolog.Logger, calendarRepo *repository.CalendarRepository) *CalendarHandler {
+func NewCalendarHandler(log zerolog.Logger, calendarRepo *repository.CalendarRepository, userRepo *repository.UserRepository, reminders services.ReminderPlanner) *CalendarHandler {
 	return &CalendarHandler{
 		log:          log,
 		calendarRepo: calendarRepo,
+		userRepo:     userRepo,
+		reminders:    reminders,
 	}
 }
 
@@ -53,13 +64,17 @@ func (h *CalendarHandler) ListEvents(c *fiber.Ctx) error {
 		endDate = time.Now().AddDate(0, 2, 0)
 	}
 
-	events, err := h.calendarRepo.ListByUser(c.Context(), userID, startDate, endDate)
+	events, err := h.calendarRepo.ListInRange(c.Context(), userID, startDate, endDate)
 	if err != nil {
 		h.log.Error().Err(err).Msg("Failed to list calendar events")
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch events"})
 	}
 
-	return c.JSON(events)
+	// expand=false returns recurring events as stored, with their overrides
+	if c.Query("expand") == "false" {
+		return c.JSON(events)
+	}
+	return c.JSON(services.ExpandEvents(events, startDate, endDate))
 }
 
 // CreateEvent creates a new calendar event
@@ -77,6 +92,7 @@ func (h *CalendarHandler) CreateEvent(c *fiber.Ctx) error {
 		AllDay       bool                 `json:"allDay"`
 		Color        string               `json:"color"`
 		Recurrence   *models.RecurrenceRule `json:"recurrence"`
+		Reminders    []models.EventReminder `json:"reminders"`
 		LinkedTaskID *string              `json:"linkedTaskId"`
 	}
 
@@ -108,6 +124,11 @@ func (h *CalendarHandler) CreateEvent(c *fiber.Ctx) error {
 		input.Color = "#3b82f6"
 	}
 
+	reminders, err := eventReminders(input.Reminders)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
 	now := time.Now()
 	event := &models.CalendarEvent{
 		ID:           uuid.New(),
@@ -119,7 +140,7 @@ func (h *CalendarHandler) CreateEvent(c *fiber.Ctx) error {
 		AllDay:       input.AllDay,
 		Color:        input.Color,
 		Recurrence:   input.Recurrence,
-		Reminders:    []models.EventReminder{},
+		Reminders:    reminders,
 		LinkedTaskID: input.LinkedTaskID,
 		CreatedAt:    now,
 		UpdatedAt:    now,
@@ -135,6 +156,8 @@ func (h *CalendarHandler) CreateEvent(c *fiber.Ctx) error {
 		Str("title", event.Title).
 		Msg("Calendar event created")
 
+	h.reminders.PlanEventReminders(c.Context(), event)
+
 	return c.Status(fiber.StatusCreated).JSON(event)
 }
 
@@ -158,7 +181,121 @@ func (h *CalendarHandler) GetEvent(c *fiber.Ctx) error {
 	return c.JSON(event)
 }
 
-// UpdateEvent updates an existing event
+// eventUpdate is the body of UpdateEvent
+type eventUpdate struct {
+	Title       string                 `json:"title"`
+	Description string                 `json:"description"`
+	StartDate   string                 `json:"startDate"`
+	EndDate     string                 `json:"endDate"`
+	AllDay      bool                   `json:"allDay"`
+	Color       string                 `json:"color"`
+	Recurrence  *models.RecurrenceRule `json:"recurrence"`
+	// Reminders replaces the reminders when present
+	Reminders []models.EventReminder `json:"reminders"`
+	// Scope selects what an edit of a recurring event applies to: "this"
+	// occurrence, "following" occurrences or "all" (the default)
+	Scope        string `json:"scope"`
+	RecurrenceID string `json:"recurrenceId"`
+}
+
+// apply copies the edited fields, except the recurrence rule, onto an event
+func (u *eventUpdate) apply(event *models.CalendarEvent) error {
+	if u.Title != "" {
+		event.Title = u.Title
+	}
+	event.Description = u.Description
+	event.AllDay = u.AllDay
+	if u.Color != "" {
+		event.Color = u.Color
+	}
+
+	if u.StartDate != "" {
+		startDate, err := parseEventTime(u.StartDate)
+		if err != nil {
+			return errors.New("Invalid start date format")
+		}
+		event.StartDate = startDate
+	}
+	if u.EndDate != "" {
+		endDate, err := parseEventTime(u.EndDate)
+		if err != nil {
+			return errors.New("Invalid end date format")
+		}
+		event.EndDate = endDate
+	}
+	if u.Reminders != nil {
+		reminders, err := eventReminders(u.Reminders)
+		if err != nil {
+			return err
+		}
+		event.Reminders = reminders
+	}
+	return nil
+}
+
+// eventReminders validates reminders sent by a client and assigns missing IDs
+func eventReminders(in []models.EventReminder) ([]models.EventReminder, error) {
+	reminders := []models.EventReminder{}
+	for _, r := range in {
+		if r.Minutes < 0 {
+			return nil, errors.New("Reminder minutes must not be negative")
+		}
+		if r.ID == uuid.Nil {
+			r.ID = uuid.New()
+		}
+		reminders = append(reminders, r)
+	}
+	return reminders, nil
+}
+
+// parseEventTime accepts RFC 3339 and the offset-less form the web client sends
+func parseEventTime(value string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t, err = time.Parse("2006-01-02T15:04:05", value)
+	}
+	return t, err
+}
+
+// Edit scopes for recurring events
+const (
+	scopeThis      = "this"
+	scopeFollowing = "following"
+	scopeAll       = "all"
+)
+
+// occurrenceParams validates the scope and recurrence ID of an edit or
+// delete; recurrenceID is zero when none was given
+func occurrenceParams(event *models.CalendarEvent, scope, recurrenceIDStr string) (string, time.Time, error) {
+	if scope == "" {
+		scope = scopeAll
+	}
+	if scope != scopeThis && scope != scopeFollowing && scope != scopeAll {
+		return "", time.Time{}, errors.New("scope must be this, following or all")
+	}
+	if recurrenceIDStr == "" {
+		if scope != scopeAll {
+			return "", time.Time{}, errors.New("recurrenceId is required for this scope")
+		}
+		return scope, time.Time{}, nil
+	}
+
+	recurrenceID, err := parseEventTime(recurrenceIDStr)
+	if err != nil {
+		return "", time.Time{}, errors.New("Invalid recurrenceId format")
+	}
+	if !services.IsOccurrence(event, recurrenceID) {
+		return "", time.Time{}, errors.New("recurrenceId is not an occurrence of this event")
+	}
+	// Splitting at the first occurrence affects the whole series
+	if scope == scopeFollowing && !recurrenceID.After(event.StartDate) {
+		scope = scopeAll
+	}
+	return scope, recurrenceID, nil
+}
+
+// UpdateEvent updates an existing event. For recurring events, scope and
+// recurrenceId select a single occurrence or the occurrences from one on.
 func (h *CalendarHandler) UpdateEvent(c *fiber.Ctx) error {
 	userID, ok := c.Locals("userID").(uuid.UUID)
 	if !ok {
@@ -170,16 +307,7 @@ func (h *CalendarHandler) UpdateEvent(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid event ID"})
 	}
 
-	var input struct {
-		Title       string               `json:"title"`
-		Description string               `json:"description"`
-		StartDate   string               `json:"startDate"`
-		EndDate     string               `json:"endDate"`
-		AllDay      bool                 `json:"allDay"`
-		Color       string               `json:"color"`
-		Recurrence  *models.RecurrenceRule `json:"recurrence"`
-	}
-
+	var input eventUpdate
 	if err := c.BodyParser(&input); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
 	}
@@ -189,30 +317,51 @@ func (h *CalendarHandler) UpdateEvent(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Event not found"})
 	}
 
-	if input.Title != "" {
-		event.Title = input.Title
+	scope, recurrenceID, err := occurrenceParams(event, input.Scope, input.RecurrenceID)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	switch scope {
+	case scopeThis:
+		return h.updateOccurrence(c, event, recurrenceID, &input)
+	case scopeFollowing:
+		return h.splitSeries(c, event, recurrenceID, &input)
+	}
+
+	oldStart := event.StartDate
+	hadOverrides := len(event.Overrides) > 0
+	if err := input.apply(event); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if !recurrenceID.IsZero() && input.StartDate != "" {
+		// Times sent for an occurrence move the whole series by the same amount
+		duration := event.EndDate.Sub(event.StartDate)
+		event.StartDate = oldStart.Add(event.StartDate.Sub(recurrenceID))
+		event.EndDate = event.StartDate.Add(duration)
 	}
-	event.Description = input.Description
-	event.AllDay = input.AllDay
-	if input.Color != "" {
-		event.Color = input.Color
+
+	// Cancelled occurrences survive edits that resend the rule without them
+	if input.Recurrence != nil && event.Recurrence != nil && input.Recurrence.ExceptionDates == nil {
+		input.Recurrence.ExceptionDates = event.Recurrence.ExceptionDates
 	}
 	event.Recurrence = input.Recurrence
 
-	if input.StartDate != "" {
-		startDate, err := time.Parse(time.RFC3339, input.StartDate)
-		if err != nil {
-			startDate, _ = time.Parse("2006-01-02T15:04:05", input.StartDate)
+	if delta := event.StartDate.Sub(oldStart); event.Recurrence != nil && delta != 0 {
+		shiftTimes(event.Recurrence.ExceptionDates, delta)
+		if hadOverrides {
+			if err := h.calendarRepo.ShiftOverrides(c.Context(), event, delta); err != nil {
+				h.log.Error().Err(err).Msg("Failed to move modified occurrences")
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update event"})
+			}
 		}
-		event.StartDate = startDate
 	}
-
-	if input.EndDate != "" {
-		endDate, err := time.Parse(time.RFC3339, input.EndDate)
-		if err != nil {
-			endDate, _ = time.Parse("2006-01-02T15:04:05", input.EndDate)
+	if event.Recurrence == nil && hadOverrides {
+		if err := h.calendarRepo.SetOverrides(c.Context(), event, nil); err != nil {
+			h.log.Error().Err(err).Msg("Failed to delete modified occurrences")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update event"})
 		}
-		event.EndDate = endDate
+		event.Overrides = nil
 	}
 
 	event.UpdatedAt = time.Now()
@@ -226,10 +375,129 @@ func (h *CalendarHandler) UpdateEvent(c *fiber.Ctx) error {
 		Str("event_id", eventID.String()).
 		Msg("Calendar event updated")
 
+	h.reminders.PlanEventReminders(c.Context(), event)
+
 	return c.JSON(event)
 }
 
-// DeleteEvent deletes an event
+// updateOccurrence stores an edit of one occurrence as an override
+func (h *CalendarHandler) updateOccurrence(c *fiber.Ctx, series *models.CalendarEvent, recurrenceID time.Time, input *eventUpdate) error {
+	occurrence := services.Occurrence(series, recurrenceID)
+	if err := input.apply(&occurrence); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	now := time.Now()
+	occurrence.UpdatedAt = now
+	if err := h.calendarRepo.SaveOverride(c.Context(), series, &occurrence); err != nil {
+		h.log.Error().Err(err).Msg("Failed to save modified occurrence")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update event"})
+	}
+	// Bumps the series' ETag so CalDAV clients pick up the override
+	series.UpdatedAt = now
+	if err := h.calendarRepo.Update(c.Context(), series); err != nil {
+		h.log.Error().Err(err).Msg("Failed to update calendar event")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update event"})
+	}
+
+	h.log.Info().
+		Str("event_id", series.ID.String()).
+		Time("recurrence_id", recurrenceID).
+		Msg("Calendar occurrence updated")
+
+	overrides := []models.CalendarEvent{occurrence}
+	for _, o := range series.Overrides {
+		if !o.RecurrenceID.Equal(recurrenceID) {
+			overrides = append(overrides, o)
+		}
+	}
+	series.Overrides = overrides
+	h.reminders.PlanEventReminders(c.Context(), series)
+
+	// Respond with the occurrence as ListEvents shows it
+	occurrence.ID = series.ID
+	occurrence.SeriesID = nil
+	occurrence.Recurrence = series.Recurrence
+	occurrence.LinkedTaskID = series.LinkedTaskID
+	return c.JSON(occurrence)
+}
+
+// splitSeries applies an edit to an occurrence and all following ones: the
+// series ends before the occurrence and a new series (with a new UID) starts
+// there. Overrides of the moved occurrences are dropped.
+func (h *CalendarHandler) splitSeries(c *fiber.Ctx, series *models.CalendarEvent, recurrenceID time.Time, input *eventUpdate) error {
+	now := time.Now()
+
+	tail := *series
+	tailRule := *series.Recurrence
+	tail.ID = uuid.New()
+	tail.UID = ""
+	tail.ResourceName = ""
+	tail.Recurrence = &tailRule
+	tail.Overrides = nil
+	tail.StartDate = recurrenceID
+	tail.EndDate = recurrenceID.Add(series.EndDate.Sub(series.StartDate))
+	tail.CreatedAt = now
+	tail.UpdatedAt = now
+
+	headRule := *series.Recurrence
+	series.Recurrence = &headRule
+	if remaining := services.TruncateSeries(series, recurrenceID); remaining > 0 {
+		tailRule.Occurrences = &remaining
+	}
+	tailRule.ExceptionDates = nil
+	for _, d := range series.Recurrence.ExceptionDates {
+		if !d.Before(recurrenceID) {
+			tailRule.ExceptionDates = append(tailRule.ExceptionDates, d)
+		}
+	}
+
+	if err := input.apply(&tail); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	shiftTimes(tailRule.ExceptionDates, tail.StartDate.Sub(recurrenceID))
+	if input.Recurrence != nil {
+		if input.Recurrence.ExceptionDates == nil {
+			input.Recurrence.ExceptionDates = tailRule.ExceptionDates
+		}
+		tail.Recurrence = input.Recurrence
+	}
+	series.UpdatedAt = now
+
+	ctx := c.Context()
+	if err := h.calendarRepo.DeleteOverridesFrom(ctx, series, recurrenceID); err != nil {
+		h.log.Error().Err(err).Msg("Failed to delete modified occurrences")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update event"})
+	}
+	if err := h.calendarRepo.Update(ctx, series); err != nil {
+		h.log.Error().Err(err).Msg("Failed to update calendar event")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update event"})
+	}
+	if err := h.calendarRepo.Create(ctx, &tail); err != nil {
+		h.log.Error().Err(err).Msg("Failed to create calendar event")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update event"})
+	}
+
+	h.log.Info().
+		Str("event_id", series.ID.String()).
+		Str("new_event_id", tail.ID.String()).
+		Msg("Calendar series split")
+
+	h.reminders.PlanEventReminders(ctx, series)
+	h.reminders.PlanEventReminders(ctx, &tail)
+
+	return c.JSON(tail)
+}
+
+// shiftTimes moves each time by delta, in place
+func shiftTimes(times []time.Time, delta time.Duration) {
+	for i := range times {
+		times[i] = times[i].Add(delta)
+	}
+}
+
+// DeleteEvent deletes an event. For recurring events, scope and recurrenceId
+// (query parameters) delete a single occurrence or the occurrences from one on.
 func (h *CalendarHandler) DeleteEvent(c *fiber.Ctx) error {
 	userID, ok := c.Locals("userID").(uuid.UUID)
 	if !ok {
@@ -241,6 +509,10 @@ func (h *CalendarHandler) DeleteEvent(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid event ID"})
 	}
 
+	if c.Query("scope", scopeAll) != scopeAll {
+		return h.deleteOccurrences(c, eventID, userID)
+	}
+
 	if err := h.calendarRepo.Delete(c.Context(), eventID, userID); err != nil {
 		h.log.Error().Err(err).Msg("Failed to delete calendar event")
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete event"})
@@ -253,6 +525,51 @@ func (h *CalendarHandler) DeleteEvent(c *fiber.Ctx) error {
 	return c.SendStatus(fiber.StatusNoContent)
 }
 
+// deleteOccurrences cancels one occurrence (scope=this) or ends the series
+// before an occurrence (scope=following)
+func (h *CalendarHandler) deleteOccurrences(c *fiber.Ctx, eventID, userID uuid.UUID) error {
+	ctx := c.Context()
+	event, err := h.calendarRepo.GetByID(ctx, eventID, userID)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Event not found"})
+	}
+
+	scope, recurrenceID, err := occurrenceParams(event, c.Query("scope"), c.Query("recurrenceId"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	switch scope {
+	case scopeThis:
+		event.Recurrence.ExceptionDates = append(event.Recurrence.ExceptionDates, recurrenceID)
+		err = h.calendarRepo.DeleteOverride(ctx, event, recurrenceID)
+	case scopeFollowing:
+		services.TruncateSeries(event, recurrenceID)
+		err = h.calendarRepo.DeleteOverridesFrom(ctx, event, recurrenceID)
+	default:
+		err = h.calendarRepo.Delete(ctx, eventID, userID)
+		if err == nil {
+			return c.SendStatus(fiber.StatusNoContent)
+		}
+	}
+	if err == nil {
+		event.UpdatedAt = time.Now()
+		err = h.calendarRepo.Update(ctx, event)
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to delete calendar occurrences")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete event"})
+	}
+
+	h.log.Info().
+		Str("event_id", eventID.String()).
+		Str("scope", scope).
+		Time("recurrence_id", recurrenceID).
+		Msg("Calendar occurrences deleted")
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
 // DeleteEventByTask deletes all calendar events linked to a specific task
 func (h *CalendarHandler) DeleteEventByTask(c *fiber.Ctx) error {
 	userID, ok := c.Locals("userID").(uuid.UUID)
@@ -278,3 +595,265 @@ func (h *CalendarHandler) DeleteEventByTask(c *fiber.Ctx) error {
 
 	return c.JSON(fiber.Map{"deleted": deleted})
 }
+
+// calendarFeedPath is the public path of a subscription feed
+const calendarFeedPath = "/api/calendar/feed/"
+
+// ImportEvents imports an .ics file. Events are matched by UID, so importing
+// the same file again updates the events instead of duplicating them.
+func (h *CalendarHandler) ImportEvents(c *fiber.Ctx) error {
+	userID, ok := c.Locals("userID").(uuid.UUID)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	var data io.Reader
+	if fileHeader, err := c.FormFile("file"); err == nil {
+		f, err := fileHeader.Open()
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Failed to read file"})
+		}
+		defer f.Close()
+		data = f
+	} else if len(c.Body()) > 0 && !strings.HasPrefix(c.Get("Content-Type"), "multipart/") {
+		data = bytes.NewReader(c.Body())
+	} else {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "No file provided"})
+	}
+
+	user, err := h.userRepo.GetByID(c.Context(), userID)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	items, err := services.DecodeICalCalendar(data, services.UserLocation(user.Timezone))
+	if err != nil {
+		if errors.Is(err, services.ErrICalNoEvent) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "The file contains no events"})
+		}
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid iCalendar file: " + err.Error()})
+	}
+
+	type importError struct {
+		UID     string `json:"uid"`
+		Summary string `json:"summary"`
+		Error   string `json:"error"`
+	}
+	created, updated := 0, 0
+	importErrors := []importError{}
+
+	for _, item := range items {
+		if item.Err != nil {
+			importErrors = append(importErrors, importError{UID: item.UID, Summary: item.Summary, Error: item.Err.Error()})
+			continue
+		}
+
+		isNew, err := h.importEvent(c, userID, item.Event)
+		if err != nil {
+			h.log.Error().Err(err).Str("uid", item.UID).Msg("Failed to import calendar event")
+			importErrors = append(importErrors, importError{UID: item.UID, Summary: item.Summary, Error: "Failed to save event"})
+			continue
+		}
+		if isNew {
+			created++
+		} else {
+			updated++
+		}
+	}
+
+	h.log.Info().
+		Str("user_id", userID.String()).
+		Int("created", created).
+		Int("updated", updated).
+		Int("failed", len(importErrors)).
+		Msg("Calendar import finished")
+
+	return c.JSON(fiber.Map{
+		"created": created,
+		"updated": updated,
+		"failed":  len(importErrors),
+		"errors":  importErrors,
+	})
+}
+
+// importEvent creates an imported event, or updates the event with the same UID
+func (h *CalendarHandler) importEvent(c *fiber.Ctx, userID uuid.UUID, parsed *models.CalendarEvent) (bool, error) {
+	now := time.Now()
+
+	existing, err := h.calendarRepo.GetByUID(c.Context(), userID, parsed.UID)
+	if err != nil && !errors.Is(err, repository.ErrEventNotFound) {
+		return false, err
+	}
+
+	if existing != nil {
+		existing.Title = parsed.Title
+		existing.Description = parsed.Description
+		existing.StartDate = parsed.StartDate
+		existing.EndDate = parsed.EndDate
+		existing.AllDay = parsed.AllDay
+		existing.Recurrence = parsed.Recurrence
+		existing.Reminders = parsed.Reminders
+		if parsed.Color != "" {
+			existing.Color = parsed.Color
+		}
+		existing.UpdatedAt = now
+		if err := h.calendarRepo.SetOverrides(c.Context(), existing, parsed.Overrides); err != nil {
+			return false, err
+		}
+		if err := h.calendarRepo.Update(c.Context(), existing); err != nil {
+			return false, err
+		}
+		existing.Overrides = parsed.Overrides
+		h.reminders.PlanEventReminders(c.Context(), existing)
+		return false, nil
+	}
+
+	event := parsed
+	event.ID = uuid.New()
+	event.UserID = userID
+	if event.Color == "" {
+		event.Color = services.DefaultEventColor
+	}
+	// Task links only make sense for exports of this same account
+	event.LinkedTaskID = nil
+	event.CreatedAt = now
+	event.UpdatedAt = now
+	if err := h.calendarRepo.Create(c.Context(), event); err != nil {
+		return false, err
+	}
+	if len(event.Overrides) > 0 {
+		if err := h.calendarRepo.SetOverrides(c.Context(), event, event.Overrides); err != nil {
+			return true, err
+		}
+	}
+	h.reminders.PlanEventReminders(c.Context(), event)
+	return true, nil
+}
+
+// ExportEvents downloads the calendar as an .ics file. With start and end
+// (RFC 3339) only events overlapping that range are exported.
+func (h *CalendarHandler) ExportEvents(c *fiber.Ctx) error {
+	userID, ok := c.Locals("userID").(uuid.UUID)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	var events []models.CalendarEvent
+	var err error
+	startStr, endStr := c.Query("start"), c.Query("end")
+	if startStr != "" || endStr != "" {
+		startDate, err1 := time.Parse(time.RFC3339, startStr)
+		endDate, err2 := time.Parse(time.RFC3339, endStr)
+		if err1 != nil || err2 != nil || endDate.Before(startDate) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "start and end must be RFC 3339 dates"})
+		}
+		events, err = h.calendarRepo.ListInRange(c.Context(), userID, startDate, endDate)
+	} else {
+		events, err = h.calendarRepo.ListAll(c.Context(), userID)
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to list calendar events")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch events"})
+	}
+
+	c.Set("Content-Disposition", `attachment; filename="tessera-calendar.ics"`)
+	return h.sendCalendar(c, userID, events)
+}
+
+// GetFeed returns the subscription feed settings
+func (h *CalendarHandler) GetFeed(c *fiber.Ctx) error {
+	userID, ok := c.Locals("userID").(uuid.UUID)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	token, err := h.calendarRepo.GetFeedToken(c.Context(), userID)
+	if errors.Is(err, repository.ErrFeedNotFound) {
+		return c.JSON(fiber.Map{"enabled": false})
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to load calendar feed")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load feed"})
+	}
+
+	return c.JSON(fiber.Map{"enabled": true, "token": token, "path": calendarFeedPath + token + ".ics"})
+}
+
+// EnableFeed creates the subscription feed URL, or rotates it if one exists
+// (the old URL stops working)
+func (h *CalendarHandler) EnableFeed(c *fiber.Ctx) error {
+	userID, ok := c.Locals("userID").(uuid.UUID)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		h.log.Error().Err(err).Msg("Failed to generate calendar feed token")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create feed"})
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	if err := h.calendarRepo.SetFeedToken(c.Context(), userID, token); err != nil {
+		h.log.Error().Err(err).Msg("Failed to save calendar feed token")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create feed"})
+	}
+
+	h.log.Info().Str("user_id", userID.String()).Msg("Calendar feed URL created")
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"enabled": true, "token": token, "path": calendarFeedPath + token + ".ics"})
+}
+
+// DisableFeed revokes the subscription feed URL
+func (h *CalendarHandler) DisableFeed(c *fiber.Ctx) error {
+	userID, ok := c.Locals("userID").(uuid.UUID)
+	if !ok {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Unauthorized"})
+	}
+
+	if err := h.calendarRepo.DeleteFeedToken(c.Context(), userID); err != nil {
+		h.log.Error().Err(err).Msg("Failed to delete calendar feed token")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to disable feed"})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// Feed serves the read-only subscription feed (no auth; the token is the secret)
+func (h *CalendarHandler) Feed(c *fiber.Ctx) error {
+	token := strings.TrimSuffix(c.Params("token"), ".ics")
+
+	userID, err := h.calendarRepo.GetFeedOwner(c.Context(), token)
+	if err != nil {
+		if !errors.Is(err, repository.ErrFeedNotFound) {
+			h.log.Error().Err(err).Msg("Failed to look up calendar feed")
+		}
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Feed not found"})
+	}
+
+	events, err := h.calendarRepo.ListAll(c.Context(), userID)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to list calendar events")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch events"})
+	}
+
+	c.Set("Cache-Control", "private, max-age=300")
+	return h.sendCalendar(c, userID, events)
+}
+
+func (h *CalendarHandler) sendCalendar(c *fiber.Ctx, userID uuid.UUID, events []models.CalendarEvent) error {
+	user, err := h.userRepo.GetByID(c.Context(), userID)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to load calendar owner")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to export calendar"})
+	}
+
+	var buf bytes.Buffer
+	if err := services.EncodeICalCalendar(&buf, events, "Tessera", services.UserLocation(user.Timezone)); err != nil {
+		h.log.Error().Err(err).Msg("Failed to encode calendar")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to export calendar"})
+	}
+
+	c.Set("Content-Type", "text/calendar; charset=utf-8")
+	return c.Send(buf.Bytes())
+}
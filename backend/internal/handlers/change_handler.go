@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/tessera/tessera/internal/middleware"
+	"github.com/tessera/tessera/internal/services"
+)
+
+// changeLister pages through a user's change journal
+type changeLister interface {
+	List(ctx context.Context, userID uuid.UUID, cursor string, limit int) (*services.ChangePage, error)
+}
+
+// ChangeHandler serves the change journal to sync clients
+type ChangeHandler struct {
+	log     zerolog.Logger
+	changes changeLister
+}
+
+// NewChangeHandler creates a new change handler
+func NewChangeHandler(log zerolog.Logger, changes changeLister) *ChangeHandler {
+	return &ChangeHandler{
+		log:     log,
+		changes: changes,
+	}
+}
+
+// ListChanges returns the changes to the user's files after a cursor.
+// Without one, it returns the current cursor to continue from after a full
+// listing.
+func (h *ChangeHandler) ListChanges(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	page, err := h.changes.List(c.Context(), userID, c.Query("cursor"), c.QueryInt("limit", services.DefaultChangeLimit))
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidCursor) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid cursor",
+			})
+		}
+		if errors.Is(err, services.ErrCursorExpired) {
+			return c.Status(fiber.StatusGone).JSON(fiber.Map{
+				"error": "Cursor expired, resync required",
+				"reset": true,
+			})
+		}
+		h.log.Error().Err(err).Msg("Failed to list changes")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to list changes",
+		})
+	}
+
+	return c.JSON(page)
+}
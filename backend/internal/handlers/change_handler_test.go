@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/tessera/tessera/internal/services"
+)
+
+// failingLister fails every listing with err
+type failingLister struct {
+	err error
+}
+
+func (l failingLister) List(ctx context.Context, userID uuid.UUID, cursor string, limit int) (*services.ChangePage, error) {
+	return nil, l.err
+}
+
+func TestListChangesErrors(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		reset  bool
+	}{
+		{services.ErrCursorExpired, fiber.StatusGone, true},
+		{services.ErrInvalidCursor, fiber.StatusBadRequest, false},
+	}
+	for _, tt := range tests {
+		app := fiber.New()
+		app.Get("/changes", NewChangeHandler(zerolog.Nop(), failingLister{tt.err}).ListChanges)
+
+		resp, err := app.Test(httptest.NewRequest("GET", "/changes?cursor=1", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Error string `json:"error"`
+			Reset bool   `json:"reset"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status || body.Reset != tt.reset {
+			t.Errorf("%v: status %d, reset %v; want %d, %v", tt.err, resp.StatusCode, body.Reset, tt.status, tt.reset)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+
+	"github.com/tessera/tessera/internal/models"
+	"github.com/tessera/tessera/internal/storage"
+)
+
+// errRangeNotSatisfiable is returned for a Range that starts past the end of
+// the file
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// byteRange is a part of a file, as asked for by a Range header
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+// parseRange parses a Range header asking for one byte range of a size-byte
+// file. Headers it doesn't handle (another unit, several ranges or bad
+// syntax) return nil, and are answered with the whole file.
+func parseRange(header string, size int64) (*byteRange, error) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(header), "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return nil, nil
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return nil, nil
+	}
+
+	if first == "" {
+		// Suffix range: bytes=-500 is the last 500 bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return nil, nil
+		}
+		if n == 0 || size == 0 {
+			return nil, errRangeNotSatisfiable
+		}
+		n = min(n, size)
+		return &byteRange{start: size - n, length: n}, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return nil, nil
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return nil, nil
+		}
+	}
+	if start >= size {
+		return nil, errRangeNotSatisfiable
+	}
+	end = min(end, size-1)
+	return &byteRange{start: start, length: end - start + 1}, nil
+}
+
+// etagMatches reports whether an If-Match or If-None-Match list names etag.
+// Weak comparison ignores W/ prefixes, as If-None-Match requires.
+func etagMatches(list, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// contentResponse is how a GET or HEAD for a file's content is answered
+type contentResponse struct {
+	status int
+	start  int64
+	length int64
+}
+
+// evaluateContentRequest applies the conditional and Range headers of a
+// request, read with get, to a size-byte file with the given validators
+func evaluateContentRequest(get func(string) string, size int64, etag string, modified time.Time) contentResponse {
+	modified = modified.Truncate(time.Second)
+	since := func(header string) (time.Time, bool) {
+		t, err := http.ParseTime(get(header))
+		return t, err == nil
+	}
+
+	// Preconditions, in the order RFC 9110 section 13.2.2 evaluates them
+	if ifMatch := get("If-Match"); ifMatch != "" {
+		if !etagMatches(ifMatch, etag, false) {
+			return contentResponse{status: fiber.StatusPreconditionFailed}
+		}
+	} else if t, ok := since("If-Unmodified-Since"); ok && modified.After(t) {
+		return contentResponse{status: fiber.StatusPreconditionFailed}
+	}
+	if ifNoneMatch := get("If-None-Match"); ifNoneMatch != "" {
+		if etagMatches(ifNoneMatch, etag, true) {
+			return contentResponse{status: fiber.StatusNotModified}
+		}
+	} else if t, ok := since("If-Modified-Since"); ok && !modified.After(t) {
+		return contentResponse{status: fiber.StatusNotModified}
+	}
+
+	full := contentResponse{status: fiber.StatusOK, length: size}
+	header := get("Range")
+	if header == "" {
+		return full
+	}
+	// If-Range resumes a download only if the file is unchanged, otherwise
+	// the whole new file is sent
+	if ifRange := strings.TrimSpace(get("If-Range")); ifRange != "" {
+		if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+			if ifRange != etag {
+				return full
+			}
+		} else if t, ok := since("If-Range"); !ok || !t.Equal(modified) {
+			return full
+		}
+	}
+
+	r, err := parseRange(header, size)
+	if err != nil {
+		return contentResponse{status: fiber.StatusRequestedRangeNotSatisfiable}
+	}
+	if r == nil {
+		return full
+	}
+	return contentResponse{status: fiber.StatusPartialContent, start: r.start, length: r.length}
+}
+
+// fileContent is a file's stored object, ready to be served
+type fileContent struct {
+	file     *models.File
+	size     int64
+	etag     string
+	modified time.Time
+	response contentResponse
+}
+
+// prepareContent stats a file's object and works out how to answer the
+// request for it
+func prepareContent(c *fiber.Ctx, store storage.Storage, file *models.File) (*fileContent, error) {
+	info, err := store.Stat(c.Context(), file.StorageKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// The content hash changes exactly when the content does, so it makes a
+	// strong validator; files from before hashing fall back to the object's
+	etag := file.Hash
+	if etag == "" {
+		etag = strings.Trim(info.ETag, `"`)
+	}
+	content := &fileContent{
+		file:     file,
+		size:     info.Size,
+		etag:     `"` + etag + `"`,
+		modified: info.LastModified,
+	}
+	content.response = evaluateContentRequest(func(key string) string { return c.Get(key) },
+		content.size, content.etag, content.modified)
+	return content, nil
+}
+
+// startsFile reports whether the response sends the file from its first byte
+func (fc *fileContent) startsFile() bool {
+	status := fc.response.status
+	return (status == fiber.StatusOK || status == fiber.StatusPartialContent) && fc.response.start == 0
+}
+
+// send writes the response. The object is read while the response is
+// written, so memory use doesn't grow with the file. An empty disposition
+// leaves out Content-Disposition.
+func (fc *fileContent) send(c *fiber.Ctx, store storage.Storage, disposition string, log zerolog.Logger) error {
+	resp := fc.response
+	c.Set("Accept-Ranges", "bytes")
+	c.Set("ETag", fc.etag)
+	c.Set("Last-Modified", fc.modified.UTC().Format(http.TimeFormat))
+
+	switch resp.status {
+	case fiber.StatusNotModified, fiber.StatusPreconditionFailed:
+		return c.SendStatus(resp.status)
+	case fiber.StatusRequestedRangeNotSatisfiable:
+		c.Set("Content-Range", fmt.Sprintf("bytes */%d", fc.size))
+		return c.Status(resp.status).SendString("Range not satisfiable")
+	case fiber.StatusPartialContent:
+		c.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", resp.start, resp.start+resp.length-1, fc.size))
+	}
+
+	mimeType := fc.file.MimeType
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	c.Set("Content-Type", mimeType)
+	if disposition != "" {
+		// Sanitize filename to prevent header injection
+		safeName := sanitizeFilename(fc.file.Name)
+		c.Set("Content-Disposition", disposition+"; filename=\""+safeName+"\"; filename*=UTF-8''"+url.PathEscape(fc.file.Name))
+	}
+	c.Status(resp.status)
+
+	if c.Method() == fiber.MethodHead {
+		c.Response().Header.SetContentLength(int(resp.length))
+		return nil
+	}
+	if resp.length == 0 {
+		return c.Send(nil)
+	}
+
+	// The object is opened here but only read while fasthttp writes the
+	// response, after the handler returns; fasthttp closes it when done.
+	// The request context can't be used for it, as it ends with the handler.
+	var reader io.ReadCloser
+	var err error
+	if resp.start == 0 && resp.length == fc.size {
+		reader, err = store.Download(context.Background(), fc.file.StorageKey)
+	} else {
+		reader, err = store.DownloadRange(context.Background(), fc.file.StorageKey, resp.start, resp.length)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("file_id", fc.file.ID.String()).Msg("Failed to open file content")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read file",
+		})
+	}
+	c.Context().SetBodyStream(&loggedReader{ReadCloser: reader, file: fc.file, log: log}, int(resp.length))
+	return nil
+}
+
+// ServeContent answers a GET or HEAD request with a file's content. It
+// supports conditional requests against the file's ETag and Last-Modified,
+// and single Range requests (with If-Range) so downloads can be resumed.
+func ServeContent(c *fiber.Ctx, store storage.Storage, file *models.File, disposition string, log zerolog.Logger) error {
+	if file.Infected() {
+		return fileInfected(c)
+	}
+	content, err := prepareContent(c, store, file)
+	if err != nil {
+		log.Error().Err(err).Str("file_id", file.ID.String()).Msg("Failed to stat file content")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read file",
+		})
+	}
+	return content.send(c, store, disposition, log)
+}
+
+// loggedReader logs a storage error that cuts a streamed response short,
+// which otherwise only shows as a dropped connection
+type loggedReader struct {
+	io.ReadCloser
+	file *models.File
+	log  zerolog.Logger
+}
+
+func (r *loggedReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		r.log.Error().Err(err).Str("file_id", r.file.ID.String()).Msg("Failed to stream file content")
+	}
+	return n, err
+}
+
+// RequestBodyReader returns the request body without buffering it when the
+// server is streaming request bodies, along with its length, or -1 if the
+// client didn't send one (a chunked upload). A body small enough to arrive
+// with the headers has no stream; it's read from the request as received,
+// without decoding it into another copy.
+func RequestBodyReader(c *fiber.Ctx) (io.Reader, int64) {
+	if stream := c.Context().RequestBodyStream(); stream != nil {
+		return stream, max(int64(c.Request().Header.ContentLength()), -1)
+	}
+	body := c.Request().Body()
+	return bytes.NewReader(body), int64(len(body))
+}
@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header        string
+		start, length int64
+		ignored       bool
+		unsatisfiable bool
+	}{
+		{header: "bytes=0-99", start: 0, length: 100},
+		{header: "bytes=100-", start: 100, length: 900},
+		{header: "bytes=-100", start: 900, length: 100},
+		{header: "bytes=-5000", start: 0, length: 1000},
+		{header: "bytes=900-5000", start: 900, length: 100},
+		{header: "bytes=1000-", unsatisfiable: true},
+		{header: "bytes=-0", unsatisfiable: true},
+		{header: "bytes=0-1,5-6", ignored: true},
+		{header: "items=0-1", ignored: true},
+		{header: "bytes=5-1", ignored: true},
+		{header: "bytes=abc", ignored: true},
+	}
+	for _, tt := range tests {
+		r, err := parseRange(tt.header, 1000)
+		switch {
+		case tt.unsatisfiable:
+			if err != errRangeNotSatisfiable {
+				t.Errorf("%s: err = %v, want errRangeNotSatisfiable", tt.header, err)
+			}
+		case tt.ignored:
+			if r != nil || err != nil {
+				t.Errorf("%s: got %+v, %v, want it ignored", tt.header, r, err)
+			}
+		case err != nil || r == nil:
+			t.Errorf("%s: got %+v, %v", tt.header, r, err)
+		case r.start != tt.start || r.length != tt.length:
+			t.Errorf("%s: got %d+%d, want %d+%d", tt.header, r.start, r.length, tt.start, tt.length)
+		}
+	}
+}
+
+func TestEvaluateContentRequest(t *testing.T) {
+	modified := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	etag := `"abc"`
+	evaluate := func(headers map[string]string) contentResponse {
+		return evaluateContentRequest(func(key string) string { return headers[key] }, 1000, etag, modified)
+	}
+
+	t.Run("conditional GET", func(t *testing.T) {
+		if got := evaluate(map[string]string{"If-None-Match": `W/"abc"`}); got.status != 304 {
+			t.Errorf("matching If-None-Match: status = %d, want 304", got.status)
+		}
+		if got := evaluate(map[string]string{"If-None-Match": `"old"`}); got.status != 200 || got.length != 1000 {
+			t.Errorf("stale If-None-Match: got %+v, want the whole file", got)
+		}
+		if got := evaluate(map[string]string{"If-Modified-Since": modified.Format(http.TimeFormat)}); got.status != 304 {
+			t.Errorf("If-Modified-Since: status = %d, want 304", got.status)
+		}
+		// If-None-Match takes precedence over the date
+		got := evaluate(map[string]string{"If-None-Match": `"old"`, "If-Modified-Since": modified.Format(http.TimeFormat)})
+		if got.status != 200 {
+			t.Errorf("status = %d, want 200", got.status)
+		}
+		if got := evaluate(map[string]string{"If-Match": `"old"`}); got.status != 412 {
+			t.Errorf("If-Match: status = %d, want 412", got.status)
+		}
+	})
+
+	t.Run("If-Range", func(t *testing.T) {
+		got := evaluate(map[string]string{"Range": "bytes=500-", "If-Range": etag})
+		if got.status != 206 || got.start != 500 || got.length != 500 {
+			t.Errorf("matching ETag: got %+v, want bytes 500-999", got)
+		}
+		got = evaluate(map[string]string{"Range": "bytes=500-", "If-Range": modified.Format(http.TimeFormat)})
+		if got.status != 206 {
+			t.Errorf("matching date: status = %d, want 206", got.status)
+		}
+		got = evaluate(map[string]string{"Range": "bytes=500-", "If-Range": `"old"`})
+		if got.status != 200 || got.length != 1000 {
+			t.Errorf("changed file: got %+v, want the whole file", got)
+		}
+		got = evaluate(map[string]string{"Range": "bytes=500-", "If-Range": `W/"abc"`})
+		if got.status != 200 {
+			t.Errorf("weak ETag: status = %d, want 200", got.status)
+		}
+	})
+
+	if got := evaluate(map[string]string{"Range": "bytes=2000-"}); got.status != 416 {
+		t.Errorf("Range past the end: status = %d, want 416", got.status)
+	}
+}
@@ -1109,6 +1109,10 @@ func (h *EmailHandler) QueueSend(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Access denied"})
 	}
 
+	if err := h.emailService.ScanOutgoing(c.Context(), middleware.GetUserID(c), compose.FileAttachments); err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"error": err.Error()})
+	}
+
 	delay := account.SendDelay
 	if delay <= 0 {
 		// No delay, send immediately
@@ -1290,6 +1294,10 @@ func (h *EmailHandler) SendEmail(c *fiber.Ctx) error {
 		}
 	}
 
+	if err := h.emailService.ScanOutgoing(c.Context(), middleware.GetUserID(c), compose.FileAttachments); err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"error": err.Error()})
+	}
+
 	if err := h.emailService.SendEmail(c.Context(), compose.AccountID, compose); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": err.Error()})
 	}
@@ -1695,6 +1703,9 @@ func (h *EmailHandler) DownloadAttachment(c *fiber.Ctx) error {
 	}
 
 	attachment, data, err := h.emailService.DownloadAttachment(c.Context(), attachmentID)
+	if errors.Is(err, services.ErrInfected) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Attachment is infected and has been blocked"})
+	}
 	if err != nil {
 		log.Printf("Error downloading attachment: %v", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to download attachment"})
@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+	"github.com/tessera/tessera/internal/jobs"
+	"github.com/tessera/tessera/internal/middleware"
+	"github.com/tessera/tessera/internal/services"
+	"github.com/tessera/tessera/internal/storage"
+)
+
+// EncryptionHandler serves the admin controls for encryption at rest. The
+// service and store are nil when no master key is configured.
+type EncryptionHandler struct {
+	log          zerolog.Logger
+	encryption   *services.EncryptionService
+	emailService *services.EmailService
+	store        *storage.EncryptedStorage
+	queue        jobs.JobQueue
+}
+
+func NewEncryptionHandler(log zerolog.Logger, encryption *services.EncryptionService, emailService *services.EmailService, store *storage.EncryptedStorage, queue jobs.JobQueue) *EncryptionHandler {
+	return &EncryptionHandler{
+		log:          log,
+		encryption:   encryption,
+		emailService: emailService,
+		store:        store,
+		queue:        queue,
+	}
+}
+
+// encryptStorageKey keeps a second migration from being queued while one runs
+var encryptStorageKey = jobs.UniqueKey(jobs.JobTypeEncryptStorage, "all")
+
+// GetStatus reports whether encryption at rest is on, the state of the data
+// keys and the latest migration job
+func (h *EncryptionHandler) GetStatus(c *fiber.Ctx) error {
+	if h.encryption == nil {
+		return c.JSON(fiber.Map{"enabled": false, "encrypt_files": false})
+	}
+
+	ctx, cancel := context.WithTimeout(c.Context(), 10*time.Second)
+	defer cancel()
+
+	status, err := h.encryption.Status(ctx)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to get encryption status")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to get encryption status"})
+	}
+	var migration *jobs.Job
+	if list, _, err := h.queue.ListJobs(ctx, jobs.JobFilter{Type: jobs.JobTypeEncryptStorage, Limit: 1}); err == nil && len(list) > 0 {
+		migration = list[0]
+	}
+
+	return c.JSON(fiber.Map{
+		"enabled":             true,
+		"encrypt_files":       h.store.Encrypting(),
+		"master_key_id":       status.MasterKeyID,
+		"data_keys":           status.DataKeys,
+		"data_keys_to_rotate": status.DataKeysToRotate,
+		"migration":           migration,
+	})
+}
+
+// Migrate queues a job encrypting everything stored before encryption at
+// rest was turned on
+func (h *EncryptionHandler) Migrate(c *fiber.Ctx) error {
+	if h.store == nil || !h.store.Encrypting() {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Encryption at rest is not enabled"})
+	}
+
+	job, err := jobs.CreateJob(jobs.JobTypeEncryptStorage, jobs.EncryptStoragePayload{})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to queue encryption"})
+	}
+	job.UniqueKey = encryptStorageKey
+	err = h.queue.Enqueue(c.Context(), job)
+	if errors.Is(err, jobs.ErrDuplicateJob) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Encryption of existing files is already running"})
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to queue storage encryption")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to queue encryption"})
+	}
+
+	h.log.Info().
+		Str("job_id", job.ID).
+		Str("admin_id", middleware.GetUserID(c).String()).
+		Msg("Storage encryption queued")
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"job_id": job.ID})
+}
+
+// Rotate rewraps the data keys, and re-encrypts email account passwords,
+// with the current master key after it was changed. Stored files aren't
+// touched.
+func (h *EncryptionHandler) Rotate(c *fiber.Ctx) error {
+	if h.encryption == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "No encryption key is configured"})
+	}
+
+	ctx, cancel := context.WithTimeout(c.Context(), 5*time.Minute)
+	defer cancel()
+
+	rewrapped, err := h.encryption.RotateDataKeys(ctx)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to rewrap data keys")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to rewrap data keys"})
+	}
+	passwords, err := h.emailService.ReencryptPasswords(ctx)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to re-encrypt email passwords")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to re-encrypt email account passwords"})
+	}
+
+	h.log.Info().
+		Int("data_keys", rewrapped).
+		Int("email_accounts", passwords).
+		Str("admin_id", middleware.GetUserID(c).String()).
+		Msg("Master key rotated")
+
+	return c.JSON(fiber.Map{
+		"data_keys_rewrapped":    rewrapped,
+		"email_accounts_updated": passwords,
+	})
+}
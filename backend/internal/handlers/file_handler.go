@@ -4,9 +4,13 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
@@ -18,6 +22,7 @@ import (
 	"github.com/rs/zerolog"
 
 	"github.com/tessera/tessera/internal/middleware"
+	"github.com/tessera/tessera/internal/models"
 	"github.com/tessera/tessera/internal/repository"
 	"github.com/tessera/tessera/internal/services"
 	"github.com/tessera/tessera/internal/storage"
@@ -26,12 +31,13 @@ import (
 
 // FileHandler handles file operation endpoints
 type FileHandler struct {
-	fileService  *services.FileService
-	log          zerolog.Logger
-	hub          *websocket.Hub
-	jwtSecret    string
-	storage      storage.Storage
-	settingsRepo settingsRepo
+	fileService   *services.FileService
+	uploadService *services.UploadService
+	log           zerolog.Logger
+	hub           *websocket.Hub
+	jwtSecret     string
+	storage       storage.Storage
+	settingsRepo  settingsRepo
 }
 
 // settingsRepo is the minimal interface needed to check module settings.
@@ -40,14 +46,15 @@ type settingsRepo interface {
 }
 
 // NewFileHandler creates a new file handler
-func NewFileHandler(fileService *services.FileService, log zerolog.Logger, hub *websocket.Hub, jwtSecret string, store storage.Storage, sr settingsRepo) *FileHandler {
+func NewFileHandler(fileService *services.FileService, uploadService *services.UploadService, log zerolog.Logger, hub *websocket.Hub, jwtSecret string, store storage.Storage, sr settingsRepo) *FileHandler {
 	return &FileHandler{
-		fileService:  fileService,
-		log:          log,
-		hub:          hub,
-		jwtSecret:    jwtSecret,
-		storage:      store,
-		settingsRepo: sr,
+		fileService:   fileService,
+		uploadService: uploadService,
+		log:           log,
+		hub:           hub,
+		jwtSecret:     jwtSecret,
+		storage:       store,
+		settingsRepo:  sr,
 	}
 }
 
@@ -145,6 +152,9 @@ func (h *FileHandler) CreateFolder(c *fiber.Ctx) error {
 	})
 
 	if err != nil {
+		if errors.Is(err, services.ErrLocked) {
+			return fileLocked(c)
+		}
 		h.log.Error().Err(err).Msg("Failed to create folder")
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to create folder",
@@ -230,6 +240,12 @@ func (h *FileHandler) CreateDocumentFile(c *fiber.Ctx) error {
 	})
 
 	if err != nil {
+		if errors.Is(err, services.ErrLocked) {
+			return fileLocked(c)
+		}
+		if errors.Is(err, services.ErrQuotaExceeded) {
+			return quotaExceeded(c)
+		}
 		h.log.Error().Err(err).Msg("Failed to create document file")
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to create document file",
@@ -275,6 +291,9 @@ func (h *FileHandler) GetDocumentContent(c *fiber.Ctx) error {
 
 	// Get file content
 	reader, _, err := h.fileService.Download(c.Context(), fileID, userID)
+	if errors.Is(err, services.ErrInfected) {
+		return fileInfected(c)
+	}
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to read document",
@@ -369,6 +388,12 @@ func (h *FileHandler) UpdateDocumentContent(c *fiber.Ctx) error {
 	})
 
 	if err != nil {
+		if errors.Is(err, services.ErrLocked) {
+			return fileLocked(c)
+		}
+		if errors.Is(err, services.ErrQuotaExceeded) {
+			return quotaExceeded(c)
+		}
 		h.log.Error().Err(err).Msg("Failed to update document content")
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to update document",
@@ -422,6 +447,9 @@ func (h *FileHandler) Update(c *fiber.Ctx) error {
 
 	file, err := h.fileService.Update(c.Context(), input)
 	if err != nil {
+		if errors.Is(err, services.ErrLocked) {
+			return fileLocked(c)
+		}
 		if err == repository.ErrFileNotFound {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 				"error": "File not found",
@@ -485,6 +513,9 @@ func (h *FileHandler) Delete(c *fiber.Ctx) error {
 
 	if permanent {
 		if err := h.fileService.PermanentDelete(c.Context(), fileID, userID); err != nil {
+			if errors.Is(err, services.ErrLocked) {
+				return fileLocked(c)
+			}
 			if err == repository.ErrFileNotFound {
 				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 					"error": "File not found",
@@ -497,6 +528,9 @@ func (h *FileHandler) Delete(c *fiber.Ctx) error {
 		}
 	} else {
 		if err := h.fileService.Delete(c.Context(), fileID, userID); err != nil {
+			if errors.Is(err, services.ErrLocked) {
+				return fileLocked(c)
+			}
 			if err == repository.ErrFileNotFound {
 				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 					"error": "File not found",
@@ -536,6 +570,9 @@ func (h *FileHandler) Restore(c *fiber.Ctx) error {
 
 	file, err := h.fileService.Restore(c.Context(), fileID, userID)
 	if err != nil {
+		if errors.Is(err, services.ErrLocked) {
+			return fileLocked(c)
+		}
 		if err == repository.ErrFileNotFound {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 				"error": "File not found",
@@ -589,6 +626,12 @@ func (h *FileHandler) Copy(c *fiber.Ctx) error {
 
 	file, err := h.fileService.CopyFile(c.Context(), fileID, userID, destID, "")
 	if err != nil {
+		if errors.Is(err, services.ErrLocked) {
+			return fileLocked(c)
+		}
+		if errors.Is(err, services.ErrQuotaExceeded) {
+			return quotaExceeded(c)
+		}
 		if err == repository.ErrFileNotFound {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 				"error": "File not found",
@@ -614,7 +657,7 @@ func (h *FileHandler) Download(c *fiber.Ctx) error {
 		})
 	}
 
-	reader, file, err := h.fileService.Download(c.Context(), fileID, userID)
+	file, err := h.fileService.Get(c.Context(), fileID, userID)
 	if err != nil {
 		if err == repository.ErrFileNotFound {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
@@ -626,32 +669,245 @@ func (h *FileHandler) Download(c *fiber.Ctx) error {
 			"error": "Failed to download file",
 		})
 	}
+	if file.IsFolder {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Cannot download a folder",
+		})
+	}
+
+	// Use inline disposition for previewable types, attachment for others
+	disposition := "attachment"
+	if isPreviewable(file.MimeType) {
+		disposition = "inline"
+	}
+	return ServeContent(c, h.storage, file, disposition, h.log)
+}
+
+// DownloadArchive streams files and folders as one ZIP archive. The ids
+// query parameter lists them, separated by commas.
+func (h *FileHandler) DownloadArchive(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	ids, err := parseIDList(c.Query("ids"))
+	if err != nil || len(ids) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid ids",
+		})
+	}
+
+	archive, err := h.fileService.GetArchive(c.Context(), userID, ids)
+	if err != nil {
+		return h.archiveError(c, err)
+	}
+	return h.sendArchive(c, archive)
+}
+
+// parseIDList parses a comma-separated list of IDs
+func parseIDList(list string) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	for _, part := range strings.Split(list, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		id, err := uuid.Parse(part)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// archiveError answers a ZIP download that can't be made
+func (h *FileHandler) archiveError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, repository.ErrFileNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "File not found",
+		})
+	case errors.Is(err, services.ErrArchiveTooLarge):
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": fmt.Sprintf("Too many files, at most %d can be downloaded at once", services.MaxArchiveEntries),
+		})
+	}
+	h.log.Error().Err(err).Msg("Failed to prepare archive")
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "Failed to prepare download",
+	})
+}
+
+// sendArchive streams a ZIP archive as the response. It's written while
+// fasthttp sends the response, after the handler returns, so a storage
+// error can only cut it short; that's logged.
+func (h *FileHandler) sendArchive(c *fiber.Ctx, archive *services.Archive) error {
+	safeName := sanitizeFilename(archive.Name)
+	c.Set("Content-Type", "application/zip")
+	c.Set("Content-Disposition", "attachment; filename=\""+safeName+"\"; filename*=UTF-8''"+url.PathEscape(archive.Name))
+	if c.Method() == fiber.MethodHead {
+		return nil
+	}
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		if err := h.fileService.WriteArchive(context.Background(), w, archive); err != nil {
+			h.log.Error().Err(err).Str("archive", archive.Name).Msg("Failed to stream archive")
+			return
+		}
+		_ = w.Flush()
+	})
+	return nil
+}
+
+// Thumbnail serves a JPEG preview of an image, PDF or video
+func (h *FileHandler) Thumbnail(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	fileID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid file ID",
+		})
+	}
+
+	size := c.Query("size", services.DefaultThumbnailSize)
+	if _, ok := services.ThumbnailSizes[size]; !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid size, expected small, medium or large",
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(c.Context(), 10*time.Second)
+	defer cancel()
+
+	reader, thumb, err := h.fileService.GetThumbnail(ctx, fileID, userID, size)
+	if err != nil {
+		switch {
+		case errors.Is(err, repository.ErrFileNotFound):
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "File not found",
+			})
+		case errors.Is(err, services.ErrThumbnailUnsupported):
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "No thumbnail for this file type",
+			})
+		case errors.Is(err, services.ErrInfected):
+			return fileInfected(c)
+		case errors.Is(err, services.ErrThumbnailPending):
+			c.Set("Retry-After", "5")
+			return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+				"status": "pending",
+			})
+		}
+		h.log.Error().Err(err).Msg("Failed to get thumbnail")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get thumbnail",
+		})
+	}
 
-	// Read the entire file into memory before the handler returns.
-	// We cannot use defer reader.Close() + c.SendStream(reader) because
-	// fasthttp reads the body stream AFTER the handler returns, but defer
-	// would close the reader BEFORE that — resulting in truncated responses.
+	etag := fmt.Sprintf(`"%s-%s"`, thumb.SourceHash, size)
+	c.Set("ETag", etag)
+	c.Set("Cache-Control", "private, max-age=86400")
+	if c.Get("If-None-Match") == etag {
+		reader.Close()
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	// Thumbnails are small, so reading them whole is fine
 	data, readErr := io.ReadAll(reader)
 	reader.Close()
 	if readErr != nil {
-		h.log.Error().Err(readErr).Msg("Failed to read file data")
+		h.log.Error().Err(readErr).Msg("Failed to read thumbnail")
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to read file data",
+			"error": "Failed to read thumbnail",
 		})
 	}
 
-	c.Set("Content-Type", file.MimeType)
+	c.Set("Content-Type", "image/jpeg")
+	return c.Send(data)
+}
 
-	// Use inline disposition for previewable types, attachment for others
-	disposition := "attachment"
-	if isPreviewable(file.MimeType) {
-		disposition = "inline"
+// GetLocks lists the WebDAV locks covering a file
+func (h *FileHandler) GetLocks(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	fileID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid file ID",
+		})
 	}
-	// Sanitize filename to prevent header injection
-	safeName := sanitizeFilename(file.Name)
-	c.Set("Content-Disposition", disposition+"; filename=\""+safeName+"\"; filename*=UTF-8''"+url.PathEscape(file.Name))
 
-	return c.Send(data)
+	locks, err := h.fileService.GetLocks(c.Context(), fileID, userID)
+	if err != nil {
+		if err == repository.ErrFileNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "File not found",
+			})
+		}
+		h.log.Error().Err(err).Msg("Failed to get locks")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get locks",
+		})
+	}
+	if locks == nil {
+		locks = []*models.Lock{}
+	}
+
+	return c.JSON(fiber.Map{
+		"locks": locks,
+	})
+}
+
+// BreakLocks releases the WebDAV locks taken on a file, for when an editor
+// crashed or went offline without unlocking it
+func (h *FileHandler) BreakLocks(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	fileID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid file ID",
+		})
+	}
+
+	released, err := h.fileService.BreakLocks(c.Context(), fileID, userID)
+	if err != nil {
+		if err == repository.ErrFileNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "File not found",
+			})
+		}
+		h.log.Error().Err(err).Msg("Failed to break locks")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to break locks",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"released": released,
+	})
+}
+
+// fileLocked answers a write refused because the file is locked over WebDAV
+func fileLocked(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusLocked).JSON(fiber.Map{
+		"error": "File is locked for editing",
+	})
+}
+
+// fileInfected answers a download or share refused because the file was
+// found to contain malware
+func fileInfected(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+		"error": "File is infected and has been quarantined",
+	})
+}
+
+// quotaExceeded answers a write refused because it doesn't fit the user's
+// storage quota
+func quotaExceeded(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusPaymentRequired).JSON(fiber.Map{
+		"error": "Storage quota exceeded",
+	})
 }
 
 // sanitizeFilename removes characters that could be used for header injection
@@ -731,6 +987,12 @@ func (h *FileHandler) RestoreVersion(c *fiber.Ctx) error {
 
 	file, err := h.fileService.RestoreVersion(c.Context(), fileID, userID, version)
 	if err != nil {
+		if errors.Is(err, services.ErrLocked) {
+			return fileLocked(c)
+		}
+		if errors.Is(err, services.ErrQuotaExceeded) {
+			return quotaExceeded(c)
+		}
 		if err == repository.ErrFileNotFound {
 			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 				"error": "File or version not found",
@@ -745,25 +1007,129 @@ func (h *FileHandler) RestoreVersion(c *fiber.Ctx) error {
 	return c.JSON(file)
 }
 
-// Search finds files matching a query
+// PinVersion keeps a version of a file whatever the version retention
+// policy says
+func (h *FileHandler) PinVersion(c *fiber.Ctx) error {
+	return h.setVersionPinned(c, true)
+}
+
+// UnpinVersion lets the version retention policy prune a version again
+func (h *FileHandler) UnpinVersion(c *fiber.Ctx) error {
+	return h.setVersionPinned(c, false)
+}
+
+func (h *FileHandler) setVersionPinned(c *fiber.Ctx, pinned bool) error {
+	userID := middleware.GetUserID(c)
+
+	fileID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid file ID",
+		})
+	}
+
+	version, err := strconv.Atoi(c.Params("version"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid version number",
+		})
+	}
+
+	v, err := h.fileService.PinVersion(c.Context(), fileID, userID, version, pinned)
+	if err != nil {
+		if err == repository.ErrFileNotFound {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "File or version not found",
+			})
+		}
+		h.log.Error().Err(err).Msg("Failed to pin version")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update version",
+		})
+	}
+
+	return c.JSON(v)
+}
+
+// searchTypes are the file categories /search can filter by; a MIME type
+// works too
+var searchTypes = map[string]bool{
+	"folder": true, "image": true, "video": true, "audio": true, "document": true,
+}
+
+// Search finds files by name and content, best matches first
 func (h *FileHandler) Search(c *fiber.Ctx) error {
 	userID := middleware.GetUserID(c)
 
-	query := c.Query("q")
+	query := strings.TrimSpace(c.Query("q"))
 	if query == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "Search query is required",
 		})
 	}
 
-	limit := 50
-	if limitStr := c.Query("limit"); limitStr != "" {
-		if l, err := strconv.Atoi(limitStr); err == nil {
-			limit = l
+	page, _ := strconv.Atoi(c.Query("page", "1"))
+	limit, _ := strconv.Atoi(c.Query("limit", "50"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 50
+	}
+
+	filter := models.FileSearchFilter{
+		Query:  query,
+		Type:   c.Query("type"),
+		Limit:  limit,
+		Offset: (page - 1) * limit,
+	}
+	if filter.Type != "" && !searchTypes[filter.Type] && !strings.Contains(filter.Type, "/") {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid type, expected folder, image, video, audio, document or a MIME type",
+		})
+	}
+
+	for param, target := range map[string]**int64{"min_size": &filter.MinSize, "max_size": &filter.MaxSize} {
+		if value := c.Query(param); value != "" {
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Invalid " + param,
+				})
+			}
+			*target = &size
 		}
 	}
 
-	files, err := h.fileService.Search(c.Context(), userID, query, limit)
+	for param, target := range map[string]**time.Time{"modified_after": &filter.ModifiedAfter, "modified_before": &filter.ModifiedBefore} {
+		if value := c.Query(param); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				t, err = time.Parse("2006-01-02", value)
+			}
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Invalid " + param + ", expected RFC 3339 or YYYY-MM-DD",
+				})
+			}
+			*target = &t
+		}
+	}
+
+	if folderID := c.Query("folder_id"); folderID != "" {
+		id, err := uuid.Parse(folderID)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid folder_id",
+			})
+		}
+		filter.FolderID = &id
+	}
+
+	ctx, cancel := context.WithTimeout(c.Context(), 10*time.Second)
+	defer cancel()
+
+	results, total, err := h.fileService.Search(ctx, userID, filter)
 	if err != nil {
 		h.log.Error().Err(err).Msg("Search failed")
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -772,8 +1138,12 @@ func (h *FileHandler) Search(c *fiber.Ctx) error {
 	}
 
 	return c.JSON(fiber.Map{
-		"files": files,
-		"query": query,
+		"files":      results,
+		"query":      query,
+		"total":      total,
+		"page":       page,
+		"limit":      limit,
+		"totalPages": int(math.Ceil(float64(total) / float64(limit))),
 	})
 }
 
@@ -845,70 +1215,270 @@ func (h *FileHandler) StorageStats(c *fiber.Ctx) error {
 	return c.JSON(stats)
 }
 
-// Upload-related handlers (Tus protocol simplified implementation)
+// Upload-related handlers (Tus 1.0 resumable upload protocol)
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,termination,checksum,expiration"
+
+	// statusChecksumMismatch is defined by the Tus checksum extension
+	statusChecksumMismatch = 460
+)
+
+// UploadOptions advertises the server's Tus capabilities
+func (h *FileHandler) UploadOptions(c *fiber.Ctx) error {
+	c.Set("Tus-Resumable", tusVersion)
+	c.Set("Tus-Version", tusVersion)
+	c.Set("Tus-Extension", tusExtensions)
+	c.Set("Tus-Checksum-Algorithm", services.UploadChecksumAlgorithms)
+	if maxSize := h.uploadService.MaxSize(); maxSize > 0 {
+		c.Set("Tus-Max-Size", strconv.FormatInt(maxSize, 10))
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
 
 // InitiateUpload starts a new upload session
 func (h *FileHandler) InitiateUpload(c *fiber.Ctx) error {
+	if c.Get("Tus-Resumable") != tusVersion {
+		return tusVersionMismatch(c)
+	}
 	userID := middleware.GetUserID(c)
 
-	// Get upload metadata from headers (Tus protocol)
-	fileName := c.Get("Upload-Metadata") // Simplified - would need base64 decode
-	fileSize := c.Get("Upload-Length")
+	if c.Get("Upload-Defer-Length") != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Upload-Defer-Length is not supported",
+		})
+	}
 
-	size, err := strconv.ParseInt(fileSize, 10, 64)
-	if err != nil {
+	size, err := strconv.ParseInt(c.Get("Upload-Length"), 10, 64)
+	if err != nil || size < 0 {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "Invalid Upload-Length",
 		})
 	}
 
-	// Generate upload ID
-	uploadID := uuid.New().String()
+	rawMetadata := c.Get("Upload-Metadata")
+	metadata, err := parseUploadMetadata(rawMetadata)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid Upload-Metadata",
+		})
+	}
+
+	fileName := metadata["filename"]
+	if fileName == "" {
+		fileName = metadata["name"]
+	}
+	if fileName == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Upload-Metadata must include a filename",
+		})
+	}
+
+	var parentID *uuid.UUID
+	if parentIDStr := metadata["parent_id"]; parentIDStr != "" {
+		id, err := uuid.Parse(parentIDStr)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid parent_id",
+			})
+		}
+		parentID = &id
+	}
+
+	result, err := h.uploadService.Create(c.Context(), services.CreateUploadInput{
+		OwnerID:  userID,
+		ParentID: parentID,
+		FileName: fileName,
+		Length:   size,
+		Metadata: rawMetadata,
+	})
+	if err != nil {
+		return h.uploadError(c, err)
+	}
 
-	// TODO: Store upload session in Redis with metadata
-	_ = userID
-	_ = fileName
-	_ = size
+	session := result.Session
+	h.broadcastFileEvent(websocket.EventUploadStarted, fiber.Map{
+		"upload_id": session.ID,
+		"file_name": session.FileName,
+		"length":    session.Length,
+	}, userID, parentID)
 
-	c.Set("Location", "/api/upload/"+uploadID)
-	c.Set("Tus-Resumable", "1.0.0")
+	c.Set("Tus-Resumable", tusVersion)
+	c.Set("Location", "/api/upload/"+session.ID)
+	if result.File != nil {
+		h.broadcastUploadComplete(result, userID)
+	} else {
+		c.Set("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
 
 	return c.SendStatus(fiber.StatusCreated)
 }
 
-// ChunkUpload handles file chunk uploads
+// ChunkUpload appends a chunk to an upload, finalizing it on the last byte
 func (h *FileHandler) ChunkUpload(c *fiber.Ctx) error {
+	if c.Get("Tus-Resumable") != tusVersion {
+		return tusVersionMismatch(c)
+	}
+	userID := middleware.GetUserID(c)
 	uploadID := c.Params("uploadId")
-	_ = uploadID
 
-	// TODO: Implement chunk handling
-	// 1. Get upload session from Redis
-	// 2. Validate offset
-	// 3. Write chunk to temporary storage
-	// 4. Update offset
-	// 5. If complete, finalize upload
+	if c.Get("Content-Type") != "application/offset+octet-stream" {
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{
+			"error": "Content-Type must be application/offset+octet-stream",
+		})
+	}
+
+	offset, err := strconv.ParseInt(c.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid Upload-Offset",
+		})
+	}
+
+	body, size := RequestBodyReader(c)
+	result, err := h.uploadService.WriteChunk(c.Context(), uploadID, userID, offset, body, size, c.Get("Upload-Checksum"))
+	if err != nil {
+		return h.uploadError(c, err)
+	}
+
+	session := result.Session
+	h.broadcastFileEvent(websocket.EventUploadProgress, fiber.Map{
+		"upload_id": session.ID,
+		"file_name": session.FileName,
+		"offset":    session.Offset,
+		"length":    session.Length,
+	}, userID, session.ParentID)
 
-	c.Set("Tus-Resumable", "1.0.0")
-	c.Set("Upload-Offset", "0") // Would be actual offset
+	c.Set("Tus-Resumable", tusVersion)
+	c.Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	if result.File != nil {
+		h.broadcastUploadComplete(result, userID)
+	} else {
+		c.Set("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+	}
 
 	return c.SendStatus(fiber.StatusNoContent)
 }
 
 // UploadStatus returns the current upload offset
 func (h *FileHandler) UploadStatus(c *fiber.Ctx) error {
-	uploadID := c.Params("uploadId")
-	_ = uploadID
+	if c.Get("Tus-Resumable") != tusVersion {
+		return tusVersionMismatch(c)
+	}
+	userID := middleware.GetUserID(c)
 
-	// TODO: Get upload session from Redis and return offset
+	session, err := h.uploadService.Get(c.Context(), c.Params("uploadId"), userID)
+	if err != nil {
+		c.Set("Cache-Control", "no-store")
+		return h.uploadError(c, err)
+	}
 
-	c.Set("Tus-Resumable", "1.0.0")
-	c.Set("Upload-Offset", "0")
-	c.Set("Upload-Length", "0")
+	c.Set("Tus-Resumable", tusVersion)
+	c.Set("Upload-Offset", strconv.FormatInt(session.Offset, 10))
+	c.Set("Upload-Length", strconv.FormatInt(session.Length, 10))
+	c.Set("Upload-Expires", session.ExpiresAt.UTC().Format(http.TimeFormat))
+	if session.Metadata != "" {
+		c.Set("Upload-Metadata", session.Metadata)
+	}
 	c.Set("Cache-Control", "no-store")
 
 	return c.SendStatus(fiber.StatusOK)
 }
 
+// TerminateUpload aborts an upload and discards its data
+func (h *FileHandler) TerminateUpload(c *fiber.Ctx) error {
+	if c.Get("Tus-Resumable") != tusVersion {
+		return tusVersionMismatch(c)
+	}
+	userID := middleware.GetUserID(c)
+
+	if err := h.uploadService.Terminate(c.Context(), c.Params("uploadId"), userID); err != nil {
+		return h.uploadError(c, err)
+	}
+
+	c.Set("Tus-Resumable", tusVersion)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// broadcastUploadComplete notifies clients that an upload produced a file
+func (h *FileHandler) broadcastUploadComplete(result *services.UploadResult, userID uuid.UUID) {
+	h.broadcastFileEvent(websocket.EventUploadComplete, fiber.Map{
+		"upload_id": result.Session.ID,
+		"file":      result.File,
+	}, userID, result.File.ParentID)
+
+	eventType := websocket.EventFileCreated
+	if result.Replaced {
+		eventType = websocket.EventFileUpdated
+	}
+	h.broadcastFileEvent(eventType, result.File, userID, result.File.ParentID)
+}
+
+// uploadError maps upload service errors to Tus status codes
+func (h *FileHandler) uploadError(c *fiber.Ctx, err error) error {
+	c.Set("Tus-Resumable", tusVersion)
+
+	switch {
+	case errors.Is(err, repository.ErrUploadNotFound), errors.Is(err, repository.ErrFileNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Upload not found"})
+	case errors.Is(err, services.ErrUploadExpired):
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{"error": "Upload expired"})
+	case errors.Is(err, repository.ErrUploadLocked):
+		return c.Status(fiber.StatusLocked).JSON(fiber.Map{"error": "Upload is in use by another request"})
+	case errors.Is(err, services.ErrUploadOffsetMismatch):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Upload-Offset does not match"})
+	case errors.Is(err, services.ErrChecksumMismatch):
+		return c.Status(statusChecksumMismatch).JSON(fiber.Map{"error": "Checksum mismatch"})
+	case errors.Is(err, services.ErrUploadTruncated):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, services.ErrUnsupportedChecksum):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Unsupported checksum algorithm"})
+	case errors.Is(err, services.ErrUploadTooLarge), errors.Is(err, services.ErrUploadOverrun):
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, services.ErrQuotaExceeded):
+		return c.Status(fiber.StatusPaymentRequired).JSON(fiber.Map{"error": "Storage quota exceeded"})
+	case errors.Is(err, services.ErrLocked):
+		return c.Status(fiber.StatusLocked).JSON(fiber.Map{"error": "File is locked for editing"})
+	}
+
+	h.log.Error().Err(err).Msg("Upload failed")
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "Upload failed",
+	})
+}
+
+// tusVersionMismatch rejects requests from clients speaking another Tus version
+func tusVersionMismatch(c *fiber.Ctx) error {
+	c.Set("Tus-Version", tusVersion)
+	return c.Status(fiber.StatusPreconditionFailed).JSON(fiber.Map{
+		"error": "Unsupported Tus-Resumable version",
+	})
+}
+
+// parseUploadMetadata decodes a Tus Upload-Metadata header ("key base64,key base64")
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("empty metadata key")
+		}
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid metadata value for %q: %w", key, err)
+		}
+		metadata[key] = string(value)
+	}
+
+	return metadata, nil
+}
+
 // SimpleUpload handles simple file uploads (non-Tus)
 func (h *FileHandler) SimpleUpload(c *fiber.Ctx) error {
 	userID := middleware.GetUserID(c)
@@ -950,6 +1520,9 @@ func (h *FileHandler) SimpleUpload(c *fiber.Ctx) error {
 	})
 
 	if err != nil {
+		if errors.Is(err, services.ErrLocked) {
+			return fileLocked(c)
+		}
 		if err == services.ErrQuotaExceeded {
 			return c.Status(fiber.StatusPaymentRequired).JSON(fiber.Map{
 				"error": "Storage quota exceeded",
@@ -1001,6 +1574,9 @@ func (h *FileHandler) CreateShare(c *fiber.Ctx) error {
 		MaxDownloads:  req.MaxDownloads,
 	})
 
+	if errors.Is(err, services.ErrInfected) {
+		return fileInfected(c)
+	}
 	if err != nil {
 		h.log.Error().Err(err).Msg("Failed to create share")
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -1011,6 +1587,66 @@ func (h *FileHandler) CreateShare(c *fiber.Ctx) error {
 	return c.Status(fiber.StatusCreated).JSON(share)
 }
 
+// CreateFileRequestRequest represents the file request creation payload
+type CreateFileRequestRequest struct {
+	ExpiresInDays     *int     `json:"expires_in_days"`
+	Password          *string  `json:"password"`
+	MaxFileSize       *int64   `json:"max_file_size"`
+	MaxUploads        *int     `json:"max_uploads"`
+	AllowedExtensions []string `json:"allowed_extensions"`
+}
+
+// CreateFileRequest creates a link that lets anyone upload files into a
+// folder without seeing its contents
+func (h *FileHandler) CreateFileRequest(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	folderID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid file ID",
+		})
+	}
+
+	var req CreateFileRequestRequest
+	if err := c.BodyParser(&req); err != nil {
+		req = CreateFileRequestRequest{}
+	}
+	if (req.MaxFileSize != nil && *req.MaxFileSize <= 0) || (req.MaxUploads != nil && *req.MaxUploads <= 0) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "max_file_size and max_uploads must be positive",
+		})
+	}
+
+	request, err := h.fileService.CreateFileRequest(c.Context(), services.CreateFileRequestInput{
+		FolderID:          folderID,
+		OwnerID:           userID,
+		ExpiresInDays:     req.ExpiresInDays,
+		Password:          req.Password,
+		MaxFileSize:       req.MaxFileSize,
+		MaxUploads:        req.MaxUploads,
+		AllowedExtensions: req.AllowedExtensions,
+	})
+	if err != nil {
+		if errors.Is(err, repository.ErrFileNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Folder not found",
+			})
+		}
+		if errors.Is(err, services.ErrNotFolder) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "File requests can only be created for folders",
+			})
+		}
+		h.log.Error().Err(err).Msg("Failed to create file request")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create file request",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(request)
+}
+
 // GetShareAnalytics returns analytics for a file's share link
 func (h *FileHandler) GetShareAnalytics(c *fiber.Ctx) error {
 	userID := middleware.GetUserID(c)
@@ -1083,6 +1719,9 @@ func (h *FileHandler) ShareWithUser(c *fiber.Ctx) error {
 		Permission: req.Permission,
 	})
 
+	if errors.Is(err, services.ErrInfected) {
+		return fileInfected(c)
+	}
 	if err != nil {
 		h.log.Error().Err(err).Msg("Failed to share with user")
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -1185,9 +1824,12 @@ func (h *FileHandler) DownloadShare(c *fiber.Ctx) error {
 	token := c.Params("token")
 	password := c.Query("password")
 
-	reader, fileInfo, err := h.fileService.DownloadShare(c.Context(), token, password)
+	share, file, err := h.fileService.GetShareDownload(c.Context(), token, password)
 	if err != nil {
-		if err.Error() == "password required" || err.Error() == "invalid password" {
+		if errors.Is(err, services.ErrInfected) {
+			return fileInfected(c)
+		}
+		if errors.Is(err, services.ErrPasswordRequired) || errors.Is(err, services.ErrInvalidPassword) {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 				"error": err.Error(),
 			})
@@ -1197,20 +1839,158 @@ func (h *FileHandler) DownloadShare(c *fiber.Ctx) error {
 		})
 	}
 
-	data, readErr := io.ReadAll(reader)
-	reader.Close()
-	if readErr != nil {
-		h.log.Error().Err(readErr).Msg("Failed to read shared file data")
+	content, err := prepareContent(c, h.storage, file)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to stat shared file")
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to read file data",
+			"error": "Failed to read file",
 		})
 	}
 
-	safeName := sanitizeFilename(fileInfo.Name)
-	c.Set("Content-Disposition", "attachment; filename=\""+safeName+"\"; filename*=UTF-8''"+url.PathEscape(fileInfo.Name))
-	c.Set("Content-Type", fileInfo.MimeType)
+	// Only a response starting at the first byte counts as a download, so
+	// resuming one or revalidating a cached copy doesn't use up the limit
+	if content.startsFile() {
+		if err := h.fileService.CountShareDownload(c.Context(), share); err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Share not found or expired",
+			})
+		}
+	}
 
-	return c.Send(data)
+	return content.send(c, h.storage, "attachment", h.log)
+}
+
+// UploadToShare uploads a file to a file request (public). The visitor
+// only learns the name the file was stored under; the owner is notified.
+func (h *FileHandler) UploadToShare(c *fiber.Ctx) error {
+	token := c.Params("token")
+
+	fh, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "No file provided",
+		})
+	}
+	src, err := fh.Open()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read file",
+		})
+	}
+	defer src.Close()
+
+	password := c.FormValue("password")
+	if password == "" {
+		password = c.Query("password")
+	}
+
+	share, file, err := h.fileService.UploadToShare(c.Context(), services.FileRequestUpload{
+		Token:    token,
+		Password: password,
+		Name:     fh.Filename,
+		Size:     fh.Size,
+		Reader:   src,
+	})
+	if err != nil {
+		return h.fileRequestError(c, err)
+	}
+
+	// The owner sees the file appear in the folder and is told where it
+	// came from
+	h.broadcastFileEvent(websocket.EventFileCreated, file, share.OwnerID, file.ParentID)
+	if h.hub != nil {
+		h.hub.BroadcastToUser(share.OwnerID, &websocket.Event{
+			Type: websocket.EventFileRequestUpload,
+			Payload: fiber.Map{
+				"share_id": share.ID,
+				"token":    token,
+				"file":     file,
+			},
+			UserID:    share.OwnerID,
+			FolderID:  file.ParentID,
+			Timestamp: time.Now().UnixMilli(),
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"name": file.Name,
+		"size": file.Size,
+	})
+}
+
+// fileRequestError maps file request upload errors to status codes
+func (h *FileHandler) fileRequestError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, services.ErrPasswordRequired) || errors.Is(err, services.ErrInvalidPassword):
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	case errors.Is(err, services.ErrFileTypeNotAllowed):
+		return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{
+			"error": "File type not allowed",
+		})
+	case errors.Is(err, services.ErrFileTooLarge):
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+			"error": "File is too large",
+		})
+	case errors.Is(err, services.ErrFileRequestClosed):
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": "This file request is closed",
+		})
+	case errors.Is(err, services.ErrQuotaExceeded):
+		return c.Status(fiber.StatusInsufficientStorage).JSON(fiber.Map{
+			"error": "Not enough storage to accept this file",
+		})
+	case errors.Is(err, services.ErrLocked):
+		return fileLocked(c)
+	case errors.Is(err, repository.ErrFileNotFound), errors.Is(err, repository.ErrShareNotFound), errors.Is(err, services.ErrUploadNotAllowed):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Share not found or expired",
+		})
+	}
+	h.log.Error().Err(err).Msg("File request upload failed")
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "Upload failed",
+	})
+}
+
+// DownloadShareArchive downloads a shared folder, or a selection of files
+// and folders inside it, as a ZIP archive (public). Each archive counts as
+// one download of the share.
+func (h *FileHandler) DownloadShareArchive(c *fiber.Ctx) error {
+	token := c.Params("token")
+	password := c.Query("password")
+
+	ids, err := parseIDList(c.Query("ids"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid ids",
+		})
+	}
+
+	share, archive, err := h.fileService.GetShareArchive(c.Context(), token, password, ids)
+	if err != nil {
+		if errors.Is(err, services.ErrPasswordRequired) || errors.Is(err, services.ErrInvalidPassword) {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if errors.Is(err, services.ErrArchiveTooLarge) || errors.Is(err, repository.ErrFileNotFound) {
+			return h.archiveError(c, err)
+		}
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Share not found or expired",
+		})
+	}
+
+	if c.Method() != fiber.MethodHead {
+		if err := h.fileService.CountShareDownload(c.Context(), share); err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Share not found or expired",
+			})
+		}
+	}
+	return h.sendArchive(c, archive)
 }
 
 // streamTokenClaims represents a short-lived token for file streaming
@@ -1271,12 +2051,6 @@ func (h *FileHandler) StreamToken(c *fiber.Ctx) error {
 
 // StreamFile serves a file with HTTP Range request support for streaming playback.
 // Auth is via a short-lived token in the query string (so <video src="..."> works).
-//
-// IMPORTANT: We use c.Context().SetBodyStreamWriter() instead of c.SendStream()
-// because fasthttp reads the body stream AFTER the handler returns. If we used
-// defer reader.Close() + SendStream(), the reader would be closed before fasthttp
-// reads from it, producing empty/truncated responses. SetBodyStreamWriter gives us
-// a callback that runs during response writing, so the reader stays open.
 func (h *FileHandler) StreamFile(c *fiber.Ctx) error {
 	tokenString := c.Query("token")
 	if tokenString == "" {
@@ -1321,134 +2095,14 @@ func (h *FileHandler) StreamFile(c *fiber.Ctx) error {
 		})
 	}
 
-	// Get object info for Content-Length
-	objInfo, err := h.storage.Stat(c.Context(), file.StorageKey)
-	if err != nil {
-		h.log.Error().Err(err).Msg("Failed to stat file object")
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to read file",
+	if file.IsFolder {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Cannot stream a folder",
 		})
 	}
-	totalSize := objInfo.Size
 
-	// Set common headers
-	safeName := sanitizeFilename(file.Name)
-	c.Set("Content-Type", file.MimeType)
-	c.Set("Accept-Ranges", "bytes")
-	c.Set("Content-Disposition", "inline; filename=\""+safeName+"\"; filename*=UTF-8''"+url.PathEscape(file.Name))
 	c.Set("Cache-Control", "private, max-age=3600")
-
-	// Parse Range header
-	rangeHeader := c.Get("Range")
-	if rangeHeader == "" {
-		// No range — serve the entire file using stream writer
-		c.Set("Content-Length", strconv.FormatInt(totalSize, 10))
-		c.Status(fiber.StatusOK)
-
-		storageKey := file.StorageKey
-		c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
-			reader, err := h.storage.Download(context.Background(), storageKey)
-			if err != nil {
-				h.log.Error().Err(err).Msg("Stream: failed to download file")
-				return
-			}
-			defer reader.Close()
-
-			if _, err := io.Copy(w, reader); err != nil {
-				h.log.Error().Err(err).Msg("Stream: failed to write file to response")
-			}
-			w.Flush()
-		})
-		return nil
-	}
-
-	// Parse "bytes=start-end"
-	rangeHeader = strings.TrimPrefix(rangeHeader, "bytes=")
-	parts := strings.SplitN(rangeHeader, "-", 2)
-	if len(parts) != 2 {
-		c.Set("Content-Range", fmt.Sprintf("bytes */%d", totalSize))
-		return c.Status(fiber.StatusRequestedRangeNotSatisfiable).SendString("Invalid range")
-	}
-
-	var start, end int64
-	if parts[0] == "" {
-		// Suffix range: bytes=-500 → last 500 bytes
-		suffixLen, parseErr := strconv.ParseInt(parts[1], 10, 64)
-		if parseErr != nil || suffixLen <= 0 {
-			c.Set("Content-Range", fmt.Sprintf("bytes */%d", totalSize))
-			return c.Status(fiber.StatusRequestedRangeNotSatisfiable).SendString("Invalid range")
-		}
-		start = totalSize - suffixLen
-		if start < 0 {
-			start = 0
-		}
-		end = totalSize - 1
-	} else {
-		var parseErr error
-		start, parseErr = strconv.ParseInt(parts[0], 10, 64)
-		if parseErr != nil || start < 0 {
-			c.Set("Content-Range", fmt.Sprintf("bytes */%d", totalSize))
-			return c.Status(fiber.StatusRequestedRangeNotSatisfiable).SendString("Invalid range")
-		}
-		if parts[1] == "" {
-			end = totalSize - 1
-		} else {
-			end, parseErr = strconv.ParseInt(parts[1], 10, 64)
-			if parseErr != nil || end < start {
-				c.Set("Content-Range", fmt.Sprintf("bytes */%d", totalSize))
-				return c.Status(fiber.StatusRequestedRangeNotSatisfiable).SendString("Invalid range")
-			}
-		}
-	}
-
-	if start >= totalSize {
-		c.Set("Content-Range", fmt.Sprintf("bytes */%d", totalSize))
-		return c.Status(fiber.StatusRequestedRangeNotSatisfiable).SendString("Range not satisfiable")
-	}
-	if end >= totalSize {
-		end = totalSize - 1
-	}
-
-	contentLen := end - start + 1
-
-	c.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, totalSize))
-	c.Set("Content-Length", strconv.FormatInt(contentLen, 10))
-	c.Status(fiber.StatusPartialContent)
-
-	storageKey := file.StorageKey
-	rangeStart := start
-	rangeLen := contentLen
-	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
-		reader, err := h.storage.Download(context.Background(), storageKey)
-		if err != nil {
-			h.log.Error().Err(err).Msg("Stream range: failed to download file")
-			return
-		}
-		defer reader.Close()
-
-		// Seek to start position
-		if rangeStart > 0 {
-			if seeker, ok := reader.(io.Seeker); ok {
-				if _, err := seeker.Seek(rangeStart, io.SeekStart); err != nil {
-					h.log.Error().Err(err).Msg("Stream range: failed to seek")
-					return
-				}
-			} else {
-				// Fallback: discard bytes to reach start
-				if _, err := io.CopyN(io.Discard, reader, rangeStart); err != nil {
-					h.log.Error().Err(err).Msg("Stream range: failed to skip to start")
-					return
-				}
-			}
-		}
-
-		// Copy only the requested range
-		if _, err := io.CopyN(w, reader, rangeLen); err != nil && err != io.EOF {
-			h.log.Error().Err(err).Msg("Stream range: failed to write range to response")
-		}
-		w.Flush()
-	})
-	return nil
+	return ServeContent(c, h.storage, file, "inline", h.log)
 }
 
 // broadcastFileEvent sends a WebSocket event to subscribers
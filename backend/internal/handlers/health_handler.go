@@ -7,28 +7,33 @@ import (
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/jackc/pgx/v5/pgxpool"
-	"github.com/minio/minio-go/v7"
 	"github.com/redis/go-redis/v9"
 	"github.com/rs/zerolog"
 )
 
 var startTime = time.Now()
 
+// storageBackend is the object storage readiness checks ping
+type storageBackend interface {
+	Name() string
+	Ping(ctx context.Context) error
+}
+
 // HealthHandler handles health check endpoints
 type HealthHandler struct {
 	log   zerolog.Logger
 	db    *pgxpool.Pool
 	rdb   *redis.Client
-	minio *minio.Client
+	store storageBackend
 }
 
 // NewHealthHandler creates a new health handler
-func NewHealthHandler(log zerolog.Logger, db *pgxpool.Pool, rdb *redis.Client, minio *minio.Client) *HealthHandler {
+func NewHealthHandler(log zerolog.Logger, db *pgxpool.Pool, rdb *redis.Client, store storageBackend) *HealthHandler {
 	return &HealthHandler{
 		log:   log,
 		db:    db,
 		rdb:   rdb,
-		minio: minio,
+		store: store,
 	}
 }
 
@@ -82,10 +87,10 @@ func (h *HealthHandler) Readiness(c *fiber.Ctx) error {
 		overallStatus = "degraded"
 	}
 
-	// Check MinIO
-	minioHealth := h.checkMinIO(ctx)
-	components["minio"] = minioHealth
-	if minioHealth.Status != "ok" {
+	// Check object storage
+	storageHealth := h.checkStorage(ctx)
+	components["storage"] = storageHealth
+	if storageHealth.Status != "ok" {
 		overallStatus = "degraded"
 	}
 
@@ -165,31 +170,33 @@ func (h *HealthHandler) checkRedis(ctx context.Context) ComponentHealth {
 	}
 }
 
-// checkMinIO verifies MinIO connectivity
-func (h *HealthHandler) checkMinIO(ctx context.Context) ComponentHealth {
+// checkStorage verifies the object storage backend can be reached and
+// written to
+func (h *HealthHandler) checkStorage(ctx context.Context) ComponentHealth {
 	start := time.Now()
 
-	if h.minio == nil {
+	if h.store == nil {
 		return ComponentHealth{
 			Status:  "error",
-			Message: "MinIO client is nil",
+			Message: "Storage backend is nil",
 		}
 	}
 
-	_, err := h.minio.ListBuckets(ctx)
+	err := h.store.Ping(ctx)
 	latency := time.Since(start)
 
 	if err != nil {
-		h.log.Error().Err(err).Msg("MinIO health check failed")
+		h.log.Error().Err(err).Str("backend", h.store.Name()).Msg("Storage health check failed")
 		return ComponentHealth{
 			Status:  "error",
 			Latency: latency.String(),
-			Message: "ListBuckets failed",
+			Message: h.store.Name() + ": ping failed",
 		}
 	}
 
 	return ComponentHealth{
 		Status:  "ok",
 		Latency: latency.String(),
+		Message: "backend: " + h.store.Name(),
 	}
 }
@@ -0,0 +1,187 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+	"github.com/tessera/tessera/internal/jobs"
+	"github.com/tessera/tessera/internal/middleware"
+)
+
+// JobHandler serves the admin job console
+type JobHandler struct {
+	log   zerolog.Logger
+	queue jobs.JobQueue
+}
+
+func NewJobHandler(log zerolog.Logger, queue jobs.JobQueue) *JobHandler {
+	return &JobHandler{
+		log:   log,
+		queue: queue,
+	}
+}
+
+// GetStats returns queue counts and per-type throughput and latency over the
+// last `minutes` (default 60, at most one day)
+func (h *JobHandler) GetStats(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.Context(), 10*time.Second)
+	defer cancel()
+
+	minutes, _ := strconv.Atoi(c.Query("minutes", "60"))
+	if minutes < 1 || minutes > 24*60 {
+		minutes = 60
+	}
+
+	queue, err := h.queue.Stats(ctx)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to get job queue stats")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to get job stats"})
+	}
+	types, err := h.queue.TypeStats(ctx, time.Now().Add(-time.Duration(minutes)*time.Minute))
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to get job type stats")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to get job stats"})
+	}
+
+	return c.JSON(fiber.Map{
+		"queue":   queue,
+		"types":   types,
+		"minutes": minutes,
+	})
+}
+
+// ListJobs lists jobs, optionally filtered by type and status
+func (h *JobHandler) ListJobs(c *fiber.Ctx) error {
+	ctx, cancel := context.WithTimeout(c.Context(), 10*time.Second)
+	defer cancel()
+
+	page, _ := strconv.Atoi(c.Query("page", "1"))
+	limit, _ := strconv.Atoi(c.Query("limit", "50"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 200 {
+		limit = 50
+	}
+
+	filter := jobs.JobFilter{
+		Type:   jobs.JobType(c.Query("type")),
+		Status: jobs.JobStatus(c.Query("status")),
+		Limit:  limit,
+		Offset: (page - 1) * limit,
+	}
+	if filter.Type != "" && !jobs.IsKnownType(filter.Type) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Unknown job type"})
+	}
+
+	list, total, err := h.queue.ListJobs(ctx, filter)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to list jobs")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to list jobs"})
+	}
+
+	return c.JSON(fiber.Map{
+		"jobs":       list,
+		"total":      total,
+		"page":       page,
+		"limit":      limit,
+		"totalPages": int(math.Ceil(float64(total) / float64(limit))),
+	})
+}
+
+// GetJob returns one job with its payload and last error
+func (h *JobHandler) GetJob(c *fiber.Ctx) error {
+	job, err := h.queue.GetJob(c.Context(), c.Params("id"))
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to get job")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to get job"})
+	}
+	if job == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Job not found"})
+	}
+	return c.JSON(job)
+}
+
+// RetryJob queues a dead-lettered job again
+func (h *JobHandler) RetryJob(c *fiber.Ctx) error {
+	jobID := c.Params("id")
+	retried, err := h.queue.Retry(c.Context(), jobID)
+	if errors.Is(err, jobs.ErrDuplicateJob) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "An equivalent job is already queued"})
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to retry job")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to retry job"})
+	}
+	if !retried {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Only failed jobs can be retried"})
+	}
+
+	h.log.Info().
+		Str("job_id", jobID).
+		Str("admin_id", middleware.GetUserID(c).String()).
+		Msg("Job retried")
+
+	return c.JSON(fiber.Map{"message": "Job queued for retry"})
+}
+
+// CancelJob removes a pending or scheduled job
+func (h *JobHandler) CancelJob(c *fiber.Ctx) error {
+	jobID := c.Params("id")
+	cancelled, err := h.queue.Cancel(c.Context(), jobID)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to cancel job")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to cancel job"})
+	}
+	if !cancelled {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Only pending or scheduled jobs can be cancelled"})
+	}
+
+	h.log.Info().
+		Str("job_id", jobID).
+		Str("admin_id", middleware.GetUserID(c).String()).
+		Msg("Job cancelled")
+
+	return c.JSON(fiber.Map{"message": "Job cancelled"})
+}
+
+// PauseType stops workers from starting jobs of a type
+func (h *JobHandler) PauseType(c *fiber.Ctx) error {
+	return h.setPaused(c, true)
+}
+
+// ResumeType lets jobs of a paused type run again
+func (h *JobHandler) ResumeType(c *fiber.Ctx) error {
+	return h.setPaused(c, false)
+}
+
+func (h *JobHandler) setPaused(c *fiber.Ctx, paused bool) error {
+	jobType := jobs.JobType(c.Params("type"))
+	if !jobs.IsKnownType(jobType) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Unknown job type"})
+	}
+
+	var err error
+	if paused {
+		err = h.queue.Pause(c.Context(), jobType)
+	} else {
+		err = h.queue.Resume(c.Context(), jobType)
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to update job type")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to update job type"})
+	}
+
+	h.log.Info().
+		Str("job_type", string(jobType)).
+		Bool("paused", paused).
+		Str("admin_id", middleware.GetUserID(c).String()).
+		Msg("Job type paused state changed")
+
+	return c.JSON(fiber.Map{"type": jobType, "paused": paused})
+}
@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+	"github.com/tessera/tessera/internal/jobs"
+	"github.com/tessera/tessera/internal/middleware"
+	"github.com/tessera/tessera/internal/services"
+)
+
+// QuotaHandler serves the admin report of storage usage
+type QuotaHandler struct {
+	log   zerolog.Logger
+	quota *services.QuotaService
+	queue jobs.JobQueue
+}
+
+// NewQuotaHandler creates a new quota handler
+func NewQuotaHandler(log zerolog.Logger, quota *services.QuotaService, queue jobs.JobQueue) *QuotaHandler {
+	return &QuotaHandler{
+		log:   log,
+		quota: quota,
+		queue: queue,
+	}
+}
+
+// GetUsage returns the users taking up the most storage
+func (h *QuotaHandler) GetUsage(c *fiber.Ctx) error {
+	limit := min(max(c.QueryInt("limit", 20), 1), 200)
+
+	users, err := h.quota.TopConsumers(c.Context(), limit)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to get storage usage")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to get storage usage"})
+	}
+	return c.JSON(fiber.Map{
+		"users":         users,
+		"quotaWarnings": h.quota.QuotaWarnings(c.Context()),
+	})
+}
+
+// Reconcile queues correcting every user's storage used now, rather than
+// at the next scheduled run
+func (h *QuotaHandler) Reconcile(c *fiber.Ctx) error {
+	job, err := jobs.CreateJob(jobs.JobTypeQuotaCheck, jobs.QuotaCheckPayload{})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to queue quota check"})
+	}
+	job.UniqueKey = jobs.UniqueKey(jobs.JobTypeQuotaCheck, "all")
+	err = h.queue.Enqueue(c.Context(), job)
+	if errors.Is(err, jobs.ErrDuplicateJob) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "A quota check is already queued"})
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to queue quota check")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to queue quota check"})
+	}
+
+	h.log.Info().
+		Str("job_id", job.ID).
+		Str("admin_id", middleware.GetUserID(c).String()).
+		Msg("Quota check queued")
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"job_id": job.ID})
+}
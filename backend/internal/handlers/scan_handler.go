@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+	"github.com/tessera/tessera/internal/jobs"
+	"github.com/tessera/tessera/internal/middleware"
+	"github.com/tessera/tessera/internal/services"
+)
+
+// ScanHandler serves the admin controls for virus scanning
+type ScanHandler struct {
+	log   zerolog.Logger
+	scans *services.ScanService
+	queue jobs.JobQueue
+}
+
+// NewScanHandler creates a new scan handler
+func NewScanHandler(log zerolog.Logger, scans *services.ScanService, queue jobs.JobQueue) *ScanHandler {
+	return &ScanHandler{
+		log:   log,
+		scans: scans,
+		queue: queue,
+	}
+}
+
+// GetStatus returns whether scanning is enabled and working, how many files
+// are in each scan state, and the latest rescan job
+func (h *ScanHandler) GetStatus(c *fiber.Ctx) error {
+	overview, err := h.scans.Overview(c.Context())
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to get scan status")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to get scan status"})
+	}
+	var job *jobs.Job
+	if list, _, err := h.queue.ListJobs(c.Context(), jobs.JobFilter{Type: jobs.JobTypeVirusRescan, Limit: 1}); err == nil && len(list) > 0 {
+		job = list[0]
+	}
+
+	return c.JSON(fiber.Map{
+		"scan": overview,
+		"job":  job,
+	})
+}
+
+// Rescan queues scanning every stored file and email attachment again
+func (h *ScanHandler) Rescan(c *fiber.Ctx) error {
+	if !h.scans.Enabled() {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Virus scanning is not enabled"})
+	}
+
+	job, err := jobs.CreateJob(jobs.JobTypeVirusRescan, jobs.VirusRescanPayload{})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to queue rescan"})
+	}
+	job.UniqueKey = jobs.UniqueKey(jobs.JobTypeVirusRescan, "all")
+	// A failed rescan is run again by hand, once the scanner is back
+	job.MaxRetries = 1
+	err = h.queue.Enqueue(c.Context(), job)
+	if errors.Is(err, jobs.ErrDuplicateJob) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "A rescan is already running"})
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to queue rescan")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to queue rescan"})
+	}
+
+	h.log.Info().
+		Str("job_id", job.ID).
+		Str("admin_id", middleware.GetUserID(c).String()).
+		Msg("Virus rescan queued")
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"job_id": job.ID})
+}
+
+// ListInfected returns the quarantined files
+func (h *ScanHandler) ListInfected(c *fiber.Ctx) error {
+	limit := min(max(c.QueryInt("limit", 50), 1), 500)
+	offset := max(c.QueryInt("offset", 0), 0)
+
+	files, total, err := h.scans.ListInfected(c.Context(), limit, offset)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to list infected files")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to list infected files"})
+	}
+	return c.JSON(fiber.Map{
+		"files": files,
+		"total": total,
+	})
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+	"github.com/tessera/tessera/internal/jobs"
+	"github.com/tessera/tessera/internal/middleware"
+	"github.com/tessera/tessera/internal/repository"
+	"github.com/tessera/tessera/internal/services"
+)
+
+// StorageCheckHandler serves the admin controls for storage consistency
+// checks
+type StorageCheckHandler struct {
+	log    zerolog.Logger
+	checks *services.StorageCheckService
+	queue  jobs.JobQueue
+}
+
+// NewStorageCheckHandler creates a new storage check handler
+func NewStorageCheckHandler(log zerolog.Logger, checks *services.StorageCheckService, queue jobs.JobQueue) *StorageCheckHandler {
+	return &StorageCheckHandler{
+		log:    log,
+		checks: checks,
+		queue:  queue,
+	}
+}
+
+// storageCheckKey keeps a second check from being queued while one runs
+var storageCheckKey = jobs.UniqueKey(jobs.JobTypeStorageCheck, "all")
+
+// GetCheck returns the report of the last check and the latest check job
+func (h *StorageCheckHandler) GetCheck(c *fiber.Ctx) error {
+	report, err := h.checks.LatestReport(c.Context())
+	if err != nil && !errors.Is(err, repository.ErrNoStorageCheck) {
+		h.log.Error().Err(err).Msg("Failed to get storage check report")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to get storage check report"})
+	}
+	var job *jobs.Job
+	if list, _, err := h.queue.ListJobs(c.Context(), jobs.JobFilter{Type: jobs.JobTypeStorageCheck, Limit: 1}); err == nil && len(list) > 0 {
+		job = list[0]
+	}
+
+	return c.JSON(fiber.Map{
+		"report": report,
+		"job":    job,
+	})
+}
+
+// RunCheck queues a check with the given options
+func (h *StorageCheckHandler) RunCheck(c *fiber.Ctx) error {
+	var input services.StorageCheckOptions
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+	}
+	if input.HashSample < 0 || input.HashSample > 1 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "hashSample must be between 0 and 1"})
+	}
+
+	job, err := jobs.CreateJob(jobs.JobTypeStorageCheck, jobs.StorageCheckPayload{
+		HashSample: input.HashSample,
+		Quarantine: input.Quarantine,
+		MarkBroken: input.MarkBroken,
+		FixCounts:  input.FixCounts,
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to queue storage check"})
+	}
+	job.UniqueKey = storageCheckKey
+	// A failed check is run again by hand, with a look at why it failed
+	job.MaxRetries = 1
+	err = h.queue.Enqueue(c.Context(), job)
+	if errors.Is(err, jobs.ErrDuplicateJob) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "A storage check is already running"})
+	}
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to queue storage check")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to queue storage check"})
+	}
+
+	h.log.Info().
+		Str("job_id", job.ID).
+		Str("admin_id", middleware.GetUserID(c).String()).
+		Bool("quarantine", input.Quarantine).
+		Bool("mark_broken", input.MarkBroken).
+		Bool("fix_counts", input.FixCounts).
+		Msg("Storage check queued")
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{"job_id": job.ID})
+}
+
+// ListBroken returns the files and versions a check marked broken
+func (h *StorageCheckHandler) ListBroken(c *fiber.Ctx) error {
+	limit := min(max(c.QueryInt("limit", 50), 1), 500)
+	offset := max(c.QueryInt("offset", 0), 0)
+
+	files, total, err := h.checks.ListBroken(c.Context(), limit, offset)
+	if err != nil {
+		h.log.Error().Err(err).Msg("Failed to list broken files")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to list broken files"})
+	}
+	return c.JSON(fiber.Map{
+		"files": files,
+		"total": total,
+	})
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"errors"
+	"os"
+	"path"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+	"github.com/tessera/tessera/internal/models"
+	"github.com/tessera/tessera/internal/storage"
+)
+
+// signedStorage is a storage that serves objects over URLs it signed
+type signedStorage interface {
+	storage.Storage
+	VerifyURL(objectName, expires, signature string) error
+}
+
+// StorageHandler serves objects of the local storage backend over the
+// signed URLs it hands out in place of presigned ones
+type StorageHandler struct {
+	log   zerolog.Logger
+	store signedStorage
+}
+
+// NewStorageHandler creates a new storage handler
+func NewStorageHandler(log zerolog.Logger, store signedStorage) *StorageHandler {
+	return &StorageHandler{
+		log:   log,
+		store: store,
+	}
+}
+
+// ServeObject serves the object a signed URL names, with Range support.
+// The signature is the credential, so the route is public.
+func (h *StorageHandler) ServeObject(c *fiber.Ctx) error {
+	key := c.Query("key")
+	if err := h.store.VerifyURL(key, c.Query("expires"), c.Query("signature")); err != nil {
+		message := "Invalid signature"
+		if errors.Is(err, storage.ErrURLExpired) {
+			message = "URL expired"
+		}
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": message,
+		})
+	}
+
+	info, err := h.store.Stat(c.Context(), key)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Object not found",
+			})
+		}
+		h.log.Error().Err(err).Str("key", key).Msg("Failed to stat object")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read object",
+		})
+	}
+
+	object := &models.File{
+		Name:       path.Base(key),
+		StorageKey: key,
+		MimeType:   info.ContentType,
+	}
+	c.Set("Cache-Control", "private, no-store")
+	return ServeContent(c, h.store, object, "", h.log)
+}
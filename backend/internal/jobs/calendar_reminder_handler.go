@@ -0,0 +1,247 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tessera/tessera/internal/models"
+	"github.com/tessera/tessera/internal/repository"
+	"github.com/tessera/tessera/internal/services"
+	ws "github.com/tessera/tessera/internal/websocket"
+)
+
+const (
+	// reminderHorizon is how far ahead reminders are scheduled. The planner
+	// runs more often than this, so every reminder is scheduled at least once.
+	reminderHorizon = 10 * time.Minute
+	// reminderGrace is how late a reminder may still be delivered, e.g. after
+	// the server was down when it was due
+	reminderGrace = 15 * time.Minute
+	// reminderDeliveryRetention is how long delivered reminders are remembered
+	reminderDeliveryRetention = 7 * 24 * time.Hour
+)
+
+// CalendarReminderPlanner turns event reminders into scheduled reminder jobs.
+// It looks at a short window ahead and runs periodically, so reminders of
+// edited events are re-planned soon enough; delivered reminders are recorded
+// in the database, which keeps a reminder planned twice from firing twice.
+type CalendarReminderPlanner struct {
+	worker       *Worker
+	calendarRepo *repository.CalendarRepository
+	userRepo     *repository.UserRepository
+
+	mu sync.Mutex
+	// planned holds the reminders scheduled by this process, by plannedKey
+	planned   map[string]time.Time
+	lastPurge time.Time
+}
+
+// NewCalendarReminderPlanner creates a reminder planner
+func NewCalendarReminderPlanner(worker *Worker, calendarRepo *repository.CalendarRepository, userRepo *repository.UserRepository) *CalendarReminderPlanner {
+	return &CalendarReminderPlanner{
+		worker:       worker,
+		calendarRepo: calendarRepo,
+		userRepo:     userRepo,
+		planned:      make(map[string]time.Time),
+	}
+}
+
+func plannedKey(eventID uuid.UUID, fireAt time.Time) string {
+	return eventID.String() + "/" + strconv.FormatInt(fireAt.Unix(), 10)
+}
+
+// Plan schedules the reminders of all users that are due between from and to
+func (p *CalendarReminderPlanner) Plan(ctx context.Context, from, to time.Time) error {
+	// Stored times are wall-clock times in each owner's timezone; a day on
+	// either side covers every UTC offset
+	events, err := p.calendarRepo.ListWithReminders(ctx, from.Add(-24*time.Hour), to.Add(24*time.Hour))
+	if err != nil {
+		return err
+	}
+
+	locations := make(map[uuid.UUID]*time.Location)
+	for i := range events {
+		event := &events[i]
+		loc, ok := locations[event.UserID]
+		if !ok {
+			loc = p.userLocation(ctx, event.UserID)
+			locations[event.UserID] = loc
+		}
+		p.schedule(ctx, services.DueReminders(event, loc, from, to))
+	}
+
+	p.forget(from)
+
+	if time.Since(p.lastPurge) > time.Hour {
+		if _, err := p.calendarRepo.PurgeReminderDeliveries(ctx, time.Now().Add(-reminderDeliveryRetention)); err != nil {
+			log.Printf("[REMINDERS] Failed to purge delivered reminders: %v", err)
+		}
+		p.lastPurge = time.Now()
+	}
+	return nil
+}
+
+// PlanEventReminders schedules the upcoming reminders of one event right
+// after it was saved, instead of at the planner's next run
+func (p *CalendarReminderPlanner) PlanEventReminders(ctx context.Context, event *models.CalendarEvent) {
+	now := time.Now()
+	p.schedule(ctx, services.DueReminders(event, p.userLocation(ctx, event.UserID), now, now.Add(reminderHorizon)))
+}
+
+func (p *CalendarReminderPlanner) userLocation(ctx context.Context, userID uuid.UUID) *time.Location {
+	user, err := p.userRepo.GetByID(ctx, userID)
+	if err != nil {
+		return time.UTC
+	}
+	return services.UserLocation(user.Timezone)
+}
+
+func (p *CalendarReminderPlanner) schedule(ctx context.Context, due []services.ReminderFire) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, r := range due {
+		key := plannedKey(r.EventID, r.FireAt)
+		if _, ok := p.planned[key]; ok {
+			continue
+		}
+		payload := CalendarReminderPayload{
+			EventID: r.EventID.String(),
+			UserID:  r.UserID.String(),
+			Start:   r.Start,
+			Minutes: r.Minutes,
+			FireAt:  r.FireAt,
+		}
+		// The unique key keeps replicas from scheduling the same reminder twice
+		err := p.worker.ScheduleUnique(ctx, JobTypeCalendarReminder, UniqueKey(JobTypeCalendarReminder, key), payload, r.FireAt)
+		if err != nil && !errors.Is(err, ErrDuplicateJob) {
+			log.Printf("[REMINDERS] Failed to schedule reminder for event %s: %v", r.EventID, err)
+			continue
+		}
+		p.planned[key] = r.FireAt
+	}
+}
+
+// forget drops planned reminders that are older than any future window
+func (p *CalendarReminderPlanner) forget(before time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for key, fireAt := range p.planned {
+		if fireAt.Before(before) {
+			delete(p.planned, key)
+		}
+	}
+}
+
+// CalendarReminderHandler delivers due reminders over WebSocket and, when a
+// system mail account is configured, by email
+type CalendarReminderHandler struct {
+	calendarRepo *repository.CalendarRepository
+	userRepo     *repository.UserRepository
+	hub          *ws.Hub
+	mailer       *services.Mailer
+}
+
+// NewCalendarReminderHandler creates a new reminder handler
+func NewCalendarReminderHandler(calendarRepo *repository.CalendarRepository, userRepo *repository.UserRepository, hub *ws.Hub, mailer *services.Mailer) *CalendarReminderHandler {
+	return &CalendarReminderHandler{
+		calendarRepo: calendarRepo,
+		userRepo:     userRepo,
+		hub:          hub,
+		mailer:       mailer,
+	}
+}
+
+// Handle delivers one reminder, unless the event changed since it was planned
+func (h *CalendarReminderHandler) Handle(ctx context.Context, job *Job) error {
+	var payload CalendarReminderPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return fmt.Errorf("failed to unmarshal payload: %w", err)
+	}
+	if time.Since(payload.FireAt) > reminderGrace {
+		log.Printf("[REMINDERS] Skipping reminder for event %s, due at %s", payload.EventID, payload.FireAt)
+		return nil
+	}
+
+	eventID, err := uuid.Parse(payload.EventID)
+	if err != nil {
+		return fmt.Errorf("invalid event ID: %w", err)
+	}
+	userID, err := uuid.Parse(payload.UserID)
+	if err != nil {
+		return fmt.Errorf("invalid user ID: %w", err)
+	}
+
+	event, err := h.calendarRepo.GetByID(ctx, eventID, userID)
+	if errors.Is(err, repository.ErrEventNotFound) {
+		return nil // deleted since the reminder was planned
+	}
+	if err != nil {
+		return err
+	}
+	user, err := h.userRepo.GetByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	loc := services.UserLocation(user.Timezone)
+
+	// The event may have been edited since: only deliver if it still has this reminder
+	var reminder *services.ReminderFire
+	for _, r := range services.DueReminders(event, loc, payload.FireAt, payload.FireAt.Add(time.Second)) {
+		if r.Minutes == payload.Minutes && r.Start.Equal(payload.Start) {
+			reminder = &r
+			break
+		}
+	}
+	if reminder == nil {
+		return nil
+	}
+
+	claimed, err := h.calendarRepo.ClaimReminder(ctx, eventID, payload.FireAt)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return nil
+	}
+
+	h.hub.BroadcastToUser(userID, &ws.Event{
+		Type: ws.EventCalendarReminder,
+		Payload: map[string]interface{}{
+			"eventId":      reminder.EventID,
+			"recurrenceId": reminder.RecurrenceID,
+			"title":        reminder.Title,
+			"startDate":    reminder.Start,
+			"allDay":       reminder.AllDay,
+			"minutes":      reminder.Minutes,
+		},
+		UserID:    userID,
+		Timestamp: time.Now().UnixMilli(),
+	})
+
+	if h.mailer.Enabled() && user.Email != "" {
+		// The reminder is claimed already, so a failed email is not retried
+		// (which would repeat the WebSocket notification)
+		subject, body := reminderEmail(reminder, loc)
+		if err := h.mailer.Send(user.Email, subject, body); err != nil {
+			log.Printf("[REMINDERS] Failed to email reminder for event %s: %v", payload.EventID, err)
+		}
+	}
+	return nil
+}
+
+func reminderEmail(r *services.ReminderFire, loc *time.Location) (string, string) {
+	when := r.Start.Format("Monday, 2 January 2006")
+	if !r.AllDay {
+		when += " at " + r.Start.Format("15:04") + " (" + loc.String() + ")"
+	}
+	return "Reminder: " + r.Title, fmt.Sprintf("%s\n\n%s\n", r.Title, when)
+}
@@ -0,0 +1,74 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/tessera/tessera/internal/models"
+	"github.com/tessera/tessera/internal/services"
+)
+
+// EmailSendHandler sends emails that were queued for undo-send
+type EmailSendHandler struct {
+	emailService *services.EmailService
+}
+
+// NewEmailSendHandler creates a new email send handler
+func NewEmailSendHandler(emailService *services.EmailService) *EmailSendHandler {
+	return &EmailSendHandler{
+		emailService: emailService,
+	}
+}
+
+// Handle processes an email send job
+func (h *EmailSendHandler) Handle(ctx context.Context, job *Job) error {
+	var payload EmailSendPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+
+	compose := payload.Compose
+	compose.FileAttachments = payload.Files
+	if err := h.emailService.SendEmail(ctx, payload.AccountID, &compose); err != nil {
+		log.Printf("[EMAIL_SEND] Failed to send queued email %s: %v", job.ID, err)
+		return err
+	}
+
+	log.Printf("[EMAIL_SEND] Queued email %s sent", job.ID)
+	return nil
+}
+
+// EmailSendQueue keeps undo-send emails in the job queue, so they are sent
+// even if the server restarts during the delay
+type EmailSendQueue struct {
+	worker *Worker
+}
+
+// NewEmailSendQueue creates the job-backed queue for EmailService.SetSendQueue
+func NewEmailSendQueue(worker *Worker) *EmailSendQueue {
+	return &EmailSendQueue{worker: worker}
+}
+
+// ScheduleSend schedules an email; the send ID becomes the job ID
+func (q *EmailSendQueue) ScheduleSend(ctx context.Context, sendID, accountID string, compose *models.ComposeEmail, sendAt time.Time) error {
+	job, err := CreateJob(JobTypeEmailSend, EmailSendPayload{
+		AccountID: accountID,
+		Compose:   *compose,
+		Files:     compose.FileAttachments,
+	})
+	if err != nil {
+		return err
+	}
+	job.ID = sendID
+	// A failure may come after the server accepted the message, and retrying
+	// would send it twice; failed sends go to the dead-letter set instead
+	job.MaxRetries = 1
+	return q.worker.queue.Schedule(ctx, job, sendAt)
+}
+
+// CancelSend cancels a scheduled email; it reports false once sending started
+func (q *EmailSendQueue) CancelSend(ctx context.Context, sendID string) (bool, error) {
+	return q.worker.Cancel(ctx, sendID)
+}
@@ -0,0 +1,75 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/tessera/tessera/internal/services"
+	"github.com/tessera/tessera/internal/storage"
+)
+
+// encryptStorageBatch is how many objects are listed at a time
+const encryptStorageBatch = 100
+
+// EncryptStorageHandler encrypts the objects stored before encryption at
+// rest was turned on. Objects already encrypted are skipped, so a job that
+// failed or timed out can simply run again.
+type EncryptStorageHandler struct {
+	encryption *services.EncryptionService
+	store      *storage.EncryptedStorage
+}
+
+// NewEncryptStorageHandler creates a new storage encryption handler
+func NewEncryptStorageHandler(encryption *services.EncryptionService, store *storage.EncryptedStorage) *EncryptStorageHandler {
+	return &EncryptStorageHandler{
+		encryption: encryption,
+		store:      store,
+	}
+}
+
+// Handle encrypts every plaintext object, each with its owner's data key
+func (h *EncryptStorageHandler) Handle(ctx context.Context, job *Job) error {
+	var payload EncryptStoragePayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return fmt.Errorf("failed to unmarshal payload: %w", err)
+	}
+	if !h.store.Encrypting() {
+		return fmt.Errorf("encryption at rest is not enabled")
+	}
+
+	after := payload.After
+	checked, encrypted, failed := 0, 0, 0
+	for {
+		objects, err := h.encryption.ListStoredObjects(ctx, after, encryptStorageBatch)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objects {
+			ok, err := h.store.EncryptObject(ctx, obj.Key, obj.OwnerID)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			checked++
+			switch {
+			case err != nil:
+				log.Printf("[ENCRYPTION] Failed to encrypt %s: %v", obj.Key, err)
+				failed++
+			case ok:
+				encrypted++
+			}
+		}
+		if len(objects) < encryptStorageBatch {
+			break
+		}
+		after = objects[len(objects)-1].Key
+		log.Printf("[ENCRYPTION] Checked %d objects, encrypted %d", checked, encrypted)
+	}
+
+	log.Printf("[ENCRYPTION] Encrypted %d of %d objects", encrypted, checked)
+	if failed > 0 {
+		return fmt.Errorf("failed to encrypt %d of %d objects", failed, checked)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/tessera/tessera/internal/repository"
+	"github.com/tessera/tessera/internal/services"
+)
+
+// FileIndexHandler keeps the full-text index of file contents up to date
+type FileIndexHandler struct {
+	fileRepo *repository.FileRepository
+	index    *services.FileIndexService
+}
+
+// NewFileIndexHandler creates a new file index handler
+func NewFileIndexHandler(fileRepo *repository.FileRepository, index *services.FileIndexService) *FileIndexHandler {
+	return &FileIndexHandler{
+		fileRepo: fileRepo,
+		index:    index,
+	}
+}
+
+// Handle indexes the current content of a file, or drops it from the index
+func (h *FileIndexHandler) Handle(ctx context.Context, job *Job) error {
+	var payload FileIndexPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return fmt.Errorf("failed to unmarshal payload: %w", err)
+	}
+
+	fileID, err := uuid.Parse(payload.FileID)
+	if err != nil {
+		return fmt.Errorf("invalid file ID: %w", err)
+	}
+
+	if payload.Action == "delete" {
+		return h.index.Remove(ctx, fileID)
+	}
+
+	file, err := h.fileRepo.GetByID(ctx, fileID)
+	if errors.Is(err, repository.ErrFileNotFound) {
+		// Deleted since; its index entry went with it
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := h.index.Index(ctx, file); err != nil {
+		return err
+	}
+
+	// Content uploaded while this job ran had its own job rejected as a
+	// duplicate of this one; failing makes the retry pick it up
+	current, err := h.fileRepo.GetByID(ctx, fileID)
+	if err == nil && current.Hash != file.Hash {
+		return fmt.Errorf("file %s changed while it was indexed", file.ID)
+	}
+
+	log.Printf("[FILE_INDEX] Indexed file %s", file.ID)
+	return nil
+}
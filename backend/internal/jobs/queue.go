@@ -3,6 +3,8 @@ package jobs
 import (
 	"context"
 	"encoding/json"
+	"math/rand"
+	"sort"
 	"sync"
 	"time"
 
@@ -10,15 +12,29 @@ import (
 )
 
 // MemoryQueue is an in-memory implementation of JobQueue
-// This is suitable for single-instance deployments
-// For production multi-instance setups, use RedisQueue
+// This is suitable for single-instance deployments and tests; jobs do not
+// survive a restart. For production multi-instance setups, use RedisQueue
 type MemoryQueue struct {
 	jobs      map[string]*Job
 	pending   chan *Job
 	scheduled []*Job
+	paused    map[JobType]bool
+	runs      []jobRun
 	mu        sync.RWMutex
 }
 
+// jobRun records one finished run for TypeStats
+type jobRun struct {
+	jobType  JobType
+	ok       bool
+	at       time.Time
+	duration time.Duration
+	wait     time.Duration
+}
+
+// runRetention is how long finished runs count towards TypeStats
+const runRetention = 24 * time.Hour
+
 // NewMemoryQueue creates a new in-memory job queue
 func NewMemoryQueue(bufferSize int) *MemoryQueue {
 	if bufferSize <= 0 {
@@ -28,14 +44,53 @@ func NewMemoryQueue(bufferSize int) *MemoryQueue {
 		jobs:      make(map[string]*Job),
 		pending:   make(chan *Job, bufferSize),
 		scheduled: make([]*Job, 0),
+		paused:    make(map[JobType]bool),
 	}
 }
 
+// Retry delays grow exponentially from retryBaseDelay up to retryMaxDelay
+const (
+	retryBaseDelay = 5 * time.Second
+	retryMaxDelay  = time.Hour
+)
+
+// retryBackoff returns how long to wait before retrying a job that failed
+// for the given number of times. Up to a fifth is added at random so jobs
+// that failed together do not all retry at the same moment.
+func retryBackoff(attempts int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempts && delay < retryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay/5)+1))
+}
+
+// active reports whether a job still counts against its unique key
+func (j *Job) active() bool {
+	return j.Status == JobStatusPending || j.Status == JobStatusRunning || j.Status == JobStatusRetrying
+}
+
+// hasActive reports whether an active job holds the unique key. Callers hold q.mu.
+func (q *MemoryQueue) hasActive(uniqueKey string) bool {
+	for _, job := range q.jobs {
+		if job.UniqueKey == uniqueKey && job.active() {
+			return true
+		}
+	}
+	return false
+}
+
 // Enqueue adds a job to the queue
 func (q *MemoryQueue) Enqueue(ctx context.Context, job *Job) error {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
+	if job.UniqueKey != "" && q.hasActive(job.UniqueKey) {
+		return ErrDuplicateJob
+	}
 	if job.ID == "" {
 		job.ID = uuid.New().String()
 	}
@@ -46,56 +101,52 @@ func (q *MemoryQueue) Enqueue(ctx context.Context, job *Job) error {
 		job.MaxRetries = 3
 	}
 
-	q.jobs[job.ID] = job
-
 	select {
 	case q.pending <- job:
+		q.jobs[job.ID] = job
 		return nil
 	case <-ctx.Done():
 		return ctx.Err()
 	default:
-		// Queue is full, job is stored but won't be processed immediately
-		return nil
+		return ErrQueueFull
 	}
 }
 
-// IsJobRunning checks if a job of the given type is currently running or pending for the given key
-// For email sync jobs, the key is the account ID
-func (q *MemoryQueue) IsJobRunning(jobType JobType, key string) bool {
+// IsActive checks if a job with the given unique key is pending or running
+func (q *MemoryQueue) IsActive(ctx context.Context, uniqueKey string) (bool, error) {
 	q.mu.RLock()
 	defer q.mu.RUnlock()
 
-	for _, job := range q.jobs {
-		if job.Type != jobType {
-			continue
-		}
-		if job.Status != JobStatusRunning && job.Status != JobStatusPending {
-			continue
-		}
-		// For email sync, check the account ID in the payload
-		if jobType == JobTypeEmailSync {
-			var payload EmailSyncPayload
-			if err := json.Unmarshal(job.Payload, &payload); err == nil {
-				if payload.AccountID == key {
-					return true
-				}
-			}
-		}
-	}
-	return false
+	return q.hasActive(uniqueKey), nil
 }
 
-// Dequeue retrieves the next job from the queue
-func (q *MemoryQueue) Dequeue(ctx context.Context) (*Job, error) {
-	select {
-	case job := <-q.pending:
-		q.mu.Lock()
-		job.Status = JobStatusRunning
-		job.UpdatedAt = time.Now()
-		q.mu.Unlock()
-		return job, nil
-	case <-ctx.Done():
-		return nil, ctx.Err()
+// Dequeue retrieves the next job from the queue. All types are served, as
+// the only worker is the one of this process.
+func (q *MemoryQueue) Dequeue(ctx context.Context, types []JobType) (*Job, error) {
+	for {
+		select {
+		case job := <-q.pending:
+			q.mu.Lock()
+			if _, ok := q.jobs[job.ID]; !ok {
+				// Cancelled while waiting
+				q.mu.Unlock()
+				continue
+			}
+			if q.paused[job.Type] {
+				// Held back until the type is resumed
+				q.scheduled = append(q.scheduled, job)
+				q.mu.Unlock()
+				continue
+			}
+			now := time.Now()
+			job.Status = JobStatusRunning
+			job.StartedAt = &now
+			job.UpdatedAt = now
+			q.mu.Unlock()
+			return job, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
 }
 
@@ -105,34 +156,43 @@ func (q *MemoryQueue) MarkCompleted(ctx context.Context, jobID string) error {
 	defer q.mu.Unlock()
 
 	if job, ok := q.jobs[jobID]; ok {
+		now := time.Now()
+		q.recordRun(job, true, now)
 		job.Status = JobStatusCompleted
-		job.UpdatedAt = time.Now()
+		job.FinishedAt = &now
+		job.UpdatedAt = now
 	}
 	return nil
 }
 
-// MarkFailed marks a job as failed
+// recordRun counts a finished run. Callers hold q.mu.
+func (q *MemoryQueue) recordRun(job *Job, ok bool, now time.Time) {
+	duration, wait := job.runTimes(now)
+	q.runs = append(q.runs, jobRun{jobType: job.Type, ok: ok, at: now, duration: duration, wait: wait})
+	for len(q.runs) > 0 && now.Sub(q.runs[0].at) > runRetention {
+		q.runs = q.runs[1:]
+	}
+}
+
+// MarkFailed marks a job as failed, scheduling a retry while it has retries left
 func (q *MemoryQueue) MarkFailed(ctx context.Context, jobID string, err error) error {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
 	if job, ok := q.jobs[jobID]; ok {
+		now := time.Now()
+		q.recordRun(job, false, now)
 		job.Attempts++
 		job.Error = err.Error()
-		job.UpdatedAt = time.Now()
+		job.UpdatedAt = now
 
 		if job.Attempts < job.MaxRetries {
 			job.Status = JobStatusRetrying
-			// Re-queue the job
-			go func() {
-				time.Sleep(time.Duration(job.Attempts) * time.Second * 5) // Exponential backoff
-				select {
-				case q.pending <- job:
-				default:
-				}
-			}()
+			job.RunAt = now.Add(retryBackoff(job.Attempts))
+			q.scheduled = append(q.scheduled, job)
 		} else {
-			job.Status = JobStatusFailed
+			job.Status = JobStatusDead
+			job.FinishedAt = &now
 		}
 	}
 	return nil
@@ -143,6 +203,9 @@ func (q *MemoryQueue) Schedule(ctx context.Context, job *Job, runAt time.Time) e
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
+	if job.UniqueKey != "" && q.hasActive(job.UniqueKey) {
+		return ErrDuplicateJob
+	}
 	if job.ID == "" {
 		job.ID = uuid.New().String()
 	}
@@ -159,6 +222,31 @@ func (q *MemoryQueue) Schedule(ctx context.Context, job *Job, runAt time.Time) e
 	return nil
 }
 
+// Cancel removes a job that has not started yet
+func (q *MemoryQueue) Cancel(ctx context.Context, jobID string) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[jobID]
+	if !ok || job.Status == JobStatusRunning || !job.active() {
+		return false, nil
+	}
+	delete(q.jobs, jobID)
+	for i, scheduled := range q.scheduled {
+		if scheduled.ID == jobID {
+			q.scheduled = append(q.scheduled[:i], q.scheduled[i+1:]...)
+			break
+		}
+	}
+	return true, nil
+}
+
+// Extend is a no-op: jobs of the in-memory queue die with the process, so a
+// running job never needs to be handed out again
+func (q *MemoryQueue) Extend(ctx context.Context, jobID string) error {
+	return nil
+}
+
 // GetJob retrieves a job by ID
 func (q *MemoryQueue) GetJob(ctx context.Context, jobID string) (*Job, error) {
 	q.mu.RLock()
@@ -185,7 +273,7 @@ func (q *MemoryQueue) GetPendingJobs(ctx context.Context, jobType JobType) ([]*J
 }
 
 // ProcessScheduled checks and enqueues scheduled jobs that are ready
-func (q *MemoryQueue) ProcessScheduled() {
+func (q *MemoryQueue) ProcessScheduled(ctx context.Context) error {
 	q.mu.Lock()
 	defer q.mu.Unlock()
 
@@ -193,20 +281,23 @@ func (q *MemoryQueue) ProcessScheduled() {
 	remaining := make([]*Job, 0)
 
 	for _, job := range q.scheduled {
-		if job.RunAt.Before(now) || job.RunAt.Equal(now) {
-			select {
-			case q.pending <- job:
-			default:
-			}
-		} else {
+		if job.RunAt.After(now) || q.paused[job.Type] {
+			remaining = append(remaining, job)
+			continue
+		}
+		select {
+		case q.pending <- job:
+		default:
+			// Queue is full, try again on the next run
 			remaining = append(remaining, job)
 		}
 	}
 	q.scheduled = remaining
+	return nil
 }
 
 // Stats returns queue statistics
-func (q *MemoryQueue) Stats() map[string]interface{} {
+func (q *MemoryQueue) Stats(ctx context.Context) (map[string]interface{}, error) {
 	q.mu.RLock()
 	defer q.mu.RUnlock()
 
@@ -219,11 +310,134 @@ func (q *MemoryQueue) Stats() map[string]interface{} {
 	}
 
 	return map[string]interface{}{
+		"backend":   "memory",
 		"total":     len(q.jobs),
 		"pending":   len(q.pending),
 		"scheduled": len(q.scheduled),
 		"by_status": statusCounts,
 		"by_type":   typeCounts,
+	}, nil
+}
+
+// ListJobs returns the jobs matching the filter
+func (q *MemoryQueue) ListJobs(ctx context.Context, filter JobFilter) ([]*Job, int, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	var matched []*Job
+	for _, job := range q.jobs {
+		if filter.Type != "" && job.Type != filter.Type {
+			continue
+		}
+		if filter.Status != "" && job.Status != filter.Status {
+			continue
+		}
+		copied := *job
+		matched = append(matched, &copied)
+	}
+	return pageJobs(matched, filter), len(matched), nil
+}
+
+// pageJobs sorts jobs by last update, newest first, and applies the
+// filter's offset and limit
+func pageJobs(jobs []*Job, filter JobFilter) []*Job {
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].UpdatedAt.After(jobs[j].UpdatedAt) })
+	if filter.Offset >= len(jobs) {
+		return []*Job{}
+	}
+	jobs = jobs[filter.Offset:]
+	if filter.Limit > 0 && filter.Limit < len(jobs) {
+		jobs = jobs[:filter.Limit]
+	}
+	return jobs
+}
+
+// Retry queues a dead-lettered job again
+func (q *MemoryQueue) Retry(ctx context.Context, jobID string) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[jobID]
+	if !ok || job.Status != JobStatusDead {
+		return false, nil
+	}
+	if job.UniqueKey != "" && q.hasActive(job.UniqueKey) {
+		return false, ErrDuplicateJob
+	}
+	job.resetForRetry()
+	q.scheduled = append(q.scheduled, job)
+	return true, nil
+}
+
+// resetForRetry prepares a dead-lettered job to run again from scratch
+func (j *Job) resetForRetry() {
+	now := time.Now()
+	j.Status = JobStatusPending
+	j.Attempts = 0
+	j.RunAt = now
+	j.UpdatedAt = now
+	j.StartedAt = nil
+	j.FinishedAt = nil
+}
+
+// Pause holds back jobs of a type
+func (q *MemoryQueue) Pause(ctx context.Context, jobType JobType) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.paused[jobType] = true
+	return nil
+}
+
+// Resume lets jobs of a paused type run again
+func (q *MemoryQueue) Resume(ctx context.Context, jobType JobType) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.paused, jobType)
+	return nil
+}
+
+// PausedTypes returns the paused job types
+func (q *MemoryQueue) PausedTypes(ctx context.Context) ([]JobType, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	types := make([]JobType, 0, len(q.paused))
+	for t := range q.paused {
+		types = append(types, t)
+	}
+	return types, nil
+}
+
+// TypeStats returns the throughput and latency of each job type
+func (q *MemoryQueue) TypeStats(ctx context.Context, since time.Time) ([]JobTypeStats, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	stats := make([]JobTypeStats, len(JobTypes))
+	index := make(map[JobType]int, len(JobTypes))
+	for i, t := range JobTypes {
+		stats[i] = JobTypeStats{Type: t, Paused: q.paused[t]}
+		index[t] = i
+	}
+	for _, run := range q.runs {
+		if i, ok := index[run.jobType]; ok && !run.at.Before(since) {
+			stats[i].add(run.ok, run.duration, run.wait)
+		}
+	}
+	setPerMinute(stats, since)
+	return stats, nil
+}
+
+// setPerMinute derives the throughput from the counts over the window
+func setPerMinute(stats []JobTypeStats, since time.Time) {
+	minutes := time.Since(since).Minutes()
+	if minutes <= 0 {
+		return
+	}
+	for i := range stats {
+		stats[i].PerMinute = float64(stats[i].Completed+stats[i].Failed) / minutes
 	}
 }
 
@@ -0,0 +1,110 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{1: 5 * time.Second, 2: 10 * time.Second, 4: 40 * time.Second, 20: time.Hour} {
+		got := retryBackoff(attempts)
+		if got < want || got > want+want/5 {
+			t.Errorf("retryBackoff(%d) = %v, want %v plus at most 20%%", attempts, got, want)
+		}
+	}
+}
+
+func TestMemoryQueue_UniqueKey(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("rejects a second active job with the same key", func(t *testing.T) {
+		q := NewMemoryQueue(10)
+		first, _ := CreateJob(JobTypeEmailSync, EmailSyncPayload{AccountID: "a"})
+		first.UniqueKey = UniqueKey(JobTypeEmailSync, "a")
+		if err := q.Enqueue(ctx, first); err != nil {
+			t.Fatal(err)
+		}
+		second, _ := CreateJob(JobTypeEmailSync, EmailSyncPayload{AccountID: "a"})
+		second.UniqueKey = first.UniqueKey
+		if err := q.Enqueue(ctx, second); !errors.Is(err, ErrDuplicateJob) {
+			t.Errorf("second Enqueue = %v, want ErrDuplicateJob", err)
+		}
+
+		job, err := q.Dequeue(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if active, _ := q.IsActive(ctx, first.UniqueKey); !active {
+			t.Error("running job does not hold its key")
+		}
+		q.MarkCompleted(ctx, job.ID)
+		if active, _ := q.IsActive(ctx, first.UniqueKey); active {
+			t.Error("completed job still holds its key")
+		}
+		if err := q.Enqueue(ctx, second); err != nil {
+			t.Errorf("Enqueue after completion = %v", err)
+		}
+	})
+
+	t.Run("releases the key of cancelled jobs", func(t *testing.T) {
+		q := NewMemoryQueue(10)
+		job, _ := CreateJob(JobTypeEmailSend, EmailSendPayload{AccountID: "a"})
+		job.UniqueKey = "send"
+		q.Schedule(ctx, job, time.Now().Add(time.Minute))
+		if cancelled, _ := q.Cancel(ctx, job.ID); !cancelled {
+			t.Fatal("Cancel = false, want true for a scheduled job")
+		}
+		if active, _ := q.IsActive(ctx, "send"); active {
+			t.Error("cancelled job still holds its key")
+		}
+	})
+}
+
+func TestMemoryQueue_MarkFailed(t *testing.T) {
+	ctx := context.Background()
+	q := NewMemoryQueue(10)
+	job, _ := CreateJob(JobTypeCleanup, CleanupPayload{Type: "temp"})
+	job.MaxRetries = 2
+	q.Enqueue(ctx, job)
+	q.Dequeue(ctx, nil)
+
+	q.MarkFailed(ctx, job.ID, errors.New("boom"))
+	if job.Status != JobStatusRetrying || !job.RunAt.After(time.Now()) {
+		t.Fatalf("after first failure: status %s, run at %v; want a retry in the future", job.Status, job.RunAt)
+	}
+	q.MarkFailed(ctx, job.ID, errors.New("boom"))
+	if job.Status != JobStatusDead {
+		t.Errorf("after last failure: status %s, want dead", job.Status)
+	}
+}
+
+func TestMemoryQueue_Pause(t *testing.T) {
+	ctx := context.Background()
+	q := NewMemoryQueue(10)
+	q.Pause(ctx, JobTypeCleanup)
+
+	job, _ := CreateJob(JobTypeCleanup, CleanupPayload{Type: "temp"})
+	q.Enqueue(ctx, job)
+	dequeueCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if got, _ := q.Dequeue(dequeueCtx, nil); got != nil {
+		t.Fatal("Dequeue returned a job of a paused type")
+	}
+
+	q.Resume(ctx, JobTypeCleanup)
+	q.ProcessScheduled(ctx)
+	got, err := q.Dequeue(ctx, nil)
+	if err != nil || got.ID != job.ID {
+		t.Fatalf("Dequeue after resume = %v, %v; want the held-back job", got, err)
+	}
+	q.MarkCompleted(ctx, got.ID)
+
+	stats, _ := q.TypeStats(ctx, time.Now().Add(-time.Minute))
+	for _, s := range stats {
+		if s.Type == JobTypeCleanup && s.Completed != 1 {
+			t.Errorf("completed cleanup jobs = %d, want 1", s.Completed)
+		}
+	}
+}
@@ -0,0 +1,670 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// redisVisibilityTimeout is how long a dequeued job stays invisible to
+	// other workers. Workers extend it while the job runs, so it only runs out
+	// when the worker's process went away; the job is then handed out again.
+	redisVisibilityTimeout = 2 * time.Minute
+	// redisPollInterval is how often an idle Dequeue looks for due jobs
+	redisPollInterval = 500 * time.Millisecond
+	// completedJobRetention is how long finished jobs can still be looked up
+	completedJobRetention = 24 * time.Hour
+	// maxHistory caps the number of completed jobs kept for listing
+	maxHistory = 10000
+	// uniqueKeyRetention bounds how long a unique key outlives the run time
+	// of its job, in case the job record is lost
+	uniqueKeyRetention = 24 * time.Hour
+	// metricsRetention is how long the per-minute run counters are kept
+	metricsRetention = 25 * time.Hour
+)
+
+const (
+	redisJobPrefix       = "jobs:job:"
+	redisScheduledPrefix = "jobs:scheduled:" // per type: job IDs by the time they are due
+	redisRunningKey      = "jobs:running"    // job IDs by their visibility deadline
+	redisDeadKey         = "jobs:dead"       // dead-lettered job IDs by the time they failed
+	redisHistoryKey      = "jobs:history"    // completed job IDs by the time they finished
+	redisDeliveriesKey   = "jobs:deliveries" // hash of job ID to times handed out
+	redisPausedKey       = "jobs:paused"     // set of paused job types
+)
+
+func redisJobKey(jobID string) string {
+	return redisJobPrefix + jobID
+}
+
+func redisScheduledKey(jobType JobType) string {
+	return redisScheduledPrefix + string(jobType)
+}
+
+func redisUniqueKey(uniqueKey string) string {
+	return fmt.Sprintf("jobs:unique:%s", uniqueKey)
+}
+
+// redisMetricsKey holds the run counters of a job type for one minute
+func redisMetricsKey(jobType JobType, minute int64) string {
+	return fmt.Sprintf("jobs:metrics:%s:%d", jobType, minute)
+}
+
+// claimScript moves the earliest due job of the given, unpaused types to the
+// running set and counts the delivery, atomically so that replicas never
+// claim the same job.
+// KEYS: running, deliveries, paused, then the scheduled set of each type.
+// ARGV: now, visibility deadline, then the name of each type.
+var claimScript = redis.NewScript(`
+local best, bestScore, bestKey
+for i = 4, #KEYS do
+	if redis.call('SISMEMBER', KEYS[3], ARGV[i - 1]) == 0 then
+		local due = redis.call('ZRANGEBYSCORE', KEYS[i], '-inf', ARGV[1], 'WITHSCORES', 'LIMIT', 0, 1)
+		if #due > 0 and (bestScore == nil or tonumber(due[2]) < bestScore) then
+			best, bestScore, bestKey = due[1], tonumber(due[2]), KEYS[i]
+		end
+	end
+end
+if best == nil then
+	return false
+end
+redis.call('ZREM', bestKey, best)
+redis.call('ZADD', KEYS[1], ARGV[2], best)
+local deliveries = redis.call('HINCRBY', KEYS[2], best, 1)
+return {best, deliveries}
+`)
+
+// recoverScript puts running jobs whose visibility deadline passed back into
+// the scheduled set of their type.
+// KEYS: running. ARGV: now, job key prefix, scheduled key prefix.
+var recoverScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 100)
+for _, id in ipairs(ids) do
+	redis.call('ZREM', KEYS[1], id)
+	local data = redis.call('GET', ARGV[2] .. id)
+	if data then
+		local job = cjson.decode(data)
+		redis.call('ZADD', ARGV[3] .. job.type, ARGV[1], id)
+	end
+end
+return #ids
+`)
+
+// releaseScript deletes a unique key if it still belongs to the job
+var releaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// RedisQueue is a durable JobQueue shared by all backend replicas. Jobs are
+// delivered at least once: a job that is running when its worker dies is
+// handed out again after the visibility timeout, so handlers must tolerate
+// running twice. Jobs that exhaust their retries are kept in a dead-letter set.
+type RedisQueue struct {
+	rdb *redis.Client
+}
+
+// NewRedisQueue creates a new Redis-backed job queue
+func NewRedisQueue(rdb *redis.Client) *RedisQueue {
+	return &RedisQueue{rdb: rdb}
+}
+
+func msScore(t time.Time) float64 {
+	return float64(t.UnixMilli())
+}
+
+// Enqueue adds a job to the queue
+func (q *RedisQueue) Enqueue(ctx context.Context, job *Job) error {
+	return q.Schedule(ctx, job, time.Now())
+}
+
+// Schedule schedules a job to run at a specific time
+func (q *RedisQueue) Schedule(ctx context.Context, job *Job, runAt time.Time) error {
+	if job.ID == "" {
+		job.ID = uuid.New().String()
+	}
+	job.Status = JobStatusPending
+	job.CreatedAt = time.Now()
+	job.UpdatedAt = time.Now()
+	job.RunAt = runAt
+	if job.MaxRetries == 0 {
+		job.MaxRetries = 3
+	}
+
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	if job.UniqueKey != "" {
+		if err := q.acquireUnique(ctx, job); err != nil {
+			return err
+		}
+	}
+
+	_, err = q.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, redisJobKey(job.ID), data, 0)
+		pipe.ZAdd(ctx, redisScheduledKey(job.Type), redis.Z{Score: msScore(runAt), Member: job.ID})
+		return nil
+	})
+	if err != nil {
+		q.releaseUnique(ctx, job)
+	}
+	return err
+}
+
+func (q *RedisQueue) acquireUnique(ctx context.Context, job *Job) error {
+	ttl := time.Until(job.RunAt) + uniqueKeyRetention
+	ok, err := q.rdb.SetNX(ctx, redisUniqueKey(job.UniqueKey), job.ID, ttl).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrDuplicateJob
+	}
+	return nil
+}
+
+func (q *RedisQueue) releaseUnique(ctx context.Context, job *Job) {
+	if job.UniqueKey != "" {
+		releaseScript.Run(ctx, q.rdb, []string{redisUniqueKey(job.UniqueKey)}, job.ID)
+	}
+}
+
+// Dequeue waits for the next due job and claims it
+func (q *RedisQueue) Dequeue(ctx context.Context, types []JobType) (*Job, error) {
+	for {
+		// Once the claim ran in Redis the job must reach the caller, so the
+		// claim is not cut short by the caller's deadline
+		job, err := q.claim(context.WithoutCancel(ctx), types)
+		if err != nil || job != nil {
+			return job, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(redisPollInterval):
+		}
+	}
+}
+
+// claim returns the next due job, or nil if there is none
+func (q *RedisQueue) claim(ctx context.Context, types []JobType) (*Job, error) {
+	if len(types) == 0 {
+		return nil, nil
+	}
+	keys := []string{redisRunningKey, redisDeliveriesKey, redisPausedKey}
+	args := []interface{}{0, 0}
+	for _, t := range types {
+		keys = append(keys, redisScheduledKey(t))
+		args = append(args, string(t))
+	}
+
+	for {
+		now := time.Now()
+		args[0], args[1] = now.UnixMilli(), now.Add(redisVisibilityTimeout).UnixMilli()
+		res, err := claimScript.Run(ctx, q.rdb, keys, args...).Slice()
+		if errors.Is(err, redis.Nil) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		jobID, _ := res[0].(string)
+		deliveries, _ := res[1].(int64)
+
+		job, err := q.GetJob(ctx, jobID)
+		if err != nil {
+			return nil, err
+		}
+		if job == nil {
+			// The job record is gone (cancelled concurrently); drop the ID
+			q.rdb.ZRem(ctx, redisRunningKey, jobID)
+			q.rdb.HDel(ctx, redisDeliveriesKey, jobID)
+			continue
+		}
+
+		// Deliveries beyond the attempts reported back were lost with their
+		// worker, and count as failed attempts
+		if lost := int(deliveries) - 1; lost > job.Attempts {
+			job.Attempts = lost
+			job.Error = "worker stopped while running the job"
+			if job.Attempts >= job.MaxRetries {
+				if err := q.bury(ctx, job); err != nil {
+					return nil, err
+				}
+				continue
+			}
+		}
+
+		job.Status = JobStatusRunning
+		job.StartedAt = &now
+		job.UpdatedAt = now
+		if err := q.save(ctx, job, 0); err != nil {
+			return nil, err
+		}
+		return job, nil
+	}
+}
+
+func (q *RedisQueue) save(ctx context.Context, job *Job, ttl time.Duration) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return q.rdb.Set(ctx, redisJobKey(job.ID), data, ttl).Err()
+}
+
+// recordRun counts a finished run in the per-minute counters of its type
+func (q *RedisQueue) recordRun(ctx context.Context, pipe redis.Pipeliner, job *Job, ok bool, now time.Time) {
+	duration, wait := job.runTimes(now)
+	key := redisMetricsKey(job.Type, now.Unix()/60)
+	if ok {
+		pipe.HIncrBy(ctx, key, "completed", 1)
+	} else {
+		pipe.HIncrBy(ctx, key, "failed", 1)
+	}
+	pipe.HIncrBy(ctx, key, "duration_ms", duration.Milliseconds())
+	pipe.HIncrBy(ctx, key, "wait_ms", wait.Milliseconds())
+	pipe.Expire(ctx, key, metricsRetention)
+}
+
+// bury moves a job that exhausted its retries to the dead-letter set
+func (q *RedisQueue) bury(ctx context.Context, job *Job) error {
+	now := time.Now()
+	job.Status = JobStatusDead
+	job.FinishedAt = &now
+	job.UpdatedAt = now
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, redisJobKey(job.ID), data, 0)
+		pipe.ZRem(ctx, redisRunningKey, job.ID)
+		pipe.ZAdd(ctx, redisDeadKey, redis.Z{Score: msScore(now), Member: job.ID})
+		pipe.HDel(ctx, redisDeliveriesKey, job.ID)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	q.releaseUnique(ctx, job)
+	return nil
+}
+
+// MarkCompleted marks a job as completed
+func (q *RedisQueue) MarkCompleted(ctx context.Context, jobID string) error {
+	job, err := q.GetJob(ctx, jobID)
+	if err != nil || job == nil {
+		return err
+	}
+	now := time.Now()
+	job.Status = JobStatusCompleted
+	job.FinishedAt = &now
+	job.UpdatedAt = now
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, redisJobKey(job.ID), data, completedJobRetention)
+		pipe.ZRem(ctx, redisRunningKey, job.ID)
+		pipe.HDel(ctx, redisDeliveriesKey, job.ID)
+		pipe.ZAdd(ctx, redisHistoryKey, redis.Z{Score: msScore(now), Member: job.ID})
+		pipe.ZRemRangeByScore(ctx, redisHistoryKey, "-inf", strconv.FormatInt(now.Add(-completedJobRetention).UnixMilli(), 10))
+		pipe.ZRemRangeByRank(ctx, redisHistoryKey, 0, -maxHistory-1)
+		q.recordRun(ctx, pipe, job, true, now)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	q.releaseUnique(ctx, job)
+	return nil
+}
+
+// MarkFailed marks a job as failed, scheduling a retry with exponential
+// backoff while it has retries left and dead-lettering it otherwise
+func (q *RedisQueue) MarkFailed(ctx context.Context, jobID string, jobErr error) error {
+	job, err := q.GetJob(ctx, jobID)
+	if err != nil || job == nil {
+		return err
+	}
+	now := time.Now()
+	if _, err := q.rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		q.recordRun(ctx, pipe, job, false, now)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	job.Attempts++
+	job.Error = jobErr.Error()
+	if job.Attempts >= job.MaxRetries {
+		return q.bury(ctx, job)
+	}
+
+	job.Status = JobStatusRetrying
+	job.UpdatedAt = now
+	job.RunAt = now.Add(retryBackoff(job.Attempts))
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	_, err = q.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, redisJobKey(job.ID), data, 0)
+		pipe.ZRem(ctx, redisRunningKey, job.ID)
+		pipe.ZAdd(ctx, redisScheduledKey(job.Type), redis.Z{Score: msScore(job.RunAt), Member: job.ID})
+		return nil
+	})
+	return err
+}
+
+// Cancel removes a job that has not started yet
+func (q *RedisQueue) Cancel(ctx context.Context, jobID string) (bool, error) {
+	job, err := q.GetJob(ctx, jobID)
+	if err != nil || job == nil {
+		return false, err
+	}
+	// Removing the ID from the scheduled set decides the race with claim
+	removed, err := q.rdb.ZRem(ctx, redisScheduledKey(job.Type), jobID).Result()
+	if err != nil || removed == 0 {
+		return false, err
+	}
+	if err := q.rdb.Del(ctx, redisJobKey(jobID)).Err(); err != nil {
+		return true, err
+	}
+	q.rdb.HDel(ctx, redisDeliveriesKey, jobID)
+	q.releaseUnique(ctx, job)
+	return true, nil
+}
+
+// Retry queues a dead-lettered job again
+func (q *RedisQueue) Retry(ctx context.Context, jobID string) (bool, error) {
+	job, err := q.GetJob(ctx, jobID)
+	if err != nil || job == nil {
+		return false, err
+	}
+	// Removing the ID from the dead-letter set decides concurrent retries
+	removed, err := q.rdb.ZRem(ctx, redisDeadKey, jobID).Result()
+	if err != nil || removed == 0 {
+		return false, err
+	}
+
+	buried := job.UpdatedAt
+	job.resetForRetry()
+	if job.UniqueKey != "" {
+		if err := q.acquireUnique(ctx, job); err != nil {
+			// Another job holds the key; leave this one dead-lettered
+			q.rdb.ZAdd(ctx, redisDeadKey, redis.Z{Score: msScore(buried), Member: jobID})
+			return false, err
+		}
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = q.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, redisJobKey(job.ID), data, 0)
+		pipe.ZAdd(ctx, redisScheduledKey(job.Type), redis.Z{Score: msScore(job.RunAt), Member: job.ID})
+		return nil
+	})
+	return err == nil, err
+}
+
+// Extend pushes back the visibility deadline of a running job
+func (q *RedisQueue) Extend(ctx context.Context, jobID string) error {
+	return q.rdb.ZAddXX(ctx, redisRunningKey, redis.Z{
+		Score:  msScore(time.Now().Add(redisVisibilityTimeout)),
+		Member: jobID,
+	}).Err()
+}
+
+// IsActive checks if a job with the given unique key is pending or running
+func (q *RedisQueue) IsActive(ctx context.Context, uniqueKey string) (bool, error) {
+	n, err := q.rdb.Exists(ctx, redisUniqueKey(uniqueKey)).Result()
+	return n > 0, err
+}
+
+// Pause holds back jobs of a type on all replicas
+func (q *RedisQueue) Pause(ctx context.Context, jobType JobType) error {
+	return q.rdb.SAdd(ctx, redisPausedKey, string(jobType)).Err()
+}
+
+// Resume lets jobs of a paused type run again
+func (q *RedisQueue) Resume(ctx context.Context, jobType JobType) error {
+	return q.rdb.SRem(ctx, redisPausedKey, string(jobType)).Err()
+}
+
+// PausedTypes returns the paused job types
+func (q *RedisQueue) PausedTypes(ctx context.Context) ([]JobType, error) {
+	members, err := q.rdb.SMembers(ctx, redisPausedKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	types := make([]JobType, len(members))
+	for i, m := range members {
+		types[i] = JobType(m)
+	}
+	return types, nil
+}
+
+// GetJob retrieves a job by ID
+func (q *RedisQueue) GetJob(ctx context.Context, jobID string) (*Job, error) {
+	data, err := q.rdb.Get(ctx, redisJobKey(jobID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// GetPendingJobs retrieves all pending jobs of a specific type
+func (q *RedisQueue) GetPendingJobs(ctx context.Context, jobType JobType) ([]*Job, error) {
+	ids, err := q.rdb.ZRange(ctx, redisScheduledKey(jobType), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	jobs, err := q.getJobs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*Job, 0)
+	for _, job := range jobs {
+		if job.Status == JobStatusPending {
+			result = append(result, job)
+		}
+	}
+	return result, nil
+}
+
+// getJobs loads the jobs with the given IDs, skipping ones that are gone
+func (q *RedisQueue) getJobs(ctx context.Context, ids []string) ([]*Job, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = redisJobKey(id)
+	}
+	values, err := q.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := make([]*Job, 0, len(values))
+	for _, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var job Job
+		if err := json.Unmarshal([]byte(data), &job); err != nil {
+			continue
+		}
+		jobs = append(jobs, &job)
+	}
+	return jobs, nil
+}
+
+// ListJobs returns the jobs matching the filter
+func (q *RedisQueue) ListJobs(ctx context.Context, filter JobFilter) ([]*Job, int, error) {
+	// Pick the sets that can hold jobs in the requested status
+	var sets []string
+	switch filter.Status {
+	case JobStatusPending, JobStatusRetrying:
+	case JobStatusRunning:
+		sets = []string{redisRunningKey}
+	case JobStatusDead:
+		sets = []string{redisDeadKey}
+	case JobStatusCompleted:
+		sets = []string{redisHistoryKey}
+	default:
+		sets = []string{redisRunningKey, redisDeadKey, redisHistoryKey}
+	}
+	if filter.Status == "" || filter.Status == JobStatusPending || filter.Status == JobStatusRetrying {
+		if filter.Type != "" {
+			sets = append(sets, redisScheduledKey(filter.Type))
+		} else {
+			for _, t := range JobTypes {
+				sets = append(sets, redisScheduledKey(t))
+			}
+		}
+	}
+
+	pipe := q.rdb.Pipeline()
+	members := make([]*redis.StringSliceCmd, len(sets))
+	for i, set := range sets {
+		members[i] = pipe.ZRange(ctx, set, 0, -1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, 0, err
+	}
+	var ids []string
+	for _, m := range members {
+		ids = append(ids, m.Val()...)
+	}
+
+	jobs, err := q.getJobs(ctx, ids)
+	if err != nil {
+		return nil, 0, err
+	}
+	matched := jobs[:0]
+	for _, job := range jobs {
+		if (filter.Type == "" || job.Type == filter.Type) && (filter.Status == "" || job.Status == filter.Status) {
+			matched = append(matched, job)
+		}
+	}
+	return pageJobs(matched, filter), len(matched), nil
+}
+
+// ProcessScheduled recovers jobs whose worker stopped extending them. Due
+// jobs need no promotion: Dequeue claims them straight from the schedule.
+func (q *RedisQueue) ProcessScheduled(ctx context.Context) error {
+	return recoverScript.Run(ctx, q.rdb, []string{redisRunningKey},
+		time.Now().UnixMilli(), redisJobPrefix, redisScheduledPrefix,
+	).Err()
+}
+
+// Stats returns queue statistics
+func (q *RedisQueue) Stats(ctx context.Context) (map[string]interface{}, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	pipe := q.rdb.Pipeline()
+	ready := make([]*redis.IntCmd, len(JobTypes))
+	scheduled := make([]*redis.IntCmd, len(JobTypes))
+	for i, t := range JobTypes {
+		ready[i] = pipe.ZCount(ctx, redisScheduledKey(t), "-inf", now)
+		scheduled[i] = pipe.ZCard(ctx, redisScheduledKey(t))
+	}
+	running := pipe.ZCard(ctx, redisRunningKey)
+	dead := pipe.ZCard(ctx, redisDeadKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	var pending, later int64
+	for i := range JobTypes {
+		pending += ready[i].Val()
+		later += scheduled[i].Val() - ready[i].Val()
+	}
+	return map[string]interface{}{
+		"backend":   "redis",
+		"pending":   pending,
+		"scheduled": later,
+		"running":   running.Val(),
+		"dead":      dead.Val(),
+	}, nil
+}
+
+// TypeStats returns the throughput and latency of each job type, from the
+// per-minute counters
+func (q *RedisQueue) TypeStats(ctx context.Context, since time.Time) ([]JobTypeStats, error) {
+	if oldest := time.Now().Add(-metricsRetention); since.Before(oldest) {
+		since = oldest
+	}
+	first, last := since.Unix()/60, time.Now().Unix()/60
+
+	pipe := q.rdb.Pipeline()
+	paused := pipe.SMembers(ctx, redisPausedKey)
+	counters := make([][]*redis.MapStringStringCmd, len(JobTypes))
+	for i, t := range JobTypes {
+		for minute := first; minute <= last; minute++ {
+			counters[i] = append(counters[i], pipe.HGetAll(ctx, redisMetricsKey(t, minute)))
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	isPaused := make(map[string]bool)
+	for _, t := range paused.Val() {
+		isPaused[t] = true
+	}
+	stats := make([]JobTypeStats, len(JobTypes))
+	for i, t := range JobTypes {
+		s := JobTypeStats{Type: t, Paused: isPaused[string(t)]}
+		var duration, wait int64
+		for _, cmd := range counters[i] {
+			m := cmd.Val()
+			s.Completed += counterValue(m, "completed")
+			s.Failed += counterValue(m, "failed")
+			duration += counterValue(m, "duration_ms")
+			wait += counterValue(m, "wait_ms")
+		}
+		if n := s.Completed + s.Failed; n > 0 {
+			s.AvgDurationMs = float64(duration) / float64(n)
+			s.AvgWaitMs = float64(wait) / float64(n)
+		}
+		stats[i] = s
+	}
+	setPerMinute(stats, since)
+	return stats, nil
+}
+
+func counterValue(m map[string]string, field string) int64 {
+	n, _ := strconv.ParseInt(m[field], 10, 64)
+	return n
+}
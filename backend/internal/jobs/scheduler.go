@@ -2,9 +2,11 @@ package jobs
 
 import (
 	"context"
+	"errors"
 	"log"
 	"time"
 
+	"github.com/tessera/tessera/internal/middleware"
 	"github.com/tessera/tessera/internal/services"
 )
 
@@ -12,6 +14,8 @@ import (
 type Scheduler struct {
 	worker       *Worker
 	emailService *services.EmailService
+	fileService  *services.FileService
+	reminders    *CalendarReminderPlanner
 	stopCh       chan struct{}
 }
 
@@ -28,6 +32,17 @@ func (s *Scheduler) SetEmailService(emailService *services.EmailService) {
 	s.emailService = emailService
 }
 
+// SetFileService sets the file service for storage metrics and search
+// index backfill
+func (s *Scheduler) SetFileService(fileService *services.FileService) {
+	s.fileService = fileService
+}
+
+// SetReminderPlanner sets the planner for calendar reminder scheduling
+func (s *Scheduler) SetReminderPlanner(planner *CalendarReminderPlanner) {
+	s.reminders = planner
+}
+
 // Start begins the scheduler
 func (s *Scheduler) Start(ctx context.Context) {
 	log.Println("Starting job scheduler")
@@ -35,7 +50,12 @@ func (s *Scheduler) Start(ctx context.Context) {
 	go s.scheduleTrashCleanup(ctx)
 	go s.scheduleExpiredSharesCleanup(ctx)
 	go s.scheduleTempCleanup(ctx)
+	go s.scheduleVersionSweep(ctx)
+	go s.scheduleQuotaReconcile(ctx)
 	go s.scheduleEmailSync(ctx)
+	go s.scheduleCalendarReminders(ctx)
+	go s.scheduleStorageMetrics(ctx)
+	go s.scheduleIndexBackfill(ctx)
 }
 
 // Stop gracefully stops the scheduler
@@ -87,21 +107,124 @@ func (s *Scheduler) enqueueEmailSync(ctx context.Context) {
 
 	// Enqueue a sync job for each account (skip if already running)
 	for _, account := range accounts {
-		// Check if sync is already running for this account
-		if s.worker.IsJobRunning(JobTypeEmailSync, account.ID) {
-			log.Printf("[EMAIL_SYNC] Sync already running for account %s, skipping", account.ID)
-			continue
-		}
 		payload := EmailSyncPayload{
 			AccountID: account.ID,
 			UserID:    account.UserID,
 		}
-		if err := s.worker.Enqueue(ctx, JobTypeEmailSync, payload); err != nil {
+		err := s.worker.EnqueueUnique(ctx, JobTypeEmailSync, UniqueKey(JobTypeEmailSync, account.ID), payload)
+		if errors.Is(err, ErrDuplicateJob) {
+			log.Printf("[EMAIL_SYNC] Sync already running for account %s, skipping", account.ID)
+		} else if err != nil {
 			log.Printf("[EMAIL_SYNC] Failed to enqueue sync for account %s: %v", account.ID, err)
 		}
 	}
 }
 
+// scheduleCalendarReminders plans upcoming calendar reminders every minute
+func (s *Scheduler) scheduleCalendarReminders(ctx context.Context) {
+	// Wait for system to stabilize
+	time.Sleep(time.Second * 20)
+
+	// On startup, also pick up reminders that came due while the server was down
+	now := time.Now()
+	s.planCalendarReminders(ctx, now.Add(-reminderGrace), now.Add(reminderHorizon))
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			s.planCalendarReminders(ctx, now, now.Add(reminderHorizon))
+		}
+	}
+}
+
+func (s *Scheduler) planCalendarReminders(ctx context.Context, from, to time.Time) {
+	if s.reminders == nil {
+		return
+	}
+	if err := s.reminders.Plan(ctx, from, to); err != nil {
+		log.Printf("[REMINDERS] Failed to plan reminders: %v", err)
+	}
+}
+
+// scheduleStorageMetrics refreshes the storage usage gauges every 5 minutes
+func (s *Scheduler) scheduleStorageMetrics(ctx context.Context) {
+	// Wait for system to stabilize
+	time.Sleep(time.Second * 10)
+	s.updateStorageMetrics(ctx)
+
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			s.updateStorageMetrics(ctx)
+		}
+	}
+}
+
+func (s *Scheduler) updateStorageMetrics(ctx context.Context) {
+	if s.fileService == nil {
+		return
+	}
+
+	totals, err := s.fileService.GetStorageTotals(ctx)
+	if err != nil {
+		log.Printf("[METRICS] Failed to get storage totals: %v", err)
+		return
+	}
+	middleware.UpdateStorageMetrics(totals.FilesBytes, totals.AttachmentsBytes, totals.ThumbnailsBytes, totals.TotalFiles)
+}
+
+// scheduleIndexBackfill queues indexing of files missing from the search
+// index once after startup and then daily, catching files from before
+// content search and any whose indexing job was lost
+func (s *Scheduler) scheduleIndexBackfill(ctx context.Context) {
+	// Wait for system to stabilize
+	time.Sleep(time.Minute)
+	s.queueUnindexed(ctx)
+
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			s.queueUnindexed(ctx)
+		}
+	}
+}
+
+func (s *Scheduler) queueUnindexed(ctx context.Context) {
+	if s.fileService == nil {
+		return
+	}
+
+	queued, err := s.fileService.QueueUnindexed(ctx)
+	if err != nil {
+		log.Printf("[FILE_INDEX] Failed to queue unindexed files: %v", err)
+	}
+	if queued > 0 {
+		log.Printf("[FILE_INDEX] Queued %d unindexed files", queued)
+	}
+}
+
 // scheduleTrashCleanup schedules trash cleanup every day
 func (s *Scheduler) scheduleTrashCleanup(ctx context.Context) {
 	// Run once on startup
@@ -125,16 +248,20 @@ func (s *Scheduler) scheduleTrashCleanup(ctx context.Context) {
 }
 
 func (s *Scheduler) enqueueTrashCleanup(ctx context.Context) {
-	// Delete items in trash older than 30 days
+	// How long trash is kept is up to the admin and each user's override
 	payload := CleanupPayload{
-		Type:      "trash",
-		OlderThan: time.Now().AddDate(0, 0, -30),
+		Type: "trash",
 	}
 	if err := s.worker.Enqueue(ctx, JobTypeCleanup, payload); err != nil {
 		log.Printf("Failed to enqueue trash cleanup job: %v", err)
 	} else {
 		log.Println("Enqueued trash cleanup job")
 	}
+
+	// The change journal is pruned on the same schedule
+	if err := s.worker.Enqueue(ctx, JobTypeCleanup, CleanupPayload{Type: "changes"}); err != nil {
+		log.Printf("Failed to enqueue change journal cleanup job: %v", err)
+	}
 }
 
 // scheduleExpiredSharesCleanup schedules expired shares cleanup every hour
@@ -182,15 +309,66 @@ func (s *Scheduler) scheduleTempCleanup(ctx context.Context) {
 	}
 }
 
-// ScheduleQuotaCheck schedules a quota check for a user
+// scheduleVersionSweep applies the version retention policy to all files
+// nightly, pruning versions that aged out of it without the file changing
+func (s *Scheduler) scheduleVersionSweep(ctx context.Context) {
+	ticker := time.NewTicker(24 * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			err := s.worker.EnqueueUnique(ctx, JobTypeVersionCleanup, UniqueKey(JobTypeVersionCleanup, "all"), VersionCleanupPayload{})
+			if err != nil && !errors.Is(err, ErrDuplicateJob) {
+				log.Printf("Failed to enqueue version sweep job: %v", err)
+			}
+		}
+	}
+}
+
+// scheduleQuotaReconcile corrects every user's storage used every 6 hours,
+// for whatever the writes that keep it up to date missed
+func (s *Scheduler) scheduleQuotaReconcile(ctx context.Context) {
+	ticker := time.NewTicker(6 * time.Hour)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.stopCh:
+			return
+		case <-ticker.C:
+			if err := s.ScheduleQuotaCheck(ctx, ""); err != nil {
+				log.Printf("Failed to enqueue quota check job: %v", err)
+			}
+		}
+	}
+}
+
+// ScheduleQuotaCheck schedules reconciling the storage used of a user, or
+// of every user when userID is empty
 func (s *Scheduler) ScheduleQuotaCheck(ctx context.Context, userID string) error {
 	payload := QuotaCheckPayload{
 		UserID: userID,
 	}
-	return s.worker.Enqueue(ctx, JobTypeQuotaCheck, payload)
+	target := userID
+	if target == "" {
+		target = "all"
+	}
+	err := s.worker.EnqueueUnique(ctx, JobTypeQuotaCheck, UniqueKey(JobTypeQuotaCheck, target), payload)
+	if errors.Is(err, ErrDuplicateJob) {
+		return nil
+	}
+	return err
 }
 
-// ScheduleThumbnail schedules thumbnail generation for a file
+// ScheduleThumbnail schedules thumbnail generation for a file. A file has at
+// most one job at a time, which always renders its latest content.
 func (s *Scheduler) ScheduleThumbnail(ctx context.Context, fileID, userID, filePath, mimeType string) error {
 	payload := ThumbnailPayload{
 		FileID:   fileID,
@@ -198,7 +376,39 @@ func (s *Scheduler) ScheduleThumbnail(ctx context.Context, fileID, userID, fileP
 		FilePath: filePath,
 		MimeType: mimeType,
 	}
-	return s.worker.Enqueue(ctx, JobTypeThumbnail, payload)
+	err := s.worker.EnqueueUnique(ctx, JobTypeThumbnail, UniqueKey(JobTypeThumbnail, fileID), payload)
+	if errors.Is(err, ErrDuplicateJob) {
+		return nil
+	}
+	return err
+}
+
+// ScheduleFileIndex schedules indexing of a file's content. Like thumbnails,
+// a file has at most one job at a time.
+func (s *Scheduler) ScheduleFileIndex(ctx context.Context, fileID, userID string) error {
+	payload := FileIndexPayload{
+		FileID: fileID,
+		UserID: userID,
+		Action: "index",
+	}
+	err := s.worker.EnqueueUnique(ctx, JobTypeFileIndex, UniqueKey(JobTypeFileIndex, fileID), payload)
+	if errors.Is(err, ErrDuplicateJob) {
+		return nil
+	}
+	return err
+}
+
+// ScheduleVirusScan schedules a virus scan of a file's content. Like
+// thumbnails, a file has at most one job at a time.
+func (s *Scheduler) ScheduleVirusScan(ctx context.Context, fileID string) error {
+	payload := VirusScanPayload{
+		FileID: fileID,
+	}
+	err := s.worker.EnqueueUnique(ctx, JobTypeVirusScan, UniqueKey(JobTypeVirusScan, fileID), payload)
+	if errors.Is(err, ErrDuplicateJob) {
+		return nil
+	}
+	return err
 }
 
 // ScheduleNotification schedules a notification for a user
@@ -213,11 +423,15 @@ func (s *Scheduler) ScheduleNotification(ctx context.Context, userID, notifType,
 	return s.worker.Enqueue(ctx, JobTypeNotification, payload)
 }
 
-// ScheduleVersionCleanup schedules version cleanup for a file
-func (s *Scheduler) ScheduleVersionCleanup(ctx context.Context, fileID string, keepVersions int) error {
+// ScheduleVersionCleanup schedules pruning of a file's versions. A file has
+// at most one job at a time, which sees all versions made before it runs.
+func (s *Scheduler) ScheduleVersionCleanup(ctx context.Context, fileID string) error {
 	payload := VersionCleanupPayload{
-		FileID:       fileID,
-		KeepVersions: keepVersions,
+		FileID: fileID,
+	}
+	err := s.worker.EnqueueUnique(ctx, JobTypeVersionCleanup, UniqueKey(JobTypeVersionCleanup, fileID), payload)
+	if errors.Is(err, ErrDuplicateJob) {
+		return nil
 	}
-	return s.worker.Enqueue(ctx, JobTypeVersionCleanup, payload)
+	return err
 }
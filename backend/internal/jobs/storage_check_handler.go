@@ -0,0 +1,46 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/tessera/tessera/internal/services"
+)
+
+// StorageCheckHandler runs storage consistency checks queued by admins
+type StorageCheckHandler struct {
+	checks *services.StorageCheckService
+}
+
+// NewStorageCheckHandler creates a new storage check handler
+func NewStorageCheckHandler(checks *services.StorageCheckService) *StorageCheckHandler {
+	return &StorageCheckHandler{checks: checks}
+}
+
+// Handle runs a check; its report is saved for the admin to read
+func (h *StorageCheckHandler) Handle(ctx context.Context, job *Job) error {
+	var payload StorageCheckPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return fmt.Errorf("failed to unmarshal payload: %w", err)
+	}
+
+	report, err := h.checks.Check(ctx, services.StorageCheckOptions{
+		HashSample: payload.HashSample,
+		Quarantine: payload.Quarantine,
+		MarkBroken: payload.MarkBroken,
+		FixCounts:  payload.FixCounts,
+	})
+	if err != nil {
+		return err
+	}
+
+	issues := 0
+	for _, n := range report.Counts {
+		issues += n
+	}
+	log.Printf("[STORAGE CHECK] Checked %d contents (%d hashed) and %d objects, found %d issues",
+		report.ContentsChecked, report.ContentsHashed, report.ObjectsListed, issues)
+	return nil
+}
@@ -0,0 +1,68 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/tessera/tessera/internal/repository"
+	"github.com/tessera/tessera/internal/services"
+)
+
+// ThumbnailHandler handles thumbnail generation jobs
+type ThumbnailHandler struct {
+	fileRepo   *repository.FileRepository
+	thumbnails *services.ThumbnailService
+}
+
+// NewThumbnailHandler creates a new thumbnail handler
+func NewThumbnailHandler(fileRepo *repository.FileRepository, thumbnails *services.ThumbnailService) *ThumbnailHandler {
+	return &ThumbnailHandler{
+		fileRepo:   fileRepo,
+		thumbnails: thumbnails,
+	}
+}
+
+// Handle renders the thumbnails of a file's current content
+func (h *ThumbnailHandler) Handle(ctx context.Context, job *Job) error {
+	var payload ThumbnailPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return fmt.Errorf("failed to unmarshal payload: %w", err)
+	}
+
+	fileID, err := uuid.Parse(payload.FileID)
+	if err != nil {
+		return fmt.Errorf("invalid file ID: %w", err)
+	}
+
+	file, err := h.fileRepo.GetByID(ctx, fileID)
+	if errors.Is(err, repository.ErrFileNotFound) {
+		// Deleted since it was uploaded
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = h.thumbnails.Generate(ctx, file)
+	if errors.Is(err, services.ErrThumbnailUnsupported) || errors.Is(err, services.ErrThumbnailSource) || errors.Is(err, services.ErrInfected) {
+		log.Printf("[THUMBNAIL] Skipping file %s: %v", file.ID, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Content uploaded while this job ran had its own job rejected as a
+	// duplicate of this one; failing makes the retry pick it up
+	current, err := h.fileRepo.GetByID(ctx, fileID)
+	if err == nil && current.Hash != file.Hash {
+		return fmt.Errorf("file %s changed while its thumbnails were generated", file.ID)
+	}
+
+	log.Printf("[THUMBNAIL] Generated thumbnails for file %s", file.ID)
+	return nil
+}
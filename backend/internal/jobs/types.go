@@ -3,22 +3,66 @@ package jobs
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"time"
+
+	"github.com/tessera/tessera/internal/models"
+)
+
+var (
+	// ErrDuplicateJob is returned when a job with the same unique key is
+	// already pending or running
+	ErrDuplicateJob = errors.New("job with this unique key is already queued")
+	// ErrQueueFull is returned when the queue cannot accept more jobs
+	ErrQueueFull = errors.New("job queue is full")
 )
 
 // JobType represents different types of background jobs
 type JobType string
 
 const (
-	JobTypeThumbnail      JobType = "thumbnail"
-	JobTypeCleanup        JobType = "cleanup"
-	JobTypeNotification   JobType = "notification"
-	JobTypeFileIndex      JobType = "file_index"
-	JobTypeQuotaCheck     JobType = "quota_check"
-	JobTypeVersionCleanup JobType = "version_cleanup"
-	JobTypeEmailSync      JobType = "email_sync"
+	JobTypeThumbnail        JobType = "thumbnail"
+	JobTypeCleanup          JobType = "cleanup"
+	JobTypeNotification     JobType = "notification"
+	JobTypeFileIndex        JobType = "file_index"
+	JobTypeQuotaCheck       JobType = "quota_check"
+	JobTypeVersionCleanup   JobType = "version_cleanup"
+	JobTypeEmailSync        JobType = "email_sync"
+	JobTypeCalendarReminder JobType = "calendar_reminder"
+	JobTypeEmailSend        JobType = "email_send"
+	JobTypeEncryptStorage   JobType = "encrypt_storage"
+	JobTypeStorageCheck     JobType = "storage_check"
+	JobTypeVirusScan        JobType = "virus_scan"
+	JobTypeVirusRescan      JobType = "virus_rescan"
 )
 
+// JobTypes lists every job type
+var JobTypes = []JobType{
+	JobTypeThumbnail,
+	JobTypeCleanup,
+	JobTypeNotification,
+	JobTypeFileIndex,
+	JobTypeQuotaCheck,
+	JobTypeVersionCleanup,
+	JobTypeEmailSync,
+	JobTypeCalendarReminder,
+	JobTypeEmailSend,
+	JobTypeEncryptStorage,
+	JobTypeStorageCheck,
+	JobTypeVirusScan,
+	JobTypeVirusRescan,
+}
+
+// IsKnownType reports whether t is one of JobTypes
+func IsKnownType(t JobType) bool {
+	for _, known := range JobTypes {
+		if t == known {
+			return true
+		}
+	}
+	return false
+}
+
 // JobStatus represents the current status of a job
 type JobStatus string
 
@@ -28,6 +72,7 @@ const (
 	JobStatusCompleted JobStatus = "completed"
 	JobStatusFailed    JobStatus = "failed"
 	JobStatusRetrying  JobStatus = "retrying"
+	JobStatusDead      JobStatus = "dead" // retries exhausted, kept for inspection
 )
 
 // Job represents a background job
@@ -42,6 +87,65 @@ type Job struct {
 	CreatedAt  time.Time       `json:"created_at"`
 	UpdatedAt  time.Time       `json:"updated_at"`
 	RunAt      time.Time       `json:"run_at,omitempty"`
+	// UniqueKey, when set, keeps a second job with the same key from being
+	// queued while this one is pending or running
+	UniqueKey string `json:"unique_key,omitempty"`
+	// StartedAt is when the job was last handed to a worker, FinishedAt when
+	// it completed or was dead-lettered
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// JobFilter selects jobs for listing; zero fields match everything
+type JobFilter struct {
+	Type   JobType
+	Status JobStatus
+	Limit  int
+	Offset int
+}
+
+// JobTypeStats summarizes the recent jobs of one type
+type JobTypeStats struct {
+	Type      JobType `json:"type"`
+	Paused    bool    `json:"paused"`
+	Completed int64   `json:"completed"`
+	Failed    int64   `json:"failed"`
+	// PerMinute is the number of jobs finished per minute
+	PerMinute float64 `json:"per_minute"`
+	// AvgDurationMs is the average run time, AvgWaitMs the average time
+	// from when a job was due until a worker picked it up
+	AvgDurationMs float64 `json:"avg_duration_ms"`
+	AvgWaitMs     float64 `json:"avg_wait_ms"`
+}
+
+// add counts one finished run
+func (s *JobTypeStats) add(ok bool, duration, wait time.Duration) {
+	n := float64(s.Completed + s.Failed)
+	s.AvgDurationMs = (s.AvgDurationMs*n + float64(duration.Milliseconds())) / (n + 1)
+	s.AvgWaitMs = (s.AvgWaitMs*n + float64(wait.Milliseconds())) / (n + 1)
+	if ok {
+		s.Completed++
+	} else {
+		s.Failed++
+	}
+}
+
+// runTimes returns how long the job ran and how long it waited to start
+func (j *Job) runTimes(finished time.Time) (time.Duration, time.Duration) {
+	if j.StartedAt == nil {
+		return 0, 0
+	}
+	wait := j.StartedAt.Sub(j.RunAt)
+	if j.RunAt.IsZero() || wait < 0 {
+		wait = 0
+	}
+	return finished.Sub(*j.StartedAt), wait
+}
+
+// UniqueKey builds the unique key of a job type for one subject (an account,
+// a file, ...)
+func UniqueKey(jobType JobType, subject string) string {
+	return string(jobType) + ":" + subject
 }
 
 // ThumbnailPayload for thumbnail generation jobs
@@ -54,7 +158,7 @@ type ThumbnailPayload struct {
 
 // CleanupPayload for cleanup jobs
 type CleanupPayload struct {
-	Type      string    `json:"type"` // "trash", "temp", "expired_shares"
+	Type      string    `json:"type"` // "trash", "temp", "expired_shares", "changes"
 	OlderThan time.Time `json:"older_than,omitempty"`
 	UserID    string    `json:"user_id,omitempty"`
 }
@@ -75,15 +179,16 @@ type FileIndexPayload struct {
 	Action string `json:"action"` // "index", "update", "delete"
 }
 
-// QuotaCheckPayload for quota check jobs
+// QuotaCheckPayload for quota check jobs, which reconcile the storage used
+// of one user or, without UserID, of every user
 type QuotaCheckPayload struct {
-	UserID string `json:"user_id"`
+	UserID string `json:"user_id,omitempty"`
 }
 
-// VersionCleanupPayload for version cleanup jobs
+// VersionCleanupPayload for version cleanup jobs, which apply the version
+// retention policy to one file or, without FileID, to every file
 type VersionCleanupPayload struct {
-	FileID       string `json:"file_id"`
-	KeepVersions int    `json:"keep_versions"`
+	FileID string `json:"file_id,omitempty"`
 }
 
 // EmailSyncPayload for email sync jobs
@@ -92,6 +197,45 @@ type EmailSyncPayload struct {
 	UserID    string `json:"user_id"`
 }
 
+// CalendarReminderPayload for calendar reminder jobs
+type CalendarReminderPayload struct {
+	EventID string    `json:"event_id"`
+	UserID  string    `json:"user_id"`
+	Start   time.Time `json:"start"` // wall-clock start of the occurrence
+	Minutes int       `json:"minutes"`
+	FireAt  time.Time `json:"fire_at"`
+}
+
+// EmailSendPayload for delayed (undo-send) email jobs
+type EmailSendPayload struct {
+	AccountID string                  `json:"account_id"`
+	Compose   models.ComposeEmail     `json:"compose"`
+	Files     []models.FileAttachment `json:"files,omitempty"` // uploaded attachments, not part of Compose's JSON
+}
+
+// EncryptStoragePayload for jobs encrypting objects stored before
+// encryption at rest was turned on
+type EncryptStoragePayload struct {
+	After string `json:"after,omitempty"` // start after this storage key
+}
+
+// StorageCheckPayload for storage consistency check jobs
+type StorageCheckPayload struct {
+	HashSample float64 `json:"hash_sample,omitempty"`
+	Quarantine bool    `json:"quarantine,omitempty"`
+	MarkBroken bool    `json:"mark_broken,omitempty"`
+	FixCounts  bool    `json:"fix_counts,omitempty"`
+}
+
+// VirusScanPayload for virus scan jobs
+type VirusScanPayload struct {
+	FileID string `json:"file_id"`
+}
+
+// VirusRescanPayload for jobs scanning every stored file and email
+// attachment again
+type VirusRescanPayload struct{}
+
 // JobHandler is the interface for job handlers
 type JobHandler interface {
 	Handle(ctx context.Context, job *Job) error
@@ -100,10 +244,38 @@ type JobHandler interface {
 // JobQueue is the interface for job queue operations
 type JobQueue interface {
 	Enqueue(ctx context.Context, job *Job) error
-	Dequeue(ctx context.Context) (*Job, error)
+	// Dequeue waits for the next due job of one of the given types that is
+	// not paused
+	Dequeue(ctx context.Context, types []JobType) (*Job, error)
 	MarkCompleted(ctx context.Context, jobID string) error
 	MarkFailed(ctx context.Context, jobID string, err error) error
 	Schedule(ctx context.Context, job *Job, runAt time.Time) error
 	GetJob(ctx context.Context, jobID string) (*Job, error)
 	GetPendingJobs(ctx context.Context, jobType JobType) ([]*Job, error)
+	// Cancel removes a job that has not started yet; it reports whether
+	// there was such a job
+	Cancel(ctx context.Context, jobID string) (bool, error)
+	// Extend keeps a running job from being handed out again while its
+	// worker is still busy with it
+	Extend(ctx context.Context, jobID string) error
+	// IsActive reports whether a job with the unique key is pending or running
+	IsActive(ctx context.Context, uniqueKey string) (bool, error)
+	// ProcessScheduled makes due jobs available and recovers jobs whose
+	// worker went away
+	ProcessScheduled(ctx context.Context) error
+	Stats(ctx context.Context) (map[string]interface{}, error)
+
+	// ListJobs returns the jobs matching the filter, most recently updated
+	// first, and how many match in total
+	ListJobs(ctx context.Context, filter JobFilter) ([]*Job, int, error)
+	// Retry queues a dead-lettered job again; it reports false if the job is
+	// not dead-lettered
+	Retry(ctx context.Context, jobID string) (bool, error)
+	// Pause stops workers from starting jobs of a type until Resume
+	Pause(ctx context.Context, jobType JobType) error
+	Resume(ctx context.Context, jobType JobType) error
+	PausedTypes(ctx context.Context) ([]JobType, error)
+	// TypeStats returns the throughput and latency of each job type since the
+	// given time
+	TypeStats(ctx context.Context, since time.Time) ([]JobTypeStats, error)
 }
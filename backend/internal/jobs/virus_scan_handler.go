@@ -0,0 +1,59 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/google/uuid"
+	"github.com/tessera/tessera/internal/services"
+)
+
+// VirusScanHandler scans files for malware after they get new content
+type VirusScanHandler struct {
+	scans *services.ScanService
+}
+
+// NewVirusScanHandler creates a new virus scan handler
+func NewVirusScanHandler(scans *services.ScanService) *VirusScanHandler {
+	return &VirusScanHandler{scans: scans}
+}
+
+// Handle scans the current content of a file. A scanner that can't be
+// reached fails the job, so it is retried.
+func (h *VirusScanHandler) Handle(ctx context.Context, job *Job) error {
+	var payload VirusScanPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return fmt.Errorf("failed to unmarshal payload: %w", err)
+	}
+
+	fileID, err := uuid.Parse(payload.FileID)
+	if err != nil {
+		return fmt.Errorf("invalid file ID: %w", err)
+	}
+	return h.scans.ScanFile(ctx, fileID)
+}
+
+// VirusRescanHandler scans everything stored again, run by admins after
+// the scanner's signatures were updated
+type VirusRescanHandler struct {
+	scans *services.ScanService
+}
+
+// NewVirusRescanHandler creates a new virus rescan handler
+func NewVirusRescanHandler(scans *services.ScanService) *VirusRescanHandler {
+	return &VirusRescanHandler{scans: scans}
+}
+
+// Handle rescans every stored file and email attachment
+func (h *VirusRescanHandler) Handle(ctx context.Context, job *Job) error {
+	result, err := h.scans.RescanAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[VIRUS RESCAN] Scanned %d files and %d email attachments, %d infected, %d failed",
+		result.Files, result.Attachments, result.Infected, result.Failed)
+	return nil
+}
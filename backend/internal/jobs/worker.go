@@ -3,23 +3,34 @@ package jobs
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"sync"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/tessera/tessera/internal/middleware"
+	"github.com/tessera/tessera/internal/repository"
+	"github.com/tessera/tessera/internal/services"
+	ws "github.com/tessera/tessera/internal/websocket"
 )
 
+// jobHeartbeatInterval is how often a running job's visibility is extended
+const jobHeartbeatInterval = 30 * time.Second
+
 // Worker processes jobs from the queue
 type Worker struct {
-	queue       *MemoryQueue
+	queue       JobQueue
 	handlers    map[JobType]JobHandler
+	types       []JobType // types with a handler, fixed when the worker starts
 	concurrency int
 	stopCh      chan struct{}
 	wg          sync.WaitGroup
 }
 
 // NewWorker creates a new job worker
-func NewWorker(queue *MemoryQueue, concurrency int) *Worker {
+func NewWorker(queue JobQueue, concurrency int) *Worker {
 	if concurrency <= 0 {
 		concurrency = 4
 	}
@@ -40,6 +51,12 @@ func (w *Worker) RegisterHandler(jobType JobType, handler JobHandler) {
 func (w *Worker) Start(ctx context.Context) {
 	log.Printf("Starting job worker with %d goroutines", w.concurrency)
 
+	// Only take jobs this process can handle; with several replicas, jobs of
+	// other types stay queued for the replicas that can
+	for jobType := range w.handlers {
+		w.types = append(w.types, jobType)
+	}
+
 	// Start worker goroutines
 	for i := 0; i < w.concurrency; i++ {
 		w.wg.Add(1)
@@ -71,7 +88,7 @@ func (w *Worker) process(ctx context.Context, id int) {
 		default:
 			// Try to get a job with a timeout
 			jobCtx, cancel := context.WithTimeout(ctx, time.Second)
-			job, err := w.queue.Dequeue(jobCtx)
+			job, err := w.queue.Dequeue(jobCtx, w.types)
 			cancel()
 
 			if err != nil || job == nil {
@@ -94,24 +111,53 @@ func (w *Worker) processJob(ctx context.Context, job *Job) {
 	log.Printf("Processing job %s (type: %s, attempt: %d)", job.ID, job.Type, job.Attempts+1)
 
 	// Create a context with timeout for job processing
-	// Email sync jobs need longer timeout (30 min) for large mailboxes
+	// Email sync jobs need longer timeout (30 min) for large mailboxes, and
+	// encrypting existing storage rewrites every object, as checking it may
+	// read every one
 	timeout := 5 * time.Minute
-	if job.Type == JobTypeEmailSync {
+	switch job.Type {
+	case JobTypeEmailSync:
 		timeout = 30 * time.Minute
+	case JobTypeEncryptStorage, JobTypeStorageCheck:
+		timeout = 12 * time.Hour
 	}
 	jobCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
+	// Keep the queue from handing the job to another worker while it runs
+	done := make(chan struct{})
+	defer close(done)
+	go w.heartbeat(ctx, job.ID, done)
+
+	start := time.Now()
 	err := handler.Handle(jobCtx, job)
 	if err != nil {
 		log.Printf("Job %s failed: %v", job.ID, err)
+		middleware.RecordJobProcessed(string(job.Type), "failure", time.Since(start))
 		w.queue.MarkFailed(ctx, job.ID, err)
 	} else {
 		log.Printf("Job %s completed successfully", job.ID)
+		middleware.RecordJobProcessed(string(job.Type), "success", time.Since(start))
 		w.queue.MarkCompleted(ctx, job.ID)
 	}
 }
 
+func (w *Worker) heartbeat(ctx context.Context, jobID string, done <-chan struct{}) {
+	ticker := time.NewTicker(jobHeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := w.queue.Extend(ctx, jobID); err != nil {
+				log.Printf("Failed to extend job %s: %v", jobID, err)
+			}
+		}
+	}
+}
+
 func (w *Worker) scheduler(ctx context.Context) {
 	defer w.wg.Done()
 
@@ -125,63 +171,94 @@ func (w *Worker) scheduler(ctx context.Context) {
 		case <-w.stopCh:
 			return
 		case <-ticker.C:
-			w.queue.ProcessScheduled()
+			if err := w.queue.ProcessScheduled(ctx); err != nil {
+				log.Printf("Failed to process scheduled jobs: %v", err)
+			}
+			w.updateQueuedMetric(ctx)
 		}
 	}
 }
 
-// IsJobRunning checks if a job of the given type is currently running for the given key
-func (w *Worker) IsJobRunning(jobType JobType, key string) bool {
-	return w.queue.IsJobRunning(jobType, key)
+// updateQueuedMetric publishes the number of due jobs waiting for a worker
+func (w *Worker) updateQueuedMetric(ctx context.Context) {
+	stats, err := w.queue.Stats(ctx)
+	if err != nil {
+		return
+	}
+	switch pending := stats["pending"].(type) {
+	case int:
+		middleware.UpdateJobsQueued(pending)
+	case int64:
+		middleware.UpdateJobsQueued(int(pending))
+	}
+}
+
+// Queue returns the queue the worker takes jobs from
+func (w *Worker) Queue() JobQueue {
+	return w.queue
+}
+
+// IsJobActive checks if a job with the given unique key is pending or running
+func (w *Worker) IsJobActive(ctx context.Context, uniqueKey string) bool {
+	active, err := w.queue.IsActive(ctx, uniqueKey)
+	if err != nil {
+		log.Printf("Failed to check job %s: %v", uniqueKey, err)
+	}
+	return active
 }
 
 // Enqueue is a helper to enqueue a job
 func (w *Worker) Enqueue(ctx context.Context, jobType JobType, payload interface{}) error {
+	return w.EnqueueUnique(ctx, jobType, "", payload)
+}
+
+// EnqueueUnique enqueues a job unless one with the same unique key is
+// pending or running, in which case it returns ErrDuplicateJob
+func (w *Worker) EnqueueUnique(ctx context.Context, jobType JobType, uniqueKey string, payload interface{}) error {
 	job, err := CreateJob(jobType, payload)
 	if err != nil {
 		return err
 	}
+	job.UniqueKey = uniqueKey
 	return w.queue.Enqueue(ctx, job)
 }
 
 // Schedule is a helper to schedule a job
 func (w *Worker) Schedule(ctx context.Context, jobType JobType, payload interface{}, runAt time.Time) error {
+	return w.ScheduleUnique(ctx, jobType, "", payload, runAt)
+}
+
+// ScheduleUnique schedules a job unless one with the same unique key is
+// pending or running, in which case it returns ErrDuplicateJob
+func (w *Worker) ScheduleUnique(ctx context.Context, jobType JobType, uniqueKey string, payload interface{}, runAt time.Time) error {
 	job, err := CreateJob(jobType, payload)
 	if err != nil {
 		return err
 	}
+	job.UniqueKey = uniqueKey
 	return w.queue.Schedule(ctx, job, runAt)
 }
 
-// ThumbnailHandler handles thumbnail generation jobs
-type ThumbnailHandler struct {
-	// Add dependencies like storage service
+// Cancel removes a job that has not started yet
+func (w *Worker) Cancel(ctx context.Context, jobID string) (bool, error) {
+	return w.queue.Cancel(ctx, jobID)
 }
 
-func NewThumbnailHandler() *ThumbnailHandler {
-	return &ThumbnailHandler{}
-}
-
-func (h *ThumbnailHandler) Handle(ctx context.Context, job *Job) error {
-	var payload ThumbnailPayload
-	if err := json.Unmarshal(job.Payload, &payload); err != nil {
-		return fmt.Errorf("failed to unmarshal payload: %w", err)
-	}
-
-	log.Printf("Generating thumbnail for file %s", payload.FileID)
-
-	// TODO: Implement thumbnail generation
-	// For now, just log and return
-	return nil
+// Stats returns queue statistics
+func (w *Worker) Stats(ctx context.Context) (map[string]interface{}, error) {
+	return w.queue.Stats(ctx)
 }
 
 // CleanupHandler handles cleanup jobs
 type CleanupHandler struct {
-	// Add dependencies
+	uploadService *services.UploadService
+	fileService   *services.FileService
+	retention     *services.RetentionService
+	changes       *services.ChangeService
 }
 
-func NewCleanupHandler() *CleanupHandler {
-	return &CleanupHandler{}
+func NewCleanupHandler(uploadService *services.UploadService, fileService *services.FileService, retention *services.RetentionService, changes *services.ChangeService) *CleanupHandler {
+	return &CleanupHandler{uploadService: uploadService, fileService: fileService, retention: retention, changes: changes}
 }
 
 func (h *CleanupHandler) Handle(ctx context.Context, job *Job) error {
@@ -194,23 +271,68 @@ func (h *CleanupHandler) Handle(ctx context.Context, job *Job) error {
 
 	switch payload.Type {
 	case "trash":
-		// TODO: Clean up old trash items
+		// Purge files trashed longer than their owner's retention
+		purge, err := h.retention.PurgeTrash(ctx, false)
+		if err != nil {
+			return fmt.Errorf("failed to purge trash: %w", err)
+		}
+		if len(purge.Files) > 0 || purge.Skipped > 0 {
+			log.Printf("Purged %d trashed files (%d bytes), skipped %d", len(purge.Files), purge.BytesFreed, purge.Skipped)
+		}
 	case "temp":
-		// TODO: Clean up temporary files
+		// Abort resumable uploads that were abandoned past their expiry
+		purged, err := h.uploadService.PurgeExpired(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to purge expired uploads: %w", err)
+		}
+		if purged > 0 {
+			log.Printf("Purged %d expired uploads", purged)
+		}
+
+		// Delete stored content nothing refers to anymore
+		deleted, err := h.fileService.PurgeUnreferencedBlobs(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to purge unreferenced content: %w", err)
+		}
+		if deleted > 0 {
+			log.Printf("Deleted %d unreferenced objects", deleted)
+		}
 	case "expired_shares":
-		// TODO: Clean up expired share links
+		shares, err := h.retention.PurgeShares(ctx, false)
+		if err != nil {
+			return fmt.Errorf("failed to delete expired shares: %w", err)
+		}
+		if len(shares) > 0 {
+			log.Printf("Deleted %d expired shares", len(shares))
+		}
+	case "changes":
+		// Prune the change journal; sync clients behind it resync in full
+		pruned, err := h.changes.Prune(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to prune change journal: %w", err)
+		}
+		if pruned > 0 {
+			log.Printf("Pruned %d journaled file changes", pruned)
+		}
 	}
 
 	return nil
 }
 
-// NotificationHandler handles notification jobs
+// NotificationHandler delivers notifications to users over WebSocket, and
+// by email when system mail is configured
 type NotificationHandler struct {
-	// Add WebSocket hub for real-time notifications
+	userRepo *repository.UserRepository
+	hub      *ws.Hub
+	mailer   *services.Mailer
 }
 
-func NewNotificationHandler() *NotificationHandler {
-	return &NotificationHandler{}
+func NewNotificationHandler(userRepo *repository.UserRepository, hub *ws.Hub, mailer *services.Mailer) *NotificationHandler {
+	return &NotificationHandler{
+		userRepo: userRepo,
+		hub:      hub,
+		mailer:   mailer,
+	}
 }
 
 func (h *NotificationHandler) Handle(ctx context.Context, job *Job) error {
@@ -218,20 +340,47 @@ func (h *NotificationHandler) Handle(ctx context.Context, job *Job) error {
 	if err := json.Unmarshal(job.Payload, &payload); err != nil {
 		return fmt.Errorf("failed to unmarshal payload: %w", err)
 	}
+	userID, err := uuid.Parse(payload.UserID)
+	if err != nil {
+		return fmt.Errorf("invalid user ID: %w", err)
+	}
+	user, err := h.userRepo.GetByID(ctx, userID)
+	if errors.Is(err, repository.ErrUserNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
 
-	log.Printf("Sending notification to user %s: %s", payload.UserID, payload.Title)
-
-	// TODO: Send notification via WebSocket or email
+	h.hub.BroadcastToUser(userID, &ws.Event{
+		Type: ws.EventNotification,
+		Payload: map[string]interface{}{
+			"type":    payload.Type,
+			"title":   payload.Title,
+			"message": payload.Message,
+			"data":    payload.Data,
+		},
+		UserID:    userID,
+		Timestamp: time.Now().UnixMilli(),
+	})
+
+	if h.mailer.Enabled() && user.Email != "" {
+		// Not retried, which would repeat the WebSocket notification
+		if err := h.mailer.Send(user.Email, payload.Title, payload.Message+"\n"); err != nil {
+			log.Printf("Failed to email notification to user %s: %v", payload.UserID, err)
+		}
+	}
 	return nil
 }
 
-// QuotaCheckHandler handles quota check jobs
+// QuotaCheckHandler reconciles users' storage used with what their files,
+// versions and attachments take up, for one user or, without UserID, all
 type QuotaCheckHandler struct {
-	// Add dependencies
+	quota *services.QuotaService
 }
 
-func NewQuotaCheckHandler() *QuotaCheckHandler {
-	return &QuotaCheckHandler{}
+func NewQuotaCheckHandler(quota *services.QuotaService) *QuotaCheckHandler {
+	return &QuotaCheckHandler{quota: quota}
 }
 
 func (h *QuotaCheckHandler) Handle(ctx context.Context, job *Job) error {
@@ -240,19 +389,35 @@ func (h *QuotaCheckHandler) Handle(ctx context.Context, job *Job) error {
 		return fmt.Errorf("failed to unmarshal payload: %w", err)
 	}
 
-	log.Printf("Checking quota for user %s", payload.UserID)
+	var userID *uuid.UUID
+	if payload.UserID != "" {
+		id, err := uuid.Parse(payload.UserID)
+		if err != nil {
+			return fmt.Errorf("invalid user ID: %w", err)
+		}
+		userID = &id
+	}
 
-	// TODO: Check and update user quota
+	result, err := h.quota.Reconcile(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, m := range result.Corrected {
+		log.Printf("Corrected storage used of %s from %d to %d bytes", m.Email, m.Recorded, m.Actual)
+	}
+	if len(result.Corrected) > 0 || result.Warned > 0 {
+		log.Printf("Quota check corrected %d users and warned %d", len(result.Corrected), result.Warned)
+	}
 	return nil
 }
 
 // VersionCleanupHandler handles version cleanup jobs
 type VersionCleanupHandler struct {
-	// Add dependencies
+	retention *services.RetentionService
 }
 
-func NewVersionCleanupHandler() *VersionCleanupHandler {
-	return &VersionCleanupHandler{}
+func NewVersionCleanupHandler(retention *services.RetentionService) *VersionCleanupHandler {
+	return &VersionCleanupHandler{retention: retention}
 }
 
 func (h *VersionCleanupHandler) Handle(ctx context.Context, job *Job) error {
@@ -261,8 +426,23 @@ func (h *VersionCleanupHandler) Handle(ctx context.Context, job *Job) error {
 		return fmt.Errorf("failed to unmarshal payload: %w", err)
 	}
 
-	log.Printf("Cleaning up versions for file %s, keeping %d versions", payload.FileID, payload.KeepVersions)
+	if payload.FileID == "" {
+		sweep, err := h.retention.SweepVersions(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to sweep versions: %w", err)
+		}
+		if sweep.Versions > 0 {
+			log.Printf("Pruned %d versions of %d files (%d bytes)", sweep.Versions, sweep.Files, sweep.BytesFreed)
+		}
+		return nil
+	}
 
-	// TODO: Delete old versions
+	fileID, err := uuid.Parse(payload.FileID)
+	if err != nil {
+		return fmt.Errorf("invalid file ID: %w", err)
+	}
+	if _, _, err := h.retention.PruneVersions(ctx, fileID); err != nil {
+		return fmt.Errorf("failed to prune versions: %w", err)
+	}
 	return nil
 }
@@ -40,8 +40,12 @@ func Metrics() fiber.Handler {
 			metrics.HTTPRequestSize.WithLabelValues(method, path).Observe(float64(reqSize))
 		}
 
-		// Response size
-		respSize := len(c.Response().Body())
+		// Response size. A streamed body is measured by its Content-Length,
+		// as reading it here would buffer the whole stream.
+		respSize := c.Response().Header.ContentLength()
+		if !c.Response().IsBodyStream() {
+			respSize = len(c.Response().Body())
+		}
 		if respSize > 0 {
 			metrics.HTTPResponseSize.WithLabelValues(method, path).Observe(float64(respSize))
 		}
@@ -10,6 +10,8 @@ import (
 type CalendarEvent struct {
 	ID           uuid.UUID       `json:"id"`
 	UserID       uuid.UUID       `json:"userId"`
+	UID          string          `json:"uid"` // iCalendar UID, stable across CalDAV clients
+	ResourceName string          `json:"-"`   // CalDAV object name within the calendar collection
 	Title        string          `json:"title"`
 	Description  string          `json:"description"`
 	StartDate    time.Time       `json:"startDate"`
@@ -21,6 +23,15 @@ type CalendarEvent struct {
 	LinkedTaskID *string         `json:"linkedTaskId,omitempty"`
 	CreatedAt    time.Time       `json:"createdAt"`
 	UpdatedAt    time.Time       `json:"updatedAt"`
+
+	// RecurrenceID is the original start of an occurrence of a recurring
+	// event; it is set on expanded occurrences and on overrides. Together with
+	// ID (the series) it identifies one occurrence.
+	RecurrenceID *time.Time `json:"recurrenceId,omitempty"`
+	// SeriesID links a stored override to the recurring event it modifies
+	SeriesID *uuid.UUID `json:"-"`
+	// Overrides holds the modified occurrences of a recurring event
+	Overrides []CalendarEvent `json:"overrides,omitempty"`
 }
 
 // EventReminder represents a reminder for an event
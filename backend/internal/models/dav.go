@@ -0,0 +1,13 @@
+package models
+
+// DAV collection names used in the change journal
+const (
+	DAVCollectionCalendar = "calendar"
+	DAVCollectionContacts = "contacts"
+)
+
+// DAVChange is the latest recorded state of a resource in a DAV collection
+type DAVChange struct {
+	ResourceName string `json:"resource_name"`
+	Deleted      bool   `json:"deleted"`
+}
@@ -139,6 +139,9 @@ type EmailAttachment struct {
 	IsInline    bool      `json:"is_inline" db:"is_inline"`
 	StorageKey  string    `json:"-" db:"storage_key"`
 	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	// Virus is what the attachment was found to contain; such attachments
+	// can't be downloaded
+	Virus string `json:"virus,omitempty" db:"virus"`
 }
 
 // EmailListItem is a lightweight email for list views
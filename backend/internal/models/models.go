@@ -44,6 +44,32 @@ type Session struct {
 	CreatedAt    time.Time `json:"created_at"`
 }
 
+// UploadSession tracks an in-progress resumable (Tus) upload
+type UploadSession struct {
+	ID          string       `json:"id"`
+	UserID      uuid.UUID    `json:"user_id"`
+	ParentID    *uuid.UUID   `json:"parent_id,omitempty"`
+	FileName    string       `json:"file_name"`
+	Length      int64        `json:"length"`
+	Offset      int64        `json:"offset"`
+	Metadata    string       `json:"metadata,omitempty"` // Raw Upload-Metadata header, echoed on HEAD
+	StorageKey  string       `json:"storage_key"`        // Staging object assembled from the parts
+	MultipartID string       `json:"multipart_id"`
+	Parts       []UploadPart `json:"parts"`
+	TailKey     string       `json:"tail_key,omitempty"` // Bytes received that don't yet fill a part
+	TailSize    int64        `json:"tail_size"`
+	Assembled   bool         `json:"assembled,omitempty"` // Parts are combined into the staging object; only storing it is left
+	ExpiresAt   time.Time    `json:"expires_at"`
+	CreatedAt   time.Time    `json:"created_at"`
+}
+
+// UploadPart is a committed part of an upload session's multipart object
+type UploadPart struct {
+	Number int    `json:"number"`
+	ETag   string `json:"etag"`
+	Size   int64  `json:"size"`
+}
+
 // File represents a file or folder in the virtual file system
 type File struct {
 	ID         uuid.UUID  `json:"id"`
@@ -61,6 +87,25 @@ type File struct {
 	CreatedAt  time.Time  `json:"created_at"`
 	UpdatedAt  time.Time  `json:"updated_at"`
 	AccessedAt *time.Time `json:"accessed_at,omitempty"`
+	// ScanStatus is the virus scan state of the current content, one of the
+	// Scan constants, or empty when it was stored while scanning was off
+	ScanStatus string     `json:"scan_status,omitempty"`
+	Virus      string     `json:"virus,omitempty"` // what an infected file contains
+	ScannedAt  *time.Time `json:"scanned_at,omitempty"`
+}
+
+// File scan states
+const (
+	ScanPending  = "pending"
+	ScanClean    = "clean"
+	ScanInfected = "infected"
+	ScanSkipped  = "skipped" // too large for the scanner
+)
+
+// Infected reports whether the file's content was found to contain malware,
+// which quarantines it: it can't be downloaded or shared
+func (f *File) Infected() bool {
+	return f.ScanStatus == ScanInfected
 }
 
 // FileVersion represents a previous version of a file
@@ -73,8 +118,83 @@ type FileVersion struct {
 	Hash       string    `json:"-"`
 	CreatedAt  time.Time `json:"created_at"`
 	CreatedBy  uuid.UUID `json:"created_by"`
+	Pinned     bool      `json:"pinned"` // never pruned by version retention
+}
+
+// FileSearchFilter narrows a file search
+type FileSearchFilter struct {
+	Query          string
+	Type           string // "folder", "image", "video", "audio", "document" or a MIME type
+	MinSize        *int64
+	MaxSize        *int64
+	ModifiedAfter  *time.Time
+	ModifiedBefore *time.Time
+	FolderID       *uuid.UUID // searches the folder and its subfolders
+	Limit          int
+	Offset         int
+}
+
+// FileSearchResult is a file matched by a search. Snippet is HTML-escaped
+// content around the matches, which are wrapped in <mark>.
+type FileSearchResult struct {
+	*File
+	Snippet string  `json:"snippet,omitempty"`
+	Rank    float64 `json:"rank"`
+}
+
+// FileThumbnail is a generated preview of a file at one size
+type FileThumbnail struct {
+	FileID     uuid.UUID `json:"file_id"`
+	Size       string    `json:"size"`
+	StorageKey string    `json:"-"`
+	Width      int       `json:"width"`
+	Height     int       `json:"height"`
+	Bytes      int64     `json:"bytes"`
+	SourceHash string    `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// DataKey encrypts a user's stored objects, wrapped by a master key
+type DataKey struct {
+	ID          uuid.UUID  `json:"id"`
+	OwnerID     uuid.UUID  `json:"owner_id"` // the nil UUID for objects no user owns
+	WrappedKey  []byte     `json:"-"`
+	MasterKeyID string     `json:"master_key_id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	RotatedAt   *time.Time `json:"rotated_at,omitempty"`
+}
+
+// FileProperty is a WebDAV dead property of a file: one a client set with
+// PROPPATCH, which the server stores without interpreting
+type FileProperty struct {
+	FileID    uuid.UUID `json:"file_id"`
+	Namespace string    `json:"namespace"`
+	Name      string    `json:"name"`
+	Value     string    `json:"value"` // inner XML of the property element
+}
+
+// Lock is a WebDAV write lock on a file or folder. A folder lock with
+// Infinite depth also covers everything inside it.
+type Lock struct {
+	Token     string    `json:"token"`
+	FileID    uuid.UUID `json:"file_id"`
+	OwnerID   uuid.UUID `json:"owner_id"` // owner of the locked file
+	UserID    uuid.UUID `json:"user_id"`  // who took the lock
+	Scope     string    `json:"scope"`    // "exclusive" or "shared"
+	Infinite  bool      `json:"infinite"`
+	Owner     string    `json:"owner,omitempty"` // the client's <owner> XML
+	Root      string    `json:"root"`            // URL the lock was taken on
+	Timeout   int64     `json:"timeout"`         // seconds
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
+// LockScope constants
+const (
+	LockExclusive = "exclusive"
+	LockShared    = "shared"
+)
+
 // Share represents a file or folder sharing configuration
 type Share struct {
 	ID             uuid.UUID  `json:"id"`
@@ -90,20 +210,41 @@ type Share struct {
 	ViewCount      int        `json:"view_count"`
 	LastAccessedAt *time.Time `json:"last_accessed_at,omitempty"`
 	CreatedAt      time.Time  `json:"created_at"`
+
+	// Limits of a file request, a link with the "upload" permission
+	MaxUploadSize     *int64   `json:"max_upload_size,omitempty"`
+	MaxUploads        *int     `json:"max_uploads,omitempty"`
+	UploadCount       int      `json:"upload_count"`
+	AllowedExtensions []string `json:"allowed_extensions,omitempty"`
+}
+
+// FileChange is an entry of a user's change journal. IDs increase with
+// every change, so the last one a client has seen is its sync cursor.
+type FileChange struct {
+	ID        int64      `json:"id"`
+	UserID    uuid.UUID  `json:"-"`
+	FileID    uuid.UUID  `json:"file_id"`
+	ParentID  *uuid.UUID `json:"parent_id,omitempty"`
+	Type      string     `json:"type"`
+	Name      string     `json:"name"`
+	IsFolder  bool       `json:"is_folder"`
+	CreatedAt time.Time  `json:"created_at"`
 }
 
 // SharedFile represents a file shared with a user (used in queries)
 type SharedFile struct {
-	ID         uuid.UUID `json:"id"`
-	Name       string    `json:"name"`
-	IsFolder   bool      `json:"is_folder"`
-	Size       int64     `json:"size"`
-	MimeType   string    `json:"mime_type"`
-	Permission string    `json:"permission"`
-	OwnerID    uuid.UUID `json:"owner_id"`
-	OwnerName  string    `json:"owner_name"`
-	OwnerEmail string    `json:"owner_email"`
-	SharedAt   time.Time `json:"shared_at"`
+	ID         uuid.UUID  `json:"id"`
+	Name       string     `json:"name"`
+	IsFolder   bool       `json:"is_folder"`
+	Size       int64      `json:"size"`
+	MimeType   string     `json:"mime_type"`
+	Permission string     `json:"permission"`
+	OwnerID    uuid.UUID  `json:"owner_id"`
+	OwnerName  string     `json:"owner_name"`
+	OwnerEmail string     `json:"owner_email"`
+	SharedAt   time.Time  `json:"shared_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	UpdatedAt  time.Time  `json:"updated_at"`
 }
 
 // AuditLog represents an immutable activity log entry
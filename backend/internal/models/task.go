@@ -44,6 +44,8 @@ type RecurrenceRule struct {
 	EndDate              *time.Time `json:"endDate,omitempty"`
 	Occurrences          *int       `json:"occurrences,omitempty"`
 	OccurrencesCompleted int        `json:"occurrencesCompleted"`
+	// ExceptionDates lists the start times of skipped occurrences (calendar events only)
+	ExceptionDates []time.Time `json:"exceptionDates,omitempty"`
 }
 
 // TaskGroup represents a task group
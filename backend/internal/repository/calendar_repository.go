@@ -3,13 +3,22 @@ package repository
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/tessera/tessera/internal/models"
 )
 
+// Calendar repository errors
+var (
+	ErrEventNotFound = errors.New("event not found")
+	ErrFeedNotFound  = errors.New("calendar feed not found")
+)
+
 // CalendarRepository handles calendar event database operations
 type CalendarRepository struct {
 	db *pgxpool.Pool
@@ -20,106 +29,208 @@ func NewCalendarRepository(db *pgxpool.Pool) *CalendarRepository {
 	return &CalendarRepository{db: db}
 }
 
-// ListByUser returns events for a user within a date range
-func (r *CalendarRepository) ListByUser(ctx context.Context, userID uuid.UUID, startDate, endDate time.Time) ([]models.CalendarEvent, error) {
-	query := `
-		SELECT id, user_id, title, description, start_date, end_date, all_day,
-		       color, recurrence, reminders, linked_task_id, created_at, updated_at
-		FROM calendar_events
-		WHERE user_id = $1 AND start_date <= $3 AND end_date >= $2
-		ORDER BY start_date ASC
-	`
+const calendarEventColumns = `
+	id, user_id, uid, resource_name, title, description, start_date, end_date, all_day,
+	color, recurrence, reminders, linked_task_id, created_at, updated_at, series_id, recurrence_id
+`
 
-	rows, err := r.db.Query(ctx, query, userID, startDate, endDate)
+func scanCalendarEvent(row pgx.Row) (*models.CalendarEvent, error) {
+	var e models.CalendarEvent
+	var recurrenceJSON, remindersJSON []byte
+	if err := row.Scan(
+		&e.ID, &e.UserID, &e.UID, &e.ResourceName, &e.Title, &e.Description, &e.StartDate, &e.EndDate,
+		&e.AllDay, &e.Color, &recurrenceJSON, &remindersJSON, &e.LinkedTaskID,
+		&e.CreatedAt, &e.UpdatedAt, &e.SeriesID, &e.RecurrenceID,
+	); err != nil {
+		return nil, err
+	}
+
+	if recurrenceJSON != nil {
+		var rec models.RecurrenceRule
+		if err := json.Unmarshal(recurrenceJSON, &rec); err == nil && rec.Type != "" {
+			e.Recurrence = &rec
+		}
+	}
+	if remindersJSON != nil {
+		json.Unmarshal(remindersJSON, &e.Reminders)
+	}
+	if e.Reminders == nil {
+		e.Reminders = []models.EventReminder{}
+	}
+	return &e, nil
+}
+
+// queryEvents loads recurring events together with their overrides; the
+// queries passed in select series rows only (series_id IS NULL)
+func (r *CalendarRepository) queryEvents(ctx context.Context, query string, args ...interface{}) ([]models.CalendarEvent, error) {
+	events, err := r.scanEvents(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.attachOverrides(ctx, events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+func (r *CalendarRepository) scanEvents(ctx context.Context, query string, args ...interface{}) ([]models.CalendarEvent, error) {
+	rows, err := r.db.Query(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var events []models.CalendarEvent
+	events := []models.CalendarEvent{}
 	for rows.Next() {
-		var e models.CalendarEvent
-		var recurrenceJSON, remindersJSON []byte
-		if err := rows.Scan(
-			&e.ID, &e.UserID, &e.Title, &e.Description, &e.StartDate, &e.EndDate,
-			&e.AllDay, &e.Color, &recurrenceJSON, &remindersJSON, &e.LinkedTaskID,
-			&e.CreatedAt, &e.UpdatedAt,
-		); err != nil {
+		e, err := scanCalendarEvent(rows)
+		if err != nil {
 			return nil, err
 		}
-		if recurrenceJSON != nil {
-			var rec models.RecurrenceRule
-			if err := json.Unmarshal(recurrenceJSON, &rec); err == nil {
-				e.Recurrence = &rec
-			}
-		}
-		if remindersJSON != nil {
-			json.Unmarshal(remindersJSON, &e.Reminders)
-		}
-		if e.Reminders == nil {
-			e.Reminders = []models.EventReminder{}
+		events = append(events, *e)
+	}
+	return events, rows.Err()
+}
+
+func (r *CalendarRepository) getEvent(ctx context.Context, query string, args ...interface{}) (*models.CalendarEvent, error) {
+	e, err := scanCalendarEvent(r.db.QueryRow(ctx, query, args...))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrEventNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	events := []models.CalendarEvent{*e}
+	if err := r.attachOverrides(ctx, events); err != nil {
+		return nil, err
+	}
+	return &events[0], nil
+}
+
+// attachOverrides fills Overrides on the recurring events in the slice
+func (r *CalendarRepository) attachOverrides(ctx context.Context, events []models.CalendarEvent) error {
+	var ids []uuid.UUID
+	for i := range events {
+		if events[i].Recurrence != nil {
+			ids = append(ids, events[i].ID)
 		}
-		events = append(events, e)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	overrides, err := r.scanEvents(ctx, `SELECT `+calendarEventColumns+`
+		FROM calendar_events
+		WHERE series_id = ANY($1)
+		ORDER BY recurrence_id ASC
+	`, ids)
+	if err != nil {
+		return err
 	}
 
-	if events == nil {
-		events = []models.CalendarEvent{}
+	bySeries := make(map[uuid.UUID][]models.CalendarEvent, len(ids))
+	for _, o := range overrides {
+		bySeries[*o.SeriesID] = append(bySeries[*o.SeriesID], o)
 	}
-	return events, nil
+	for i := range events {
+		events[i].Overrides = bySeries[events[i].ID]
+	}
+	return nil
+}
+
+// ListByUser returns events for a user within a date range
+func (r *CalendarRepository) ListByUser(ctx context.Context, userID uuid.UUID, startDate, endDate time.Time) ([]models.CalendarEvent, error) {
+	query := `SELECT ` + calendarEventColumns + `
+		FROM calendar_events
+		WHERE user_id = $1 AND series_id IS NULL AND start_date <= $3 AND end_date >= $2
+		ORDER BY start_date ASC
+	`
+	return r.queryEvents(ctx, query, userID, startDate, endDate)
+}
+
+// ListInRange returns the events overlapping a date range, plus recurring
+// events that start before the range ends (their occurrences may fall inside it)
+func (r *CalendarRepository) ListInRange(ctx context.Context, userID uuid.UUID, startDate, endDate time.Time) ([]models.CalendarEvent, error) {
+	query := `SELECT ` + calendarEventColumns + `
+		FROM calendar_events
+		WHERE user_id = $1 AND series_id IS NULL AND start_date <= $3 AND (end_date >= $2 OR recurrence IS NOT NULL)
+		ORDER BY start_date ASC
+	`
+	return r.queryEvents(ctx, query, userID, startDate, endDate)
+}
+
+// ListAll returns every event belonging to a user
+func (r *CalendarRepository) ListAll(ctx context.Context, userID uuid.UUID) ([]models.CalendarEvent, error) {
+	query := `SELECT ` + calendarEventColumns + `
+		FROM calendar_events
+		WHERE user_id = $1 AND series_id IS NULL
+		ORDER BY start_date ASC
+	`
+	return r.queryEvents(ctx, query, userID)
+}
+
+// ListByResourceNames returns the events stored under the given CalDAV resource names
+func (r *CalendarRepository) ListByResourceNames(ctx context.Context, userID uuid.UUID, names []string) ([]models.CalendarEvent, error) {
+	query := `SELECT ` + calendarEventColumns + `
+		FROM calendar_events
+		WHERE user_id = $1 AND series_id IS NULL AND resource_name = ANY($2)
+	`
+	return r.queryEvents(ctx, query, userID, names)
 }
 
 // GetByID returns a single event
 func (r *CalendarRepository) GetByID(ctx context.Context, eventID, userID uuid.UUID) (*models.CalendarEvent, error) {
-	query := `
-		SELECT id, user_id, title, description, start_date, end_date, all_day,
-		       color, recurrence, reminders, linked_task_id, created_at, updated_at
+	query := `SELECT ` + calendarEventColumns + `
 		FROM calendar_events
-		WHERE id = $1 AND user_id = $2
+		WHERE id = $1 AND user_id = $2 AND series_id IS NULL
 	`
+	return r.getEvent(ctx, query, eventID, userID)
+}
 
-	var e models.CalendarEvent
-	var recurrenceJSON, remindersJSON []byte
-	err := r.db.QueryRow(ctx, query, eventID, userID).Scan(
-		&e.ID, &e.UserID, &e.Title, &e.Description, &e.StartDate, &e.EndDate,
-		&e.AllDay, &e.Color, &recurrenceJSON, &remindersJSON, &e.LinkedTaskID,
-		&e.CreatedAt, &e.UpdatedAt,
-	)
-	if err != nil {
-		return nil, err
-	}
+// GetByResourceName returns the event stored under a CalDAV resource name
+func (r *CalendarRepository) GetByResourceName(ctx context.Context, userID uuid.UUID, name string) (*models.CalendarEvent, error) {
+	query := `SELECT ` + calendarEventColumns + `
+		FROM calendar_events
+		WHERE user_id = $1 AND series_id IS NULL AND resource_name = $2
+	`
+	return r.getEvent(ctx, query, userID, name)
+}
 
-	if recurrenceJSON != nil {
-		var rec models.RecurrenceRule
-		if err := json.Unmarshal(recurrenceJSON, &rec); err == nil {
-			e.Recurrence = &rec
-		}
-	}
-	if remindersJSON != nil {
-		json.Unmarshal(remindersJSON, &e.Reminders)
-	}
-	if e.Reminders == nil {
-		e.Reminders = []models.EventReminder{}
-	}
-	return &e, nil
+// GetByUID returns the event with the given iCalendar UID
+func (r *CalendarRepository) GetByUID(ctx context.Context, userID uuid.UUID, uid string) (*models.CalendarEvent, error) {
+	query := `SELECT ` + calendarEventColumns + `
+		FROM calendar_events
+		WHERE user_id = $1 AND series_id IS NULL AND uid = $2
+	`
+	return r.getEvent(ctx, query, userID, uid)
 }
 
 // Create inserts a new calendar event
 func (r *CalendarRepository) Create(ctx context.Context, event *models.CalendarEvent) error {
+	if event.UID == "" {
+		event.UID = event.ID.String()
+	}
+	if event.ResourceName == "" {
+		event.ResourceName = event.ID.String() + ".ics"
+	}
+
 	recurrenceJSON, _ := json.Marshal(event.Recurrence)
 	remindersJSON, _ := json.Marshal(event.Reminders)
 
 	query := `
-		INSERT INTO calendar_events (id, user_id, title, description, start_date, end_date, all_day,
+		INSERT INTO calendar_events (id, user_id, uid, resource_name, title, description, start_date, end_date, all_day,
 		                              color, recurrence, reminders, linked_task_id, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
 	`
 
 	_, err := r.db.Exec(ctx, query,
-		event.ID, event.UserID, event.Title, event.Description, event.StartDate, event.EndDate,
+		event.ID, event.UserID, event.UID, event.ResourceName, event.Title, event.Description, event.StartDate, event.EndDate,
 		event.AllDay, event.Color, recurrenceJSON, remindersJSON, event.LinkedTaskID,
 		event.CreatedAt, event.UpdatedAt,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	return recordDAVChange(ctx, r.db, event.UserID, models.DAVCollectionCalendar, event.ResourceName, false)
 }
 
 // Update updates a calendar event
@@ -131,31 +242,243 @@ func (r *CalendarRepository) Update(ctx context.Context, event *models.CalendarE
 		UPDATE calendar_events SET
 			title = $3, description = $4, start_date = $5, end_date = $6, all_day = $7,
 			color = $8, recurrence = $9, reminders = $10, linked_task_id = $11, updated_at = $12
-		WHERE id = $1 AND user_id = $2
+		WHERE id = $1 AND user_id = $2 AND series_id IS NULL
+		RETURNING resource_name
 	`
 
-	_, err := r.db.Exec(ctx, query,
+	var resourceName string
+	err := r.db.QueryRow(ctx, query,
 		event.ID, event.UserID, event.Title, event.Description, event.StartDate, event.EndDate,
 		event.AllDay, event.Color, recurrenceJSON, remindersJSON, event.LinkedTaskID,
 		event.UpdatedAt,
-	)
-	return err
+	).Scan(&resourceName)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrEventNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return recordDAVChange(ctx, r.db, event.UserID, models.DAVCollectionCalendar, resourceName, false)
 }
 
 // Delete deletes a calendar event
 func (r *CalendarRepository) Delete(ctx context.Context, eventID, userID uuid.UUID) error {
-	_, err := r.db.Exec(ctx, "DELETE FROM calendar_events WHERE id = $1 AND user_id = $2", eventID, userID)
-	return err
+	var resourceName string
+	err := r.db.QueryRow(ctx,
+		"DELETE FROM calendar_events WHERE id = $1 AND user_id = $2 AND series_id IS NULL RETURNING resource_name",
+		eventID, userID,
+	).Scan(&resourceName)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return recordDAVChange(ctx, r.db, userID, models.DAVCollectionCalendar, resourceName, true)
 }
 
 // DeleteByTaskID deletes all calendar events linked to a specific task
 func (r *CalendarRepository) DeleteByTaskID(ctx context.Context, userID uuid.UUID, taskID string) (int64, error) {
-	result, err := r.db.Exec(ctx,
-		"DELETE FROM calendar_events WHERE user_id = $1 AND linked_task_id = $2",
+	rows, err := r.db.Query(ctx,
+		"DELETE FROM calendar_events WHERE user_id = $1 AND linked_task_id = $2 AND series_id IS NULL RETURNING resource_name",
 		userID, taskID,
 	)
 	if err != nil {
 		return 0, err
 	}
-	return result.RowsAffected(), nil
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, name := range names {
+		if err := recordDAVChange(ctx, r.db, userID, models.DAVCollectionCalendar, name, true); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(names)), nil
+}
+
+// Overrides are stored as rows of their own but belong to the series' CalDAV
+// resource, so the methods below do not record DAV changes: callers follow an
+// override change with Update on the series, which bumps its ETag.
+
+// SaveOverride inserts or replaces the override of one occurrence of a series
+func (r *CalendarRepository) SaveOverride(ctx context.Context, series, override *models.CalendarEvent) error {
+	return saveOverride(ctx, r.db, series, override)
+}
+
+// dbExecer is satisfied by both the pool and a transaction
+type dbExecer interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+}
+
+func saveOverride(ctx context.Context, db dbExecer, series, override *models.CalendarEvent) error {
+	if override.RecurrenceID == nil {
+		return errors.New("override without recurrence ID")
+	}
+	if override.ID == uuid.Nil {
+		override.ID = uuid.New()
+	}
+	override.UserID = series.UserID
+	override.UID = series.UID
+	override.ResourceName = series.ResourceName
+	override.SeriesID = &series.ID
+	override.Recurrence = nil
+	if override.Reminders == nil {
+		override.Reminders = []models.EventReminder{}
+	}
+	if override.CreatedAt.IsZero() {
+		override.CreatedAt = series.UpdatedAt
+	}
+	if override.UpdatedAt.IsZero() {
+		override.UpdatedAt = series.UpdatedAt
+	}
+	remindersJSON, _ := json.Marshal(override.Reminders)
+
+	query := `
+		INSERT INTO calendar_events (id, user_id, uid, resource_name, series_id, recurrence_id, title, description,
+		                              start_date, end_date, all_day, color, reminders, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+		ON CONFLICT (series_id, recurrence_id) WHERE series_id IS NOT NULL DO UPDATE SET
+			title = EXCLUDED.title, description = EXCLUDED.description, start_date = EXCLUDED.start_date,
+			end_date = EXCLUDED.end_date, all_day = EXCLUDED.all_day, color = EXCLUDED.color,
+			reminders = EXCLUDED.reminders, updated_at = EXCLUDED.updated_at
+	`
+	_, err := db.Exec(ctx, query,
+		override.ID, override.UserID, override.UID, override.ResourceName, series.ID, *override.RecurrenceID,
+		override.Title, override.Description, override.StartDate, override.EndDate, override.AllDay,
+		override.Color, remindersJSON, override.CreatedAt, override.UpdatedAt,
+	)
+	return err
+}
+
+// SetOverrides replaces every override of a series
+func (r *CalendarRepository) SetOverrides(ctx context.Context, series *models.CalendarEvent, overrides []models.CalendarEvent) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "DELETE FROM calendar_events WHERE series_id = $1 AND user_id = $2", series.ID, series.UserID); err != nil {
+		return err
+	}
+	for i := range overrides {
+		if err := saveOverride(ctx, tx, series, &overrides[i]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// DeleteOverride removes the override of one occurrence, if any
+func (r *CalendarRepository) DeleteOverride(ctx context.Context, series *models.CalendarEvent, recurrenceID time.Time) error {
+	_, err := r.db.Exec(ctx,
+		"DELETE FROM calendar_events WHERE series_id = $1 AND user_id = $2 AND recurrence_id = $3",
+		series.ID, series.UserID, recurrenceID,
+	)
+	return err
+}
+
+// DeleteOverridesFrom removes the overrides of occurrences starting at or after from
+func (r *CalendarRepository) DeleteOverridesFrom(ctx context.Context, series *models.CalendarEvent, from time.Time) error {
+	_, err := r.db.Exec(ctx,
+		"DELETE FROM calendar_events WHERE series_id = $1 AND user_id = $2 AND recurrence_id >= $3",
+		series.ID, series.UserID, from,
+	)
+	return err
+}
+
+// ShiftOverrides moves the recurrence IDs of all overrides of a series by
+// delta, after the series start has moved
+func (r *CalendarRepository) ShiftOverrides(ctx context.Context, series *models.CalendarEvent, delta time.Duration) error {
+	_, err := r.db.Exec(ctx,
+		"UPDATE calendar_events SET recurrence_id = recurrence_id + make_interval(secs => $3) WHERE series_id = $1 AND user_id = $2",
+		series.ID, series.UserID, delta.Seconds(),
+	)
+	return err
+}
+
+// ListWithReminders returns the events of all users that have reminders and
+// may occur between start and end (wall-clock times, as stored)
+func (r *CalendarRepository) ListWithReminders(ctx context.Context, startDate, endDate time.Time) ([]models.CalendarEvent, error) {
+	query := `SELECT ` + calendarEventColumns + `
+		FROM calendar_events e
+		WHERE series_id IS NULL AND start_date <= $2 AND (end_date >= $1 OR recurrence IS NOT NULL)
+		  AND (reminders <> '[]'::jsonb OR EXISTS (
+			SELECT 1 FROM calendar_events o WHERE o.series_id = e.id AND o.reminders <> '[]'::jsonb
+		  ))
+		ORDER BY start_date ASC
+	`
+	return r.queryEvents(ctx, query, startDate, endDate)
+}
+
+// ClaimReminder records that the reminder of an event due at fireAt is being
+// delivered. It returns false if it was claimed before.
+func (r *CalendarRepository) ClaimReminder(ctx context.Context, eventID uuid.UUID, fireAt time.Time) (bool, error) {
+	tag, err := r.db.Exec(ctx,
+		"INSERT INTO calendar_reminder_deliveries (event_id, fire_at) VALUES ($1, $2) ON CONFLICT DO NOTHING",
+		eventID, fireAt,
+	)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// PurgeReminderDeliveries forgets reminders delivered before the given time
+func (r *CalendarRepository) PurgeReminderDeliveries(ctx context.Context, before time.Time) (int64, error) {
+	tag, err := r.db.Exec(ctx, "DELETE FROM calendar_reminder_deliveries WHERE delivered_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// GetFeedToken returns the secret token of a user's subscription feed
+func (r *CalendarRepository) GetFeedToken(ctx context.Context, userID uuid.UUID) (string, error) {
+	var token string
+	err := r.db.QueryRow(ctx, "SELECT token FROM calendar_feeds WHERE user_id = $1", userID).Scan(&token)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrFeedNotFound
+	}
+	return token, err
+}
+
+// SetFeedToken enables the subscription feed, replacing any previous token
+func (r *CalendarRepository) SetFeedToken(ctx context.Context, userID uuid.UUID, token string) error {
+	query := `
+		INSERT INTO calendar_feeds (user_id, token, created_at)
+		VALUES ($1, $2, NOW())
+		ON CONFLICT (user_id) DO UPDATE SET token = EXCLUDED.token, created_at = EXCLUDED.created_at
+	`
+	_, err := r.db.Exec(ctx, query, userID, token)
+	return err
+}
+
+// DeleteFeedToken disables the subscription feed
+func (r *CalendarRepository) DeleteFeedToken(ctx context.Context, userID uuid.UUID) error {
+	_, err := r.db.Exec(ctx, "DELETE FROM calendar_feeds WHERE user_id = $1", userID)
+	return err
+}
+
+// GetFeedOwner returns the user a subscription feed token belongs to
+func (r *CalendarRepository) GetFeedOwner(ctx context.Context, token string) (uuid.UUID, error) {
+	var userID uuid.UUID
+	err := r.db.QueryRow(ctx, "SELECT user_id FROM calendar_feeds WHERE token = $1", token).Scan(&userID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return uuid.Nil, ErrFeedNotFound
+	}
+	return userID, err
 }
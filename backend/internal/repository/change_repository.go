@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/tessera/tessera/internal/models"
+)
+
+// ChangeRepository handles the journal of changes to users' files
+type ChangeRepository struct {
+	db *pgxpool.Pool
+}
+
+// NewChangeRepository creates a new change repository
+func NewChangeRepository(db *pgxpool.Pool) *ChangeRepository {
+	return &ChangeRepository{db: db}
+}
+
+// Record appends a change to its user's journal
+func (r *ChangeRepository) Record(ctx context.Context, change *models.FileChange) error {
+	query := `
+		INSERT INTO file_changes (user_id, file_id, parent_id, change_type, name, is_folder)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`
+	return r.db.QueryRow(ctx, query,
+		change.UserID, change.FileID, change.ParentID, change.Type, change.Name, change.IsFolder,
+	).Scan(&change.ID, &change.CreatedAt)
+}
+
+// List returns up to limit changes of a user made after the change with ID
+// after, oldest first
+func (r *ChangeRepository) List(ctx context.Context, userID uuid.UUID, after int64, limit int) ([]*models.FileChange, error) {
+	query := `
+		SELECT id, user_id, file_id, parent_id, change_type, name, is_folder, created_at
+		FROM file_changes
+		WHERE user_id = $1 AND id > $2
+		ORDER BY id
+		LIMIT $3
+	`
+	rows, err := r.db.Query(ctx, query, userID, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := make([]*models.FileChange, 0)
+	for rows.Next() {
+		c := &models.FileChange{}
+		if err := rows.Scan(&c.ID, &c.UserID, &c.FileID, &c.ParentID, &c.Type, &c.Name, &c.IsFolder, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// Bounds returns the ID of a user's latest change and the highest ID pruned
+// from their journal. Either is 0 when there is none.
+func (r *ChangeRepository) Bounds(ctx context.Context, userID uuid.UUID) (latest, prunedThrough int64, err error) {
+	query := `
+		SELECT COALESCE((SELECT MAX(id) FROM file_changes WHERE user_id = $1), 0),
+		       changes_pruned_through
+		FROM users
+		WHERE id = $1
+	`
+	err = r.db.QueryRow(ctx, query, userID).Scan(&latest, &prunedThrough)
+	return latest, prunedThrough, err
+}
+
+// Prune deletes up to limit changes made before cutoff, recording for each
+// user the highest ID deleted. It returns how many were deleted.
+func (r *ChangeRepository) Prune(ctx context.Context, cutoff time.Time, limit int) (int, error) {
+	query := `
+		WITH pruned AS (
+			DELETE FROM file_changes
+			WHERE id IN (
+				SELECT id FROM file_changes WHERE created_at < $1 ORDER BY id LIMIT $2
+			)
+			RETURNING user_id, id
+		), floors AS (
+			UPDATE users u
+			SET changes_pruned_through = GREATEST(u.changes_pruned_through, p.max_id)
+			FROM (SELECT user_id, MAX(id) AS max_id FROM pruned GROUP BY user_id) p
+			WHERE u.id = p.user_id
+		)
+		SELECT COUNT(*) FROM pruned
+	`
+	var deleted int
+	err := r.db.QueryRow(ctx, query, cutoff, limit).Scan(&deleted)
+	return deleted, err
+}
@@ -2,13 +2,18 @@ package repository
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/tessera/tessera/internal/models"
 )
 
+// ErrContactNotFound is returned when a contact does not exist
+var ErrContactNotFound = errors.New("contact not found")
+
 // ContactRepository handles contact database operations
 type ContactRepository struct {
 	db *pgxpool.Pool
@@ -19,76 +24,119 @@ func NewContactRepository(db *pgxpool.Pool) *ContactRepository {
 	return &ContactRepository{db: db}
 }
 
-// ListByUser returns all contacts for a user
-func (r *ContactRepository) ListByUser(ctx context.Context, userID uuid.UUID) ([]models.Contact, error) {
-	query := `
-		SELECT id, user_id, first_name, last_name, email, phone, company, job_title,
-		       birthday, notes, avatar, favorite, created_at, updated_at
-		FROM contacts
-		WHERE user_id = $1
-		ORDER BY first_name ASC, last_name ASC
-	`
+const contactColumns = `
+	id, user_id, uid, resource_name, first_name, last_name, email, phone, company, job_title,
+	birthday, notes, avatar, favorite, COALESCE(vcard, ''), created_at, updated_at
+`
 
-	rows, err := r.db.Query(ctx, query, userID)
+func scanContact(row pgx.Row) (*models.Contact, error) {
+	var c models.Contact
+	if err := row.Scan(
+		&c.ID, &c.UserID, &c.UID, &c.ResourceName, &c.FirstName, &c.LastName, &c.Email, &c.Phone,
+		&c.Company, &c.JobTitle, &c.Birthday, &c.Notes, &c.Avatar,
+		&c.Favorite, &c.VCard, &c.CreatedAt, &c.UpdatedAt,
+	); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (r *ContactRepository) queryContacts(ctx context.Context, query string, args ...interface{}) ([]models.Contact, error) {
+	rows, err := r.db.Query(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var contacts []models.Contact
+	contacts := []models.Contact{}
 	for rows.Next() {
-		var c models.Contact
-		if err := rows.Scan(
-			&c.ID, &c.UserID, &c.FirstName, &c.LastName, &c.Email, &c.Phone,
-			&c.Company, &c.JobTitle, &c.Birthday, &c.Notes, &c.Avatar,
-			&c.Favorite, &c.CreatedAt, &c.UpdatedAt,
-		); err != nil {
+		c, err := scanContact(rows)
+		if err != nil {
 			return nil, err
 		}
-		contacts = append(contacts, c)
+		contacts = append(contacts, *c)
 	}
+	return contacts, rows.Err()
+}
 
-	if contacts == nil {
-		contacts = []models.Contact{}
+func (r *ContactRepository) getContact(ctx context.Context, query string, args ...interface{}) (*models.Contact, error) {
+	c, err := scanContact(r.db.QueryRow(ctx, query, args...))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrContactNotFound
 	}
-	return contacts, nil
+	return c, err
+}
+
+// ListByUser returns all contacts for a user
+func (r *ContactRepository) ListByUser(ctx context.Context, userID uuid.UUID) ([]models.Contact, error) {
+	query := `SELECT ` + contactColumns + `
+		FROM contacts
+		WHERE user_id = $1
+		ORDER BY first_name ASC, last_name ASC
+	`
+	return r.queryContacts(ctx, query, userID)
+}
+
+// ListByResourceNames returns the contacts stored under the given CardDAV resource names
+func (r *ContactRepository) ListByResourceNames(ctx context.Context, userID uuid.UUID, names []string) ([]models.Contact, error) {
+	query := `SELECT ` + contactColumns + `
+		FROM contacts
+		WHERE user_id = $1 AND resource_name = ANY($2)
+	`
+	return r.queryContacts(ctx, query, userID, names)
 }
 
 // GetByID returns a single contact
 func (r *ContactRepository) GetByID(ctx context.Context, contactID, userID uuid.UUID) (*models.Contact, error) {
-	query := `
-		SELECT id, user_id, first_name, last_name, email, phone, company, job_title,
-		       birthday, notes, avatar, favorite, created_at, updated_at
+	query := `SELECT ` + contactColumns + `
 		FROM contacts
 		WHERE id = $1 AND user_id = $2
 	`
+	return r.getContact(ctx, query, contactID, userID)
+}
 
-	var c models.Contact
-	err := r.db.QueryRow(ctx, query, contactID, userID).Scan(
-		&c.ID, &c.UserID, &c.FirstName, &c.LastName, &c.Email, &c.Phone,
-		&c.Company, &c.JobTitle, &c.Birthday, &c.Notes, &c.Avatar,
-		&c.Favorite, &c.CreatedAt, &c.UpdatedAt,
-	)
-	if err != nil {
-		return nil, err
-	}
-	return &c, nil
+// GetByResourceName returns the contact stored under a CardDAV resource name
+func (r *ContactRepository) GetByResourceName(ctx context.Context, userID uuid.UUID, name string) (*models.Contact, error) {
+	query := `SELECT ` + contactColumns + `
+		FROM contacts
+		WHERE user_id = $1 AND resource_name = $2
+	`
+	return r.getContact(ctx, query, userID, name)
+}
+
+// GetByUID returns the contact with the given vCard UID
+func (r *ContactRepository) GetByUID(ctx context.Context, userID uuid.UUID, uid string) (*models.Contact, error) {
+	query := `SELECT ` + contactColumns + `
+		FROM contacts
+		WHERE user_id = $1 AND uid = $2
+	`
+	return r.getContact(ctx, query, userID, uid)
 }
 
 // Create inserts a new contact
 func (r *ContactRepository) Create(ctx context.Context, contact *models.Contact) error {
+	if contact.UID == "" {
+		contact.UID = contact.ID.String()
+	}
+	if contact.ResourceName == "" {
+		contact.ResourceName = contact.ID.String() + ".vcf"
+	}
+
 	query := `
-		INSERT INTO contacts (id, user_id, first_name, last_name, email, phone, company, job_title,
-		                       birthday, notes, avatar, favorite, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		INSERT INTO contacts (id, user_id, uid, resource_name, first_name, last_name, email, phone, company, job_title,
+		                       birthday, notes, avatar, favorite, vcard, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, NULLIF($15, ''), $16, $17)
 	`
 
 	_, err := r.db.Exec(ctx, query,
-		contact.ID, contact.UserID, contact.FirstName, contact.LastName, contact.Email,
+		contact.ID, contact.UserID, contact.UID, contact.ResourceName, contact.FirstName, contact.LastName, contact.Email,
 		contact.Phone, contact.Company, contact.JobTitle, contact.Birthday, contact.Notes,
-		contact.Avatar, contact.Favorite, contact.CreatedAt, contact.UpdatedAt,
+		contact.Avatar, contact.Favorite, contact.VCard, contact.CreatedAt, contact.UpdatedAt,
 	)
-	return err
+	if err != nil {
+		return err
+	}
+	return recordDAVChange(ctx, r.db, contact.UserID, models.DAVCollectionContacts, contact.ResourceName, false)
 }
 
 // Update updates a contact
@@ -97,29 +145,54 @@ func (r *ContactRepository) Update(ctx context.Context, contact *models.Contact)
 		UPDATE contacts SET
 			first_name = $3, last_name = $4, email = $5, phone = $6, company = $7,
 			job_title = $8, birthday = $9, notes = $10, avatar = $11, favorite = $12,
-			updated_at = $13
+			vcard = NULLIF($13, ''), updated_at = $14
 		WHERE id = $1 AND user_id = $2
+		RETURNING resource_name
 	`
 
-	_, err := r.db.Exec(ctx, query,
+	var resourceName string
+	err := r.db.QueryRow(ctx, query,
 		contact.ID, contact.UserID, contact.FirstName, contact.LastName, contact.Email,
 		contact.Phone, contact.Company, contact.JobTitle, contact.Birthday, contact.Notes,
-		contact.Avatar, contact.Favorite, contact.UpdatedAt,
-	)
-	return err
+		contact.Avatar, contact.Favorite, contact.VCard, contact.UpdatedAt,
+	).Scan(&resourceName)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrContactNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return recordDAVChange(ctx, r.db, contact.UserID, models.DAVCollectionContacts, resourceName, false)
 }
 
 // ToggleFavorite toggles the favorite status
 func (r *ContactRepository) ToggleFavorite(ctx context.Context, contactID, userID uuid.UUID, favorite bool) error {
-	_, err := r.db.Exec(ctx,
-		"UPDATE contacts SET favorite = $3, updated_at = $4 WHERE id = $1 AND user_id = $2",
+	var resourceName string
+	err := r.db.QueryRow(ctx,
+		"UPDATE contacts SET favorite = $3, updated_at = $4 WHERE id = $1 AND user_id = $2 RETURNING resource_name",
 		contactID, userID, favorite, time.Now(),
-	)
-	return err
+	).Scan(&resourceName)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return recordDAVChange(ctx, r.db, userID, models.DAVCollectionContacts, resourceName, false)
 }
 
 // Delete deletes a contact
 func (r *ContactRepository) Delete(ctx context.Context, contactID, userID uuid.UUID) error {
-	_, err := r.db.Exec(ctx, "DELETE FROM contacts WHERE id = $1 AND user_id = $2", contactID, userID)
-	return err
+	var resourceName string
+	err := r.db.QueryRow(ctx,
+		"DELETE FROM contacts WHERE id = $1 AND user_id = $2 RETURNING resource_name",
+		contactID, userID,
+	).Scan(&resourceName)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return recordDAVChange(ctx, r.db, userID, models.DAVCollectionContacts, resourceName, true)
 }
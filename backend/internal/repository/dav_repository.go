@@ -0,0 +1,65 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/tessera/tessera/internal/models"
+)
+
+// DAVRepository reads the change journal behind DAV sync tokens
+type DAVRepository struct {
+	db *pgxpool.Pool
+}
+
+// NewDAVRepository creates a new DAV change repository
+func NewDAVRepository(db *pgxpool.Pool) *DAVRepository {
+	return &DAVRepository{db: db}
+}
+
+// recordDAVChange appends a change for a resource to the journal. Repositories
+// backing DAV collections call it after every write so sync clients see it.
+func recordDAVChange(ctx context.Context, db *pgxpool.Pool, userID uuid.UUID, collection, resourceName string, deleted bool) error {
+	_, err := db.Exec(ctx,
+		"INSERT INTO dav_changes (user_id, collection, resource_name, deleted) VALUES ($1, $2, $3, $4)",
+		userID, collection, resourceName, deleted,
+	)
+	return err
+}
+
+// CurrentToken returns the ID of the latest change in a collection, or 0 if it has none
+func (r *DAVRepository) CurrentToken(ctx context.Context, userID uuid.UUID, collection string) (int64, error) {
+	var token int64
+	err := r.db.QueryRow(ctx,
+		"SELECT COALESCE(MAX(id), 0) FROM dav_changes WHERE user_id = $1 AND collection = $2",
+		userID, collection,
+	).Scan(&token)
+	return token, err
+}
+
+// ChangesSince returns the latest state of every resource changed after the given token
+func (r *DAVRepository) ChangesSince(ctx context.Context, userID uuid.UUID, collection string, since int64) ([]models.DAVChange, error) {
+	query := `
+		SELECT DISTINCT ON (resource_name) resource_name, deleted
+		FROM dav_changes
+		WHERE user_id = $1 AND collection = $2 AND id > $3
+		ORDER BY resource_name, id DESC
+	`
+
+	rows, err := r.db.Query(ctx, query, userID, collection, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []models.DAVChange{}
+	for rows.Next() {
+		var ch models.DAVChange
+		if err := rows.Scan(&ch.ResourceName, &ch.Deleted); err != nil {
+			return nil, err
+		}
+		changes = append(changes, ch)
+	}
+	return changes, rows.Err()
+}
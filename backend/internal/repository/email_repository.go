@@ -652,17 +652,18 @@ func (r *EmailRepository) SearchEmails(ctx context.Context, accountID, searchQue
 
 func (r *EmailRepository) CreateAttachment(ctx context.Context, att *models.EmailAttachment) error {
 	query := `
-		INSERT INTO email_attachments (email_id, filename, content_type, size, content_id, is_inline, storage_key)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		INSERT INTO email_attachments (email_id, filename, content_type, size, content_id, is_inline, storage_key, virus)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 		RETURNING id, created_at`
 
 	return r.db.QueryRow(ctx, query,
-		att.EmailID, att.Filename, att.ContentType, att.Size, att.ContentID, att.IsInline, att.StorageKey,
+		att.EmailID, att.Filename, att.ContentType, att.Size, att.ContentID, att.IsInline, att.StorageKey, att.Virus,
 	).Scan(&att.ID, &att.CreatedAt)
 }
 
 func (r *EmailRepository) GetAttachmentsByEmail(ctx context.Context, emailID string) ([]models.EmailAttachment, error) {
-	query := `SELECT * FROM email_attachments WHERE email_id = $1 ORDER BY filename`
+	query := `SELECT id, email_id, filename, content_type, size, content_id, is_inline, storage_key, created_at, virus
+		FROM email_attachments WHERE email_id = $1 ORDER BY filename`
 
 	rows, err := r.db.Query(ctx, query, emailID)
 	if err != nil {
@@ -673,7 +674,7 @@ func (r *EmailRepository) GetAttachmentsByEmail(ctx context.Context, emailID str
 	var attachments []models.EmailAttachment
 	for rows.Next() {
 		var a models.EmailAttachment
-		err := rows.Scan(&a.ID, &a.EmailID, &a.Filename, &a.ContentType, &a.Size, &a.ContentID, &a.IsInline, &a.StorageKey, &a.CreatedAt)
+		err := rows.Scan(&a.ID, &a.EmailID, &a.Filename, &a.ContentType, &a.Size, &a.ContentID, &a.IsInline, &a.StorageKey, &a.CreatedAt, &a.Virus)
 		if err != nil {
 			return nil, err
 		}
@@ -688,7 +689,7 @@ func (r *EmailRepository) GetAttachmentsByEmailIDs(ctx context.Context, emailIDs
 		return make(map[string][]models.EmailAttachment), nil
 	}
 
-	query := `SELECT id, email_id, filename, content_type, size, content_id, is_inline, storage_key, created_at
+	query := `SELECT id, email_id, filename, content_type, size, content_id, is_inline, storage_key, created_at, virus
 		FROM email_attachments WHERE email_id = ANY($1) ORDER BY filename`
 
 	rows, err := r.db.Query(ctx, query, emailIDs)
@@ -700,7 +701,7 @@ func (r *EmailRepository) GetAttachmentsByEmailIDs(ctx context.Context, emailIDs
 	result := make(map[string][]models.EmailAttachment)
 	for rows.Next() {
 		var a models.EmailAttachment
-		err := rows.Scan(&a.ID, &a.EmailID, &a.Filename, &a.ContentType, &a.Size, &a.ContentID, &a.IsInline, &a.StorageKey, &a.CreatedAt)
+		err := rows.Scan(&a.ID, &a.EmailID, &a.Filename, &a.ContentType, &a.Size, &a.ContentID, &a.IsInline, &a.StorageKey, &a.CreatedAt, &a.Virus)
 		if err != nil {
 			return nil, err
 		}
@@ -710,12 +711,12 @@ func (r *EmailRepository) GetAttachmentsByEmailIDs(ctx context.Context, emailIDs
 }
 
 func (r *EmailRepository) GetAttachmentByID(ctx context.Context, attachmentID string) (*models.EmailAttachment, error) {
-	query := `SELECT id, email_id, filename, content_type, size, content_id, is_inline, storage_key, created_at 
+	query := `SELECT id, email_id, filename, content_type, size, content_id, is_inline, storage_key, created_at, virus
 		FROM email_attachments WHERE id = $1`
 
 	var a models.EmailAttachment
 	err := r.db.QueryRow(ctx, query, attachmentID).Scan(
-		&a.ID, &a.EmailID, &a.Filename, &a.ContentType, &a.Size, &a.ContentID, &a.IsInline, &a.StorageKey, &a.CreatedAt,
+		&a.ID, &a.EmailID, &a.Filename, &a.ContentType, &a.Size, &a.ContentID, &a.IsInline, &a.StorageKey, &a.CreatedAt, &a.Virus,
 	)
 	if err != nil {
 		return nil, err
@@ -1562,6 +1563,12 @@ func (r *EmailRepository) UpdateAccountSignature(ctx context.Context, accountID,
 	return err
 }
 
+// UpdateAccountPasswords updates just the stored (encrypted) passwords
+func (r *EmailRepository) UpdateAccountPasswords(ctx context.Context, accountID, imapPassword, smtpPassword string) error {
+	_, err := r.db.Exec(ctx, `UPDATE email_accounts SET imap_password = $2, smtp_password = $3, updated_at = NOW() WHERE id = $1`, accountID, imapPassword, smtpPassword)
+	return err
+}
+
 // UpdateAccountSendDelay updates just the send_delay field
 func (r *EmailRepository) UpdateAccountSendDelay(ctx context.Context, accountID string, sendDelay int) error {
 	_, err := r.db.Exec(ctx, `UPDATE email_accounts SET send_delay = $2, updated_at = NOW() WHERE id = $1`, accountID, sendDelay)
@@ -0,0 +1,147 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/tessera/tessera/internal/models"
+)
+
+// ErrDataKeyNotFound is returned when a data key does not exist
+var ErrDataKeyNotFound = errors.New("data key not found")
+
+// EncryptionRepository handles the data keys encrypting stored objects
+type EncryptionRepository struct {
+	db *pgxpool.Pool
+}
+
+// NewEncryptionRepository creates a new encryption repository
+func NewEncryptionRepository(db *pgxpool.Pool) *EncryptionRepository {
+	return &EncryptionRepository{db: db}
+}
+
+const dataKeyColumns = `id, owner_id, wrapped_key, master_key_id, created_at, rotated_at`
+
+func scanDataKey(row pgx.Row) (*models.DataKey, error) {
+	key := &models.DataKey{}
+	err := row.Scan(&key.ID, &key.OwnerID, &key.WrappedKey, &key.MasterKeyID, &key.CreatedAt, &key.RotatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrDataKeyNotFound
+	}
+	return key, err
+}
+
+// GetDataKey retrieves a data key by its ID
+func (r *EncryptionRepository) GetDataKey(ctx context.Context, id uuid.UUID) (*models.DataKey, error) {
+	return scanDataKey(r.db.QueryRow(ctx, `SELECT `+dataKeyColumns+` FROM data_keys WHERE id = $1`, id))
+}
+
+// GetOwnerDataKey retrieves the data key of a user
+func (r *EncryptionRepository) GetOwnerDataKey(ctx context.Context, ownerID uuid.UUID) (*models.DataKey, error) {
+	return scanDataKey(r.db.QueryRow(ctx, `SELECT `+dataKeyColumns+` FROM data_keys WHERE owner_id = $1`, ownerID))
+}
+
+// CreateDataKey stores a user's data key unless another request stored one
+// first, returning whichever key the user has
+func (r *EncryptionRepository) CreateDataKey(ctx context.Context, key *models.DataKey) (*models.DataKey, error) {
+	_, err := r.db.Exec(ctx, `
+		INSERT INTO data_keys (id, owner_id, wrapped_key, master_key_id)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (owner_id) DO NOTHING`,
+		key.ID, key.OwnerID, key.WrappedKey, key.MasterKeyID)
+	if err != nil {
+		return nil, err
+	}
+	return r.GetOwnerDataKey(ctx, key.OwnerID)
+}
+
+// ListDataKeysNotWrappedBy lists the data keys wrapped by any master key but
+// the given one
+func (r *EncryptionRepository) ListDataKeysNotWrappedBy(ctx context.Context, masterKeyID string) ([]*models.DataKey, error) {
+	rows, err := r.db.Query(ctx, `SELECT `+dataKeyColumns+` FROM data_keys WHERE master_key_id <> $1`, masterKeyID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*models.DataKey
+	for rows.Next() {
+		key, err := scanDataKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// RewrapDataKey replaces a data key's wrapping after a master key rotation.
+// It only applies if the key is still wrapped as it was read, so two
+// concurrent rotations can't overwrite each other.
+func (r *EncryptionRepository) RewrapDataKey(ctx context.Context, id uuid.UUID, fromMasterKeyID string, wrapped []byte, masterKeyID string) (bool, error) {
+	result, err := r.db.Exec(ctx, `
+		UPDATE data_keys SET wrapped_key = $3, master_key_id = $4, rotated_at = NOW()
+		WHERE id = $1 AND master_key_id = $2`,
+		id, fromMasterKeyID, wrapped, masterKeyID)
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() > 0, nil
+}
+
+// CountDataKeys returns how many data keys there are, and how many of them
+// are wrapped by a master key other than the given one
+func (r *EncryptionRepository) CountDataKeys(ctx context.Context, masterKeyID string) (int64, int64, error) {
+	var total, stale int64
+	err := r.db.QueryRow(ctx, `
+		SELECT COUNT(*), COUNT(*) FILTER (WHERE master_key_id <> $1) FROM data_keys`,
+		masterKeyID).Scan(&total, &stale)
+	return total, stale, err
+}
+
+// StoredObject is an object in storage and the user it belongs to
+type StoredObject struct {
+	Key     string
+	OwnerID uuid.UUID
+}
+
+// ListStoredObjects lists the objects of file contents, versions, thumbnails
+// and email attachments in key order, starting after the given key. Content
+// shared by several users is listed once, as the first one's.
+func (r *EncryptionRepository) ListStoredObjects(ctx context.Context, after string, limit int) ([]StoredObject, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT DISTINCT ON (storage_key) storage_key, owner_id FROM (
+			SELECT storage_key, owner_id FROM files
+			WHERE is_folder = false AND storage_key > $1
+			UNION ALL
+			SELECT v.storage_key, f.owner_id FROM file_versions v JOIN files f ON f.id = v.file_id
+			WHERE v.storage_key > $1
+			UNION ALL
+			SELECT t.storage_key, f.owner_id FROM file_thumbnails t JOIN files f ON f.id = t.file_id
+			WHERE t.storage_key > $1
+			UNION ALL
+			SELECT a.storage_key, acc.user_id FROM email_attachments a
+			JOIN emails e ON e.id = a.email_id
+			JOIN email_accounts acc ON acc.id = e.account_id
+			WHERE a.storage_key > $1
+		) objects
+		ORDER BY storage_key, owner_id
+		LIMIT $2`, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var objects []StoredObject
+	for rows.Next() {
+		var obj StoredObject
+		if err := rows.Scan(&obj.Key, &obj.OwnerID); err != nil {
+			return nil, err
+		}
+		objects = append(objects, obj)
+	}
+	return objects, rows.Err()
+}
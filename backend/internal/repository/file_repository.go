@@ -3,6 +3,9 @@ package repository
 import (
 	"context"
 	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -13,6 +16,8 @@ import (
 
 var (
 	ErrFileNotFound = errors.New("file not found")
+	// ErrShareNotFound is returned for a share that doesn't exist
+	ErrShareNotFound = errors.New("share not found")
 )
 
 // FileRepository handles file database operations
@@ -28,8 +33,9 @@ func NewFileRepository(db *pgxpool.Pool) *FileRepository {
 // Create inserts a new file or folder into the database
 func (r *FileRepository) Create(ctx context.Context, file *models.File) error {
 	query := `
-		INSERT INTO files (id, parent_id, owner_id, name, is_folder, size, mime_type, storage_key, hash, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		INSERT INTO files (id, parent_id, owner_id, name, is_folder, size, mime_type, storage_key, hash, created_at, updated_at,
+		                   scan_status, virus, scanned_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
 	`
 
 	file.ID = uuid.New()
@@ -48,6 +54,9 @@ func (r *FileRepository) Create(ctx context.Context, file *models.File) error {
 		file.Hash,
 		file.CreatedAt,
 		file.UpdatedAt,
+		file.ScanStatus,
+		file.Virus,
+		file.ScannedAt,
 	)
 
 	return err
@@ -57,7 +66,8 @@ func (r *FileRepository) Create(ctx context.Context, file *models.File) error {
 func (r *FileRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.File, error) {
 	query := `
 		SELECT id, parent_id, owner_id, name, is_folder, size, mime_type, storage_key, hash,
-		       is_starred, is_trashed, trashed_at, created_at, updated_at, accessed_at
+		       is_starred, is_trashed, trashed_at, created_at, updated_at, accessed_at,
+		       scan_status, virus, scanned_at
 		FROM files
 		WHERE id = $1
 	`
@@ -79,6 +89,9 @@ func (r *FileRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.Fil
 		&file.CreatedAt,
 		&file.UpdatedAt,
 		&file.AccessedAt,
+		&file.ScanStatus,
+		&file.Virus,
+		&file.ScannedAt,
 	)
 
 	if errors.Is(err, pgx.ErrNoRows) {
@@ -88,6 +101,38 @@ func (r *FileRepository) GetByID(ctx context.Context, id uuid.UUID) (*models.Fil
 	return file, err
 }
 
+// GetAncestorIDs returns the IDs of the folders containing a file, nearest
+// first
+func (r *FileRepository) GetAncestorIDs(ctx context.Context, id uuid.UUID) ([]uuid.UUID, error) {
+	query := `
+		WITH RECURSIVE ancestors AS (
+			SELECT parent_id, 1 AS depth FROM files WHERE id = $1
+			UNION ALL
+			SELECT f.parent_id, a.depth + 1
+			FROM files f
+			JOIN ancestors a ON f.id = a.parent_id
+		)
+		SELECT parent_id FROM ancestors WHERE parent_id IS NOT NULL ORDER BY depth
+	`
+
+	rows, err := r.db.Query(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]uuid.UUID, 0)
+	for rows.Next() {
+		var parentID uuid.UUID
+		if err := rows.Scan(&parentID); err != nil {
+			return nil, err
+		}
+		ids = append(ids, parentID)
+	}
+
+	return ids, rows.Err()
+}
+
 // GetByName retrieves a file by name within a parent folder
 func (r *FileRepository) GetByName(ctx context.Context, ownerID uuid.UUID, parentID *uuid.UUID, name string) (*models.File, error) {
 	var query string
@@ -96,7 +141,8 @@ func (r *FileRepository) GetByName(ctx context.Context, ownerID uuid.UUID, paren
 	if parentID == nil {
 		query = `
 			SELECT id, parent_id, owner_id, name, is_folder, size, mime_type, storage_key, hash,
-			       is_starred, is_trashed, trashed_at, created_at, updated_at, accessed_at
+			       is_starred, is_trashed, trashed_at, created_at, updated_at, accessed_at,
+			       scan_status, virus, scanned_at
 			FROM files
 			WHERE owner_id = $1 AND parent_id IS NULL AND name = $2 AND is_trashed = false
 		`
@@ -104,7 +150,8 @@ func (r *FileRepository) GetByName(ctx context.Context, ownerID uuid.UUID, paren
 	} else {
 		query = `
 			SELECT id, parent_id, owner_id, name, is_folder, size, mime_type, storage_key, hash,
-			       is_starred, is_trashed, trashed_at, created_at, updated_at, accessed_at
+			       is_starred, is_trashed, trashed_at, created_at, updated_at, accessed_at,
+			       scan_status, virus, scanned_at
 			FROM files
 			WHERE owner_id = $1 AND parent_id = $2 AND name = $3 AND is_trashed = false
 		`
@@ -128,6 +175,9 @@ func (r *FileRepository) GetByName(ctx context.Context, ownerID uuid.UUID, paren
 		&file.CreatedAt,
 		&file.UpdatedAt,
 		&file.AccessedAt,
+		&file.ScanStatus,
+		&file.Virus,
+		&file.ScannedAt,
 	)
 
 	if errors.Is(err, pgx.ErrNoRows) {
@@ -145,7 +195,8 @@ func (r *FileRepository) ListByParent(ctx context.Context, ownerID uuid.UUID, pa
 	if parentID == nil {
 		query = `
 			SELECT id, parent_id, owner_id, name, is_folder, size, mime_type, storage_key, hash,
-			       is_starred, is_trashed, trashed_at, created_at, updated_at, accessed_at
+			       is_starred, is_trashed, trashed_at, created_at, updated_at, accessed_at,
+			       scan_status, virus, scanned_at
 			FROM files
 			WHERE owner_id = $1 AND parent_id IS NULL
 		`
@@ -153,7 +204,8 @@ func (r *FileRepository) ListByParent(ctx context.Context, ownerID uuid.UUID, pa
 	} else {
 		query = `
 			SELECT id, parent_id, owner_id, name, is_folder, size, mime_type, storage_key, hash,
-			       is_starred, is_trashed, trashed_at, created_at, updated_at, accessed_at
+			       is_starred, is_trashed, trashed_at, created_at, updated_at, accessed_at,
+			       scan_status, virus, scanned_at
 			FROM files
 			WHERE owner_id = $1 AND parent_id = $2
 		`
@@ -191,6 +243,9 @@ func (r *FileRepository) ListByParent(ctx context.Context, ownerID uuid.UUID, pa
 			&file.CreatedAt,
 			&file.UpdatedAt,
 			&file.AccessedAt,
+			&file.ScanStatus,
+			&file.Virus,
+			&file.ScannedAt,
 		)
 		if err != nil {
 			return nil, err
@@ -201,11 +256,15 @@ func (r *FileRepository) ListByParent(ctx context.Context, ownerID uuid.UUID, pa
 	return files, rows.Err()
 }
 
-// Update modifies an existing file
+// Update modifies an existing file. Its scan state is only written along
+// with new content, so a stale copy of the file can't undo a scan result.
 func (r *FileRepository) Update(ctx context.Context, file *models.File) error {
 	query := `
 		UPDATE files
-		SET parent_id = $2, name = $3, is_starred = $4, storage_key = $5, size = $6, hash = $7, updated_at = $8
+		SET parent_id = $2, name = $3, is_starred = $4, storage_key = $5, size = $6, hash = $7, updated_at = $8,
+		    scan_status = CASE WHEN hash IS NOT DISTINCT FROM $7 THEN scan_status ELSE $9 END,
+		    virus = CASE WHEN hash IS NOT DISTINCT FROM $7 THEN virus ELSE $10 END,
+		    scanned_at = CASE WHEN hash IS NOT DISTINCT FROM $7 THEN scanned_at ELSE $11 END
 		WHERE id = $1
 	`
 
@@ -220,6 +279,9 @@ func (r *FileRepository) Update(ctx context.Context, file *models.File) error {
 		file.Size,
 		file.Hash,
 		file.UpdatedAt,
+		file.ScanStatus,
+		file.Virus,
+		file.ScannedAt,
 	)
 
 	return err
@@ -261,7 +323,8 @@ func (r *FileRepository) PermanentDelete(ctx context.Context, id uuid.UUID) erro
 func (r *FileRepository) ListTrashed(ctx context.Context, ownerID uuid.UUID) ([]*models.File, error) {
 	query := `
 		SELECT id, parent_id, owner_id, name, is_folder, size, mime_type, storage_key, hash,
-		       is_starred, is_trashed, trashed_at, created_at, updated_at, accessed_at
+		       is_starred, is_trashed, trashed_at, created_at, updated_at, accessed_at,
+		       scan_status, virus, scanned_at
 		FROM files
 		WHERE owner_id = $1 AND is_trashed = true
 		ORDER BY trashed_at DESC
@@ -292,6 +355,9 @@ func (r *FileRepository) ListTrashed(ctx context.Context, ownerID uuid.UUID) ([]
 			&file.CreatedAt,
 			&file.UpdatedAt,
 			&file.AccessedAt,
+			&file.ScanStatus,
+			&file.Virus,
+			&file.ScannedAt,
 		)
 		if err != nil {
 			return nil, err
@@ -302,11 +368,57 @@ func (r *FileRepository) ListTrashed(ctx context.Context, ownerID uuid.UUID) ([]
 	return files, rows.Err()
 }
 
+// ExpiredTrash is a trashed file kept longer than its owner's trash
+// retention
+type ExpiredTrash struct {
+	ID            uuid.UUID
+	OwnerID       uuid.UUID
+	Name          string
+	IsFolder      bool
+	TrashedAt     time.Time
+	RetentionDays int
+}
+
+// ListExpiredTrash returns up to limit trashed files, oldest first, whose
+// owner's retention (defaultDays unless they have their own) ran out before
+// now. A retention of 0 keeps trash forever. Listing continues after the
+// file trashed at afterTime with ID afterID.
+func (r *FileRepository) ListExpiredTrash(ctx context.Context, defaultDays int, now, afterTime time.Time, afterID uuid.UUID, limit int) ([]*ExpiredTrash, error) {
+	query := `
+		SELECT f.id, f.owner_id, f.name, f.is_folder, f.trashed_at, COALESCE(u.trash_retention_days, $1) AS days
+		FROM files f
+		JOIN users u ON u.id = f.owner_id
+		WHERE f.is_trashed = true AND f.trashed_at IS NOT NULL
+		  AND COALESCE(u.trash_retention_days, $1) > 0
+		  AND f.trashed_at < $2::timestamptz - make_interval(days => COALESCE(u.trash_retention_days, $1))
+		  AND (f.trashed_at, f.id) > ($3, $4)
+		ORDER BY f.trashed_at, f.id
+		LIMIT $5
+	`
+
+	rows, err := r.db.Query(ctx, query, defaultDays, now, afterTime, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	expired := make([]*ExpiredTrash, 0)
+	for rows.Next() {
+		item := &ExpiredTrash{}
+		if err := rows.Scan(&item.ID, &item.OwnerID, &item.Name, &item.IsFolder, &item.TrashedAt, &item.RetentionDays); err != nil {
+			return nil, err
+		}
+		expired = append(expired, item)
+	}
+	return expired, rows.Err()
+}
+
 // ListStarred retrieves all starred files for a user
 func (r *FileRepository) ListStarred(ctx context.Context, ownerID uuid.UUID) ([]*models.File, error) {
 	query := `
 		SELECT id, parent_id, owner_id, name, is_folder, size, mime_type, storage_key, hash,
-		       is_starred, is_trashed, trashed_at, created_at, updated_at, accessed_at
+		       is_starred, is_trashed, trashed_at, created_at, updated_at, accessed_at,
+		       scan_status, virus, scanned_at
 		FROM files
 		WHERE owner_id = $1 AND is_starred = true AND is_trashed = false
 		ORDER BY updated_at DESC
@@ -337,6 +449,9 @@ func (r *FileRepository) ListStarred(ctx context.Context, ownerID uuid.UUID) ([]
 			&file.CreatedAt,
 			&file.UpdatedAt,
 			&file.AccessedAt,
+			&file.ScanStatus,
+			&file.Virus,
+			&file.ScannedAt,
 		)
 		if err != nil {
 			return nil, err
@@ -347,27 +462,125 @@ func (r *FileRepository) ListStarred(ctx context.Context, ownerID uuid.UUID) ([]
 	return files, rows.Err()
 }
 
-// Search performs a text search on file names
-func (r *FileRepository) Search(ctx context.Context, ownerID uuid.UUID, query string, limit int) ([]*models.File, error) {
-	sqlQuery := `
-		SELECT id, parent_id, owner_id, name, is_folder, size, mime_type, storage_key, hash,
-		       is_starred, is_trashed, trashed_at, created_at, updated_at, accessed_at
-		FROM files
-		WHERE owner_id = $1 AND is_trashed = false
-		  AND name ILIKE '%' || $2 || '%'
-		ORDER BY similarity(name, $2) DESC
-		LIMIT $3
-	`
+// Snippets come back with matches between these markers, which are stripped
+// from indexed content so they can't appear in it otherwise
+const (
+	SnippetStart = "\u27e6"
+	SnippetStop  = "\u27e7"
+)
+
+// Search finds a user's files whose name or indexed content matches a query,
+// best matches first. It also returns the number of matches before paging.
+func (r *FileRepository) Search(ctx context.Context, ownerID uuid.UUID, filter models.FileSearchFilter) ([]*models.FileSearchResult, int, error) {
+	args := []interface{}{ownerID, filter.Query}
+	argN := 3
+
+	// Content only counts while it was extracted from the current version
+	conditions := []string{
+		"f.owner_id = $1",
+		"f.is_trashed = false",
+		"(c.search_vector @@ q.query OR f.name ILIKE '%' || $2 || '%')",
+		// Trashing a folder only flags the folder itself
+		`NOT EXISTS (
+			WITH RECURSIVE ancestors AS (
+				SELECT a.parent_id, a.is_trashed FROM files a WHERE a.id = f.parent_id
+				UNION ALL
+				SELECT p.parent_id, p.is_trashed FROM files p JOIN ancestors ON p.id = ancestors.parent_id
+			)
+			SELECT 1 FROM ancestors WHERE is_trashed
+		)`,
+	}
 
-	rows, err := r.db.Query(ctx, sqlQuery, ownerID, query, limit)
+	switch filter.Type {
+	case "":
+	case "folder":
+		conditions = append(conditions, "f.is_folder = true")
+	case "image", "video", "audio":
+		conditions = append(conditions, fmt.Sprintf("f.mime_type LIKE $%d", argN))
+		args = append(args, filter.Type+"/%")
+		argN++
+	case "document":
+		conditions = append(conditions, `f.is_folder = false AND (f.mime_type = 'application/pdf'
+			OR f.mime_type LIKE 'application/msword%' OR f.mime_type LIKE 'application/vnd.openxmlformats%'
+			OR f.mime_type LIKE 'text/%' OR f.name ILIKE '%.md' OR f.name ILIKE '%.tdoc')`)
+	default:
+		conditions = append(conditions, fmt.Sprintf("f.mime_type = $%d", argN))
+		args = append(args, filter.Type)
+		argN++
+	}
+
+	if filter.MinSize != nil {
+		conditions = append(conditions, fmt.Sprintf("f.is_folder = false AND f.size >= $%d", argN))
+		args = append(args, *filter.MinSize)
+		argN++
+	}
+	if filter.MaxSize != nil {
+		conditions = append(conditions, fmt.Sprintf("f.is_folder = false AND f.size <= $%d", argN))
+		args = append(args, *filter.MaxSize)
+		argN++
+	}
+	if filter.ModifiedAfter != nil {
+		conditions = append(conditions, fmt.Sprintf("f.updated_at >= $%d", argN))
+		args = append(args, *filter.ModifiedAfter)
+		argN++
+	}
+	if filter.ModifiedBefore != nil {
+		conditions = append(conditions, fmt.Sprintf("f.updated_at < $%d", argN))
+		args = append(args, *filter.ModifiedBefore)
+		argN++
+	}
+	if filter.FolderID != nil {
+		conditions = append(conditions, fmt.Sprintf(`f.parent_id IN (
+			WITH RECURSIVE tree AS (
+				SELECT id FROM files WHERE id = $%d AND owner_id = $1
+				UNION ALL
+				SELECT sub.id FROM files sub JOIN tree ON sub.parent_id = tree.id WHERE sub.is_folder = true
+			)
+			SELECT id FROM tree
+		)`, argN))
+		args = append(args, *filter.FolderID)
+		argN++
+	}
+
+	// Snippets are only built for the page being returned; ts_headline
+	// re-parses the whole content
+	query := fmt.Sprintf(`
+		WITH q AS (SELECT websearch_to_tsquery('english', $2) AS query)
+		SELECT m.id, m.parent_id, m.owner_id, m.name, m.is_folder, m.size, m.mime_type, m.storage_key, m.hash,
+		       m.is_starred, m.is_trashed, m.trashed_at, m.created_at, m.updated_at, m.accessed_at,
+		       m.scan_status, m.virus, m.scanned_at,
+		       CASE WHEN m.search_vector @@ q.query
+		            THEN ts_headline('english', m.content, q.query,
+		                 'StartSel=%[1]s, StopSel=%[2]s, MaxFragments=2, MaxWords=20, MinWords=8, FragmentDelimiter=" … "')
+		            ELSE '' END,
+		       m.rank, m.total
+		FROM (
+			SELECT f.*, c.content, c.search_vector,
+			       similarity(f.name, $2) + COALESCE(ts_rank(c.search_vector, q.query, 32), 0) AS rank,
+			       COUNT(*) OVER () AS total
+			FROM files f
+			CROSS JOIN q
+			LEFT JOIN file_contents c ON c.file_id = f.id AND c.source_hash = f.hash
+			WHERE %[3]s
+			ORDER BY rank DESC, f.updated_at DESC
+			LIMIT $%[4]d OFFSET $%[5]d
+		) m
+		CROSS JOIN q
+		ORDER BY m.rank DESC, m.updated_at DESC
+	`, SnippetStart, SnippetStop, strings.Join(conditions, " AND "), argN, argN+1)
+	args = append(args, filter.Limit, filter.Offset)
+
+	rows, err := r.db.Query(ctx, query, args...)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer rows.Close()
 
-	files := make([]*models.File, 0)
+	results := make([]*models.FileSearchResult, 0)
+	total := 0
 	for rows.Next() {
 		file := &models.File{}
+		result := &models.FileSearchResult{File: file}
 		err := rows.Scan(
 			&file.ID,
 			&file.ParentID,
@@ -384,8 +597,69 @@ func (r *FileRepository) Search(ctx context.Context, ownerID uuid.UUID, query st
 			&file.CreatedAt,
 			&file.UpdatedAt,
 			&file.AccessedAt,
+			&file.ScanStatus,
+			&file.Virus,
+			&file.ScannedAt,
+			&result.Snippet,
+			&result.Rank,
+			&total,
 		)
 		if err != nil {
+			return nil, 0, err
+		}
+		results = append(results, result)
+	}
+
+	return results, total, rows.Err()
+}
+
+// SaveContent stores the text extracted from a file's current content
+func (r *FileRepository) SaveContent(ctx context.Context, fileID, ownerID uuid.UUID, content, sourceHash string) error {
+	query := `
+		INSERT INTO file_contents (file_id, owner_id, content, search_vector, source_hash, indexed_at)
+		VALUES ($1, $2, $3, to_tsvector('english', $3), $4, NOW())
+		ON CONFLICT (file_id) DO UPDATE SET
+			owner_id = EXCLUDED.owner_id,
+			content = EXCLUDED.content,
+			search_vector = EXCLUDED.search_vector,
+			source_hash = EXCLUDED.source_hash,
+			indexed_at = EXCLUDED.indexed_at
+	`
+
+	_, err := r.db.Exec(ctx, query, fileID, ownerID, content, sourceHash)
+	return err
+}
+
+// DeleteContent removes a file from the content index
+func (r *FileRepository) DeleteContent(ctx context.Context, fileID uuid.UUID) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM file_contents WHERE file_id = $1`, fileID)
+	return err
+}
+
+// ListUnindexed returns files, ordered by ID and after the given one, whose
+// current content has not been indexed
+func (r *FileRepository) ListUnindexed(ctx context.Context, after uuid.UUID, limit int) ([]*models.File, error) {
+	query := `
+		SELECT id, owner_id, name, size, mime_type, hash
+		FROM files f
+		WHERE f.is_folder = false AND f.is_trashed = false AND f.id > $1
+		  AND NOT EXISTS (
+			SELECT 1 FROM file_contents c WHERE c.file_id = f.id AND c.source_hash = f.hash
+		  )
+		ORDER BY f.id
+		LIMIT $2
+	`
+
+	rows, err := r.db.Query(ctx, query, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make([]*models.File, 0)
+	for rows.Next() {
+		file := &models.File{}
+		if err := rows.Scan(&file.ID, &file.OwnerID, &file.Name, &file.Size, &file.MimeType, &file.Hash); err != nil {
 			return nil, err
 		}
 		files = append(files, file)
@@ -394,12 +668,109 @@ func (r *FileRepository) Search(ctx context.Context, ownerID uuid.UUID, query st
 	return files, rows.Err()
 }
 
-// GetStorageUsed calculates total storage used by a user
+// ListProperties returns the dead properties of the given files, by file
+func (r *FileRepository) ListProperties(ctx context.Context, fileIDs []uuid.UUID) (map[uuid.UUID][]*models.FileProperty, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT file_id, namespace, name, value
+		FROM file_properties
+		WHERE file_id = ANY($1)
+		ORDER BY namespace, name
+	`, fileIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	props := map[uuid.UUID][]*models.FileProperty{}
+	for rows.Next() {
+		p := &models.FileProperty{}
+		if err := rows.Scan(&p.FileID, &p.Namespace, &p.Name, &p.Value); err != nil {
+			return nil, err
+		}
+		props[p.FileID] = append(props[p.FileID], p)
+	}
+	return props, rows.Err()
+}
+
+// PatchProperties sets and removes dead properties of a file and, if
+// modified is given, changes its modification time, all or nothing
+func (r *FileRepository) PatchProperties(ctx context.Context, fileID uuid.UUID, set, remove []*models.FileProperty, modified *time.Time) error {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, p := range set {
+		_, err := tx.Exec(ctx, `
+			INSERT INTO file_properties (file_id, namespace, name, value)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (file_id, namespace, name) DO UPDATE SET value = EXCLUDED.value
+		`, fileID, p.Namespace, p.Name, p.Value)
+		if err != nil {
+			return err
+		}
+	}
+	for _, p := range remove {
+		_, err := tx.Exec(ctx, `DELETE FROM file_properties WHERE file_id = $1 AND namespace = $2 AND name = $3`,
+			fileID, p.Namespace, p.Name)
+		if err != nil {
+			return err
+		}
+	}
+	if modified != nil {
+		if _, err := tx.Exec(ctx, `UPDATE files SET updated_at = $2 WHERE id = $1`, fileID, *modified); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// CopyProperties gives a copied file the dead properties of its source
+func (r *FileRepository) CopyProperties(ctx context.Context, sourceID, targetID uuid.UUID) error {
+	_, err := r.db.Exec(ctx, `
+		INSERT INTO file_properties (file_id, namespace, name, value)
+		SELECT $2, namespace, name, value FROM file_properties WHERE file_id = $1
+		ON CONFLICT (file_id, namespace, name) DO UPDATE SET value = EXCLUDED.value
+	`, sourceID, targetID)
+	return err
+}
+
+// GetStorageUsed calculates total storage used by a user: their files,
+// trashed ones included, the versions of those files and their stored email
+// attachments
 func (r *FileRepository) GetStorageUsed(ctx context.Context, ownerID uuid.UUID) (int64, error) {
+	query := `SELECT ` + storageUsedSQL + ` FROM users u WHERE u.id = $1`
+
+	var total int64
+	err := r.db.QueryRow(ctx, query, ownerID).Scan(&total)
+	return total, err
+}
+
+// GetAttachmentStorageUsed calculates the storage taken by the email
+// attachments of a user kept in storage
+func (r *FileRepository) GetAttachmentStorageUsed(ctx context.Context, ownerID uuid.UUID) (int64, error) {
 	query := `
-		SELECT COALESCE(SUM(size), 0)
-		FROM files
-		WHERE owner_id = $1 AND is_folder = false
+		SELECT COALESCE(SUM(a.size), 0)
+		FROM email_attachments a
+		JOIN emails e ON e.id = a.email_id
+		JOIN email_accounts acc ON acc.id = e.account_id
+		WHERE acc.user_id = $1 AND COALESCE(a.storage_key, '') <> ''
+	`
+
+	var total int64
+	err := r.db.QueryRow(ctx, query, ownerID).Scan(&total)
+	return total, err
+}
+
+// GetVersionStorageUsed calculates the storage taken by the versions of a
+// user's files
+func (r *FileRepository) GetVersionStorageUsed(ctx context.Context, ownerID uuid.UUID) (int64, error) {
+	query := `
+		SELECT COALESCE(SUM(v.size), 0)
+		FROM file_versions v
+		JOIN files f ON f.id = v.file_id
+		WHERE f.owner_id = $1
 	`
 
 	var total int64
@@ -444,17 +815,33 @@ func (r *FileRepository) GetStorageByType(ctx context.Context, ownerID uuid.UUID
 	return result, rows.Err()
 }
 
-// CreateVersion creates a new version of a file
+// CreateVersion creates a new version of a file, numbered after its latest
+// one. The file's row is locked while the number is taken, so versions made
+// at the same time can't get the same number.
 func (r *FileRepository) CreateVersion(ctx context.Context, version *models.FileVersion) error {
 	query := `
-		INSERT INTO file_versions (id, file_id, version, size, storage_key, hash, created_at, created_by)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		INSERT INTO file_versions (id, file_id, version, size, storage_key, hash, created_at, created_by, pinned)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 	`
 
 	version.ID = uuid.New()
 	version.CreatedAt = time.Now()
 
-	_, err := r.db.Exec(ctx, query,
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT id FROM files WHERE id = $1 FOR UPDATE`, version.FileID); err != nil {
+		return err
+	}
+	err = tx.QueryRow(ctx, `SELECT COALESCE(MAX(version), 0) + 1 FROM file_versions WHERE file_id = $1`, version.FileID).Scan(&version.Version)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, query,
 		version.ID,
 		version.FileID,
 		version.Version,
@@ -463,15 +850,23 @@ func (r *FileRepository) CreateVersion(ctx context.Context, version *models.File
 		version.Hash,
 		version.CreatedAt,
 		version.CreatedBy,
+		version.Pinned,
 	)
+	if err != nil {
+		return err
+	}
 
-	return err
+	// The version holds a reference to the content it keeps
+	if _, err := tx.Exec(ctx, `UPDATE blobs SET ref_count = ref_count + 1 WHERE storage_key = $1`, version.StorageKey); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
 }
 
 // GetVersions retrieves all versions of a file
 func (r *FileRepository) GetVersions(ctx context.Context, fileID uuid.UUID) ([]*models.FileVersion, error) {
 	query := `
-		SELECT id, file_id, version, size, storage_key, hash, created_at, created_by
+		SELECT id, file_id, version, size, storage_key, hash, created_at, created_by, pinned
 		FROM file_versions
 		WHERE file_id = $1
 		ORDER BY version DESC
@@ -495,6 +890,7 @@ func (r *FileRepository) GetVersions(ctx context.Context, fileID uuid.UUID) ([]*
 			&v.Hash,
 			&v.CreatedAt,
 			&v.CreatedBy,
+			&v.Pinned,
 		)
 		if err != nil {
 			return nil, err
@@ -508,7 +904,7 @@ func (r *FileRepository) GetVersions(ctx context.Context, fileID uuid.UUID) ([]*
 // GetVersion retrieves a specific version of a file
 func (r *FileRepository) GetVersion(ctx context.Context, fileID uuid.UUID, version int) (*models.FileVersion, error) {
 	query := `
-		SELECT id, file_id, version, size, storage_key, hash, created_at, created_by
+		SELECT id, file_id, version, size, storage_key, hash, created_at, created_by, pinned
 		FROM file_versions
 		WHERE file_id = $1 AND version = $2
 	`
@@ -523,6 +919,7 @@ func (r *FileRepository) GetVersion(ctx context.Context, fileID uuid.UUID, versi
 		&v.Hash,
 		&v.CreatedAt,
 		&v.CreatedBy,
+		&v.Pinned,
 	)
 	if err != nil {
 		return nil, err
@@ -530,6 +927,89 @@ func (r *FileRepository) GetVersion(ctx context.Context, fileID uuid.UUID, versi
 	return v, nil
 }
 
+// SetVersionPinned pins or unpins a version of a file
+func (r *FileRepository) SetVersionPinned(ctx context.Context, fileID uuid.UUID, version int, pinned bool) (*models.FileVersion, error) {
+	query := `
+		UPDATE file_versions SET pinned = $3
+		WHERE file_id = $1 AND version = $2
+		RETURNING id, file_id, version, size, storage_key, hash, created_at, created_by, pinned
+	`
+
+	v := &models.FileVersion{}
+	err := r.db.QueryRow(ctx, query, fileID, version, pinned).Scan(
+		&v.ID,
+		&v.FileID,
+		&v.Version,
+		&v.Size,
+		&v.StorageKey,
+		&v.Hash,
+		&v.CreatedAt,
+		&v.CreatedBy,
+		&v.Pinned,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// DeleteVersions deletes the versions with the given IDs, except those
+// pinned in the meantime, and returns the ones it deleted so their content
+// can be released
+func (r *FileRepository) DeleteVersions(ctx context.Context, ids []uuid.UUID) ([]*models.FileVersion, error) {
+	query := `
+		DELETE FROM file_versions
+		WHERE id = ANY($1) AND pinned = false
+		RETURNING id, file_id, version, size, storage_key
+	`
+
+	rows, err := r.db.Query(ctx, query, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deleted := make([]*models.FileVersion, 0)
+	for rows.Next() {
+		v := &models.FileVersion{}
+		if err := rows.Scan(&v.ID, &v.FileID, &v.Version, &v.Size, &v.StorageKey); err != nil {
+			return nil, err
+		}
+		deleted = append(deleted, v)
+	}
+	return deleted, rows.Err()
+}
+
+// ListVersionedFiles returns the IDs of up to limit files that have
+// versions, in order, starting after the given ID
+func (r *FileRepository) ListVersionedFiles(ctx context.Context, after uuid.UUID, limit int) ([]uuid.UUID, error) {
+	query := `
+		SELECT DISTINCT file_id FROM file_versions
+		WHERE file_id > $1
+		ORDER BY file_id
+		LIMIT $2
+	`
+
+	rows, err := r.db.Query(ctx, query, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]uuid.UUID, 0)
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
 // GetNextVersion returns the next version number for a file
 func (r *FileRepository) GetNextVersion(ctx context.Context, fileID uuid.UUID) (int, error) {
 	query := `SELECT COALESCE(MAX(version), 0) + 1 FROM file_versions WHERE file_id = $1`
@@ -539,11 +1019,365 @@ func (r *FileRepository) GetNextVersion(ctx context.Context, fileID uuid.UUID) (
 	return nextVersion, err
 }
 
+// SaveThumbnail creates or replaces the thumbnail of a file at one size
+func (r *FileRepository) SaveThumbnail(ctx context.Context, thumb *models.FileThumbnail) error {
+	query := `
+		INSERT INTO file_thumbnails (file_id, size, storage_key, width, height, bytes, source_hash, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (file_id, size) DO UPDATE SET
+			storage_key = EXCLUDED.storage_key,
+			width = EXCLUDED.width,
+			height = EXCLUDED.height,
+			bytes = EXCLUDED.bytes,
+			source_hash = EXCLUDED.source_hash,
+			created_at = EXCLUDED.created_at
+	`
+
+	thumb.CreatedAt = time.Now()
+
+	_, err := r.db.Exec(ctx, query,
+		thumb.FileID,
+		thumb.Size,
+		thumb.StorageKey,
+		thumb.Width,
+		thumb.Height,
+		thumb.Bytes,
+		thumb.SourceHash,
+		thumb.CreatedAt,
+	)
+
+	return err
+}
+
+// GetThumbnail retrieves the thumbnail of a file at one size
+func (r *FileRepository) GetThumbnail(ctx context.Context, fileID uuid.UUID, size string) (*models.FileThumbnail, error) {
+	query := `
+		SELECT file_id, size, storage_key, width, height, bytes, source_hash, created_at
+		FROM file_thumbnails
+		WHERE file_id = $1 AND size = $2
+	`
+
+	t := &models.FileThumbnail{}
+	err := r.db.QueryRow(ctx, query, fileID, size).Scan(
+		&t.FileID,
+		&t.Size,
+		&t.StorageKey,
+		&t.Width,
+		&t.Height,
+		&t.Bytes,
+		&t.SourceHash,
+		&t.CreatedAt,
+	)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ListTreeThumbnailKeys returns the storage keys of the thumbnails of a
+// file or, for a folder, of every file inside it
+func (r *FileRepository) ListTreeThumbnailKeys(ctx context.Context, id uuid.UUID) ([]string, error) {
+	query := `
+		WITH RECURSIVE tree AS (
+			SELECT id FROM files WHERE id = $1
+			UNION ALL
+			SELECT f.id
+			FROM files f
+			JOIN tree t ON f.parent_id = t.id
+		)
+		SELECT th.storage_key FROM file_thumbnails th JOIN tree t ON th.file_id = t.id
+	`
+
+	rows, err := r.db.Query(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// StorageTotals holds instance-wide storage usage
+type StorageTotals struct {
+	FilesBytes       int64
+	AttachmentsBytes int64
+	ThumbnailsBytes  int64
+	TotalFiles       int
+	// VersionsBytes is the size of the files' earlier versions
+	VersionsBytes int64
+	// BlobsBytes is what files and versions take up in storage, with
+	// identical content stored once
+	BlobsBytes int64
+}
+
+// LogicalBytes is the size of all files and versions, as their owners see
+// them
+func (t *StorageTotals) LogicalBytes() int64 {
+	return t.FilesBytes + t.VersionsBytes
+}
+
+// GetStorageTotals sums the storage used by files, email attachments and
+// thumbnails across all users
+func (r *FileRepository) GetStorageTotals(ctx context.Context) (*StorageTotals, error) {
+	query := `
+		SELECT
+			(SELECT COALESCE(SUM(size), 0) FROM files WHERE is_folder = false),
+			(SELECT COUNT(*) FROM files WHERE is_folder = false),
+			(SELECT COALESCE(SUM(size), 0) FROM email_attachments WHERE storage_key IS NOT NULL),
+			(SELECT COALESCE(SUM(bytes), 0) FROM file_thumbnails),
+			(SELECT COALESCE(SUM(size), 0) FROM file_versions),
+			(SELECT COALESCE(SUM(size), 0) FROM blobs)
+	`
+
+	totals := &StorageTotals{}
+	err := r.db.QueryRow(ctx, query).Scan(
+		&totals.FilesBytes,
+		&totals.TotalFiles,
+		&totals.AttachmentsBytes,
+		&totals.ThumbnailsBytes,
+		&totals.VersionsBytes,
+		&totals.BlobsBytes,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return totals, nil
+}
+
+// ClaimBlob records a reference to content just stored under key. If a blob
+// with the same hash exists it gains the reference and its key is returned,
+// and the new object is no longer needed; otherwise the new object becomes
+// the blob for that content.
+func (r *FileRepository) ClaimBlob(ctx context.Context, hash string, size int64, key string) (string, error) {
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+
+	// Two uploads of the same new content would otherwise both store it
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, hash); err != nil {
+		return "", err
+	}
+
+	var existing string
+	err = tx.QueryRow(ctx, `
+		SELECT storage_key FROM blobs
+		WHERE hash = $1 AND size = $2
+		ORDER BY ref_count DESC
+		LIMIT 1
+		FOR UPDATE
+	`, hash, size).Scan(&existing)
+	switch {
+	case err == nil:
+		if _, err := tx.Exec(ctx, `UPDATE blobs SET ref_count = ref_count + 1 WHERE storage_key = $1`, existing); err != nil {
+			return "", err
+		}
+		key = existing
+	case errors.Is(err, pgx.ErrNoRows):
+		_, err := tx.Exec(ctx, `
+			INSERT INTO blobs (storage_key, hash, size, ref_count)
+			VALUES ($1, $2, $3, 1)
+			ON CONFLICT (storage_key) DO UPDATE SET ref_count = blobs.ref_count + 1
+		`, key, hash, size)
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", err
+	}
+
+	return key, tx.Commit(ctx)
+}
+
+// RetainBlob adds a reference to the blob stored under key, for a copy of a
+// file or version that shares its content
+func (r *FileRepository) RetainBlob(ctx context.Context, key string) error {
+	_, err := r.db.Exec(ctx, `UPDATE blobs SET ref_count = ref_count + 1 WHERE storage_key = $1`, key)
+	return err
+}
+
+// ReleaseBlobs drops one reference to the blob under each key, a key
+// listed twice losing two. It returns the keys no longer referenced, whose
+// objects can be deleted; keys without a blob are never returned.
+func (r *FileRepository) ReleaseBlobs(ctx context.Context, keys []string) ([]string, error) {
+	counts := map[string]int{}
+	for _, key := range keys {
+		if key != "" {
+			counts[key]++
+		}
+	}
+	if len(counts) == 0 {
+		return nil, nil
+	}
+	// Locking rows in the same order keeps concurrent releases from
+	// deadlocking
+	sorted := make([]string, 0, len(counts))
+	for key := range counts {
+		sorted = append(sorted, key)
+	}
+	slices.Sort(sorted)
+
+	tx, err := r.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var unreferenced []string
+	for _, key := range sorted {
+		var refs int
+		err := tx.QueryRow(ctx, `
+			UPDATE blobs SET ref_count = ref_count - $2 WHERE storage_key = $1
+			RETURNING ref_count
+		`, key, counts[key]).Scan(&refs)
+		if errors.Is(err, pgx.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if refs <= 0 {
+			if _, err := tx.Exec(ctx, `DELETE FROM blobs WHERE storage_key = $1`, key); err != nil {
+				return nil, err
+			}
+			unreferenced = append(unreferenced, key)
+		}
+	}
+	return unreferenced, tx.Commit(ctx)
+}
+
+// DeleteUnreferencedBlobs removes up to limit blobs no longer referenced,
+// left behind when files were deleted without releasing them (such as with
+// their owner), and returns their keys so the objects can be deleted
+func (r *FileRepository) DeleteUnreferencedBlobs(ctx context.Context, limit int) ([]string, error) {
+	rows, err := r.db.Query(ctx, `
+		DELETE FROM blobs WHERE storage_key IN (
+			SELECT storage_key FROM blobs WHERE ref_count <= 0
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING storage_key
+	`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// ListTreeStorageKeys returns the storage keys of a file and its versions
+// and, for a folder, of everything inside it, one per reference
+func (r *FileRepository) ListTreeStorageKeys(ctx context.Context, id uuid.UUID) ([]string, error) {
+	query := `
+		WITH RECURSIVE tree AS (
+			SELECT id, is_folder, storage_key FROM files WHERE id = $1
+			UNION ALL
+			SELECT f.id, f.is_folder, f.storage_key
+			FROM files f
+			JOIN tree t ON f.parent_id = t.id
+		)
+		SELECT storage_key FROM tree
+		WHERE is_folder = false AND COALESCE(storage_key, '') <> ''
+		UNION ALL
+		SELECT v.storage_key FROM file_versions v JOIN tree t ON v.file_id = t.id
+	`
+
+	rows, err := r.db.Query(ctx, query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// GetTreeSize returns the size of a file and its versions and, for a
+// folder, of everything inside it: the storage its owner gets back when it
+// is deleted
+func (r *FileRepository) GetTreeSize(ctx context.Context, id uuid.UUID) (int64, error) {
+	query := `
+		WITH RECURSIVE tree AS (
+			SELECT id, is_folder, size FROM files WHERE id = $1
+			UNION ALL
+			SELECT f.id, f.is_folder, f.size
+			FROM files f
+			JOIN tree t ON f.parent_id = t.id
+		)
+		SELECT
+			(SELECT COALESCE(SUM(size), 0) FROM tree WHERE is_folder = false) +
+			(SELECT COALESCE(SUM(v.size), 0) FROM file_versions v JOIN tree t ON v.file_id = t.id)
+	`
+
+	var size int64
+	err := r.db.QueryRow(ctx, query, id).Scan(&size)
+	return size, err
+}
+
+// shareColumns are the columns scanShare reads
+const shareColumns = `id, file_id, owner_id, shared_with, public_token, permission, password_hash, expires_at,
+		       max_downloads, download_count, view_count, last_accessed_at, created_at,
+		       max_upload_size, max_uploads, upload_count, allowed_extensions`
+
+func scanShare(row pgx.Row) (*models.Share, error) {
+	share := &models.Share{}
+	err := row.Scan(
+		&share.ID,
+		&share.FileID,
+		&share.OwnerID,
+		&share.SharedWith,
+		&share.PublicToken,
+		&share.Permission,
+		&share.PasswordHash,
+		&share.ExpiresAt,
+		&share.MaxDownloads,
+		&share.DownloadCount,
+		&share.ViewCount,
+		&share.LastAccessedAt,
+		&share.CreatedAt,
+		&share.MaxUploadSize,
+		&share.MaxUploads,
+		&share.UploadCount,
+		&share.AllowedExtensions,
+	)
+	return share, err
+}
+
 // CreateShare creates a new share record
 func (r *FileRepository) CreateShare(ctx context.Context, share *models.Share) error {
 	query := `
-		INSERT INTO shares (id, file_id, owner_id, shared_with, public_token, permission, password_hash, expires_at, max_downloads, download_count, view_count, last_accessed_at, created_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		INSERT INTO shares (id, file_id, owner_id, shared_with, public_token, permission, password_hash, expires_at, max_downloads, download_count, view_count, last_accessed_at, created_at,
+		                    max_upload_size, max_uploads, upload_count, allowed_extensions)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
 	`
 
 	share.ID = uuid.New()
@@ -563,6 +1397,10 @@ func (r *FileRepository) CreateShare(ctx context.Context, share *models.Share) e
 		share.ViewCount,
 		share.LastAccessedAt,
 		share.CreatedAt,
+		share.MaxUploadSize,
+		share.MaxUploads,
+		share.UploadCount,
+		share.AllowedExtensions,
 	)
 
 	return err
@@ -571,30 +1409,15 @@ func (r *FileRepository) CreateShare(ctx context.Context, share *models.Share) e
 // GetShareByToken retrieves a share by its public token
 func (r *FileRepository) GetShareByToken(ctx context.Context, token string) (*models.Share, error) {
 	query := `
-		SELECT id, file_id, owner_id, shared_with, public_token, permission, password_hash, expires_at, max_downloads, download_count, view_count, last_accessed_at, created_at
+		SELECT ` + shareColumns + `
 		FROM shares
 		WHERE public_token = $1
 	`
 
-	share := &models.Share{}
-	err := r.db.QueryRow(ctx, query, token).Scan(
-		&share.ID,
-		&share.FileID,
-		&share.OwnerID,
-		&share.SharedWith,
-		&share.PublicToken,
-		&share.Permission,
-		&share.PasswordHash,
-		&share.ExpiresAt,
-		&share.MaxDownloads,
-		&share.DownloadCount,
-		&share.ViewCount,
-		&share.LastAccessedAt,
-		&share.CreatedAt,
-	)
+	share, err := scanShare(r.db.QueryRow(ctx, query, token))
 
 	if errors.Is(err, pgx.ErrNoRows) {
-		return nil, errors.New("share not found")
+		return nil, ErrShareNotFound
 	}
 
 	return share, err
@@ -623,6 +1446,30 @@ func (r *FileRepository) IncrementDownloadIfAllowed(ctx context.Context, shareID
 	return result.RowsAffected() > 0, nil
 }
 
+// ReserveShareUpload atomically checks max_uploads and counts an upload to
+// a file request. It returns false once the request has all its uploads.
+func (r *FileRepository) ReserveShareUpload(ctx context.Context, shareID uuid.UUID) (bool, error) {
+	query := `
+		UPDATE shares
+		SET upload_count = upload_count + 1, last_accessed_at = NOW()
+		WHERE id = $1
+		AND (max_uploads IS NULL OR upload_count < max_uploads)
+	`
+	result, err := r.db.Exec(ctx, query, shareID)
+	if err != nil {
+		return false, err
+	}
+	return result.RowsAffected() > 0, nil
+}
+
+// ReleaseShareUpload gives back an upload reserved with ReserveShareUpload
+// that failed
+func (r *FileRepository) ReleaseShareUpload(ctx context.Context, shareID uuid.UUID) error {
+	query := `UPDATE shares SET upload_count = GREATEST(upload_count - 1, 0) WHERE id = $1`
+	_, err := r.db.Exec(ctx, query, shareID)
+	return err
+}
+
 // IncrementShareViewCount increments the view count for a share
 func (r *FileRepository) IncrementShareViewCount(ctx context.Context, shareID uuid.UUID) error {
 	query := `UPDATE shares SET view_count = view_count + 1, last_accessed_at = NOW() WHERE id = $1`
@@ -633,27 +1480,12 @@ func (r *FileRepository) IncrementShareViewCount(ctx context.Context, shareID uu
 // GetUserShare retrieves a share for a specific user on a specific file
 func (r *FileRepository) GetUserShare(ctx context.Context, fileID, userID uuid.UUID) (*models.Share, error) {
 	query := `
-		SELECT id, file_id, owner_id, shared_with, public_token, permission, password_hash, expires_at, max_downloads, download_count, view_count, last_accessed_at, created_at
+		SELECT ` + shareColumns + `
 		FROM shares
 		WHERE file_id = $1 AND shared_with = $2
 	`
 
-	share := &models.Share{}
-	err := r.db.QueryRow(ctx, query, fileID, userID).Scan(
-		&share.ID,
-		&share.FileID,
-		&share.OwnerID,
-		&share.SharedWith,
-		&share.PublicToken,
-		&share.Permission,
-		&share.PasswordHash,
-		&share.ExpiresAt,
-		&share.MaxDownloads,
-		&share.DownloadCount,
-		&share.ViewCount,
-		&share.LastAccessedAt,
-		&share.CreatedAt,
-	)
+	share, err := scanShare(r.db.QueryRow(ctx, query, fileID, userID))
 
 	if errors.Is(err, pgx.ErrNoRows) {
 		return nil, nil
@@ -672,30 +1504,15 @@ func (r *FileRepository) UpdateShare(ctx context.Context, share *models.Share) e
 // GetShareByID retrieves a share by its ID
 func (r *FileRepository) GetShareByID(ctx context.Context, shareID uuid.UUID) (*models.Share, error) {
 	query := `
-		SELECT id, file_id, owner_id, shared_with, public_token, permission, password_hash, expires_at, max_downloads, download_count, view_count, last_accessed_at, created_at
+		SELECT ` + shareColumns + `
 		FROM shares
 		WHERE id = $1
 	`
 
-	share := &models.Share{}
-	err := r.db.QueryRow(ctx, query, shareID).Scan(
-		&share.ID,
-		&share.FileID,
-		&share.OwnerID,
-		&share.SharedWith,
-		&share.PublicToken,
-		&share.Permission,
-		&share.PasswordHash,
-		&share.ExpiresAt,
-		&share.MaxDownloads,
-		&share.DownloadCount,
-		&share.ViewCount,
-		&share.LastAccessedAt,
-		&share.CreatedAt,
-	)
+	share, err := scanShare(r.db.QueryRow(ctx, query, shareID))
 
 	if errors.Is(err, pgx.ErrNoRows) {
-		return nil, errors.New("share not found")
+		return nil, ErrShareNotFound
 	}
 
 	return share, err
@@ -708,10 +1525,74 @@ func (r *FileRepository) DeleteShare(ctx context.Context, shareID uuid.UUID) err
 	return err
 }
 
+// ExpiredShare is a share past its expiry, a link downloaded as often as it
+// allows or a file request that received all its uploads
+type ExpiredShare struct {
+	ID         uuid.UUID  `json:"id"`
+	FileID     uuid.UUID  `json:"fileId"`
+	FileName   string     `json:"fileName"`
+	OwnerID    uuid.UUID  `json:"ownerId"`
+	SharedWith *uuid.UUID `json:"sharedWith,omitempty"`
+	Reason     string     `json:"reason"` // "expired" or "exhausted"
+}
+
+// shareExpired is the condition on shares s expired or exhausted at $1
+const shareExpired = `((s.expires_at IS NOT NULL AND s.expires_at < $1)
+	OR (s.max_downloads IS NOT NULL AND s.download_count >= s.max_downloads)
+	OR (s.max_uploads IS NOT NULL AND s.upload_count >= s.max_uploads))`
+
+// ListExpiredShares returns up to limit shares expired or exhausted at now,
+// continuing after the share with ID afterID
+func (r *FileRepository) ListExpiredShares(ctx context.Context, now time.Time, afterID uuid.UUID, limit int) ([]*ExpiredShare, error) {
+	query := `
+		SELECT s.id, s.file_id, f.name, s.owner_id, s.shared_with,
+		       CASE WHEN s.expires_at < $1 THEN 'expired' ELSE 'exhausted' END
+		FROM shares s
+		JOIN files f ON f.id = s.file_id
+		WHERE ` + shareExpired + ` AND s.id > $2
+		ORDER BY s.id
+		LIMIT $3
+	`
+	return r.scanExpiredShares(ctx, query, now, afterID, limit)
+}
+
+// DeleteExpiredShares deletes up to limit shares expired or exhausted at
+// now and returns them
+func (r *FileRepository) DeleteExpiredShares(ctx context.Context, now time.Time, limit int) ([]*ExpiredShare, error) {
+	query := `
+		DELETE FROM shares s
+		USING files f
+		WHERE f.id = s.file_id AND s.id IN (
+			SELECT s.id FROM shares s WHERE ` + shareExpired + ` LIMIT $2
+		)
+		RETURNING s.id, s.file_id, f.name, s.owner_id, s.shared_with,
+		          CASE WHEN s.expires_at < $1 THEN 'expired' ELSE 'exhausted' END
+	`
+	return r.scanExpiredShares(ctx, query, now, limit)
+}
+
+func (r *FileRepository) scanExpiredShares(ctx context.Context, query string, args ...interface{}) ([]*ExpiredShare, error) {
+	rows, err := r.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shares := make([]*ExpiredShare, 0)
+	for rows.Next() {
+		share := &ExpiredShare{}
+		if err := rows.Scan(&share.ID, &share.FileID, &share.FileName, &share.OwnerID, &share.SharedWith, &share.Reason); err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	return shares, rows.Err()
+}
+
 // GetSharesByFile returns all shares for a file
 func (r *FileRepository) GetSharesByFile(ctx context.Context, fileID uuid.UUID) ([]*models.Share, error) {
 	query := `
-		SELECT id, file_id, owner_id, shared_with, public_token, permission, password_hash, expires_at, max_downloads, download_count, view_count, last_accessed_at, created_at
+		SELECT ` + shareColumns + `
 		FROM shares
 		WHERE file_id = $1
 		ORDER BY created_at DESC
@@ -725,22 +1606,7 @@ func (r *FileRepository) GetSharesByFile(ctx context.Context, fileID uuid.UUID)
 
 	shares := make([]*models.Share, 0)
 	for rows.Next() {
-		share := &models.Share{}
-		err := rows.Scan(
-			&share.ID,
-			&share.FileID,
-			&share.OwnerID,
-			&share.SharedWith,
-			&share.PublicToken,
-			&share.Permission,
-			&share.PasswordHash,
-			&share.ExpiresAt,
-			&share.MaxDownloads,
-			&share.DownloadCount,
-			&share.ViewCount,
-			&share.LastAccessedAt,
-			&share.CreatedAt,
-		)
+		share, err := scanShare(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -754,7 +1620,8 @@ func (r *FileRepository) GetSharesByFile(ctx context.Context, fileID uuid.UUID)
 func (r *FileRepository) GetSharedWithUser(ctx context.Context, userID uuid.UUID) ([]*models.SharedFile, error) {
 	query := `
 		SELECT f.id, f.name, f.is_folder, f.size, f.mime_type, s.permission, 
-		       u.id as owner_id, u.name as owner_name, u.email as owner_email, s.created_at as shared_at
+		       u.id as owner_id, u.name as owner_name, u.email as owner_email, s.created_at as shared_at,
+		       s.expires_at, f.updated_at
 		FROM shares s
 		JOIN files f ON f.id = s.file_id
 		JOIN users u ON u.id = s.owner_id
@@ -782,6 +1649,8 @@ func (r *FileRepository) GetSharedWithUser(ctx context.Context, userID uuid.UUID
 			&sf.OwnerName,
 			&sf.OwnerEmail,
 			&sf.SharedAt,
+			&sf.ExpiresAt,
+			&sf.UpdatedAt,
 		)
 		if err != nil {
 			return nil, err
@@ -0,0 +1,142 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"github.com/tessera/tessera/internal/models"
+)
+
+var (
+	// ErrLockNotFound is returned when a lock does not exist or has expired
+	ErrLockNotFound = errors.New("lock not found")
+	// ErrLockBusy is returned when another request is changing the same
+	// owner's locks
+	ErrLockBusy = errors.New("locks are being changed by another request")
+)
+
+// LockRepository handles WebDAV locks in Redis, so every replica sees them.
+// Locks are grouped by the owner of the locked files, as conflicts can only
+// arise within one owner's tree.
+type LockRepository struct {
+	rdb *redis.Client
+}
+
+// NewLockRepository creates a new lock repository
+func NewLockRepository(rdb *redis.Client) *LockRepository {
+	return &LockRepository{rdb: rdb}
+}
+
+func lockKey(token string) string {
+	return fmt.Sprintf("dav_lock:%s", token)
+}
+
+// ownerLocksKey is a set of the tokens of an owner's locks, which may still
+// name locks that have expired
+func ownerLocksKey(ownerID uuid.UUID) string {
+	return fmt.Sprintf("dav_locks:%s", ownerID.String())
+}
+
+func lockGuardKey(ownerID uuid.UUID) string {
+	return fmt.Sprintf("dav_lock_guard:%s", ownerID.String())
+}
+
+// Save creates or refreshes a lock, which Redis drops when it expires
+func (r *LockRepository) Save(ctx context.Context, lock *models.Lock) error {
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+
+	pipe := r.rdb.Pipeline()
+	pipe.Set(ctx, lockKey(lock.Token), data, time.Until(lock.ExpiresAt))
+	pipe.SAdd(ctx, ownerLocksKey(lock.OwnerID), lock.Token)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// Get retrieves a lock by its token
+func (r *LockRepository) Get(ctx context.Context, token string) (*models.Lock, error) {
+	data, err := r.rdb.Get(ctx, lockKey(token)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrLockNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &models.Lock{}
+	if err := json.Unmarshal(data, lock); err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// Delete removes a lock
+func (r *LockRepository) Delete(ctx context.Context, lock *models.Lock) error {
+	pipe := r.rdb.Pipeline()
+	pipe.Del(ctx, lockKey(lock.Token))
+	pipe.SRem(ctx, ownerLocksKey(lock.OwnerID), lock.Token)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// ListByOwner returns the active locks on an owner's files, forgetting
+// expired ones along the way
+func (r *LockRepository) ListByOwner(ctx context.Context, ownerID uuid.UUID) ([]*models.Lock, error) {
+	tokens, err := r.rdb.SMembers(ctx, ownerLocksKey(ownerID)).Result()
+	if err != nil || len(tokens) == 0 {
+		return nil, err
+	}
+
+	keys := make([]string, len(tokens))
+	for i, token := range tokens {
+		keys[i] = lockKey(token)
+	}
+	values, err := r.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var locks []*models.Lock
+	var expired []interface{}
+	for i, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			expired = append(expired, tokens[i])
+			continue
+		}
+		lock := &models.Lock{}
+		if err := json.Unmarshal([]byte(data), lock); err != nil {
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+	if len(expired) > 0 {
+		_ = r.rdb.SRem(ctx, ownerLocksKey(ownerID), expired...).Err()
+	}
+	return locks, nil
+}
+
+// Guard serializes changes to an owner's locks, so two conflicting locks
+// can't both be granted. It must be released with Unguard.
+func (r *LockRepository) Guard(ctx context.Context, ownerID uuid.UUID, ttl time.Duration) error {
+	ok, err := r.rdb.SetNX(ctx, lockGuardKey(ownerID), 1, ttl).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrLockBusy
+	}
+	return nil
+}
+
+// Unguard releases the guard on an owner's locks
+func (r *LockRepository) Unguard(ctx context.Context, ownerID uuid.UUID) error {
+	return r.rdb.Del(ctx, lockGuardKey(ownerID)).Err()
+}
@@ -0,0 +1,200 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/tessera/tessera/internal/models"
+)
+
+// ScanRepository handles the queries of virus scanning: scan results of
+// files and email attachments, and the admin's view of them
+type ScanRepository struct {
+	db *pgxpool.Pool
+}
+
+// NewScanRepository creates a new scan repository
+func NewScanRepository(db *pgxpool.Pool) *ScanRepository {
+	return &ScanRepository{db: db}
+}
+
+// SetFileResult records the scan result of a file's content with the given
+// hash. It reports false, recording nothing, when the file has had new
+// content since.
+func (r *ScanRepository) SetFileResult(ctx context.Context, fileID uuid.UUID, hash, status, virus string) (bool, error) {
+	tag, err := r.db.Exec(ctx, `
+		UPDATE files SET scan_status = $3, virus = $4, scanned_at = NOW()
+		WHERE id = $1 AND hash = $2
+	`, fileID, hash, status, virus)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// ListFiles returns up to limit files, not folders, in ID order after the
+// given one, trashed ones included
+func (r *ScanRepository) ListFiles(ctx context.Context, after uuid.UUID, limit int) ([]*models.File, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT id, owner_id, name, size, storage_key, hash, scan_status, virus
+		FROM files
+		WHERE is_folder = false AND id > $1
+		ORDER BY id
+		LIMIT $2
+	`, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	files := make([]*models.File, 0)
+	for rows.Next() {
+		file := &models.File{}
+		if err := rows.Scan(&file.ID, &file.OwnerID, &file.Name, &file.Size, &file.StorageKey, &file.Hash, &file.ScanStatus, &file.Virus); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
+// CountFiles returns how many files there are in each scan state; files
+// stored while scanning was off are counted under ""
+func (r *ScanRepository) CountFiles(ctx context.Context) (map[string]int64, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT scan_status, COUNT(*) FROM files WHERE is_folder = false GROUP BY scan_status
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var status string
+		var n int64
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		counts[status] = n
+	}
+	return counts, rows.Err()
+}
+
+// InfectedFile is a file quarantined because its content contains malware
+type InfectedFile struct {
+	FileID     uuid.UUID `json:"fileId"`
+	Name       string    `json:"name"`
+	Size       int64     `json:"size"`
+	OwnerID    uuid.UUID `json:"ownerId"`
+	OwnerEmail string    `json:"ownerEmail"`
+	Virus      string    `json:"virus"`
+	IsTrashed  bool      `json:"isTrashed"`
+	ScannedAt  time.Time `json:"scannedAt"`
+}
+
+// ListInfected returns the infected files, most recently found first
+func (r *ScanRepository) ListInfected(ctx context.Context, limit, offset int) ([]*InfectedFile, int, error) {
+	var total int
+	if err := r.db.QueryRow(ctx, `SELECT COUNT(*) FROM files WHERE scan_status = 'infected'`).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := r.db.Query(ctx, `
+		SELECT f.id, f.name, f.size, f.owner_id, u.email, f.virus, f.is_trashed, f.scanned_at
+		FROM files f
+		JOIN users u ON u.id = f.owner_id
+		WHERE f.scan_status = 'infected'
+		ORDER BY f.scanned_at DESC, f.id
+		LIMIT $1 OFFSET $2
+	`, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	infected := make([]*InfectedFile, 0)
+	for rows.Next() {
+		f := &InfectedFile{}
+		if err := rows.Scan(&f.FileID, &f.Name, &f.Size, &f.OwnerID, &f.OwnerEmail, &f.Virus, &f.IsTrashed, &f.ScannedAt); err != nil {
+			return nil, 0, err
+		}
+		infected = append(infected, f)
+	}
+	return infected, total, rows.Err()
+}
+
+// StoredAttachment is an email attachment kept in storage, with the user
+// whose account received it
+type StoredAttachment struct {
+	ID         string
+	Filename   string
+	StorageKey string
+	UserID     uuid.UUID
+	Virus      string
+}
+
+// ListStoredAttachments returns up to limit email attachments kept in
+// storage, in ID order after the given one (uuid.Nil's to start)
+func (r *ScanRepository) ListStoredAttachments(ctx context.Context, after string, limit int) ([]*StoredAttachment, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT a.id, a.filename, a.storage_key, acc.user_id, a.virus
+		FROM email_attachments a
+		JOIN emails e ON e.id = a.email_id
+		JOIN email_accounts acc ON acc.id = e.account_id
+		WHERE COALESCE(a.storage_key, '') <> '' AND a.id > $1::uuid
+		ORDER BY a.id
+		LIMIT $2
+	`, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attachments := make([]*StoredAttachment, 0)
+	for rows.Next() {
+		a := &StoredAttachment{}
+		if err := rows.Scan(&a.ID, &a.Filename, &a.StorageKey, &a.UserID, &a.Virus); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments, rows.Err()
+}
+
+// SetAttachmentVirus records what an email attachment contains, or clears
+// it when virus is empty
+func (r *ScanRepository) SetAttachmentVirus(ctx context.Context, attachmentID, virus string) error {
+	_, err := r.db.Exec(ctx, `UPDATE email_attachments SET virus = $2 WHERE id = $1`, attachmentID, virus)
+	return err
+}
+
+// CountInfectedAttachments returns how many email attachments were found
+// to contain malware
+func (r *ScanRepository) CountInfectedAttachments(ctx context.Context) (int64, error) {
+	var n int64
+	err := r.db.QueryRow(ctx, `SELECT COUNT(*) FROM email_attachments WHERE virus <> ''`).Scan(&n)
+	return n, err
+}
+
+// ListAdminIDs returns the active admins, who are told about infected
+// uploads
+func (r *ScanRepository) ListAdminIDs(ctx context.Context) ([]uuid.UUID, error) {
+	rows, err := r.db.Query(ctx, `SELECT id FROM users WHERE role = $1 AND is_active = true`, models.RoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make([]uuid.UUID, 0)
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,385 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ErrNoStorageCheck is returned when no storage check has run yet
+var ErrNoStorageCheck = errors.New("no storage check has run")
+
+// StorageCheckRepository handles the queries of storage consistency checks
+// and their reports
+type StorageCheckRepository struct {
+	db *pgxpool.Pool
+}
+
+// NewStorageCheckRepository creates a new storage check repository
+func NewStorageCheckRepository(db *pgxpool.Pool) *StorageCheckRepository {
+	return &StorageCheckRepository{db: db}
+}
+
+// Blob is stored file content, shared by the files and versions with the
+// same hash
+type Blob struct {
+	Key      string
+	Hash     string // empty for content stored before hashing
+	Size     int64
+	RefCount int
+}
+
+// ListBlobs returns up to limit referenced blobs in key order, starting
+// after the given key
+func (r *StorageCheckRepository) ListBlobs(ctx context.Context, after string, limit int) ([]*Blob, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT storage_key, COALESCE(hash, ''), size, ref_count FROM blobs
+		WHERE storage_key > $1 AND ref_count > 0
+		ORDER BY storage_key
+		LIMIT $2
+	`, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blobs := make([]*Blob, 0)
+	for rows.Next() {
+		b := &Blob{}
+		if err := rows.Scan(&b.Key, &b.Hash, &b.Size, &b.RefCount); err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, b)
+	}
+	return blobs, rows.Err()
+}
+
+// ReferencedKeys returns which of keys are in use: by a blob, a thumbnail or
+// an email attachment
+func (r *StorageCheckRepository) ReferencedKeys(ctx context.Context, keys []string) (map[string]bool, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT k FROM unnest($1::text[]) AS k
+		WHERE EXISTS (SELECT 1 FROM blobs WHERE storage_key = k)
+		   OR EXISTS (SELECT 1 FROM file_thumbnails WHERE storage_key = k)
+		   OR EXISTS (SELECT 1 FROM email_attachments WHERE storage_key = k)
+	`, keys)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	referenced := make(map[string]bool)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		referenced[key] = true
+	}
+	return referenced, rows.Err()
+}
+
+// ContentRef is a file, or one of its versions, whose content is in a blob.
+// Version is 0 for the file's current content.
+type ContentRef struct {
+	FileID  uuid.UUID `json:"fileId"`
+	Version int       `json:"version,omitempty"`
+	OwnerID uuid.UUID `json:"ownerId"`
+	Name    string    `json:"name"`
+}
+
+// ContentRefs returns the files and versions whose content is stored under
+// key
+func (r *StorageCheckRepository) ContentRefs(ctx context.Context, key string) ([]*ContentRef, error) {
+	rows, err := r.db.Query(ctx, `
+		SELECT id, 0, owner_id, name FROM files
+		WHERE storage_key = $1 AND is_folder = false
+		UNION ALL
+		SELECT f.id, v.version, f.owner_id, f.name FROM file_versions v
+		JOIN files f ON f.id = v.file_id
+		WHERE v.storage_key = $1
+	`, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	refs := make([]*ContentRef, 0)
+	for rows.Next() {
+		ref := &ContentRef{}
+		if err := rows.Scan(&ref.FileID, &ref.Version, &ref.OwnerID, &ref.Name); err != nil {
+			return nil, err
+		}
+		refs = append(refs, ref)
+	}
+	return refs, rows.Err()
+}
+
+// UnrecordedBlobs returns up to limit keys files or versions use that have
+// no blob, with what they take up. Such content is never deleted, as
+// releasing it finds nothing to release. With record set, blobs are created
+// for them, referenced by each file and version using them.
+func (r *StorageCheckRepository) UnrecordedBlobs(ctx context.Context, record bool, limit int) ([]*Blob, error) {
+	refs := `
+		SELECT storage_key, MAX(hash) AS hash, MAX(size) AS size, COUNT(*) AS ref_count
+		FROM (
+			SELECT storage_key, hash, size FROM files
+			WHERE is_folder = false AND storage_key IS NOT NULL AND storage_key <> ''
+			UNION ALL
+			SELECT storage_key, hash, size FROM file_versions
+			WHERE storage_key <> ''
+		) refs
+		WHERE NOT EXISTS (SELECT 1 FROM blobs b WHERE b.storage_key = refs.storage_key)
+		GROUP BY storage_key
+		ORDER BY storage_key
+		LIMIT $1`
+	query := refs
+	if record {
+		query = `
+			INSERT INTO blobs (storage_key, hash, size, ref_count)
+			` + refs + `
+			ON CONFLICT (storage_key) DO NOTHING
+			RETURNING storage_key, hash, size, ref_count`
+	}
+	rows, err := r.db.Query(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blobs := make([]*Blob, 0)
+	for rows.Next() {
+		b := &Blob{}
+		var hash *string
+		if err := rows.Scan(&b.Key, &hash, &b.Size, &b.RefCount); err != nil {
+			return nil, err
+		}
+		if hash != nil {
+			b.Hash = *hash
+		}
+		blobs = append(blobs, b)
+	}
+	return blobs, rows.Err()
+}
+
+// RefCountMismatch is a blob whose reference count isn't the number of
+// files and versions using it
+type RefCountMismatch struct {
+	Key      string `json:"key"`
+	Recorded int    `json:"recorded"`
+	Actual   int    `json:"actual"`
+}
+
+// RefCountMismatches returns up to limit blobs whose reference count is
+// off. With raise set, counts that are too low are raised to the actual
+// one, so the content isn't deleted while still in use. Counts that are too
+// high are only returned: uploads claim a blob before their file exists, so
+// lowering them could race one in progress.
+func (r *StorageCheckRepository) RefCountMismatches(ctx context.Context, raise bool, limit int) ([]*RefCountMismatch, error) {
+	mismatches := `
+		WITH refs AS (
+			SELECT storage_key, COUNT(*) AS n FROM (
+				SELECT storage_key FROM files
+				WHERE is_folder = false AND storage_key IS NOT NULL AND storage_key <> ''
+				UNION ALL
+				SELECT storage_key FROM file_versions WHERE storage_key <> ''
+			) r
+			GROUP BY storage_key
+		)
+		SELECT b.storage_key, b.ref_count AS recorded, COALESCE(refs.n, 0)::int AS actual
+		FROM blobs b LEFT JOIN refs ON refs.storage_key = b.storage_key
+		WHERE b.ref_count <> COALESCE(refs.n, 0) AND NOT (b.ref_count <= 0 AND refs.n IS NULL)
+		ORDER BY b.storage_key
+		LIMIT $1`
+	rows, err := r.db.Query(ctx, mismatches, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := make([]*RefCountMismatch, 0)
+	for rows.Next() {
+		m := &RefCountMismatch{}
+		if err := rows.Scan(&m.Key, &m.Recorded, &m.Actual); err != nil {
+			return nil, err
+		}
+		found = append(found, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if !raise {
+		return found, nil
+	}
+
+	for _, m := range found {
+		if m.Actual <= m.Recorded {
+			continue
+		}
+		// Raised by the difference, so a reference claimed meanwhile isn't
+		// lost
+		_, err := r.db.Exec(ctx, `UPDATE blobs SET ref_count = ref_count + $2 WHERE storage_key = $1`,
+			m.Key, m.Actual-m.Recorded)
+		if err != nil {
+			return found, err
+		}
+	}
+	return found, nil
+}
+
+// UsageMismatch is a user whose recorded storage used isn't what their
+// files, versions and attachments take up
+type UsageMismatch struct {
+	UserID   uuid.UUID `json:"userId"`
+	Email    string    `json:"email"`
+	Recorded int64     `json:"recorded"`
+	Actual   int64     `json:"actual"`
+}
+
+// UsageMismatches returns the users whose storage used is off. With fix
+// set, it's set to what their files, versions and attachments take up.
+func (r *StorageCheckRepository) UsageMismatches(ctx context.Context, fix bool) ([]*UsageMismatch, error) {
+	actual := `
+		SELECT u.id, u.email, u.storage_used AS recorded, ` + storageUsedSQL + ` AS actual
+		FROM users u`
+	query := `SELECT id, email, recorded, actual FROM (` + actual + `) usage WHERE recorded <> actual ORDER BY email`
+	if fix {
+		query = `
+			WITH usage AS (` + actual + `)
+			UPDATE users u SET storage_used = usage.actual, updated_at = NOW()
+			FROM usage
+			WHERE u.id = usage.id AND usage.recorded <> usage.actual
+			RETURNING u.id, usage.email, usage.recorded, usage.actual`
+	}
+	rows, err := r.db.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mismatches := make([]*UsageMismatch, 0)
+	for rows.Next() {
+		m := &UsageMismatch{}
+		if err := rows.Scan(&m.UserID, &m.Email, &m.Recorded, &m.Actual); err != nil {
+			return nil, err
+		}
+		mismatches = append(mismatches, m)
+	}
+	return mismatches, rows.Err()
+}
+
+// MarkBroken marks files and versions whose content under key is missing
+// or damaged
+func (r *StorageCheckRepository) MarkBroken(ctx context.Context, refs []*ContentRef, key, reason string) error {
+	batch := &pgx.Batch{}
+	for _, ref := range refs {
+		batch.Queue(`
+			INSERT INTO broken_files (file_id, version, storage_key, reason)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT (file_id, version) DO UPDATE
+			SET storage_key = EXCLUDED.storage_key, reason = EXCLUDED.reason, detected_at = NOW()
+		`, ref.FileID, ref.Version, key, reason)
+	}
+	return r.db.SendBatch(ctx, batch).Close()
+}
+
+// BrokenKeys returns the keys of marked content with the reasons they were
+// marked for
+func (r *StorageCheckRepository) BrokenKeys(ctx context.Context) (map[string]string, error) {
+	rows, err := r.db.Query(ctx, `SELECT DISTINCT ON (storage_key) storage_key, reason FROM broken_files`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := make(map[string]string)
+	for rows.Next() {
+		var key, reason string
+		if err := rows.Scan(&key, &reason); err != nil {
+			return nil, err
+		}
+		keys[key] = reason
+	}
+	return keys, rows.Err()
+}
+
+// ClearBroken removes the marks of content under key, found sound again
+func (r *StorageCheckRepository) ClearBroken(ctx context.Context, key string) error {
+	_, err := r.db.Exec(ctx, `DELETE FROM broken_files WHERE storage_key = $1`, key)
+	return err
+}
+
+// BrokenFile is a file or version marked broken
+type BrokenFile struct {
+	FileID     uuid.UUID `json:"fileId"`
+	Version    int       `json:"version,omitempty"`
+	Name       string    `json:"name"`
+	OwnerID    uuid.UUID `json:"ownerId"`
+	OwnerEmail string    `json:"ownerEmail"`
+	Reason     string    `json:"reason"`
+	DetectedAt time.Time `json:"detectedAt"`
+}
+
+// ListBroken returns files and versions marked broken whose content hasn't
+// been replaced since, newest marks first
+func (r *StorageCheckRepository) ListBroken(ctx context.Context, limit, offset int) ([]*BrokenFile, int, error) {
+	where := `
+		FROM broken_files b
+		JOIN files f ON f.id = b.file_id
+		JOIN users u ON u.id = f.owner_id
+		LEFT JOIN file_versions v ON v.file_id = b.file_id AND v.version = b.version
+		WHERE (b.version = 0 AND f.storage_key = b.storage_key)
+		   OR (b.version > 0 AND v.storage_key = b.storage_key)`
+
+	var total int
+	if err := r.db.QueryRow(ctx, `SELECT COUNT(*) `+where).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := r.db.Query(ctx, `
+		SELECT b.file_id, b.version, f.name, f.owner_id, u.email, b.reason, b.detected_at `+where+`
+		ORDER BY b.detected_at DESC, b.file_id, b.version
+		LIMIT $1 OFFSET $2
+	`, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	broken := make([]*BrokenFile, 0)
+	for rows.Next() {
+		b := &BrokenFile{}
+		if err := rows.Scan(&b.FileID, &b.Version, &b.Name, &b.OwnerID, &b.OwnerEmail, &b.Reason, &b.DetectedAt); err != nil {
+			return nil, 0, err
+		}
+		broken = append(broken, b)
+	}
+	return broken, total, rows.Err()
+}
+
+// SaveReport stores the report of a finished check
+func (r *StorageCheckRepository) SaveReport(ctx context.Context, startedAt, finishedAt time.Time, report interface{}) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	_, err = r.db.Exec(ctx, `
+		INSERT INTO storage_checks (started_at, finished_at, report) VALUES ($1, $2, $3)
+	`, startedAt, finishedAt, data)
+	return err
+}
+
+// LatestReport returns the report of the last check
+func (r *StorageCheckRepository) LatestReport(ctx context.Context) (json.RawMessage, error) {
+	var report json.RawMessage
+	err := r.db.QueryRow(ctx, `SELECT report FROM storage_checks ORDER BY started_at DESC LIMIT 1`).Scan(&report)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNoStorageCheck
+	}
+	return report, err
+}
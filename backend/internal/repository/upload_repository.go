@@ -0,0 +1,115 @@
+package repository
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/tessera/tessera/internal/models"
+)
+
+var (
+	// ErrUploadNotFound is returned when an upload session does not exist or has expired
+	ErrUploadNotFound = errors.New("upload not found")
+	// ErrUploadLocked is returned when another request is already writing to an upload
+	ErrUploadLocked = errors.New("upload is locked by another request")
+)
+
+// uploadRetention is how long a session outlives its advertised expiry so the
+// cleanup job can still find and abort its multipart upload.
+const uploadRetention = 24 * time.Hour
+
+// UploadRepository handles resumable upload sessions in Redis
+type UploadRepository struct {
+	rdb *redis.Client
+}
+
+// NewUploadRepository creates a new upload session repository
+func NewUploadRepository(rdb *redis.Client) *UploadRepository {
+	return &UploadRepository{rdb: rdb}
+}
+
+func uploadSessionKey(uploadID string) string {
+	return fmt.Sprintf("upload_session:%s", uploadID)
+}
+
+func uploadLockKey(uploadID string) string {
+	return fmt.Sprintf("upload_lock:%s", uploadID)
+}
+
+// uploadExpiryKey is a sorted set of upload IDs scored by their expiry time
+const uploadExpiryKey = "upload_sessions:expiry"
+
+// Save creates or updates an upload session
+func (r *UploadRepository) Save(ctx context.Context, session *models.UploadSession) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	ttl := time.Until(session.ExpiresAt) + uploadRetention
+
+	pipe := r.rdb.Pipeline()
+	pipe.Set(ctx, uploadSessionKey(session.ID), data, ttl)
+	pipe.ZAdd(ctx, uploadExpiryKey, redis.Z{
+		Score:  float64(session.ExpiresAt.Unix()),
+		Member: session.ID,
+	})
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// GetByID retrieves an upload session, including ones past their expiry
+func (r *UploadRepository) GetByID(ctx context.Context, uploadID string) (*models.UploadSession, error) {
+	data, err := r.rdb.Get(ctx, uploadSessionKey(uploadID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	session := &models.UploadSession{}
+	if err := json.Unmarshal(data, session); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// Delete removes an upload session
+func (r *UploadRepository) Delete(ctx context.Context, uploadID string) error {
+	pipe := r.rdb.Pipeline()
+	pipe.Del(ctx, uploadSessionKey(uploadID))
+	pipe.ZRem(ctx, uploadExpiryKey, uploadID)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// ListExpired returns the IDs of sessions that expired before the given time
+func (r *UploadRepository) ListExpired(ctx context.Context, before time.Time, limit int64) ([]string, error) {
+	return r.rdb.ZRangeByScore(ctx, uploadExpiryKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   fmt.Sprintf("%d", before.Unix()),
+		Count: limit,
+	}).Result()
+}
+
+// Lock acquires an exclusive write lock on an upload session
+func (r *UploadRepository) Lock(ctx context.Context, uploadID string, ttl time.Duration) error {
+	ok, err := r.rdb.SetNX(ctx, uploadLockKey(uploadID), 1, ttl).Result()
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrUploadLocked
+	}
+	return nil
+}
+
+// Unlock releases the write lock on an upload session
+func (r *UploadRepository) Unlock(ctx context.Context, uploadID string) error {
+	return r.rdb.Del(ctx, uploadLockKey(uploadID)).Err()
+}
@@ -14,6 +14,9 @@ import (
 var (
 	ErrUserNotFound      = errors.New("user not found")
 	ErrUserAlreadyExists = errors.New("user already exists")
+	// ErrStorageLimit is returned when storage would be charged past a
+	// user's limit
+	ErrStorageLimit = errors.New("storage limit reached")
 )
 
 // UserRepository handles user database operations
@@ -138,7 +141,7 @@ func (r *UserRepository) GetByEmail(ctx context.Context, email string) (*models.
 func (r *UserRepository) Update(ctx context.Context, user *models.User) error {
 	query := `
 		UPDATE users
-		SET email = $2, name = $3, role = $4, storage_used = $5, is_active = $6, updated_at = $7, last_login_at = $8
+		SET email = $2, name = $3, role = $4, storage_limit = $5, is_active = $6, updated_at = $7, last_login_at = $8
 		WHERE id = $1
 	`
 
@@ -149,7 +152,7 @@ func (r *UserRepository) Update(ctx context.Context, user *models.User) error {
 		user.Email,
 		user.Name,
 		user.Role,
-		user.StorageUsed,
+		user.StorageLimit,
 		user.IsActive,
 		user.UpdatedAt,
 		user.LastLoginAt,
@@ -182,15 +185,223 @@ func (r *UserRepository) UpdateTimezone(ctx context.Context, userID uuid.UUID, t
 	return err
 }
 
-// UpdateStorageUsed updates the user's storage usage
-func (r *UserRepository) UpdateStorageUsed(ctx context.Context, userID uuid.UUID, delta int64) error {
+// storageUsedSQL is the storage taken up by the user u: their files, trashed
+// ones included, the versions of those files and the email attachments
+// kept in storage. storage_used is kept at this by QuotaService.
+const storageUsedSQL = `
+	(SELECT COALESCE(SUM(size), 0) FROM files WHERE owner_id = u.id AND is_folder = false) +
+	(SELECT COALESCE(SUM(v.size), 0) FROM file_versions v JOIN files f ON f.id = v.file_id WHERE f.owner_id = u.id) +
+	(SELECT COALESCE(SUM(a.size), 0) FROM email_attachments a
+		JOIN emails e ON e.id = a.email_id
+		JOIN email_accounts acc ON acc.id = e.account_id
+		WHERE acc.user_id = u.id AND COALESCE(a.storage_key, '') <> '')`
+
+// StorageUsage is a user's storage used with their limit, where a limit of
+// 0 means none, and the warning threshold they were last warned about
+type StorageUsage struct {
+	UserID    uuid.UUID
+	Used      int64
+	Limit     int64
+	WarnedPct int
+}
+
+// ChargeStorage adds size to the user's storage used, unless that would
+// take them past their limit, in which case ErrStorageLimit is returned
+func (r *UserRepository) ChargeStorage(ctx context.Context, userID uuid.UUID, size int64) (*StorageUsage, error) {
 	query := `
 		UPDATE users
 		SET storage_used = storage_used + $2, updated_at = $3
+		WHERE id = $1 AND (storage_limit <= 0 OR storage_used + $2 <= storage_limit)
+		RETURNING id, storage_used, storage_limit, quota_warned_pct
+	`
+
+	usage := &StorageUsage{}
+	err := r.db.QueryRow(ctx, query, userID, size, time.Now()).Scan(&usage.UserID, &usage.Used, &usage.Limit, &usage.WarnedPct)
+	if errors.Is(err, pgx.ErrNoRows) {
+		var exists bool
+		if err := r.db.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)`, userID).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, ErrUserNotFound
+		}
+		return nil, ErrStorageLimit
+	}
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// ReleaseStorage takes size off the user's storage used
+func (r *UserRepository) ReleaseStorage(ctx context.Context, userID uuid.UUID, size int64) (*StorageUsage, error) {
+	query := `
+		UPDATE users
+		SET storage_used = GREATEST(storage_used - $2, 0), updated_at = $3
 		WHERE id = $1
+		RETURNING id, storage_used, storage_limit, quota_warned_pct
+	`
+
+	usage := &StorageUsage{}
+	err := r.db.QueryRow(ctx, query, userID, size, time.Now()).Scan(&usage.UserID, &usage.Used, &usage.Limit, &usage.WarnedPct)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
+
+// SetQuotaWarned records the warning threshold the user was last warned
+// about. It reports false when that was already recorded, such as by a
+// concurrent write that crossed the same threshold.
+func (r *UserRepository) SetQuotaWarned(ctx context.Context, userID uuid.UUID, pct int) (bool, error) {
+	tag, err := r.db.Exec(ctx, `UPDATE users SET quota_warned_pct = $2 WHERE id = $1 AND quota_warned_pct <> $2`, userID, pct)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() > 0, nil
+}
+
+// ListStorageUsage returns the storage usage of the users with a limit or
+// a warning recorded, or of one of them when userID is set
+func (r *UserRepository) ListStorageUsage(ctx context.Context, userID *uuid.UUID) ([]*StorageUsage, error) {
+	query := `
+		SELECT id, storage_used, storage_limit, quota_warned_pct
+		FROM users
+		WHERE (storage_limit > 0 OR quota_warned_pct > 0) AND ($1::uuid IS NULL OR id = $1)
 	`
 
-	_, err := r.db.Exec(ctx, query, userID, delta, time.Now())
+	rows, err := r.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usages := make([]*StorageUsage, 0)
+	for rows.Next() {
+		usage := &StorageUsage{}
+		if err := rows.Scan(&usage.UserID, &usage.Used, &usage.Limit, &usage.WarnedPct); err != nil {
+			return nil, err
+		}
+		usages = append(usages, usage)
+	}
+	return usages, rows.Err()
+}
+
+// ReconcileStorageUsed sets the storage used of every user, or of one when
+// userID is set, to what they take up, returning those for whom it was off
+func (r *UserRepository) ReconcileStorageUsed(ctx context.Context, userID *uuid.UUID) ([]*UsageMismatch, error) {
+	query := `
+		WITH usage AS (
+			SELECT u.id, u.email, u.storage_used AS recorded, ` + storageUsedSQL + ` AS actual
+			FROM users u
+			WHERE $1::uuid IS NULL OR u.id = $1
+		)
+		UPDATE users u SET storage_used = usage.actual, updated_at = NOW()
+		FROM usage
+		WHERE u.id = usage.id AND usage.recorded <> usage.actual
+		RETURNING u.id, usage.email, usage.recorded, usage.actual
+	`
+
+	rows, err := r.db.Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	mismatches := make([]*UsageMismatch, 0)
+	for rows.Next() {
+		m := &UsageMismatch{}
+		if err := rows.Scan(&m.UserID, &m.Email, &m.Recorded, &m.Actual); err != nil {
+			return nil, err
+		}
+		mismatches = append(mismatches, m)
+	}
+	return mismatches, rows.Err()
+}
+
+// StorageConsumer is a user with what their storage goes to
+type StorageConsumer struct {
+	UserID       uuid.UUID `json:"userId"`
+	Email        string    `json:"email"`
+	Name         string    `json:"name"`
+	StorageUsed  int64     `json:"storageUsed"`
+	StorageQuota int64     `json:"storageQuota"`
+	Files        int64     `json:"files"`
+	Trash        int64     `json:"trash"`
+	Versions     int64     `json:"versions"`
+	Attachments  int64     `json:"attachments"`
+}
+
+// TopStorageConsumers returns the users taking up the most storage, going
+// by what their files, versions and attachments take up rather than their
+// recorded storage used
+func (r *UserRepository) TopStorageConsumers(ctx context.Context, limit int) ([]*StorageConsumer, error) {
+	query := `
+		WITH file_totals AS (
+			SELECT owner_id,
+			       COALESCE(SUM(size) FILTER (WHERE NOT is_trashed), 0) AS files,
+			       COALESCE(SUM(size) FILTER (WHERE is_trashed), 0) AS trash
+			FROM files WHERE is_folder = false
+			GROUP BY owner_id
+		), version_totals AS (
+			SELECT f.owner_id, SUM(v.size) AS versions
+			FROM file_versions v JOIN files f ON f.id = v.file_id
+			GROUP BY f.owner_id
+		), attachment_totals AS (
+			SELECT acc.user_id, SUM(a.size) AS attachments
+			FROM email_attachments a
+			JOIN emails e ON e.id = a.email_id
+			JOIN email_accounts acc ON acc.id = e.account_id
+			WHERE COALESCE(a.storage_key, '') <> ''
+			GROUP BY acc.user_id
+		)
+		SELECT u.id, u.email, u.name, u.storage_used, u.storage_limit,
+		       COALESCE(f.files, 0), COALESCE(f.trash, 0),
+		       COALESCE(v.versions, 0), COALESCE(a.attachments, 0)
+		FROM users u
+		LEFT JOIN file_totals f ON f.owner_id = u.id
+		LEFT JOIN version_totals v ON v.owner_id = u.id
+		LEFT JOIN attachment_totals a ON a.user_id = u.id
+		ORDER BY COALESCE(f.files, 0) + COALESCE(f.trash, 0) + COALESCE(v.versions, 0) + COALESCE(a.attachments, 0) DESC, u.email
+		LIMIT $1
+	`
+
+	rows, err := r.db.Query(ctx, query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	consumers := make([]*StorageConsumer, 0)
+	for rows.Next() {
+		c := &StorageConsumer{}
+		if err := rows.Scan(&c.UserID, &c.Email, &c.Name, &c.StorageUsed, &c.StorageQuota,
+			&c.Files, &c.Trash, &c.Versions, &c.Attachments); err != nil {
+			return nil, err
+		}
+		consumers = append(consumers, c)
+	}
+	return consumers, rows.Err()
+}
+
+// GetTrashRetention returns how many days the user's trash is kept, or nil
+// when the system setting applies
+func (r *UserRepository) GetTrashRetention(ctx context.Context, userID uuid.UUID) (*int, error) {
+	var days *int
+	err := r.db.QueryRow(ctx, `SELECT trash_retention_days FROM users WHERE id = $1`, userID).Scan(&days)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	return days, err
+}
+
+// SetTrashRetention overrides how many days the user's trash is kept; nil
+// returns them to the system setting
+func (r *UserRepository) SetTrashRetention(ctx context.Context, userID uuid.UUID, days *int) error {
+	_, err := r.db.Exec(ctx, `UPDATE users SET trash_retention_days = $2, updated_at = $3 WHERE id = $1`, userID, days, time.Now())
 	return err
 }
 
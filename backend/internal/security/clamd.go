@@ -0,0 +1,197 @@
+package security
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// clamdChunkSize is how much content is sent to clamd at a time
+const clamdChunkSize = 64 * 1024
+
+// ErrScanTooLarge is returned when content is larger than clamd accepts
+// (its StreamMaxLength)
+var ErrScanTooLarge = errors.New("content too large to scan")
+
+// ScanResult is what a virus scan found
+type ScanResult struct {
+	Infected bool
+	Virus    string // the signature found, when infected
+}
+
+// Clamd scans content for malware with a clamd daemon, over its INSTREAM
+// protocol. Each scan uses a connection of its own.
+type Clamd struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// NewClamd creates a clamd client. address is "tcp://host:port",
+// "unix:///path/to/clamd.sock", or a bare host:port or socket path. timeout
+// is how long clamd may go without answering.
+func NewClamd(address string, timeout time.Duration) (*Clamd, error) {
+	c := &Clamd{timeout: timeout}
+	switch {
+	case strings.HasPrefix(address, "tcp://"):
+		c.network, c.address = "tcp", strings.TrimPrefix(address, "tcp://")
+	case strings.HasPrefix(address, "unix://"):
+		c.network, c.address = "unix", strings.TrimPrefix(address, "unix://")
+	case strings.HasPrefix(address, "/"):
+		c.network, c.address = "unix", address
+	default:
+		c.network, c.address = "tcp", address
+	}
+	if c.address == "" {
+		return nil, fmt.Errorf("invalid clamd address %q", address)
+	}
+	if c.timeout <= 0 {
+		c.timeout = time.Minute
+	}
+	return c, nil
+}
+
+// Ping checks clamd is reachable
+func (c *Clamd) Ping(ctx context.Context) error {
+	reply, err := c.command(ctx, "PING")
+	if err != nil {
+		return err
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("unexpected clamd reply %q", reply)
+	}
+	return nil
+}
+
+// Version returns the version of clamd and of its signature database
+func (c *Clamd) Version(ctx context.Context) (string, error) {
+	return c.command(ctx, "VERSION")
+}
+
+// Scan streams content to clamd and returns what it found. It returns
+// ErrScanTooLarge when the content is larger than clamd accepts.
+func (c *Clamd) Scan(ctx context.Context, r io.Reader) (*ScanResult, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// clamd stops reading once content passes its limit and answers
+	// straight away, so a failed write may still be followed by a reply
+	writeErr := c.stream(conn, r)
+	reply, err := c.readReply(conn)
+	if err != nil {
+		if writeErr != nil {
+			return nil, writeErr
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return parseScanReply(reply)
+}
+
+// stream sends content as INSTREAM chunks, each prefixed with its length,
+// ending with an empty chunk
+func (c *Clamd) stream(conn net.Conn, r io.Reader) error {
+	w := bufio.NewWriterSize(conn, clamdChunkSize+4)
+	if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+		return err
+	}
+	buf := make([]byte, clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			conn.SetDeadline(time.Now().Add(c.timeout))
+			if err := binary.Write(w, binary.BigEndian, uint32(n)); err != nil {
+				return err
+			}
+			if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read content: %w", err)
+		}
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(0)); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// command sends a command without arguments and returns its reply
+func (c *Clamd) command(ctx context.Context, name string) (string, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("z" + name + "\x00")); err != nil {
+		return "", err
+	}
+	return c.readReply(conn)
+}
+
+// dial connects to clamd. The connection is closed when ctx ends, which
+// interrupts a scan in progress.
+func (c *Clamd) dial(ctx context.Context) (net.Conn, error) {
+	d := net.Dialer{Timeout: c.timeout}
+	conn, err := d.DialContext(ctx, c.network, c.address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	return &clamdConn{Conn: conn, stop: stop}, nil
+}
+
+// readReply reads a reply, which ends with a NUL with the z prefix
+func (c *Clamd) readReply(conn net.Conn) (string, error) {
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && (err != io.EOF || reply == "") {
+		return "", fmt.Errorf("failed to read clamd reply: %w", err)
+	}
+	return strings.TrimSpace(strings.TrimRight(reply, "\x00")), nil
+}
+
+// parseScanReply reads the reply to INSTREAM: "stream: OK", "stream: <virus>
+// FOUND" or "<message> ERROR"
+func parseScanReply(reply string) (*ScanResult, error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case reply == "OK":
+		return &ScanResult{}, nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return &ScanResult{Infected: true, Virus: strings.TrimSuffix(reply, " FOUND")}, nil
+	case strings.Contains(reply, "size limit exceeded"):
+		return nil, ErrScanTooLarge
+	case strings.HasSuffix(reply, " ERROR"):
+		return nil, fmt.Errorf("clamd: %s", strings.TrimSuffix(reply, " ERROR"))
+	}
+	return nil, fmt.Errorf("unexpected clamd reply %q", reply)
+}
+
+// clamdConn stops watching its context once closed
+type clamdConn struct {
+	net.Conn
+	stop func() bool
+}
+
+func (c *clamdConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
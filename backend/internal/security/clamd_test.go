@@ -0,0 +1,186 @@
+package security
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// eicar is the standard antivirus test file
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd is a stand-in for clamd speaking enough of its protocol for the
+// client: PING, VERSION and INSTREAM, flagging content containing eicar
+type fakeClamd struct {
+	addr      string
+	maxStream int
+	received  chan []byte
+}
+
+func newFakeClamd(t *testing.T, maxStream int) *fakeClamd {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	f := &fakeClamd{addr: ln.Addr().String(), maxStream: maxStream, received: make(chan []byte, 10)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeClamd) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	cmd, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+	switch cmd {
+	case "zPING\x00":
+		conn.Write([]byte("PONG\x00"))
+	case "zVERSION\x00":
+		conn.Write([]byte("ClamAV 1.4.1/27400/Mon Oct 12 08:00:00 2026\x00"))
+	case "zINSTREAM\x00":
+		var content []byte
+		for {
+			var size uint32
+			if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+				return
+			}
+			if size == 0 {
+				break
+			}
+			if len(content)+int(size) > f.maxStream {
+				conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+				return
+			}
+			chunk := make([]byte, size)
+			if _, err := io.ReadFull(r, chunk); err != nil {
+				return
+			}
+			content = append(content, chunk...)
+		}
+		f.received <- content
+		if bytes.Contains(content, []byte(eicar)) {
+			conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+		} else {
+			conn.Write([]byte("stream: OK\x00"))
+		}
+	default:
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+	}
+}
+
+func TestClamd(t *testing.T) {
+	ctx := context.Background()
+	fake := newFakeClamd(t, 1<<20)
+	clamd, err := NewClamd("tcp://"+fake.addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := clamd.Ping(ctx); err != nil {
+		t.Errorf("Ping() error = %v", err)
+	}
+	if version, err := clamd.Version(ctx); err != nil || !strings.HasPrefix(version, "ClamAV 1.4.1/") {
+		t.Errorf("Version() = %q, %v", version, err)
+	}
+
+	// Content spanning several chunks arrives whole
+	content := bytes.Repeat([]byte("tessera "), 3*clamdChunkSize/8+100)
+	result, err := clamd.Scan(ctx, bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Infected {
+		t.Errorf("Scan() of clean content = %+v", result)
+	}
+	if got := <-fake.received; !bytes.Equal(got, content) {
+		t.Errorf("clamd received %d bytes, want %d", len(got), len(content))
+	}
+
+	result, err = clamd.Scan(ctx, strings.NewReader("prefix "+eicar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Infected || result.Virus != "Eicar-Test-Signature" {
+		t.Errorf("Scan() of eicar = %+v", result)
+	}
+	<-fake.received
+
+	// Empty content is a valid stream
+	if result, err := clamd.Scan(ctx, strings.NewReader("")); err != nil || result.Infected {
+		t.Errorf("Scan() of nothing = %+v, %v", result, err)
+	}
+}
+
+func TestClamdTooLarge(t *testing.T) {
+	fake := newFakeClamd(t, 100*1024)
+	clamd, _ := NewClamd(fake.addr, 5*time.Second)
+
+	_, err := clamd.Scan(context.Background(), bytes.NewReader(make([]byte, 4<<20)))
+	if !errors.Is(err, ErrScanTooLarge) {
+		t.Errorf("Scan() of too much error = %v, want ErrScanTooLarge", err)
+	}
+}
+
+func TestClamdUnreachable(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+
+	clamd, _ := NewClamd(addr, time.Second)
+	if _, err := clamd.Scan(context.Background(), strings.NewReader("x")); err == nil {
+		t.Error("Scan() without clamd succeeded")
+	}
+}
+
+func TestNewClamd(t *testing.T) {
+	tests := []struct {
+		address, network, addr string
+	}{
+		{"tcp://clamav:3310", "tcp", "clamav:3310"},
+		{"clamav:3310", "tcp", "clamav:3310"},
+		{"unix:///run/clamav/clamd.ctl", "unix", "/run/clamav/clamd.ctl"},
+		{"/run/clamav/clamd.ctl", "unix", "/run/clamav/clamd.ctl"},
+	}
+	for _, tt := range tests {
+		c, err := NewClamd(tt.address, 0)
+		if err != nil {
+			t.Errorf("NewClamd(%q) error = %v", tt.address, err)
+			continue
+		}
+		if c.network != tt.network || c.address != tt.addr {
+			t.Errorf("NewClamd(%q) = %s %s, want %s %s", tt.address, c.network, c.address, tt.network, tt.addr)
+		}
+	}
+	if _, err := NewClamd("tcp://", 0); err == nil {
+		t.Error("NewClamd() of an empty address succeeded")
+	}
+}
+
+func TestParseScanReply(t *testing.T) {
+	if _, err := parseScanReply("stream: Can't allocate memory ERROR"); err == nil || errors.Is(err, ErrScanTooLarge) {
+		t.Errorf("parseScanReply() of an error = %v", err)
+	}
+	if _, err := parseScanReply("something else"); err == nil {
+		t.Error("parseScanReply() of an unknown reply succeeded")
+	}
+}
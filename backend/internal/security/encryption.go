@@ -6,8 +6,8 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
-	"io"
 
 	"golang.org/x/crypto/pbkdf2"
 )
@@ -18,16 +18,41 @@ const (
 	pbkdf2Iter = 100000
 )
 
-// ErrInvalidCiphertext is returned when the ciphertext is invalid
-var ErrInvalidCiphertext = errors.New("invalid ciphertext")
+var (
+	// ErrInvalidCiphertext is returned when the ciphertext is invalid
+	ErrInvalidCiphertext = errors.New("invalid ciphertext")
+	// ErrUnknownMasterKey is returned when data was encrypted with a master
+	// key that isn't configured
+	ErrUnknownMasterKey = errors.New("encrypted with an unknown master key")
+)
 
 // Encryptor handles file encryption and decryption
 type Encryptor struct {
 	masterKey []byte
+	// previous are master keys being rotated out; data encrypted with them
+	// can still be decrypted
+	previous [][]byte
+}
+
+// NewEncryptor creates a new encryptor with the given master key and any
+// previous master keys still needed to decrypt older data
+func NewEncryptor(masterKeyBase64 string, previousBase64 ...string) (*Encryptor, error) {
+	key, err := decodeMasterKey(masterKeyBase64)
+	if err != nil {
+		return nil, err
+	}
+	e := &Encryptor{masterKey: key}
+	for _, p := range previousBase64 {
+		old, err := decodeMasterKey(p)
+		if err != nil {
+			return nil, err
+		}
+		e.previous = append(e.previous, old)
+	}
+	return e, nil
 }
 
-// NewEncryptor creates a new encryptor with the given master key
-func NewEncryptor(masterKeyBase64 string) (*Encryptor, error) {
+func decodeMasterKey(masterKeyBase64 string) ([]byte, error) {
 	key, err := base64.StdEncoding.DecodeString(masterKeyBase64)
 	if err != nil {
 		return nil, err
@@ -35,7 +60,7 @@ func NewEncryptor(masterKeyBase64 string) (*Encryptor, error) {
 	if len(key) != keyLen {
 		return nil, errors.New("master key must be 32 bytes (base64 encoded)")
 	}
-	return &Encryptor{masterKey: key}, nil
+	return key, nil
 }
 
 // GenerateMasterKey generates a new random master key
@@ -49,7 +74,22 @@ func GenerateMasterKey() (string, error) {
 
 // DeriveKey derives an encryption key from the master key and a salt
 func (e *Encryptor) DeriveKey(salt []byte) []byte {
-	return pbkdf2.Key(e.masterKey, salt, pbkdf2Iter, keyLen, sha256.New)
+	return deriveKey(e.masterKey, salt)
+}
+
+func deriveKey(masterKey, salt []byte) []byte {
+	return pbkdf2.Key(masterKey, salt, pbkdf2Iter, keyLen, sha256.New)
+}
+
+// KeyID identifies the master key, so wrapped data keys can record which
+// one wrapped them
+func (e *Encryptor) KeyID() string {
+	return masterKeyID(e.masterKey)
+}
+
+func masterKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
 }
 
 // Encrypt encrypts data using AES-256-GCM
@@ -92,8 +132,35 @@ func (e *Encryptor) Encrypt(plaintext []byte) ([]byte, error) {
 	return result, nil
 }
 
-// Decrypt decrypts data encrypted with Encrypt
+// Decrypt decrypts data encrypted with Encrypt, by the master key or one
+// of the previous ones
 func (e *Encryptor) Decrypt(data []byte) ([]byte, error) {
+	plaintext, err := decrypt(e.masterKey, data)
+	for _, old := range e.previous {
+		if err == nil || errors.Is(err, ErrInvalidCiphertext) {
+			break
+		}
+		plaintext, err = decrypt(old, data)
+	}
+	return plaintext, err
+}
+
+// Reencrypt re-encrypts data encrypted with a previous master key with the
+// current one. It reports false, returning data unchanged, if the current
+// key encrypted it already.
+func (e *Encryptor) Reencrypt(data []byte) ([]byte, bool, error) {
+	if _, err := decrypt(e.masterKey, data); err == nil {
+		return data, false, nil
+	}
+	plaintext, err := e.Decrypt(data)
+	if err != nil {
+		return nil, false, err
+	}
+	encrypted, err := e.Encrypt(plaintext)
+	return encrypted, err == nil, err
+}
+
+func decrypt(masterKey, data []byte) ([]byte, error) {
 	// Check minimum length (salt + nonce + at least 1 byte)
 	if len(data) < saltLen+12+1 {
 		return nil, ErrInvalidCiphertext
@@ -103,7 +170,7 @@ func (e *Encryptor) Decrypt(data []byte) ([]byte, error) {
 	salt := data[:saltLen]
 
 	// Derive key
-	key := e.DeriveKey(salt)
+	key := deriveKey(masterKey, salt)
 
 	// Create cipher
 	block, err := aes.NewCipher(key)
@@ -134,25 +201,55 @@ func (e *Encryptor) Decrypt(data []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
-// EncryptReader wraps a reader and encrypts data as it's read
-type EncryptReader struct {
-	reader    io.Reader
-	encryptor *Encryptor
-	buffer    []byte
+// GenerateDataKey generates a new random key for encrypting stored objects
+func GenerateDataKey() ([]byte, error) {
+	key := make([]byte, keyLen)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
 }
 
-// NewEncryptReader creates a new encrypting reader
-func (e *Encryptor) NewEncryptReader(r io.Reader) *EncryptReader {
-	return &EncryptReader{
-		reader:    r,
-		encryptor: e,
+// WrapKey encrypts a data key with the master key. Both are random, so no
+// key derivation is needed, unlike Encrypt.
+func (e *Encryptor) WrapKey(dataKey []byte) ([]byte, error) {
+	gcm, err := newGCM(e.masterKey)
+	if err != nil {
+		return nil, err
 	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, dataKey, nil), nil
+}
+
+// UnwrapKey decrypts a data key wrapped by the master key with the given ID,
+// which may be the current one or a previous one
+func (e *Encryptor) UnwrapKey(wrapped []byte, keyID string) ([]byte, error) {
+	for _, key := range append([][]byte{e.masterKey}, e.previous...) {
+		if masterKeyID(key) != keyID {
+			continue
+		}
+		gcm, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		if len(wrapped) < gcm.NonceSize()+gcm.Overhead() {
+			return nil, ErrInvalidCiphertext
+		}
+		nonce, ciphertext := wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():]
+		return gcm.Open(nil, nonce, ciphertext, nil)
+	}
+	return nil, ErrUnknownMasterKey
 }
 
-// Read reads and encrypts data
-// Note: For large files, consider chunked encryption instead
-func (er *EncryptReader) Read(p []byte) (n int, err error) {
-	return er.reader.Read(p)
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
 }
 
 // HashPassword creates a secure hash of a password
@@ -208,6 +208,51 @@ func TestEncryptor_DecryptErrors(t *testing.T) {
 	})
 }
 
+func TestEncryptor_Rotation(t *testing.T) {
+	oldKey, _ := GenerateMasterKey()
+	newKey, _ := GenerateMasterKey()
+	old, _ := NewEncryptor(oldKey)
+	rotated, err := NewEncryptor(newKey, oldKey)
+	if err != nil {
+		t.Fatalf("NewEncryptor() error = %v", err)
+	}
+
+	t.Run("decrypts data from the previous key", func(t *testing.T) {
+		ciphertext, _ := old.Encrypt([]byte("secret"))
+		plaintext, err := rotated.Decrypt(ciphertext)
+		if err != nil || string(plaintext) != "secret" {
+			t.Fatalf("Decrypt() = %q, %v", plaintext, err)
+		}
+
+		reencrypted, changed, err := rotated.Reencrypt(ciphertext)
+		if err != nil || !changed {
+			t.Fatalf("Reencrypt() changed = %v, error = %v", changed, err)
+		}
+		current, _ := NewEncryptor(newKey)
+		if plaintext, err := current.Decrypt(reencrypted); err != nil || string(plaintext) != "secret" {
+			t.Errorf("re-encrypted data doesn't decrypt with the new key alone: %q, %v", plaintext, err)
+		}
+		if _, changed, _ := rotated.Reencrypt(reencrypted); changed {
+			t.Error("Reencrypt() changed data already encrypted with the current key")
+		}
+	})
+
+	t.Run("unwraps data keys from the previous key", func(t *testing.T) {
+		dataKey, _ := GenerateDataKey()
+		wrapped, err := old.WrapKey(dataKey)
+		if err != nil {
+			t.Fatalf("WrapKey() error = %v", err)
+		}
+		got, err := rotated.UnwrapKey(wrapped, old.KeyID())
+		if err != nil || !bytes.Equal(got, dataKey) {
+			t.Errorf("UnwrapKey() = %x, %v; want %x", got, err, dataKey)
+		}
+		if _, err := old.UnwrapKey(wrapped, rotated.KeyID()); err != ErrUnknownMasterKey {
+			t.Errorf("UnwrapKey() with unknown master key error = %v, want ErrUnknownMasterKey", err)
+		}
+	})
+}
+
 func TestHashPassword(t *testing.T) {
 	t.Run("creates hash", func(t *testing.T) {
 		hash, err := HashPassword("mypassword123")
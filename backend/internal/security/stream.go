@@ -0,0 +1,267 @@
+package security
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/google/uuid"
+)
+
+// Encrypted objects start with a header naming the data key, followed by
+// the content in chunks of StreamChunkSize bytes, each sealed with
+// AES-256-GCM on its own. Any chunk can be decrypted without the ones before
+// it, so ranges of an object can be read without reading it all.
+//
+// A chunk's nonce is the header's random prefix and the chunk's index. Its
+// additional data is the header and whether it is the last chunk, so chunks
+// can't be reordered, moved between objects, or dropped from the end.
+const (
+	// StreamChunkSize is the plaintext size of every chunk but the last
+	StreamChunkSize = 64 * 1024
+	// StreamHeaderSize is the size of the header of an encrypted object
+	StreamHeaderSize = len(streamMagic) + 16 + streamPrefixLen
+
+	streamPrefixLen = 8
+	streamTagSize   = 16
+	streamChunkOut  = StreamChunkSize + streamTagSize
+)
+
+// streamMagic marks an encrypted object; its last byte is the format version
+const streamMagic = "TSE\x01"
+
+// ErrStreamCorrupt is returned when an encrypted object fails to decrypt:
+// it was changed, truncated or extended since it was written
+var ErrStreamCorrupt = errors.New("encrypted content is corrupt")
+
+// StreamHeader starts an encrypted object
+type StreamHeader struct {
+	KeyID  uuid.UUID // the data key the object is encrypted with
+	prefix [streamPrefixLen]byte
+}
+
+// NewStreamHeader returns the header for a new object encrypted with the
+// given data key
+func NewStreamHeader(keyID uuid.UUID) (*StreamHeader, error) {
+	h := &StreamHeader{KeyID: keyID}
+	if _, err := rand.Read(h.prefix[:]); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// ParseStreamHeader parses the first StreamHeaderSize bytes of an object. It
+// reports false if they aren't the header of an encrypted object.
+func ParseStreamHeader(b []byte) (*StreamHeader, bool) {
+	if len(b) < StreamHeaderSize || !bytes.HasPrefix(b, []byte(streamMagic)) {
+		return nil, false
+	}
+	h := &StreamHeader{}
+	b = b[len(streamMagic):]
+	copy(h.KeyID[:], b[:16])
+	copy(h.prefix[:], b[16:StreamHeaderSize-len(streamMagic)])
+	return h, true
+}
+
+// Bytes returns the header as stored
+func (h *StreamHeader) Bytes() []byte {
+	b := make([]byte, 0, StreamHeaderSize)
+	b = append(b, streamMagic...)
+	b = append(b, h.KeyID[:]...)
+	return append(b, h.prefix[:]...)
+}
+
+// nonce returns the nonce of a chunk
+func (h *StreamHeader) nonce(chunk int64) []byte {
+	nonce := make([]byte, streamPrefixLen+4)
+	copy(nonce, h.prefix[:])
+	binary.BigEndian.PutUint32(nonce[streamPrefixLen:], uint32(chunk))
+	return nonce
+}
+
+// additionalData returns the additional data of a chunk
+func (h *StreamHeader) additionalData(last bool) []byte {
+	ad := append(h.Bytes(), 0)
+	if last {
+		ad[len(ad)-1] = 1
+	}
+	return ad
+}
+
+// EncryptedSize returns the size of the encrypted object for plaintext of
+// the given size. Empty plaintext still has one (empty) chunk.
+func EncryptedSize(size int64) int64 {
+	chunks := max((size+StreamChunkSize-1)/StreamChunkSize, 1)
+	return int64(StreamHeaderSize) + size + chunks*streamTagSize
+}
+
+// PlaintextSize returns the size of the plaintext of an encrypted object of
+// the given size
+func PlaintextSize(size int64) int64 {
+	sealed := size - int64(StreamHeaderSize)
+	chunks := (sealed + streamChunkOut - 1) / streamChunkOut
+	return max(sealed-chunks*streamTagSize, 0)
+}
+
+// ChunkOffset returns where a chunk starts in an encrypted object
+func ChunkOffset(chunk int64) int64 {
+	return int64(StreamHeaderSize) + chunk*streamChunkOut
+}
+
+// EncryptReader wraps a reader and encrypts data as it's read, producing
+// the header and then the sealed chunks
+type EncryptReader struct {
+	src    *bufio.Reader
+	aead   cipher.AEAD
+	header *StreamHeader
+	chunk  int64
+	in     []byte
+	sealed []byte
+	out    []byte // sealed data not read yet
+	done   bool
+}
+
+// NewEncryptReader creates a new encrypting reader with the given data key
+func NewEncryptReader(r io.Reader, key []byte, header *StreamHeader) (*EncryptReader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptReader{
+		src:    bufio.NewReaderSize(r, StreamChunkSize),
+		aead:   aead,
+		header: header,
+		in:     make([]byte, StreamChunkSize),
+		sealed: make([]byte, 0, streamChunkOut),
+		out:    header.Bytes(),
+	}, nil
+}
+
+// Read reads and encrypts data
+func (er *EncryptReader) Read(p []byte) (int, error) {
+	for len(er.out) == 0 {
+		if er.done {
+			return 0, io.EOF
+		}
+		if err := er.seal(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, er.out)
+	er.out = er.out[n:]
+	return n, nil
+}
+
+// seal reads and seals the next chunk. A full chunk is the last one if
+// nothing follows it, so the last chunk is only empty for empty content.
+func (er *EncryptReader) seal() error {
+	n, err := io.ReadFull(er.src, er.in)
+	last := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		if _, err := er.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	er.out = er.aead.Seal(er.sealed[:0], er.header.nonce(er.chunk), er.in[:n], er.header.additionalData(last))
+	er.chunk++
+	er.done = last
+	return nil
+}
+
+// DecryptReader decrypts an encrypted object as it's read
+type DecryptReader struct {
+	src     *bufio.Reader
+	aead    cipher.AEAD
+	header  *StreamHeader
+	chunk   int64
+	partial bool
+	in      []byte
+	plain   []byte
+	out     []byte // plaintext not read yet
+	done    bool
+}
+
+// NewDecryptReader creates a reader decrypting chunks read from r with the
+// given data key, starting at chunk first. r holds the chunks only, without
+// the header. With partial set, r may stop before the last chunk, as when
+// reading a range of an object.
+func NewDecryptReader(r io.Reader, key []byte, header *StreamHeader, first int64, partial bool) (*DecryptReader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &DecryptReader{
+		src:     bufio.NewReaderSize(r, streamChunkOut),
+		aead:    aead,
+		header:  header,
+		chunk:   first,
+		partial: partial,
+		in:      make([]byte, streamChunkOut),
+		plain:   make([]byte, 0, StreamChunkSize),
+	}, nil
+}
+
+// Read reads and decrypts data
+func (dr *DecryptReader) Read(p []byte) (int, error) {
+	for len(dr.out) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		if err := dr.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.out)
+	dr.out = dr.out[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk
+func (dr *DecryptReader) open() error {
+	n, err := io.ReadFull(dr.src, dr.in)
+	switch {
+	case err == io.EOF && dr.partial:
+		dr.done = true // a range may end between chunks
+		return nil
+	case err == io.EOF:
+		return ErrStreamCorrupt // the last chunk is missing
+	case err != nil && err != io.ErrUnexpectedEOF:
+		return err
+	}
+
+	// A chunk is the last if nothing follows it
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		if _, err := dr.src.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	sealed, nonce := dr.in[:n], dr.header.nonce(dr.chunk)
+	plaintext, err := dr.aead.Open(dr.plain[:0], nonce, sealed, dr.header.additionalData(last))
+	if err != nil && last && dr.partial {
+		// A range may also end on a chunk before the last
+		plaintext, err = dr.aead.Open(dr.plain[:0], nonce, sealed, dr.header.additionalData(false))
+	}
+	if err != nil {
+		return ErrStreamCorrupt
+	}
+	dr.out = plaintext
+	dr.chunk++
+	dr.done = last
+	return nil
+}
@@ -0,0 +1,135 @@
+package security
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func encryptStream(t *testing.T, key, plaintext []byte) (*StreamHeader, []byte) {
+	header, err := NewStreamHeader(uuid.New())
+	if err != nil {
+		t.Fatalf("NewStreamHeader() error = %v", err)
+	}
+	er, err := NewEncryptReader(bytes.NewReader(plaintext), key, header)
+	if err != nil {
+		t.Fatalf("NewEncryptReader() error = %v", err)
+	}
+	sealed, err := io.ReadAll(er)
+	if err != nil {
+		t.Fatalf("encrypt error = %v", err)
+	}
+	return header, sealed
+}
+
+func decryptStream(key, sealed []byte, first int64, partial bool) ([]byte, error) {
+	header, ok := ParseStreamHeader(sealed)
+	if !ok {
+		return nil, errors.New("no header")
+	}
+	dr, err := NewDecryptReader(bytes.NewReader(sealed[ChunkOffset(first):]), key, header, first, partial)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(dr)
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key, _ := GenerateDataKey()
+	for _, size := range []int{0, 1, StreamChunkSize - 1, StreamChunkSize, StreamChunkSize + 1, 3*StreamChunkSize + 100} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+
+		header, sealed := encryptStream(t, key, plaintext)
+		if got := int64(len(sealed)); got != EncryptedSize(int64(size)) {
+			t.Errorf("size %d: encrypted to %d bytes, EncryptedSize = %d", size, got, EncryptedSize(int64(size)))
+		}
+		if got := PlaintextSize(int64(len(sealed))); got != int64(size) {
+			t.Errorf("size %d: PlaintextSize = %d", size, got)
+		}
+		if parsed, ok := ParseStreamHeader(sealed); !ok || parsed.KeyID != header.KeyID {
+			t.Errorf("size %d: header not parsed back", size)
+		}
+
+		got, err := decryptStream(key, sealed, 0, false)
+		if err != nil {
+			t.Fatalf("size %d: decrypt error = %v", size, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("size %d: decrypted content differs", size)
+		}
+	}
+}
+
+func TestStreamRanges(t *testing.T) {
+	key, _ := GenerateDataKey()
+	plaintext := make([]byte, 3*StreamChunkSize+100)
+	rand.Read(plaintext)
+	_, sealed := encryptStream(t, key, plaintext)
+
+	// The second chunk alone, as a range ending before the last chunk
+	end := ChunkOffset(2)
+	header, _ := ParseStreamHeader(sealed)
+	dr, _ := NewDecryptReader(bytes.NewReader(sealed[ChunkOffset(1):end]), key, header, 1, true)
+	got, err := io.ReadAll(dr)
+	if err != nil {
+		t.Fatalf("range decrypt error = %v", err)
+	}
+	if !bytes.Equal(got, plaintext[StreamChunkSize:2*StreamChunkSize]) {
+		t.Error("range decrypted to the wrong content")
+	}
+
+	// From the third chunk to the end
+	got, err = decryptStream(key, sealed, 2, true)
+	if err != nil {
+		t.Fatalf("tail decrypt error = %v", err)
+	}
+	if !bytes.Equal(got, plaintext[2*StreamChunkSize:]) {
+		t.Error("tail decrypted to the wrong content")
+	}
+}
+
+func TestStreamTampering(t *testing.T) {
+	key, _ := GenerateDataKey()
+	plaintext := make([]byte, 2*StreamChunkSize+10)
+	rand.Read(plaintext)
+	_, sealed := encryptStream(t, key, plaintext)
+
+	tests := []struct {
+		name   string
+		sealed []byte
+	}{
+		{"flipped byte", func() []byte {
+			b := bytes.Clone(sealed)
+			b[StreamHeaderSize+5] ^= 1
+			return b
+		}()},
+		{"last chunk dropped", sealed[:ChunkOffset(2)]},
+		{"truncated", sealed[:len(sealed)-1]},
+		{"extended", append(bytes.Clone(sealed), sealed[StreamHeaderSize:ChunkOffset(1)]...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decryptStream(key, tt.sealed, 0, false); !errors.Is(err, ErrStreamCorrupt) {
+				t.Errorf("decrypt error = %v, want ErrStreamCorrupt", err)
+			}
+		})
+	}
+
+	otherKey, _ := GenerateDataKey()
+	if _, err := decryptStream(otherKey, sealed, 0, false); !errors.Is(err, ErrStreamCorrupt) {
+		t.Errorf("wrong key: error = %v, want ErrStreamCorrupt", err)
+	}
+}
+
+func TestParseStreamHeaderPlaintext(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("TSE"), bytes.Repeat([]byte("x"), StreamHeaderSize+10)} {
+		if _, ok := ParseStreamHeader(data); ok {
+			t.Errorf("ParseStreamHeader(%q) parsed plaintext as a header", data)
+		}
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"github.com/rs/zerolog"
 
 	"github.com/tessera/tessera/internal/config"
+	"github.com/tessera/tessera/internal/dav"
 	"github.com/tessera/tessera/internal/handlers"
 	"github.com/tessera/tessera/internal/jobs"
 	"github.com/tessera/tessera/internal/middleware"
@@ -30,13 +31,22 @@ import (
 	ws "github.com/tessera/tessera/internal/websocket"
 )
 
+// requestMethods extends Fiber's defaults with the WebDAV and CalDAV verbs;
+// Fiber rejects any method not listed here before routing.
+var requestMethods = []string{
+	fiber.MethodGet, fiber.MethodHead, fiber.MethodPost, fiber.MethodPut,
+	fiber.MethodDelete, fiber.MethodConnect, fiber.MethodOptions, fiber.MethodTrace,
+	fiber.MethodPatch,
+	"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK", "REPORT",
+}
+
 // Server represents the HTTP server
 type Server struct {
 	app       *fiber.App
 	cfg       *config.Config
 	db        *pgxpool.Pool
 	rdb       *redis.Client
-	store     *storage.MinIOStorage
+	store     storage.Backend
 	log       zerolog.Logger
 	hub       *ws.Hub
 	jobWorker *jobs.Worker
@@ -44,7 +54,7 @@ type Server struct {
 }
 
 // New creates a new server instance
-func New(cfg *config.Config, db *pgxpool.Pool, rdb *redis.Client, store *storage.MinIOStorage, log zerolog.Logger) *Server {
+func New(cfg *config.Config, db *pgxpool.Pool, rdb *redis.Client, store storage.Backend, log zerolog.Logger) *Server {
 	app := fiber.New(fiber.Config{
 		AppName:               "Tessera API",
 		ReadTimeout:           10 * time.Minute,
@@ -54,23 +64,18 @@ func New(cfg *config.Config, db *pgxpool.Pool, rdb *redis.Client, store *storage
 		DisableStartupMessage: false,
 		StreamRequestBody:     true,
 		ErrorHandler:          customErrorHandler,
+		RequestMethods:        requestMethods,
 	})
 
 	// Create WebSocket hub
 	hub := ws.NewHub(log)
 	go hub.Run()
 
-	// Create job queue and worker
-	jobQueue := jobs.NewMemoryQueue(1000)
+	// Create job queue and worker. The queue lives in Redis so jobs survive
+	// restarts and are shared between replicas.
+	jobQueue := jobs.NewRedisQueue(rdb)
 	jobWorker := jobs.NewWorker(jobQueue, 4)
 
-	// Register job handlers
-	jobWorker.RegisterHandler(jobs.JobTypeThumbnail, jobs.NewThumbnailHandler())
-	jobWorker.RegisterHandler(jobs.JobTypeCleanup, jobs.NewCleanupHandler())
-	jobWorker.RegisterHandler(jobs.JobTypeNotification, jobs.NewNotificationHandler())
-	jobWorker.RegisterHandler(jobs.JobTypeQuotaCheck, jobs.NewQuotaCheckHandler())
-	jobWorker.RegisterHandler(jobs.JobTypeVersionCleanup, jobs.NewVersionCleanupHandler())
-
 	// Create scheduler for recurring jobs
 	scheduler := jobs.NewScheduler(jobWorker)
 
@@ -123,14 +128,19 @@ func (s *Server) setupMiddleware() {
 	// CORS
 	s.app.Use(cors.New(cors.Config{
 		AllowOrigins:     s.cfg.Server.FrontendURL,
-		AllowMethods:     "GET,POST,PUT,PATCH,DELETE,OPTIONS",
-		AllowHeaders:     "Origin,Content-Type,Accept,Authorization,X-Request-ID",
+		AllowMethods:     "GET,HEAD,POST,PUT,PATCH,DELETE,OPTIONS",
+		AllowHeaders:     "Origin,Content-Type,Accept,Authorization,X-Request-ID,Tus-Resumable,Upload-Length,Upload-Offset,Upload-Metadata,Upload-Checksum,Upload-Defer-Length",
+		ExposeHeaders:    "Location,Tus-Resumable,Tus-Version,Tus-Extension,Tus-Max-Size,Tus-Checksum-Algorithm,Upload-Offset,Upload-Length,Upload-Metadata,Upload-Expires",
 		AllowCredentials: true,
 		MaxAge:           300,
 	}))
 
-	// Rate limiting
+	// Rate limiting. Signed storage URLs are left out: ffmpeg makes a request
+	// per seek when reading a video for a thumbnail.
 	s.app.Use(limiter.New(limiter.Config{
+		Next: func(c *fiber.Ctx) bool {
+			return c.Path() == storage.SignedURLPath
+		},
 		Max:               100,
 		Expiration:        1 * time.Minute,
 		LimiterMiddleware: limiter.SlidingWindow{},
@@ -150,6 +160,7 @@ func (s *Server) setupRoutes() {
 	userRepo := repository.NewUserRepository(s.db)
 	fileRepo := repository.NewFileRepository(s.db)
 	sessionRepo := repository.NewSessionRepository(s.rdb)
+	uploadRepo := repository.NewUploadRepository(s.rdb)
 	activityRepo := repository.NewActivityRepository(s.db)
 	settingsRepo := repository.NewSettingsRepository(s.db)
 	emailRepo := repository.NewEmailRepository(s.db)
@@ -157,12 +168,15 @@ func (s *Server) setupRoutes() {
 	calendarRepo := repository.NewCalendarRepository(s.db)
 	contactRepo := repository.NewContactRepository(s.db)
 	documentRepo := repository.NewDocumentRepository(s.db)
+	davRepo := repository.NewDAVRepository(s.db)
+	lockRepo := repository.NewLockRepository(s.rdb)
+	changeRepo := repository.NewChangeRepository(s.db)
 
 	// Initialize encryptor for sensitive data (email passwords, etc.)
 	var encryptor *security.Encryptor
 	if s.cfg.Encryption.MasterKey != "" {
 		var err error
-		encryptor, err = security.NewEncryptor(s.cfg.Encryption.MasterKey)
+		encryptor, err = security.NewEncryptor(s.cfg.Encryption.MasterKey, s.cfg.Encryption.PreviousKeys...)
 		if err != nil {
 			s.log.Warn().Err(err).Msg("Failed to initialize encryptor - email passwords will not be encrypted")
 		} else {
@@ -172,27 +186,118 @@ func (s *Server) setupRoutes() {
 		s.log.Warn().Msg("ENCRYPTION_KEY not set - email passwords will be stored in plain text")
 	}
 
+	// Stored objects go through the encryption layer whenever a master key
+	// is set, so encrypted ones stay readable with ENCRYPT_FILES turned off.
+	// Resumable uploads are staged in storage directly until they complete.
+	var store storage.Storage = s.store
+	var encryptionService *services.EncryptionService
+	var encryptedStore *storage.EncryptedStorage
+	if encryptor != nil {
+		encryptionService = services.NewEncryptionService(repository.NewEncryptionRepository(s.db), encryptor, s.log)
+		encryptedStore = storage.NewEncrypted(s.store, encryptionService, s.cfg.Encryption.Files)
+		store = encryptedStore
+		s.jobWorker.RegisterHandler(jobs.JobTypeEncryptStorage, jobs.NewEncryptStorageHandler(encryptionService, encryptedStore))
+		if s.cfg.Encryption.Files {
+			s.log.Info().Msg("Encryption at rest enabled for stored files")
+		}
+	} else if s.cfg.Encryption.Files {
+		s.log.Warn().Msg("ENCRYPT_FILES is set but ENCRYPTION_KEY is not - files will be stored unencrypted")
+	}
+
 	// Initialize services
 	authService := services.NewAuthService(userRepo, sessionRepo, s.cfg.JWT)
-	fileService := services.NewFileService(fileRepo, userRepo, s.store, s.log)
-	emailService := services.NewEmailService(emailRepo, s.store, encryptor)
+	quotaService := services.NewQuotaService(userRepo, settingsRepo, s.log)
+	fileService := services.NewFileService(fileRepo, userRepo, quotaService, store, s.log)
+	changeService := services.NewChangeService(changeRepo, s.log)
+	fileService.SetChanges(changeService)
+	uploadService := services.NewUploadService(uploadRepo, fileRepo, fileService, s.store, s.cfg.Upload, s.log)
+	emailService := services.NewEmailService(emailRepo, store, encryptor)
 
 	// Register email sync handler now that we have the email service
 	s.jobWorker.RegisterHandler(jobs.JobTypeEmailSync, jobs.NewEmailSyncHandler(emailService))
+	s.jobWorker.RegisterHandler(jobs.JobTypeEmailSend, jobs.NewEmailSendHandler(emailService))
 	s.scheduler.SetEmailService(emailService)
+	emailService.SetSendQueue(jobs.NewEmailSendQueue(s.jobWorker))
+	emailService.SetQuota(quotaService)
+
+	// Register notification delivery, and storage quota reconciliation and
+	// warnings
+	s.jobWorker.RegisterHandler(jobs.JobTypeNotification, jobs.NewNotificationHandler(userRepo, s.hub, services.NewMailer(s.cfg.SMTP)))
+	s.jobWorker.RegisterHandler(jobs.JobTypeQuotaCheck, jobs.NewQuotaCheckHandler(quotaService))
+	quotaService.SetNotifications(s.scheduler)
+
+	// Register thumbnail generation for uploaded files
+	thumbnailService := services.NewThumbnailService(fileRepo, store, s.log)
+	s.jobWorker.RegisterHandler(jobs.JobTypeThumbnail, jobs.NewThumbnailHandler(fileRepo, thumbnailService))
+	fileService.SetThumbnails(thumbnailService, s.scheduler)
+
+	// Register content indexing for full-text search
+	indexService := services.NewFileIndexService(fileRepo, store, s.log)
+	s.jobWorker.RegisterHandler(jobs.JobTypeFileIndex, jobs.NewFileIndexHandler(fileRepo, indexService))
+	fileService.SetIndexing(indexService, s.scheduler)
+	s.scheduler.SetFileService(fileService)
+
+	// WebDAV locks, which REST writes respect too
+	lockService := services.NewLockService(lockRepo, fileRepo, s.log)
+	fileService.SetLocks(lockService)
+
+	// Storage consistency checks, run by admins
+	storageCheckService := services.NewStorageCheckService(repository.NewStorageCheckRepository(s.db), s.store, store, s.log)
+	s.jobWorker.RegisterHandler(jobs.JobTypeStorageCheck, jobs.NewStorageCheckHandler(storageCheckService))
+
+	// Virus scanning of uploads, when a clamd is configured
+	var scanner services.Scanner
+	if s.cfg.Scan.Enabled() {
+		clamd, err := security.NewClamd(s.cfg.Scan.ClamdAddress, s.cfg.Scan.Timeout)
+		if err != nil {
+			s.log.Warn().Err(err).Msg("Invalid CLAMD_ADDRESS - uploads will not be scanned")
+		} else {
+			scanner = clamd
+			s.log.Info().Str("clamd", s.cfg.Scan.ClamdAddress).Msg("Virus scanning of uploads enabled")
+		}
+	}
+	scanService := services.NewScanService(scanner, repository.NewScanRepository(s.db), fileRepo, userRepo, store, s.log)
+	if scanService.Enabled() {
+		s.jobWorker.RegisterHandler(jobs.JobTypeVirusScan, jobs.NewVirusScanHandler(scanService))
+		s.jobWorker.RegisterHandler(jobs.JobTypeVirusRescan, jobs.NewVirusRescanHandler(scanService))
+		scanService.SetNotifications(s.scheduler)
+		fileService.SetScanning(s.scheduler)
+		emailService.SetScanning(scanService)
+	}
+
+	// Register cleanup handler now that expired uploads, trash and shares
+	// can be purged
+	retentionService := services.NewRetentionService(fileService, fileRepo, settingsRepo, activityRepo, s.log)
+	s.jobWorker.RegisterHandler(jobs.JobTypeCleanup, jobs.NewCleanupHandler(uploadService, fileService, retentionService, changeService))
+
+	// Apply the version retention policy after writes and nightly
+	s.jobWorker.RegisterHandler(jobs.JobTypeVersionCleanup, jobs.NewVersionCleanupHandler(retentionService))
+	fileService.SetVersionCleanup(s.scheduler)
+
+	// Register calendar reminder delivery and planning
+	reminderPlanner := jobs.NewCalendarReminderPlanner(s.jobWorker, calendarRepo, userRepo)
+	s.jobWorker.RegisterHandler(jobs.JobTypeCalendarReminder, jobs.NewCalendarReminderHandler(calendarRepo, userRepo, s.hub, services.NewMailer(s.cfg.SMTP)))
+	s.scheduler.SetReminderPlanner(reminderPlanner)
 
 	// Initialize handlers
 	authHandler := handlers.NewAuthHandler(authService, s.log, s.db)
-	fileHandler := handlers.NewFileHandler(fileService, s.log, s.hub, s.cfg.JWT.Secret, s.store, settingsRepo)
-	healthHandler := handlers.NewHealthHandler(s.log, s.db, s.rdb, s.store.Client())
+	fileHandler := handlers.NewFileHandler(fileService, uploadService, s.log, s.hub, s.cfg.JWT.Secret, store, settingsRepo)
+	healthHandler := handlers.NewHealthHandler(s.log, s.db, s.rdb, s.store)
 	wsHandler := ws.NewHandler(s.hub, s.log)
-	webdavServer := webdav.NewServer(fileRepo, s.store, authService, fileService, s.log)
-	adminHandler := handlers.NewAdminHandler(s.db, s.rdb, userRepo, fileRepo, activityRepo, settingsRepo, s.cfg, s.log)
+	webdavServer := webdav.NewServer(fileRepo, store, authService, fileService, lockService, changeService, s.log)
+	davServer := dav.NewServer(authService, calendarRepo, contactRepo, davRepo, reminderPlanner, s.log)
+	adminHandler := handlers.NewAdminHandler(s.db, s.rdb, userRepo, fileRepo, activityRepo, settingsRepo, retentionService, s.cfg, s.log)
 	moduleHandler := handlers.NewModuleHandler(s.log, settingsRepo)
+	changeHandler := handlers.NewChangeHandler(s.log, changeService)
+	jobHandler := handlers.NewJobHandler(s.log, s.jobWorker.Queue())
+	storageCheckHandler := handlers.NewStorageCheckHandler(s.log, storageCheckService, s.jobWorker.Queue())
+	quotaHandler := handlers.NewQuotaHandler(s.log, quotaService, s.jobWorker.Queue())
+	scanHandler := handlers.NewScanHandler(s.log, scanService, s.jobWorker.Queue())
+	encryptionHandler := handlers.NewEncryptionHandler(s.log, encryptionService, emailService, encryptedStore, s.jobWorker.Queue())
 	taskHandler := handlers.NewTaskHandler(s.log, taskRepo)
 	documentHandler := handlers.NewDocumentHandler(s.log, documentRepo, userRepo)
 	emailHandler := handlers.NewEmailHandler(emailService)
-	calendarHandler := handlers.NewCalendarHandler(s.log, calendarRepo)
+	calendarHandler := handlers.NewCalendarHandler(s.log, calendarRepo, userRepo, reminderPlanner)
 	contactsHandler := handlers.NewContactsHandler(s.log, contactRepo)
 
 	// Auth middleware
@@ -205,12 +310,15 @@ func (s *Server) setupRoutes() {
 	api.Get("/health", healthHandler.Liveness)
 	api.Get("/ready", healthHandler.Readiness)
 
+	// Local storage objects over signed URLs (public; the signature is the
+	// credential)
+	if local, ok := s.store.(*storage.LocalStorage); ok {
+		s.app.Get(storage.SignedURLPath, handlers.NewStorageHandler(s.log, local).ServeObject)
+	}
+
 	// Prometheus metrics endpoint (public for scraping)
 	s.app.Get("/metrics", adaptor.HTTPHandler(promhttp.Handler()))
 
-	// Jobs stats (for admin monitoring)
-	api.Get("/jobs/stats", s.jobsStatsHandler)
-
 	// Auth routes (public)
 	auth := api.Group("/auth")
 	auth.Get("/setup-status", authHandler.SetupStatus)
@@ -221,6 +329,9 @@ func (s *Server) setupRoutes() {
 	auth.Post("/forgot-password", authHandler.ForgotPassword)
 	auth.Post("/reset-password", authHandler.ResetPassword)
 
+	// Calendar subscription feed (public; the URL token is the credential)
+	api.Get("/calendar/feed/:token", calendarHandler.Feed)
+
 	// Protected routes
 	protected := api.Group("", authMiddleware.Authenticate)
 
@@ -242,6 +353,8 @@ func (s *Server) setupRoutes() {
 	files := protected.Group("/files")
 	files.Get("/", fileHandler.List)
 	files.Get("/documents-folder", fileHandler.GetDocumentsFolder) // Must be before /:id
+	files.Get("/zip", fileHandler.DownloadArchive)                 // Must be before /:id
+	files.Get("/changes", changeHandler.ListChanges)               // Must be before /:id
 	files.Get("/:id", fileHandler.Get)
 	files.Post("/folder", fileHandler.CreateFolder)
 	files.Put("/:id", fileHandler.Update)
@@ -249,11 +362,17 @@ func (s *Server) setupRoutes() {
 	files.Post("/:id/restore", fileHandler.Restore)
 	files.Post("/:id/copy", fileHandler.Copy)
 	files.Get("/:id/download", fileHandler.Download)
+	files.Get("/:id/thumbnail", fileHandler.Thumbnail)
+	files.Get("/:id/lock", fileHandler.GetLocks)
+	files.Delete("/:id/lock", fileHandler.BreakLocks)
 	files.Get("/:id/stream-token", fileHandler.StreamToken)
 	files.Get("/:id/versions", fileHandler.GetVersions)
 	files.Post("/:id/versions/:version/restore", fileHandler.RestoreVersion)
+	files.Post("/:id/versions/:version/pin", fileHandler.PinVersion)
+	files.Delete("/:id/versions/:version/pin", fileHandler.UnpinVersion)
 	files.Post("/:id/share", fileHandler.CreateShare)
 	files.Post("/:id/share/user", fileHandler.ShareWithUser)
+	files.Post("/:id/request", fileHandler.CreateFileRequest)
 	files.Get("/:id/share/analytics", fileHandler.GetShareAnalytics)
 	files.Get("/:id/shares", fileHandler.GetFileShares)
 	files.Delete("/shares/:shareId", fileHandler.RevokeShare)
@@ -266,9 +385,11 @@ func (s *Server) setupRoutes() {
 
 	// Upload (using Tus protocol)
 	upload := protected.Group("/upload")
+	upload.Options("/", fileHandler.UploadOptions)
 	upload.Post("/", fileHandler.InitiateUpload)
 	upload.Patch("/:uploadId", fileHandler.ChunkUpload)
 	upload.Head("/:uploadId", fileHandler.UploadStatus)
+	upload.Delete("/:uploadId", fileHandler.TerminateUpload)
 
 	// Simple upload (multipart form)
 	files.Post("/upload", fileHandler.SimpleUpload)
@@ -305,6 +426,34 @@ func (s *Server) setupRoutes() {
 	admin.Put("/modules/:id", moduleHandler.UpdateModule)
 	admin.Put("/modules", moduleHandler.UpdateAllModules)
 
+	// Admin job console
+	admin.Get("/jobs", jobHandler.ListJobs)
+	admin.Get("/jobs/stats", jobHandler.GetStats)
+	admin.Get("/jobs/:id", jobHandler.GetJob)
+	admin.Post("/jobs/:id/retry", jobHandler.RetryJob)
+	admin.Post("/jobs/:id/cancel", jobHandler.CancelJob)
+	admin.Post("/jobs/types/:type/pause", jobHandler.PauseType)
+	admin.Post("/jobs/types/:type/resume", jobHandler.ResumeType)
+
+	// Encryption at rest
+	admin.Get("/encryption", encryptionHandler.GetStatus)
+	admin.Post("/encryption/migrate", encryptionHandler.Migrate)
+	admin.Post("/encryption/rotate", encryptionHandler.Rotate)
+
+	// Storage consistency checks (admin only)
+	admin.Get("/storage/check", storageCheckHandler.GetCheck)
+	admin.Post("/storage/check", storageCheckHandler.RunCheck)
+	admin.Get("/storage/broken", storageCheckHandler.ListBroken)
+
+	// Storage usage and quota reconciliation (admin only)
+	admin.Get("/storage/usage", quotaHandler.GetUsage)
+	admin.Post("/storage/reconcile", quotaHandler.Reconcile)
+
+	// Virus scanning (admin only)
+	admin.Get("/scan", scanHandler.GetStatus)
+	admin.Post("/scan/rescan", scanHandler.Rescan)
+	admin.Get("/scan/infected", scanHandler.ListInfected)
+
 	// Module settings (public for users to know what's enabled)
 	protected.Get("/modules", moduleHandler.GetModules)
 
@@ -409,6 +558,11 @@ func (s *Server) setupRoutes() {
 	// Calendar routes (optional module)
 	calendar := protected.Group("/calendar")
 	calendar.Get("/events", calendarHandler.ListEvents)
+	calendar.Post("/import", calendarHandler.ImportEvents)
+	calendar.Get("/export", calendarHandler.ExportEvents)
+	calendar.Get("/feed", calendarHandler.GetFeed)
+	calendar.Post("/feed", calendarHandler.EnableFeed)
+	calendar.Delete("/feed", calendarHandler.DisableFeed)
 	calendar.Post("/events", calendarHandler.CreateEvent)
 	calendar.Delete("/events/by-task/:taskId", calendarHandler.DeleteEventByTask)
 	calendar.Get("/events/:id", calendarHandler.GetEvent)
@@ -427,6 +581,8 @@ func (s *Server) setupRoutes() {
 	// Public share access (no auth required)
 	api.Get("/share/:token", fileHandler.GetShare)
 	api.Get("/share/:token/download", fileHandler.DownloadShare)
+	api.Get("/share/:token/zip", fileHandler.DownloadShareArchive)
+	api.Post("/share/:token/upload", fileHandler.UploadToShare)
 
 	// File streaming (auth via short-lived query token for <video>/<audio> src)
 	api.Get("/files/:id/stream", fileHandler.StreamFile)
@@ -463,6 +619,12 @@ func (s *Server) setupRoutes() {
 	// WebDAV endpoint (handles all methods)
 	s.app.All("/webdav/*", webdavServer.Handler())
 	s.app.All("/webdav", webdavServer.Handler())
+
+	// CalDAV and CardDAV endpoint, discoverable through /.well-known/caldav and /.well-known/carddav
+	s.app.All(dav.Prefix+"/*", davServer.Handler())
+	s.app.All(dav.Prefix, davServer.Handler())
+	s.app.All("/.well-known/caldav", davServer.WellKnownHandler())
+	s.app.All("/.well-known/carddav", davServer.WellKnownHandler())
 }
 
 // Start begins listening for requests
@@ -498,19 +660,3 @@ func customErrorHandler(c *fiber.Ctx, err error) error {
 		"error": err.Error(),
 	})
 }
-
-// jobsStatsHandler returns job queue statistics
-func (s *Server) jobsStatsHandler(c *fiber.Ctx) error {
-	queue := s.jobWorker
-	if queue == nil {
-		return c.JSON(fiber.Map{
-			"status": "not available",
-		})
-	}
-
-	// Get stats from the memory queue
-	return c.JSON(fiber.Map{
-		"status":  "running",
-		"workers": 4,
-	})
-}
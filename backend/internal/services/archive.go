@@ -0,0 +1,252 @@
+package services
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/tessera/tessera/internal/models"
+	"github.com/tessera/tessera/internal/repository"
+)
+
+// MaxArchiveEntries caps the files and folders in one ZIP download, so a
+// single request can't walk an entire tree of millions of files
+const MaxArchiveEntries = 50000
+
+// ErrArchiveTooLarge is returned when a ZIP download would hold more than
+// MaxArchiveEntries files and folders
+var ErrArchiveTooLarge = errors.New("too many files to download at once")
+
+// Archive is a set of files and folders downloaded as one ZIP
+type Archive struct {
+	Name    string // suggested file name, ending in .zip
+	Entries []ArchiveEntry
+}
+
+// ArchiveEntry is a file or folder in an Archive
+type ArchiveEntry struct {
+	Path string // slash-separated; folders end in a slash
+	File *models.File
+}
+
+// GetArchive collects the files and folders a user asked to download, with
+// everything inside the folders. Each must be the user's own or shared
+// with them, directly or through a folder containing it.
+func (s *FileService) GetArchive(ctx context.Context, userID uuid.UUID, ids []uuid.UUID) (*Archive, error) {
+	roots := make([]*models.File, 0, len(ids))
+	for _, id := range ids {
+		file, err := s.readable(ctx, id, userID)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, file)
+	}
+	return s.collectArchive(ctx, roots)
+}
+
+// GetShareArchive checks a public share allows downloading and collects
+// the files to download from it: the shared file or folder, or a selection
+// of files and folders inside a shared folder. As with GetShareDownload,
+// the download isn't counted.
+func (s *FileService) GetShareArchive(ctx context.Context, token, password string, ids []uuid.UUID) (*models.Share, *Archive, error) {
+	share, err := s.openShareDownload(ctx, token, password)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(ids) == 0 {
+		ids = []uuid.UUID{share.FileID}
+	}
+	roots := make([]*models.File, 0, len(ids))
+	for _, id := range ids {
+		file, err := s.fileRepo.GetByID(ctx, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		if file.IsTrashed || file.OwnerID != share.OwnerID {
+			return nil, nil, repository.ErrFileNotFound
+		}
+		if id != share.FileID {
+			ancestors, err := s.fileRepo.GetAncestorIDs(ctx, id)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !slices.Contains(ancestors, share.FileID) {
+				return nil, nil, repository.ErrFileNotFound
+			}
+		}
+		roots = append(roots, file)
+	}
+
+	archive, err := s.collectArchive(ctx, roots)
+	if err != nil {
+		return nil, nil, err
+	}
+	return share, archive, nil
+}
+
+// WriteArchive streams an archive as ZIP, reading each file from storage as
+// it's written. Sizes aren't known up front, so entries use data
+// descriptors, and ZIP64 records once an entry or the archive passes 4 GiB.
+func (s *FileService) WriteArchive(ctx context.Context, w io.Writer, archive *Archive) error {
+	return writeArchive(ctx, w, archive.Entries, s.storage.Download)
+}
+
+// readable returns a file a user owns or can read through a share of it or
+// of a folder containing it
+func (s *FileService) readable(ctx context.Context, fileID, userID uuid.UUID) (*models.File, error) {
+	file, err := s.fileRepo.GetByID(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if file.IsTrashed {
+		return nil, repository.ErrFileNotFound
+	}
+	if file.OwnerID == userID {
+		return file, nil
+	}
+
+	ancestors, err := s.fileRepo.GetAncestorIDs(ctx, fileID)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range append([]uuid.UUID{fileID}, ancestors...) {
+		share, err := s.fileRepo.GetUserShare(ctx, id, userID)
+		if err != nil || share == nil {
+			continue
+		}
+		if share.ExpiresAt == nil || share.ExpiresAt.After(time.Now()) {
+			return file, nil
+		}
+	}
+	return nil, repository.ErrFileNotFound
+}
+
+// collectArchive walks the folders among the roots, listing everything in
+// them. Roots with the same name are told apart with a number.
+func (s *FileService) collectArchive(ctx context.Context, roots []*models.File) (*Archive, error) {
+	archive := &Archive{Name: "download.zip"}
+	if len(roots) == 1 {
+		archive.Name = roots[0].Name + ".zip"
+	}
+
+	taken := map[string]bool{}
+	for _, root := range roots {
+		name := archiveName(root.Name, root.IsFolder, taken)
+		if err := s.collectEntries(ctx, archive, root, name); err != nil {
+			return nil, err
+		}
+	}
+	return archive, nil
+}
+
+// collectEntries adds a file, or a folder and everything inside it, to an
+// archive
+func (s *FileService) collectEntries(ctx context.Context, archive *Archive, file *models.File, name string) error {
+	if len(archive.Entries) >= MaxArchiveEntries {
+		return ErrArchiveTooLarge
+	}
+	if !file.IsFolder {
+		// Quarantined files are left out
+		if !file.Infected() {
+			archive.Entries = append(archive.Entries, ArchiveEntry{Path: name, File: file})
+		}
+		return nil
+	}
+
+	// Folders get entries of their own, so empty ones aren't lost
+	archive.Entries = append(archive.Entries, ArchiveEntry{Path: name + "/", File: file})
+	children, err := s.fileRepo.ListByParent(ctx, file.OwnerID, &file.ID, false)
+	if err != nil {
+		return err
+	}
+	for _, child := range children {
+		if err := s.collectEntries(ctx, archive, child, name+"/"+zipSafeName(child.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveName returns a unique name for a top-level entry of an archive,
+// adding a number before the extension if needed
+func archiveName(name string, isFolder bool, taken map[string]bool) string {
+	name = zipSafeName(name)
+	ext := ""
+	if !isFolder {
+		ext = path.Ext(name)
+	}
+	unique := name
+	for n := 2; taken[unique]; n++ {
+		unique = fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext)
+	}
+	taken[unique] = true
+	return unique
+}
+
+// zipSafeName makes a file name safe as one path element in a ZIP, so
+// extracting it can't write outside the target folder
+func zipSafeName(name string) string {
+	name = strings.NewReplacer("/", "_", "\\", "_").Replace(name)
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+// compressedTypes are content types not worth deflating again
+var compressedTypes = []string{"image/", "video/", "audio/", "application/zip", "application/gzip",
+	"application/x-7z-compressed", "application/x-rar-compressed", "application/x-bzip2", "application/x-xz"}
+
+// writeArchive writes entries as ZIP, opening file content with open
+func writeArchive(ctx context.Context, w io.Writer, entries []ArchiveEntry, open func(context.Context, string) (io.ReadCloser, error)) error {
+	zw := zip.NewWriter(w)
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		file := entry.File
+		header := &zip.FileHeader{Name: entry.Path, Modified: file.UpdatedAt}
+		if file.IsFolder {
+			header.SetMode(fs.ModeDir | 0755)
+			if _, err := zw.CreateHeader(header); err != nil {
+				return err
+			}
+			continue
+		}
+
+		header.SetMode(0644)
+		header.Method = zip.Deflate
+		if slices.ContainsFunc(compressedTypes, func(t string) bool { return strings.HasPrefix(file.MimeType, t) }) {
+			header.Method = zip.Store
+		}
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if file.StorageKey == "" {
+			continue // an empty file that was never uploaded to
+		}
+
+		reader, err := open(ctx, file.StorageKey)
+		if err != nil {
+			return fmt.Errorf("open %s: %w", file.ID, err)
+		}
+		_, err = io.Copy(fw, reader)
+		reader.Close()
+		if err != nil {
+			return fmt.Errorf("read %s: %w", file.ID, err)
+		}
+	}
+	return zw.Close()
+}
@@ -0,0 +1,102 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tessera/tessera/internal/models"
+)
+
+func TestWriteArchive(t *testing.T) {
+	modified := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	objects := map[string]string{
+		"k/notes": strings.Repeat("notes ", 100),
+		"k/photo": "\xff\xd8jpeg",
+	}
+	entries := []ArchiveEntry{
+		{Path: "Trip/", File: &models.File{IsFolder: true, UpdatedAt: modified}},
+		{Path: "Trip/notes.txt", File: &models.File{StorageKey: "k/notes", MimeType: "text/plain", UpdatedAt: modified}},
+		{Path: "Trip/photo.jpg", File: &models.File{StorageKey: "k/photo", MimeType: "image/jpeg", UpdatedAt: modified}},
+		{Path: "Trip/empty.txt", File: &models.File{UpdatedAt: modified}},
+	}
+	open := func(_ context.Context, key string) (io.ReadCloser, error) {
+		data, ok := objects[key]
+		if !ok {
+			return nil, errors.New("no such object")
+		}
+		return io.NopCloser(strings.NewReader(data)), nil
+	}
+
+	var buf bytes.Buffer
+	if err := writeArchive(context.Background(), &buf, entries, open); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != len(entries) {
+		t.Fatalf("archive has %d entries, want %d", len(zr.File), len(entries))
+	}
+	want := map[string]string{"Trip/notes.txt": objects["k/notes"], "Trip/photo.jpg": objects["k/photo"], "Trip/empty.txt": ""}
+	for _, f := range zr.File {
+		if !f.Modified.Equal(modified) {
+			t.Errorf("%s: modified = %v, want %v", f.Name, f.Modified, modified)
+		}
+		if f.Name == "Trip/" {
+			if !f.FileInfo().IsDir() {
+				t.Errorf("Trip/ is not a directory")
+			}
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		if string(data) != want[f.Name] {
+			t.Errorf("%s = %q, want %q", f.Name, data, want[f.Name])
+		}
+	}
+	if m := zr.File[2].Method; m != zip.Store {
+		t.Errorf("photo method = %d, want store", m)
+	}
+	if m := zr.File[1].Method; m != zip.Deflate {
+		t.Errorf("notes method = %d, want deflate", m)
+	}
+
+	missing := append(entries, ArchiveEntry{Path: "gone.txt", File: &models.File{StorageKey: "k/gone"}})
+	if err := writeArchive(context.Background(), io.Discard, missing, open); err == nil {
+		t.Error("missing object: no error")
+	}
+}
+
+func TestArchiveName(t *testing.T) {
+	taken := map[string]bool{}
+	tests := []struct {
+		name     string
+		isFolder bool
+		want     string
+	}{
+		{"report.pdf", false, "report.pdf"},
+		{"report.pdf", false, "report (2).pdf"},
+		{"report.pdf", false, "report (3).pdf"},
+		{"v1.2", true, "v1.2"},
+		{"v1.2", true, "v1.2 (2)"},
+		{"..", false, "_"},
+		{"a/b\\c", false, "a_b_c"},
+	}
+	for _, tt := range tests {
+		if got := archiveName(tt.name, tt.isFolder, taken); got != tt.want {
+			t.Errorf("archiveName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
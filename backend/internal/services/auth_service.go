@@ -240,6 +240,33 @@ func (s *AuthService) Login(ctx context.Context, input LoginInput) (*models.User
 	return user, tokens, nil, nil
 }
 
+// VerifyCredentials checks an email and password without creating a session.
+// It is meant for protocols such as CalDAV that send Basic auth on every request.
+// Returns ErrTOTPRequired for accounts with 2FA, which cannot use password-only auth.
+func (s *AuthService) VerifyCredentials(ctx context.Context, email, password string) (*models.User, error) {
+	user, err := s.userRepo.GetByEmail(ctx, email)
+	if err != nil {
+		if errors.Is(err, repository.ErrUserNotFound) {
+			return nil, ErrInvalidCredentials
+		}
+		return nil, err
+	}
+
+	if !user.IsActive {
+		return nil, ErrUserNotActive
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	if user.TOTPEnabled {
+		return nil, ErrTOTPRequired
+	}
+
+	return user, nil
+}
+
 // CompleteTOTPLoginInput contains data for completing 2FA login
 type CompleteTOTPLoginInput struct {
 	PendingToken string
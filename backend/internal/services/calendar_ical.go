@@ -0,0 +1,845 @@
+package services
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-ical"
+	"github.com/google/uuid"
+	"github.com/tessera/tessera/internal/models"
+)
+
+// Calendar interchange errors
+var (
+	ErrICalNoEvent          = errors.New("calendar object contains no event")
+	ErrICalMultipleUIDs     = errors.New("calendar object contains more than one event UID")
+	ErrICalMissingStart     = errors.New("event has no start date")
+	ErrICalUnsupportedRRule = errors.New("unsupported recurrence rule")
+	ErrICalUIDTooLong       = errors.New("event UID is longer than 255 characters")
+	ErrICalOrphanOverride   = errors.New("modified occurrence has no matching recurring event")
+)
+
+// ICalProductID identifies Tessera as the producer of exported calendars
+const ICalProductID = "-//Tessera//Calendar//EN"
+
+// Custom properties that round-trip Tessera-only event fields through clients
+const (
+	icalPropColor  = "X-TESSERA-COLOR"
+	icalPropTaskID = "X-TESSERA-TASK-ID"
+)
+
+// DefaultEventColor is used for events created without a color
+const DefaultEventColor = "#3b82f6"
+
+// Column sizes of the calendar_events table
+const (
+	eventTitleLimit = 500
+	eventColorLimit = 50
+	eventUIDLimit   = 255
+)
+
+// Event times are stored as wall-clock times in the owner's timezone, labelled
+// UTC (the web client sends "2006-01-02T15:04:05" without an offset). iCalendar
+// data carries real instants, so conversions go through the owner's location.
+
+// UserLocation returns the location for a user's configured timezone, or UTC
+func UserLocation(timezone string) *time.Location {
+	if timezone == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// WallClockInstant interprets a stored wall-clock event time in loc
+func WallClockInstant(t time.Time, loc *time.Location) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, loc).UTC()
+}
+
+// InstantToWallClock converts an instant to the stored wall-clock representation
+func InstantToWallClock(t time.Time, loc *time.Location) time.Time {
+	t = t.In(loc)
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), 0, time.UTC)
+}
+
+// NewICalCalendar creates an empty VCALENDAR with Tessera's product ID
+func NewICalCalendar() *ical.Calendar {
+	cal := ical.NewCalendar()
+	cal.Props.SetText(ical.PropVersion, "2.0")
+	cal.Props.SetText(ical.PropProductID, ICalProductID)
+	return cal
+}
+
+// EncodeICalEvent writes a single event, with the overrides of a recurring
+// event, as a complete iCalendar object
+func EncodeICalEvent(w io.Writer, event *models.CalendarEvent, loc *time.Location) error {
+	cal := NewICalCalendar()
+	cal.Children = append(cal.Children, eventComponents(event, loc)...)
+	return ical.NewEncoder(w).Encode(cal)
+}
+
+// eventComponents returns the VEVENT of an event followed by one VEVENT per
+// overridden occurrence
+func eventComponents(event *models.CalendarEvent, loc *time.Location) []*ical.Component {
+	comps := []*ical.Component{EventToICal(event, loc).Component}
+	for i := range event.Overrides {
+		override := event.Overrides[i]
+		override.UID = event.UID
+		comps = append(comps, EventToICal(&override, loc).Component)
+	}
+	return comps
+}
+
+// EventToICal converts an event to a VEVENT component. Overrides (events with
+// a RecurrenceID) get a RECURRENCE-ID instead of a recurrence rule.
+func EventToICal(event *models.CalendarEvent, loc *time.Location) *ical.Event {
+	ev := ical.NewEvent()
+	ev.Props.SetText(ical.PropUID, event.UID)
+	ev.Props.SetDateTime(ical.PropDateTimeStamp, event.UpdatedAt.UTC())
+	ev.Props.SetDateTime(ical.PropCreated, event.CreatedAt.UTC())
+	ev.Props.SetDateTime(ical.PropLastModified, event.UpdatedAt.UTC())
+	ev.Props.SetText(ical.PropSummary, event.Title)
+	if event.Description != "" {
+		ev.Props.SetText(ical.PropDescription, event.Description)
+	}
+
+	if event.AllDay {
+		ev.Props.SetDate(ical.PropDateTimeStart, event.StartDate)
+		end := event.EndDate
+		if end.Before(event.StartDate) {
+			end = event.StartDate
+		}
+		ev.Props.SetDate(ical.PropDateTimeEnd, end.AddDate(0, 0, 1))
+	} else {
+		ev.Props.SetDateTime(ical.PropDateTimeStart, WallClockInstant(event.StartDate, loc))
+		ev.Props.SetDateTime(ical.PropDateTimeEnd, WallClockInstant(event.EndDate, loc))
+	}
+
+	if event.RecurrenceID != nil {
+		prop := ical.NewProp(ical.PropRecurrenceID)
+		if event.AllDay {
+			prop.SetDate(*event.RecurrenceID)
+		} else {
+			prop.SetDateTime(WallClockInstant(*event.RecurrenceID, loc))
+		}
+		ev.Props.Set(prop)
+	} else if event.Recurrence != nil {
+		if rule := recurrenceToRRule(event.Recurrence, event.StartDate, event.AllDay, loc); rule != "" {
+			prop := ical.NewProp(ical.PropRecurrenceRule)
+			prop.Value = rule
+			ev.Props.Set(prop)
+			if exdate := exceptionDatesProp(event.Recurrence.ExceptionDates, event.AllDay, loc); exdate != nil {
+				ev.Props.Set(exdate)
+			}
+		}
+	}
+
+	if event.Color != "" {
+		ev.Props.SetText(icalPropColor, event.Color)
+	}
+	if event.LinkedTaskID != nil {
+		ev.Props.SetText(icalPropTaskID, *event.LinkedTaskID)
+	}
+
+	for _, r := range event.Reminders {
+		alarm := ical.NewComponent(ical.CompAlarm)
+		alarm.Props.SetText(ical.PropAction, "DISPLAY")
+		alarm.Props.SetText(ical.PropDescription, event.Title)
+		trigger := ical.NewProp(ical.PropTrigger)
+		trigger.Value = formatTriggerMinutes(r.Minutes)
+		alarm.Props.Set(trigger)
+		ev.Children = append(ev.Children, alarm)
+	}
+
+	return ev
+}
+
+// DecodeICalEvent parses an iCalendar object holding one event, as stored in a
+// CalDAV calendar collection. Overridden occurrences (RECURRENCE-ID) are
+// returned in the event's Overrides.
+func DecodeICalEvent(r io.Reader, loc *time.Location) (*models.CalendarEvent, error) {
+	cal, err := ical.NewDecoder(r).Decode()
+	if err != nil {
+		return nil, err
+	}
+
+	var master *ical.Event
+	var overrides []ical.Event
+	uid := ""
+	for _, ev := range cal.Events() {
+		evUID, _ := ev.Props.Text(ical.PropUID)
+		if uid != "" && evUID != uid {
+			return nil, ErrICalMultipleUIDs
+		}
+		uid = evUID
+		if ev.Props.Get(ical.PropRecurrenceID) != nil {
+			overrides = append(overrides, ev)
+		} else if master == nil {
+			e := ev
+			master = &e
+		}
+	}
+	if master == nil {
+		return nil, ErrICalNoEvent
+	}
+
+	zones := newICalZones(cal, loc)
+	event, err := eventFromICal(master, zones)
+	if err != nil {
+		return nil, err
+	}
+	if event.Recurrence == nil {
+		// Overrides of a series that no longer recurs have nothing to modify
+		overrides = nil
+	}
+	for i := range overrides {
+		override, err := overrideFromICal(&overrides[i], zones)
+		if err != nil {
+			return nil, err
+		}
+		attachOverride(event, override)
+	}
+	return event, nil
+}
+
+// overrideFromICal converts a VEVENT carrying a RECURRENCE-ID
+func overrideFromICal(ev *ical.Event, zones *icalZones) (*models.CalendarEvent, error) {
+	prop := ev.Props.Get(ical.PropRecurrenceID)
+	recurrenceID, err := zones.propTime(prop, prop.Value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RECURRENCE-ID: %w", err)
+	}
+	if !isICalDate(prop) {
+		recurrenceID = InstantToWallClock(recurrenceID, zones.owner)
+	}
+
+	override, err := eventFromICal(ev, zones)
+	if err != nil {
+		return nil, err
+	}
+	override.Recurrence = nil
+	override.LinkedTaskID = nil
+	override.RecurrenceID = &recurrenceID
+	return override, nil
+}
+
+// attachOverride adds an override to its recurring event; a later override of
+// the same occurrence replaces an earlier one
+func attachOverride(series, override *models.CalendarEvent) {
+	if series.AllDay {
+		t := *override.RecurrenceID
+		t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		override.RecurrenceID = &t
+	}
+	override.UID = series.UID
+	for i := range series.Overrides {
+		if series.Overrides[i].RecurrenceID.Equal(*override.RecurrenceID) {
+			series.Overrides[i] = *override
+			return
+		}
+	}
+	series.Overrides = append(series.Overrides, *override)
+}
+
+// EncodeICalCalendar writes events as one VCALENDAR, as used for exports and
+// subscription feeds
+func EncodeICalCalendar(w io.Writer, events []models.CalendarEvent, name string, loc *time.Location) error {
+	if len(events) == 0 {
+		// go-ical refuses to encode a calendar without components, but an
+		// empty export is still a valid (if unusual) iCalendar stream
+		_, err := fmt.Fprintf(w, "BEGIN:VCALENDAR\r\nPRODID:%s\r\nVERSION:2.0\r\nX-WR-CALNAME:%s\r\nEND:VCALENDAR\r\n", ICalProductID, name)
+		return err
+	}
+
+	cal := NewICalCalendar()
+	cal.Props.SetText("X-WR-CALNAME", name)
+	cal.Props.SetText("X-WR-TIMEZONE", loc.String())
+	for i := range events {
+		cal.Children = append(cal.Children, eventComponents(&events[i], loc)...)
+	}
+	return ical.NewEncoder(w).Encode(cal)
+}
+
+// ICalImportItem is one event read from an uploaded calendar. Event is nil
+// when the VEVENT could not be converted, and Err says why.
+type ICalImportItem struct {
+	UID     string
+	Summary string
+	Event   *models.CalendarEvent
+	Err     error
+}
+
+// DecodeICalCalendar parses a calendar export (one or more VCALENDARs) into
+// events keyed by UID, with modified occurrences attached to their recurring
+// event. Conversion problems are reported per event so a single bad VEVENT
+// does not fail the whole import; only unreadable data is an error.
+func DecodeICalCalendar(r io.Reader, loc *time.Location) ([]ICalImportItem, error) {
+	dec := ical.NewDecoder(r)
+	var items []ICalImportItem
+	seen := map[string]bool{}
+	// Overrides may come before their series, so they are attached at the end
+	var overrides []ICalImportItem
+
+	for {
+		cal, err := dec.Decode()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		zones := newICalZones(cal, loc)
+		for _, ev := range cal.Events() {
+			e := ev
+			uid, _ := e.Props.Text(ical.PropUID)
+			summary, _ := e.Props.Text(ical.PropSummary)
+			if uid == "" {
+				uid = importedEventUID(&e)
+			}
+			if len(uid) > eventUIDLimit {
+				items = append(items, ICalImportItem{UID: uid, Summary: summary, Err: ErrICalUIDTooLong})
+				continue
+			}
+
+			if e.Props.Get(ical.PropRecurrenceID) != nil {
+				override, err := overrideFromICal(&e, zones)
+				overrides = append(overrides, ICalImportItem{UID: uid, Summary: summary, Event: override, Err: err})
+				continue
+			}
+			if seen[uid] {
+				items = append(items, ICalImportItem{UID: uid, Summary: summary, Err: ErrICalMultipleUIDs})
+				continue
+			}
+			seen[uid] = true
+
+			event, err := eventFromICal(&e, zones)
+			if err != nil {
+				items = append(items, ICalImportItem{UID: uid, Summary: summary, Err: err})
+				continue
+			}
+			event.UID = uid
+			items = append(items, ICalImportItem{UID: uid, Summary: summary, Event: event})
+		}
+	}
+
+	for _, o := range overrides {
+		if o.Err != nil {
+			items = append(items, o)
+			continue
+		}
+		attached := false
+		for i := range items {
+			if items[i].UID == o.UID && items[i].Event != nil && items[i].Event.Recurrence != nil {
+				attachOverride(items[i].Event, o.Event)
+				attached = true
+				break
+			}
+		}
+		if !attached {
+			items = append(items, ICalImportItem{UID: o.UID, Summary: o.Summary, Err: ErrICalOrphanOverride})
+		}
+	}
+
+	if len(items) == 0 {
+		return nil, ErrICalNoEvent
+	}
+	return items, nil
+}
+
+// importedEventUID derives a stable UID for a VEVENT that lacks one, so
+// importing the same file twice still de-duplicates
+func importedEventUID(ev *ical.Event) string {
+	h := sha256.New()
+	for _, name := range []string{ical.PropDateTimeStart, ical.PropDateTimeEnd, ical.PropSummary, ical.PropRecurrenceRule} {
+		if prop := ev.Props.Get(name); prop != nil {
+			h.Write([]byte(prop.Value))
+		}
+		h.Write([]byte{0})
+	}
+	return fmt.Sprintf("%x@import.tessera", h.Sum(nil)[:16])
+}
+
+// EventFromICal converts a VEVENT into an event. The returned event has no ID,
+// owner or timestamps, and Color is empty unless the VEVENT carries one; loc is
+// the owner's timezone and is used for floating times.
+func EventFromICal(ev *ical.Event, loc *time.Location) (*models.CalendarEvent, error) {
+	return eventFromICal(ev, newICalZones(nil, loc))
+}
+
+func eventFromICal(ev *ical.Event, zones *icalZones) (*models.CalendarEvent, error) {
+	loc := zones.owner
+	event := &models.CalendarEvent{
+		Reminders: []models.EventReminder{},
+	}
+
+	event.UID, _ = ev.Props.Text(ical.PropUID)
+	event.Title, _ = ev.Props.Text(ical.PropSummary)
+	event.Description, _ = ev.Props.Text(ical.PropDescription)
+	if event.Title == "" {
+		event.Title = "Untitled event"
+	}
+	event.Title = truncateRunes(event.Title, eventTitleLimit)
+	if color, _ := ev.Props.Text(icalPropColor); color != "" && len(color) <= eventColorLimit {
+		event.Color = color
+	}
+	if taskID, _ := ev.Props.Text(icalPropTaskID); taskID != "" {
+		event.LinkedTaskID = &taskID
+	}
+
+	startProp := ev.Props.Get(ical.PropDateTimeStart)
+	if startProp == nil {
+		return nil, ErrICalMissingStart
+	}
+	start, err := zones.propTime(startProp, startProp.Value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DTSTART: %w", err)
+	}
+	event.AllDay = isICalDate(startProp)
+
+	var end time.Time
+	if endProp := ev.Props.Get(ical.PropDateTimeEnd); endProp != nil {
+		if end, err = zones.propTime(endProp, endProp.Value); err != nil {
+			return nil, fmt.Errorf("invalid DTEND: %w", err)
+		}
+	} else if durProp := ev.Props.Get(ical.PropDuration); durProp != nil {
+		dur, err := durProp.Duration()
+		if err != nil {
+			return nil, fmt.Errorf("invalid DURATION: %w", err)
+		}
+		end = start.Add(dur)
+	} else if event.AllDay {
+		end = start.AddDate(0, 0, 1)
+	} else {
+		end = start
+	}
+
+	if event.AllDay {
+		// DTEND is exclusive for dates; Tessera stores the last second of the final day
+		event.StartDate = start
+		event.EndDate = end.Add(-time.Second)
+		if event.EndDate.Before(start) {
+			event.EndDate = start.AddDate(0, 0, 1).Add(-time.Second)
+		}
+	} else {
+		event.StartDate = InstantToWallClock(start, loc)
+		event.EndDate = InstantToWallClock(end, loc)
+		if event.EndDate.Before(event.StartDate) {
+			event.EndDate = event.StartDate
+		}
+	}
+
+	if prop := ev.Props.Get(ical.PropRecurrenceRule); prop != nil {
+		rule, err := recurrenceFromRRule(withoutStartMonth(prop.Value, event.StartDate), loc)
+		if err != nil {
+			return nil, err
+		}
+		event.Recurrence = rule
+
+		dates, err := exceptionDates(ev, zones, event.AllDay)
+		if err != nil {
+			return nil, err
+		}
+		rule.ExceptionDates = dates
+	}
+
+	alarmStart, alarmEnd := start, end
+	if event.AllDay {
+		alarmStart, alarmEnd = WallClockInstant(start, loc), WallClockInstant(end, loc)
+	}
+	for _, child := range ev.Children {
+		if child.Name != ical.CompAlarm {
+			continue
+		}
+		minutes, ok := alarmMinutes(child, alarmStart, alarmEnd, zones)
+		if !ok {
+			continue
+		}
+		event.Reminders = append(event.Reminders, models.EventReminder{ID: uuid.New(), Minutes: minutes})
+	}
+
+	return event, nil
+}
+
+func isICalDate(prop *ical.Prop) bool {
+	return prop.ValueType() == ical.ValueDate || (prop.ValueType() == ical.ValueDefault && len(prop.Value) == len("20060102"))
+}
+
+// icalZones resolves the TZIDs used by a calendar. IANA names are loaded from
+// the system database; other TZIDs (Outlook's "W. Europe Standard Time", ...)
+// are evaluated from the VTIMEZONE definitions embedded in the calendar.
+// Floating times and unresolvable TZIDs are read in the owner's timezone.
+type icalZones struct {
+	owner *time.Location
+	defs  map[string]*ical.Component
+}
+
+func newICalZones(cal *ical.Calendar, owner *time.Location) *icalZones {
+	zones := &icalZones{owner: owner, defs: map[string]*ical.Component{}}
+	if cal == nil {
+		return zones
+	}
+	for _, child := range cal.Children {
+		if child.Name != ical.CompTimezone {
+			continue
+		}
+		if tzid, _ := child.Props.Text(ical.PropTimezoneID); tzid != "" {
+			zones.defs[tzid] = child
+		}
+	}
+	return zones
+}
+
+// propTime parses one DATE or DATE-TIME value of prop (EXDATE may hold
+// several). Dates are returned as UTC midnight.
+func (z *icalZones) propTime(prop *ical.Prop, value string) (time.Time, error) {
+	if prop.ValueType() == ical.ValueDate || (prop.ValueType() == ical.ValueDefault && len(value) == len("20060102")) {
+		return time.ParseInLocation("20060102", value, time.UTC)
+	}
+	return z.dateTime(value, prop.Params.Get(ical.PropTimezoneID))
+}
+
+// dateTime converts a DATE-TIME value to an instant
+func (z *icalZones) dateTime(value, tzid string) (time.Time, error) {
+	if strings.HasSuffix(value, "Z") {
+		return time.Parse("20060102T150405Z", value)
+	}
+	wall, err := time.ParseInLocation("20060102T150405", value, time.UTC)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if tzid == "" {
+		return WallClockInstant(wall, z.owner), nil
+	}
+	if loc, err := time.LoadLocation(strings.TrimPrefix(tzid, "/")); err == nil {
+		return WallClockInstant(wall, loc), nil
+	}
+	if def, ok := z.defs[tzid]; ok {
+		if name, _ := def.Props.Text("X-LIC-LOCATION"); name != "" {
+			if loc, err := time.LoadLocation(name); err == nil {
+				return WallClockInstant(wall, loc), nil
+			}
+		}
+		if offset, ok := vtimezoneOffset(def, wall); ok {
+			return wall.Add(-offset), nil
+		}
+	}
+	return WallClockInstant(wall, z.owner), nil
+}
+
+// vtimezoneOffset evaluates the STANDARD and DAYLIGHT observances of a
+// VTIMEZONE for a wall-clock time: the observance with the latest onset at or
+// before it supplies the UTC offset.
+func vtimezoneOffset(tz *ical.Component, wall time.Time) (time.Duration, bool) {
+	var onset time.Time
+	var offset time.Duration
+	found := false
+	for _, obs := range tz.Children {
+		if obs.Name != ical.CompTimezoneStandard && obs.Name != ical.CompTimezoneDaylight {
+			continue
+		}
+		to, ok := parseUTCOffset(obs.Props.Get(ical.PropTimezoneOffsetTo))
+		if !ok {
+			continue
+		}
+		start, err := obs.Props.DateTime(ical.PropDateTimeStart, time.UTC)
+		if err != nil {
+			continue
+		}
+		if set, err := obs.RecurrenceSet(time.UTC); err == nil && set != nil {
+			if last := set.Before(wall, true); !last.IsZero() {
+				start = last
+			}
+		}
+		if start.After(wall) {
+			// Before the observance's first onset; only used if nothing earlier applies
+			if !found {
+				offset, found = to, true
+			}
+			continue
+		}
+		if onset.IsZero() || start.After(onset) {
+			onset, offset, found = start, to, true
+		}
+	}
+	return offset, found
+}
+
+// parseUTCOffset parses a UTC-OFFSET value such as +0100 or -053000
+func parseUTCOffset(prop *ical.Prop) (time.Duration, bool) {
+	if prop == nil || (len(prop.Value) != 5 && len(prop.Value) != 7) {
+		return 0, false
+	}
+	sign := time.Duration(1)
+	switch prop.Value[0] {
+	case '-':
+		sign = -1
+	case '+':
+	default:
+		return 0, false
+	}
+	var h, m, sec int
+	var err error
+	if h, err = strconv.Atoi(prop.Value[1:3]); err != nil {
+		return 0, false
+	}
+	if m, err = strconv.Atoi(prop.Value[3:5]); err != nil {
+		return 0, false
+	}
+	if len(prop.Value) == 7 {
+		if sec, err = strconv.Atoi(prop.Value[5:7]); err != nil {
+			return 0, false
+		}
+	}
+	return sign * (time.Duration(h)*time.Hour + time.Duration(m)*time.Minute + time.Duration(sec)*time.Second), true
+}
+
+// exceptionDates reads the EXDATE properties of a VEVENT as stored
+// wall-clock occurrence starts
+func exceptionDates(ev *ical.Event, zones *icalZones, allDay bool) ([]time.Time, error) {
+	var dates []time.Time
+	for i := range ev.Props[ical.PropExceptionDates] {
+		prop := &ev.Props[ical.PropExceptionDates][i]
+		for _, value := range strings.Split(prop.Value, ",") {
+			t, err := zones.propTime(prop, strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("invalid EXDATE: %w", err)
+			}
+			if len(value) != len("20060102") {
+				t = InstantToWallClock(t, zones.owner)
+			}
+			if allDay {
+				t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+			}
+			dates = append(dates, t)
+		}
+	}
+	return dates, nil
+}
+
+// exceptionDatesProp formats skipped occurrences as a single EXDATE property
+func exceptionDatesProp(dates []time.Time, allDay bool, loc *time.Location) *ical.Prop {
+	if len(dates) == 0 {
+		return nil
+	}
+	prop := ical.NewProp(ical.PropExceptionDates)
+	values := make([]string, 0, len(dates))
+	for _, d := range dates {
+		if allDay {
+			values = append(values, d.Format("20060102"))
+		} else {
+			values = append(values, WallClockInstant(d, loc).Format("20060102T150405Z"))
+		}
+	}
+	if allDay {
+		prop.SetValueType(ical.ValueDate)
+	}
+	prop.Value = strings.Join(values, ",")
+	return prop
+}
+
+var icalFrequencies = map[string]string{
+	"daily":   "DAILY",
+	"weekly":  "WEEKLY",
+	"monthly": "MONTHLY",
+	"yearly":  "YEARLY",
+}
+
+// icalWeekdays maps time.Weekday (0 = Sunday, as used by RecurrenceRule) to BYDAY codes
+var icalWeekdays = [7]string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+// recurrenceToRRule formats a recurrence rule as an RRULE value
+func recurrenceToRRule(rule *models.RecurrenceRule, start time.Time, allDay bool, loc *time.Location) string {
+	freq, ok := icalFrequencies[rule.Type]
+	if !ok {
+		return ""
+	}
+
+	parts := []string{"FREQ=" + freq}
+	if rule.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(rule.Interval))
+	}
+	if len(rule.DaysOfWeek) > 0 {
+		days := make([]string, 0, len(rule.DaysOfWeek))
+		for _, d := range rule.DaysOfWeek {
+			if d >= 0 && d < 7 {
+				days = append(days, icalWeekdays[d])
+			}
+		}
+		if len(days) > 0 {
+			parts = append(parts, "BYDAY="+strings.Join(days, ","))
+		}
+	}
+	if rule.DayOfMonth != nil {
+		parts = append(parts, "BYMONTHDAY="+strconv.Itoa(*rule.DayOfMonth))
+	}
+	if rule.Type == "yearly" && (len(rule.DaysOfWeek) > 0 || rule.DayOfMonth != nil) {
+		// Yearly BYDAY/BYMONTHDAY without BYMONTH would match every month
+		parts = append(parts, "BYMONTH="+strconv.Itoa(int(start.Month())))
+	}
+	if rule.Occurrences != nil && *rule.Occurrences > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(*rule.Occurrences))
+	} else if rule.EndDate != nil {
+		if allDay {
+			parts = append(parts, "UNTIL="+rule.EndDate.Format("20060102"))
+		} else {
+			parts = append(parts, "UNTIL="+WallClockInstant(*rule.EndDate, loc).Format("20060102T150405Z"))
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// recurrenceFromRRule parses an RRULE value into a recurrence rule. Parts that
+// RecurrenceRule cannot express make the rule unsupported rather than silently
+// changing which dates recur.
+func recurrenceFromRRule(value string, loc *time.Location) (*models.RecurrenceRule, error) {
+	rule := &models.RecurrenceRule{Interval: 1}
+	for _, part := range strings.Split(value, ";") {
+		key, val, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, ErrICalUnsupportedRRule
+		}
+		switch strings.ToUpper(key) {
+		case "FREQ":
+			for typ, freq := range icalFrequencies {
+				if strings.EqualFold(val, freq) {
+					rule.Type = typ
+				}
+			}
+			if rule.Type == "" {
+				return nil, fmt.Errorf("%w: FREQ=%s", ErrICalUnsupportedRRule, val)
+			}
+		case "INTERVAL":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%w: INTERVAL=%s", ErrICalUnsupportedRRule, val)
+			}
+			rule.Interval = n
+		case "BYDAY":
+			for _, day := range strings.Split(val, ",") {
+				// Ordinal weekdays (e.g. 2MO) have no equivalent; only the day is kept
+				day = strings.ToUpper(strings.TrimLeft(day, "+-0123456789"))
+				found := false
+				for i, code := range icalWeekdays {
+					if day == code {
+						rule.DaysOfWeek = append(rule.DaysOfWeek, i)
+						found = true
+					}
+				}
+				if !found {
+					return nil, fmt.Errorf("%w: BYDAY=%s", ErrICalUnsupportedRRule, val)
+				}
+			}
+		case "BYMONTHDAY":
+			n, err := strconv.Atoi(strings.Split(val, ",")[0])
+			if err != nil || n < 1 || n > 31 {
+				return nil, fmt.Errorf("%w: BYMONTHDAY=%s", ErrICalUnsupportedRRule, val)
+			}
+			rule.DayOfMonth = &n
+		case "COUNT":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%w: COUNT=%s", ErrICalUnsupportedRRule, val)
+			}
+			rule.Occurrences = &n
+		case "UNTIL":
+			until, err := parseRRuleUntil(val, loc)
+			if err != nil {
+				return nil, fmt.Errorf("%w: UNTIL=%s", ErrICalUnsupportedRRule, val)
+			}
+			rule.EndDate = &until
+		case "WKST":
+			// Week start does not affect the rules RecurrenceRule can express
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrICalUnsupportedRRule, key)
+		}
+	}
+	if rule.Type == "" {
+		return nil, ErrICalUnsupportedRRule
+	}
+	return rule, nil
+}
+
+// withoutStartMonth drops a BYMONTH part that names the month of DTSTART
+// from a yearly rule, as written by recurrenceToRRule; it is implied by the
+// start and RecurrenceRule has no field for it
+func withoutStartMonth(value string, start time.Time) string {
+	if !strings.Contains(strings.ToUpper(value), "FREQ=YEARLY") {
+		return value
+	}
+	parts := strings.Split(value, ";")
+	kept := parts[:0]
+	for _, part := range parts {
+		if strings.EqualFold(part, "BYMONTH="+strconv.Itoa(int(start.Month()))) {
+			continue
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, ";")
+}
+
+func parseRRuleUntil(val string, loc *time.Location) (time.Time, error) {
+	switch len(val) {
+	case len("20060102"):
+		return time.ParseInLocation("20060102", val, time.UTC)
+	case len("20060102T150405Z"):
+		t, err := time.Parse("20060102T150405Z", val)
+		if err != nil {
+			return time.Time{}, err
+		}
+		return InstantToWallClock(t, loc), nil
+	default:
+		return time.ParseInLocation("20060102T150405", val, time.UTC)
+	}
+}
+
+// formatTriggerMinutes formats a reminder offset as a negative TRIGGER duration
+func formatTriggerMinutes(minutes int) string {
+	if minutes <= 0 {
+		return "PT0M"
+	}
+	if minutes%(24*60) == 0 {
+		return fmt.Sprintf("-P%dD", minutes/(24*60))
+	}
+	return fmt.Sprintf("-PT%dM", minutes)
+}
+
+// alarmMinutes returns how many minutes before the start a VALARM fires.
+// Alarms after the start cannot be represented and are skipped.
+func alarmMinutes(alarm *ical.Component, start, end time.Time, zones *icalZones) (int, bool) {
+	trigger := alarm.Props.Get(ical.PropTrigger)
+	if trigger == nil {
+		return 0, false
+	}
+
+	var offset time.Duration
+	if trigger.ValueType() == ical.ValueDateTime {
+		at, err := zones.propTime(trigger, trigger.Value)
+		if err != nil {
+			return 0, false
+		}
+		offset = at.Sub(start)
+	} else {
+		dur, err := trigger.Duration()
+		if err != nil {
+			return 0, false
+		}
+		offset = dur
+		if strings.EqualFold(trigger.Params.Get("RELATED"), "END") {
+			offset += end.Sub(start)
+		}
+	}
+
+	if offset > 0 {
+		return 0, false
+	}
+	return int(-offset / time.Minute), true
+}
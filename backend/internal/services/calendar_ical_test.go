@@ -0,0 +1,242 @@
+package services
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tessera/tessera/internal/models"
+)
+
+func TestEventICalRoundTrip(t *testing.T) {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("timezone data unavailable: %v", err)
+	}
+
+	until := time.Date(2025, 6, 30, 9, 0, 0, 0, time.UTC)
+	taskID := "task-1"
+	event := &models.CalendarEvent{
+		ID:          uuid.New(),
+		UID:         "round-trip@tessera",
+		Title:       "Standup",
+		Description: "Daily sync, with commas; and semicolons",
+		StartDate:   time.Date(2025, 3, 3, 9, 0, 0, 0, time.UTC),
+		EndDate:     time.Date(2025, 3, 3, 9, 30, 0, 0, time.UTC),
+		Color:       "#ef4444",
+		Recurrence: &models.RecurrenceRule{
+			Type:       "weekly",
+			Interval:   2,
+			DaysOfWeek: []int{1, 3},
+			EndDate:    &until,
+		},
+		Reminders:    []models.EventReminder{{Minutes: 15}, {Minutes: 1440}},
+		LinkedTaskID: &taskID,
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeICalEvent(&buf, event, loc); err != nil {
+		t.Fatalf("EncodeICalEvent() error = %v", err)
+	}
+	data := buf.String()
+
+	t.Run("writes UTC instants", func(t *testing.T) {
+		// 09:00 in Berlin during CET is 08:00 UTC
+		if !strings.Contains(data, "DTSTART:20250303T080000Z") {
+			t.Errorf("encoded event missing UTC DTSTART:\n%s", data)
+		}
+		if !strings.Contains(data, "RRULE:FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,WE;UNTIL=20250630T070000Z") {
+			t.Errorf("encoded event has unexpected RRULE:\n%s", data)
+		}
+		if !strings.Contains(data, "TRIGGER:-P1D") || !strings.Contains(data, "TRIGGER:-PT15M") {
+			t.Errorf("encoded event missing VALARM triggers:\n%s", data)
+		}
+	})
+
+	t.Run("decodes back to the same event", func(t *testing.T) {
+		got, err := DecodeICalEvent(strings.NewReader(data), loc)
+		if err != nil {
+			t.Fatalf("DecodeICalEvent() error = %v", err)
+		}
+		if got.UID != event.UID || got.Title != event.Title || got.Description != event.Description {
+			t.Errorf("text fields = %q/%q/%q, want %q/%q/%q", got.UID, got.Title, got.Description, event.UID, event.Title, event.Description)
+		}
+		if !got.StartDate.Equal(event.StartDate) || !got.EndDate.Equal(event.EndDate) || got.AllDay {
+			t.Errorf("times = %v-%v allDay=%v, want %v-%v", got.StartDate, got.EndDate, got.AllDay, event.StartDate, event.EndDate)
+		}
+		if got.Color != event.Color || got.LinkedTaskID == nil || *got.LinkedTaskID != taskID {
+			t.Errorf("color/task = %q/%v, want %q/%q", got.Color, got.LinkedTaskID, event.Color, taskID)
+		}
+		rec := got.Recurrence
+		if rec == nil || rec.Type != "weekly" || rec.Interval != 2 || len(rec.DaysOfWeek) != 2 ||
+			rec.DaysOfWeek[0] != 1 || rec.DaysOfWeek[1] != 3 || rec.EndDate == nil || !rec.EndDate.Equal(until) {
+			t.Errorf("recurrence = %+v, want %+v", rec, event.Recurrence)
+		}
+		if len(got.Reminders) != 2 || got.Reminders[0].Minutes != 15 || got.Reminders[1].Minutes != 1440 {
+			t.Errorf("reminders = %+v, want 15 and 1440 minutes", got.Reminders)
+		}
+	})
+}
+
+func TestEventFromICal_AllDay(t *testing.T) {
+	data := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//Test//EN\r\n" +
+		"BEGIN:VEVENT\r\nUID:holiday\r\nDTSTAMP:20250101T000000Z\r\nSUMMARY:Holiday\r\n" +
+		"DTSTART;VALUE=DATE:20250414\r\nDTEND;VALUE=DATE:20250416\r\n" +
+		"RRULE:FREQ=YEARLY;COUNT=3\r\n" +
+		"BEGIN:VALARM\r\nACTION:DISPLAY\r\nTRIGGER;VALUE=DATE-TIME:20250413T230000Z\r\nEND:VALARM\r\n" +
+		"END:VEVENT\r\nEND:VCALENDAR\r\n"
+
+	got, err := DecodeICalEvent(strings.NewReader(data), time.UTC)
+	if err != nil {
+		t.Fatalf("DecodeICalEvent() error = %v", err)
+	}
+	if !got.AllDay {
+		t.Error("AllDay = false, want true")
+	}
+	wantEnd := time.Date(2025, 4, 15, 23, 59, 59, 0, time.UTC)
+	if !got.EndDate.Equal(wantEnd) {
+		t.Errorf("EndDate = %v, want %v (DTEND is exclusive)", got.EndDate, wantEnd)
+	}
+	if got.Recurrence == nil || got.Recurrence.Occurrences == nil || *got.Recurrence.Occurrences != 3 {
+		t.Errorf("Recurrence = %+v, want yearly with 3 occurrences", got.Recurrence)
+	}
+	if len(got.Reminders) != 1 || got.Reminders[0].Minutes != 60 {
+		t.Errorf("Reminders = %+v, want one 60 minutes before", got.Reminders)
+	}
+}
+
+func TestRecurrenceFromRRule(t *testing.T) {
+	t.Run("rejects parts RecurrenceRule cannot express", func(t *testing.T) {
+		if _, err := recurrenceFromRRule("FREQ=MONTHLY;BYSETPOS=-1;BYDAY=FR", time.UTC); err == nil {
+			t.Error("recurrenceFromRRule() accepted BYSETPOS")
+		}
+		if _, err := recurrenceFromRRule("FREQ=HOURLY", time.UTC); err == nil {
+			t.Error("recurrenceFromRRule() accepted FREQ=HOURLY")
+		}
+	})
+
+	t.Run("maps BYMONTHDAY", func(t *testing.T) {
+		rule, err := recurrenceFromRRule("FREQ=MONTHLY;BYMONTHDAY=15", time.UTC)
+		if err != nil {
+			t.Fatalf("recurrenceFromRRule() error = %v", err)
+		}
+		if rule.DayOfMonth == nil || *rule.DayOfMonth != 15 || rule.Interval != 1 {
+			t.Errorf("rule = %+v, want monthly on day 15", rule)
+		}
+	})
+}
+
+func TestDecodeICalCalendar(t *testing.T) {
+	// An Outlook-style export: a non-IANA TZID defined by an embedded VTIMEZONE
+	data := "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//Test//EN\r\n" +
+		"BEGIN:VTIMEZONE\r\nTZID:W. Europe Standard Time\r\n" +
+		"BEGIN:STANDARD\r\nDTSTART:16010101T030000\r\nTZOFFSETFROM:+0200\r\nTZOFFSETTO:+0100\r\n" +
+		"RRULE:FREQ=YEARLY;BYDAY=-1SU;BYMONTH=10\r\nEND:STANDARD\r\n" +
+		"BEGIN:DAYLIGHT\r\nDTSTART:16010101T020000\r\nTZOFFSETFROM:+0100\r\nTZOFFSETTO:+0200\r\n" +
+		"RRULE:FREQ=YEARLY;BYDAY=-1SU;BYMONTH=3\r\nEND:DAYLIGHT\r\nEND:VTIMEZONE\r\n" +
+		"BEGIN:VEVENT\r\nUID:weekly\r\nDTSTAMP:20250101T000000Z\r\nSUMMARY:Weekly\r\n" +
+		"DTSTART;TZID=W. Europe Standard Time:20250707T100000\r\n" +
+		"DTEND;TZID=W. Europe Standard Time:20250707T110000\r\n" +
+		"RRULE:FREQ=WEEKLY\r\n" +
+		"EXDATE;TZID=W. Europe Standard Time:20250714T100000,20250721T100000\r\n" +
+		"END:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nUID:weekly\r\nDTSTAMP:20250101T000000Z\r\nSUMMARY:Weekly (moved)\r\n" +
+		"RECURRENCE-ID;TZID=W. Europe Standard Time:20250728T100000\r\n" +
+		"DTSTART;TZID=W. Europe Standard Time:20250728T120000\r\n" +
+		"DTEND;TZID=W. Europe Standard Time:20250728T130000\r\nEND:VEVENT\r\n" +
+		"BEGIN:VEVENT\r\nUID:broken\r\nDTSTAMP:20250101T000000Z\r\nSUMMARY:No start\r\nEND:VEVENT\r\n" +
+		"END:VCALENDAR\r\n"
+
+	items, err := DecodeICalCalendar(strings.NewReader(data), time.UTC)
+	if err != nil {
+		t.Fatalf("DecodeICalCalendar() error = %v", err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("len(items) = %d, want 2", len(items))
+	}
+
+	t.Run("resolves VTIMEZONE offsets", func(t *testing.T) {
+		event := items[0].Event
+		if event == nil {
+			t.Fatalf("first item error = %v", items[0].Err)
+		}
+		// 10:00 at +02:00 (summer time), stored as wall-clock time in the owner's UTC zone
+		want := time.Date(2025, 7, 7, 8, 0, 0, 0, time.UTC)
+		if !event.StartDate.Equal(want) {
+			t.Errorf("StartDate = %v, want %v", event.StartDate, want)
+		}
+	})
+
+	t.Run("reads EXDATE lists", func(t *testing.T) {
+		rec := items[0].Event.Recurrence
+		if rec == nil || len(rec.ExceptionDates) != 2 {
+			t.Fatalf("Recurrence = %+v, want two exception dates", rec)
+		}
+		want := time.Date(2025, 7, 21, 8, 0, 0, 0, time.UTC)
+		if !rec.ExceptionDates[1].Equal(want) {
+			t.Errorf("ExceptionDates[1] = %v, want %v", rec.ExceptionDates[1], want)
+		}
+	})
+
+	t.Run("attaches modified occurrences", func(t *testing.T) {
+		overrides := items[0].Event.Overrides
+		if len(overrides) != 1 {
+			t.Fatalf("len(Overrides) = %d, want 1", len(overrides))
+		}
+		o := overrides[0]
+		wantID := time.Date(2025, 7, 28, 8, 0, 0, 0, time.UTC)
+		wantStart := time.Date(2025, 7, 28, 10, 0, 0, 0, time.UTC)
+		if o.RecurrenceID == nil || !o.RecurrenceID.Equal(wantID) || !o.StartDate.Equal(wantStart) {
+			t.Errorf("override = %v at %v, want %v at %v", o.RecurrenceID, o.StartDate, wantID, wantStart)
+		}
+		if o.Title != "Weekly (moved)" || o.UID != "weekly" {
+			t.Errorf("override title/uid = %q/%q", o.Title, o.UID)
+		}
+	})
+
+	t.Run("reports per-event errors", func(t *testing.T) {
+		if items[1].Err != ErrICalMissingStart || items[1].UID != "broken" {
+			t.Errorf("broken item = %+v, want ErrICalMissingStart", items[1])
+		}
+	})
+}
+
+func TestEncodeICalCalendar(t *testing.T) {
+	t.Run("writes an empty calendar", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := EncodeICalCalendar(&buf, nil, "Tessera", time.UTC); err != nil {
+			t.Fatalf("EncodeICalCalendar() error = %v", err)
+		}
+		if !strings.HasPrefix(buf.String(), "BEGIN:VCALENDAR\r\n") {
+			t.Errorf("output = %q, want a VCALENDAR", buf.String())
+		}
+	})
+
+	t.Run("round-trips exception dates", func(t *testing.T) {
+		skipped := time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC)
+		events := []models.CalendarEvent{{
+			UID:        "series",
+			Title:      "Series",
+			StartDate:  time.Date(2025, 3, 3, 9, 0, 0, 0, time.UTC),
+			EndDate:    time.Date(2025, 3, 3, 10, 0, 0, 0, time.UTC),
+			Recurrence: &models.RecurrenceRule{Type: "weekly", Interval: 1, ExceptionDates: []time.Time{skipped}},
+		}}
+
+		var buf bytes.Buffer
+		if err := EncodeICalCalendar(&buf, events, "Tessera", time.UTC); err != nil {
+			t.Fatalf("EncodeICalCalendar() error = %v", err)
+		}
+		items, err := DecodeICalCalendar(&buf, time.UTC)
+		if err != nil || len(items) != 1 || items[0].Event == nil {
+			t.Fatalf("DecodeICalCalendar() = %+v, %v", items, err)
+		}
+		got := items[0].Event.Recurrence
+		if got == nil || len(got.ExceptionDates) != 1 || !got.ExceptionDates[0].Equal(skipped) {
+			t.Errorf("Recurrence = %+v, want exception at %v", got, skipped)
+		}
+	})
+}
@@ -0,0 +1,246 @@
+package services
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/teambition/rrule-go"
+	"github.com/tessera/tessera/internal/models"
+)
+
+// ErrInvalidRecurrence is returned for recurrence rules that cannot be expanded
+var ErrInvalidRecurrence = errors.New("invalid recurrence rule")
+
+// Recurring events are stored once, with their RecurrenceRule, cancelled
+// occurrences (RecurrenceRule.ExceptionDates) and overrides; occurrences are
+// generated on read. Everything works on the stored wall-clock times, so a
+// series keeps its local time of day across DST changes.
+
+// maxOccurrencesPerSeries bounds the occurrences generated for one series in
+// a single window
+const maxOccurrencesPerSeries = 1000
+
+var rruleFrequencies = map[string]rrule.Frequency{
+	"daily":   rrule.DAILY,
+	"weekly":  rrule.WEEKLY,
+	"monthly": rrule.MONTHLY,
+	"yearly":  rrule.YEARLY,
+}
+
+// rruleWeekdays is indexed like RecurrenceRule.DaysOfWeek (0 = Sunday)
+var rruleWeekdays = [7]rrule.Weekday{rrule.SU, rrule.MO, rrule.TU, rrule.WE, rrule.TH, rrule.FR, rrule.SA}
+
+// seriesRule builds the occurrence generator of a recurring event
+func seriesRule(series *models.CalendarEvent) (*rrule.RRule, error) {
+	rule := series.Recurrence
+	freq, ok := rruleFrequencies[rule.Type]
+	if !ok {
+		return nil, ErrInvalidRecurrence
+	}
+
+	opt := rrule.ROption{
+		Freq:     freq,
+		Dtstart:  series.StartDate,
+		Interval: rule.Interval,
+	}
+	if opt.Interval < 1 {
+		opt.Interval = 1
+	}
+	for _, d := range rule.DaysOfWeek {
+		if d >= 0 && d < 7 {
+			opt.Byweekday = append(opt.Byweekday, rruleWeekdays[d])
+		}
+	}
+	if rule.DayOfMonth != nil {
+		opt.Bymonthday = []int{*rule.DayOfMonth}
+	}
+	if freq == rrule.YEARLY && (len(opt.Byweekday) > 0 || len(opt.Bymonthday) > 0) {
+		// Without BYMONTH these would repeat in every month of the year
+		opt.Bymonth = []int{int(series.StartDate.Month())}
+	}
+	if rule.Occurrences != nil && *rule.Occurrences > 0 {
+		opt.Count = *rule.Occurrences
+	} else if rule.EndDate != nil {
+		opt.Until = seriesUntil(*rule.EndDate)
+	}
+	return rrule.NewRRule(opt)
+}
+
+// seriesUntil treats an end date without a time of day (as the web client
+// sends it) as including that whole day
+func seriesUntil(end time.Time) time.Time {
+	if end.Hour() == 0 && end.Minute() == 0 && end.Second() == 0 {
+		return end.AddDate(0, 0, 1).Add(-time.Second)
+	}
+	return end
+}
+
+// overlaps mirrors the range test of CalendarRepository.ListByUser
+func overlaps(start, end, rangeStart, rangeEnd time.Time) bool {
+	return !start.After(rangeEnd) && !end.Before(rangeStart)
+}
+
+// exceptionMatcher reports whether an occurrence start is cancelled. Dates
+// without a time (imported EXDATE;VALUE=DATE on timed events) cancel the
+// occurrence on that day.
+func exceptionMatcher(series *models.CalendarEvent) func(time.Time) bool {
+	exact := map[time.Time]bool{}
+	days := map[time.Time]bool{}
+	for _, d := range series.Recurrence.ExceptionDates {
+		d = d.UTC()
+		exact[d] = true
+		if !series.AllDay && d.Hour() == 0 && d.Minute() == 0 && d.Second() == 0 {
+			days[d] = true
+		}
+	}
+	return func(at time.Time) bool {
+		at = at.UTC()
+		return exact[at] || days[time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, time.UTC)]
+	}
+}
+
+// ExpandEvents replaces recurring events by their occurrences overlapping
+// [start, end], sorted by start. Occurrences keep the series ID and carry
+// their RecurrenceID; cancelled occurrences are left out and overridden ones
+// are replaced by the override. Other events are passed through when they
+// overlap the range.
+func ExpandEvents(events []models.CalendarEvent, start, end time.Time) []models.CalendarEvent {
+	out := []models.CalendarEvent{}
+	for i := range events {
+		e := &events[i]
+		if e.Recurrence == nil {
+			if overlaps(e.StartDate, e.EndDate, start, end) {
+				out = append(out, *e)
+			}
+			continue
+		}
+		out = append(out, expandSeries(e, start, end)...)
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].StartDate.Before(out[j].StartDate) })
+	return out
+}
+
+func expandSeries(series *models.CalendarEvent, start, end time.Time) []models.CalendarEvent {
+	rule, err := seriesRule(series)
+	if err != nil {
+		// A rule that cannot be expanded still shows its first occurrence
+		if overlaps(series.StartDate, series.EndDate, start, end) {
+			return []models.CalendarEvent{*series}
+		}
+		return nil
+	}
+
+	duration := series.EndDate.Sub(series.StartDate)
+	cancelled := exceptionMatcher(series)
+	overridden := map[time.Time]bool{}
+	for _, o := range series.Overrides {
+		overridden[o.RecurrenceID.UTC()] = true
+	}
+
+	var out []models.CalendarEvent
+	next := rule.Iterator()
+	for len(out) < maxOccurrencesPerSeries {
+		at, ok := next()
+		if !ok || at.After(end) {
+			break
+		}
+		if cancelled(at) || overridden[at.UTC()] || !overlaps(at, at.Add(duration), start, end) {
+			continue
+		}
+		occ := *series
+		occ.StartDate = at
+		occ.EndDate = at.Add(duration)
+		recurrenceID := at
+		occ.RecurrenceID = &recurrenceID
+		occ.Overrides = nil
+		out = append(out, occ)
+	}
+
+	for _, o := range series.Overrides {
+		if cancelled(*o.RecurrenceID) || !overlaps(o.StartDate, o.EndDate, start, end) {
+			continue
+		}
+		occ := o
+		occ.ID = series.ID
+		occ.SeriesID = nil
+		occ.Recurrence = series.Recurrence
+		occ.LinkedTaskID = series.LinkedTaskID
+		out = append(out, occ)
+	}
+	return out
+}
+
+// IsOccurrence reports whether at is the original start of an occurrence of
+// a recurring event (cancelled occurrences included)
+func IsOccurrence(series *models.CalendarEvent, at time.Time) bool {
+	if series.Recurrence == nil {
+		return false
+	}
+	for _, o := range series.Overrides {
+		if o.RecurrenceID.Equal(at) {
+			return true
+		}
+	}
+	rule, err := seriesRule(series)
+	if err != nil {
+		return at.Equal(series.StartDate)
+	}
+	return len(rule.Between(at, at, true)) > 0
+}
+
+// Occurrence returns the occurrence of a series starting (originally) at at:
+// its override if there is one, otherwise a copy of the series moved to at
+func Occurrence(series *models.CalendarEvent, at time.Time) models.CalendarEvent {
+	for _, o := range series.Overrides {
+		if o.RecurrenceID.Equal(at) {
+			return o
+		}
+	}
+	occ := *series
+	occ.ID = uuid.Nil
+	occ.StartDate = at
+	occ.EndDate = at.Add(series.EndDate.Sub(series.StartDate))
+	occ.Recurrence = nil
+	occ.Overrides = nil
+	recurrenceID := at
+	occ.RecurrenceID = &recurrenceID
+	return occ
+}
+
+// TruncateSeries ends a series just before the occurrence at at, for "this
+// and following" edits. It returns how many occurrences a count-limited rule
+// had left from at on (0 for rules without a count). Exception dates from at
+// on are dropped; overrides are the caller's to delete.
+func TruncateSeries(series *models.CalendarEvent, at time.Time) int {
+	rule := series.Recurrence
+	remaining := 0
+
+	if rule.Occurrences != nil && *rule.Occurrences > 0 {
+		before := 0
+		if r, err := seriesRule(series); err == nil {
+			before = len(r.Between(series.StartDate, at, true))
+			if len(r.Between(at, at, true)) > 0 {
+				before-- // Between includes at itself
+			}
+		}
+		remaining = *rule.Occurrences - before
+		if remaining < 0 {
+			remaining = 0
+		}
+		rule.Occurrences = &before
+	} else {
+		until := at.Add(-time.Second)
+		rule.EndDate = &until
+	}
+
+	var kept []time.Time
+	for _, d := range rule.ExceptionDates {
+		if d.Before(at) {
+			kept = append(kept, d)
+		}
+	}
+	rule.ExceptionDates = kept
+	return remaining
+}
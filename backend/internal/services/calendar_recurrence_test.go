@@ -0,0 +1,127 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tessera/tessera/internal/models"
+)
+
+func weeklySeries() *models.CalendarEvent {
+	return &models.CalendarEvent{
+		ID:         uuid.New(),
+		UID:        "weekly",
+		Title:      "Weekly",
+		StartDate:  time.Date(2025, 3, 3, 9, 0, 0, 0, time.UTC), // a Monday
+		EndDate:    time.Date(2025, 3, 3, 10, 0, 0, 0, time.UTC),
+		Recurrence: &models.RecurrenceRule{Type: "weekly", Interval: 1},
+	}
+}
+
+func TestExpandEvents(t *testing.T) {
+	march := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	endOfMarch := time.Date(2025, 3, 31, 23, 59, 59, 0, time.UTC)
+
+	t.Run("generates occurrences in the range", func(t *testing.T) {
+		series := weeklySeries()
+		got := ExpandEvents([]models.CalendarEvent{*series}, march, endOfMarch)
+		if len(got) != 5 {
+			t.Fatalf("len = %d, want 5 Mondays in March 2025", len(got))
+		}
+		last := got[4]
+		if last.ID != series.ID || last.RecurrenceID == nil || !last.RecurrenceID.Equal(time.Date(2025, 3, 31, 9, 0, 0, 0, time.UTC)) {
+			t.Errorf("last occurrence = %v (%v), want the series ID and recurrence ID 2025-03-31 09:00", last.ID, last.RecurrenceID)
+		}
+		if last.EndDate.Sub(last.StartDate) != time.Hour {
+			t.Errorf("duration = %v, want 1h", last.EndDate.Sub(last.StartDate))
+		}
+	})
+
+	t.Run("applies exception dates and overrides", func(t *testing.T) {
+		series := weeklySeries()
+		series.Recurrence.ExceptionDates = []time.Time{time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC)}
+		moved := time.Date(2025, 3, 17, 9, 0, 0, 0, time.UTC)
+		series.Overrides = []models.CalendarEvent{{
+			Title:        "Moved",
+			StartDate:    time.Date(2025, 3, 18, 14, 0, 0, 0, time.UTC),
+			EndDate:      time.Date(2025, 3, 18, 15, 0, 0, 0, time.UTC),
+			RecurrenceID: &moved,
+		}}
+
+		got := ExpandEvents([]models.CalendarEvent{*series}, march, endOfMarch)
+		if len(got) != 4 {
+			t.Fatalf("len = %d, want 4", len(got))
+		}
+		for _, occ := range got {
+			if occ.StartDate.Day() == 10 || occ.StartDate.Day() == 17 {
+				t.Errorf("occurrence on %v should be cancelled or moved", occ.StartDate)
+			}
+		}
+		if got[1].Title != "Moved" || got[1].ID != series.ID || got[1].StartDate.Day() != 18 {
+			t.Errorf("second occurrence = %q on %v, want the override on the 18th", got[1].Title, got[1].StartDate)
+		}
+	})
+
+	t.Run("honours count and end date", func(t *testing.T) {
+		series := weeklySeries()
+		count := 2
+		series.Recurrence.Occurrences = &count
+		if got := ExpandEvents([]models.CalendarEvent{*series}, march, endOfMarch); len(got) != 2 {
+			t.Errorf("len with COUNT=2 = %d, want 2", len(got))
+		}
+
+		series = weeklySeries()
+		until := time.Date(2025, 3, 17, 0, 0, 0, 0, time.UTC)
+		series.Recurrence.EndDate = &until
+		if got := ExpandEvents([]models.CalendarEvent{*series}, march, endOfMarch); len(got) != 3 {
+			t.Errorf("len with end date 17 March = %d, want 3 (the end date is inclusive)", len(got))
+		}
+	})
+
+	t.Run("keeps yearly rules in the start month", func(t *testing.T) {
+		day := 3
+		series := weeklySeries()
+		series.Recurrence = &models.RecurrenceRule{Type: "yearly", Interval: 1, DayOfMonth: &day}
+		got := ExpandEvents([]models.CalendarEvent{*series}, march, time.Date(2027, 12, 31, 0, 0, 0, 0, time.UTC))
+		if len(got) != 3 {
+			t.Errorf("len = %d, want one occurrence per year", len(got))
+		}
+	})
+}
+
+func TestTruncateSeries(t *testing.T) {
+	split := time.Date(2025, 3, 17, 9, 0, 0, 0, time.UTC)
+
+	t.Run("ends an open series before the occurrence", func(t *testing.T) {
+		series := weeklySeries()
+		series.Recurrence.ExceptionDates = []time.Time{
+			time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC),
+			time.Date(2025, 3, 24, 9, 0, 0, 0, time.UTC),
+		}
+		if remaining := TruncateSeries(series, split); remaining != 0 {
+			t.Errorf("remaining = %d, want 0 for a rule without count", remaining)
+		}
+		if end := series.Recurrence.EndDate; end == nil || !end.Before(split) {
+			t.Errorf("EndDate = %v, want before %v", end, split)
+		}
+		if len(series.Recurrence.ExceptionDates) != 1 {
+			t.Errorf("ExceptionDates = %v, want only the one before the split", series.Recurrence.ExceptionDates)
+		}
+		if IsOccurrence(series, split) {
+			t.Error("the split occurrence is still part of the series")
+		}
+	})
+
+	t.Run("divides a count between both parts", func(t *testing.T) {
+		series := weeklySeries()
+		count := 5
+		series.Recurrence.Occurrences = &count
+		if remaining := TruncateSeries(series, split); remaining != 3 {
+			t.Errorf("remaining = %d, want 3", remaining)
+		}
+		if n := *series.Recurrence.Occurrences; n != 2 {
+			t.Errorf("Occurrences = %d, want 2", n)
+		}
+	})
+}
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tessera/tessera/internal/models"
+)
+
+// ReminderPlanner schedules the reminders of an event after it was created or
+// changed. Reminders planned earlier are checked against the event when they
+// come due, so edits and deletes need no unplanning.
+type ReminderPlanner interface {
+	PlanEventReminders(ctx context.Context, event *models.CalendarEvent)
+}
+
+// ReminderFire is one reminder of one occurrence of an event
+type ReminderFire struct {
+	EventID uuid.UUID
+	UserID  uuid.UUID
+	Title   string
+	// Start is the wall-clock start of the occurrence
+	Start        time.Time
+	AllDay       bool
+	RecurrenceID *time.Time
+	Minutes      int
+	// FireAt is the instant the reminder is due
+	FireAt time.Time
+}
+
+// DueReminders returns the reminders of an event's occurrences that are due
+// in [from, to). loc is the owner's timezone, in which event times are kept.
+func DueReminders(event *models.CalendarEvent, loc *time.Location, from, to time.Time) []ReminderFire {
+	lead := 0
+	for _, r := range event.Reminders {
+		lead = max(lead, r.Minutes)
+	}
+	for _, o := range event.Overrides {
+		for _, r := range o.Reminders {
+			lead = max(lead, r.Minutes)
+		}
+	}
+
+	// Occurrences start at or after their reminders fire; an hour of slack
+	// covers the wall-clock conversion around DST changes
+	windowStart := InstantToWallClock(from, loc).Add(-time.Hour)
+	windowEnd := InstantToWallClock(to, loc).Add(time.Duration(lead)*time.Minute + time.Hour)
+
+	var due []ReminderFire
+	for _, occ := range ExpandEvents([]models.CalendarEvent{*event}, windowStart, windowEnd) {
+		start := WallClockInstant(occ.StartDate, loc)
+		for _, r := range occ.Reminders {
+			fireAt := start.Add(-time.Duration(r.Minutes) * time.Minute)
+			if fireAt.Before(from) || !fireAt.Before(to) {
+				continue
+			}
+			due = append(due, ReminderFire{
+				EventID:      event.ID,
+				UserID:       event.UserID,
+				Title:        occ.Title,
+				Start:        occ.StartDate,
+				AllDay:       occ.AllDay,
+				RecurrenceID: occ.RecurrenceID,
+				Minutes:      r.Minutes,
+				FireAt:       fireAt,
+			})
+		}
+	}
+	return due
+}
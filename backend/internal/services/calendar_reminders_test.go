@@ -0,0 +1,56 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tessera/tessera/internal/models"
+)
+
+func TestDueReminders(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("timezone data not available")
+	}
+
+	t.Run("fires in the owner's timezone", func(t *testing.T) {
+		series := weeklySeries()
+		series.Reminders = []models.EventReminder{{ID: uuid.New(), Minutes: 15}}
+
+		// 09:00 in Berlin on 10 March 2025 is 08:00 UTC
+		from := time.Date(2025, 3, 10, 7, 30, 0, 0, time.UTC)
+		due := DueReminders(series, berlin, from, from.Add(time.Hour))
+		if len(due) != 1 {
+			t.Fatalf("len = %d, want 1", len(due))
+		}
+		if want := time.Date(2025, 3, 10, 7, 45, 0, 0, time.UTC); !due[0].FireAt.Equal(want) {
+			t.Errorf("FireAt = %v, want %v", due[0].FireAt, want)
+		}
+		if due[0].RecurrenceID == nil || due[0].EventID != series.ID {
+			t.Errorf("reminder = %+v, want the occurrence of the series", due[0])
+		}
+	})
+
+	t.Run("uses the reminders of overrides", func(t *testing.T) {
+		series := weeklySeries()
+		series.Reminders = []models.EventReminder{{ID: uuid.New(), Minutes: 15}}
+		moved := time.Date(2025, 3, 17, 9, 0, 0, 0, time.UTC)
+		series.Overrides = []models.CalendarEvent{{
+			Title:        "Moved",
+			StartDate:    time.Date(2025, 3, 17, 12, 0, 0, 0, time.UTC),
+			EndDate:      time.Date(2025, 3, 17, 13, 0, 0, 0, time.UTC),
+			Reminders:    []models.EventReminder{{ID: uuid.New(), Minutes: 60}},
+			RecurrenceID: &moved,
+		}}
+
+		day := time.Date(2025, 3, 17, 0, 0, 0, 0, time.UTC)
+		due := DueReminders(series, time.UTC, day, day.AddDate(0, 0, 1))
+		if len(due) != 1 || due[0].Title != "Moved" || due[0].Minutes != 60 {
+			t.Fatalf("due = %+v, want only the override's reminder", due)
+		}
+		if want := time.Date(2025, 3, 17, 11, 0, 0, 0, time.UTC); !due[0].FireAt.Equal(want) {
+			t.Errorf("FireAt = %v, want %v", due[0].FireAt, want)
+		}
+	})
+}
@@ -0,0 +1,182 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+
+	"github.com/tessera/tessera/internal/models"
+	"github.com/tessera/tessera/internal/repository"
+)
+
+// Change types recorded in the change journal
+const (
+	ChangeCreate  = "create"
+	ChangeUpdate  = "update" // new content
+	ChangeRename  = "rename"
+	ChangeMove    = "move" // to another folder, possibly renamed too
+	ChangeTrash   = "trash"
+	ChangeRestore = "restore"
+	ChangeDelete  = "delete"
+	ChangeShare   = "share" // shared, or a share's permission changed
+	ChangeUnshare = "unshare"
+)
+
+// ChangeJournalRetention is how long changes are kept. A client that
+// hasn't synced for longer must resync in full.
+const ChangeJournalRetention = 30 * 24 * time.Hour
+
+// changePruneBatch is how many changes are pruned at a time
+const changePruneBatch = 1000
+
+const (
+	// DefaultChangeLimit and MaxChangeLimit bound a page of changes
+	DefaultChangeLimit = 500
+	MaxChangeLimit     = 1000
+)
+
+var (
+	// ErrInvalidCursor is returned for a cursor the server didn't issue
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrCursorExpired is returned for a cursor past which changes were
+	// pruned, or one from before the journal was reset. The client has to
+	// list its files again and continue from a new cursor.
+	ErrCursorExpired = errors.New("cursor expired")
+)
+
+// changeStore is where the change journal is kept
+type changeStore interface {
+	Record(ctx context.Context, change *models.FileChange) error
+	List(ctx context.Context, userID uuid.UUID, after int64, limit int) ([]*models.FileChange, error)
+	Bounds(ctx context.Context, userID uuid.UUID) (latest, prunedThrough int64, err error)
+	Prune(ctx context.Context, cutoff time.Time, limit int) (int, error)
+}
+
+// ChangeService keeps a journal of changes to each user's files, so sync
+// clients can fetch what changed since they last synced instead of listing
+// every folder. Changes are journaled for the owner of the file; a folder
+// trashed, restored or deleted is one change, standing for everything in
+// it too.
+type ChangeService struct {
+	repo changeStore
+	log  zerolog.Logger
+}
+
+// NewChangeService creates a new change service
+func NewChangeService(repo *repository.ChangeRepository, log zerolog.Logger) *ChangeService {
+	return &ChangeService{repo: repo, log: log}
+}
+
+// Record journals a change to a file for its owner. A change that can't be
+// recorded is logged rather than failing the change itself.
+func (s *ChangeService) Record(ctx context.Context, changeType string, file *models.File) {
+	s.RecordFor(ctx, file.OwnerID, changeType, file)
+}
+
+// RecordFor journals a change to a file for another user than its owner,
+// such as the user it was shared with
+func (s *ChangeService) RecordFor(ctx context.Context, userID uuid.UUID, changeType string, file *models.File) {
+	if s == nil {
+		return
+	}
+	change := &models.FileChange{
+		UserID:   userID,
+		FileID:   file.ID,
+		ParentID: file.ParentID,
+		Type:     changeType,
+		Name:     file.Name,
+		IsFolder: file.IsFolder,
+	}
+	if err := s.repo.Record(context.WithoutCancel(ctx), change); err != nil {
+		s.log.Error().Err(err).
+			Str("user_id", userID.String()).
+			Str("file_id", file.ID.String()).
+			Str("type", changeType).
+			Msg("Failed to record file change")
+	}
+}
+
+// ChangePage is a page of a user's changes
+type ChangePage struct {
+	Changes []*models.FileChange `json:"changes"`
+	// Cursor continues after the last change on the page, or is the
+	// current position when there are none
+	Cursor  string `json:"cursor"`
+	HasMore bool   `json:"has_more"`
+}
+
+// List returns the changes of a user after cursor, oldest first. Without a
+// cursor it returns none, only the current cursor: clients take it before
+// listing their files in full, then continue from it.
+func (s *ChangeService) List(ctx context.Context, userID uuid.UUID, cursor string, limit int) (*ChangePage, error) {
+	if limit <= 0 {
+		limit = DefaultChangeLimit
+	}
+	limit = min(limit, MaxChangeLimit)
+
+	latest, prunedThrough, err := s.repo.Bounds(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if cursor == "" {
+		return &ChangePage{
+			Changes: make([]*models.FileChange, 0),
+			Cursor:  formatCursor(max(latest, prunedThrough)),
+		}, nil
+	}
+
+	after, err := parseCursor(cursor)
+	if err != nil {
+		return nil, err
+	}
+	if after < prunedThrough || after > max(latest, prunedThrough) {
+		return nil, ErrCursorExpired
+	}
+
+	// One more than asked for tells whether there are more
+	changes, err := s.repo.List(ctx, userID, after, limit+1)
+	if err != nil {
+		return nil, err
+	}
+	page := &ChangePage{Changes: changes, Cursor: cursor}
+	if len(changes) > limit {
+		page.Changes = changes[:limit]
+		page.HasMore = true
+	}
+	if len(page.Changes) > 0 {
+		page.Cursor = formatCursor(page.Changes[len(page.Changes)-1].ID)
+	}
+	return page, nil
+}
+
+// Prune deletes changes older than ChangeJournalRetention, returning how
+// many it deleted
+func (s *ChangeService) Prune(ctx context.Context) (int, error) {
+	cutoff := time.Now().Add(-ChangeJournalRetention)
+	total := 0
+	for {
+		deleted, err := s.repo.Prune(ctx, cutoff, changePruneBatch)
+		total += deleted
+		if err != nil || deleted < changePruneBatch {
+			return total, err
+		}
+	}
+}
+
+// formatCursor and parseCursor turn the ID of the last change a client has
+// into the cursor it's given, and back
+func formatCursor(id int64) string {
+	return strconv.FormatInt(id, 10)
+}
+
+func parseCursor(cursor string) (int64, error) {
+	id, err := strconv.ParseInt(cursor, 10, 64)
+	if err != nil || id < 0 {
+		return 0, ErrInvalidCursor
+	}
+	return id, nil
+}
@@ -0,0 +1,173 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+
+	"github.com/tessera/tessera/internal/models"
+)
+
+// fakeJournal keeps the change journal in memory
+type fakeJournal struct {
+	changes []*models.FileChange
+	pruned  map[uuid.UUID]int64
+	nextID  int64
+}
+
+func (j *fakeJournal) Record(ctx context.Context, change *models.FileChange) error {
+	j.nextID++
+	change.ID = j.nextID
+	change.CreatedAt = time.Now()
+	j.changes = append(j.changes, change)
+	return nil
+}
+
+func (j *fakeJournal) List(ctx context.Context, userID uuid.UUID, after int64, limit int) ([]*models.FileChange, error) {
+	changes := make([]*models.FileChange, 0)
+	for _, c := range j.changes {
+		if c.UserID == userID && c.ID > after && len(changes) < limit {
+			changes = append(changes, c)
+		}
+	}
+	return changes, nil
+}
+
+func (j *fakeJournal) Bounds(ctx context.Context, userID uuid.UUID) (latest, prunedThrough int64, err error) {
+	for _, c := range j.changes {
+		if c.UserID == userID {
+			latest = max(latest, c.ID)
+		}
+	}
+	return latest, j.pruned[userID], nil
+}
+
+func (j *fakeJournal) Prune(ctx context.Context, cutoff time.Time, limit int) (int, error) {
+	kept := j.changes[:0]
+	deleted := 0
+	for _, c := range j.changes {
+		if c.CreatedAt.Before(cutoff) && deleted < limit {
+			j.pruned[c.UserID] = max(j.pruned[c.UserID], c.ID)
+			deleted++
+			continue
+		}
+		kept = append(kept, c)
+	}
+	j.changes = kept
+	return deleted, nil
+}
+
+func TestCursor(t *testing.T) {
+	for _, id := range []int64{0, 1, 1 << 40} {
+		got, err := parseCursor(formatCursor(id))
+		if err != nil || got != id {
+			t.Errorf("parseCursor(formatCursor(%d)) = %d, %v", id, got, err)
+		}
+	}
+	for _, cursor := range []string{"abc", "-1", "1.5", "0x10", " 1", "99999999999999999999"} {
+		if _, err := parseCursor(cursor); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("parseCursor(%q) error = %v, want ErrInvalidCursor", cursor, err)
+		}
+	}
+}
+
+func TestChangeServiceList(t *testing.T) {
+	ctx := context.Background()
+	journal := &fakeJournal{pruned: map[uuid.UUID]int64{}}
+	s := &ChangeService{repo: journal, log: zerolog.Nop()}
+	user, other := uuid.New(), uuid.New()
+
+	// A client takes the cursor, lists its files, then follows changes
+	start, err := s.List(ctx, user, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(start.Changes) != 0 || start.HasMore {
+		t.Errorf("List() without a cursor = %+v, want only a cursor", start)
+	}
+
+	for i := 0; i < 5; i++ {
+		s.Record(ctx, ChangeCreate, &models.File{ID: uuid.New(), OwnerID: user})
+		s.Record(ctx, ChangeCreate, &models.File{ID: uuid.New(), OwnerID: other})
+	}
+
+	cursor := start.Cursor
+	var seen int
+	for _, want := range []struct {
+		changes int
+		hasMore bool
+	}{{2, true}, {2, true}, {1, false}, {0, false}} {
+		page, err := s.List(ctx, user, cursor, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Changes) != want.changes || page.HasMore != want.hasMore {
+			t.Fatalf("page after %s has %d changes, more %v; want %d, %v", cursor, len(page.Changes), page.HasMore, want.changes, want.hasMore)
+		}
+		for _, c := range page.Changes {
+			if c.UserID != user {
+				t.Errorf("page has a change of another user")
+			}
+		}
+		if want.changes == 0 && page.Cursor != cursor {
+			t.Errorf("empty page moved the cursor from %s to %s", cursor, page.Cursor)
+		}
+		seen += len(page.Changes)
+		cursor = page.Cursor
+	}
+	if seen != 5 {
+		t.Errorf("paged through %d changes, want 5", seen)
+	}
+
+	for _, cursor := range []string{"abc", "-3"} {
+		if _, err := s.List(ctx, user, cursor, 0); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("List(%q) error = %v, want ErrInvalidCursor", cursor, err)
+		}
+	}
+	// Past the latest change, such as from before the journal was reset
+	if _, err := s.List(ctx, user, "1000", 0); !errors.Is(err, ErrCursorExpired) {
+		t.Errorf("List() past the latest change: error = %v, want ErrCursorExpired", err)
+	}
+}
+
+func TestChangeServiceExpiredCursor(t *testing.T) {
+	ctx := context.Background()
+	journal := &fakeJournal{pruned: map[uuid.UUID]int64{}}
+	s := &ChangeService{repo: journal, log: zerolog.Nop()}
+	user := uuid.New()
+
+	for i := 0; i < 4; i++ {
+		s.Record(ctx, ChangeUpdate, &models.File{ID: uuid.New(), OwnerID: user})
+	}
+	// The first two are past the retention period
+	for _, c := range journal.changes[:2] {
+		c.CreatedAt = time.Now().Add(-ChangeJournalRetention - time.Hour)
+	}
+	if pruned, err := s.Prune(ctx); err != nil || pruned != 2 {
+		t.Fatalf("Prune() = %d, %v, want 2", pruned, err)
+	}
+
+	// A client that hadn't seen the pruned changes has to resync
+	for _, cursor := range []string{"0", "1"} {
+		if _, err := s.List(ctx, user, cursor, 0); !errors.Is(err, ErrCursorExpired) {
+			t.Errorf("List(%s) error = %v, want ErrCursorExpired", cursor, err)
+		}
+	}
+	page, err := s.List(ctx, user, "2", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Changes) != 2 || page.Cursor != "4" {
+		t.Errorf("List(2) = %d changes up to %s, want 2 up to 4", len(page.Changes), page.Cursor)
+	}
+
+	// A new cursor starts past what was pruned
+	start, err := s.List(ctx, user, "", 0)
+	if err != nil || start.Cursor != "4" {
+		t.Errorf("List() without a cursor = %+v, %v, want cursor 4", start, err)
+	}
+}
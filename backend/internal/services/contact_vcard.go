@@ -0,0 +1,289 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/emersion/go-vcard"
+	"github.com/tessera/tessera/internal/models"
+)
+
+// ErrVCardInvalid is returned for data that is not a single vCard
+var ErrVCardInvalid = errors.New("invalid vCard")
+
+// VCardProductID identifies Tessera as the producer of served vCards
+const VCardProductID = "-//Tessera//Contacts//EN"
+
+// vcardPropFavorite round-trips the favorite flag through clients
+const vcardPropFavorite = "X-TESSERA-FAVORITE"
+
+// Column sizes of the contacts table
+const (
+	contactTextLimit  = 255
+	contactPhoneLimit = 100
+)
+
+// Contacts keep the last card a client wrote (Contact.VCard) so that
+// properties Tessera does not model — extra addresses, IM handles, labels —
+// survive a round trip. Serialising overlays the modelled fields onto that
+// card, editing the preferred instance of each property in place so its
+// parameters (TYPE=work, groups, ...) are kept.
+
+// EncodeContactVCard writes a contact as a vCard 4.0 object
+func EncodeContactVCard(w io.Writer, contact *models.Contact) error {
+	return vcard.NewEncoder(w).Encode(ContactToVCard(contact))
+}
+
+// ContactToVCard builds the vCard 4.0 representation of a contact
+func ContactToVCard(contact *models.Contact) vcard.Card {
+	card := make(vcard.Card)
+	if contact.VCard != "" {
+		if stored, err := vcard.NewDecoder(strings.NewReader(contact.VCard)).Decode(); err == nil {
+			card = stored
+		}
+	}
+
+	card.SetValue(vcard.FieldVersion, "4.0")
+	card.SetValue(vcard.FieldProductID, VCardProductID)
+	card.SetValue(vcard.FieldUID, contact.UID)
+	card.SetRevision(contact.UpdatedAt.UTC())
+
+	name := card.Name()
+	if name == nil {
+		name = &vcard.Name{}
+	}
+	name.GivenName = contact.FirstName
+	name.FamilyName = contact.LastName
+	card.SetName(name)
+	card.SetValue(vcard.FieldFormattedName, contactDisplayName(contact))
+
+	setPreferred(card, vcard.FieldEmail, contact.Email)
+	setPreferredTel(card, contact.Phone)
+	setPreferred(card, vcard.FieldTitle, contact.JobTitle)
+	setPreferred(card, vcard.FieldNote, contact.Notes)
+
+	org := card.Preferred(vcard.FieldOrganization)
+	if contact.Company != "" {
+		if org == nil {
+			card.AddValue(vcard.FieldOrganization, contact.Company)
+		} else {
+			units := strings.SplitN(org.Value, ";", 2)
+			units[0] = contact.Company
+			org.Value = strings.Join(units, ";")
+		}
+	} else if org != nil && !strings.Contains(org.Value, ";") {
+		removeField(card, vcard.FieldOrganization, org)
+	}
+
+	if contact.Birthday != nil {
+		setPreferred(card, vcard.FieldBirthday, contact.Birthday.UTC().Format("20060102"))
+	} else if bday := card.Preferred(vcard.FieldBirthday); bday != nil {
+		// Only drop dates Tessera could have read; partial dates such as --0412 stay
+		if _, ok := parseVCardDate(bday.Value); ok {
+			removeField(card, vcard.FieldBirthday, bday)
+		}
+	}
+
+	delete(card, vcard.FieldPhoto)
+	if contact.Avatar != nil && *contact.Avatar != "" {
+		card.Set(vcard.FieldPhoto, &vcard.Field{Value: *contact.Avatar, Params: vcard.Params{vcard.ParamValue: {"uri"}}})
+	}
+
+	if contact.Favorite {
+		card.SetValue(vcardPropFavorite, "TRUE")
+	} else {
+		delete(card, vcardPropFavorite)
+	}
+
+	return card
+}
+
+// DecodeContactVCard parses a vCard 3.0 or 4.0 object into a contact. The
+// returned contact has no ID, owner or timestamps; VCard holds the card
+// upgraded to 4.0 so unmodelled properties can be written back later.
+func DecodeContactVCard(r io.Reader) (*models.Contact, error) {
+	dec := vcard.NewDecoder(r)
+	card, err := dec.Decode()
+	if err != nil {
+		return nil, ErrVCardInvalid
+	}
+	if _, err := dec.Decode(); err != io.EOF {
+		return nil, ErrVCardInvalid
+	}
+	return ContactFromVCard(card)
+}
+
+// ContactFromVCard converts a parsed vCard into a contact
+func ContactFromVCard(card vcard.Card) (*models.Contact, error) {
+	if card.Get(vcard.FieldVersion) == nil {
+		return nil, ErrVCardInvalid
+	}
+	upgradeToV4(card)
+
+	contact := &models.Contact{UID: card.Value(vcard.FieldUID)}
+
+	if name := card.Name(); name != nil {
+		contact.FirstName = vcardText(name.GivenName)
+		contact.LastName = vcardText(name.FamilyName)
+	} else if fn := vcardText(card.PreferredValue(vcard.FieldFormattedName)); fn != "" {
+		contact.FirstName, contact.LastName, _ = strings.Cut(fn, " ")
+	}
+	if contact.FirstName == "" && contact.LastName == "" {
+		contact.FirstName = vcardText(card.PreferredValue(vcard.FieldFormattedName))
+	}
+
+	contact.Email = card.PreferredValue(vcard.FieldEmail)
+	contact.Phone = strings.TrimPrefix(card.PreferredValue(vcard.FieldTelephone), "tel:")
+	contact.JobTitle = vcardText(card.PreferredValue(vcard.FieldTitle))
+	contact.Notes = vcardText(card.PreferredValue(vcard.FieldNote))
+	if org := card.PreferredValue(vcard.FieldOrganization); org != "" {
+		company, _, _ := strings.Cut(org, ";")
+		contact.Company = vcardText(company)
+	}
+	if bday, ok := parseVCardDate(card.PreferredValue(vcard.FieldBirthday)); ok {
+		contact.Birthday = &bday
+	}
+	if photo := card.PreferredValue(vcard.FieldPhoto); photo != "" {
+		contact.Avatar = &photo
+	}
+	contact.Favorite = strings.EqualFold(card.Value(vcardPropFavorite), "TRUE")
+
+	contact.FirstName = truncateRunes(contact.FirstName, contactTextLimit)
+	contact.LastName = truncateRunes(contact.LastName, contactTextLimit)
+	contact.Email = truncateRunes(contact.Email, contactTextLimit)
+	contact.Phone = truncateRunes(contact.Phone, contactPhoneLimit)
+	contact.Company = truncateRunes(contact.Company, contactTextLimit)
+	contact.JobTitle = truncateRunes(contact.JobTitle, contactTextLimit)
+
+	// The photo is kept in Avatar only, so it is not stored twice
+	stored := make(vcard.Card, len(card))
+	for k, fields := range card {
+		if k != vcard.FieldPhoto {
+			stored[k] = fields
+		}
+	}
+	var buf bytes.Buffer
+	if err := vcard.NewEncoder(&buf).Encode(stored); err != nil {
+		return nil, err
+	}
+	contact.VCard = buf.String()
+
+	return contact, nil
+}
+
+func contactDisplayName(contact *models.Contact) string {
+	name := strings.TrimSpace(contact.FirstName + " " + contact.LastName)
+	switch {
+	case name != "":
+		return name
+	case contact.Company != "":
+		return contact.Company
+	case contact.Email != "":
+		return contact.Email
+	default:
+		return "Unnamed contact"
+	}
+}
+
+// setPreferred replaces the value of the preferred instance of a property,
+// adding one if needed; an empty value removes that instance.
+func setPreferred(card vcard.Card, key, value string) {
+	field := card.Preferred(key)
+	switch {
+	case value == "" && field != nil:
+		removeField(card, key, field)
+	case value == "":
+	case field == nil:
+		card.AddValue(key, value)
+	default:
+		field.Value = value
+	}
+}
+
+// setPreferredTel is setPreferred for TEL, keeping the tel: URI form when the
+// client used it
+func setPreferredTel(card vcard.Card, phone string) {
+	field := card.Preferred(vcard.FieldTelephone)
+	if phone != "" && field != nil && strings.EqualFold(field.Params.Get(vcard.ParamValue), "uri") {
+		field.Value = "tel:" + phone
+		return
+	}
+	setPreferred(card, vcard.FieldTelephone, phone)
+}
+
+func removeField(card vcard.Card, key string, field *vcard.Field) {
+	fields := card[key]
+	for i, f := range fields {
+		if f == field {
+			card[key] = append(fields[:i:i], fields[i+1:]...)
+			break
+		}
+	}
+	if len(card[key]) == 0 {
+		delete(card, key)
+	}
+}
+
+// upgradeToV4 converts a vCard 3.0 card in place: TYPE=pref becomes PREF=1
+// and inline photos (ENCODING=b) become data URIs.
+func upgradeToV4(card vcard.Card) {
+	if strings.HasPrefix(card.Value(vcard.FieldVersion), "4.") {
+		return
+	}
+	card.SetValue(vcard.FieldVersion, "4.0")
+
+	for _, fields := range card {
+		for _, f := range fields {
+			types := f.Params[vcard.ParamType]
+			for i, t := range types {
+				if strings.EqualFold(t, "pref") {
+					f.Params[vcard.ParamType] = append(types[:i:i], types[i+1:]...)
+					f.Params.Set(vcard.ParamPreferred, "1")
+					break
+				}
+			}
+			if len(f.Params[vcard.ParamType]) == 0 {
+				delete(f.Params, vcard.ParamType)
+			}
+		}
+	}
+
+	for _, f := range card[vcard.FieldPhoto] {
+		enc := strings.ToLower(f.Params.Get("ENCODING"))
+		if enc != "b" && enc != "base64" {
+			continue
+		}
+		mediaType := "image/jpeg"
+		if t := f.Params.Get(vcard.ParamType); t != "" {
+			mediaType = "image/" + strings.ToLower(t)
+		}
+		f.Value = "data:" + mediaType + ";base64," + strings.Join(strings.Fields(f.Value), "")
+		f.Params = vcard.Params{vcard.ParamValue: {"uri"}}
+	}
+}
+
+// parseVCardDate parses full BDAY dates in the 3.0 and 4.0 forms
+func parseVCardDate(value string) (time.Time, bool) {
+	for _, layout := range []string{"20060102", "2006-01-02", "2006-01-02T15:04:05Z", "20060102T150405Z"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// vcardText unescapes the text escapes go-vcard leaves in place
+func vcardText(s string) string {
+	return strings.ReplaceAll(s, `\;`, ";")
+}
+
+func truncateRunes(s string, limit int) string {
+	if utf8.RuneCountInString(s) <= limit {
+		return s
+	}
+	return string([]rune(s)[:limit])
+}
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-vcard"
+)
+
+func TestContactVCardRoundTrip(t *testing.T) {
+	// A vCard 3.0 card as written by an older client, with properties Tessera does not model
+	data := "BEGIN:VCARD\r\nVERSION:3.0\r\nPRODID:-//Test//EN\r\nUID:contact-1\r\n" +
+		"N:Lovelace;Ada;;;\r\nFN:Ada Lovelace\r\n" +
+		"EMAIL;TYPE=INTERNET,HOME:ada@home.example\r\n" +
+		"EMAIL;TYPE=INTERNET,WORK,pref:ada@work.example\r\n" +
+		"TEL;TYPE=CELL:+44 20 7946 0000\r\n" +
+		"ORG:Analytical Engines;Research\r\n" +
+		"item1.ADR;TYPE=HOME:;;12 St James's Square;London;;SW1Y 4JH;UK\r\n" +
+		"item1.X-ABLabel:Home\r\n" +
+		"BDAY:1815-12-10\r\n" +
+		"END:VCARD\r\n"
+
+	contact, err := DecodeContactVCard(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("DecodeContactVCard() error = %v", err)
+	}
+
+	t.Run("extracts modelled fields", func(t *testing.T) {
+		if contact.UID != "contact-1" || contact.FirstName != "Ada" || contact.LastName != "Lovelace" {
+			t.Errorf("uid/name = %q/%q/%q", contact.UID, contact.FirstName, contact.LastName)
+		}
+		if contact.Email != "ada@work.example" {
+			t.Errorf("Email = %q, want the TYPE=pref address", contact.Email)
+		}
+		if contact.Phone != "+44 20 7946 0000" || contact.Company != "Analytical Engines" {
+			t.Errorf("phone/company = %q/%q", contact.Phone, contact.Company)
+		}
+		want := time.Date(1815, 12, 10, 0, 0, 0, 0, time.UTC)
+		if contact.Birthday == nil || !contact.Birthday.Equal(want) {
+			t.Errorf("Birthday = %v, want %v", contact.Birthday, want)
+		}
+	})
+
+	// Simulate an edit made in the Tessera UI
+	contact.Email = "ada@new.example"
+	contact.Company = "Difference Engines"
+	contact.UpdatedAt = time.Now()
+
+	var buf bytes.Buffer
+	if err := EncodeContactVCard(&buf, contact); err != nil {
+		t.Fatalf("EncodeContactVCard() error = %v", err)
+	}
+	card, err := vcard.NewDecoder(&buf).Decode()
+	if err != nil {
+		t.Fatalf("re-decoding the served card: %v", err)
+	}
+
+	t.Run("serves vCard 4.0", func(t *testing.T) {
+		if v := card.Value(vcard.FieldVersion); v != "4.0" {
+			t.Errorf("VERSION = %q, want 4.0", v)
+		}
+		if pref := card.Preferred(vcard.FieldEmail); pref == nil || pref.Params.Get(vcard.ParamPreferred) != "1" {
+			t.Errorf("preferred EMAIL = %+v, want PREF=1", pref)
+		}
+	})
+
+	t.Run("applies edits to the preferred instance", func(t *testing.T) {
+		emails := card.Values(vcard.FieldEmail)
+		if len(emails) != 2 || emails[0] != "ada@home.example" || emails[1] != "ada@new.example" {
+			t.Errorf("EMAIL values = %v, want home address kept and work address replaced", emails)
+		}
+		if org := card.Value(vcard.FieldOrganization); org != "Difference Engines;Research" {
+			t.Errorf("ORG = %q, want the unit kept", org)
+		}
+	})
+
+	t.Run("keeps unmodelled properties", func(t *testing.T) {
+		adr := card.Get(vcard.FieldAddress)
+		if adr == nil || adr.Group != "item1" || !strings.Contains(adr.Value, "London") {
+			t.Errorf("ADR = %+v, want the grouped address kept", adr)
+		}
+		if label := card.Get("X-ABLABEL"); label == nil || label.Value != "Home" {
+			t.Errorf("X-ABLabel = %+v, want Home", label)
+		}
+	})
+}
+
+func TestDecodeContactVCard_Invalid(t *testing.T) {
+	inputs := map[string]string{
+		"not a vCard": "hello",
+		"two cards": "BEGIN:VCARD\r\nVERSION:4.0\r\nFN:A\r\nEND:VCARD\r\n" +
+			"BEGIN:VCARD\r\nVERSION:4.0\r\nFN:B\r\nEND:VCARD\r\n",
+		"missing VERSION": "BEGIN:VCARD\r\nFN:A\r\nEND:VCARD\r\n",
+	}
+	for name, data := range inputs {
+		t.Run(name, func(t *testing.T) {
+			if _, err := DecodeContactVCard(strings.NewReader(data)); err == nil {
+				t.Error("DecodeContactVCard() accepted invalid data")
+			}
+		})
+	}
+}
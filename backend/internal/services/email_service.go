@@ -20,6 +20,7 @@ import (
 
 	"github.com/emersion/go-imap/v2"
 	"github.com/emersion/go-imap/v2/imapclient"
+	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 	"github.com/tessera/tessera/internal/models"
 	"github.com/tessera/tessera/internal/repository"
@@ -32,9 +33,20 @@ type EmailService struct {
 	storage   storage.Storage
 	encryptor *security.Encryptor
 	imapPool  *IMAPPool
-	// Pending sends for undo-send feature
+	// Pending sends for undo-send feature, used when no sendQueue is set
 	pendingSends     map[string]*models.PendingSend
 	pendingSendsLock sync.Mutex
+	sendQueue        SendQueue
+	quota            *QuotaService
+	scans            *ScanService
+}
+
+// SendQueue holds undo-send emails until they are due, durably unlike the
+// in-process pendingSends
+type SendQueue interface {
+	ScheduleSend(ctx context.Context, sendID, accountID string, compose *models.ComposeEmail, sendAt time.Time) error
+	// CancelSend reports false if the email is unknown or already being sent
+	CancelSend(ctx context.Context, sendID string) (bool, error)
 }
 
 func NewEmailService(repo *repository.EmailRepository, store storage.Storage, encryptor *security.Encryptor) *EmailService {
@@ -47,6 +59,47 @@ func NewEmailService(repo *repository.EmailRepository, store storage.Storage, en
 	}
 }
 
+// SetSendQueue makes undo-send emails go through the given queue
+func (s *EmailService) SetSendQueue(q SendQueue) {
+	s.sendQueue = q
+}
+
+// SetQuota charges attachments kept in storage to their owner's quota
+func (s *EmailService) SetQuota(quota *QuotaService) {
+	s.quota = quota
+}
+
+// SetScanning scans attachments for malware, received ones before they are
+// stored and uploaded ones before they are sent
+func (s *EmailService) SetScanning(scans *ScanService) {
+	s.scans = scans
+}
+
+// scanAttachment scans a received attachment of the account's, returning
+// ErrInfected, with the virus set on att, if it must not be stored
+func (s *EmailService) scanAttachment(ctx context.Context, account *models.EmailAccount, att *models.EmailAttachment, content []byte) error {
+	if s.scans == nil {
+		return nil
+	}
+	ownerID, _ := uuid.Parse(account.UserID)
+	return s.scans.ScanAttachment(ctx, ownerID, att, content)
+}
+
+// ScanOutgoing scans attachments uploaded to an email of the user's,
+// returning ErrInfected for the first one containing malware
+func (s *EmailService) ScanOutgoing(ctx context.Context, userID uuid.UUID, files []models.FileAttachment) error {
+	if s.scans == nil {
+		return nil
+	}
+	for _, f := range files {
+		att := &models.EmailAttachment{Filename: f.Filename, ContentType: f.ContentType}
+		if err := s.scans.ScanAttachment(ctx, userID, att, f.Data); err != nil {
+			return fmt.Errorf("attachment %s: %w", f.Filename, err)
+		}
+	}
+	return nil
+}
+
 // encryptPassword encrypts a password for storage
 func (s *EmailService) encryptPassword(password string) (string, error) {
 	if s.encryptor == nil || password == "" {
@@ -87,6 +140,81 @@ func (s *EmailService) decryptPassword(encryptedPassword string) (string, error)
 	return string(decrypted), nil
 }
 
+// ReencryptPasswords re-encrypts account passwords encrypted with a previous
+// master key with the current one, after the master key is rotated. It
+// returns how many accounts were updated.
+func (s *EmailService) ReencryptPasswords(ctx context.Context) (int, error) {
+	if s.encryptor == nil {
+		return 0, nil
+	}
+	accounts, err := s.repo.GetAllAccounts(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for _, account := range accounts {
+		imapPassword, imapChanged, err := s.reencryptPassword(account.IMAPPassword)
+		if err != nil {
+			return updated, fmt.Errorf("account %s: %w", account.ID, err)
+		}
+		smtpPassword, smtpChanged, err := s.reencryptPassword(account.SMTPPassword)
+		if err != nil {
+			return updated, fmt.Errorf("account %s: %w", account.ID, err)
+		}
+		if !imapChanged && !smtpChanged {
+			continue
+		}
+		if err := s.repo.UpdateAccountPasswords(ctx, account.ID, imapPassword, smtpPassword); err != nil {
+			return updated, err
+		}
+		updated++
+	}
+	return updated, nil
+}
+
+// reencryptPassword re-encrypts a stored password with the current master
+// key, reporting whether it changed. Plaintext from before encryption is
+// left alone.
+func (s *EmailService) reencryptPassword(stored string) (string, bool, error) {
+	encrypted, err := base64.StdEncoding.DecodeString(stored)
+	if stored == "" || err != nil {
+		return stored, false, nil
+	}
+	reencrypted, changed, err := s.encryptor.Reencrypt(encrypted)
+	if err != nil || !changed {
+		return stored, false, err
+	}
+	return base64.StdEncoding.EncodeToString(reencrypted), true, nil
+}
+
+// attachmentContext marks attachments uploaded with it as the account
+// owner's, so they're encrypted with that user's data key
+func attachmentContext(ctx context.Context, account *models.EmailAccount) context.Context {
+	ownerID, _ := uuid.Parse(account.UserID)
+	return storage.WithOwner(ctx, ownerID)
+}
+
+// storeAttachment keeps the content of an attachment in storage, charged to
+// the account owner's quota. Content that doesn't fit isn't stored; it's
+// fetched from the mail server whenever it's downloaded instead.
+func (s *EmailService) storeAttachment(ctx context.Context, account *models.EmailAccount, storageKey string, content []byte, contentType string) error {
+	ownerID, _ := uuid.Parse(account.UserID)
+	size := int64(len(content))
+	if s.quota != nil {
+		if err := s.quota.Charge(ctx, ownerID, size); err != nil {
+			return err
+		}
+	}
+	if err := s.storage.Upload(attachmentContext(ctx, account), storageKey, bytes.NewReader(content), size, contentType); err != nil {
+		if s.quota != nil {
+			s.quota.Release(ctx, ownerID, size)
+		}
+		return err
+	}
+	return nil
+}
+
 // encryptAccountPasswords encrypts the IMAP and SMTP passwords in an account
 func (s *EmailService) encryptAccountPasswords(account *models.EmailAccount) error {
 	var err error
@@ -536,9 +664,13 @@ func (s *EmailService) syncAllMailToInbox(ctx context.Context, client *imapclien
 							// Find content by matching size (since we deduplicated by content)
 							for _, content := range attachmentContents {
 								if int64(len(content)) == att.Size {
+									// Infected attachments are kept as metadata only
+									if s.scanAttachment(ctx, account, &att, content) != nil {
+										break
+									}
 									storageKey := fmt.Sprintf("email-attachments/%s/%s/%d_%s", account.ID, email.ID, i, att.Filename)
 
-									err := s.storage.Upload(ctx, storageKey, bytes.NewReader(content), int64(len(content)), att.ContentType)
+									err := s.storeAttachment(ctx, account, storageKey, content, att.ContentType)
 									if err != nil {
 										log.Error().Err(err).Str("filename", att.Filename).Msg("Error uploading attachment")
 									} else {
@@ -2176,8 +2308,11 @@ func (s *EmailService) fetchBodiesFromFolder(ctx context.Context, client *imapcl
 				if s.storage != nil {
 					for _, content := range attachmentContents {
 						if int64(len(content)) == att.Size {
+							if s.scanAttachment(ctx, account, &att, content) != nil {
+								break
+							}
 							storageKey := fmt.Sprintf("email-attachments/%s/%s/%d_%s", account.ID, email.ID, i, att.Filename)
-							if uploadErr := s.storage.Upload(ctx, storageKey, bytes.NewReader(content), int64(len(content)), att.ContentType); uploadErr == nil {
+							if uploadErr := s.storeAttachment(ctx, account, storageKey, content, att.ContentType); uploadErr == nil {
 								att.StorageKey = storageKey
 							}
 							break
@@ -2352,8 +2487,11 @@ func (s *EmailService) fetchEmailBody(ctx context.Context, email *models.Email)
 			if s.storage != nil {
 				for _, content := range attachmentContents {
 					if int64(len(content)) == att.Size {
+						if s.scanAttachment(ctx, account, &att, content) != nil {
+							break
+						}
 						storageKey := fmt.Sprintf("email-attachments/%s/%s/%d_%s", account.ID, email.ID, i, att.Filename)
-						if uploadErr := s.storage.Upload(ctx, storageKey, bytes.NewReader(content), int64(len(content)), att.ContentType); uploadErr == nil {
+						if uploadErr := s.storeAttachment(ctx, account, storageKey, content, att.ContentType); uploadErr == nil {
 							att.StorageKey = storageKey
 						}
 						break
@@ -2453,6 +2591,14 @@ func (s *EmailService) DeleteDraft(ctx context.Context, draftID string) error {
 // QueueSend queues an email for delayed sending (undo-send feature)
 func (s *EmailService) QueueSend(ctx context.Context, accountID string, compose *models.ComposeEmail, delaySecs int) (string, error) {
 	id := generateID()
+	if s.sendQueue != nil {
+		sendAt := time.Now().Add(time.Duration(delaySecs) * time.Second)
+		if err := s.sendQueue.ScheduleSend(ctx, id, accountID, compose, sendAt); err != nil {
+			return "", fmt.Errorf("failed to queue email: %w", err)
+		}
+		return id, nil
+	}
+
 	pending := &models.PendingSend{
 		ID:        id,
 		AccountID: accountID,
@@ -2501,6 +2647,17 @@ func (s *EmailService) QueueSend(ctx context.Context, accountID string, compose
 
 // CancelSend cancels a queued email
 func (s *EmailService) CancelSend(ctx context.Context, sendID string) error {
+	if s.sendQueue != nil {
+		cancelled, err := s.sendQueue.CancelSend(ctx, sendID)
+		if err != nil {
+			return err
+		}
+		if !cancelled {
+			return fmt.Errorf("pending send not found or already sent")
+		}
+		return nil
+	}
+
 	s.pendingSendsLock.Lock()
 	defer s.pendingSendsLock.Unlock()
 
@@ -2526,6 +2683,9 @@ func (s *EmailService) DownloadAttachment(ctx context.Context, attachmentID stri
 	if err != nil {
 		return nil, nil, fmt.Errorf("attachment not found: %w", err)
 	}
+	if attachment.Virus != "" {
+		return nil, nil, ErrInfected
+	}
 
 	// If attachment is stored in MinIO, serve from there (fast path)
 	if attachment.StorageKey != "" && s.storage != nil {
@@ -2594,10 +2754,13 @@ func (s *EmailService) DownloadAttachment(ctx context.Context, attachmentID stri
 		if len(section.Bytes) > 0 {
 			data, err := s.extractAttachment(section.Bytes, attachment.Filename)
 			if err == nil && len(data) > 0 {
+				if err := s.scanAttachment(ctx, account, attachment, data); err != nil {
+					return nil, nil, err
+				}
 				// Cache to MinIO for future downloads
 				if s.storage != nil {
 					storageKey := fmt.Sprintf("email-attachments/%s/%s/%s", account.ID, email.ID, attachment.Filename)
-					uploadErr := s.storage.Upload(ctx, storageKey, bytes.NewReader(data), int64(len(data)), attachment.ContentType)
+					uploadErr := s.storeAttachment(ctx, account, storageKey, data, attachment.ContentType)
 					if uploadErr == nil {
 						// Update attachment with storage key
 						s.repo.UpdateAttachmentStorageKey(ctx, attachment.ID, storageKey)
@@ -0,0 +1,175 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+
+	"github.com/tessera/tessera/internal/models"
+	"github.com/tessera/tessera/internal/repository"
+	"github.com/tessera/tessera/internal/security"
+)
+
+// EncryptionService manages the data keys that encrypt stored objects at
+// rest. Each user's objects are encrypted with a data key of their own,
+// stored wrapped by the master key, so rotating the master key only rewraps
+// the data keys. Unwrapped keys are cached in memory.
+type EncryptionService struct {
+	repo      *repository.EncryptionRepository
+	encryptor *security.Encryptor
+	log       zerolog.Logger
+
+	mu      sync.RWMutex
+	keys    map[uuid.UUID][]byte    // unwrapped keys by ID
+	byOwner map[uuid.UUID]uuid.UUID // key IDs by owner
+}
+
+// NewEncryptionService creates a new encryption service
+func NewEncryptionService(repo *repository.EncryptionRepository, encryptor *security.Encryptor, log zerolog.Logger) *EncryptionService {
+	return &EncryptionService{
+		repo:      repo,
+		encryptor: encryptor,
+		log:       log,
+		keys:      make(map[uuid.UUID][]byte),
+		byOwner:   make(map[uuid.UUID]uuid.UUID),
+	}
+}
+
+// DataKey returns the ID and key a user's new objects are encrypted with,
+// creating the key on first use. The nil UUID has a key of its own, for
+// objects uploaded without an owner.
+func (s *EncryptionService) DataKey(ctx context.Context, ownerID uuid.UUID) (uuid.UUID, []byte, error) {
+	s.mu.RLock()
+	keyID, ok := s.byOwner[ownerID]
+	key := s.keys[keyID]
+	s.mu.RUnlock()
+	if ok {
+		return keyID, key, nil
+	}
+
+	stored, err := s.repo.GetOwnerDataKey(ctx, ownerID)
+	if errors.Is(err, repository.ErrDataKeyNotFound) {
+		stored, err = s.createDataKey(ctx, ownerID)
+	}
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	key, err = s.unwrap(stored)
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+
+	s.mu.Lock()
+	s.byOwner[ownerID] = stored.ID
+	s.mu.Unlock()
+	return stored.ID, key, nil
+}
+
+// Key returns the data key with the given ID
+func (s *EncryptionService) Key(ctx context.Context, keyID uuid.UUID) ([]byte, error) {
+	s.mu.RLock()
+	key, ok := s.keys[keyID]
+	s.mu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	stored, err := s.repo.GetDataKey(ctx, keyID)
+	if err != nil {
+		return nil, err
+	}
+	return s.unwrap(stored)
+}
+
+// createDataKey generates and stores a user's data key. Another request
+// may store one first, in which case that one is returned.
+func (s *EncryptionService) createDataKey(ctx context.Context, ownerID uuid.UUID) (*models.DataKey, error) {
+	key, err := security.GenerateDataKey()
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := s.encryptor.WrapKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.repo.CreateDataKey(ctx, &models.DataKey{
+		ID:          uuid.New(),
+		OwnerID:     ownerID,
+		WrappedKey:  wrapped,
+		MasterKeyID: s.encryptor.KeyID(),
+	})
+}
+
+// unwrap decrypts a stored data key and caches it
+func (s *EncryptionService) unwrap(stored *models.DataKey) ([]byte, error) {
+	key, err := s.encryptor.UnwrapKey(stored.WrappedKey, stored.MasterKeyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key %s: %w", stored.ID, err)
+	}
+	s.mu.Lock()
+	s.keys[stored.ID] = key
+	s.mu.Unlock()
+	return key, nil
+}
+
+// RotateDataKeys rewraps the data keys wrapped by previous master keys with
+// the current one. Stored objects stay as they are. It returns how many
+// keys were rewrapped.
+func (s *EncryptionService) RotateDataKeys(ctx context.Context) (int, error) {
+	current := s.encryptor.KeyID()
+	stale, err := s.repo.ListDataKeysNotWrappedBy(ctx, current)
+	if err != nil {
+		return 0, err
+	}
+
+	rotated := 0
+	for _, stored := range stale {
+		key, err := s.encryptor.UnwrapKey(stored.WrappedKey, stored.MasterKeyID)
+		if err != nil {
+			return rotated, fmt.Errorf("failed to unwrap data key %s: %w", stored.ID, err)
+		}
+		wrapped, err := s.encryptor.WrapKey(key)
+		if err != nil {
+			return rotated, err
+		}
+		ok, err := s.repo.RewrapDataKey(ctx, stored.ID, stored.MasterKeyID, wrapped, current)
+		if err != nil {
+			return rotated, err
+		}
+		if ok {
+			rotated++
+		}
+	}
+	if rotated > 0 {
+		s.log.Info().Int("data_keys", rotated).Str("master_key_id", current).Msg("Rewrapped data keys")
+	}
+	return rotated, nil
+}
+
+// EncryptionStatus describes the data keys
+type EncryptionStatus struct {
+	MasterKeyID string `json:"master_key_id"`
+	DataKeys    int64  `json:"data_keys"`
+	// DataKeysToRotate are still wrapped by a previous master key
+	DataKeysToRotate int64 `json:"data_keys_to_rotate"`
+}
+
+// Status returns how many data keys there are and how many need rewrapping
+func (s *EncryptionService) Status(ctx context.Context) (*EncryptionStatus, error) {
+	current := s.encryptor.KeyID()
+	total, stale, err := s.repo.CountDataKeys(ctx, current)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptionStatus{MasterKeyID: current, DataKeys: total, DataKeysToRotate: stale}, nil
+}
+
+// ListStoredObjects lists stored objects in key order after the given key,
+// with the users they belong to
+func (s *EncryptionService) ListStoredObjects(ctx context.Context, after string, limit int) ([]repository.StoredObject, error) {
+	return s.repo.ListStoredObjects(ctx, after, limit)
+}
@@ -0,0 +1,351 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"golang.org/x/net/html"
+
+	"github.com/tessera/tessera/internal/models"
+	"github.com/tessera/tessera/internal/repository"
+	"github.com/tessera/tessera/internal/storage"
+)
+
+const (
+	// indexMaxSourceBytes bounds how much of a file is read for indexing
+	indexMaxSourceBytes = 64 * 1024 * 1024
+	// indexMaxTextBytes bounds the indexed text of one file, keeping its
+	// tsvector well under Postgres' 1 MB limit
+	indexMaxTextBytes = 512 * 1024
+	// indexMaxEntryBytes bounds how much of one member of an Office
+	// document is decompressed
+	indexMaxEntryBytes = 32 * 1024 * 1024
+	// indexMaxPDFPages bounds how many pages of a PDF are read
+	indexMaxPDFPages = 100
+)
+
+// ErrExtractText is returned when no text can be extracted from a file's
+// content; indexing again won't help
+var ErrExtractText = errors.New("cannot extract text")
+
+// FileIndexQueue schedules content indexing in the background
+type FileIndexQueue interface {
+	ScheduleFileIndex(ctx context.Context, fileID, userID string) error
+}
+
+// text formats the index can read
+const (
+	textPlain    = "text"
+	textDocument = "document" // .tdoc and .md files from the document editor
+	textHTML     = "html"
+	textPDF      = "pdf"
+	textOOXML    = "ooxml"
+)
+
+var textExtensions = map[string]string{
+	".txt": textPlain, ".text": textPlain, ".log": textPlain, ".csv": textPlain, ".tsv": textPlain,
+	".json": textPlain, ".xml": textPlain, ".yaml": textPlain, ".yml": textPlain, ".toml": textPlain,
+	".ini": textPlain, ".conf": textPlain, ".rst": textPlain, ".tex": textPlain,
+	".md": textDocument, ".markdown": textDocument, ".tdoc": textDocument,
+	".html": textHTML, ".htm": textHTML,
+	".pdf":  textPDF,
+	".docx": textOOXML, ".xlsx": textOOXML, ".pptx": textOOXML,
+}
+
+// FileIndexService extracts text from files into the full-text index. PDFs
+// need pdftotext on the PATH and are skipped without it.
+type FileIndexService struct {
+	fileRepo  *repository.FileRepository
+	storage   storage.Storage
+	log       zerolog.Logger
+	pdftotext string
+}
+
+// NewFileIndexService creates a new file index service
+func NewFileIndexService(fileRepo *repository.FileRepository, store storage.Storage, log zerolog.Logger) *FileIndexService {
+	s := &FileIndexService{
+		fileRepo: fileRepo,
+		storage:  store,
+		log:      log,
+	}
+	s.pdftotext, _ = exec.LookPath("pdftotext")
+	if s.pdftotext == "" {
+		log.Info().Msg("pdftotext not found - PDF content search disabled")
+	}
+	return s
+}
+
+// textFormat returns how a file's text can be read, or "" if it can't
+func textFormat(file *models.File) string {
+	if file.IsFolder {
+		return ""
+	}
+	if format, ok := textExtensions[strings.ToLower(filepath.Ext(file.Name))]; ok {
+		return format
+	}
+	switch {
+	case file.MimeType == "text/html":
+		return textHTML
+	case strings.HasPrefix(file.MimeType, "text/"), file.MimeType == "application/json":
+		return textPlain
+	case file.MimeType == "application/pdf":
+		return textPDF
+	default:
+		return ""
+	}
+}
+
+// Indexable reports whether text can be extracted from a file
+func (s *FileIndexService) Indexable(file *models.File) bool {
+	format := textFormat(file)
+	return format != "" && (format != textPDF || s.pdftotext != "")
+}
+
+// Index extracts the text of a file's current content and stores it. Files
+// without extractable text are stored empty, so they aren't retried.
+func (s *FileIndexService) Index(ctx context.Context, file *models.File) error {
+	if !s.Indexable(file) {
+		return s.fileRepo.DeleteContent(ctx, file.ID)
+	}
+
+	text, err := s.extract(ctx, file)
+	if errors.Is(err, ErrExtractText) {
+		s.log.Warn().Err(err).Str("file_id", file.ID.String()).Msg("Indexing file without content")
+		text = ""
+	} else if err != nil {
+		return err
+	}
+
+	return s.fileRepo.SaveContent(ctx, file.ID, file.OwnerID, cleanIndexText(text), file.Hash)
+}
+
+// Remove drops a file from the index
+func (s *FileIndexService) Remove(ctx context.Context, fileID uuid.UUID) error {
+	return s.fileRepo.DeleteContent(ctx, fileID)
+}
+
+func (s *FileIndexService) extract(ctx context.Context, file *models.File) (string, error) {
+	if file.Size > indexMaxSourceBytes {
+		return "", fmt.Errorf("%w: file is larger than %d bytes", ErrExtractText, indexMaxSourceBytes)
+	}
+
+	reader, err := s.storage.Download(ctx, file.StorageKey)
+	if err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, indexMaxSourceBytes))
+	reader.Close()
+	if err != nil {
+		return "", err
+	}
+
+	switch textFormat(file) {
+	case textDocument:
+		return documentText(data), nil
+	case textHTML:
+		return htmlText(bytes.NewReader(data)), nil
+	case textPDF:
+		return s.pdfText(ctx, data)
+	case textOOXML:
+		return ooxmlText(data)
+	default:
+		return string(data), nil
+	}
+}
+
+// documentText reads a document saved by the editor, a JSON envelope with a
+// title and HTML or Markdown content. Anything else is taken as plain text.
+func documentText(data []byte) string {
+	var doc struct {
+		Title   string `json:"title"`
+		Content string `json:"content"`
+		Format  string `json:"format"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil || (doc.Title == "" && doc.Content == "") {
+		return string(data)
+	}
+
+	content := doc.Content
+	if doc.Format == "html" {
+		content = htmlText(strings.NewReader(content))
+	}
+	return doc.Title + "\n" + content
+}
+
+// htmlText returns the visible text of an HTML document
+func htmlText(r io.Reader) string {
+	var b strings.Builder
+	tokens := html.NewTokenizer(r)
+	skip := 0
+	for {
+		switch tokens.Next() {
+		case html.ErrorToken:
+			return b.String()
+		case html.StartTagToken:
+			if name, _ := tokens.TagName(); isHiddenTag(name) {
+				skip++
+			}
+		case html.EndTagToken:
+			if name, _ := tokens.TagName(); isHiddenTag(name) && skip > 0 {
+				skip--
+			}
+		case html.TextToken:
+			if skip == 0 {
+				b.Write(tokens.Text())
+				b.WriteByte(' ')
+			}
+		}
+	}
+}
+
+func isHiddenTag(name []byte) bool {
+	switch string(name) {
+	case "script", "style", "noscript", "template":
+		return true
+	default:
+		return false
+	}
+}
+
+// pdfText extracts the text of a PDF with pdftotext
+func (s *FileIndexService) pdfText(ctx context.Context, data []byte) (string, error) {
+	dir, err := os.MkdirTemp("", "tessera-index-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "source.pdf")
+	if err := os.WriteFile(src, data, 0o600); err != nil {
+		return "", err
+	}
+
+	out, err := runTool(ctx, ErrExtractText, s.pdftotext,
+		"-q", "-enc", "UTF-8", "-l", fmt.Sprint(indexMaxPDFPages), src, "-",
+	)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+// ooxmlText extracts the text runs of a Word, Excel or PowerPoint document
+func ooxmlText(data []byte) (string, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrExtractText, err)
+	}
+
+	var parts []*zip.File
+	for _, f := range archive.File {
+		name := f.Name
+		switch {
+		case name == "word/document.xml",
+			strings.HasPrefix(name, "word/header"), strings.HasPrefix(name, "word/footer"),
+			name == "xl/sharedStrings.xml",
+			strings.HasPrefix(name, "ppt/slides/slide") && strings.HasSuffix(name, ".xml"):
+			parts = append(parts, f)
+		}
+	}
+	// slide2.xml before slide10.xml
+	sort.Slice(parts, func(i, j int) bool {
+		if len(parts[i].Name) != len(parts[j].Name) {
+			return len(parts[i].Name) < len(parts[j].Name)
+		}
+		return parts[i].Name < parts[j].Name
+	})
+
+	var b strings.Builder
+	for _, part := range parts {
+		if b.Len() >= indexMaxTextBytes {
+			break
+		}
+		rc, err := part.Open()
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrExtractText, err)
+		}
+		err = xmlTextRuns(&b, io.LimitReader(rc, indexMaxEntryBytes))
+		rc.Close()
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrExtractText, err)
+		}
+	}
+	return b.String(), nil
+}
+
+// xmlTextRuns copies the content of <t> elements (w:t, a:t and the shared
+// strings of a workbook), ending a line at each paragraph
+func xmlTextRuns(b *strings.Builder, r io.Reader) error {
+	decoder := xml.NewDecoder(r)
+	inText := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "t":
+				inText = true
+			case "tab", "br":
+				b.WriteByte(' ')
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p", "si":
+				b.WriteByte('\n')
+			}
+		case xml.CharData:
+			if inText {
+				b.Write(t)
+			}
+		}
+	}
+}
+
+// cleanIndexText makes extracted text safe to store: valid UTF-8 without NUL
+// bytes or snippet markers, whitespace collapsed, and capped in size
+func cleanIndexText(text string) string {
+	text = strings.ToValidUTF8(text, " ")
+
+	var b strings.Builder
+	space := false
+	for _, r := range text {
+		if unicode.IsSpace(r) || r == 0 || unicode.IsControl(r) ||
+			string(r) == repository.SnippetStart || string(r) == repository.SnippetStop {
+			space = true
+			continue
+		}
+		if b.Len()+utf8.RuneLen(r)+1 > indexMaxTextBytes {
+			break
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
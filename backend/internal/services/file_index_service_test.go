@@ -0,0 +1,87 @@
+package services
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/tessera/tessera/internal/models"
+)
+
+func TestTextFormat(t *testing.T) {
+	tests := []struct {
+		name, mimeType, want string
+	}{
+		{"notes.txt", "text/plain", textPlain},
+		{"Report.DOCX", "application/octet-stream", textOOXML},
+		{"page", "text/html", textHTML},
+		{"draft.md", "application/octet-stream", textDocument},
+		{"photo.jpg", "image/jpeg", ""},
+	}
+	for _, tt := range tests {
+		if got := textFormat(&models.File{Name: tt.name, MimeType: tt.mimeType}); got != tt.want {
+			t.Errorf("textFormat(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExtractText(t *testing.T) {
+	t.Run("editor documents", func(t *testing.T) {
+		got := documentText([]byte(`{"title":"Plan","content":"<p>Ship <b>it</b></p>","format":"html"}`))
+		if got := cleanIndexText(got); got != "Plan Ship it" {
+			t.Errorf("text = %q, want %q", got, "Plan Ship it")
+		}
+		if got := documentText([]byte("# Just markdown")); got != "# Just markdown" {
+			t.Errorf("text = %q, want the file as is", got)
+		}
+	})
+
+	t.Run("HTML skips scripts", func(t *testing.T) {
+		got := cleanIndexText(htmlText(strings.NewReader(`<html><script>var x</script><body><h1>Hello</h1>world</body></html>`)))
+		if got != "Hello world" {
+			t.Errorf("text = %q, want %q", got, "Hello world")
+		}
+	})
+
+	t.Run("Word documents", func(t *testing.T) {
+		var buf bytes.Buffer
+		archive := zip.NewWriter(&buf)
+		w, _ := archive.Create("word/document.xml")
+		w.Write([]byte(`<w:document xmlns:w="http://schemas.openxmlformats.org/wordprocessingml/2006/main"><w:body>` +
+			`<w:p><w:r><w:t>Quarterly</w:t></w:r><w:r><w:t xml:space="preserve"> report</w:t></w:r></w:p>` +
+			`<w:p><w:r><w:t>Revenue</w:t></w:r></w:p></w:body></w:document>`))
+		archive.Close()
+
+		got, err := ooxmlText(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != "Quarterly report\nRevenue\n" {
+			t.Errorf("text = %q", got)
+		}
+
+		if _, err := ooxmlText([]byte("not a zip")); err == nil {
+			t.Error("want an error for a corrupt document")
+		}
+	})
+}
+
+func TestCleanIndexText(t *testing.T) {
+	got := cleanIndexText("a\x00b ⟦c⟧\n\n d\xff")
+	if got != "a b c d" {
+		t.Errorf("text = %q, want %q", got, "a b c d")
+	}
+
+	long := cleanIndexText(strings.Repeat("word ", indexMaxTextBytes))
+	if len(long) > indexMaxTextBytes {
+		t.Errorf("len = %d, want at most %d", len(long), indexMaxTextBytes)
+	}
+}
+
+func TestHighlightSnippet(t *testing.T) {
+	got := highlightSnippet("<b>x</b> ⟦match⟧")
+	if want := "&lt;b&gt;x&lt;/b&gt; <mark>match</mark>"; got != want {
+		t.Errorf("snippet = %q, want %q", got, want)
+	}
+}
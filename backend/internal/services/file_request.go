@@ -0,0 +1,289 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/tessera/tessera/internal/models"
+	"github.com/tessera/tessera/internal/repository"
+)
+
+// PermissionUpload is the permission of a file request: a public link to a
+// folder that visitors upload files into without seeing what it holds
+const PermissionUpload = "upload"
+
+var (
+	// ErrNotFolder is returned for a file request on something other than a
+	// folder
+	ErrNotFolder = errors.New("not a folder")
+	// ErrFileRequestClosed is returned for uploads to a file request that
+	// expired, received all its uploads or lost its folder
+	ErrFileRequestClosed = errors.New("file request is closed")
+	// ErrFileTypeNotAllowed is returned for uploads whose extension the file
+	// request doesn't accept
+	ErrFileTypeNotAllowed = errors.New("file type not allowed")
+	// ErrFileTooLarge is returned for uploads over the file request's size
+	// limit
+	ErrFileTooLarge = errors.New("file exceeds the size limit")
+	// ErrUploadNotAllowed is returned for uploads to a share that isn't a
+	// file request
+	ErrUploadNotAllowed = errors.New("upload not allowed")
+	// ErrPasswordRequired and ErrInvalidPassword are returned for a public
+	// share protected by a password when none or the wrong one is given
+	ErrPasswordRequired = errors.New("password required")
+	ErrInvalidPassword  = errors.New("invalid password")
+)
+
+// CreateFileRequestInput contains file request creation data
+type CreateFileRequestInput struct {
+	FolderID          uuid.UUID
+	OwnerID           uuid.UUID
+	ExpiresInDays     *int
+	Password          *string
+	MaxFileSize       *int64
+	MaxUploads        *int
+	AllowedExtensions []string
+}
+
+// FileRequestResponse represents the file request returned to its owner
+type FileRequestResponse struct {
+	ID                uuid.UUID  `json:"id"`
+	Token             string     `json:"token"`
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"`
+	HasPassword       bool       `json:"has_password"`
+	MaxFileSize       *int64     `json:"max_file_size,omitempty"`
+	MaxUploads        *int       `json:"max_uploads,omitempty"`
+	AllowedExtensions []string   `json:"allowed_extensions,omitempty"`
+}
+
+// CreateFileRequest creates a public link that lets visitors upload files
+// into one of the owner's folders. Uploads belong to the owner and count
+// towards their quota.
+func (s *FileService) CreateFileRequest(ctx context.Context, input CreateFileRequestInput) (*FileRequestResponse, error) {
+	folder, err := s.Get(ctx, input.FolderID, input.OwnerID)
+	if err != nil {
+		return nil, err
+	}
+	if !folder.IsFolder || folder.IsTrashed {
+		return nil, ErrNotFolder
+	}
+
+	token := uuid.New().String()[:12]
+
+	var expiresAt *time.Time
+	if input.ExpiresInDays != nil && *input.ExpiresInDays > 0 {
+		exp := time.Now().Add(time.Duration(*input.ExpiresInDays) * 24 * time.Hour)
+		expiresAt = &exp
+	}
+
+	var passwordHash *string
+	if input.Password != nil && *input.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(*input.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash password: %w", err)
+		}
+		hashStr := string(hash)
+		passwordHash = &hashStr
+	}
+
+	share := &models.Share{
+		FileID:            folder.ID,
+		OwnerID:           input.OwnerID,
+		PublicToken:       &token,
+		Permission:        PermissionUpload,
+		PasswordHash:      passwordHash,
+		ExpiresAt:         expiresAt,
+		MaxUploadSize:     input.MaxFileSize,
+		MaxUploads:        input.MaxUploads,
+		AllowedExtensions: normalizeExtensions(input.AllowedExtensions),
+	}
+	if err := s.fileRepo.CreateShare(ctx, share); err != nil {
+		return nil, err
+	}
+	s.changes.Record(ctx, ChangeShare, folder)
+
+	return &FileRequestResponse{
+		ID:                share.ID,
+		Token:             token,
+		ExpiresAt:         expiresAt,
+		HasPassword:       passwordHash != nil,
+		MaxFileSize:       share.MaxUploadSize,
+		MaxUploads:        share.MaxUploads,
+		AllowedExtensions: share.AllowedExtensions,
+	}, nil
+}
+
+// normalizeExtensions lowercases extensions and gives them a leading dot,
+// dropping empty ones and repeats. It returns nil, accepting any file, when
+// none are left.
+func normalizeExtensions(exts []string) []string {
+	var normalized []string
+	for _, ext := range exts {
+		ext = strings.ToLower(strings.TrimSpace(ext))
+		if ext == "" || ext == "." {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if !slices.Contains(normalized, ext) {
+			normalized = append(normalized, ext)
+		}
+	}
+	return normalized
+}
+
+// fileRequestInfo describes a file request to visitors
+func fileRequestInfo(share *models.Share, folder *models.File) (*ShareInfo, error) {
+	if folder.IsTrashed {
+		return nil, ErrFileRequestClosed
+	}
+	info := &ShareInfo{
+		FileName:          folder.Name,
+		IsFolder:          true,
+		HasPassword:       share.PasswordHash != nil,
+		FileRequest:       true,
+		ExpiresAt:         share.ExpiresAt,
+		MaxFileSize:       share.MaxUploadSize,
+		AllowedExtensions: share.AllowedExtensions,
+	}
+	if share.MaxUploads != nil {
+		left := *share.MaxUploads - share.UploadCount
+		if left <= 0 {
+			return nil, ErrFileRequestClosed
+		}
+		info.UploadsLeft = &left
+	}
+	return info, nil
+}
+
+// FileRequestUpload is a file uploaded to a file request
+type FileRequestUpload struct {
+	Token    string
+	Password string
+	Name     string
+	Size     int64
+	Reader   io.Reader
+}
+
+// UploadToShare stores a file uploaded to a file request in the request's
+// folder. A file of the same name already there is kept and the upload
+// renamed, so visitors can't overwrite or learn of each other's uploads.
+func (s *FileService) UploadToShare(ctx context.Context, upload FileRequestUpload) (*models.Share, *models.File, error) {
+	share, err := s.fileRepo.GetShareByToken(ctx, upload.Token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if share.Permission != PermissionUpload {
+		return nil, nil, ErrUploadNotAllowed
+	}
+	if share.ExpiresAt != nil && share.ExpiresAt.Before(time.Now()) {
+		return nil, nil, ErrFileRequestClosed
+	}
+	if err := checkSharePassword(share, upload.Password); err != nil {
+		return nil, nil, err
+	}
+
+	name := zipSafeName(strings.TrimSpace(upload.Name))
+	if err := checkFileRequestUpload(share, name, upload.Size); err != nil {
+		return nil, nil, err
+	}
+
+	folder, err := s.fileRepo.GetByID(ctx, share.FileID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if folder.IsTrashed {
+		return nil, nil, ErrFileRequestClosed
+	}
+
+	// The upload is counted before it's stored, so concurrent ones can't
+	// exceed the limit, and given back if storing it fails
+	allowed, err := s.fileRepo.ReserveShareUpload(ctx, share.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !allowed {
+		return nil, nil, ErrFileRequestClosed
+	}
+
+	file, err := s.uploadToFolder(ctx, folder, name, upload)
+	if err != nil {
+		if err := s.fileRepo.ReleaseShareUpload(context.WithoutCancel(ctx), share.ID); err != nil {
+			s.log.Warn().Err(err).Str("share_id", share.ID.String()).Msg("Failed to release file request upload")
+		}
+		return nil, nil, err
+	}
+	return share, file, nil
+}
+
+// checkFileRequestUpload checks a file named name of size bytes, or of an
+// unknown size if negative, is one the file request accepts
+func checkFileRequestUpload(share *models.Share, name string, size int64) error {
+	if len(share.AllowedExtensions) > 0 && !slices.Contains(share.AllowedExtensions, strings.ToLower(path.Ext(name))) {
+		return ErrFileTypeNotAllowed
+	}
+	if share.MaxUploadSize != nil && (size < 0 || size > *share.MaxUploadSize) {
+		return ErrFileTooLarge
+	}
+	return nil
+}
+
+func (s *FileService) uploadToFolder(ctx context.Context, folder *models.File, name string, upload FileRequestUpload) (*models.File, error) {
+	name, err := s.freeName(ctx, folder, name)
+	if err != nil {
+		return nil, err
+	}
+	return s.UploadFile(ctx, UploadInput{
+		OwnerID:  folder.OwnerID,
+		ParentID: &folder.ID,
+		Name:     name,
+		Size:     upload.Size,
+		Reader:   upload.Reader,
+	})
+}
+
+// freeName returns name, or name with a number added before the extension,
+// whichever no file in the folder has yet
+func (s *FileService) freeName(ctx context.Context, folder *models.File, name string) (string, error) {
+	unique := name
+	for n := 2; ; n++ {
+		_, err := s.fileRepo.GetByName(ctx, folder.OwnerID, &folder.ID, unique)
+		if errors.Is(err, repository.ErrFileNotFound) {
+			return unique, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		unique = numberedName(name, n)
+	}
+}
+
+// numberedName adds n to name before its extension: "report (2).pdf"
+func numberedName(name string, n int) string {
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext)
+}
+
+// checkSharePassword checks the password given for a public share
+func checkSharePassword(share *models.Share, password string) error {
+	if share.PasswordHash == nil {
+		return nil
+	}
+	if password == "" {
+		return ErrPasswordRequired
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(*share.PasswordHash), []byte(password)); err != nil {
+		return ErrInvalidPassword
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package services
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/tessera/tessera/internal/models"
+)
+
+func TestNormalizeExtensions(t *testing.T) {
+	tests := []struct {
+		exts []string
+		want []string
+	}{
+		{nil, nil},
+		{[]string{"pdf", ".PDF", " .Docx ", "", "."}, []string{".pdf", ".docx"}},
+		{[]string{"tar.gz"}, []string{".tar.gz"}},
+	}
+	for _, tt := range tests {
+		if got := normalizeExtensions(tt.exts); !slices.Equal(got, tt.want) {
+			t.Errorf("normalizeExtensions(%q) = %q, want %q", tt.exts, got, tt.want)
+		}
+	}
+}
+
+func TestCheckFileRequestUpload(t *testing.T) {
+	maxSize := int64(10)
+	limited := &models.Share{MaxUploadSize: &maxSize, AllowedExtensions: []string{".pdf", ".txt"}}
+	tests := []struct {
+		share *models.Share
+		name  string
+		size  int64
+		want  error
+	}{
+		{limited, "report.pdf", 10, nil},
+		// Extensions match whatever their case
+		{limited, "Report.PDF", 5, nil},
+		{limited, "setup.exe", 5, ErrFileTypeNotAllowed},
+		{limited, "README", 5, ErrFileTypeNotAllowed},
+		{limited, "big.txt", 11, ErrFileTooLarge},
+		// A size limit needs the size up front
+		{limited, "unknown.txt", -1, ErrFileTooLarge},
+		{&models.Share{}, "anything.exe", -1, nil},
+	}
+	for _, tt := range tests {
+		if err := checkFileRequestUpload(tt.share, tt.name, tt.size); !errors.Is(err, tt.want) {
+			t.Errorf("checkFileRequestUpload(%q, %d) = %v, want %v", tt.name, tt.size, err, tt.want)
+		}
+	}
+}
+
+func TestNumberedName(t *testing.T) {
+	tests := []struct {
+		name string
+		n    int
+		want string
+	}{
+		{"report.pdf", 2, "report (2).pdf"},
+		{"Report.PDF", 10, "Report (10).PDF"},
+		{"notes", 2, "notes (2)"},
+		{"archive.tar.gz", 3, "archive.tar (3).gz"},
+	}
+	for _, tt := range tests {
+		if got := numberedName(tt.name, tt.n); got != tt.want {
+			t.Errorf("numberedName(%q, %d) = %q, want %q", tt.name, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestCheckSharePassword(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashStr := string(hash)
+	protected := &models.Share{PasswordHash: &hashStr}
+
+	tests := []struct {
+		share    *models.Share
+		password string
+		want     error
+	}{
+		{protected, "secret", nil},
+		{protected, "", ErrPasswordRequired},
+		{protected, "guess", ErrInvalidPassword},
+		{&models.Share{}, "", nil},
+	}
+	for _, tt := range tests {
+		if err := checkSharePassword(tt.share, tt.password); !errors.Is(err, tt.want) {
+			t.Errorf("checkSharePassword(%q) = %v, want %v", tt.password, err, tt.want)
+		}
+	}
+}
+
+func TestFileRequestInfo(t *testing.T) {
+	folder := &models.File{Name: "Inbox", IsFolder: true}
+	maxUploads := 3
+
+	info, err := fileRequestInfo(&models.Share{MaxUploads: &maxUploads, UploadCount: 1}, folder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.UploadsLeft == nil || *info.UploadsLeft != 2 || !info.FileRequest {
+		t.Errorf("info = %+v, want a file request with 2 uploads left", info)
+	}
+
+	if _, err := fileRequestInfo(&models.Share{MaxUploads: &maxUploads, UploadCount: 3}, folder); !errors.Is(err, ErrFileRequestClosed) {
+		t.Errorf("all uploads received: error = %v, want ErrFileRequestClosed", err)
+	}
+	trashed := &models.File{Name: "Inbox", IsFolder: true, IsTrashed: true}
+	if _, err := fileRequestInfo(&models.Share{}, trashed); !errors.Is(err, ErrFileRequestClosed) {
+		t.Errorf("trashed folder: error = %v, want ErrFileRequestClosed", err)
+	}
+}
@@ -6,9 +6,11 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"html"
 	"io"
 	"mime"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -25,24 +27,143 @@ var (
 	ErrQuotaExceeded = errors.New("storage quota exceeded")
 )
 
+// contentRefs counts the files and versions referring to each stored
+// object. A version holds a reference to the content it keeps.
+type contentRefs interface {
+	ClaimBlob(ctx context.Context, hash string, size int64, key string) (string, error)
+	RetainBlob(ctx context.Context, key string) error
+	ReleaseBlobs(ctx context.Context, keys []string) ([]string, error)
+	CreateVersion(ctx context.Context, version *models.FileVersion) error
+}
+
 // FileService handles file operations
 type FileService struct {
 	fileRepo *repository.FileRepository
+	refs     contentRefs
 	userRepo *repository.UserRepository
-	storage  *storage.MinIOStorage
+	quota    *QuotaService
+	storage  storage.Storage
 	log      zerolog.Logger
+
+	thumbnails     *ThumbnailService
+	thumbnailQueue ThumbnailQueue
+	index          *FileIndexService
+	indexQueue     FileIndexQueue
+	locks          *LockService
+	versionQueue   VersionCleanupQueue
+	changes        *ChangeService
+	scanQueue      ScanQueue
 }
 
-// NewFileService creates a new file service
-func NewFileService(fileRepo *repository.FileRepository, userRepo *repository.UserRepository, storage *storage.MinIOStorage, log zerolog.Logger) *FileService {
+// NewFileService creates a new file service. Everything it stores is
+// charged to its owner's quota.
+func NewFileService(fileRepo *repository.FileRepository, userRepo *repository.UserRepository, quota *QuotaService, storage storage.Storage, log zerolog.Logger) *FileService {
 	return &FileService{
 		fileRepo: fileRepo,
+		refs:     fileRepo,
 		userRepo: userRepo,
+		quota:    quota,
 		storage:  storage,
 		log:      log,
 	}
 }
 
+// SetThumbnails enables thumbnails, which are then generated in the
+// background whenever a file gets new content
+func (s *FileService) SetThumbnails(thumbnails *ThumbnailService, queue ThumbnailQueue) {
+	s.thumbnails = thumbnails
+	s.thumbnailQueue = queue
+}
+
+// SetIndexing enables full-text search of file content, which is then
+// indexed in the background whenever a file gets new content
+func (s *FileService) SetIndexing(index *FileIndexService, queue FileIndexQueue) {
+	s.index = index
+	s.indexQueue = queue
+}
+
+// SetVersionCleanup applies the version retention policy in the
+// background whenever a file gets a new version
+func (s *FileService) SetVersionCleanup(queue VersionCleanupQueue) {
+	s.versionQueue = queue
+}
+
+// SetScanning enables virus scanning, which then scans every file in the
+// background whenever it gets new content
+func (s *FileService) SetScanning(queue ScanQueue) {
+	s.scanQueue = queue
+}
+
+// SetChanges records changes to files in the change journal
+func (s *FileService) SetChanges(changes *ChangeService) {
+	s.changes = changes
+}
+
+// SetLocks makes writes respect WebDAV locks. A write to a locked file
+// fails with ErrLocked unless its context carries the lock's token (see
+// WithLockTokens).
+func (s *FileService) SetLocks(locks *LockService) {
+	s.locks = locks
+}
+
+// checkWrite, checkFolder and checkTree are the LockService checks, when
+// locking is enabled
+func (s *FileService) checkWrite(ctx context.Context, file *models.File) error {
+	if s.locks == nil {
+		return nil
+	}
+	return s.locks.CheckWrite(ctx, file)
+}
+
+func (s *FileService) checkFolder(ctx context.Context, ownerID uuid.UUID, folderID *uuid.UUID) error {
+	if s.locks == nil {
+		return nil
+	}
+	return s.locks.CheckFolder(ctx, ownerID, folderID)
+}
+
+func (s *FileService) checkTree(ctx context.Context, file *models.File) error {
+	if s.locks == nil {
+		return nil
+	}
+	return s.locks.CheckTree(ctx, file)
+}
+
+// GetLocks returns the WebDAV locks covering a file the user owns
+func (s *FileService) GetLocks(ctx context.Context, fileID, ownerID uuid.UUID) ([]*models.Lock, error) {
+	file, err := s.Get(ctx, fileID, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	if s.locks == nil {
+		return nil, nil
+	}
+	return s.locks.Locks(ctx, file)
+}
+
+// BreakLocks releases the WebDAV locks taken on a file the user owns, for
+// when a client went away without unlocking it
+func (s *FileService) BreakLocks(ctx context.Context, fileID, ownerID uuid.UUID) (int, error) {
+	file, err := s.Get(ctx, fileID, ownerID)
+	if err != nil {
+		return 0, err
+	}
+	if s.locks == nil {
+		return 0, nil
+	}
+	return s.locks.BreakLocks(ctx, file, ownerID)
+}
+
+// GetUser looks up a user by ID
+func (s *FileService) GetUser(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	return s.userRepo.GetByID(ctx, id)
+}
+
+// CheckQuota returns ErrQuotaExceeded when the user can't store size more
+func (s *FileService) CheckQuota(ctx context.Context, ownerID uuid.UUID, size int64) error {
+	return s.quota.Check(ctx, ownerID, size)
+}
+
 // GetUserByEmail looks up a user by email
 func (s *FileService) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
 	return s.userRepo.GetByEmail(ctx, email)
@@ -83,6 +204,10 @@ type CreateFolderInput struct {
 
 // CreateFolder creates a new folder
 func (s *FileService) CreateFolder(ctx context.Context, input CreateFolderInput) (*models.File, error) {
+	if err := s.checkFolder(ctx, input.OwnerID, input.ParentID); err != nil {
+		return nil, err
+	}
+
 	folder := &models.File{
 		ParentID: input.ParentID,
 		OwnerID:  input.OwnerID,
@@ -93,6 +218,7 @@ func (s *FileService) CreateFolder(ctx context.Context, input CreateFolderInput)
 	if err := s.fileRepo.Create(ctx, folder); err != nil {
 		return nil, err
 	}
+	s.changes.Record(ctx, ChangeCreate, folder)
 
 	return folder, nil
 }
@@ -126,23 +252,25 @@ type UploadInput struct {
 	OwnerID  uuid.UUID
 	ParentID *uuid.UUID
 	Name     string
-	Size     int64
+	Size     int64 // -1 when the reader's length isn't known up front
 	Reader   io.Reader
 }
 
 // UploadFile stores a new file
 func (s *FileService) UploadFile(ctx context.Context, input UploadInput) (*models.File, error) {
-	// Check storage quota before uploading
-	user, err := s.userRepo.GetByID(ctx, input.OwnerID)
+	// Refuse what can't fit before storing any of it
+	available, err := s.quota.Available(ctx, input.OwnerID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get user: %w", err)
+		return nil, err
 	}
-
-	// Enforce quota if limit is set (> 0)
-	if user.StorageLimit > 0 && user.StorageUsed+input.Size > user.StorageLimit {
+	if available >= 0 && input.Size > available {
 		return nil, ErrQuotaExceeded
 	}
 
+	if err := s.checkFolder(ctx, input.OwnerID, input.ParentID); err != nil {
+		return nil, err
+	}
+
 	// Determine MIME type from extension
 	ext := filepath.Ext(input.Name)
 	mimeType := mime.TypeByExtension(ext)
@@ -153,14 +281,39 @@ func (s *FileService) UploadFile(ctx context.Context, input UploadInput) (*model
 	// Generate storage key
 	storageKey := fmt.Sprintf("%s/%s/%s", input.OwnerID.String(), time.Now().Format("2006/01/02"), uuid.New().String())
 
-	// Calculate hash while uploading (using TeeReader would be ideal here)
-	// For simplicity, we'll upload first, then the hash would be calculated during chunked upload
-	hash := ""
+	// Calculate hash while uploading. A stream of unknown size is cut off
+	// just past the remaining quota, so an oversized one can be refused
+	// without storing all of it.
+	hasher := sha256.New()
+	src := io.TeeReader(input.Reader, hasher)
+	if input.Size < 0 && available >= 0 {
+		src = io.LimitReader(src, available+1)
+	}
+	counter := &countingReader{r: src}
 
-	// Upload to storage
-	if err := s.storage.Upload(ctx, storageKey, input.Reader, input.Size, mimeType); err != nil {
+	// Upload to storage, encrypted with the owner's key if enabled
+	if err := s.storage.Upload(storage.WithOwner(ctx, input.OwnerID), storageKey, counter, input.Size, mimeType); err != nil {
 		return nil, fmt.Errorf("failed to upload file: %w", err)
 	}
+	hash := hex.EncodeToString(hasher.Sum(nil))
+
+	size := input.Size
+	if size < 0 {
+		size = counter.n
+	}
+
+	// The charge decides, as other writes may have taken the space meanwhile
+	if err := s.quota.Charge(ctx, input.OwnerID, size); err != nil {
+		_ = s.storage.Delete(ctx, storageKey)
+		return nil, err
+	}
+
+	// Content stored before is shared rather than kept twice
+	storageKey, err = s.storeBlob(ctx, storageKey, hash, size)
+	if err != nil {
+		s.quota.Release(ctx, input.OwnerID, size)
+		return nil, err
+	}
 
 	// Create file record
 	file := &models.File{
@@ -168,21 +321,82 @@ func (s *FileService) UploadFile(ctx context.Context, input UploadInput) (*model
 		OwnerID:    input.OwnerID,
 		Name:       input.Name,
 		IsFolder:   false,
-		Size:       input.Size,
+		Size:       size,
 		MimeType:   mimeType,
 		StorageKey: storageKey,
 		Hash:       hash,
 	}
+	s.markUnscanned(file)
 
 	if err := s.fileRepo.Create(ctx, file); err != nil {
 		// Cleanup uploaded file on error
-		_ = s.storage.Delete(ctx, storageKey)
+		s.releaseBlobs(ctx, storageKey)
+		s.quota.Release(ctx, input.OwnerID, size)
 		return nil, err
 	}
+	s.changes.Record(ctx, ChangeCreate, file)
+
+	s.contentChanged(ctx, file)
 
 	return file, nil
 }
 
+// storeBlob records content just uploaded under key, returning the key the
+// file should use. When the same content is already stored, that blob is
+// used and the new object deleted.
+func (s *FileService) storeBlob(ctx context.Context, key, hash string, size int64) (string, error) {
+	blobKey, err := s.refs.ClaimBlob(ctx, hash, size, key)
+	if err != nil {
+		_ = s.storage.Delete(ctx, key)
+		return "", fmt.Errorf("failed to record stored content: %w", err)
+	}
+	if blobKey != key {
+		if err := s.storage.Delete(ctx, key); err != nil {
+			s.log.Warn().Err(err).Str("storage_key", key).Msg("Failed to delete duplicate content")
+		}
+	}
+	return blobKey, nil
+}
+
+// releaseBlobs drops references to stored content, deleting the objects
+// nothing refers to anymore. Failures only leave objects behind, which
+// PurgeUnreferencedBlobs or a later release catches, so they're logged.
+func (s *FileService) releaseBlobs(ctx context.Context, keys ...string) {
+	unreferenced, err := s.refs.ReleaseBlobs(ctx, keys)
+	if err != nil {
+		s.log.Error().Err(err).Strs("storage_keys", keys).Msg("Failed to release stored content")
+		return
+	}
+	for _, key := range unreferenced {
+		if err := s.storage.Delete(ctx, key); err != nil {
+			s.log.Error().Err(err).Str("storage_key", key).Msg("Failed to delete file from storage")
+		}
+	}
+}
+
+// PurgeUnreferencedBlobs deletes stored content no file or version refers
+// to, such as that of deleted users' files. It returns how many objects it
+// deleted.
+func (s *FileService) PurgeUnreferencedBlobs(ctx context.Context) (int, error) {
+	purged := 0
+	for {
+		keys, err := s.fileRepo.DeleteUnreferencedBlobs(ctx, 100)
+		if err != nil {
+			return purged, err
+		}
+		for _, key := range keys {
+			if err := s.storage.Delete(ctx, key); err != nil {
+				s.log.Error().Err(err).Str("storage_key", key).Msg("Failed to delete file from storage")
+				continue
+			}
+			purged++
+		}
+		if len(keys) < 100 {
+			return purged, nil
+		}
+	}
+}
+
 // UpdateInput contains file update data
 type UpdateInput struct {
 	FileID    uuid.UUID
@@ -196,8 +410,11 @@ type UpdateInput struct {
 type UpdateContentInput struct {
 	FileID  uuid.UUID
 	OwnerID uuid.UUID
-	Reader  io.Reader
-	Size    int64
+	// UserID is who writes the content when that isn't the owner, such as a
+	// user the file is shared with. The owner's quota and storage are used.
+	UserID uuid.UUID
+	Reader io.Reader
+	Size   int64
 }
 
 // Update modifies a file's metadata
@@ -207,6 +424,24 @@ func (s *FileService) Update(ctx context.Context, input UpdateInput) (*models.Fi
 		return nil, err
 	}
 
+	// Renaming or moving changes the file and both folders; starring
+	// changes nothing a lock protects
+	renamed := input.Name != nil && *input.Name != file.Name
+	moved := input.ParentID != nil && (file.ParentID == nil || *input.ParentID != *file.ParentID)
+	if renamed || moved {
+		if err := s.checkTree(ctx, file); err != nil {
+			return nil, err
+		}
+		if err := s.checkFolder(ctx, file.OwnerID, file.ParentID); err != nil {
+			return nil, err
+		}
+	}
+	if moved {
+		if err := s.checkFolder(ctx, file.OwnerID, input.ParentID); err != nil {
+			return nil, err
+		}
+	}
+
 	if input.Name != nil {
 		file.Name = *input.Name
 	}
@@ -220,6 +455,11 @@ func (s *FileService) Update(ctx context.Context, input UpdateInput) (*models.Fi
 	if err := s.fileRepo.Update(ctx, file); err != nil {
 		return nil, err
 	}
+	if moved {
+		s.changes.Record(ctx, ChangeMove, file)
+	} else if renamed {
+		s.changes.Record(ctx, ChangeRename, file)
+	}
 
 	return file, nil
 }
@@ -231,7 +471,18 @@ func (s *FileService) Delete(ctx context.Context, fileID, ownerID uuid.UUID) err
 		return err
 	}
 
-	return s.fileRepo.MoveToTrash(ctx, file.ID)
+	if err := s.checkTree(ctx, file); err != nil {
+		return err
+	}
+	if err := s.checkFolder(ctx, file.OwnerID, file.ParentID); err != nil {
+		return err
+	}
+
+	if err := s.fileRepo.MoveToTrash(ctx, file.ID); err != nil {
+		return err
+	}
+	s.changes.Record(ctx, ChangeTrash, file)
+	return nil
 }
 
 // Restore recovers a file from trash
@@ -245,12 +496,17 @@ func (s *FileService) Restore(ctx context.Context, fileID, ownerID uuid.UUID) (*
 		return nil, repository.ErrFileNotFound
 	}
 
+	if err := s.checkFolder(ctx, file.OwnerID, file.ParentID); err != nil {
+		return nil, err
+	}
+
 	if err := s.fileRepo.RestoreFromTrash(ctx, file.ID); err != nil {
 		return nil, err
 	}
 
 	file.IsTrashed = false
 	file.TrashedAt = nil
+	s.changes.Record(ctx, ChangeRestore, file)
 
 	return file, nil
 }
@@ -266,14 +522,42 @@ func (s *FileService) PermanentDelete(ctx context.Context, fileID, ownerID uuid.
 		return repository.ErrFileNotFound
 	}
 
-	// Delete from storage
-	if !file.IsFolder && file.StorageKey != "" {
-		if err := s.storage.Delete(ctx, file.StorageKey); err != nil {
-			s.log.Error().Err(err).Str("storage_key", file.StorageKey).Msg("Failed to delete file from storage")
-		}
+	_, err = s.permanentDelete(ctx, file)
+	return err
+}
+
+// permanentDelete removes a file, its versions and anything inside a
+// folder, returning the storage its owner got back
+func (s *FileService) permanentDelete(ctx context.Context, file *models.File) (int64, error) {
+	if err := s.checkTree(ctx, file); err != nil {
+		return 0, err
+	}
+
+	// The content of the file, its versions and anything inside a folder
+	// is released once the rows are gone; other files may still share it
+	keys, err := s.fileRepo.ListTreeStorageKeys(ctx, file.ID)
+	if err != nil {
+		return 0, err
+	}
+	size, err := s.fileRepo.GetTreeSize(ctx, file.ID)
+	if err != nil {
+		return 0, err
+	}
+	// Thumbnail records go with the files, so their objects are listed
+	// first, for a folder those of every file inside it
+	thumbnails, err := s.fileRepo.ListTreeThumbnailKeys(ctx, file.ID)
+	if err != nil {
+		return 0, err
 	}
 
-	return s.fileRepo.PermanentDelete(ctx, file.ID)
+	if err := s.fileRepo.PermanentDelete(ctx, file.ID); err != nil {
+		return 0, err
+	}
+	s.changes.Record(ctx, ChangeDelete, file)
+	s.releaseBlobs(ctx, keys...)
+	s.deleteThumbnails(ctx, thumbnails)
+	s.quota.Release(ctx, file.OwnerID, size)
+	return size, nil
 }
 
 // CopyFile duplicates a file
@@ -283,31 +567,64 @@ func (s *FileService) CopyFile(ctx context.Context, fileID, ownerID uuid.UUID, d
 		return nil, err
 	}
 
+	return s.CopyTo(ctx, source, ownerID, destParentID, newName)
+}
+
+// CopyTo duplicates a file the caller may read into a folder of another
+// user, such as a folder shared with the caller. The destination's owner
+// owns the copy, which counts towards their quota. The copy shares the
+// source's stored content, so no bytes are copied.
+func (s *FileService) CopyTo(ctx context.Context, source *models.File, destOwnerID uuid.UUID, destParentID *uuid.UUID, newName string) (*models.File, error) {
 	if source.IsFolder {
 		// TODO: Implement recursive folder copy
 		return nil, fmt.Errorf("folder copy not yet implemented")
 	}
 
-	// Download source file
-	reader, err := s.storage.Download(ctx, source.StorageKey)
-	if err != nil {
+	if err := s.checkFolder(ctx, destOwnerID, destParentID); err != nil {
+		return nil, err
+	}
+	if err := s.quota.Charge(ctx, destOwnerID, source.Size); err != nil {
 		return nil, err
 	}
-	defer reader.Close()
 
 	name := source.Name
 	if newName != "" {
 		name = newName
 	}
 
-	// Upload as new file
-	return s.UploadFile(ctx, UploadInput{
-		OwnerID:  ownerID,
-		ParentID: destParentID,
-		Name:     name,
-		Size:     source.Size,
-		Reader:   reader,
-	})
+	if source.StorageKey != "" {
+		if err := s.refs.RetainBlob(ctx, source.StorageKey); err != nil {
+			s.quota.Release(ctx, destOwnerID, source.Size)
+			return nil, err
+		}
+	}
+
+	file := &models.File{
+		ParentID:   destParentID,
+		OwnerID:    destOwnerID,
+		Name:       name,
+		Size:       source.Size,
+		MimeType:   source.MimeType,
+		StorageKey: source.StorageKey,
+		Hash:       source.Hash,
+		// The copy has the same content, so the same scan result
+		ScanStatus: source.ScanStatus,
+		Virus:      source.Virus,
+		ScannedAt:  source.ScannedAt,
+	}
+	if file.ScanStatus == "" {
+		s.markUnscanned(file)
+	}
+	if err := s.fileRepo.Create(ctx, file); err != nil {
+		s.releaseBlobs(ctx, source.StorageKey)
+		s.quota.Release(ctx, destOwnerID, source.Size)
+		return nil, err
+	}
+	s.changes.Record(ctx, ChangeCreate, file)
+
+	s.contentChanged(ctx, file)
+
+	return file, nil
 }
 
 // Download returns a reader for a file's content
@@ -320,6 +637,9 @@ func (s *FileService) Download(ctx context.Context, fileID, ownerID uuid.UUID) (
 	if file.IsFolder {
 		return nil, nil, fmt.Errorf("cannot download a folder")
 	}
+	if file.Infected() {
+		return nil, nil, ErrInfected
+	}
 
 	reader, err := s.storage.Download(ctx, file.StorageKey)
 	if err != nil {
@@ -335,10 +655,122 @@ func (s *FileService) GetPresignedURL(ctx context.Context, fileID, ownerID uuid.
 	if err != nil {
 		return "", err
 	}
+	if file.Infected() {
+		return "", ErrInfected
+	}
 
 	return s.storage.GetPresignedURL(ctx, file.StorageKey, expiry)
 }
 
+// GetThumbnail opens a thumbnail of a file the user owns or has been shared.
+// When none is ready for the current content one is scheduled, and
+// ErrThumbnailPending returned.
+func (s *FileService) GetThumbnail(ctx context.Context, fileID, userID uuid.UUID, size string) (io.ReadCloser, *models.FileThumbnail, error) {
+	file, err := s.fileRepo.GetByID(ctx, fileID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if file.OwnerID != userID {
+		share, err := s.fileRepo.GetUserShare(ctx, fileID, userID)
+		if err != nil || share == nil {
+			return nil, nil, repository.ErrFileNotFound
+		}
+	}
+
+	if s.thumbnails == nil || file.IsFolder || !s.thumbnails.Supports(file.MimeType) {
+		return nil, nil, ErrThumbnailUnsupported
+	}
+	// Thumbnails rendered before the file was found infected show its content
+	if file.Infected() {
+		return nil, nil, ErrInfected
+	}
+
+	reader, thumb, err := s.thumbnails.Open(ctx, file, size)
+	if errors.Is(err, ErrThumbnailNotFound) {
+		// Files from before thumbnails existed get theirs on first request
+		s.queueThumbnail(ctx, file)
+		return nil, nil, ErrThumbnailPending
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return reader, thumb, nil
+}
+
+// contentChanged schedules the background work for new content of a file
+func (s *FileService) contentChanged(ctx context.Context, file *models.File) {
+	s.queueScan(ctx, file)
+	s.queueThumbnail(ctx, file)
+	s.queueIndex(ctx, file)
+}
+
+// markUnscanned drops the scan result of a file's previous content, and
+// marks the new content as waiting for its scan when scanning is enabled
+func (s *FileService) markUnscanned(file *models.File) {
+	file.ScanStatus = ""
+	if s.scanQueue != nil {
+		file.ScanStatus = models.ScanPending
+	}
+	file.Virus = ""
+	file.ScannedAt = nil
+}
+
+// queueScan schedules a virus scan of a file's content, unless it has its
+// result already
+func (s *FileService) queueScan(ctx context.Context, file *models.File) {
+	if s.scanQueue == nil || file.ScanStatus != models.ScanPending {
+		return
+	}
+	if err := s.scanQueue.ScheduleVirusScan(ctx, file.ID.String()); err != nil {
+		s.log.Warn().Err(err).Str("file_id", file.ID.String()).Msg("Failed to schedule virus scan")
+	}
+}
+
+// queueIndex schedules indexing of the current content of a file
+func (s *FileService) queueIndex(ctx context.Context, file *models.File) {
+	if s.indexQueue == nil || !s.index.Indexable(file) {
+		return
+	}
+	if err := s.indexQueue.ScheduleFileIndex(ctx, file.ID.String(), file.OwnerID.String()); err != nil {
+		s.log.Warn().Err(err).Str("file_id", file.ID.String()).Msg("Failed to schedule file indexing")
+	}
+}
+
+// queueVersionCleanup schedules pruning of a file's versions
+func (s *FileService) queueVersionCleanup(ctx context.Context, file *models.File) {
+	if s.versionQueue == nil {
+		return
+	}
+	if err := s.versionQueue.ScheduleVersionCleanup(ctx, file.ID.String()); err != nil {
+		s.log.Warn().Err(err).Str("file_id", file.ID.String()).Msg("Failed to schedule version cleanup")
+	}
+}
+
+// queueThumbnail schedules thumbnails for the current content of a file
+func (s *FileService) queueThumbnail(ctx context.Context, file *models.File) {
+	if s.thumbnailQueue == nil || !s.thumbnails.Supports(file.MimeType) {
+		return
+	}
+	if err := s.thumbnailQueue.ScheduleThumbnail(ctx, file.ID.String(), file.OwnerID.String(), file.StorageKey, file.MimeType); err != nil {
+		s.log.Warn().Err(err).Str("file_id", file.ID.String()).Msg("Failed to schedule thumbnail")
+	}
+}
+
+// deleteThumbnails removes thumbnails of deleted files from storage; their
+// records went with the files
+func (s *FileService) deleteThumbnails(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		if err := s.storage.Delete(ctx, key); err != nil {
+			s.log.Error().Err(err).Str("storage_key", key).Msg("Failed to delete thumbnail from storage")
+		}
+	}
+}
+
+// GetStorageTotals returns storage usage across all users
+func (s *FileService) GetStorageTotals(ctx context.Context) (*repository.StorageTotals, error) {
+	return s.fileRepo.GetStorageTotals(ctx)
+}
+
 // ListTrash retrieves all trashed files
 func (s *FileService) ListTrash(ctx context.Context, ownerID uuid.UUID) ([]*models.File, error) {
 	return s.fileRepo.ListTrashed(ctx, ownerID)
@@ -365,12 +797,62 @@ func (s *FileService) EmptyTrash(ctx context.Context, ownerID uuid.UUID) error {
 	return nil
 }
 
-// Search finds files matching a query
-func (s *FileService) Search(ctx context.Context, ownerID uuid.UUID, query string, limit int) ([]*models.File, error) {
-	if limit <= 0 || limit > 100 {
-		limit = 50
+// Search finds files whose name or indexed content matches a query
+func (s *FileService) Search(ctx context.Context, ownerID uuid.UUID, filter models.FileSearchFilter) ([]*models.FileSearchResult, int, error) {
+	if filter.Limit <= 0 || filter.Limit > 100 {
+		filter.Limit = 50
+	}
+	if filter.Offset < 0 {
+		filter.Offset = 0
+	}
+
+	results, total, err := s.fileRepo.Search(ctx, ownerID, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, result := range results {
+		result.Snippet = highlightSnippet(result.Snippet)
+	}
+	return results, total, nil
+}
+
+// highlightSnippet escapes a snippet for HTML and turns its match markers
+// into <mark> elements
+func highlightSnippet(snippet string) string {
+	snippet = html.EscapeString(snippet)
+	snippet = strings.ReplaceAll(snippet, repository.SnippetStart, "<mark>")
+	return strings.ReplaceAll(snippet, repository.SnippetStop, "</mark>")
+}
+
+// QueueUnindexed schedules indexing of every file whose current content is
+// not in the search index yet, such as files from before content search
+func (s *FileService) QueueUnindexed(ctx context.Context) (int, error) {
+	if s.indexQueue == nil {
+		return 0, nil
+	}
+
+	queued := 0
+	after := uuid.Nil
+	for {
+		files, err := s.fileRepo.ListUnindexed(ctx, after, 500)
+		if err != nil {
+			return queued, err
+		}
+		if len(files) == 0 {
+			return queued, nil
+		}
+
+		for _, file := range files {
+			if !s.index.Indexable(file) {
+				continue
+			}
+			if err := s.indexQueue.ScheduleFileIndex(ctx, file.ID.String(), file.OwnerID.String()); err != nil {
+				return queued, err
+			}
+			queued++
+		}
+		after = files[len(files)-1].ID
 	}
-	return s.fileRepo.Search(ctx, ownerID, query, limit)
 }
 
 // StorageStats represents storage usage statistics
@@ -379,6 +861,10 @@ type StorageStats struct {
 	Limit   int64            `json:"limit"`
 	ByType  map[string]int64 `json:"by_type"`
 	UsedPct float64          `json:"used_pct"`
+	// Versions is the part of Used taken by earlier versions of files
+	Versions int64 `json:"versions"`
+	// Attachments is the part of Used taken by stored email attachments
+	Attachments int64 `json:"attachments"`
 }
 
 // GetStorageStats returns storage usage statistics
@@ -393,16 +879,28 @@ func (s *FileService) GetStorageStats(ctx context.Context, ownerID uuid.UUID, st
 		return nil, err
 	}
 
+	versions, err := s.fileRepo.GetVersionStorageUsed(ctx, ownerID)
+	if err != nil {
+		return nil, err
+	}
+
+	attachments, err := s.fileRepo.GetAttachmentStorageUsed(ctx, ownerID)
+	if err != nil {
+		return nil, err
+	}
+
 	usedPct := 0.0
 	if storageLimit > 0 {
 		usedPct = float64(used) / float64(storageLimit) * 100
 	}
 
 	return &StorageStats{
-		Used:    used,
-		Limit:   storageLimit,
-		ByType:  byType,
-		UsedPct: usedPct,
+		Used:        used,
+		Limit:       storageLimit,
+		ByType:      byType,
+		UsedPct:     usedPct,
+		Versions:    versions,
+		Attachments: attachments,
 	}, nil
 }
 
@@ -424,43 +922,99 @@ func (s *FileService) RestoreVersion(ctx context.Context, fileID, ownerID uuid.U
 		return nil, err
 	}
 
+	if err := s.checkWrite(ctx, file); err != nil {
+		return nil, err
+	}
+
 	// Get the version to restore
 	v, err := s.fileRepo.GetVersion(ctx, fileID, version)
 	if err != nil {
 		return nil, err
 	}
 
-	// Save current file as a new version before restoring
-	nextVersion, err := s.fileRepo.GetNextVersion(ctx, fileID)
-	if err != nil {
+	// The current content is kept as a version, so the restored content
+	// takes up storage of its own
+	if err := s.quota.Charge(ctx, file.OwnerID, v.Size); err != nil {
 		return nil, err
 	}
 
-	currentVersion := &models.FileVersion{
-		FileID:     fileID,
-		Version:    nextVersion,
-		Size:       file.Size,
-		StorageKey: file.StorageKey,
-		Hash:       file.Hash,
-		CreatedBy:  ownerID,
-	}
-	if err := s.fileRepo.CreateVersion(ctx, currentVersion); err != nil {
+	// Save current file as a new version before restoring
+	if err := s.saveVersion(ctx, file, ownerID); err != nil {
+		s.quota.Release(ctx, file.OwnerID, v.Size)
 		return nil, err
 	}
 
-	// Update file with the restored version's data
+	// Update file with the restored version's data, which the version
+	// keeps too. Every file and version holds a reference to its content.
+	if err := s.refs.RetainBlob(ctx, v.StorageKey); err != nil {
+		s.quota.Release(ctx, file.OwnerID, v.Size)
+		return nil, err
+	}
+	previousKey := file.StorageKey
+	if v.Hash != file.Hash {
+		s.markUnscanned(file)
+	}
 	file.Size = v.Size
 	file.StorageKey = v.StorageKey
 	file.Hash = v.Hash
 	file.UpdatedAt = time.Now()
 
 	if err := s.fileRepo.Update(ctx, file); err != nil {
+		s.releaseBlobs(ctx, v.StorageKey)
+		s.quota.Release(ctx, file.OwnerID, v.Size)
 		return nil, err
 	}
+	s.releaseBlobs(ctx, previousKey)
+
+	s.changes.Record(ctx, ChangeUpdate, file)
+	s.contentChanged(ctx, file)
+	s.queueVersionCleanup(ctx, file)
 
 	return file, nil
 }
 
+// PinVersion pins a version of a file, keeping it whatever the version
+// retention policy says, or unpins it
+func (s *FileService) PinVersion(ctx context.Context, fileID, ownerID uuid.UUID, version int, pinned bool) (*models.FileVersion, error) {
+	file, err := s.Get(ctx, fileID, ownerID)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := s.fileRepo.SetVersionPinned(ctx, file.ID, version, pinned)
+	if err != nil {
+		return nil, err
+	}
+	if !pinned {
+		s.queueVersionCleanup(ctx, file)
+	}
+	return v, nil
+}
+
+// deleteVersions deletes versions of a file, releasing their content and
+// giving the storage back to the file's owner. Versions pinned meanwhile
+// are left alone. It returns how many were deleted and their size.
+func (s *FileService) deleteVersions(ctx context.Context, file *models.File, versions []*models.FileVersion) (int, int64, error) {
+	ids := make([]uuid.UUID, len(versions))
+	for i, v := range versions {
+		ids[i] = v.ID
+	}
+	deleted, err := s.fileRepo.DeleteVersions(ctx, ids)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	keys := make([]string, len(deleted))
+	var size int64
+	for i, v := range deleted {
+		keys[i] = v.StorageKey
+		size += v.Size
+	}
+	s.releaseBlobs(ctx, keys...)
+	s.quota.Release(ctx, file.OwnerID, size)
+	return len(deleted), size, nil
+}
+
 // CreateShareInput contains share creation data
 type CreateShareInput struct {
 	FileID        uuid.UUID
@@ -486,6 +1040,9 @@ func (s *FileService) CreateShare(ctx context.Context, input CreateShareInput) (
 	if err != nil {
 		return nil, err
 	}
+	if file.Infected() {
+		return nil, ErrInfected
+	}
 
 	// Generate unique token
 	token := uuid.New().String()[:12]
@@ -532,6 +1089,7 @@ func (s *FileService) CreateShare(ctx context.Context, input CreateShareInput) (
 	if err := s.fileRepo.CreateShare(ctx, share); err != nil {
 		return nil, err
 	}
+	s.changes.Record(ctx, ChangeShare, file)
 
 	return &ShareResponse{
 		Token:         token,
@@ -550,6 +1108,13 @@ type ShareInfo struct {
 	HasPassword   bool   `json:"has_password"`
 	MaxDownloads  *int   `json:"max_downloads,omitempty"`
 	DownloadsLeft *int   `json:"downloads_left,omitempty"`
+
+	// Set for file requests, whose folder's contents and size aren't shown
+	FileRequest       bool       `json:"file_request,omitempty"`
+	ExpiresAt         *time.Time `json:"expires_at,omitempty"`
+	MaxFileSize       *int64     `json:"max_file_size,omitempty"`
+	UploadsLeft       *int       `json:"uploads_left,omitempty"`
+	AllowedExtensions []string   `json:"allowed_extensions,omitempty"`
 }
 
 // GetShare retrieves share info by token and increments view count
@@ -577,6 +1142,10 @@ func (s *FileService) GetShare(ctx context.Context, token string) (*ShareInfo, e
 	// Increment view count
 	_ = s.fileRepo.IncrementShareViewCount(ctx, share.ID)
 
+	if share.Permission == PermissionUpload {
+		return fileRequestInfo(share, file)
+	}
+
 	allowDownload := share.Permission == "download" || share.Permission == "edit"
 
 	info := &ShareInfo{
@@ -608,6 +1177,8 @@ type ShareAnalytics struct {
 	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
 	HasPassword    bool       `json:"has_password"`
 	AllowDownload  bool       `json:"allow_download"`
+	UploadCount    int        `json:"upload_count,omitempty"` // file requests only
+	MaxUploads     *int       `json:"max_uploads,omitempty"`
 }
 
 // GetShareAnalytics retrieves analytics for a share owned by the user
@@ -631,71 +1202,83 @@ func (s *FileService) GetShareAnalytics(ctx context.Context, fileID, ownerID uui
 				ExpiresAt:      share.ExpiresAt,
 				HasPassword:    share.PasswordHash != nil,
 				AllowDownload:  share.Permission == "download" || share.Permission == "edit",
+				UploadCount:    share.UploadCount,
+				MaxUploads:     share.MaxUploads,
 			}, nil
 		}
 	}
 
-	return nil, fmt.Errorf("share not found")
+	return nil, repository.ErrShareNotFound
 }
 
-// FileInfo contains basic file metadata for downloads
-type FileInfo struct {
-	Name     string
-	MimeType string
+// GetShareDownload checks a public share allows downloading and returns the
+// shared file. The download isn't counted; see CountShareDownload.
+func (s *FileService) GetShareDownload(ctx context.Context, token, password string) (*models.Share, *models.File, error) {
+	share, err := s.openShareDownload(ctx, token, password)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := s.fileRepo.GetByID(ctx, share.FileID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if file.IsFolder {
+		return nil, nil, fmt.Errorf("cannot download a folder")
+	}
+	if file.Infected() {
+		return nil, nil, ErrInfected
+	}
+
+	return share, file, nil
 }
 
-// DownloadShare downloads a shared file
-func (s *FileService) DownloadShare(ctx context.Context, token, password string) (io.ReadCloser, *FileInfo, error) {
+// openShareDownload returns a public share if it allows downloading
+func (s *FileService) openShareDownload(ctx context.Context, token, password string) (*models.Share, error) {
 	share, err := s.fileRepo.GetShareByToken(ctx, token)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	// Check if expired
 	if share.ExpiresAt != nil && share.ExpiresAt.Before(time.Now()) {
-		return nil, nil, fmt.Errorf("share expired")
+		return nil, fmt.Errorf("share expired")
 	}
 
 	// Check download permission
 	allowDownload := share.Permission == "download" || share.Permission == "edit"
 	if !allowDownload {
-		return nil, nil, fmt.Errorf("download not allowed")
+		return nil, fmt.Errorf("download not allowed")
 	}
 
 	// Check password using bcrypt
-	if share.PasswordHash != nil {
-		if password == "" {
-			return nil, nil, fmt.Errorf("password required")
-		}
-		if err := bcrypt.CompareHashAndPassword([]byte(*share.PasswordHash), []byte(password)); err != nil {
-			return nil, nil, fmt.Errorf("invalid password")
-		}
+	if err := checkSharePassword(share, password); err != nil {
+		return nil, err
 	}
 
+	// Resuming a download doesn't count as another one, but once the limit
+	// is reached nothing more is served, so ranges can't be used to get
+	// around it
+	if share.MaxDownloads != nil && share.DownloadCount >= *share.MaxDownloads {
+		return nil, fmt.Errorf("max downloads reached")
+	}
+
+	return share, nil
+}
+
+// CountShareDownload counts a download of a public share, failing once the
+// share's download limit is reached
+func (s *FileService) CountShareDownload(ctx context.Context, share *models.Share) error {
 	// Atomically check max downloads and increment count
 	// This prevents race conditions where multiple downloads could exceed the limit
 	allowed, err := s.fileRepo.IncrementDownloadIfAllowed(ctx, share.ID)
 	if err != nil {
-		return nil, nil, err
+		return err
 	}
 	if !allowed {
-		return nil, nil, fmt.Errorf("max downloads reached")
-	}
-
-	file, err := s.fileRepo.GetByID(ctx, share.FileID)
-	if err != nil {
-		return nil, nil, err
-	}
-
-	reader, err := s.storage.Download(ctx, file.StorageKey)
-	if err != nil {
-		return nil, nil, err
+		return fmt.Errorf("max downloads reached")
 	}
-
-	return reader, &FileInfo{
-		Name:     file.Name,
-		MimeType: file.MimeType,
-	}, nil
+	return nil
 }
 
 // calculateHash computes SHA-256 hash of data
@@ -741,6 +1324,9 @@ func (s *FileService) ShareWithUser(ctx context.Context, input ShareWithUserInpu
 	if err != nil {
 		return nil, err
 	}
+	if file.Infected() {
+		return nil, ErrInfected
+	}
 
 	// Validate permission
 	if input.Permission != PermissionView && input.Permission != PermissionEdit && input.Permission != PermissionAdmin {
@@ -755,6 +1341,8 @@ func (s *FileService) ShareWithUser(ctx context.Context, input ShareWithUserInpu
 		if err := s.fileRepo.UpdateShare(ctx, existing); err != nil {
 			return nil, err
 		}
+		s.changes.Record(ctx, ChangeShare, file)
+		s.changes.RecordFor(ctx, input.SharedWith, ChangeShare, file)
 
 		return &UserShareResponse{
 			ID:         existing.ID,
@@ -777,6 +1365,8 @@ func (s *FileService) ShareWithUser(ctx context.Context, input ShareWithUserInpu
 	if err := s.fileRepo.CreateShare(ctx, share); err != nil {
 		return nil, err
 	}
+	s.changes.Record(ctx, ChangeShare, file)
+	s.changes.RecordFor(ctx, input.SharedWith, ChangeShare, file)
 
 	return &UserShareResponse{
 		ID:         share.ID,
@@ -815,7 +1405,16 @@ func (s *FileService) RevokeUserShare(ctx context.Context, shareID, ownerID uuid
 		return fmt.Errorf("not authorized")
 	}
 
-	return s.fileRepo.DeleteShare(ctx, shareID)
+	if err := s.fileRepo.DeleteShare(ctx, shareID); err != nil {
+		return err
+	}
+	if file, err := s.fileRepo.GetByID(ctx, share.FileID); err == nil {
+		s.changes.Record(ctx, ChangeUnshare, file)
+		if share.SharedWith != nil {
+			s.changes.RecordFor(ctx, *share.SharedWith, ChangeUnshare, file)
+		}
+	}
+	return nil
 }
 
 // CanUserAccessFile checks if a user can access a file (owner or shared)
@@ -840,19 +1439,41 @@ func (s *FileService) CanUserAccessFile(ctx context.Context, fileID, userID uuid
 
 // WebDAV helper methods that accept string IDs
 
-// UpdateFileContent updates the content of an existing file
-func (s *FileService) UpdateFileContent(ctx context.Context, fileID, userID string, reader io.Reader, size int64) (*models.File, error) {
+// UpdateFileContent updates the content of an existing file of ownerID on
+// behalf of userID. size may be -1 when the reader's length isn't known up
+// front.
+func (s *FileService) UpdateFileContent(ctx context.Context, fileID, ownerID, userID string, reader io.Reader, size int64) (*models.File, error) {
 	fileUUID, err := uuid.Parse(fileID)
 	if err != nil {
 		return nil, fmt.Errorf("invalid file ID")
 	}
+	ownerUUID, err := uuid.Parse(ownerID)
+	if err != nil {
+		return nil, fmt.Errorf("invalid owner ID")
+	}
 	userUUID, err := uuid.Parse(userID)
 	if err != nil {
 		return nil, fmt.Errorf("invalid user ID")
 	}
 
+	return s.UpdateFileContentWithInput(ctx, UpdateContentInput{
+		FileID:  fileUUID,
+		OwnerID: ownerUUID,
+		UserID:  userUUID,
+		Reader:  reader,
+		Size:    size,
+	})
+}
+
+// UpdateFileContentWithInput updates file content using typed input
+func (s *FileService) UpdateFileContentWithInput(ctx context.Context, input UpdateContentInput) (*models.File, error) {
+	userID := input.UserID
+	if userID == uuid.Nil {
+		userID = input.OwnerID
+	}
+
 	// Get existing file
-	file, err := s.Get(ctx, fileUUID, userUUID)
+	file, err := s.Get(ctx, input.FileID, input.OwnerID)
 	if err != nil {
 		return nil, err
 	}
@@ -861,46 +1482,90 @@ func (s *FileService) UpdateFileContent(ctx context.Context, fileID, userID stri
 		return nil, fmt.Errorf("cannot update content of a folder")
 	}
 
-	// Create version of old file
-	if file.StorageKey != "" {
-		version := &models.FileVersion{
-			FileID:     file.ID,
-			Version:    1, // Will be auto-incremented
-			Size:       file.Size,
-			StorageKey: file.StorageKey,
-			Hash:       file.Hash,
-			CreatedBy:  userUUID,
-		}
-		// Get next version number
-		versions, _ := s.fileRepo.GetVersions(ctx, file.ID)
-		if len(versions) > 0 {
-			version.Version = versions[0].Version + 1
-		}
-		_ = s.fileRepo.CreateVersion(ctx, version)
+	if err := s.checkWrite(ctx, file); err != nil {
+		return nil, err
+	}
+
+	// The previous content is kept as a version, so the new content takes
+	// up storage of its own. What can't fit is refused before storing it.
+	available, err := s.quota.Available(ctx, file.OwnerID)
+	if err != nil {
+		return nil, err
+	}
+	if available >= 0 && input.Size > available {
+		return nil, ErrQuotaExceeded
 	}
 
 	// Upload new content
-	newStorageKey := fmt.Sprintf("%s/%s/%s", userID, time.Now().Format("2006/01/02"), uuid.New().String())
-	if err := s.storage.Upload(ctx, newStorageKey, reader, size, file.MimeType); err != nil {
+	newStorageKey := fmt.Sprintf("%s/%s/%s", file.OwnerID.String(), time.Now().Format("2006/01/02"), uuid.New().String())
+	hasher := sha256.New()
+	src := io.TeeReader(input.Reader, hasher)
+	if input.Size < 0 && available >= 0 {
+		src = io.LimitReader(src, available+1)
+	}
+	counter := &countingReader{r: src}
+	if err := s.storage.Upload(storage.WithOwner(ctx, file.OwnerID), newStorageKey, counter, input.Size, file.MimeType); err != nil {
 		return nil, fmt.Errorf("failed to upload file: %w", err)
 	}
+	if err := s.quota.Charge(ctx, file.OwnerID, counter.n); err != nil {
+		_ = s.storage.Delete(ctx, newStorageKey)
+		return nil, err
+	}
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	newStorageKey, err = s.storeBlob(ctx, newStorageKey, hash, counter.n)
+	if err != nil {
+		s.quota.Release(ctx, file.OwnerID, counter.n)
+		return nil, err
+	}
+
+	// Keep the old content as a version. Without it the old content would
+	// be released below, so the write is abandoned.
+	if file.StorageKey != "" {
+		if err := s.saveVersion(ctx, file, userID); err != nil {
+			s.releaseBlobs(ctx, newStorageKey)
+			s.quota.Release(ctx, file.OwnerID, counter.n)
+			return nil, fmt.Errorf("failed to save previous version: %w", err)
+		}
+	}
 
-	// Update file record
+	// Update file record. The previous content stays referenced by the
+	// version made of it above.
+	previousKey := file.StorageKey
+	if hash != file.Hash {
+		s.markUnscanned(file)
+	}
 	file.StorageKey = newStorageKey
-	file.Size = size
+	file.Size = counter.n
+	file.Hash = hash
 	file.UpdatedAt = time.Now()
 
 	if err := s.fileRepo.Update(ctx, file); err != nil {
-		_ = s.storage.Delete(ctx, newStorageKey)
+		s.releaseBlobs(ctx, newStorageKey)
+		s.quota.Release(ctx, file.OwnerID, counter.n)
 		return nil, err
 	}
+	s.releaseBlobs(ctx, previousKey)
+
+	s.changes.Record(ctx, ChangeUpdate, file)
+	if userID != file.OwnerID {
+		s.changes.RecordFor(ctx, userID, ChangeUpdate, file)
+	}
+	s.contentChanged(ctx, file)
+	s.queueVersionCleanup(ctx, file)
 
 	return file, nil
 }
 
-// UpdateFileContentWithInput updates file content using typed input
-func (s *FileService) UpdateFileContentWithInput(ctx context.Context, input UpdateContentInput) (*models.File, error) {
-	return s.UpdateFileContent(ctx, input.FileID.String(), input.OwnerID.String(), input.Reader, input.Size)
+// saveVersion keeps a file's current content as its next version
+func (s *FileService) saveVersion(ctx context.Context, file *models.File, createdBy uuid.UUID) error {
+	return s.refs.CreateVersion(ctx, &models.FileVersion{
+		FileID:     file.ID,
+		Size:       file.Size,
+		StorageKey: file.StorageKey,
+		Hash:       file.Hash,
+		CreatedBy:  createdBy,
+	})
 }
 
 // UploadString is a WebDAV helper that accepts string IDs
@@ -927,26 +1592,3 @@ func (s *FileService) Upload(ctx context.Context, userID, parentID, name string,
 		Reader:   reader,
 	})
 }
-
-// CopyString is a WebDAV helper that accepts string IDs
-func (s *FileService) Copy(ctx context.Context, fileID, userID, destParentID, newName string) (*models.File, error) {
-	fileUUID, err := uuid.Parse(fileID)
-	if err != nil {
-		return nil, fmt.Errorf("invalid file ID")
-	}
-	userUUID, err := uuid.Parse(userID)
-	if err != nil {
-		return nil, fmt.Errorf("invalid user ID")
-	}
-
-	var destParentUUID *uuid.UUID
-	if destParentID != "" {
-		parsed, err := uuid.Parse(destParentID)
-		if err != nil {
-			return nil, fmt.Errorf("invalid destination parent ID")
-		}
-		destParentUUID = &parsed
-	}
-
-	return s.CopyFile(ctx, fileUUID, userUUID, destParentUUID, newName)
-}
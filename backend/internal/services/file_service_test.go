@@ -0,0 +1,208 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+
+	"github.com/tessera/tessera/internal/models"
+	"github.com/tessera/tessera/internal/storage"
+)
+
+// memStorage keeps stored objects in memory
+type memStorage map[string][]byte
+
+func (m memStorage) Upload(_ context.Context, name string, r io.Reader, _ int64, _ string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m[name] = data
+	return nil
+}
+
+func (m memStorage) Download(_ context.Context, name string) (io.ReadCloser, error) {
+	data, ok := m[name]
+	if !ok {
+		return nil, errors.New("object not found")
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m memStorage) DownloadRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	data, ok := m[name]
+	if !ok {
+		return nil, errors.New("object not found")
+	}
+	return io.NopCloser(bytes.NewReader(data[offset : offset+length])), nil
+}
+
+func (m memStorage) Delete(_ context.Context, name string) error {
+	delete(m, name)
+	return nil
+}
+
+func (m memStorage) GetPresignedURL(_ context.Context, name string, _ time.Duration) (string, error) {
+	return "/" + name, nil
+}
+
+func (m memStorage) Stat(_ context.Context, name string) (*storage.ObjectInfo, error) {
+	data, ok := m[name]
+	if !ok {
+		return nil, errors.New("object not found")
+	}
+	return &storage.ObjectInfo{Key: name, Size: int64(len(data))}, nil
+}
+
+// fakeRefs counts references to stored objects, as the blobs table does
+type fakeRefs struct {
+	hashes   map[string]string // key to hash
+	counts   map[string]int
+	versions []*models.FileVersion
+	err      error // returned by every call when set
+}
+
+func newFakeRefs() *fakeRefs {
+	return &fakeRefs{hashes: map[string]string{}, counts: map[string]int{}}
+}
+
+func (r *fakeRefs) ClaimBlob(_ context.Context, hash string, _ int64, key string) (string, error) {
+	if r.err != nil {
+		return "", r.err
+	}
+	for existing, h := range r.hashes {
+		if h == hash {
+			r.counts[existing]++
+			return existing, nil
+		}
+	}
+	r.hashes[key] = hash
+	r.counts[key] = 1
+	return key, nil
+}
+
+func (r *fakeRefs) RetainBlob(_ context.Context, key string) error {
+	if r.err != nil {
+		return r.err
+	}
+	r.counts[key]++
+	return nil
+}
+
+func (r *fakeRefs) ReleaseBlobs(_ context.Context, keys []string) ([]string, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	var unreferenced []string
+	for _, key := range keys {
+		if r.counts[key]--; r.counts[key] <= 0 {
+			delete(r.counts, key)
+			delete(r.hashes, key)
+			unreferenced = append(unreferenced, key)
+		}
+	}
+	return unreferenced, nil
+}
+
+func (r *fakeRefs) CreateVersion(_ context.Context, version *models.FileVersion) error {
+	if r.err != nil {
+		return r.err
+	}
+	version.Version = len(r.versions) + 1
+	r.versions = append(r.versions, version)
+	r.counts[version.StorageKey]++
+	return nil
+}
+
+func newBlobTestService() (*FileService, *fakeRefs, memStorage) {
+	refs, store := newFakeRefs(), memStorage{}
+	return &FileService{refs: refs, storage: store, log: zerolog.Nop()}, refs, store
+}
+
+func TestStoreBlob(t *testing.T) {
+	ctx := context.Background()
+	s, refs, store := newBlobTestService()
+
+	store["a"] = []byte("hello")
+	if key, err := s.storeBlob(ctx, "a", "hash", 5); err != nil || key != "a" {
+		t.Fatalf("storeBlob(a) = %q, %v", key, err)
+	}
+
+	// The same content uploaded again is shared, and the new object deleted
+	store["b"] = []byte("hello")
+	if key, err := s.storeBlob(ctx, "b", "hash", 5); err != nil || key != "a" {
+		t.Fatalf("storeBlob(b) = %q, %v, want a", key, err)
+	}
+	if _, ok := store["b"]; ok {
+		t.Error("duplicate object kept")
+	}
+	if refs.counts["a"] != 2 {
+		t.Errorf("refs = %d, want 2", refs.counts["a"])
+	}
+
+	// Content that can't be recorded isn't kept either
+	refs.err = errors.New("database is down")
+	store["c"] = []byte("other")
+	if _, err := s.storeBlob(ctx, "c", "other", 5); err == nil {
+		t.Error("storeBlob() succeeded without recording the content")
+	}
+	if _, ok := store["c"]; ok {
+		t.Error("unrecorded object kept")
+	}
+}
+
+func TestReleaseBlobs(t *testing.T) {
+	ctx := context.Background()
+	s, refs, store := newBlobTestService()
+	store["a"], store["b"] = []byte("hello"), []byte("world")
+	refs.counts["a"], refs.counts["b"] = 2, 1
+
+	s.releaseBlobs(ctx, "a", "b")
+	if _, ok := store["a"]; !ok {
+		t.Error("object still referenced deleted")
+	}
+	if _, ok := store["b"]; ok {
+		t.Error("unreferenced object kept")
+	}
+
+	s.releaseBlobs(ctx, "a")
+	if len(store) != 0 {
+		t.Errorf("objects left after releasing every reference: %d", len(store))
+	}
+}
+
+func TestSaveVersion(t *testing.T) {
+	ctx := context.Background()
+	s, refs, store := newBlobTestService()
+	user := uuid.New()
+	file := &models.File{ID: uuid.New(), StorageKey: "a", Size: 5, Hash: "hash"}
+	store["a"] = []byte("hello")
+	refs.counts["a"] = 1
+
+	for want := 1; want <= 2; want++ {
+		if err := s.saveVersion(ctx, file, user); err != nil {
+			t.Fatal(err)
+		}
+		v := refs.versions[len(refs.versions)-1]
+		if v.Version != want || v.FileID != file.ID || v.StorageKey != "a" || v.CreatedBy != user {
+			t.Errorf("version = %+v, want number %d of the file's content", v, want)
+		}
+	}
+
+	// The versions keep the content once the file moves on from it
+	s.releaseBlobs(ctx, "a")
+	if _, ok := store["a"]; !ok || refs.counts["a"] != 2 {
+		t.Errorf("content kept by versions deleted, refs = %d", refs.counts["a"])
+	}
+
+	refs.err = errors.New("database is down")
+	if err := s.saveVersion(ctx, file, user); err == nil {
+		t.Error("saveVersion() succeeded without creating a version")
+	}
+}
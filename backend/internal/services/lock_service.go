@@ -0,0 +1,364 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+
+	"github.com/tessera/tessera/internal/models"
+	"github.com/tessera/tessera/internal/repository"
+)
+
+var (
+	// ErrLocked is returned when a file is locked by someone else, or the
+	// request didn't submit the token of the lock
+	ErrLocked = errors.New("file is locked")
+	// ErrLockTokenMismatch is returned when a lock token doesn't lock the
+	// file it was submitted for
+	ErrLockTokenMismatch = errors.New("lock token does not apply to this file")
+	// ErrLockNotHeld is returned when a user refreshes or releases a lock
+	// someone else took
+	ErrLockNotHeld = errors.New("lock is held by another user")
+)
+
+const (
+	// DefaultLockTimeout is how long a lock lasts when the client doesn't say
+	DefaultLockTimeout = time.Hour
+	// MaxLockTimeout caps the timeout a client can ask for, so a lock left
+	// behind by a crashed client doesn't last forever
+	MaxLockTimeout = 24 * time.Hour
+
+	// lockGuardTTL bounds how long a crashed request can block locking
+	lockGuardTTL = 10 * time.Second
+	// lockGuardWait is how long to wait for a concurrent lock request
+	lockGuardWait = 2 * time.Second
+)
+
+// LockService manages WebDAV write locks. Locks are checked by every write,
+// whether it comes through WebDAV or the REST API, so a file being edited
+// over WebDAV can't be overwritten elsewhere.
+type LockService struct {
+	locks    *repository.LockRepository
+	fileRepo *repository.FileRepository
+	log      zerolog.Logger
+}
+
+// NewLockService creates a new lock service
+func NewLockService(locks *repository.LockRepository, fileRepo *repository.FileRepository, log zerolog.Logger) *LockService {
+	return &LockService{
+		locks:    locks,
+		fileRepo: fileRepo,
+		log:      log,
+	}
+}
+
+type lockTokensKey struct{}
+
+// submittedTokens are the lock tokens a user submitted with a request
+type submittedTokens struct {
+	userID uuid.UUID
+	tokens []string
+}
+
+// WithLockTokens returns a context carrying the lock tokens a user
+// submitted. Writes made with it may change files under those locks, if
+// the user took them, whoever owns the files.
+func WithLockTokens(ctx context.Context, userID uuid.UUID, tokens []string) context.Context {
+	return context.WithValue(ctx, lockTokensKey{}, submittedTokens{userID: userID, tokens: tokens})
+}
+
+func lockTokens(ctx context.Context) submittedTokens {
+	submitted, _ := ctx.Value(lockTokensKey{}).(submittedTokens)
+	return submitted
+}
+
+// LockTimeout clamps the timeout a client asked for; zero means none
+func LockTimeout(requested time.Duration) time.Duration {
+	if requested <= 0 {
+		return DefaultLockTimeout
+	}
+	return min(requested, MaxLockTimeout)
+}
+
+// LockInput contains lock request data
+type LockInput struct {
+	File     *models.File
+	UserID   uuid.UUID
+	Scope    string // models.LockExclusive or models.LockShared
+	Infinite bool   // lock everything inside a folder too
+	Owner    string
+	Root     string
+	Timeout  time.Duration
+}
+
+// Lock takes a new lock on a file or folder. It fails with ErrLocked if an
+// existing lock conflicts: any lock conflicts with an exclusive one, and
+// shared locks only with exclusive ones.
+func (s *LockService) Lock(ctx context.Context, input LockInput) (*models.Lock, error) {
+	file := input.File
+	if err := s.guard(ctx, file.OwnerID); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := s.locks.Unguard(context.WithoutCancel(ctx), file.OwnerID); err != nil {
+			s.log.Warn().Err(err).Str("owner_id", file.OwnerID.String()).Msg("Failed to release lock guard")
+		}
+	}()
+
+	existing, err := s.overlapping(ctx, file, input.Infinite)
+	if err != nil {
+		return nil, err
+	}
+	for _, lock := range existing {
+		if input.Scope == models.LockExclusive || lock.Scope == models.LockExclusive {
+			return nil, ErrLocked
+		}
+	}
+
+	timeout := LockTimeout(input.Timeout)
+	now := time.Now()
+	lock := &models.Lock{
+		Token:     "opaquelocktoken:" + uuid.New().String(),
+		FileID:    file.ID,
+		OwnerID:   file.OwnerID,
+		UserID:    input.UserID,
+		Scope:     input.Scope,
+		Infinite:  input.Infinite && file.IsFolder,
+		Owner:     input.Owner,
+		Root:      input.Root,
+		Timeout:   int64(timeout / time.Second),
+		ExpiresAt: now.Add(timeout),
+		CreatedAt: now,
+	}
+	if err := s.locks.Save(ctx, lock); err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// Refresh extends a lock covering a file by a new timeout
+func (s *LockService) Refresh(ctx context.Context, file *models.File, token string, userID uuid.UUID, timeout time.Duration) (*models.Lock, error) {
+	lock, err := s.covering(ctx, file, token)
+	if err != nil {
+		return nil, err
+	}
+	if lock.UserID != userID {
+		return nil, ErrLockNotHeld
+	}
+
+	timeout = LockTimeout(timeout)
+	lock.Timeout = int64(timeout / time.Second)
+	lock.ExpiresAt = time.Now().Add(timeout)
+	if err := s.locks.Save(ctx, lock); err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// Unlock releases a lock covering a file. Only the user who took it can.
+func (s *LockService) Unlock(ctx context.Context, file *models.File, token string, userID uuid.UUID) error {
+	lock, err := s.covering(ctx, file, token)
+	if err != nil {
+		return err
+	}
+	if lock.UserID != userID {
+		return ErrLockNotHeld
+	}
+	return s.locks.Delete(ctx, lock)
+}
+
+// BreakLocks releases the locks taken directly on a file, for when a client
+// went away without unlocking. The file's owner can break any lock, others
+// only their own. It returns how many locks were released.
+func (s *LockService) BreakLocks(ctx context.Context, file *models.File, userID uuid.UUID) (int, error) {
+	locks, err := s.locks.ListByOwner(ctx, file.OwnerID)
+	if err != nil {
+		return 0, err
+	}
+
+	released, others := 0, 0
+	for _, lock := range locks {
+		if lock.FileID != file.ID {
+			continue
+		}
+		if lock.UserID != userID && file.OwnerID != userID {
+			others++
+			continue
+		}
+		if err := s.locks.Delete(ctx, lock); err != nil {
+			return released, err
+		}
+		released++
+	}
+	if released == 0 && others > 0 {
+		return 0, ErrLockNotHeld
+	}
+	return released, nil
+}
+
+// Locks returns the locks covering a file: those taken on it and the
+// infinite-depth locks of the folders containing it
+func (s *LockService) Locks(ctx context.Context, file *models.File) ([]*models.Lock, error) {
+	return s.overlapping(ctx, file, false)
+}
+
+// HasLocks reports whether any of an owner's files are locked, so listings
+// can skip looking up the locks of each file
+func (s *LockService) HasLocks(ctx context.Context, ownerID uuid.UUID) (bool, error) {
+	locks, err := s.locks.ListByOwner(ctx, ownerID)
+	return len(locks) > 0, err
+}
+
+// CheckWrite returns ErrLocked unless the request holds the locks covering
+// a file, having submitted their tokens with WithLockTokens. For a folder
+// this protects its members too: adding, removing or renaming one needs the
+// folder's locks.
+func (s *LockService) CheckWrite(ctx context.Context, file *models.File) error {
+	locks, err := s.overlapping(ctx, file, false)
+	if err != nil {
+		return err
+	}
+	submitted := lockTokens(ctx)
+	return checkHeld(locks, submitted.userID, submitted.tokens)
+}
+
+// CheckFolder is CheckWrite for the folder a file is added to or removed
+// from. A nil folder is the owner's root, which can't be locked.
+func (s *LockService) CheckFolder(ctx context.Context, ownerID uuid.UUID, folderID *uuid.UUID) error {
+	if folderID == nil {
+		return nil
+	}
+	return s.CheckWrite(ctx, &models.File{ID: *folderID, OwnerID: ownerID, IsFolder: true})
+}
+
+// CheckTree is CheckWrite for a file and, for a folder, everything inside
+// it, as deleting or moving it changes them all
+func (s *LockService) CheckTree(ctx context.Context, file *models.File) error {
+	locks, err := s.overlapping(ctx, file, true)
+	if err != nil {
+		return err
+	}
+	submitted := lockTokens(ctx)
+	return checkHeld(locks, submitted.userID, submitted.tokens)
+}
+
+// RemoveTree releases the locks on a file and everything inside it, once it
+// has been deleted or moved; locks don't follow a resource that moves
+func (s *LockService) RemoveTree(ctx context.Context, file *models.File) error {
+	locks, err := s.locks.ListByOwner(ctx, file.OwnerID)
+	if err != nil {
+		return err
+	}
+	for _, lock := range locks {
+		remove := lock.FileID == file.ID
+		if !remove && file.IsFolder {
+			if remove, err = s.inside(ctx, lock.FileID, file.ID); err != nil {
+				return err
+			}
+		}
+		if remove {
+			if err := s.locks.Delete(ctx, lock); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkHeld reports whether the request holds the given locks. Every
+// exclusive lock must be held, and one of any shared locks. A lock is held
+// by submitting its token as the user who took it.
+func checkHeld(locks []*models.Lock, userID uuid.UUID, tokens []string) error {
+	shared, sharedHeld := false, false
+	for _, lock := range locks {
+		held := lock.UserID == userID && slices.Contains(tokens, lock.Token)
+		if lock.Scope == models.LockExclusive {
+			if !held {
+				return ErrLocked
+			}
+			continue
+		}
+		shared = true
+		sharedHeld = sharedHeld || held
+	}
+	if shared && !sharedHeld {
+		return ErrLocked
+	}
+	return nil
+}
+
+// overlapping returns the locks covering a file and, with tree set, the
+// locks on anything inside it
+func (s *LockService) overlapping(ctx context.Context, file *models.File, tree bool) ([]*models.Lock, error) {
+	locks, err := s.locks.ListByOwner(ctx, file.OwnerID)
+	if err != nil || len(locks) == 0 {
+		return nil, err
+	}
+
+	var ancestors []uuid.UUID
+	if slices.ContainsFunc(locks, func(l *models.Lock) bool { return l.Infinite }) {
+		if ancestors, err = s.fileRepo.GetAncestorIDs(ctx, file.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	var result []*models.Lock
+	for _, lock := range locks {
+		covers := lock.FileID == file.ID || (lock.Infinite && slices.Contains(ancestors, lock.FileID))
+		if !covers && tree && file.IsFolder {
+			if covers, err = s.inside(ctx, lock.FileID, file.ID); err != nil {
+				return nil, err
+			}
+		}
+		if covers {
+			result = append(result, lock)
+		}
+	}
+	return result, nil
+}
+
+// covering returns the lock with the given token if it covers a file
+func (s *LockService) covering(ctx context.Context, file *models.File, token string) (*models.Lock, error) {
+	locks, err := s.overlapping(ctx, file, false)
+	if err != nil {
+		return nil, err
+	}
+	for _, lock := range locks {
+		if lock.Token == token {
+			return lock, nil
+		}
+	}
+	return nil, ErrLockTokenMismatch
+}
+
+// inside reports whether a file is somewhere inside a folder
+func (s *LockService) inside(ctx context.Context, fileID, folderID uuid.UUID) (bool, error) {
+	ancestors, err := s.fileRepo.GetAncestorIDs(ctx, fileID)
+	if err != nil {
+		if errors.Is(err, repository.ErrFileNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	return slices.Contains(ancestors, folderID), nil
+}
+
+// guard waits for any concurrent change to an owner's locks to finish
+func (s *LockService) guard(ctx context.Context, ownerID uuid.UUID) error {
+	deadline := time.Now().Add(lockGuardWait)
+	for {
+		err := s.locks.Guard(ctx, ownerID, lockGuardTTL)
+		if !errors.Is(err, repository.ErrLockBusy) || time.Now().After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
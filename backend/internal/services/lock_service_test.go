@@ -0,0 +1,47 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+
+	"github.com/tessera/tessera/internal/models"
+)
+
+func TestCheckHeld(t *testing.T) {
+	alice, bob := uuid.New(), uuid.New()
+	exclusive := &models.Lock{Token: "t1", UserID: alice, Scope: models.LockExclusive}
+	sharedA := &models.Lock{Token: "t2", UserID: alice, Scope: models.LockShared}
+	sharedB := &models.Lock{Token: "t3", UserID: bob, Scope: models.LockShared}
+
+	tests := []struct {
+		name   string
+		locks  []*models.Lock
+		user   uuid.UUID
+		tokens []string
+		held   bool
+	}{
+		{"unlocked", nil, bob, nil, true},
+		{"exclusive with token", []*models.Lock{exclusive}, alice, []string{"t1"}, true},
+		{"exclusive without token", []*models.Lock{exclusive}, alice, nil, false},
+		{"someone else's token", []*models.Lock{exclusive}, bob, []string{"t1"}, false},
+		{"one of the shared locks", []*models.Lock{sharedA, sharedB}, bob, []string{"t3"}, true},
+		{"no shared lock", []*models.Lock{sharedA, sharedB}, bob, []string{"t2"}, false},
+		{"exclusive and shared", []*models.Lock{exclusive, sharedA}, alice, []string{"t2"}, false},
+	}
+	for _, tt := range tests {
+		err := checkHeld(tt.locks, tt.user, tt.tokens)
+		if held := err == nil; held != tt.held {
+			t.Errorf("%s: held = %v, want %v", tt.name, held, tt.held)
+		}
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	if got := LockTimeout(0); got != DefaultLockTimeout {
+		t.Errorf("LockTimeout(0) = %v, want the default", got)
+	}
+	if got := LockTimeout(100 * MaxLockTimeout); got != MaxLockTimeout {
+		t.Errorf("LockTimeout(long) = %v, want the maximum", got)
+	}
+}
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tessera/tessera/internal/config"
+)
+
+// mailTimeout bounds connecting to and talking with the SMTP server
+const mailTimeout = 30 * time.Second
+
+// Mailer sends system notifications through the SMTP account configured by
+// the administrator (SMTP_* settings). Users' own mail accounts are handled
+// by EmailService.
+type Mailer struct {
+	cfg config.SMTPConfig
+}
+
+// NewMailer creates a mailer; it sends nothing unless SMTP is configured
+func NewMailer(cfg config.SMTPConfig) *Mailer {
+	return &Mailer{cfg: cfg}
+}
+
+// Enabled reports whether a system mail account is configured
+func (m *Mailer) Enabled() bool {
+	return m != nil && m.cfg.Enabled()
+}
+
+// Send delivers a plain-text message to a single recipient
+func (m *Mailer) Send(to, subject, body string) error {
+	if !m.Enabled() {
+		return fmt.Errorf("system mail is not configured")
+	}
+
+	msg, err := m.buildMessage(to, subject, body)
+	if err != nil {
+		return err
+	}
+
+	client, err := m.dial()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if m.cfg.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, m.cfg.Host)); err != nil {
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+	if err := client.Mail(m.cfg.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+func (m *Mailer) dial() (*smtp.Client, error) {
+	addr := net.JoinHostPort(m.cfg.Host, fmt.Sprintf("%d", m.cfg.Port))
+	dialer := &net.Dialer{Timeout: mailTimeout}
+
+	if m.cfg.TLS && m.cfg.Port == 465 {
+		// Implicit TLS (SMTPS)
+		conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: m.cfg.Host})
+		if err != nil {
+			return nil, fmt.Errorf("TLS connection failed: %w", err)
+		}
+		conn.SetDeadline(time.Now().Add(mailTimeout))
+		return smtp.NewClient(conn, m.cfg.Host)
+	}
+
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("connection failed: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(mailTimeout))
+	client, err := smtp.NewClient(conn, m.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if m.cfg.TLS {
+		if err := client.StartTLS(&tls.Config{ServerName: m.cfg.Host}); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	}
+	return client, nil
+}
+
+func (m *Mailer) buildMessage(to, subject, body string) ([]byte, error) {
+	var buf bytes.Buffer
+	// Subjects often contain user data (event titles); keep them on one line
+	subject = strings.Join(strings.Fields(subject), " ")
+	domain := m.cfg.Host
+	if at := strings.LastIndex(m.cfg.From, "@"); at >= 0 {
+		domain = m.cfg.From[at+1:]
+	}
+
+	fmt.Fprintf(&buf, "From: Tessera <%s>\r\n", m.cfg.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", to)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\r\n", uuid.New().String(), domain)
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n")
+	buf.WriteString("Auto-Submitted: auto-generated\r\n")
+	buf.WriteString("\r\n")
+
+	qp := quotedprintable.NewWriter(&buf)
+	if _, err := qp.Write([]byte(strings.ReplaceAll(body, "\n", "\r\n"))); err != nil {
+		return nil, err
+	}
+	if err := qp.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,254 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+
+	"github.com/tessera/tessera/internal/repository"
+)
+
+// DefaultQuotaWarnings are the shares of their quota, in percent, at which
+// users are warned that their storage is filling up, when the admin hasn't
+// set any
+var DefaultQuotaWarnings = []int{80, 90, 100}
+
+// NotificationStorageQuota is the type of notifications warning a user
+// about their storage
+const NotificationStorageQuota = "storage_quota"
+
+// NotificationQueue delivers notifications to users in the background
+type NotificationQueue interface {
+	ScheduleNotification(ctx context.Context, userID, notifType, title, message string, data map[string]interface{}) error
+}
+
+// QuotaService keeps users' storage used and enforces their storage limit.
+// Everything that stores content for a user charges it here first, and
+// gives it back when the content is deleted, so storage used stays what
+// their files, versions and email attachments take up. Writes that fail
+// after charging give the charge back; whatever still drifts, such as
+// attachments of deleted emails, is corrected by Reconcile.
+type QuotaService struct {
+	users         *repository.UserRepository
+	settings      *repository.SettingsRepository
+	notifications NotificationQueue
+	log           zerolog.Logger
+}
+
+// NewQuotaService creates a new quota service
+func NewQuotaService(users *repository.UserRepository, settings *repository.SettingsRepository, log zerolog.Logger) *QuotaService {
+	return &QuotaService{
+		users:    users,
+		settings: settings,
+		log:      log,
+	}
+}
+
+// SetNotifications enables warnings, sent whenever a user's storage used
+// reaches one of the warning thresholds
+func (s *QuotaService) SetNotifications(queue NotificationQueue) {
+	s.notifications = queue
+}
+
+// Available returns how much more the user may store, or -1 when they have
+// no limit
+func (s *QuotaService) Available(ctx context.Context, userID uuid.UUID) (int64, error) {
+	user, err := s.users.GetByID(ctx, userID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get user: %w", err)
+	}
+	if user.StorageLimit <= 0 {
+		return -1, nil
+	}
+	return max(user.StorageLimit-user.StorageUsed, 0), nil
+}
+
+// Check returns ErrQuotaExceeded when storing size more would take the user
+// past their limit. It records nothing, so it only refuses writes early;
+// Charge decides.
+func (s *QuotaService) Check(ctx context.Context, userID uuid.UUID, size int64) error {
+	available, err := s.Available(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if available >= 0 && size > available {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// Charge adds size to the user's storage used, or returns ErrQuotaExceeded
+// when that would take them past their limit. Storing nothing always
+// succeeds.
+func (s *QuotaService) Charge(ctx context.Context, userID uuid.UUID, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	usage, err := s.users.ChargeStorage(ctx, userID, size)
+	if errors.Is(err, repository.ErrStorageLimit) {
+		return ErrQuotaExceeded
+	}
+	if err != nil {
+		return fmt.Errorf("failed to charge storage: %w", err)
+	}
+	s.warn(ctx, usage, nil)
+	return nil
+}
+
+// Release takes size off the user's storage used, after content was
+// deleted or a write that charged it failed. Failures are only logged;
+// Reconcile corrects them.
+func (s *QuotaService) Release(ctx context.Context, userID uuid.UUID, size int64) {
+	if size <= 0 {
+		return
+	}
+	usage, err := s.users.ReleaseStorage(ctx, userID, size)
+	if err != nil {
+		s.log.Error().Err(err).Str("user_id", userID.String()).Msg("Failed to update storage used")
+		return
+	}
+	s.warn(ctx, usage, nil)
+}
+
+// QuotaWarnings returns the warning thresholds set by the admin, in percent
+// of users' quota, from lowest to highest
+func (s *QuotaService) QuotaWarnings(ctx context.Context) []int {
+	stored, err := s.settings.Get(ctx, "system_settings")
+	if err != nil {
+		return DefaultQuotaWarnings
+	}
+	values, ok := stored["quotaWarnings"].([]interface{})
+	if !ok {
+		return DefaultQuotaWarnings
+	}
+	thresholds := make([]int, 0, len(values))
+	for _, v := range values {
+		pct, ok := v.(float64)
+		if !ok || !ValidQuotaWarning(int(pct)) {
+			return DefaultQuotaWarnings
+		}
+		thresholds = append(thresholds, int(pct))
+	}
+	sort.Ints(thresholds)
+	return thresholds
+}
+
+// ValidQuotaWarning reports whether pct can be a warning threshold
+func ValidQuotaWarning(pct int) bool {
+	return pct > 0 && pct <= 100
+}
+
+// warningLevel returns the highest threshold used has reached, or 0
+func warningLevel(thresholds []int, used, limit int64) int {
+	if limit <= 0 {
+		return 0
+	}
+	level := 0
+	for _, pct := range thresholds {
+		if used*100 >= int64(pct)*limit {
+			level = max(level, pct)
+		}
+	}
+	return level
+}
+
+// warn notifies a user who reached a threshold above the one they were last
+// warned about, and records the threshold they're at, so they're warned
+// again after going below it and back up. It reports whether they were
+// warned. thresholds are looked up when nil.
+func (s *QuotaService) warn(ctx context.Context, usage *repository.StorageUsage, thresholds []int) bool {
+	if usage.Limit <= 0 && usage.WarnedPct == 0 {
+		return false
+	}
+	if thresholds == nil {
+		thresholds = s.QuotaWarnings(ctx)
+	}
+	level := warningLevel(thresholds, usage.Used, usage.Limit)
+	if level == usage.WarnedPct {
+		return false
+	}
+
+	// Only the write that moves the user to the new threshold warns them
+	changed, err := s.users.SetQuotaWarned(ctx, usage.UserID, level)
+	if err != nil {
+		s.log.Error().Err(err).Str("user_id", usage.UserID.String()).Msg("Failed to record storage warning")
+		return false
+	}
+	if !changed || level < usage.WarnedPct || s.notifications == nil {
+		return false
+	}
+
+	title := fmt.Sprintf("Your storage is %d%% full", level)
+	if level >= 100 {
+		title = "Your storage is full"
+	}
+	message := fmt.Sprintf("You're using %s of your %s of storage.", formatBytes(usage.Used), formatBytes(usage.Limit))
+	if level >= 100 {
+		message += " Delete files or empty your trash to store new ones."
+	}
+	data := map[string]interface{}{
+		"threshold": level,
+		"used":      usage.Used,
+		"limit":     usage.Limit,
+	}
+	if err := s.notifications.ScheduleNotification(ctx, usage.UserID.String(), NotificationStorageQuota, title, message, data); err != nil {
+		s.log.Warn().Err(err).Str("user_id", usage.UserID.String()).Msg("Failed to schedule storage warning")
+		return false
+	}
+	return true
+}
+
+// QuotaReconcile reports what Reconcile corrected
+type QuotaReconcile struct {
+	// Corrected lists the users whose storage used was off
+	Corrected []*repository.UsageMismatch `json:"corrected"`
+	// Warned counts the users newly warned about their storage
+	Warned int `json:"warned"`
+}
+
+// Reconcile sets the storage used of every user, or of one when userID is
+// set, to what their files, versions and attachments take up, and warns
+// those who reached a threshold. A write charged but not stored yet while
+// it runs is left out, until the next run.
+func (s *QuotaService) Reconcile(ctx context.Context, userID *uuid.UUID) (*QuotaReconcile, error) {
+	corrected, err := s.users.ReconcileStorageUsed(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reconcile storage used: %w", err)
+	}
+	result := &QuotaReconcile{Corrected: corrected}
+
+	usages, err := s.users.ListStorageUsage(ctx, userID)
+	if err != nil {
+		return result, fmt.Errorf("failed to list storage used: %w", err)
+	}
+	thresholds := s.QuotaWarnings(ctx)
+	for _, usage := range usages {
+		if s.warn(ctx, usage, thresholds) {
+			result.Warned++
+		}
+	}
+	return result, nil
+}
+
+// TopConsumers returns the users taking up the most storage
+func (s *QuotaService) TopConsumers(ctx context.Context, limit int) ([]*repository.StorageConsumer, error) {
+	return s.users.TopStorageConsumers(ctx, limit)
+}
+
+// formatBytes renders a size for people, such as "9.1 GB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTP"[exp])
+}
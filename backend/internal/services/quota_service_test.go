@@ -0,0 +1,47 @@
+package services
+
+import "testing"
+
+func TestWarningLevel(t *testing.T) {
+	thresholds := []int{80, 90, 100}
+	tests := []struct {
+		used, limit int64
+		want        int
+	}{
+		{0, 1000, 0},
+		{799, 1000, 0},
+		{800, 1000, 80},
+		{899, 1000, 80},
+		{950, 1000, 90},
+		{1000, 1000, 100},
+		{1200, 1000, 100},
+		// Without a limit nobody is warned
+		{1 << 40, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := warningLevel(thresholds, tt.used, tt.limit); got != tt.want {
+			t.Errorf("warningLevel(%d, %d) = %d, want %d", tt.used, tt.limit, got, tt.want)
+		}
+	}
+	if got := warningLevel(nil, 1000, 1000); got != 0 {
+		t.Errorf("warningLevel() without thresholds = %d, want 0", got)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := map[int64]string{
+		0:                 "0 B",
+		1023:              "1023 B",
+		1536:              "1.5 KB",
+		10 << 30:          "10.0 GB",
+		9_800_000_000:     "9.1 GB",
+		3 << 50:           "3.0 PB",
+		1 << 62:           "4096.0 PB",
+		5*(1<<40) + 1<<39: "5.5 TB",
+	}
+	for n, want := range tests {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
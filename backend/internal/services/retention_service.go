@@ -0,0 +1,381 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+
+	"github.com/tessera/tessera/internal/models"
+	"github.com/tessera/tessera/internal/repository"
+)
+
+// DefaultTrashRetentionDays is how long trashed files are kept when the
+// admin hasn't set a retention
+const DefaultTrashRetentionDays = 30
+
+// retentionBatch is how many trashed files or shares are handled at a time
+const retentionBatch = 100
+
+// VersionCleanupQueue schedules pruning of a file's versions in the
+// background
+type VersionCleanupQueue interface {
+	ScheduleVersionCleanup(ctx context.Context, fileID string) error
+}
+
+// VersionPolicy decides which earlier versions of a file are kept. The
+// newest KeepLast always are. With Thin set, older ones are thinned out by
+// age: one per hour is kept for HourlyDays, then one per day until
+// DailyDays, then one per week, until WeeklyWeeks if that isn't 0. Pinned
+// versions are never pruned.
+type VersionPolicy struct {
+	KeepLast    int  `json:"keepLast"`
+	Thin        bool `json:"thin"`
+	HourlyDays  int  `json:"hourlyDays"`
+	DailyDays   int  `json:"dailyDays"`
+	WeeklyWeeks int  `json:"weeklyWeeks"`
+}
+
+// DefaultVersionPolicy applies when the admin hasn't set one
+var DefaultVersionPolicy = VersionPolicy{
+	KeepLast:   10,
+	Thin:       true,
+	HourlyDays: 1,
+	DailyDays:  30,
+}
+
+// Valid reports whether no field of the policy is negative
+func (p VersionPolicy) Valid() bool {
+	return p.KeepLast >= 0 && p.HourlyDays >= 0 && p.DailyDays >= 0 && p.WeeklyWeeks >= 0
+}
+
+// versionBucket is a period of which thinning keeps one version
+type versionBucket struct {
+	period time.Duration
+	start  time.Time
+}
+
+// Expired returns the versions the policy doesn't keep at now. Of the
+// versions in one thinning period the newest is kept.
+func (p VersionPolicy) Expired(versions []*models.FileVersion, now time.Time) []*models.FileVersion {
+	sorted := make([]*models.FileVersion, len(versions))
+	copy(sorted, versions)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].CreatedAt.After(sorted[j].CreatedAt)
+	})
+
+	const day = 24 * time.Hour
+	kept := map[versionBucket]bool{}
+	expired := make([]*models.FileVersion, 0)
+	for i, v := range sorted {
+		age := now.Sub(v.CreatedAt)
+		var period time.Duration
+		switch {
+		case age < time.Duration(p.HourlyDays)*day:
+			period = time.Hour
+		case age < time.Duration(p.DailyDays)*day:
+			period = day
+		case p.WeeklyWeeks == 0 || age < time.Duration(p.WeeklyWeeks)*7*day:
+			period = 7 * day
+		}
+		bucket := versionBucket{period: period, start: v.CreatedAt.UTC().Truncate(period)}
+
+		keep := v.Pinned || i < p.KeepLast
+		if !keep && p.Thin && period > 0 {
+			keep = !kept[bucket]
+		}
+		if !keep {
+			expired = append(expired, v)
+			continue
+		}
+		if period > 0 {
+			kept[bucket] = true
+		}
+	}
+	return expired
+}
+
+// retentionFiles is the file metadata a RetentionService purges
+type retentionFiles interface {
+	GetByID(ctx context.Context, id uuid.UUID) (*models.File, error)
+	GetTreeSize(ctx context.Context, id uuid.UUID) (int64, error)
+	GetVersions(ctx context.Context, fileID uuid.UUID) ([]*models.FileVersion, error)
+	ListVersionedFiles(ctx context.Context, after uuid.UUID, limit int) ([]uuid.UUID, error)
+	ListExpiredTrash(ctx context.Context, defaultDays int, now, afterTime time.Time, afterID uuid.UUID, limit int) ([]*repository.ExpiredTrash, error)
+	ListExpiredShares(ctx context.Context, now time.Time, afterID uuid.UUID, limit int) ([]*repository.ExpiredShare, error)
+	DeleteExpiredShares(ctx context.Context, now time.Time, limit int) ([]*repository.ExpiredShare, error)
+}
+
+// fileRemover deletes files and versions along with their content
+type fileRemover interface {
+	permanentDelete(ctx context.Context, file *models.File) (int64, error)
+	deleteVersions(ctx context.Context, file *models.File, versions []*models.FileVersion) (int, int64, error)
+}
+
+// settingsStore holds the settings set by the admin
+type settingsStore interface {
+	Get(ctx context.Context, key string) (map[string]interface{}, error)
+}
+
+// activityLog records what happened to users' files
+type activityLog interface {
+	Log(ctx context.Context, userID uuid.UUID, action, resourceType, resourceID, ipAddress, userAgent string, details map[string]interface{}) error
+}
+
+// RetentionService purges what has been kept long enough: trashed files
+// past their owner's retention, shares that expired or ran out of downloads
+// or uploads, and file versions the version policy doesn't keep. Removed
+// files and shares are recorded in the activity log.
+type RetentionService struct {
+	files    fileRemover
+	fileRepo retentionFiles
+	settings settingsStore
+	activity activityLog
+	log      zerolog.Logger
+}
+
+// NewRetentionService creates a new retention service
+func NewRetentionService(files *FileService, fileRepo *repository.FileRepository, settings *repository.SettingsRepository, activity *repository.ActivityRepository, log zerolog.Logger) *RetentionService {
+	return &RetentionService{
+		files:    files,
+		fileRepo: fileRepo,
+		settings: settings,
+		activity: activity,
+		log:      log,
+	}
+}
+
+// PurgedFile is a trashed file removed, or to be removed, by PurgeTrash
+type PurgedFile struct {
+	ID            uuid.UUID `json:"id"`
+	OwnerID       uuid.UUID `json:"ownerId"`
+	Name          string    `json:"name"`
+	IsFolder      bool      `json:"isFolder"`
+	Size          int64     `json:"size"` // with versions and folder contents
+	TrashedAt     time.Time `json:"trashedAt"`
+	RetentionDays int       `json:"retentionDays"`
+}
+
+// TrashPurge reports what PurgeTrash removed, or would remove on a dry run
+type TrashPurge struct {
+	Files      []*PurgedFile `json:"files"`
+	BytesFreed int64         `json:"bytesFreed"`
+	// Skipped counts files that couldn't be purged, such as locked ones;
+	// they're tried again on the next run
+	Skipped int `json:"skipped"`
+}
+
+// TrashRetentionDays returns how many days trashed files are kept unless
+// their owner has a retention of their own; 0 keeps them forever
+func (s *RetentionService) TrashRetentionDays(ctx context.Context) int {
+	stored, err := s.settings.Get(ctx, "system_settings")
+	if err != nil {
+		return DefaultTrashRetentionDays
+	}
+	if days, ok := stored["trashRetentionDays"].(float64); ok && days >= 0 {
+		return int(days)
+	}
+	return DefaultTrashRetentionDays
+}
+
+// PurgeTrash permanently deletes trashed files kept past their retention,
+// with their versions and stored content, giving the storage back to their
+// owners. With dryRun set nothing is deleted.
+func (s *RetentionService) PurgeTrash(ctx context.Context, dryRun bool) (*TrashPurge, error) {
+	days := s.TrashRetentionDays(ctx)
+	now := time.Now()
+	report := &TrashPurge{Files: make([]*PurgedFile, 0)}
+
+	var afterTime time.Time
+	var afterID uuid.UUID
+	for {
+		expired, err := s.fileRepo.ListExpiredTrash(ctx, days, now, afterTime, afterID, retentionBatch)
+		if err != nil {
+			return report, err
+		}
+		for _, item := range expired {
+			afterTime, afterID = item.TrashedAt, item.ID
+			purged, err := s.purgeFile(ctx, item, dryRun)
+			if err != nil {
+				s.log.Warn().Err(err).Str("file_id", item.ID.String()).Msg("Failed to purge trashed file")
+				report.Skipped++
+				continue
+			}
+			if purged != nil {
+				report.Files = append(report.Files, purged)
+				report.BytesFreed += purged.Size
+			}
+		}
+		if len(expired) < retentionBatch {
+			return report, nil
+		}
+	}
+}
+
+// purgeFile deletes one expired file. It returns nil for a file already
+// gone, such as one inside a folder purged before it.
+func (s *RetentionService) purgeFile(ctx context.Context, item *repository.ExpiredTrash, dryRun bool) (*PurgedFile, error) {
+	file, err := s.fileRepo.GetByID(ctx, item.ID)
+	if errors.Is(err, repository.ErrFileNotFound) || (err == nil && !file.IsTrashed) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	purged := &PurgedFile{
+		ID:            item.ID,
+		OwnerID:       item.OwnerID,
+		Name:          item.Name,
+		IsFolder:      item.IsFolder,
+		TrashedAt:     item.TrashedAt,
+		RetentionDays: item.RetentionDays,
+	}
+	if dryRun {
+		purged.Size, err = s.fileRepo.GetTreeSize(ctx, file.ID)
+		return purged, err
+	}
+
+	if purged.Size, err = s.files.permanentDelete(ctx, file); err != nil {
+		return nil, err
+	}
+	resourceType := "file"
+	if item.IsFolder {
+		resourceType = "folder"
+	}
+	s.audit(ctx, item.OwnerID, "trash_purged", resourceType, item.ID, map[string]interface{}{
+		"name":           item.Name,
+		"size":           purged.Size,
+		"trashed_at":     item.TrashedAt,
+		"retention_days": item.RetentionDays,
+	})
+	return purged, nil
+}
+
+// PurgeShares deletes shares that expired, links downloaded as often as
+// they allow and file requests that received all their uploads. With dryRun
+// set nothing is deleted.
+func (s *RetentionService) PurgeShares(ctx context.Context, dryRun bool) ([]*repository.ExpiredShare, error) {
+	now := time.Now()
+	shares := make([]*repository.ExpiredShare, 0)
+
+	var afterID uuid.UUID
+	for {
+		var batch []*repository.ExpiredShare
+		var err error
+		if dryRun {
+			batch, err = s.fileRepo.ListExpiredShares(ctx, now, afterID, retentionBatch)
+		} else {
+			batch, err = s.fileRepo.DeleteExpiredShares(ctx, now, retentionBatch)
+		}
+		if err != nil {
+			return shares, err
+		}
+		for _, share := range batch {
+			afterID = share.ID
+			if !dryRun {
+				s.audit(ctx, share.OwnerID, "share_expired", "share", share.ID, map[string]interface{}{
+					"file_id":   share.FileID,
+					"file_name": share.FileName,
+					"reason":    share.Reason,
+				})
+			}
+		}
+		shares = append(shares, batch...)
+		if len(batch) < retentionBatch {
+			return shares, nil
+		}
+	}
+}
+
+// audit records a removal in the activity log. The entry is only a record,
+// so failing to write it doesn't fail the purge.
+func (s *RetentionService) audit(ctx context.Context, ownerID uuid.UUID, action, resourceType string, resourceID uuid.UUID, details map[string]interface{}) {
+	if err := s.activity.Log(ctx, ownerID, action, resourceType, resourceID.String(), "", "", details); err != nil {
+		s.log.Warn().Err(err).Str("action", action).Str("resource_id", resourceID.String()).Msg("Failed to record activity")
+	}
+}
+
+// VersionPolicy returns the version retention policy set by the admin
+func (s *RetentionService) VersionPolicy(ctx context.Context) VersionPolicy {
+	policy := DefaultVersionPolicy
+	stored, err := s.settings.Get(ctx, "system_settings")
+	if err != nil || stored["versionPolicy"] == nil {
+		return policy
+	}
+	// Merge the stored policy onto the default through JSON
+	raw, err := json.Marshal(stored["versionPolicy"])
+	if err != nil || json.Unmarshal(raw, &policy) != nil || !policy.Valid() {
+		return DefaultVersionPolicy
+	}
+	return policy
+}
+
+// PruneVersions deletes the versions of a file the version policy doesn't
+// keep. It returns how many it deleted and the storage given back.
+func (s *RetentionService) PruneVersions(ctx context.Context, fileID uuid.UUID) (int, int64, error) {
+	return s.pruneVersions(ctx, fileID, s.VersionPolicy(ctx), time.Now())
+}
+
+func (s *RetentionService) pruneVersions(ctx context.Context, fileID uuid.UUID, policy VersionPolicy, now time.Time) (int, int64, error) {
+	file, err := s.fileRepo.GetByID(ctx, fileID)
+	if errors.Is(err, repository.ErrFileNotFound) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+
+	versions, err := s.fileRepo.GetVersions(ctx, file.ID)
+	if err != nil {
+		return 0, 0, err
+	}
+	expired := policy.Expired(versions, now)
+	if len(expired) == 0 {
+		return 0, 0, nil
+	}
+	return s.files.deleteVersions(ctx, file, expired)
+}
+
+// VersionSweep reports what SweepVersions pruned
+type VersionSweep struct {
+	Files      int   `json:"files"` // files that lost versions
+	Versions   int   `json:"versions"`
+	BytesFreed int64 `json:"bytesFreed"`
+}
+
+// SweepVersions applies the version policy to every file with versions,
+// pruning those that aged out of it since the file was last written
+func (s *RetentionService) SweepVersions(ctx context.Context) (*VersionSweep, error) {
+	policy := s.VersionPolicy(ctx)
+	now := time.Now()
+	sweep := &VersionSweep{}
+
+	var after uuid.UUID
+	for {
+		ids, err := s.fileRepo.ListVersionedFiles(ctx, after, retentionBatch)
+		if err != nil {
+			return sweep, err
+		}
+		for _, id := range ids {
+			after = id
+			pruned, size, err := s.pruneVersions(ctx, id, policy, now)
+			if err != nil {
+				s.log.Warn().Err(err).Str("file_id", id.String()).Msg("Failed to prune file versions")
+				continue
+			}
+			if pruned > 0 {
+				sweep.Files++
+				sweep.Versions += pruned
+				sweep.BytesFreed += size
+			}
+		}
+		if len(ids) < retentionBatch {
+			return sweep, nil
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+
+	"github.com/tessera/tessera/internal/models"
+	"github.com/tessera/tessera/internal/repository"
+)
+
+// versionsAt returns versions created at the given ages before now, newest
+// first, numbered from the oldest
+func versionsAt(now time.Time, ages ...time.Duration) []*models.FileVersion {
+	versions := make([]*models.FileVersion, len(ages))
+	for i, age := range ages {
+		versions[i] = &models.FileVersion{Version: len(ages) - i, CreatedAt: now.Add(-age)}
+	}
+	return versions
+}
+
+func expiredNumbers(expired []*models.FileVersion) []int {
+	numbers := make([]int, len(expired))
+	for i, v := range expired {
+		numbers[i] = v.Version
+	}
+	slices.Sort(numbers)
+	return numbers
+}
+
+func TestVersionPolicyExpired(t *testing.T) {
+	now := time.Date(2025, 6, 15, 12, 30, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	t.Run("keeps only the last versions without thinning", func(t *testing.T) {
+		policy := VersionPolicy{KeepLast: 2}
+		versions := versionsAt(now, time.Minute, time.Hour, 2*time.Hour, 3*day)
+		if got := expiredNumbers(policy.Expired(versions, now)); !slices.Equal(got, []int{1, 2}) {
+			t.Errorf("expired = %v, want [1 2]", got)
+		}
+	})
+
+	t.Run("thins hourly, daily and then weekly", func(t *testing.T) {
+		policy := VersionPolicy{Thin: true, HourlyDays: 1, DailyDays: 30}
+		versions := versionsAt(now,
+			5*time.Minute,       // 10: newest of the 12:00 hour
+			10*time.Minute,      // 9: same hour
+			2*time.Hour,         // 8: 10:00 hour
+			3*day,               // 7: newest of its day
+			3*day+time.Hour,     // 6: same day
+			5*day,               // 5: another day
+			60*day,              // 4: newest of its week
+			60*day+time.Hour,    // 3: same week
+			200*day,             // 2: another week
+			200*day+time.Minute, // 1: same week
+		)
+		if got := expiredNumbers(policy.Expired(versions, now)); !slices.Equal(got, []int{1, 3, 6, 9}) {
+			t.Errorf("expired = %v, want [1 3 6 9]", got)
+		}
+	})
+
+	t.Run("drops versions older than the weekly limit", func(t *testing.T) {
+		policy := VersionPolicy{Thin: true, HourlyDays: 1, DailyDays: 7, WeeklyWeeks: 4}
+		versions := versionsAt(now, time.Hour, 20*day, 40*day)
+		if got := expiredNumbers(policy.Expired(versions, now)); !slices.Equal(got, []int{1}) {
+			t.Errorf("expired = %v, want [1]", got)
+		}
+	})
+
+	t.Run("never prunes pinned versions", func(t *testing.T) {
+		policy := VersionPolicy{KeepLast: 1}
+		versions := versionsAt(now, time.Minute, time.Hour, 400*day)
+		versions[2].Pinned = true
+		if got := expiredNumbers(policy.Expired(versions, now)); !slices.Equal(got, []int{2}) {
+			t.Errorf("expired = %v, want [2]", got)
+		}
+	})
+
+	t.Run("the last versions take up their period", func(t *testing.T) {
+		policy := VersionPolicy{KeepLast: 1, Thin: true, HourlyDays: 1}
+		versions := versionsAt(now, time.Minute, 2*time.Minute)
+		if got := expiredNumbers(policy.Expired(versions, now)); !slices.Equal(got, []int{1}) {
+			t.Errorf("expired = %v, want [1]", got)
+		}
+	})
+}
+
+// fakeRetentionFiles returns trashed files and shares past their retention
+// as the repository's queries do, and deletes them
+type fakeRetentionFiles struct {
+	files   map[uuid.UUID]*models.File
+	expired []*repository.ExpiredTrash // oldest first
+	shares  []*repository.ExpiredShare // by ID
+	locked  map[uuid.UUID]bool
+	days    int // the retention ListExpiredTrash was given
+}
+
+func (r *fakeRetentionFiles) GetByID(_ context.Context, id uuid.UUID) (*models.File, error) {
+	file, ok := r.files[id]
+	if !ok {
+		return nil, repository.ErrFileNotFound
+	}
+	return file, nil
+}
+
+// tree returns a file and the files inside it
+func (r *fakeRetentionFiles) tree(id uuid.UUID) []*models.File {
+	tree := []*models.File{r.files[id]}
+	for _, f := range r.files {
+		if f.ParentID != nil && *f.ParentID == id {
+			tree = append(tree, f)
+		}
+	}
+	return tree
+}
+
+func (r *fakeRetentionFiles) GetTreeSize(_ context.Context, id uuid.UUID) (int64, error) {
+	var size int64
+	for _, f := range r.tree(id) {
+		size += f.Size
+	}
+	return size, nil
+}
+
+func (r *fakeRetentionFiles) permanentDelete(ctx context.Context, file *models.File) (int64, error) {
+	if r.locked[file.ID] {
+		return 0, ErrLocked
+	}
+	size, _ := r.GetTreeSize(ctx, file.ID)
+	for _, f := range r.tree(file.ID) {
+		delete(r.files, f.ID)
+	}
+	return size, nil
+}
+
+// The purge tests keep no versions
+func (r *fakeRetentionFiles) GetVersions(_ context.Context, _ uuid.UUID) ([]*models.FileVersion, error) {
+	return nil, nil
+}
+
+func (r *fakeRetentionFiles) ListVersionedFiles(_ context.Context, _ uuid.UUID, _ int) ([]uuid.UUID, error) {
+	return nil, nil
+}
+
+func (r *fakeRetentionFiles) deleteVersions(_ context.Context, _ *models.File, _ []*models.FileVersion) (int, int64, error) {
+	return 0, 0, nil
+}
+
+func (r *fakeRetentionFiles) ListExpiredTrash(_ context.Context, defaultDays int, _, afterTime time.Time, afterID uuid.UUID, limit int) ([]*repository.ExpiredTrash, error) {
+	r.days = defaultDays
+	var batch []*repository.ExpiredTrash
+	for _, item := range r.expired {
+		after := item.TrashedAt.After(afterTime) || (item.TrashedAt.Equal(afterTime) && bytes.Compare(item.ID[:], afterID[:]) > 0)
+		if after && len(batch) < limit {
+			batch = append(batch, item)
+		}
+	}
+	return batch, nil
+}
+
+func (r *fakeRetentionFiles) ListExpiredShares(_ context.Context, _ time.Time, afterID uuid.UUID, limit int) ([]*repository.ExpiredShare, error) {
+	var batch []*repository.ExpiredShare
+	for _, share := range r.shares {
+		if bytes.Compare(share.ID[:], afterID[:]) > 0 && len(batch) < limit {
+			batch = append(batch, share)
+		}
+	}
+	return batch, nil
+}
+
+func (r *fakeRetentionFiles) DeleteExpiredShares(_ context.Context, _ time.Time, limit int) ([]*repository.ExpiredShare, error) {
+	n := min(limit, len(r.shares))
+	batch := r.shares[:n]
+	r.shares = r.shares[n:]
+	return batch, nil
+}
+
+// fakeSettings holds the system settings in memory
+type fakeSettings map[string]interface{}
+
+func (f fakeSettings) Get(ctx context.Context, key string) (map[string]interface{}, error) {
+	return f, nil
+}
+
+// fakeActivity collects the actions logged
+type fakeActivity struct {
+	actions []string
+}
+
+func (f *fakeActivity) Log(ctx context.Context, userID uuid.UUID, action, resourceType, resourceID, ipAddress, userAgent string, details map[string]interface{}) error {
+	f.actions = append(f.actions, action)
+	return nil
+}
+
+func newTestRetentionService(settings fakeSettings) (*RetentionService, *fakeRetentionFiles, *fakeActivity) {
+	files := &fakeRetentionFiles{files: map[uuid.UUID]*models.File{}, locked: map[uuid.UUID]bool{}}
+	activity := &fakeActivity{}
+	s := &RetentionService{
+		files:    files,
+		fileRepo: files,
+		settings: settings,
+		activity: activity,
+		log:      zerolog.Nop(),
+	}
+	return s, files, activity
+}
+
+func TestTrashRetentionDays(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings fakeSettings
+		want     int
+	}{
+		{"unset", fakeSettings{}, DefaultTrashRetentionDays},
+		{"set", fakeSettings{"trashRetentionDays": float64(7)}, 7},
+		{"forever", fakeSettings{"trashRetentionDays": float64(0)}, 0},
+		{"negative", fakeSettings{"trashRetentionDays": float64(-1)}, DefaultTrashRetentionDays},
+		{"not a number", fakeSettings{"trashRetentionDays": "7"}, DefaultTrashRetentionDays},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _, _ := newTestRetentionService(tt.settings)
+			if got := s.TrashRetentionDays(context.Background()); got != tt.want {
+				t.Errorf("TrashRetentionDays() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	ctx := context.Background()
+	s, files, activity := newTestRetentionService(fakeSettings{"trashRetentionDays": float64(14)})
+	owner := uuid.New()
+	trashedAt := time.Now().Add(-30 * 24 * time.Hour)
+
+	// expire adds a trashed file past its retention, each trashed after the
+	// one before
+	expire := func(name string, parent *models.File, size int64) *models.File {
+		file := &models.File{ID: uuid.New(), OwnerID: owner, Name: name, Size: size, IsTrashed: true}
+		if parent != nil {
+			file.ParentID = &parent.ID
+		}
+		files.files[file.ID] = file
+		files.expired = append(files.expired, &repository.ExpiredTrash{
+			ID:        file.ID,
+			OwnerID:   owner,
+			Name:      name,
+			TrashedAt: trashedAt.Add(time.Duration(len(files.expired)) * time.Second),
+		})
+		return file
+	}
+
+	folder := expire("Old folder", nil, 0)
+	expire("inside.txt", folder, 6) // listed, but gone with its folder
+	locked := expire("locked.txt", nil, 1)
+	files.locked[locked.ID] = true
+	restored := expire("restored.txt", nil, 1)
+	restored.IsTrashed = false
+	// More than a batch, so the listing continues
+	for i := 0; i < retentionBatch; i++ {
+		expire(fmt.Sprintf("%d.txt", i), nil, 2)
+	}
+	wantFiles := 1 + retentionBatch
+	wantBytes := int64(6 + 2*retentionBatch)
+
+	t.Run("dry run", func(t *testing.T) {
+		report, err := s.PurgeTrash(ctx, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Nothing is deleted, so the file inside the folder is listed too
+		if len(report.Files) != wantFiles+2 || report.BytesFreed != wantBytes+6+1 {
+			t.Errorf("dry run reports %d files, %d bytes; want %d, %d", len(report.Files), report.BytesFreed, wantFiles+2, wantBytes+6+1)
+		}
+		if files.days != 14 {
+			t.Errorf("listed trash kept over %d days, want 14", files.days)
+		}
+		if len(files.files) != len(files.expired) || len(activity.actions) != 0 {
+			t.Errorf("dry run deleted files or logged removals")
+		}
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		report, err := s.PurgeTrash(ctx, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Files) != wantFiles || report.BytesFreed != wantBytes || report.Skipped != 1 {
+			t.Errorf("purge = %d files, %d bytes, %d skipped; want %d, %d, 1", len(report.Files), report.BytesFreed, report.Skipped, wantFiles, wantBytes)
+		}
+		if report.Files[0].Name != "Old folder" || report.Files[0].Size != 6 {
+			t.Errorf("first purged = %+v, want the folder with what's inside", report.Files[0])
+		}
+		if len(files.files) != 2 || files.files[locked.ID] == nil || files.files[restored.ID] == nil {
+			t.Errorf("left %d files, want only the locked and restored ones", len(files.files))
+		}
+		if len(activity.actions) != wantFiles || activity.actions[0] != "trash_purged" {
+			t.Errorf("logged %d actions, want %d", len(activity.actions), wantFiles)
+		}
+	})
+}
+
+func TestPurgeShares(t *testing.T) {
+	ctx := context.Background()
+	s, files, activity := newTestRetentionService(fakeSettings{})
+	for i := 0; i < retentionBatch+5; i++ {
+		files.shares = append(files.shares, &repository.ExpiredShare{ID: uuid.New(), Reason: "expired"})
+	}
+	slices.SortFunc(files.shares, func(a, b *repository.ExpiredShare) int {
+		return bytes.Compare(a.ID[:], b.ID[:])
+	})
+	total := len(files.shares)
+
+	dry, err := s.PurgeShares(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dry) != total || len(files.shares) != total || len(activity.actions) != 0 {
+		t.Errorf("dry run listed %d of %d shares, left %d, logged %d", len(dry), total, len(files.shares), len(activity.actions))
+	}
+
+	purged, err := s.PurgeShares(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != total || len(files.shares) != 0 {
+		t.Errorf("purged %d of %d shares, left %d", len(purged), total, len(files.shares))
+	}
+	if len(activity.actions) != total || activity.actions[0] != "share_expired" {
+		t.Errorf("logged %d actions, want %d share_expired", len(activity.actions), total)
+	}
+}
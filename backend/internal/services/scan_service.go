@@ -0,0 +1,373 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+
+	"github.com/tessera/tessera/internal/models"
+	"github.com/tessera/tessera/internal/repository"
+	"github.com/tessera/tessera/internal/security"
+	"github.com/tessera/tessera/internal/storage"
+)
+
+// scanBatchSize is how many files or attachments a rescan lists at a time
+const scanBatchSize = 200
+
+// NotificationVirusFound is the type of notifications telling admins about
+// an infected upload
+const NotificationVirusFound = "virus_found"
+
+// ErrInfected is returned for content found to contain malware, which is
+// neither served nor shared
+var ErrInfected = errors.New("file is infected")
+
+// Scanner scans content for malware; security.Clamd is one
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (*security.ScanResult, error)
+	Version(ctx context.Context) (string, error)
+}
+
+// ScanQueue schedules virus scans of files in the background
+type ScanQueue interface {
+	ScheduleVirusScan(ctx context.Context, fileID string) error
+}
+
+// ScanService scans uploads for malware. Files are scanned in the
+// background after every write; until their scan is done they are
+// "pending" and served as usual, and once found infected they are
+// quarantined: their content isn't served, shared or archived, and admins
+// are notified. Email attachments are scanned before they are stored, and
+// infected ones are kept as metadata only.
+//
+// When the scanner can't be reached files stay pending (their job is
+// retried) and attachments are let through, so an outage of the scanner
+// doesn't take uploads or email down with it.
+type ScanService struct {
+	scanner       Scanner
+	repo          *repository.ScanRepository
+	fileRepo      *repository.FileRepository
+	userRepo      *repository.UserRepository
+	storage       storage.Storage
+	notifications NotificationQueue
+	log           zerolog.Logger
+}
+
+// NewScanService creates a new scan service. Without a scanner nothing is
+// scanned, and Overview reports scanning disabled.
+func NewScanService(scanner Scanner, repo *repository.ScanRepository, fileRepo *repository.FileRepository, userRepo *repository.UserRepository, store storage.Storage, log zerolog.Logger) *ScanService {
+	return &ScanService{
+		scanner:  scanner,
+		repo:     repo,
+		fileRepo: fileRepo,
+		userRepo: userRepo,
+		storage:  store,
+		log:      log,
+	}
+}
+
+// SetNotifications tells admins whenever an upload is found infected
+func (s *ScanService) SetNotifications(queue NotificationQueue) {
+	s.notifications = queue
+}
+
+// Enabled reports whether uploads are scanned
+func (s *ScanService) Enabled() bool {
+	return s.scanner != nil
+}
+
+// ScanFile scans the current content of a file and records the result.
+// Content uploaded while it ran makes it fail, so that a retry scans that
+// instead.
+func (s *ScanService) ScanFile(ctx context.Context, fileID uuid.UUID) error {
+	file, err := s.fileRepo.GetByID(ctx, fileID)
+	if errors.Is(err, repository.ErrFileNotFound) {
+		// Deleted since
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if file.IsFolder {
+		return nil
+	}
+	_, err = s.scanFile(ctx, file)
+	return err
+}
+
+// scanFile scans a file's content and records the result, which it returns
+func (s *ScanService) scanFile(ctx context.Context, file *models.File) (string, error) {
+	if !s.Enabled() {
+		return "", fmt.Errorf("virus scanning is not enabled")
+	}
+
+	status, virus := models.ScanClean, ""
+	result, err := s.scan(ctx, file.StorageKey)
+	switch {
+	case errors.Is(err, security.ErrScanTooLarge):
+		status = models.ScanSkipped
+	case err != nil:
+		return "", fmt.Errorf("failed to scan file %s: %w", file.ID, err)
+	case result.Infected:
+		status, virus = models.ScanInfected, result.Virus
+	}
+
+	recorded, err := s.repo.SetFileResult(ctx, file.ID, file.Hash, status, virus)
+	if err != nil {
+		return "", fmt.Errorf("failed to record scan of file %s: %w", file.ID, err)
+	}
+	if !recorded {
+		return "", fmt.Errorf("file %s changed while it was scanned", file.ID)
+	}
+
+	if status == models.ScanSkipped {
+		s.log.Warn().Str("file_id", file.ID.String()).Int64("size", file.Size).Msg("File too large to scan")
+	}
+	if status == models.ScanInfected && !file.Infected() {
+		s.log.Warn().
+			Str("file_id", file.ID.String()).
+			Str("owner_id", file.OwnerID.String()).
+			Str("virus", virus).
+			Msg("Infected file quarantined")
+		owner := file.OwnerID.String()
+		if user, err := s.userRepo.GetByID(ctx, file.OwnerID); err == nil {
+			owner = user.Email
+		}
+		s.notifyAdmins(ctx, "Infected file quarantined",
+			fmt.Sprintf("%s, uploaded by %s, contains %s and has been quarantined.", file.Name, owner, virus),
+			map[string]interface{}{
+				"fileId":  file.ID.String(),
+				"ownerId": file.OwnerID.String(),
+				"virus":   virus,
+			})
+	}
+	return status, nil
+}
+
+// scan scans an object in storage
+func (s *ScanService) scan(ctx context.Context, key string) (*security.ScanResult, error) {
+	reader, err := s.storage.Download(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read content: %w", err)
+	}
+	defer reader.Close()
+	return s.scanner.Scan(ctx, reader)
+}
+
+// ScanAttachment scans the content of an email attachment of the user's
+// before it is stored. When it is infected ErrInfected is returned and the
+// virus set on att, and recorded if att is already saved. Attachments that
+// can't be scanned are let through.
+func (s *ScanService) ScanAttachment(ctx context.Context, userID uuid.UUID, att *models.EmailAttachment, content []byte) error {
+	if !s.Enabled() {
+		return nil
+	}
+
+	result, err := s.scanner.Scan(ctx, bytes.NewReader(content))
+	if err != nil {
+		s.log.Warn().Err(err).Str("filename", att.Filename).Msg("Failed to scan email attachment")
+		return nil
+	}
+	if !result.Infected {
+		return nil
+	}
+
+	att.Virus = result.Virus
+	if att.ID != "" {
+		if err := s.repo.SetAttachmentVirus(ctx, att.ID, att.Virus); err != nil {
+			s.log.Error().Err(err).Str("attachment_id", att.ID).Msg("Failed to record infected attachment")
+		}
+	}
+	s.attachmentInfected(ctx, userID, att.Filename, att.Virus)
+	return ErrInfected
+}
+
+// attachmentInfected logs an infected email attachment and tells admins
+func (s *ScanService) attachmentInfected(ctx context.Context, userID uuid.UUID, filename, virus string) {
+	s.log.Warn().
+		Str("user_id", userID.String()).
+		Str("filename", filename).
+		Str("virus", virus).
+		Msg("Infected email attachment blocked")
+	user := userID.String()
+	if u, err := s.userRepo.GetByID(ctx, userID); err == nil {
+		user = u.Email
+	}
+	s.notifyAdmins(ctx, "Infected email attachment blocked",
+		fmt.Sprintf("%s, an email attachment of %s, contains %s and has been blocked.", filename, user, virus),
+		map[string]interface{}{
+			"ownerId":  userID.String(),
+			"filename": filename,
+			"virus":    virus,
+		})
+}
+
+// notifyAdmins sends a notification to every active admin
+func (s *ScanService) notifyAdmins(ctx context.Context, title, message string, data map[string]interface{}) {
+	if s.notifications == nil {
+		return
+	}
+	admins, err := s.repo.ListAdminIDs(ctx)
+	if err != nil {
+		s.log.Error().Err(err).Msg("Failed to list admins")
+		return
+	}
+	for _, id := range admins {
+		if err := s.notifications.ScheduleNotification(ctx, id.String(), NotificationVirusFound, title, message, data); err != nil {
+			s.log.Warn().Err(err).Str("user_id", id.String()).Msg("Failed to schedule virus notification")
+		}
+	}
+}
+
+// RescanResult is the outcome of a rescan of everything stored
+type RescanResult struct {
+	Files       int `json:"files"`
+	Attachments int `json:"attachments"`
+	Infected    int `json:"infected"`
+	Failed      int `json:"failed"`
+}
+
+// RescanAll scans every stored file, trashed ones included, and every
+// stored email attachment again, with the scanner's current signatures.
+// What can't be scanned is counted as failed and left as it was.
+func (s *ScanService) RescanAll(ctx context.Context) (*RescanResult, error) {
+	if !s.Enabled() {
+		return nil, fmt.Errorf("virus scanning is not enabled")
+	}
+	result := &RescanResult{}
+
+	after := uuid.Nil
+	for {
+		files, err := s.repo.ListFiles(ctx, after, scanBatchSize)
+		if err != nil {
+			return result, fmt.Errorf("failed to list files: %w", err)
+		}
+		for _, file := range files {
+			status, err := s.scanFile(ctx, file)
+			if err != nil {
+				if ctx.Err() != nil {
+					return result, ctx.Err()
+				}
+				// Files changed since have a scan of their own queued
+				s.log.Warn().Err(err).Msg("Failed to rescan file")
+				result.Failed++
+				continue
+			}
+			result.Files++
+			if status == models.ScanInfected {
+				result.Infected++
+			}
+		}
+		if len(files) < scanBatchSize {
+			break
+		}
+		after = files[len(files)-1].ID
+		s.log.Info().Int("files", result.Files).Int("infected", result.Infected).Msg("Rescanning files")
+	}
+
+	afterAttachment := uuid.Nil.String()
+	for {
+		attachments, err := s.repo.ListStoredAttachments(ctx, afterAttachment, scanBatchSize)
+		if err != nil {
+			return result, fmt.Errorf("failed to list email attachments: %w", err)
+		}
+		for _, att := range attachments {
+			infected, err := s.rescanAttachment(ctx, att)
+			if err != nil {
+				if ctx.Err() != nil {
+					return result, ctx.Err()
+				}
+				s.log.Warn().Err(err).Str("attachment_id", att.ID).Msg("Failed to rescan email attachment")
+				result.Failed++
+				continue
+			}
+			result.Attachments++
+			if infected {
+				result.Infected++
+			}
+		}
+		if len(attachments) < scanBatchSize {
+			break
+		}
+		afterAttachment = attachments[len(attachments)-1].ID
+		s.log.Info().Int("attachments", result.Attachments).Int("infected", result.Infected).Msg("Rescanning email attachments")
+	}
+
+	return result, nil
+}
+
+// rescanAttachment scans a stored email attachment and records the result
+func (s *ScanService) rescanAttachment(ctx context.Context, att *repository.StoredAttachment) (bool, error) {
+	result, err := s.scan(ctx, att.StorageKey)
+	if errors.Is(err, security.ErrScanTooLarge) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	virus := ""
+	if result.Infected {
+		virus = result.Virus
+	}
+	if virus == att.Virus {
+		return result.Infected, nil
+	}
+	if err := s.repo.SetAttachmentVirus(ctx, att.ID, virus); err != nil {
+		return false, err
+	}
+	if result.Infected && att.Virus == "" {
+		s.attachmentInfected(ctx, att.UserID, att.Filename, virus)
+	}
+	return result.Infected, nil
+}
+
+// ScanOverview is the state of virus scanning, for admins
+type ScanOverview struct {
+	Enabled bool   `json:"enabled"`
+	Version string `json:"version,omitempty"` // of the scanner and its signatures
+	Error   string `json:"error,omitempty"`   // why the scanner can't be reached
+	// Files counts files by scan status; "unscanned" are those stored while
+	// scanning was off
+	Files               map[string]int64 `json:"files"`
+	InfectedAttachments int64            `json:"infectedAttachments"`
+}
+
+// Overview returns whether the scanner is reachable and how many files are
+// in each scan state
+func (s *ScanService) Overview(ctx context.Context) (*ScanOverview, error) {
+	overview := &ScanOverview{Enabled: s.Enabled()}
+	if s.Enabled() {
+		version, err := s.scanner.Version(ctx)
+		if err != nil {
+			overview.Error = err.Error()
+		}
+		overview.Version = version
+	}
+
+	counts, err := s.repo.CountFiles(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if n, ok := counts[""]; ok {
+		counts["unscanned"] = n
+		delete(counts, "")
+	}
+	overview.Files = counts
+
+	overview.InfectedAttachments, err = s.repo.CountInfectedAttachments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return overview, nil
+}
+
+// ListInfected returns the quarantined files, most recently found first
+func (s *ScanService) ListInfected(ctx context.Context, limit, offset int) ([]*repository.InfectedFile, int, error) {
+	return s.repo.ListInfected(ctx, limit, offset)
+}
@@ -0,0 +1,408 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+
+	"github.com/tessera/tessera/internal/repository"
+	"github.com/tessera/tessera/internal/storage"
+)
+
+// OrphanGracePeriod is how old an object nothing refers to must be to count
+// as orphaned. Newer ones may belong to an upload still in progress, whose
+// row isn't written yet or whose session is staged for up to a day.
+const OrphanGracePeriod = 48 * time.Hour
+
+// QuarantinePrefix is where orphaned objects are moved. They're kept until
+// an admin removes them, and not checked again.
+const QuarantinePrefix = "quarantine/"
+
+const (
+	// storageCheckBatch is how many blobs or listed objects are checked at
+	// a time
+	storageCheckBatch = 500
+	// maxReportedIssues bounds the issues a report lists; all are counted
+	maxReportedIssues = 1000
+)
+
+// Storage issue kinds
+const (
+	IssueMissingObject  = "missing_object"  // content with no object
+	IssueSizeMismatch   = "size_mismatch"   // object of another size than recorded
+	IssueHashMismatch   = "hash_mismatch"   // object whose content doesn't match its hash
+	IssueUnreadable     = "unreadable"      // object that couldn't be checked
+	IssueUnrecordedBlob = "unrecorded_blob" // content files use without a blob
+	IssueRefCount       = "ref_count"       // blob with a wrong reference count
+	IssueOrphanObject   = "orphan_object"   // object nothing refers to
+	IssueStorageUsed    = "storage_used"    // user whose storage used is off
+)
+
+// StorageCheckOptions choose how thorough a storage check is and what it
+// repairs. Without repairs it only reports.
+type StorageCheckOptions struct {
+	// HashSample is the share of stored contents read back and compared
+	// with their hash, from 0 (none) to 1 (all)
+	HashSample float64 `json:"hashSample"`
+	// Quarantine moves orphaned objects under QuarantinePrefix
+	Quarantine bool `json:"quarantine"`
+	// MarkBroken marks the files and versions whose content is missing or
+	// damaged, and clears the marks of content found sound again
+	MarkBroken bool `json:"markBroken"`
+	// FixCounts sets users' storage used to what their files take up,
+	// creates missing blobs and raises reference counts that are too low
+	FixCounts bool `json:"fixCounts"`
+}
+
+// StorageIssue is a discrepancy a storage check found
+type StorageIssue struct {
+	Kind   string                   `json:"kind"`
+	Key    string                   `json:"key,omitempty"`
+	Files  []*repository.ContentRef `json:"files,omitempty"` // files and versions with this content
+	UserID *uuid.UUID               `json:"userId,omitempty"`
+	Detail string                   `json:"detail,omitempty"`
+	// Action is what the check did about it: "marked", "quarantined",
+	// "recorded", "raised" or "fixed"
+	Action string `json:"action,omitempty"`
+}
+
+// StorageCheckReport is the outcome of a storage check
+type StorageCheckReport struct {
+	Options         StorageCheckOptions `json:"options"`
+	Backend         string              `json:"backend"`
+	StartedAt       time.Time           `json:"startedAt"`
+	FinishedAt      time.Time           `json:"finishedAt"`
+	ContentsChecked int                 `json:"contentsChecked"`
+	ContentsHashed  int                 `json:"contentsHashed"`
+	ObjectsListed   int                 `json:"objectsListed"`
+	// Counts has the number of issues of each kind found
+	Counts map[string]int  `json:"counts"`
+	Issues []*StorageIssue `json:"issues"`
+	// Truncated is set when more issues were found than are listed
+	Truncated bool `json:"truncated"`
+}
+
+func (r *StorageCheckReport) add(issue *StorageIssue) {
+	r.Counts[issue.Kind]++
+	if len(r.Issues) >= maxReportedIssues {
+		r.Truncated = true
+		return
+	}
+	r.Issues = append(r.Issues, issue)
+}
+
+// StorageCheckService cross-checks the database against the object store:
+// that the content of every file and version is stored, at its recorded
+// size and hash; that every stored object is in use; and that reference
+// counts and users' storage used add up. Crashes between storing an object
+// and recording it leave such discrepancies behind.
+type StorageCheckService struct {
+	repo    *repository.StorageCheckRepository
+	backend storage.Backend
+	store   storage.Storage
+	log     zerolog.Logger
+}
+
+// NewStorageCheckService creates a new storage check service. Objects are
+// listed and quarantined on backend as stored, and read through store,
+// which decrypts them when encryption at rest is on.
+func NewStorageCheckService(repo *repository.StorageCheckRepository, backend storage.Backend, store storage.Storage, log zerolog.Logger) *StorageCheckService {
+	return &StorageCheckService{
+		repo:    repo,
+		backend: backend,
+		store:   store,
+		log:     log,
+	}
+}
+
+// Check runs a storage check and saves its report
+func (s *StorageCheckService) Check(ctx context.Context, opts StorageCheckOptions) (*StorageCheckReport, error) {
+	opts.HashSample = min(max(opts.HashSample, 0), 1)
+	report := &StorageCheckReport{
+		Options:   opts,
+		Backend:   s.backend.Name(),
+		StartedAt: time.Now(),
+		Counts:    make(map[string]int),
+		Issues:    make([]*StorageIssue, 0),
+	}
+
+	if err := s.checkBlobs(ctx, opts, report); err != nil {
+		return report, fmt.Errorf("failed to check stored contents: %w", err)
+	}
+	if err := s.checkReferences(ctx, opts, report); err != nil {
+		return report, fmt.Errorf("failed to check references: %w", err)
+	}
+	if err := s.checkObjects(ctx, opts, report); err != nil {
+		return report, fmt.Errorf("failed to check stored objects: %w", err)
+	}
+	if err := s.checkUsage(ctx, opts, report); err != nil {
+		return report, fmt.Errorf("failed to check storage used: %w", err)
+	}
+
+	report.FinishedAt = time.Now()
+	if err := s.repo.SaveReport(ctx, report.StartedAt, report.FinishedAt, report); err != nil {
+		return report, fmt.Errorf("failed to save report: %w", err)
+	}
+	return report, nil
+}
+
+// LatestReport returns the report of the last check
+func (s *StorageCheckService) LatestReport(ctx context.Context) (json.RawMessage, error) {
+	return s.repo.LatestReport(ctx)
+}
+
+// ListBroken returns the files and versions marked broken
+func (s *StorageCheckService) ListBroken(ctx context.Context, limit, offset int) ([]*repository.BrokenFile, int, error) {
+	return s.repo.ListBroken(ctx, limit, offset)
+}
+
+// checkBlobs checks that the content of every file and version is stored
+func (s *StorageCheckService) checkBlobs(ctx context.Context, opts StorageCheckOptions, report *StorageCheckReport) error {
+	var broken map[string]string
+	if opts.MarkBroken {
+		var err error
+		if broken, err = s.repo.BrokenKeys(ctx); err != nil {
+			return err
+		}
+	}
+
+	after := ""
+	for {
+		blobs, err := s.repo.ListBlobs(ctx, after, storageCheckBatch)
+		if err != nil {
+			return err
+		}
+		for _, blob := range blobs {
+			after = blob.Key
+			hash := blob.Hash != "" && opts.HashSample > 0 && rand.Float64() < opts.HashSample
+			issue := s.checkBlob(ctx, blob, hash)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			report.ContentsChecked++
+			if hash && (issue == nil || issue.Kind == IssueHashMismatch) {
+				report.ContentsHashed++
+			}
+
+			if issue == nil {
+				// A hash mismatch is only cleared by reading the content
+				if reason, ok := broken[blob.Key]; ok && (hash || reason != IssueHashMismatch) {
+					if err := s.repo.ClearBroken(ctx, blob.Key); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if err := s.reportContent(ctx, opts, report, issue); err != nil {
+				return err
+			}
+		}
+		if len(blobs) < storageCheckBatch {
+			return nil
+		}
+	}
+}
+
+// checkBlob checks one blob's object, reading it back when hash is set. It
+// returns nil for a sound one.
+func (s *StorageCheckService) checkBlob(ctx context.Context, blob *repository.Blob, hash bool) *StorageIssue {
+	info, err := s.store.Stat(ctx, blob.Key)
+	if storage.IsNotExist(err) {
+		return &StorageIssue{Kind: IssueMissingObject, Key: blob.Key}
+	}
+	if err != nil {
+		return &StorageIssue{Kind: IssueUnreadable, Key: blob.Key, Detail: err.Error()}
+	}
+	if info.Size != blob.Size {
+		return &StorageIssue{
+			Kind:   IssueSizeMismatch,
+			Key:    blob.Key,
+			Detail: fmt.Sprintf("recorded %d bytes, stored %d", blob.Size, info.Size),
+		}
+	}
+	if !hash {
+		return nil
+	}
+
+	reader, err := s.store.Download(ctx, blob.Key)
+	if err != nil {
+		return &StorageIssue{Kind: IssueUnreadable, Key: blob.Key, Detail: err.Error()}
+	}
+	defer reader.Close()
+	sum, err := calculateHash(reader)
+	if err != nil {
+		return &StorageIssue{Kind: IssueUnreadable, Key: blob.Key, Detail: err.Error()}
+	}
+	if sum != blob.Hash {
+		return &StorageIssue{
+			Kind:   IssueHashMismatch,
+			Key:    blob.Key,
+			Detail: fmt.Sprintf("recorded %s, stored %s", blob.Hash, sum),
+		}
+	}
+	return nil
+}
+
+// reportContent reports content that's missing or damaged with the files
+// and versions it belongs to, marking them broken if asked to. Content
+// that couldn't be read isn't marked, as the failure may pass.
+func (s *StorageCheckService) reportContent(ctx context.Context, opts StorageCheckOptions, report *StorageCheckReport, issue *StorageIssue) error {
+	refs, err := s.repo.ContentRefs(ctx, issue.Key)
+	if err != nil {
+		return err
+	}
+	issue.Files = refs
+	if opts.MarkBroken && issue.Kind != IssueUnreadable && len(refs) > 0 {
+		if err := s.repo.MarkBroken(ctx, refs, issue.Key, issue.Kind); err != nil {
+			return err
+		}
+		issue.Action = "marked"
+	}
+	s.log.Warn().Str("storage_key", issue.Key).Str("kind", issue.Kind).Str("detail", issue.Detail).
+		Int("files", len(refs)).Msg("Storage check found damaged content")
+	report.add(issue)
+	return nil
+}
+
+// checkReferences checks that the content files use has a blob, and that
+// blobs are referenced as often as they're used
+func (s *StorageCheckService) checkReferences(ctx context.Context, opts StorageCheckOptions, report *StorageCheckReport) error {
+	unrecorded, err := s.repo.UnrecordedBlobs(ctx, opts.FixCounts, maxReportedIssues)
+	if err != nil {
+		return err
+	}
+	for _, blob := range unrecorded {
+		issue := &StorageIssue{
+			Kind:   IssueUnrecordedBlob,
+			Key:    blob.Key,
+			Detail: fmt.Sprintf("used %d times", blob.RefCount),
+		}
+		if opts.FixCounts {
+			issue.Action = "recorded"
+		}
+		report.add(issue)
+	}
+
+	mismatches, err := s.repo.RefCountMismatches(ctx, opts.FixCounts, maxReportedIssues)
+	if err != nil {
+		return err
+	}
+	for _, m := range mismatches {
+		issue := &StorageIssue{
+			Kind:   IssueRefCount,
+			Key:    m.Key,
+			Detail: fmt.Sprintf("recorded %d references, used %d times", m.Recorded, m.Actual),
+		}
+		if opts.FixCounts && m.Actual > m.Recorded {
+			issue.Action = "raised"
+		}
+		report.add(issue)
+	}
+	return nil
+}
+
+// checkObjects lists the stored objects, reporting those nothing refers to
+func (s *StorageCheckService) checkObjects(ctx context.Context, opts StorageCheckOptions, report *StorageCheckReport) error {
+	cutoff := report.StartedAt.Add(-OrphanGracePeriod)
+	batch := make([]*storage.ObjectInfo, 0, storageCheckBatch)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		keys := make([]string, len(batch))
+		for i, obj := range batch {
+			keys[i] = obj.Key
+		}
+		referenced, err := s.repo.ReferencedKeys(ctx, keys)
+		if err != nil {
+			return err
+		}
+		for _, obj := range batch {
+			if !referenced[obj.Key] {
+				s.reportOrphan(ctx, opts, report, obj)
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	err := s.backend.Walk(ctx, func(obj *storage.ObjectInfo) error {
+		if strings.HasPrefix(obj.Key, QuarantinePrefix) {
+			return nil
+		}
+		report.ObjectsListed++
+		if !obj.LastModified.Before(cutoff) {
+			return nil
+		}
+		batch = append(batch, obj)
+		if len(batch) < storageCheckBatch {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+func (s *StorageCheckService) reportOrphan(ctx context.Context, opts StorageCheckOptions, report *StorageCheckReport, obj *storage.ObjectInfo) {
+	issue := &StorageIssue{
+		Kind:   IssueOrphanObject,
+		Key:    obj.Key,
+		Detail: fmt.Sprintf("%d bytes, last modified %s", obj.Size, obj.LastModified.UTC().Format(time.RFC3339)),
+	}
+	if opts.Quarantine {
+		target := QuarantinePrefix + report.StartedAt.UTC().Format("2006-01-02") + "/" + obj.Key
+		if err := s.quarantine(ctx, obj, target); err != nil {
+			s.log.Warn().Err(err).Str("storage_key", obj.Key).Msg("Failed to quarantine orphaned object")
+			issue.Detail += "; quarantine failed: " + err.Error()
+		} else {
+			issue.Action = "quarantined"
+			issue.Detail += "; moved to " + target
+		}
+	}
+	report.add(issue)
+}
+
+// quarantine moves an object as stored, encrypted or not, to target
+func (s *StorageCheckService) quarantine(ctx context.Context, obj *storage.ObjectInfo, target string) error {
+	reader, err := s.backend.Download(ctx, obj.Key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	if err := s.backend.Upload(ctx, target, reader, obj.Size, "application/octet-stream"); err != nil {
+		return err
+	}
+	return s.backend.Delete(ctx, obj.Key)
+}
+
+// checkUsage checks that users' storage used is what their files and
+// versions take up
+func (s *StorageCheckService) checkUsage(ctx context.Context, opts StorageCheckOptions, report *StorageCheckReport) error {
+	mismatches, err := s.repo.UsageMismatches(ctx, opts.FixCounts)
+	if err != nil {
+		return err
+	}
+	for _, m := range mismatches {
+		userID := m.UserID
+		issue := &StorageIssue{
+			Kind:   IssueStorageUsed,
+			UserID: &userID,
+			Detail: fmt.Sprintf("%s: recorded %d bytes, files take up %d", m.Email, m.Recorded, m.Actual),
+		}
+		if opts.FixCounts {
+			issue.Action = "fixed"
+		}
+		report.add(issue)
+	}
+	return nil
+}
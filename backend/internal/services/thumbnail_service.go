@@ -0,0 +1,499 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif" // register decoder
+	"image/jpeg"
+	_ "image/png" // register decoder
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // register decoder
+
+	"github.com/tessera/tessera/internal/models"
+	"github.com/tessera/tessera/internal/repository"
+	"github.com/tessera/tessera/internal/storage"
+)
+
+// ThumbnailSizes maps each thumbnail size to the length of its longest edge
+var ThumbnailSizes = map[string]int{
+	"small":  128,
+	"medium": 512,
+	"large":  1024,
+}
+
+// DefaultThumbnailSize is served when a request doesn't name a size
+const DefaultThumbnailSize = "medium"
+
+const (
+	// thumbnailMaxSourceBytes bounds how much of an image or PDF is read
+	thumbnailMaxSourceBytes = 64 * 1024 * 1024
+	// thumbnailMaxPixels bounds the decoded size of a source image, which is
+	// held in memory in full (about 160 MB as RGBA)
+	thumbnailMaxPixels = 40 * 1000 * 1000
+	thumbnailQuality   = 80
+	// thumbnailToolTimeout bounds a single run of an external tool
+	thumbnailToolTimeout = time.Minute
+)
+
+var (
+	// ErrThumbnailNotFound is returned when no current thumbnail exists
+	ErrThumbnailNotFound = errors.New("thumbnail not found")
+	// ErrThumbnailPending is returned when a thumbnail was scheduled but isn't ready yet
+	ErrThumbnailPending = errors.New("thumbnail is being generated")
+	// ErrThumbnailUnsupported is returned for files thumbnails can't be made of
+	ErrThumbnailUnsupported = errors.New("no thumbnails for this file type")
+	// ErrThumbnailSource is returned when a file's content can't be rendered;
+	// generating again won't help
+	ErrThumbnailSource = errors.New("cannot render file")
+)
+
+// ThumbnailQueue schedules thumbnail generation in the background
+type ThumbnailQueue interface {
+	ScheduleThumbnail(ctx context.Context, fileID, userID, filePath, mimeType string) error
+}
+
+// ThumbnailService renders and stores previews of files. Images are decoded
+// in Go; PDFs and videos need pdftoppm and ffmpeg on the PATH and are skipped
+// without them.
+type ThumbnailService struct {
+	fileRepo *repository.FileRepository
+	storage  storage.Storage
+	log      zerolog.Logger
+	pdftoppm string
+	ffmpeg   string
+}
+
+// NewThumbnailService creates a new thumbnail service
+func NewThumbnailService(fileRepo *repository.FileRepository, store storage.Storage, log zerolog.Logger) *ThumbnailService {
+	s := &ThumbnailService{
+		fileRepo: fileRepo,
+		storage:  store,
+		log:      log,
+	}
+	s.pdftoppm, _ = exec.LookPath("pdftoppm")
+	s.ffmpeg, _ = exec.LookPath("ffmpeg")
+	if s.pdftoppm == "" {
+		log.Info().Msg("pdftoppm not found - PDF thumbnails disabled")
+	}
+	if s.ffmpeg == "" {
+		log.Info().Msg("ffmpeg not found - video thumbnails disabled")
+	}
+	return s
+}
+
+// ThumbnailKey is the storage key of a file's thumbnail at one size
+func ThumbnailKey(fileID uuid.UUID, size string) string {
+	return fmt.Sprintf("thumbnails/%s/%s.jpg", fileID, size)
+}
+
+// Supports reports whether thumbnails can be made of a MIME type
+func (s *ThumbnailService) Supports(mimeType string) bool {
+	switch {
+	case isThumbnailImage(mimeType):
+		return true
+	case mimeType == "application/pdf":
+		return s.pdftoppm != ""
+	case strings.HasPrefix(mimeType, "video/"):
+		return s.ffmpeg != ""
+	default:
+		return false
+	}
+}
+
+func isThumbnailImage(mimeType string) bool {
+	switch mimeType {
+	case "image/jpeg", "image/png", "image/gif", "image/webp":
+		return true
+	default:
+		return false
+	}
+}
+
+// Generate renders every thumbnail size of a file and stores them
+func (s *ThumbnailService) Generate(ctx context.Context, file *models.File) error {
+	if file.IsFolder || !s.Supports(file.MimeType) {
+		return ErrThumbnailUnsupported
+	}
+	// Quarantined content isn't read, not even to render it
+	if file.Infected() {
+		return ErrInfected
+	}
+
+	img, orientation, err := s.render(ctx, file)
+	if err != nil {
+		return err
+	}
+
+	// Largest first, each size scaled down from the one before
+	sizes := make([]string, 0, len(ThumbnailSizes))
+	for size := range ThumbnailSizes {
+		sizes = append(sizes, size)
+	}
+	sort.Slice(sizes, func(i, j int) bool { return ThumbnailSizes[sizes[i]] > ThumbnailSizes[sizes[j]] })
+
+	for i, size := range sizes {
+		img = fitWithin(img, ThumbnailSizes[size])
+		if i == 0 {
+			// Rotating the largest thumbnail is far cheaper than the source
+			img = applyOrientation(img, orientation)
+		}
+
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+			return fmt.Errorf("failed to encode thumbnail: %w", err)
+		}
+
+		key := ThumbnailKey(file.ID, size)
+		if err := s.storage.Upload(storage.WithOwner(ctx, file.OwnerID), key, bytes.NewReader(buf.Bytes()), int64(buf.Len()), "image/jpeg"); err != nil {
+			return fmt.Errorf("failed to store thumbnail: %w", err)
+		}
+
+		bounds := img.Bounds()
+		if err := s.fileRepo.SaveThumbnail(ctx, &models.FileThumbnail{
+			FileID:     file.ID,
+			Size:       size,
+			StorageKey: key,
+			Width:      bounds.Dx(),
+			Height:     bounds.Dy(),
+			Bytes:      int64(buf.Len()),
+			SourceHash: file.Hash,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Open returns the thumbnail of a file at one size. Thumbnails of earlier
+// content of the file count as missing.
+func (s *ThumbnailService) Open(ctx context.Context, file *models.File, size string) (io.ReadCloser, *models.FileThumbnail, error) {
+	thumb, err := s.fileRepo.GetThumbnail(ctx, file.ID, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	if thumb == nil || thumb.SourceHash != file.Hash {
+		return nil, nil, ErrThumbnailNotFound
+	}
+
+	reader, err := s.storage.Download(ctx, thumb.StorageKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return reader, thumb, nil
+}
+
+// render produces the source image of a file, with the EXIF orientation that
+// still has to be applied to it
+func (s *ThumbnailService) render(ctx context.Context, file *models.File) (image.Image, int, error) {
+	if strings.HasPrefix(file.MimeType, "video/") {
+		img, err := s.renderVideo(ctx, file)
+		return img, 1, err
+	}
+
+	data, err := s.readSource(ctx, file)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if file.MimeType == "application/pdf" {
+		img, err := s.renderPDF(ctx, data)
+		return img, 1, err
+	}
+
+	img, err := decodeImage(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return img, jpegOrientation(data), nil
+}
+
+func (s *ThumbnailService) readSource(ctx context.Context, file *models.File) ([]byte, error) {
+	if file.Size > thumbnailMaxSourceBytes {
+		return nil, fmt.Errorf("%w: file is larger than %d bytes", ErrThumbnailSource, thumbnailMaxSourceBytes)
+	}
+
+	reader, err := s.storage.Download(ctx, file.StorageKey)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return io.ReadAll(io.LimitReader(reader, thumbnailMaxSourceBytes))
+}
+
+// renderPDF renders the first page of a PDF with pdftoppm
+func (s *ThumbnailService) renderPDF(ctx context.Context, data []byte) (image.Image, error) {
+	dir, err := os.MkdirTemp("", "tessera-thumb-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "source.pdf")
+	if err := os.WriteFile(src, data, 0o600); err != nil {
+		return nil, err
+	}
+
+	out := filepath.Join(dir, "page")
+	if _, err := runTool(ctx, ErrThumbnailSource, s.pdftoppm,
+		"-f", "1", "-l", "1", "-singlefile", "-png",
+		"-scale-to", fmt.Sprint(maxThumbnailSize()),
+		src, out,
+	); err != nil {
+		return nil, err
+	}
+
+	page, err := os.ReadFile(out + ".png")
+	if err != nil {
+		return nil, fmt.Errorf("%w: pdftoppm produced no page", ErrThumbnailSource)
+	}
+	return decodeImage(page)
+}
+
+// renderVideo grabs a frame with ffmpeg, which reads the object over a
+// presigned URL so only the parts it needs are fetched. Objects encrypted at
+// rest have no such URL and are decrypted and piped to it instead.
+func (s *ThumbnailService) renderVideo(ctx context.Context, file *models.File) (image.Image, error) {
+	input := "pipe:0"
+	url, err := s.storage.GetPresignedURL(ctx, file.StorageKey, 15*time.Minute)
+	switch {
+	case err == nil:
+		input = url
+	case !errors.Is(err, storage.ErrEncryptedObject):
+		return nil, err
+	}
+
+	scale := fmt.Sprintf("scale=w=%[1]d:h=%[1]d:force_original_aspect_ratio=decrease", maxThumbnailSize())
+	frame := func(offset string) ([]byte, error) {
+		var stdin io.Reader
+		if input == "pipe:0" {
+			reader, err := s.storage.Download(ctx, file.StorageKey)
+			if err != nil {
+				return nil, err
+			}
+			defer reader.Close()
+			stdin = reader
+		}
+		return runToolInput(ctx, ErrThumbnailSource, stdin, s.ffmpeg,
+			"-v", "error", "-ss", offset, "-i", input,
+			"-frames:v", "1", "-vf", scale,
+			"-f", "image2pipe", "-vcodec", "png", "pipe:1",
+		)
+	}
+
+	// A second in skips black lead-in frames; videos shorter than that
+	// produce nothing and fall back to the first frame
+	data, err := frame("1")
+	if err == nil && len(data) == 0 {
+		data, err = frame("0")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("%w: ffmpeg produced no frame", ErrThumbnailSource)
+	}
+	return decodeImage(data)
+}
+
+// runTool runs an external tool and returns its standard output. A tool that
+// exits with an error is taken to have rejected the input, reported as the
+// given error.
+func runTool(ctx context.Context, rejected error, path string, args ...string) ([]byte, error) {
+	return runToolInput(ctx, rejected, nil, path, args...)
+}
+
+// runToolInput is runTool with the tool's standard input read from stdin
+func runToolInput(ctx context.Context, rejected error, stdin io.Reader, path string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, thumbnailToolTimeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%s timed out", filepath.Base(path))
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("%w: %s: %s", rejected, filepath.Base(path), strings.TrimSpace(stderr.String()))
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
+
+func maxThumbnailSize() int {
+	largest := 0
+	for _, edge := range ThumbnailSizes {
+		largest = max(largest, edge)
+	}
+	return largest
+}
+
+// decodeImage decodes a JPEG, PNG, GIF (first frame) or WebP image,
+// refusing ones too large to hold in memory
+func decodeImage(data []byte) (image.Image, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrThumbnailSource, err)
+	}
+	if cfg.Width*cfg.Height > thumbnailMaxPixels {
+		return nil, fmt.Errorf("%w: image is %dx%d pixels", ErrThumbnailSource, cfg.Width, cfg.Height)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrThumbnailSource, err)
+	}
+	return img, nil
+}
+
+// fitWithin scales an image down so neither edge exceeds limit, flattening
+// transparency onto white since thumbnails are JPEGs
+func fitWithin(img image.Image, limit int) *image.RGBA {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w > limit || h > limit {
+		if w >= h {
+			w, h = limit, max(1, h*limit/w)
+		} else {
+			w, h = max(1, w*limit/h), limit
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	if w == bounds.Dx() && h == bounds.Dy() {
+		draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Over)
+	} else {
+		xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+	}
+	return dst
+}
+
+// jpegOrientation returns the EXIF orientation (1-8) of a JPEG, or 1 when it
+// has none
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	for p := 2; p+4 <= len(data); {
+		if data[p] != 0xFF {
+			return 1
+		}
+		marker := data[p+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// Image data starts; metadata comes before it
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[p+2:]))
+		if length < 2 || p+2+length > len(data) {
+			return 1
+		}
+		segment := data[p+4 : p+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		p += 2 + length
+	}
+	return 1
+}
+
+// exifOrientation reads the orientation tag from the first IFD of a TIFF
+// structure
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	entries := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// applyOrientation turns an image upright according to its EXIF orientation
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		// 5-8 swap width and height
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // rotated 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // transposed
+				dx, dy = y, x
+			case 6: // needs 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // needs 90° counter-clockwise
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	"github.com/tessera/tessera/internal/models"
+)
+
+// withOrientation inserts an EXIF segment carrying an orientation tag right
+// after the start-of-image marker of a JPEG
+func withOrientation(t *testing.T, img image.Image, orientation uint16) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8, 0, 1}
+	entry := make([]byte, 12)
+	binary.BigEndian.PutUint16(entry[0:], 0x0112)
+	binary.BigEndian.PutUint16(entry[2:], 3) // SHORT
+	binary.BigEndian.PutUint32(entry[4:], 1)
+	binary.BigEndian.PutUint16(entry[8:], orientation)
+	tiff = append(tiff, entry...)
+	tiff = append(tiff, 0, 0, 0, 0)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(app1[2:], uint16(len(segment)+2))
+
+	data := buf.Bytes()
+	out := append([]byte{}, data[:2]...)
+	out = append(out, app1...)
+	out = append(out, segment...)
+	return append(out, data[2:]...)
+}
+
+func TestJpegOrientation(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 4))
+
+	t.Run("reads the EXIF tag", func(t *testing.T) {
+		data := withOrientation(t, img, 6)
+		if got := jpegOrientation(data); got != 6 {
+			t.Errorf("orientation = %d, want 6", got)
+		}
+		if _, err := decodeImage(data); err != nil {
+			t.Errorf("decodeImage: %v", err)
+		}
+	})
+
+	t.Run("defaults to upright", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := jpegOrientation(buf.Bytes()); got != 1 {
+			t.Errorf("orientation = %d, want 1", got)
+		}
+		if got := jpegOrientation([]byte("not a jpeg")); got != 1 {
+			t.Errorf("orientation = %d, want 1", got)
+		}
+	})
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// A 3x2 image with its top-left pixel marked
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	red := color.RGBA{R: 255, A: 255}
+	img.Set(0, 0, red)
+
+	tests := []struct {
+		orientation int
+		w, h        int
+		x, y        int
+	}{
+		{1, 3, 2, 0, 0},
+		{3, 3, 2, 2, 1},
+		{6, 2, 3, 1, 0},
+		{8, 2, 3, 0, 2},
+	}
+	for _, tt := range tests {
+		out := applyOrientation(img, tt.orientation)
+		b := out.Bounds()
+		if b.Dx() != tt.w || b.Dy() != tt.h {
+			t.Errorf("orientation %d: size = %dx%d, want %dx%d", tt.orientation, b.Dx(), b.Dy(), tt.w, tt.h)
+			continue
+		}
+		if got := color.RGBAModel.Convert(out.At(tt.x, tt.y)); got != red {
+			t.Errorf("orientation %d: pixel (%d,%d) = %v, want the marked one", tt.orientation, tt.x, tt.y, got)
+		}
+	}
+}
+
+func TestFitWithin(t *testing.T) {
+	t.Run("scales the longest edge down", func(t *testing.T) {
+		out := fitWithin(image.NewRGBA(image.Rect(0, 0, 2000, 500)), 512)
+		if b := out.Bounds(); b.Dx() != 512 || b.Dy() != 128 {
+			t.Errorf("size = %dx%d, want 512x128", b.Dx(), b.Dy())
+		}
+	})
+
+	t.Run("keeps small images and flattens transparency", func(t *testing.T) {
+		out := fitWithin(image.NewNRGBA(image.Rect(0, 0, 10, 20)), 512)
+		if b := out.Bounds(); b.Dx() != 10 || b.Dy() != 20 {
+			t.Errorf("size = %dx%d, want 10x20", b.Dx(), b.Dy())
+		}
+		if got := out.RGBAAt(0, 0); got != (color.RGBA{255, 255, 255, 255}) {
+			t.Errorf("pixel = %v, want white", got)
+		}
+	})
+}
+
+func TestGenerateSkipsInfected(t *testing.T) {
+	file := &models.File{MimeType: "image/png", ScanStatus: models.ScanInfected}
+	if err := (&ThumbnailService{}).Generate(context.Background(), file); !errors.Is(err, ErrInfected) {
+		t.Errorf("Generate() = %v, want ErrInfected", err)
+	}
+}
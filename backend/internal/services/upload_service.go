@@ -0,0 +1,557 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+
+	"github.com/tessera/tessera/internal/config"
+	"github.com/tessera/tessera/internal/models"
+	"github.com/tessera/tessera/internal/repository"
+	"github.com/tessera/tessera/internal/storage"
+)
+
+var (
+	// ErrUploadOffsetMismatch is returned when a chunk doesn't start at the session's current offset
+	ErrUploadOffsetMismatch = errors.New("upload offset mismatch")
+	// ErrUploadTooLarge is returned when a declared upload length exceeds the server maximum
+	ErrUploadTooLarge = errors.New("upload exceeds maximum size")
+	// ErrUploadOverrun is returned when a chunk carries more data than the declared length
+	ErrUploadOverrun = errors.New("upload data exceeds declared length")
+	// ErrUploadTruncated is returned when a chunk ends before its own declared length
+	ErrUploadTruncated = errors.New("chunk is shorter than its declared length")
+	// ErrUploadExpired is returned for sessions past their expiry time
+	ErrUploadExpired = errors.New("upload expired")
+	// ErrChecksumMismatch is returned when a chunk doesn't match its Upload-Checksum
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrUnsupportedChecksum is returned for unknown Upload-Checksum algorithms
+	ErrUnsupportedChecksum = errors.New("unsupported checksum algorithm")
+)
+
+// UploadChecksumAlgorithms lists the Upload-Checksum algorithms accepted by WriteChunk
+const UploadChecksumAlgorithms = "sha1,sha256,md5"
+
+const (
+	// uploadExpiry is how long an upload session stays resumable
+	uploadExpiry = 24 * time.Hour
+	// uploadLockTTL bounds how long a single chunk request may hold the session
+	uploadLockTTL = 15 * time.Minute
+	// maxFinalizing is how many completed uploads one server stores at once.
+	// Each is briefly kept twice, so this bounds the extra space they take.
+	maxFinalizing = 4
+)
+
+// UploadService implements resumable uploads on top of multipart object storage
+type UploadService struct {
+	uploadRepo  *repository.UploadRepository
+	fileRepo    *repository.FileRepository
+	fileService *FileService
+	storage     storage.MultipartStorage
+	partSize    int64
+	maxSize     int64
+	finalizing  chan struct{}
+	log         zerolog.Logger
+}
+
+// NewUploadService creates a new upload service
+func NewUploadService(uploadRepo *repository.UploadRepository, fileRepo *repository.FileRepository, fileService *FileService, store storage.MultipartStorage, cfg config.UploadConfig, log zerolog.Logger) *UploadService {
+	partSize := cfg.ChunkSize
+	if partSize < storage.MinPartSize {
+		partSize = storage.MinPartSize
+	}
+
+	return &UploadService{
+		uploadRepo:  uploadRepo,
+		fileRepo:    fileRepo,
+		fileService: fileService,
+		storage:     store,
+		partSize:    partSize,
+		maxSize:     cfg.MaxSize,
+		finalizing:  make(chan struct{}, maxFinalizing),
+		log:         log,
+	}
+}
+
+// MaxSize returns the largest upload the server accepts
+func (s *UploadService) MaxSize() int64 {
+	return s.maxSize
+}
+
+// UploadResult describes the state of an upload after a request
+type UploadResult struct {
+	Session *models.UploadSession
+	// File is set once the last byte has been received and the file stored
+	File *models.File
+	// Replaced is true when File already existed and received a new version
+	Replaced bool
+}
+
+// CreateUploadInput contains the parameters for a new upload session
+type CreateUploadInput struct {
+	OwnerID  uuid.UUID
+	ParentID *uuid.UUID
+	FileName string
+	Length   int64
+	Metadata string
+}
+
+// Create starts a new upload session after checking size limits and quota
+func (s *UploadService) Create(ctx context.Context, input CreateUploadInput) (*UploadResult, error) {
+	if input.Length < 0 {
+		return nil, fmt.Errorf("invalid upload length")
+	}
+	if s.maxSize > 0 && input.Length > s.maxSize {
+		return nil, ErrUploadTooLarge
+	}
+
+	name := filepath.Base(strings.ReplaceAll(input.FileName, "\\", "/"))
+	if name == "" || name == "." || name == "/" {
+		return nil, fmt.Errorf("filename is required")
+	}
+
+	// The upload is charged once complete; a session that can't fit isn't
+	// started
+	if err := s.fileService.CheckQuota(ctx, input.OwnerID, input.Length); err != nil {
+		return nil, err
+	}
+
+	if input.ParentID != nil {
+		parent, err := s.fileRepo.GetByID(ctx, *input.ParentID)
+		if err != nil {
+			return nil, err
+		}
+		if parent.OwnerID != input.OwnerID || !parent.IsFolder || parent.IsTrashed {
+			return nil, repository.ErrFileNotFound
+		}
+	}
+
+	now := time.Now()
+	session := &models.UploadSession{
+		ID:        uuid.New().String(),
+		UserID:    input.OwnerID,
+		ParentID:  input.ParentID,
+		FileName:  name,
+		Length:    input.Length,
+		Metadata:  input.Metadata,
+		Parts:     []models.UploadPart{},
+		ExpiresAt: now.Add(uploadExpiry),
+		CreatedAt: now,
+	}
+	session.StorageKey = fmt.Sprintf("uploads/%s/%s", input.OwnerID.String(), session.ID)
+
+	// Empty files have nothing to stage; store them straight away
+	if input.Length == 0 {
+		file, replaced, err := s.store(ctx, session, bytes.NewReader(nil))
+		if err != nil {
+			return nil, err
+		}
+		return &UploadResult{Session: session, File: file, Replaced: replaced}, nil
+	}
+
+	mimeType := mime.TypeByExtension(filepath.Ext(name))
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	multipartID, err := s.storage.NewMultipartUpload(ctx, session.StorageKey, mimeType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start multipart upload: %w", err)
+	}
+	session.MultipartID = multipartID
+
+	if err := s.uploadRepo.Save(ctx, session); err != nil {
+		_ = s.storage.AbortMultipartUpload(ctx, session.StorageKey, multipartID)
+		return nil, err
+	}
+
+	return &UploadResult{Session: session}, nil
+}
+
+// Get retrieves an upload session owned by the user
+func (s *UploadService) Get(ctx context.Context, uploadID string, ownerID uuid.UUID) (*models.UploadSession, error) {
+	session, err := s.uploadRepo.GetByID(ctx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	if session.UserID != ownerID {
+		return nil, repository.ErrUploadNotFound
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return nil, ErrUploadExpired
+	}
+	return session, nil
+}
+
+// WriteChunk appends data at the given offset. The body is cut into parts of
+// the configured chunk size; anything short of a full part is staged as a tail
+// object and prepended to the next chunk. Nothing is committed to the session
+// until the whole chunk has been received and its checksum (if any) verified.
+// size is the body's declared length, or -1 if it wasn't given.
+func (s *UploadService) WriteChunk(ctx context.Context, uploadID string, ownerID uuid.UUID, offset int64, body io.Reader, size int64, checksum string) (*UploadResult, error) {
+	if err := s.uploadRepo.Lock(ctx, uploadID, uploadLockTTL); err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = s.uploadRepo.Unlock(context.Background(), uploadID)
+	}()
+
+	// Load the session only once we hold the lock so the offset is current
+	session, err := s.Get(ctx, uploadID, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	if offset != session.Offset {
+		return nil, ErrUploadOffsetMismatch
+	}
+
+	verifier, err := newChecksumVerifier(checksum)
+	if err != nil {
+		return nil, err
+	}
+
+	remaining := session.Length - session.Offset
+	if size > remaining {
+		return nil, ErrUploadOverrun
+	}
+
+	if session.Assembled {
+		// Everything was received before but storing the file failed; the
+		// chunk sent again to retry carries nothing new
+		file, replaced, err := s.finalize(ctx, session, offset)
+		if err != nil {
+			return nil, err
+		}
+		session.Offset = session.Length
+		return &UploadResult{Session: session, File: file, Replaced: replaced}, nil
+	}
+
+	var src io.Reader = io.LimitReader(body, remaining+1)
+	if verifier != nil {
+		src = io.TeeReader(src, verifier.hash)
+	}
+	counter := &countingReader{r: src}
+
+	var reader io.Reader = counter
+	if session.TailKey != "" {
+		tail, err := s.storage.Download(ctx, session.TailKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read staged tail: %w", err)
+		}
+		defer tail.Close()
+		reader = io.MultiReader(tail, counter)
+	}
+
+	parts := append([]models.UploadPart(nil), session.Parts...)
+	buf := make([]byte, s.partSize)
+	var leftover []byte
+
+	for {
+		n, readErr := io.ReadFull(reader, buf)
+		if counter.n > remaining {
+			return nil, ErrUploadOverrun
+		}
+		if n == len(buf) {
+			part, err := s.putPart(ctx, session, len(parts)+1, buf)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, part)
+			continue
+		}
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			// A dropped connection still leaves usable data behind, but only
+			// when there is no checksum that the partial chunk would fail.
+			if verifier != nil {
+				return nil, readErr
+			}
+			s.log.Debug().Err(readErr).Str("upload_id", uploadID).Msg("Chunk interrupted, keeping received data")
+		} else if size >= 0 && counter.n < size {
+			return nil, ErrUploadTruncated
+		}
+		leftover = buf[:n]
+		break
+	}
+
+	if verifier != nil && !verifier.matches() {
+		return nil, ErrChecksumMismatch
+	}
+
+	newOffset := session.Offset + counter.n
+	oldTailKey := session.TailKey
+	session.TailKey = ""
+	session.TailSize = 0
+
+	if len(leftover) > 0 {
+		if newOffset == session.Length {
+			part, err := s.putPart(ctx, session, len(parts)+1, leftover)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, part)
+		} else {
+			tailKey := fmt.Sprintf("%s.tail.%d", session.StorageKey, newOffset)
+			if err := s.storage.Upload(ctx, tailKey, bytes.NewReader(leftover), int64(len(leftover)), "application/octet-stream"); err != nil {
+				return nil, fmt.Errorf("failed to stage tail: %w", err)
+			}
+			session.TailKey = tailKey
+			session.TailSize = int64(len(leftover))
+		}
+	}
+
+	session.Parts = parts
+	session.Offset = newOffset
+
+	result := &UploadResult{Session: session}
+	var finalizeErr error
+	if session.Offset == session.Length {
+		result.File, result.Replaced, finalizeErr = s.finalize(ctx, session, offset)
+		if finalizeErr != nil && !session.Assembled {
+			// The previous tail is still part of the upload
+			return nil, finalizeErr
+		}
+	} else if err := s.uploadRepo.Save(ctx, session); err != nil {
+		return nil, err
+	}
+
+	if oldTailKey != "" && oldTailKey != session.TailKey {
+		if err := s.storage.Delete(ctx, oldTailKey); err != nil {
+			s.log.Warn().Err(err).Str("key", oldTailKey).Msg("Failed to delete staged tail")
+		}
+	}
+	if finalizeErr != nil {
+		return nil, finalizeErr
+	}
+
+	return result, nil
+}
+
+// Terminate aborts an upload and discards everything received so far
+func (s *UploadService) Terminate(ctx context.Context, uploadID string, ownerID uuid.UUID) error {
+	session, err := s.uploadRepo.GetByID(ctx, uploadID)
+	if err != nil {
+		return err
+	}
+	if session.UserID != ownerID {
+		return repository.ErrUploadNotFound
+	}
+
+	if err := s.uploadRepo.Lock(ctx, uploadID, uploadLockTTL); err != nil {
+		return err
+	}
+	defer func() {
+		_ = s.uploadRepo.Unlock(context.Background(), uploadID)
+	}()
+
+	return s.discard(ctx, session)
+}
+
+// PurgeExpired aborts upload sessions whose expiry has passed
+func (s *UploadService) PurgeExpired(ctx context.Context) (int, error) {
+	ids, err := s.uploadRepo.ListExpired(ctx, time.Now(), 100)
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, id := range ids {
+		session, err := s.uploadRepo.GetByID(ctx, id)
+		if errors.Is(err, repository.ErrUploadNotFound) {
+			// Session data is gone already; just drop the index entry
+			_ = s.uploadRepo.Delete(ctx, id)
+			continue
+		}
+		if err != nil {
+			return purged, err
+		}
+		if err := s.discard(ctx, session); err != nil {
+			s.log.Error().Err(err).Str("upload_id", id).Msg("Failed to purge expired upload")
+			continue
+		}
+		purged++
+	}
+
+	return purged, nil
+}
+
+// discard removes all staged data for a session along with the session itself
+func (s *UploadService) discard(ctx context.Context, session *models.UploadSession) error {
+	if session.Assembled {
+		if err := s.storage.Delete(ctx, session.StorageKey); err != nil {
+			s.log.Warn().Err(err).Str("key", session.StorageKey).Msg("Failed to delete staged upload")
+		}
+	} else if session.MultipartID != "" {
+		if err := s.storage.AbortMultipartUpload(ctx, session.StorageKey, session.MultipartID); err != nil {
+			s.log.Warn().Err(err).Str("upload_id", session.ID).Msg("Failed to abort multipart upload")
+		}
+	}
+	if session.TailKey != "" {
+		if err := s.storage.Delete(ctx, session.TailKey); err != nil {
+			s.log.Warn().Err(err).Str("key", session.TailKey).Msg("Failed to delete staged tail")
+		}
+	}
+	return s.uploadRepo.Delete(ctx, session.ID)
+}
+
+// finalize assembles the staged parts and stores the result as a file.
+//
+// The file service writes the content a second time, hashed and encrypted for
+// its owner like any other upload, and the assembled object is deleted once
+// it's stored. Until then the upload takes twice its size; only maxFinalizing
+// uploads are stored at a time to keep that bounded.
+//
+// If storing fails for a reason that may pass, such as a storage or database
+// error or a full quota, the session is kept at the offset of the last chunk
+// so that sending it again retries. It's discarded when the target folder is
+// gone.
+func (s *UploadService) finalize(ctx context.Context, session *models.UploadSession, offset int64) (*models.File, bool, error) {
+	if !session.Assembled {
+		if err := s.storage.CompleteMultipartUpload(ctx, session.StorageKey, session.MultipartID, session.Parts); err != nil {
+			// The session still holds the parts, so the chunk can be sent again
+			return nil, false, fmt.Errorf("failed to complete multipart upload: %w", err)
+		}
+		session.Assembled = true
+	}
+
+	file, replaced, err := s.storeAssembled(ctx, session)
+	if errors.Is(err, repository.ErrFileNotFound) {
+		if discardErr := s.discard(ctx, session); discardErr != nil {
+			s.log.Warn().Err(discardErr).Str("upload_id", session.ID).Msg("Failed to delete upload session")
+		}
+		return nil, false, err
+	}
+	if err != nil {
+		session.Offset = offset
+		if saveErr := s.uploadRepo.Save(ctx, session); saveErr != nil {
+			s.log.Warn().Err(saveErr).Str("upload_id", session.ID).Msg("Failed to keep upload session")
+		}
+		return nil, false, err
+	}
+
+	if err := s.uploadRepo.Delete(ctx, session.ID); err != nil {
+		s.log.Warn().Err(err).Str("upload_id", session.ID).Msg("Failed to delete upload session")
+	}
+	if err := s.storage.Delete(ctx, session.StorageKey); err != nil {
+		s.log.Warn().Err(err).Str("key", session.StorageKey).Msg("Failed to delete staged upload")
+	}
+	return file, replaced, nil
+}
+
+// storeAssembled stores the session's assembled object once a slot is free
+func (s *UploadService) storeAssembled(ctx context.Context, session *models.UploadSession) (*models.File, bool, error) {
+	select {
+	case s.finalizing <- struct{}{}:
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+	defer func() { <-s.finalizing }()
+
+	reader, err := s.storage.Download(ctx, session.StorageKey)
+	if err != nil {
+		return nil, false, err
+	}
+	defer reader.Close()
+
+	return s.store(ctx, session, reader)
+}
+
+// store writes the uploaded content through the file service, adding a new
+// version when a file of the same name already exists in the target folder.
+func (s *UploadService) store(ctx context.Context, session *models.UploadSession, reader io.Reader) (*models.File, bool, error) {
+	existing, err := s.fileRepo.GetByName(ctx, session.UserID, session.ParentID, session.FileName)
+	if err != nil && !errors.Is(err, repository.ErrFileNotFound) {
+		return nil, false, err
+	}
+
+	if existing != nil && !existing.IsFolder {
+		file, err := s.fileService.UpdateFileContentWithInput(ctx, UpdateContentInput{
+			FileID:  existing.ID,
+			OwnerID: session.UserID,
+			Reader:  reader,
+			Size:    session.Length,
+		})
+		return file, true, err
+	}
+
+	file, err := s.fileService.UploadFile(ctx, UploadInput{
+		OwnerID:  session.UserID,
+		ParentID: session.ParentID,
+		Name:     session.FileName,
+		Size:     session.Length,
+		Reader:   reader,
+	})
+	return file, false, err
+}
+
+// putPart uploads one part of the session's multipart object
+func (s *UploadService) putPart(ctx context.Context, session *models.UploadSession, number int, data []byte) (models.UploadPart, error) {
+	etag, err := s.storage.PutPart(ctx, session.StorageKey, session.MultipartID, number, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return models.UploadPart{}, fmt.Errorf("failed to upload part %d: %w", number, err)
+	}
+	return models.UploadPart{Number: number, ETag: etag, Size: int64(len(data))}, nil
+}
+
+// checksumVerifier checks a chunk against an Upload-Checksum header
+type checksumVerifier struct {
+	hash     hash.Hash
+	expected []byte
+}
+
+// newChecksumVerifier parses "<algorithm> <base64 digest>"; an empty header yields nil
+func newChecksumVerifier(header string) (*checksumVerifier, error) {
+	if header == "" {
+		return nil, nil
+	}
+
+	algorithm, encoded, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok {
+		return nil, fmt.Errorf("invalid Upload-Checksum header")
+	}
+	expected, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Upload-Checksum digest")
+	}
+
+	var h hash.Hash
+	switch strings.ToLower(algorithm) {
+	case "sha1":
+		h = sha1.New()
+	case "sha256":
+		h = sha256.New()
+	case "md5":
+		h = md5.New()
+	default:
+		return nil, ErrUnsupportedChecksum
+	}
+
+	return &checksumVerifier{hash: h, expected: expected}, nil
+}
+
+func (v *checksumVerifier) matches() bool {
+	return bytes.Equal(v.hash.Sum(nil), v.expected)
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
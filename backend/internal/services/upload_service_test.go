@@ -0,0 +1,61 @@
+package services
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"testing"
+)
+
+func TestNewChecksumVerifier(t *testing.T) {
+	data := []byte("hello tus")
+	sum := sha1.Sum(data)
+	digest := base64.StdEncoding.EncodeToString(sum[:])
+
+	t.Run("empty header disables verification", func(t *testing.T) {
+		v, err := newChecksumVerifier("")
+		if err != nil {
+			t.Fatalf("newChecksumVerifier() error = %v", err)
+		}
+		if v != nil {
+			t.Error("newChecksumVerifier() should return nil for empty header")
+		}
+	})
+
+	t.Run("matches correct digest", func(t *testing.T) {
+		v, err := newChecksumVerifier("sha1 " + digest)
+		if err != nil {
+			t.Fatalf("newChecksumVerifier() error = %v", err)
+		}
+		v.hash.Write(data)
+		if !v.matches() {
+			t.Error("matches() rejected correct digest")
+		}
+	})
+
+	t.Run("rejects wrong data", func(t *testing.T) {
+		v, err := newChecksumVerifier("sha1 " + digest)
+		if err != nil {
+			t.Fatalf("newChecksumVerifier() error = %v", err)
+		}
+		v.hash.Write([]byte("something else"))
+		if v.matches() {
+			t.Error("matches() accepted wrong data")
+		}
+	})
+
+	t.Run("rejects unsupported algorithm", func(t *testing.T) {
+		_, err := newChecksumVerifier("crc32 " + digest)
+		if err != ErrUnsupportedChecksum {
+			t.Errorf("newChecksumVerifier() error = %v, want ErrUnsupportedChecksum", err)
+		}
+	})
+
+	t.Run("rejects malformed header", func(t *testing.T) {
+		if _, err := newChecksumVerifier("sha1"); err == nil {
+			t.Error("newChecksumVerifier() accepted header without digest")
+		}
+		if _, err := newChecksumVerifier("sha1 !!!"); err == nil {
+			t.Error("newChecksumVerifier() accepted invalid base64")
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/minio/minio-go/v7"
+
+	"github.com/tessera/tessera/internal/config"
+	"github.com/tessera/tessera/internal/models"
+)
+
+// Storage backends selectable with STORAGE_BACKEND
+const (
+	BackendMinIO = "minio"
+	BackendLocal = "local"
+)
+
+// MultipartStorage is a Storage that can assemble an object from parts
+// stored one at a time, as resumable uploads do
+type MultipartStorage interface {
+	Storage
+	NewMultipartUpload(ctx context.Context, objectName, contentType string) (string, error)
+	PutPart(ctx context.Context, objectName, uploadID string, partNumber int, reader io.Reader, size int64) (string, error)
+	CompleteMultipartUpload(ctx context.Context, objectName, uploadID string, parts []models.UploadPart) error
+	AbortMultipartUpload(ctx context.Context, objectName, uploadID string) error
+}
+
+// Backend is where objects are kept: a MinIO bucket or a local directory
+type Backend interface {
+	MultipartStorage
+	// Name identifies the backend, as one of the Backend constants
+	Name() string
+	// Ping checks that the backend can be reached and written to
+	Ping(ctx context.Context) error
+	// Walk calls fn with the key, size and modification time of every
+	// stored object, stopping at the first error fn returns
+	Walk(ctx context.Context, fn func(*ObjectInfo) error) error
+}
+
+// IsNotExist reports whether err says an object doesn't exist
+func IsNotExist(err error) bool {
+	if err == nil {
+		return false
+	}
+	return errors.Is(err, os.ErrNotExist) || minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
+
+// New opens the backend selected by cfg. urlSecret signs the URLs the local
+// backend hands out in place of presigned ones.
+func New(cfg config.StorageConfig, urlSecret string) (Backend, error) {
+	switch cfg.Backend {
+	case BackendMinIO, "":
+		return NewMinIO(cfg)
+	case BackendLocal:
+		return NewLocal(cfg, urlSecret)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.Backend)
+	}
+}
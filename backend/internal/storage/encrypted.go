@@ -0,0 +1,273 @@
+package storage
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tessera/tessera/internal/security"
+)
+
+// ErrEncryptedObject is returned for presigned URLs to encrypted objects,
+// which only the server can decrypt
+var ErrEncryptedObject = errors.New("object is encrypted")
+
+// KeyProvider supplies the data keys objects are encrypted with
+type KeyProvider interface {
+	// DataKey returns the ID and key new objects of a user are encrypted
+	// with, creating them if needed. The nil user has a key of its own.
+	DataKey(ctx context.Context, ownerID uuid.UUID) (uuid.UUID, []byte, error)
+	// Key returns the data key with the given ID
+	Key(ctx context.Context, keyID uuid.UUID) ([]byte, error)
+}
+
+type ownerKey struct{}
+
+// WithOwner returns a context marking objects uploaded with it as a user's,
+// so they're encrypted with that user's data key
+func WithOwner(ctx context.Context, ownerID uuid.UUID) context.Context {
+	return context.WithValue(ctx, ownerKey{}, ownerID)
+}
+
+func ownerFrom(ctx context.Context) uuid.UUID {
+	ownerID, _ := ctx.Value(ownerKey{}).(uuid.UUID)
+	return ownerID
+}
+
+// EncryptedStorage encrypts objects at rest in another Storage. Objects
+// written before encryption was enabled are read as they are, so it can be
+// turned on for existing data and EncryptObject used to migrate it.
+type EncryptedStorage struct {
+	inner   Storage
+	keys    KeyProvider
+	encrypt bool
+}
+
+// NewEncrypted wraps a storage backend. With encrypt unset, new objects are
+// stored as plaintext but encrypted ones can still be read.
+func NewEncrypted(inner Storage, keys KeyProvider, encrypt bool) *EncryptedStorage {
+	return &EncryptedStorage{inner: inner, keys: keys, encrypt: encrypt}
+}
+
+// Encrypting reports whether new objects are encrypted
+func (s *EncryptedStorage) Encrypting() bool {
+	return s.encrypt
+}
+
+// Upload stores an object, encrypted with the data key of the owner set
+// with WithOwner
+func (s *EncryptedStorage) Upload(ctx context.Context, objectName string, reader io.Reader, size int64, contentType string) error {
+	if !s.encrypt {
+		return s.inner.Upload(ctx, objectName, reader, size, contentType)
+	}
+	return s.uploadEncrypted(ctx, objectName, reader, size, contentType)
+}
+
+func (s *EncryptedStorage) uploadEncrypted(ctx context.Context, objectName string, reader io.Reader, size int64, contentType string) error {
+	keyID, key, err := s.keys.DataKey(ctx, ownerFrom(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to get data key: %w", err)
+	}
+	header, err := security.NewStreamHeader(keyID)
+	if err != nil {
+		return err
+	}
+	encrypted, err := security.NewEncryptReader(reader, key, header)
+	if err != nil {
+		return err
+	}
+	if size >= 0 {
+		size = security.EncryptedSize(size)
+	}
+	return s.inner.Upload(ctx, objectName, encrypted, size, contentType)
+}
+
+// Download retrieves an object, decrypting it as it's read
+func (s *EncryptedStorage) Download(ctx context.Context, objectName string) (io.ReadCloser, error) {
+	rc, err := s.inner.Download(ctx, objectName)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(rc)
+	peeked, err := br.Peek(security.StreamHeaderSize)
+	if err != nil && err != io.EOF {
+		rc.Close()
+		return nil, err
+	}
+	header, ok := security.ParseStreamHeader(peeked)
+	if !ok {
+		return readCloser{Reader: br, Closer: rc}, nil
+	}
+
+	key, err := s.keys.Key(ctx, header.KeyID)
+	if err != nil {
+		rc.Close()
+		return nil, fmt.Errorf("failed to get data key: %w", err)
+	}
+	br.Discard(security.StreamHeaderSize)
+	dr, err := security.NewDecryptReader(br, key, header, 0, false)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return readCloser{Reader: dr, Closer: rc}, nil
+}
+
+// DownloadRange retrieves length bytes of an object starting at offset. Of
+// an encrypted object only the chunks holding the range are read.
+func (s *EncryptedStorage) DownloadRange(ctx context.Context, objectName string, offset, length int64) (io.ReadCloser, error) {
+	header, err := s.header(ctx, objectName)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		return s.inner.DownloadRange(ctx, objectName, offset, length)
+	}
+
+	key, err := s.keys.Key(ctx, header.KeyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get data key: %w", err)
+	}
+	first := offset / security.StreamChunkSize
+	last := (offset + length - 1) / security.StreamChunkSize
+	start := security.ChunkOffset(first)
+	rc, err := s.inner.DownloadRange(ctx, objectName, start, security.ChunkOffset(last+1)-start)
+	if err != nil {
+		return nil, err
+	}
+	dr, err := security.NewDecryptReader(rc, key, header, first, true)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, dr, offset-first*security.StreamChunkSize); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return readCloser{Reader: &exactReader{r: dr, remaining: length}, Closer: rc}, nil
+}
+
+// Delete removes an object
+func (s *EncryptedStorage) Delete(ctx context.Context, objectName string) error {
+	return s.inner.Delete(ctx, objectName)
+}
+
+// GetPresignedURL generates a temporary download URL. Encrypted objects
+// have none, failing with ErrEncryptedObject.
+func (s *EncryptedStorage) GetPresignedURL(ctx context.Context, objectName string, expiry time.Duration) (string, error) {
+	header, err := s.header(ctx, objectName)
+	if err != nil {
+		return "", err
+	}
+	if header != nil {
+		return "", ErrEncryptedObject
+	}
+	return s.inner.GetPresignedURL(ctx, objectName, expiry)
+}
+
+// Stat returns object metadata, with the size of the plaintext
+func (s *EncryptedStorage) Stat(ctx context.Context, objectName string) (*ObjectInfo, error) {
+	info, err := s.inner.Stat(ctx, objectName)
+	if err != nil || info.Size < security.EncryptedSize(0) {
+		return info, err
+	}
+	header, err := s.header(ctx, objectName)
+	if err != nil {
+		return nil, err
+	}
+	if header != nil {
+		info.Size = security.PlaintextSize(info.Size)
+	}
+	return info, nil
+}
+
+// EncryptObject encrypts an object stored before encryption was enabled,
+// with the given user's data key. It reports false for an object that's
+// encrypted already.
+//
+// The object is encrypted into a temporary one first, which then replaces
+// it, so it's never read and overwritten at once.
+func (s *EncryptedStorage) EncryptObject(ctx context.Context, objectName string, ownerID uuid.UUID) (bool, error) {
+	info, err := s.inner.Stat(ctx, objectName)
+	if err != nil {
+		return false, err
+	}
+	// Anything shorter than empty encrypted content is plaintext
+	if info.Size >= security.EncryptedSize(0) {
+		header, err := s.header(ctx, objectName)
+		if err != nil || header != nil {
+			return false, err
+		}
+	}
+
+	tmp := objectName + ".encrypting"
+	plain, err := s.inner.Download(ctx, objectName)
+	if err != nil {
+		return false, err
+	}
+	err = s.uploadEncrypted(WithOwner(ctx, ownerID), tmp, plain, info.Size, info.ContentType)
+	plain.Close()
+	if err != nil {
+		return false, err
+	}
+	defer s.inner.Delete(context.WithoutCancel(ctx), tmp)
+
+	encrypted, err := s.inner.Download(ctx, tmp)
+	if err != nil {
+		return false, err
+	}
+	defer encrypted.Close()
+	if err := s.inner.Upload(ctx, objectName, encrypted, security.EncryptedSize(info.Size), info.ContentType); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// header reads the header of an encrypted object, returning nil for one
+// stored as plaintext
+func (s *EncryptedStorage) header(ctx context.Context, objectName string) (*security.StreamHeader, error) {
+	rc, err := s.inner.DownloadRange(ctx, objectName, 0, int64(security.StreamHeaderSize))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	buf := make([]byte, security.StreamHeaderSize)
+	n, err := io.ReadFull(rc, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	header, _ := security.ParseStreamHeader(buf[:n])
+	return header, nil
+}
+
+// readCloser reads from one reader and closes another
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// exactReader reads exactly remaining bytes, failing if r ends early
+type exactReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (e *exactReader) Read(p []byte) (int, error) {
+	if e.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > e.remaining {
+		p = p[:e.remaining]
+	}
+	n, err := e.r.Read(p)
+	e.remaining -= int64(n)
+	if err == io.EOF && e.remaining > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tessera/tessera/internal/security"
+)
+
+// memStorage keeps objects in memory
+type memStorage map[string][]byte
+
+func (m memStorage) Upload(_ context.Context, name string, r io.Reader, size int64, _ string) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && int64(len(data)) != size {
+		return errors.New("size mismatch")
+	}
+	m[name] = data
+	return nil
+}
+
+func (m memStorage) Download(_ context.Context, name string) (io.ReadCloser, error) {
+	data, ok := m[name]
+	if !ok {
+		return nil, errors.New("no such object")
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m memStorage) DownloadRange(_ context.Context, name string, offset, length int64) (io.ReadCloser, error) {
+	data, ok := m[name]
+	if !ok {
+		return nil, errors.New("no such object")
+	}
+	end := min(offset+length, int64(len(data)))
+	return io.NopCloser(bytes.NewReader(data[offset:end])), nil
+}
+
+func (m memStorage) Delete(_ context.Context, name string) error {
+	delete(m, name)
+	return nil
+}
+
+func (m memStorage) GetPresignedURL(_ context.Context, name string, _ time.Duration) (string, error) {
+	return "https://storage/" + name, nil
+}
+
+func (m memStorage) Stat(_ context.Context, name string) (*ObjectInfo, error) {
+	data, ok := m[name]
+	if !ok {
+		return nil, errors.New("no such object")
+	}
+	return &ObjectInfo{Key: name, Size: int64(len(data))}, nil
+}
+
+// memKeys hands out one data key per owner
+type memKeys struct {
+	owners map[uuid.UUID]uuid.UUID
+	keys   map[uuid.UUID][]byte
+}
+
+func (k *memKeys) DataKey(_ context.Context, ownerID uuid.UUID) (uuid.UUID, []byte, error) {
+	if id, ok := k.owners[ownerID]; ok {
+		return id, k.keys[id], nil
+	}
+	id := uuid.New()
+	key, _ := security.GenerateDataKey()
+	k.owners[ownerID], k.keys[id] = id, key
+	return id, key, nil
+}
+
+func (k *memKeys) Key(_ context.Context, keyID uuid.UUID) ([]byte, error) {
+	key, ok := k.keys[keyID]
+	if !ok {
+		return nil, errors.New("no such key")
+	}
+	return key, nil
+}
+
+func readAll(t *testing.T, rc io.ReadCloser, err error) []byte {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	ctx := context.Background()
+	inner := memStorage{}
+	keys := &memKeys{owners: map[uuid.UUID]uuid.UUID{}, keys: map[uuid.UUID][]byte{}}
+	store := NewEncrypted(inner, keys, true)
+
+	content := make([]byte, 2*security.StreamChunkSize+500)
+	rand.Read(content)
+	owner := uuid.New()
+	if err := store.Upload(WithOwner(ctx, owner), "a", bytes.NewReader(content), int64(len(content)), ""); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(inner["a"], content[:64]) {
+		t.Fatal("object stored as plaintext")
+	}
+	if header, _ := security.ParseStreamHeader(inner["a"]); header.KeyID != keys.owners[owner] {
+		t.Error("object not encrypted with the owner's data key")
+	}
+
+	info, err := store.Stat(ctx, "a")
+	if err != nil || info.Size != int64(len(content)) {
+		t.Errorf("Stat() size = %v, %v; want %d", info, err, len(content))
+	}
+	rc, err := store.Download(ctx, "a")
+	if got := readAll(t, rc, err); !bytes.Equal(got, content) {
+		t.Error("Download() returned different content")
+	}
+
+	ranges := [][2]int64{{0, 10}, {100, security.StreamChunkSize}, {security.StreamChunkSize - 1, 2}, {2*security.StreamChunkSize + 499, 1}, {5, int64(len(content)) - 5}}
+	for _, r := range ranges {
+		rc, err := store.DownloadRange(ctx, "a", r[0], r[1])
+		if got := readAll(t, rc, err); !bytes.Equal(got, content[r[0]:r[0]+r[1]]) {
+			t.Errorf("DownloadRange(%d, %d) returned different content", r[0], r[1])
+		}
+	}
+
+	if _, err := store.GetPresignedURL(ctx, "a", time.Minute); !errors.Is(err, ErrEncryptedObject) {
+		t.Errorf("GetPresignedURL() error = %v, want ErrEncryptedObject", err)
+	}
+}
+
+func TestEncryptedStorageMigration(t *testing.T) {
+	ctx := context.Background()
+	inner := memStorage{"old": []byte("stored before encryption"), "empty": {}}
+	keys := &memKeys{owners: map[uuid.UUID]uuid.UUID{}, keys: map[uuid.UUID][]byte{}}
+	store := NewEncrypted(inner, keys, true)
+
+	// Plaintext objects are read as they are
+	rc, err := store.DownloadRange(ctx, "old", 7, 6)
+	if got := readAll(t, rc, err); string(got) != "before" {
+		t.Errorf("DownloadRange() of plaintext = %q", got)
+	}
+	if url, err := store.GetPresignedURL(ctx, "old", time.Minute); err != nil || url == "" {
+		t.Errorf("GetPresignedURL() of plaintext = %q, %v", url, err)
+	}
+
+	for _, name := range []string{"old", "empty"} {
+		want := string(inner[name])
+		if ok, err := store.EncryptObject(ctx, name, uuid.New()); !ok || err != nil {
+			t.Fatalf("EncryptObject(%s) = %v, %v", name, ok, err)
+		}
+		if _, ok := security.ParseStreamHeader(inner[name]); !ok {
+			t.Errorf("%s not encrypted", name)
+		}
+		if _, ok := inner[name+".encrypting"]; ok {
+			t.Errorf("temporary object of %s left behind", name)
+		}
+		rc, err := store.Download(ctx, name)
+		if got := readAll(t, rc, err); string(got) != want {
+			t.Errorf("%s decrypted to %q, want %q", name, got, want)
+		}
+		if ok, err := store.EncryptObject(ctx, name, uuid.New()); ok || err != nil {
+			t.Errorf("EncryptObject(%s) again = %v, %v; want false", name, ok, err)
+		}
+	}
+}
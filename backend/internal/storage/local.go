@@ -0,0 +1,485 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tessera/tessera/internal/config"
+	"github.com/tessera/tessera/internal/models"
+)
+
+// SignedURLPath is where the API serves local objects over signed URLs
+const SignedURLPath = "/api/storage/object"
+
+var (
+	// ErrInvalidSignature is returned for a signed URL the server didn't
+	// issue, or one that was altered
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrURLExpired is returned for a signed URL past its expiry
+	ErrURLExpired = errors.New("url expired")
+)
+
+// LocalStorage implements Storage on a local directory, for installs that
+// don't run MinIO. Objects are plain files under objects/, sharded into two
+// levels of directories by a hash of their key so no directory grows too
+// large. Their content type and ETag are kept under meta/ alongside.
+//
+// Writes go to a temporary file that is synced and then renamed over the
+// object, so readers see either the old content or the new, never part of
+// it. In place of presigned URLs it hands out URLs of the Tessera API
+// signed with urlSecret.
+type LocalStorage struct {
+	root      string
+	baseURL   string
+	urlSecret []byte
+}
+
+// localMeta is what is kept of an object besides its content. Size and
+// ModTime tie it to the content it was written with; an object rewritten
+// without it, say by a crash between the two renames, falls back to
+// metadata derived from the file.
+type localMeta struct {
+	ContentType string    `json:"content_type"`
+	ETag        string    `json:"etag"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mod_time"`
+}
+
+// NewLocal creates a local storage in cfg.LocalPath, creating the directory
+// if needed
+func NewLocal(cfg config.StorageConfig, urlSecret string) (*LocalStorage, error) {
+	root, err := filepath.Abs(cfg.LocalPath)
+	if err != nil {
+		return nil, err
+	}
+	s := &LocalStorage{
+		root:    root,
+		baseURL: strings.TrimSuffix(cfg.LocalURL, "/"),
+		// The URL key is derived from the secret rather than being the
+		// secret, so signed URLs can't be confused with anything else it
+		// signs
+		urlSecret: deriveKey(urlSecret, "tessera-storage-url"),
+	}
+	for _, dir := range []string{"objects", "meta", "multipart", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o750); err != nil {
+			return nil, err
+		}
+	}
+	// Temporary files left by a crash are of writes that never completed
+	tmp, err := os.ReadDir(filepath.Join(root, "tmp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range tmp {
+		_ = os.Remove(filepath.Join(root, "tmp", entry.Name()))
+	}
+	return s, nil
+}
+
+func deriveKey(secret, purpose string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// Name returns BackendLocal
+func (s *LocalStorage) Name() string {
+	return BackendLocal
+}
+
+// Ping checks that the directory can be written to
+func (s *LocalStorage) Ping(ctx context.Context) error {
+	f, err := os.CreateTemp(filepath.Join(s.root, "tmp"), "ping-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// fileName turns an object key into a file name. Escaping keeps the slashes
+// of the key out of the path and lets the key be read back from the name; a
+// leading dot is escaped too, so no key names "." or "..".
+func fileName(objectName string) (string, error) {
+	name := url.PathEscape(objectName)
+	if strings.HasPrefix(name, ".") {
+		name = "%2E" + name[1:]
+	}
+	if objectName == "" || len(name) > 255 {
+		return "", fmt.Errorf("invalid object name %q", objectName)
+	}
+	return name, nil
+}
+
+// paths returns where an object's content and metadata are kept
+func (s *LocalStorage) paths(objectName string) (string, string, error) {
+	name, err := fileName(objectName)
+	if err != nil {
+		return "", "", err
+	}
+	sum := sha256.Sum256([]byte(objectName))
+	shard := hex.EncodeToString(sum[:2])
+	shardPath := filepath.Join(shard[:2], shard[2:], name)
+	return filepath.Join(s.root, "objects", shardPath), filepath.Join(s.root, "meta", shardPath), nil
+}
+
+// Upload stores a file. A size of -1 stores a reader of unknown length.
+func (s *LocalStorage) Upload(ctx context.Context, objectName string, reader io.Reader, size int64, contentType string) error {
+	objectPath, metaPath, err := s.paths(objectName)
+	if err != nil {
+		return err
+	}
+
+	tmpPath, etag, err := s.writeTemp(ctx, reader, size)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	info, err := os.Stat(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	if err := s.rename(tmpPath, objectPath); err != nil {
+		return err
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return s.writeMeta(metaPath, &localMeta{
+		ContentType: contentType,
+		ETag:        etag,
+		Size:        info.Size(),
+		ModTime:     info.ModTime(),
+	})
+}
+
+// writeTemp writes a reader to a synced temporary file, returning its path
+// and the MD5 of its content. The caller renames or removes the file.
+func (s *LocalStorage) writeTemp(ctx context.Context, reader io.Reader, size int64) (string, string, error) {
+	tmp, err := os.CreateTemp(filepath.Join(s.root, "tmp"), "object-*")
+	if err != nil {
+		return "", "", err
+	}
+
+	hash := md5.New()
+	written, err := io.Copy(io.MultiWriter(tmp, hash), contextReader{ctx: ctx, r: reader})
+	if err == nil && size >= 0 && written != size {
+		err = fmt.Errorf("read %d bytes, expected %d", written, size)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", "", err
+	}
+	return tmp.Name(), hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// rename moves a finished temporary file into place and syncs the
+// directory, so the rename survives a crash too
+func (s *LocalStorage) rename(tmpPath, path string) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (s *LocalStorage) writeMeta(metaPath string, meta *localMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	tmpPath, _, err := s.writeTemp(context.Background(), bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	return s.rename(tmpPath, metaPath)
+}
+
+// Download retrieves a file
+func (s *LocalStorage) Download(ctx context.Context, objectName string) (io.ReadCloser, error) {
+	objectPath, _, err := s.paths(objectName)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(objectPath)
+}
+
+// DownloadRange retrieves length bytes of a file starting at offset. A
+// range running past the end of the file stops at the end.
+func (s *LocalStorage) DownloadRange(ctx context.Context, objectName string, offset, length int64) (io.ReadCloser, error) {
+	if offset < 0 || length <= 0 {
+		return nil, fmt.Errorf("invalid range %d+%d", offset, length)
+	}
+	objectPath, _, err := s.paths(objectName)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(objectPath)
+	if err != nil {
+		return nil, err
+	}
+	return sectionReadCloser{SectionReader: io.NewSectionReader(f, offset, length), f: f}, nil
+}
+
+type sectionReadCloser struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (r sectionReadCloser) Close() error {
+	return r.f.Close()
+}
+
+// Delete removes a file. Removing one that doesn't exist isn't an error.
+func (s *LocalStorage) Delete(ctx context.Context, objectName string) error {
+	objectPath, metaPath, err := s.paths(objectName)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(objectPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(metaPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// GetPresignedURL returns a URL of the Tessera API that serves the object
+// until expiry, without other credentials
+func (s *LocalStorage) GetPresignedURL(ctx context.Context, objectName string, expiry time.Duration) (string, error) {
+	if _, err := fileName(objectName); err != nil {
+		return "", err
+	}
+	expires := strconv.FormatInt(time.Now().Add(expiry).Unix(), 10)
+	query := url.Values{
+		"key":       {objectName},
+		"expires":   {expires},
+		"signature": {s.sign(objectName, expires)},
+	}
+	return s.baseURL + SignedURLPath + "?" + query.Encode(), nil
+}
+
+func (s *LocalStorage) sign(objectName, expires string) string {
+	mac := hmac.New(sha256.New, s.urlSecret)
+	mac.Write([]byte(objectName + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyURL checks the query of a URL from GetPresignedURL
+func (s *LocalStorage) VerifyURL(objectName, expires, signature string) error {
+	if !hmac.Equal([]byte(s.sign(objectName, expires)), []byte(signature)) {
+		return ErrInvalidSignature
+	}
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if time.Now().Unix() > unix {
+		return ErrURLExpired
+	}
+	return nil
+}
+
+// Stat returns object metadata
+func (s *LocalStorage) Stat(ctx context.Context, objectName string) (*ObjectInfo, error) {
+	objectPath, metaPath, err := s.paths(objectName)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(objectPath)
+	if err != nil {
+		return nil, err
+	}
+
+	objectInfo := &ObjectInfo{
+		Key:          objectName,
+		Size:         info.Size(),
+		ContentType:  "application/octet-stream",
+		LastModified: info.ModTime(),
+		ETag:         fmt.Sprintf("%x-%x", info.ModTime().UnixNano(), info.Size()),
+	}
+	var meta localMeta
+	if data, err := os.ReadFile(metaPath); err == nil && json.Unmarshal(data, &meta) == nil &&
+		meta.Size == info.Size() && meta.ModTime.Equal(info.ModTime()) {
+		objectInfo.ContentType = meta.ContentType
+		objectInfo.ETag = meta.ETag
+	}
+	return objectInfo, nil
+}
+
+// Walk calls fn for every stored object. Files under objects/ that aren't
+// named like objects, which Tessera never writes, are skipped.
+func (s *LocalStorage) Walk(ctx context.Context, fn func(*ObjectInfo) error) error {
+	return filepath.WalkDir(filepath.Join(s.root, "objects"), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		key, err := url.PathUnescape(entry.Name())
+		if err != nil {
+			return nil
+		}
+		info, err := entry.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil // deleted while walking
+		}
+		if err != nil {
+			return err
+		}
+		return fn(&ObjectInfo{Key: key, Size: info.Size(), LastModified: info.ModTime()})
+	})
+}
+
+// NewMultipartUpload starts a multipart upload and returns its upload ID.
+// Parts are kept under multipart/ until the upload completes.
+func (s *LocalStorage) NewMultipartUpload(ctx context.Context, objectName, contentType string) (string, error) {
+	if _, err := fileName(objectName); err != nil {
+		return "", err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	uploadID := hex.EncodeToString(id)
+	dir := filepath.Join(s.root, "multipart", uploadID)
+	if err := os.Mkdir(dir, 0o750); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "content-type"), []byte(contentType), 0o640); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return uploadID, nil
+}
+
+// uploadDir returns the directory of a multipart upload
+func (s *LocalStorage) uploadDir(uploadID string) (string, error) {
+	if _, err := hex.DecodeString(uploadID); err != nil || uploadID == "" {
+		return "", fmt.Errorf("invalid upload ID %q", uploadID)
+	}
+	return filepath.Join(s.root, "multipart", uploadID), nil
+}
+
+func partPath(dir string, partNumber int) string {
+	return filepath.Join(dir, fmt.Sprintf("part-%05d", partNumber))
+}
+
+// PutPart stores a single part of a multipart upload and returns its ETag.
+// A part stored again under the same number replaces the earlier one.
+func (s *LocalStorage) PutPart(ctx context.Context, objectName, uploadID string, partNumber int, reader io.Reader, size int64) (string, error) {
+	dir, err := s.uploadDir(uploadID)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return "", err
+	}
+
+	tmpPath, etag, err := s.writeTemp(ctx, reader, size)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpPath)
+	if err := os.Rename(tmpPath, partPath(dir, partNumber)); err != nil {
+		return "", err
+	}
+	return etag, nil
+}
+
+// CompleteMultipartUpload assembles the given parts into the final object.
+// Parts that were stored but not listed are discarded.
+func (s *LocalStorage) CompleteMultipartUpload(ctx context.Context, objectName, uploadID string, parts []models.UploadPart) error {
+	dir, err := s.uploadDir(uploadID)
+	if err != nil {
+		return err
+	}
+	contentType, err := os.ReadFile(filepath.Join(dir, "content-type"))
+	if err != nil {
+		return err
+	}
+
+	sorted := slices.Clone(parts)
+	slices.SortFunc(sorted, func(a, b models.UploadPart) int { return a.Number - b.Number })
+	readers := make([]io.Reader, 0, len(sorted))
+	var size int64
+	for _, part := range sorted {
+		f, err := os.Open(partPath(dir, part.Number))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		readers = append(readers, f)
+		size += info.Size()
+	}
+
+	if err := s.Upload(ctx, objectName, io.MultiReader(readers...), size, string(contentType)); err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// AbortMultipartUpload discards a multipart upload and all of its parts
+func (s *LocalStorage) AbortMultipartUpload(ctx context.Context, objectName, uploadID string) error {
+	dir, err := s.uploadDir(uploadID)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// contextReader stops a copy once its context is done, as the network
+// backends do
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,220 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tessera/tessera/internal/config"
+	"github.com/tessera/tessera/internal/models"
+	"github.com/tessera/tessera/internal/security"
+)
+
+func newTestLocal(t *testing.T) *LocalStorage {
+	t.Helper()
+	store, err := NewLocal(config.StorageConfig{LocalPath: t.TempDir(), LocalURL: "http://tessera"}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestLocalStorage(t *testing.T) {
+	ctx := context.Background()
+	store := newTestLocal(t)
+
+	content := []byte("hello, local storage")
+	if err := store.Upload(ctx, "files/a/b.txt", bytes.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := store.Download(ctx, "files/a/b.txt")
+	if got := readAll(t, rc, err); !bytes.Equal(got, content) {
+		t.Errorf("Download() = %q, want %q", got, content)
+	}
+
+	info, err := store.Stat(ctx, "files/a/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(content)) || info.ContentType != "text/plain" || info.ETag == "" {
+		t.Errorf("Stat() = %+v", info)
+	}
+
+	// A range running past the end stops there
+	rc, err = store.DownloadRange(ctx, "files/a/b.txt", 7, 100)
+	if got := readAll(t, rc, err); !bytes.Equal(got, content[7:]) {
+		t.Errorf("DownloadRange() = %q, want %q", got, content[7:])
+	}
+
+	// Overwriting replaces the content and its ETag
+	if err := store.Upload(ctx, "files/a/b.txt", strings.NewReader("new"), -1, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	if info2, _ := store.Stat(ctx, "files/a/b.txt"); info2.Size != 3 || info2.ETag == info.ETag {
+		t.Errorf("Stat() after overwrite = %+v", info2)
+	}
+
+	// A short read leaves the object as it was
+	if err := store.Upload(ctx, "files/a/b.txt", strings.NewReader("short"), 100, ""); err == nil {
+		t.Error("Upload() of a short reader succeeded")
+	}
+	rc, err = store.Download(ctx, "files/a/b.txt")
+	if got := readAll(t, rc, err); string(got) != "new" {
+		t.Errorf("Download() after failed upload = %q, want %q", got, "new")
+	}
+
+	if err := store.Delete(ctx, "files/a/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat(ctx, "files/a/b.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat() after Delete() error = %v, want not exist", err)
+	}
+	if err := store.Delete(ctx, "files/a/b.txt"); err != nil {
+		t.Errorf("Delete() of a missing object error = %v", err)
+	}
+
+	if _, err := store.Stat(ctx, ".."); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Stat(\"..\") error = %v, want not exist", err)
+	}
+}
+
+func TestLocalStorageMultipart(t *testing.T) {
+	ctx := context.Background()
+	store := newTestLocal(t)
+
+	uploadID, err := store.NewMultipartUpload(ctx, "staging", "video/mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parts []models.UploadPart
+	for i, chunk := range []string{"one ", "two ", "three"} {
+		etag, err := store.PutPart(ctx, "staging", uploadID, i+1, strings.NewReader(chunk), int64(len(chunk)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts = append(parts, models.UploadPart{Number: i + 1, ETag: etag, Size: int64(len(chunk))})
+	}
+	if err := store.CompleteMultipartUpload(ctx, "staging", uploadID, parts); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := store.Download(ctx, "staging")
+	if got := readAll(t, rc, err); string(got) != "one two three" {
+		t.Errorf("Download() = %q, want %q", got, "one two three")
+	}
+	if info, _ := store.Stat(ctx, "staging"); info.ContentType != "video/mp4" {
+		t.Errorf("ContentType = %q, want video/mp4", info.ContentType)
+	}
+	if err := store.AbortMultipartUpload(ctx, "staging", uploadID); err != nil {
+		t.Errorf("AbortMultipartUpload() of a completed upload error = %v", err)
+	}
+}
+
+func TestLocalStorageWalk(t *testing.T) {
+	ctx := context.Background()
+	store := newTestLocal(t)
+
+	want := map[string]int64{
+		"files/a/b.txt":      3,
+		".hidden/x y%z":      1,
+		"uploads/u/1.tail.2": 5,
+	}
+	for key, size := range want {
+		if err := store.Upload(ctx, key, bytes.NewReader(make([]byte, size)), size, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := make(map[string]int64)
+	err := store.Walk(ctx, func(info *ObjectInfo) error {
+		got[info.Key] = info.Size
+		if info.LastModified.IsZero() {
+			t.Errorf("%s has no modification time", info.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Errorf("Walk() listed %v, want %v", got, want)
+	}
+	for key, size := range want {
+		if got[key] != size {
+			t.Errorf("Walk() size of %q = %d, want %d", key, got[key], size)
+		}
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	err = store.Walk(ctx, func(*ObjectInfo) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Errorf("Walk() = %v after %d calls, want stop after 1", err, calls)
+	}
+}
+
+func TestLocalStorageSignedURL(t *testing.T) {
+	ctx := context.Background()
+	store := newTestLocal(t)
+
+	signed, err := store.GetPresignedURL(ctx, "thumbs/a b", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Host != "tessera" || u.Path != SignedURLPath {
+		t.Errorf("GetPresignedURL() = %s", signed)
+	}
+	q := u.Query()
+	if err := store.VerifyURL(q.Get("key"), q.Get("expires"), q.Get("signature")); err != nil {
+		t.Errorf("VerifyURL() error = %v", err)
+	}
+	if err := store.VerifyURL("thumbs/other", q.Get("expires"), q.Get("signature")); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("VerifyURL() of another key error = %v, want ErrInvalidSignature", err)
+	}
+
+	expired, _ := store.GetPresignedURL(ctx, "thumbs/a b", -time.Minute)
+	u, _ = url.Parse(expired)
+	q = u.Query()
+	if err := store.VerifyURL(q.Get("key"), q.Get("expires"), q.Get("signature")); !errors.Is(err, ErrURLExpired) {
+		t.Errorf("VerifyURL() of an expired URL error = %v, want ErrURLExpired", err)
+	}
+}
+
+func TestLocalStorageEncrypted(t *testing.T) {
+	ctx := context.Background()
+	keys := &memKeys{owners: map[uuid.UUID]uuid.UUID{}, keys: map[uuid.UUID][]byte{}}
+	store := NewEncrypted(newTestLocal(t), keys, true)
+
+	content := make([]byte, security.StreamChunkSize+100)
+	rand.Read(content)
+	if err := store.Upload(WithOwner(ctx, uuid.New()), "a", bytes.NewReader(content), int64(len(content)), ""); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := store.DownloadRange(ctx, "a", security.StreamChunkSize-10, 20)
+	if got := readAll(t, rc, err); !bytes.Equal(got, content[security.StreamChunkSize-10:security.StreamChunkSize+10]) {
+		t.Error("DownloadRange() returned different content")
+	}
+
+	// Objects shorter than an encryption header are read as plaintext
+	if err := NewEncrypted(store.inner, keys, false).Upload(ctx, "b", strings.NewReader("hi"), 2, ""); err != nil {
+		t.Fatal(err)
+	}
+	rc, err = store.Download(ctx, "b")
+	if got := readAll(t, rc, err); string(got) != "hi" {
+		t.Errorf("Download() = %q, want %q", got, "hi")
+	}
+}
@@ -2,18 +2,30 @@ package storage
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"time"
 
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/tessera/tessera/internal/config"
+	"github.com/tessera/tessera/internal/models"
 )
 
+// MinPartSize is the smallest part S3-compatible stores accept for any part
+// of a multipart upload other than the last one.
+const MinPartSize = 5 * 1024 * 1024
+
+// StreamPartSize is the part size used when uploading a stream of unknown
+// length. Each such upload buffers one part in memory, and may be up to
+// 10,000 parts (about 156 GiB) long.
+const StreamPartSize = 16 * 1024 * 1024
+
 // Storage defines the interface for file storage operations
 type Storage interface {
 	Upload(ctx context.Context, objectName string, reader io.Reader, size int64, contentType string) error
 	Download(ctx context.Context, objectName string) (io.ReadCloser, error)
+	DownloadRange(ctx context.Context, objectName string, offset, length int64) (io.ReadCloser, error)
 	Delete(ctx context.Context, objectName string) error
 	GetPresignedURL(ctx context.Context, objectName string, expiry time.Duration) (string, error)
 	Stat(ctx context.Context, objectName string) (*ObjectInfo, error)
@@ -65,11 +77,17 @@ func NewMinIO(cfg config.StorageConfig) (*MinIOStorage, error) {
 	}, nil
 }
 
-// Upload stores a file in MinIO
+// Upload stores a file in MinIO. A size of -1 streams a reader of unknown
+// length.
 func (s *MinIOStorage) Upload(ctx context.Context, objectName string, reader io.Reader, size int64, contentType string) error {
 	opts := minio.PutObjectOptions{
 		ContentType: contentType,
 	}
+	if size < 0 {
+		// minio-go otherwise sizes parts for a 5 TiB object, buffering over
+		// 500 MiB per upload
+		opts.PartSize = StreamPartSize
+	}
 
 	_, err := s.client.PutObject(ctx, s.bucket, objectName, reader, size, opts)
 	return err
@@ -80,6 +98,15 @@ func (s *MinIOStorage) Download(ctx context.Context, objectName string) (io.Read
 	return s.client.GetObject(ctx, s.bucket, objectName, minio.GetObjectOptions{})
 }
 
+// DownloadRange retrieves length bytes of a file starting at offset
+func (s *MinIOStorage) DownloadRange(ctx context.Context, objectName string, offset, length int64) (io.ReadCloser, error) {
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(offset, offset+length-1); err != nil {
+		return nil, err
+	}
+	return s.client.GetObject(ctx, s.bucket, objectName, opts)
+}
+
 // Delete removes a file from MinIO
 func (s *MinIOStorage) Delete(ctx context.Context, objectName string) error {
 	return s.client.RemoveObject(ctx, s.bucket, objectName, minio.RemoveObjectOptions{})
@@ -110,7 +137,77 @@ func (s *MinIOStorage) Stat(ctx context.Context, objectName string) (*ObjectInfo
 	}, nil
 }
 
-// Client returns the underlying MinIO client for health checks
-func (s *MinIOStorage) Client() *minio.Client {
-	return s.client
+// Name returns BackendMinIO
+func (s *MinIOStorage) Name() string {
+	return BackendMinIO
+}
+
+// Ping checks that the bucket can be reached
+func (s *MinIOStorage) Ping(ctx context.Context) error {
+	exists, err := s.client.BucketExists(ctx, s.bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("bucket %q does not exist", s.bucket)
+	}
+	return nil
+}
+
+// Walk calls fn for every object in the bucket, in key order
+func (s *MinIOStorage) Walk(ctx context.Context, fn func(*ObjectInfo) error) error {
+	listCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for object := range s.client.ListObjects(listCtx, s.bucket, minio.ListObjectsOptions{Recursive: true}) {
+		if object.Err != nil {
+			return object.Err
+		}
+		if err := fn(&ObjectInfo{
+			Key:          object.Key,
+			Size:         object.Size,
+			LastModified: object.LastModified,
+			ETag:         object.ETag,
+		}); err != nil {
+			return err
+		}
+	}
+	// The listing ends early, without an error, when ctx is done
+	return ctx.Err()
+}
+
+// NewMultipartUpload starts a multipart upload and returns its upload ID
+func (s *MinIOStorage) NewMultipartUpload(ctx context.Context, objectName, contentType string) (string, error) {
+	core := minio.Core{Client: s.client}
+	return core.NewMultipartUpload(ctx, s.bucket, objectName, minio.PutObjectOptions{
+		ContentType: contentType,
+	})
+}
+
+// PutPart uploads a single part of a multipart upload and returns its ETag.
+// Every part except the last must be at least MinPartSize bytes.
+func (s *MinIOStorage) PutPart(ctx context.Context, objectName, uploadID string, partNumber int, reader io.Reader, size int64) (string, error) {
+	core := minio.Core{Client: s.client}
+	part, err := core.PutObjectPart(ctx, s.bucket, objectName, uploadID, partNumber, reader, size, minio.PutObjectPartOptions{})
+	if err != nil {
+		return "", err
+	}
+	return part.ETag, nil
+}
+
+// CompleteMultipartUpload assembles the given parts into the final object.
+// Parts that were uploaded but not listed are discarded.
+func (s *MinIOStorage) CompleteMultipartUpload(ctx context.Context, objectName, uploadID string, parts []models.UploadPart) error {
+	core := minio.Core{Client: s.client}
+	completed := make([]minio.CompletePart, len(parts))
+	for i, p := range parts {
+		completed[i] = minio.CompletePart{PartNumber: p.Number, ETag: p.ETag}
+	}
+	_, err := core.CompleteMultipartUpload(ctx, s.bucket, objectName, uploadID, completed, minio.PutObjectOptions{})
+	return err
+}
+
+// AbortMultipartUpload discards a multipart upload and all of its parts
+func (s *MinIOStorage) AbortMultipartUpload(ctx context.Context, objectName, uploadID string) error {
+	core := minio.Core{Client: s.client}
+	return core.AbortMultipartUpload(ctx, s.bucket, objectName, uploadID)
 }
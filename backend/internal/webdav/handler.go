@@ -2,9 +2,12 @@ package webdav
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path"
+	"slices"
 	"strings"
 	"time"
 
@@ -12,27 +15,91 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/tessera/tessera/internal/models"
 	"github.com/tessera/tessera/internal/repository"
+	"github.com/tessera/tessera/internal/services"
 	"github.com/tessera/tessera/internal/storage"
 )
 
+// SharedFolderName is the virtual collection at the top of every user's
+// tree holding the files and folders others shared with them. The name is
+// reserved there: a top-level file or folder of the user's own with the
+// same name, made elsewhere, is listed as OwnSharedFolderName, and nothing
+// can be created or moved there under it.
+const SharedFolderName = "Shared with me"
+
+// OwnSharedFolderName is what the user's own top-level file or folder named
+// SharedFolderName is listed as. If they also have one with this name, that
+// one is listed and theirs named SharedFolderName isn't.
+var OwnSharedFolderName = withSuffix(SharedFolderName, "own", true)
+
+var (
+	// errReadOnly is returned for writes the user isn't allowed: to a share
+	// they may only view, to the shared collection itself, or removing a
+	// shared file or folder from it
+	errReadOnly = errors.New("read-only")
+	// errCrossOwner is returned for moves between the user's own files and
+	// someone else's, which would change who owns the files
+	errCrossOwner = errors.New("cannot move between owners")
+)
+
+// fileStore is the file metadata the WebDAV file system reads and changes
+type fileStore interface {
+	GetByID(ctx context.Context, id uuid.UUID) (*models.File, error)
+	GetByName(ctx context.Context, ownerID uuid.UUID, parentID *uuid.UUID, name string) (*models.File, error)
+	ListByParent(ctx context.Context, ownerID uuid.UUID, parentID *uuid.UUID, includeTrash bool) ([]*models.File, error)
+	GetSharedWithUser(ctx context.Context, userID uuid.UUID) ([]*models.SharedFile, error)
+	Create(ctx context.Context, file *models.File) error
+	Update(ctx context.Context, file *models.File) error
+	MoveToTrash(ctx context.Context, id uuid.UUID) error
+	ListProperties(ctx context.Context, fileIDs []uuid.UUID) (map[uuid.UUID][]*models.FileProperty, error)
+	PatchProperties(ctx context.Context, fileID uuid.UUID, set, remove []*models.FileProperty, modified *time.Time) error
+	CopyProperties(ctx context.Context, sourceID, targetID uuid.UUID) error
+}
+
 // FileSystem implements a WebDAV file system backed by Tessera
 type FileSystem struct {
-	fileRepo *repository.FileRepository
-	storage  *storage.MinIOStorage
+	fileRepo fileStore
+	storage  storage.Storage
+	changes  *services.ChangeService
 	log      zerolog.Logger
 }
 
-// NewFileSystem creates a new WebDAV file system
-func NewFileSystem(fileRepo *repository.FileRepository, storage *storage.MinIOStorage, log zerolog.Logger) *FileSystem {
+// NewFileSystem creates a new WebDAV file system. Folders it makes, trashes
+// or moves are recorded in the change journal.
+func NewFileSystem(fileRepo *repository.FileRepository, storage storage.Storage, changes *services.ChangeService, log zerolog.Logger) *FileSystem {
 	return &FileSystem{
 		fileRepo: fileRepo,
 		storage:  storage,
+		changes:  changes,
 		log:      log,
 	}
 }
 
+// resource is a path in a user's WebDAV tree, resolved. The user's own
+// files are at the top, and files others shared with them are under
+// SharedFolderName.
+type resource struct {
+	file       *models.File // nil for the root and the shared collection
+	owner      uuid.UUID    // owns the files here, and files created here
+	shares     bool         // the shared collection itself
+	shareRoot  bool         // a shared file or folder itself
+	permission string       // the share's permission, or admin for own files
+}
+
+// canWrite reports whether the user may change the resource or add to it
+func (r *resource) canWrite() bool {
+	return !r.shares && (r.permission == services.PermissionEdit || r.permission == services.PermissionAdmin)
+}
+
+// canRemove reports whether the user may delete, move or rename the
+// resource. Shared files and folders stay where their owner put them.
+func (r *resource) canRemove() bool {
+	return r.canWrite() && r.file != nil && !r.shareRoot
+}
+
 // FileInfo represents file information for WebDAV
 type FileInfo struct {
+	id      uuid.UUID // uuid.Nil for the root and the shared collection
+	owner   uuid.UUID // uuid.Nil for the shared collection
 	name    string
 	size    int64
 	mode    os.FileMode
@@ -51,6 +118,8 @@ func (fi *FileInfo) Sys() interface{}   { return nil }
 type File struct {
 	fs       *FileSystem
 	userID   string
+	ownerID  uuid.UUID // owner of the folder's files
+	shares   bool      // the shared collection, listing shares
 	fileID   string
 	name     string
 	isDir    bool
@@ -87,28 +156,58 @@ func (f *File) Readdir(count int) ([]os.FileInfo, error) {
 	if f.children == nil {
 		ctx := context.Background()
 		userUUID, _ := uuid.Parse(f.userID)
-		var parentUUID *uuid.UUID
-		if f.fileID != "" {
-			id, _ := uuid.Parse(f.fileID)
-			parentUUID = &id
-		}
-		files, err := f.fs.fileRepo.ListByParent(ctx, userUUID, parentUUID, false)
-		if err != nil {
-			return nil, err
-		}
+		if f.shares {
+			entries, err := f.fs.sharedEntries(ctx, userUUID)
+			if err != nil {
+				return nil, err
+			}
+			f.children = make([]os.FileInfo, len(entries))
+			for i, entry := range entries {
+				f.children[i] = &FileInfo{
+					id:      entry.share.ID,
+					owner:   entry.share.OwnerID,
+					name:    entry.name,
+					size:    entry.share.Size,
+					mode:    fileMode(entry.share.IsFolder),
+					modTime: entry.share.UpdatedAt,
+					isDir:   entry.share.IsFolder,
+				}
+			}
+		} else {
+			var parentUUID *uuid.UUID
+			if f.fileID != "" {
+				id, _ := uuid.Parse(f.fileID)
+				parentUUID = &id
+			}
+			files, err := f.fs.fileRepo.ListByParent(ctx, f.ownerID, parentUUID, false)
+			if err != nil {
+				return nil, err
+			}
 
-		f.children = make([]os.FileInfo, len(files))
-		for i, file := range files {
-			mode := os.FileMode(0644)
-			if file.IsFolder {
-				mode = os.FileMode(0755) | os.ModeDir
+			f.children = make([]os.FileInfo, 0, len(files)+1)
+			hasAlias := parentUUID == nil && slices.ContainsFunc(files, func(file *models.File) bool {
+				return file.Name == OwnSharedFolderName
+			})
+			for _, file := range files {
+				name := file.Name
+				if parentUUID == nil && name == SharedFolderName {
+					if hasAlias {
+						continue
+					}
+					name = OwnSharedFolderName
+				}
+				f.children = append(f.children, &FileInfo{
+					id:      file.ID,
+					owner:   file.OwnerID,
+					name:    name,
+					size:    file.Size,
+					mode:    fileMode(file.IsFolder),
+					modTime: file.UpdatedAt,
+					isDir:   file.IsFolder,
+				})
 			}
-			f.children[i] = &FileInfo{
-				name:    file.Name,
-				size:    file.Size,
-				mode:    mode,
-				modTime: file.UpdatedAt,
-				isDir:   file.IsFolder,
+			if parentUUID == nil && f.ownerID == userUUID {
+				f.children = append(f.children, sharedFolderInfo())
 			}
 		}
 	}
@@ -133,19 +232,38 @@ func (f *File) Readdir(count int) ([]os.FileInfo, error) {
 }
 
 func (f *File) Stat() (os.FileInfo, error) {
-	mode := os.FileMode(0644)
-	if f.isDir {
-		mode = os.FileMode(0755) | os.ModeDir
+	if f.shares {
+		return sharedFolderInfo(), nil
 	}
+	id, _ := uuid.Parse(f.fileID)
 	return &FileInfo{
+		id:      id,
+		owner:   f.ownerID,
 		name:    f.name,
 		size:    f.size,
-		mode:    mode,
+		mode:    fileMode(f.isDir),
 		modTime: f.modTime,
 		isDir:   f.isDir,
 	}, nil
 }
 
+func fileMode(isDir bool) os.FileMode {
+	if isDir {
+		return os.FileMode(0755) | os.ModeDir
+	}
+	return os.FileMode(0644)
+}
+
+// sharedFolderInfo describes the shared collection
+func sharedFolderInfo() *FileInfo {
+	return &FileInfo{
+		name:    SharedFolderName,
+		mode:    fileMode(true),
+		modTime: time.Now(),
+		isDir:   true,
+	}
+}
+
 func (f *File) Write(p []byte) (n int, err error) {
 	return 0, os.ErrPermission
 }
@@ -154,34 +272,40 @@ func (f *File) Write(p []byte) (n int, err error) {
 func (fs *FileSystem) OpenFile(ctx context.Context, userID string, name string, flag int, perm os.FileMode) (*File, error) {
 	fs.log.Debug().Str("path", name).Str("user", userID).Msg("WebDAV OpenFile")
 
-	if name == "/" || name == "" {
+	name = path.Clean("/" + name)
+	res, err := fs.resolve(ctx, userID, name)
+	if err != nil {
+		return nil, err
+	}
+	if res.file == nil {
 		return &File{
 			fs:      fs,
 			userID:  userID,
+			ownerID: res.owner,
+			shares:  res.shares,
 			fileID:  "",
-			name:    "/",
+			name:    path.Base(name),
 			isDir:   true,
 			modTime: time.Now(),
 		}, nil
 	}
 
-	name = path.Clean("/" + name)
-	file, err := fs.resolveFile(ctx, userID, name)
-	if err != nil {
-		return nil, err
-	}
-
+	file := res.file
 	f := &File{
 		fs:      fs,
 		userID:  userID,
+		ownerID: file.OwnerID,
 		fileID:  file.ID.String(),
-		name:    file.Name,
+		name:    path.Base(name),
 		isDir:   file.IsFolder,
 		size:    file.Size,
 		modTime: file.UpdatedAt,
 	}
 
 	if !file.IsFolder && (flag&os.O_RDONLY != 0 || flag == 0) {
+		if file.Infected() {
+			return nil, os.ErrPermission
+		}
 		reader, err := fs.storage.Download(ctx, file.StorageKey)
 		if err != nil {
 			return nil, err
@@ -196,30 +320,31 @@ func (fs *FileSystem) OpenFile(ctx context.Context, userID string, name string,
 func (fs *FileSystem) Stat(ctx context.Context, userID string, name string) (os.FileInfo, error) {
 	fs.log.Debug().Str("path", name).Str("user", userID).Msg("WebDAV Stat")
 
-	if name == "/" || name == "" {
+	name = path.Clean("/" + name)
+	res, err := fs.resolve(ctx, userID, name)
+	if err != nil {
+		return nil, err
+	}
+	if res.shares {
+		return sharedFolderInfo(), nil
+	}
+	if res.file == nil {
 		return &FileInfo{
+			owner:   res.owner,
 			name:    "/",
-			mode:    os.FileMode(0755) | os.ModeDir,
+			mode:    fileMode(true),
 			modTime: time.Now(),
 			isDir:   true,
 		}, nil
 	}
 
-	name = path.Clean("/" + name)
-	file, err := fs.resolveFile(ctx, userID, name)
-	if err != nil {
-		return nil, err
-	}
-
-	mode := os.FileMode(0644)
-	if file.IsFolder {
-		mode = os.FileMode(0755) | os.ModeDir
-	}
-
+	file := res.file
 	return &FileInfo{
-		name:    file.Name,
+		id:      file.ID,
+		owner:   file.OwnerID,
+		name:    path.Base(name),
 		size:    file.Size,
-		mode:    mode,
+		mode:    fileMode(file.IsFolder),
 		modTime: file.UpdatedAt,
 		isDir:   file.IsFolder,
 	}, nil
@@ -232,24 +357,34 @@ func (fs *FileSystem) Mkdir(ctx context.Context, userID string, name string, per
 	name = path.Clean("/" + name)
 	dir := path.Dir(name)
 	baseName := path.Base(name)
+	if reservedName(dir, baseName) {
+		return errReadOnly
+	}
 
-	userUUID, _ := uuid.Parse(userID)
+	parent, err := fs.resolve(ctx, userID, dir)
+	if err != nil {
+		return err
+	}
+	if !parent.canWrite() {
+		return errReadOnly
+	}
 	var parentUUID *uuid.UUID
-	if dir != "/" && dir != "" {
-		parent, err := fs.resolveFile(ctx, userID, dir)
-		if err != nil {
-			return err
-		}
-		parentUUID = &parent.ID
+	if parent.file != nil {
+		parentUUID = &parent.file.ID
 	}
 
+	// A folder made in a share belongs to the share's owner
 	folder := &models.File{
-		OwnerID:  userUUID,
+		OwnerID:  parent.owner,
 		ParentID: parentUUID,
 		Name:     baseName,
 		IsFolder: true,
 	}
-	return fs.fileRepo.Create(ctx, folder)
+	if err := fs.fileRepo.Create(ctx, folder); err != nil {
+		return err
+	}
+	fs.changes.Record(ctx, services.ChangeCreate, folder)
+	return nil
 }
 
 // RemoveAll removes a file or directory
@@ -257,12 +392,19 @@ func (fs *FileSystem) RemoveAll(ctx context.Context, userID string, name string)
 	fs.log.Debug().Str("path", name).Str("user", userID).Msg("WebDAV RemoveAll")
 
 	name = path.Clean("/" + name)
-	file, err := fs.resolveFile(ctx, userID, name)
+	res, err := fs.resolve(ctx, userID, name)
 	if err != nil {
 		return err
 	}
+	if !res.canRemove() {
+		return errReadOnly
+	}
 
-	return fs.fileRepo.MoveToTrash(ctx, file.ID)
+	if err := fs.fileRepo.MoveToTrash(ctx, res.file.ID); err != nil {
+		return err
+	}
+	fs.changes.Record(ctx, services.ChangeTrash, res.file)
+	return nil
 }
 
 // Rename moves/renames a file
@@ -272,66 +414,190 @@ func (fs *FileSystem) Rename(ctx context.Context, userID string, oldName, newNam
 	oldName = path.Clean("/" + oldName)
 	newName = path.Clean("/" + newName)
 
-	file, err := fs.resolveFile(ctx, userID, oldName)
+	res, err := fs.resolve(ctx, userID, oldName)
 	if err != nil {
 		return err
 	}
+	if !res.canRemove() {
+		return errReadOnly
+	}
+	file := res.file
 
 	oldDir := path.Dir(oldName)
 	newDir := path.Dir(newName)
 	newBaseName := path.Base(newName)
+	if reservedName(newDir, newBaseName) {
+		return errReadOnly
+	}
 
 	if oldDir == newDir {
 		file.Name = newBaseName
-		return fs.fileRepo.Update(ctx, file)
+		if err := fs.fileRepo.Update(ctx, file); err != nil {
+			return err
+		}
+		fs.changes.Record(ctx, services.ChangeRename, file)
+		return nil
 	}
 
+	parent, err := fs.resolve(ctx, userID, newDir)
+	if err != nil {
+		return err
+	}
+	if !parent.canWrite() {
+		return errReadOnly
+	}
+	if parent.owner != file.OwnerID {
+		return errCrossOwner
+	}
 	var newParentUUID *uuid.UUID
-	if newDir != "/" && newDir != "" {
-		parent, err := fs.resolveFile(ctx, userID, newDir)
-		if err != nil {
-			return err
-		}
-		newParentUUID = &parent.ID
+	if parent.file != nil {
+		newParentUUID = &parent.file.ID
 	}
 
 	file.Name = newBaseName
 	file.ParentID = newParentUUID
-	return fs.fileRepo.Update(ctx, file)
-}
-
-// resolveFile resolves a path to a file
-func (fs *FileSystem) resolveFile(ctx context.Context, userID string, filePath string) (*models.File, error) {
-	parts := strings.Split(strings.Trim(filePath, "/"), "/")
-	if len(parts) == 0 || (len(parts) == 1 && parts[0] == "") {
-		return nil, os.ErrNotExist
+	if err := fs.fileRepo.Update(ctx, file); err != nil {
+		return err
 	}
+	fs.changes.Record(ctx, services.ChangeMove, file)
+	return nil
+}
 
+// resolve resolves a path in a user's tree. Paths under SharedFolderName
+// walk the tree of the share's owner, starting at the shared file or
+// folder.
+func (fs *FileSystem) resolve(ctx context.Context, userID string, filePath string) (*resource, error) {
 	userUUID, err := uuid.Parse(userID)
 	if err != nil {
 		return nil, os.ErrNotExist
 	}
 
+	var parts []string
+	for _, part := range strings.Split(filePath, "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	res := &resource{owner: userUUID, permission: services.PermissionAdmin}
 	var currentParentID *uuid.UUID
-	var currentFile *models.File
+	if len(parts) > 0 && parts[0] == SharedFolderName {
+		if len(parts) == 1 {
+			return &resource{shares: true, permission: services.PermissionView}, nil
+		}
 
-	for _, part := range parts {
-		if part == "" {
-			continue
+		entries, err := fs.sharedEntries(ctx, userUUID)
+		if err != nil {
+			return nil, err
+		}
+		i := slices.IndexFunc(entries, func(e sharedEntry) bool { return e.name == parts[1] })
+		if i < 0 {
+			return nil, os.ErrNotExist
+		}
+		file, err := fs.fileRepo.GetByID(ctx, entries[i].share.ID)
+		if err != nil {
+			return nil, os.ErrNotExist
 		}
 
-		file, err := fs.fileRepo.GetByName(ctx, userUUID, currentParentID, part)
+		res = &resource{
+			file:       file,
+			owner:      file.OwnerID,
+			shareRoot:  len(parts) == 2,
+			permission: entries[i].share.Permission,
+		}
+		currentParentID = &file.ID
+		parts = parts[2:]
+	}
+
+	for i, part := range parts {
+		if res.file != nil && !res.file.IsFolder {
+			return nil, os.ErrNotExist
+		}
+		file, err := fs.fileRepo.GetByName(ctx, res.owner, currentParentID, part)
+		if err != nil && i == 0 && currentParentID == nil && part == OwnSharedFolderName {
+			file, err = fs.fileRepo.GetByName(ctx, res.owner, nil, SharedFolderName)
+		}
 		if err != nil {
 			return nil, os.ErrNotExist
 		}
 
-		currentFile = file
+		res.file = file
 		currentParentID = &file.ID
 	}
 
-	if currentFile == nil {
+	return res, nil
+}
+
+// reservedName reports whether a name in a folder is taken by the shared
+// collection
+func reservedName(dir, name string) bool {
+	return path.Clean("/"+dir) == "/" && name == SharedFolderName
+}
+
+// resolveFile resolves a path to a file
+func (fs *FileSystem) resolveFile(ctx context.Context, userID string, filePath string) (*models.File, error) {
+	res, err := fs.resolve(ctx, userID, filePath)
+	if err != nil {
+		return nil, err
+	}
+	if res.file == nil {
 		return nil, os.ErrNotExist
 	}
+	return res.file, nil
+}
 
-	return currentFile, nil
+// sharedEntry is a file or folder in the shared collection
+type sharedEntry struct {
+	name  string
+	share *models.SharedFile
+}
+
+// sharedEntries lists the files and folders shared with a user that
+// haven't expired. Each is named after the shared file; if names clash,
+// the later shares get their owner's name added.
+func (fs *FileSystem) sharedEntries(ctx context.Context, userID uuid.UUID) ([]sharedEntry, error) {
+	shared, err := fs.fileRepo.GetSharedWithUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return sharedEntryNames(shared, time.Now()), nil
+}
+
+// sharedEntryNames names the unexpired shares in the shared collection.
+// Names only depend on which shares are older, so they stay put as shares
+// come and go.
+func sharedEntryNames(shared []*models.SharedFile, now time.Time) []sharedEntry {
+	shared = slices.Clone(shared)
+	slices.SortStableFunc(shared, func(a, b *models.SharedFile) int {
+		return a.SharedAt.Compare(b.SharedAt)
+	})
+
+	taken := map[string]bool{}
+	entries := make([]sharedEntry, 0, len(shared))
+	for _, sf := range shared {
+		if sf.ExpiresAt != nil && sf.ExpiresAt.Before(now) {
+			continue
+		}
+		name := sf.Name
+		for n := 1; taken[name]; n++ {
+			suffix := sf.OwnerName
+			if n > 1 {
+				suffix = fmt.Sprintf("%s %d", sf.OwnerName, n)
+			}
+			name = withSuffix(sf.Name, suffix, sf.IsFolder)
+		}
+		taken[name] = true
+		entries = append(entries, sharedEntry{name: name, share: sf})
+	}
+	return entries
+}
+
+// withSuffix adds a parenthesized suffix to a name, before a file's
+// extension so it still opens with the right application
+func withSuffix(name, suffix string, isFolder bool) string {
+	ext := ""
+	if !isFolder {
+		ext = path.Ext(name)
+	}
+	return fmt.Sprintf("%s (%s)%s", strings.TrimSuffix(name, ext), suffix, ext)
 }
@@ -0,0 +1,60 @@
+package webdav
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tessera/tessera/internal/models"
+	"github.com/tessera/tessera/internal/services"
+)
+
+func TestSharedEntryNames(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Hour)
+	shared := []*models.SharedFile{
+		{Name: "report.pdf", OwnerName: "Bo", SharedAt: now.Add(-time.Minute)},
+		{Name: "report.pdf", OwnerName: "Al", SharedAt: now.Add(-2 * time.Minute)},
+		{Name: "report.pdf", OwnerName: "Bo", SharedAt: now},
+		{Name: "Photos", OwnerName: "Al", IsFolder: true, SharedAt: now},
+		{Name: "Photos", OwnerName: "Bo", IsFolder: true, SharedAt: now.Add(time.Minute)},
+		{Name: "old.txt", OwnerName: "Al", SharedAt: past, ExpiresAt: &past},
+	}
+
+	var names []string
+	for _, e := range sharedEntryNames(shared, now) {
+		names = append(names, e.name)
+	}
+	want := []string{"report.pdf", "report (Bo).pdf", "report (Bo 2).pdf", "Photos", "Photos (Bo)"}
+	if len(names) != len(want) {
+		t.Fatalf("names = %q, want %q", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("names[%d] = %q, want %q", i, names[i], want[i])
+		}
+	}
+}
+
+func TestResourcePermissions(t *testing.T) {
+	file := &models.File{}
+	tests := []struct {
+		name             string
+		res              resource
+		write, canRemove bool
+	}{
+		{"own file", resource{file: file, permission: services.PermissionAdmin}, true, true},
+		{"own root", resource{permission: services.PermissionAdmin}, true, false},
+		{"shared collection", resource{shares: true, permission: services.PermissionView}, false, false},
+		{"view share", resource{file: file, permission: services.PermissionView}, false, false},
+		{"edit share root", resource{file: file, shareRoot: true, permission: services.PermissionEdit}, true, false},
+		{"inside edit share", resource{file: file, permission: services.PermissionEdit}, true, true},
+	}
+	for _, tt := range tests {
+		if got := tt.res.canWrite(); got != tt.write {
+			t.Errorf("%s: canWrite = %v, want %v", tt.name, got, tt.write)
+		}
+		if got := tt.res.canRemove(); got != tt.canRemove {
+			t.Errorf("%s: canRemove = %v, want %v", tt.name, got, tt.canRemove)
+		}
+	}
+}
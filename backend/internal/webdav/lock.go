@@ -0,0 +1,536 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/tessera/tessera/internal/models"
+	"github.com/tessera/tessera/internal/repository"
+	"github.com/tessera/tessera/internal/services"
+)
+
+// lockTokensLocal is the fiber.Locals key of the lock tokens a request
+// submitted in its If header
+const lockTokensLocal = "webdav_lock_tokens"
+
+// errMalformedIf is returned for an If header that doesn't parse
+var errMalformedIf = errors.New("malformed If header")
+
+// ifCondition is one condition of an If header list: a state (lock) token
+// or an entity tag, possibly negated with Not
+type ifCondition struct {
+	not   bool
+	token string
+	etag  string
+}
+
+// ifList is a parenthesized list of conditions, which holds when all of
+// them do. Resource is the tag the list applies to, or empty for the
+// request URL.
+type ifList struct {
+	resource   string
+	conditions []ifCondition
+}
+
+// parseIf parses an If header (RFC 4918 section 10.4)
+func parseIf(header string) ([]ifList, error) {
+	var lists []ifList
+	resource := ""
+	s := strings.TrimSpace(header)
+	for s != "" {
+		switch s[0] {
+		case '<':
+			end := strings.IndexByte(s, '>')
+			if end < 0 {
+				return nil, errMalformedIf
+			}
+			resource = s[1:end]
+			s = s[end+1:]
+		case '(':
+			list, rest, err := parseIfList(s[1:])
+			if err != nil {
+				return nil, err
+			}
+			list.resource = resource
+			lists = append(lists, list)
+			s = rest
+		default:
+			return nil, errMalformedIf
+		}
+		s = strings.TrimSpace(s)
+	}
+	if len(lists) == 0 {
+		return nil, errMalformedIf
+	}
+	return lists, nil
+}
+
+// parseIfList parses the conditions of a list up to its closing parenthesis
+func parseIfList(s string) (ifList, string, error) {
+	var list ifList
+	for {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return list, "", errMalformedIf
+		}
+		if s[0] == ')' {
+			if len(list.conditions) == 0 {
+				return list, "", errMalformedIf
+			}
+			return list, s[1:], nil
+		}
+
+		var cond ifCondition
+		if rest, ok := strings.CutPrefix(s, "Not"); ok {
+			cond.not = true
+			s = strings.TrimSpace(rest)
+		}
+		var closing byte
+		switch {
+		case strings.HasPrefix(s, "<"):
+			closing = '>'
+		case strings.HasPrefix(s, "["):
+			closing = ']'
+		default:
+			return list, "", errMalformedIf
+		}
+		end := strings.IndexByte(s, closing)
+		if end < 0 {
+			return list, "", errMalformedIf
+		}
+		if closing == '>' {
+			cond.token = s[1:end]
+		} else {
+			cond.etag = s[1:end]
+		}
+		list.conditions = append(list.conditions, cond)
+		s = s[end+1:]
+	}
+}
+
+// resourceState is what If header conditions are evaluated against: the
+// tokens of the locks covering a resource and its entity tag
+type resourceState struct {
+	tokens []string
+	etag   string
+}
+
+// evaluateIf reports whether any list of an If header holds, looking up
+// the state of the resources it names with state
+func evaluateIf(lists []ifList, state func(resource string) (resourceState, error)) (bool, error) {
+	for _, list := range lists {
+		st, err := state(list.resource)
+		if err != nil {
+			return false, err
+		}
+		holds := true
+		for _, cond := range list.conditions {
+			var match bool
+			if cond.token != "" {
+				match = slices.Contains(st.tokens, cond.token)
+			} else {
+				match = st.etag != "" && cond.etag == st.etag
+			}
+			if match == cond.not {
+				holds = false
+				break
+			}
+		}
+		if holds {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// submittedTokens returns the lock tokens named in an If header. A client
+// holding a lock submits its token this way, whether or not it's negated.
+func submittedTokens(lists []ifList) []string {
+	var tokens []string
+	for _, list := range lists {
+		for _, cond := range list.conditions {
+			if cond.token != "" {
+				tokens = append(tokens, cond.token)
+			}
+		}
+	}
+	return tokens
+}
+
+// checkIf evaluates the request's If header, if any, and keeps the lock
+// tokens it submits for the write that follows. It returns false when a
+// response has been sent.
+func (s *Server) checkIf(c *fiber.Ctx, userID, urlPath string) (bool, error) {
+	header := c.Get("If")
+	if header == "" {
+		return true, nil
+	}
+	lists, err := parseIf(header)
+	if err != nil {
+		return false, c.Status(400).SendString("Malformed If header")
+	}
+
+	states := map[string]resourceState{}
+	holds, err := evaluateIf(lists, func(resource string) (resourceState, error) {
+		p := urlPath
+		if resource != "" {
+			var err error
+			if p, err = s.hrefPath(c, resource); err != nil {
+				// Can't name anything in the tree, so it's unmapped
+				return resourceState{}, nil
+			}
+		}
+		p = path.Clean("/" + p)
+		if st, ok := states[p]; ok {
+			return st, nil
+		}
+
+		var st resourceState
+		file, err := s.fs.resolveFile(c.Context(), userID, p)
+		if err == nil {
+			locks, err := s.locks.Locks(c.Context(), file)
+			if err != nil {
+				return st, err
+			}
+			for _, lock := range locks {
+				st.tokens = append(st.tokens, lock.Token)
+			}
+			if file.Hash != "" {
+				st.etag = `"` + file.Hash + `"`
+			}
+		}
+		states[p] = st
+		return st, nil
+	})
+	if err != nil {
+		return false, c.Status(500).SendString(err.Error())
+	}
+	if !holds {
+		return false, c.Status(412).SendString("Precondition Failed")
+	}
+
+	c.Locals(lockTokensLocal, submittedTokens(lists))
+	return true, nil
+}
+
+// lockContext returns the request context carrying the lock tokens the
+// user submitted, for writes checked against locks
+func (s *Server) lockContext(c *fiber.Ctx, userID string) context.Context {
+	tokens, _ := c.Locals(lockTokensLocal).([]string)
+	userUUID, _ := uuid.Parse(userID)
+	return services.WithLockTokens(c.Context(), userUUID, tokens)
+}
+
+// locked answers a write refused because of a lock. Other lock check
+// failures are server errors.
+func locked(c *fiber.Ctx, err error) error {
+	if errors.Is(err, services.ErrLocked) || errors.Is(err, repository.ErrLockBusy) {
+		return c.Status(423).SendString("Locked")
+	}
+	return c.Status(500).SendString(err.Error())
+}
+
+// lockInfo is the body of a LOCK request creating a lock
+type lockInfo struct {
+	XMLName   xml.Name   `xml:"lockinfo"`
+	Exclusive *struct{}  `xml:"lockscope>exclusive"`
+	Shared    *struct{}  `xml:"lockscope>shared"`
+	Write     *struct{}  `xml:"locktype>write"`
+	Owner     *lockOwner `xml:"owner"`
+}
+
+type lockOwner struct {
+	Href string `xml:"href"`
+	Text string `xml:",chardata"`
+}
+
+// ownerXML renders the owner a client gave as DAV: XML to echo back. Only
+// an href or text is kept, which is what clients put there to show who
+// holds a lock.
+func (o *lockOwner) ownerXML() string {
+	if o == nil {
+		return ""
+	}
+	var buf bytes.Buffer
+	if href := strings.TrimSpace(o.Href); href != "" {
+		buf.WriteString("<D:href>")
+		_ = xml.EscapeText(&buf, []byte(href))
+		buf.WriteString("</D:href>")
+	} else {
+		_ = xml.EscapeText(&buf, []byte(strings.TrimSpace(o.Text)))
+	}
+	return buf.String()
+}
+
+// parseTimeout parses a Timeout header, taking the first value it
+// understands; zero means the default
+func parseTimeout(header string) time.Duration {
+	for _, value := range strings.Split(header, ",") {
+		value = strings.TrimSpace(value)
+		if value == "Infinite" {
+			return services.MaxLockTimeout
+		}
+		if n, ok := strings.CutPrefix(value, "Second-"); ok {
+			if seconds, err := strconv.ParseInt(n, 10, 64); err == nil && seconds > 0 {
+				return time.Duration(min(seconds, int64(services.MaxLockTimeout/time.Second))) * time.Second
+			}
+		}
+	}
+	return 0
+}
+
+func (s *Server) handleLock(c *fiber.Ctx, userID, urlPath string) error {
+	urlPath = path.Clean("/" + urlPath)
+	if urlPath == "/" {
+		return c.Status(403).SendString("The root can't be locked")
+	}
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return c.Status(401).SendString("Unauthorized")
+	}
+	timeout := parseTimeout(c.Get("Timeout"))
+
+	body := bytes.TrimSpace(c.Body())
+	if len(body) == 0 {
+		return s.refreshLock(c, userUUID, urlPath, timeout)
+	}
+
+	var info lockInfo
+	if err := xml.Unmarshal(body, &info); err != nil || info.Write == nil || (info.Exclusive == nil) == (info.Shared == nil) {
+		return c.Status(400).SendString("Invalid lockinfo")
+	}
+	scope := models.LockExclusive
+	if info.Shared != nil {
+		scope = models.LockShared
+	}
+
+	infinite := true
+	switch c.Get("Depth", "infinity") {
+	case "0":
+		infinite = false
+	case "infinity":
+	default:
+		return c.Status(400).SendString("Depth must be 0 or infinity")
+	}
+
+	// A lock reserves a resource for writing, so it needs write access
+	ctx := s.lockContext(c, userID)
+	status := 200
+	var file *models.File
+	res, err := s.fs.resolve(ctx, userID, urlPath)
+	if err == nil {
+		if res.file == nil || !res.canWrite() {
+			return forbidden(c)
+		}
+		file = res.file
+	} else {
+		// Locking an unmapped URL creates an empty file, which clients do
+		// to reserve a name before writing it
+		parent, err := s.fs.resolve(ctx, userID, path.Dir(urlPath))
+		if err != nil || (parent.file != nil && !parent.file.IsFolder) {
+			return c.Status(409).SendString("Parent directory not found")
+		}
+		if !parent.canWrite() {
+			return forbidden(c)
+		}
+		var parentID string
+		if parent.file != nil {
+			parentID = parent.file.ID.String()
+		}
+		file, err = s.fileService.Upload(ctx, parent.owner.String(), parentID, path.Base(urlPath), bytes.NewReader(nil), 0, "application/octet-stream")
+		if err != nil {
+			if errors.Is(err, services.ErrLocked) {
+				return locked(c, err)
+			}
+			return c.Status(500).SendString(err.Error())
+		}
+		status = 201
+	}
+
+	lock, err := s.locks.Lock(ctx, services.LockInput{
+		File:     file,
+		UserID:   userUUID,
+		Scope:    scope,
+		Infinite: infinite,
+		Owner:    info.Owner.ownerXML(),
+		Root:     pathHref(urlPath),
+		Timeout:  timeout,
+	})
+	if err != nil {
+		return locked(c, err)
+	}
+
+	c.Set("Lock-Token", "<"+lock.Token+">")
+	return sendLockDiscovery(c, status, lock)
+}
+
+// refreshLock handles a LOCK without a body, which extends the lock named
+// in the If header
+func (s *Server) refreshLock(c *fiber.Ctx, userID uuid.UUID, urlPath string, timeout time.Duration) error {
+	tokens, _ := c.Locals(lockTokensLocal).([]string)
+	if len(tokens) == 0 {
+		return c.Status(400).SendString("If header with a lock token required")
+	}
+	file, err := s.fs.resolveFile(c.Context(), userID.String(), urlPath)
+	if err != nil {
+		return c.Status(404).SendString("Not Found")
+	}
+
+	for _, token := range tokens {
+		lock, err := s.locks.Refresh(c.Context(), file, token, userID, timeout)
+		switch {
+		case err == nil:
+			return sendLockDiscovery(c, 200, lock)
+		case errors.Is(err, services.ErrLockNotHeld):
+			return c.Status(403).SendString("Lock is held by another user")
+		case !errors.Is(err, services.ErrLockTokenMismatch):
+			return c.Status(500).SendString(err.Error())
+		}
+	}
+	return c.Status(412).SendString("Precondition Failed")
+}
+
+func (s *Server) handleUnlock(c *fiber.Ctx, userID, urlPath string) error {
+	token := strings.TrimSpace(c.Get("Lock-Token"))
+	if !strings.HasPrefix(token, "<") || !strings.HasSuffix(token, ">") {
+		return c.Status(400).SendString("Lock-Token header required")
+	}
+	token = token[1 : len(token)-1]
+
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		return c.Status(401).SendString("Unauthorized")
+	}
+	file, err := s.fs.resolveFile(c.Context(), userID, path.Clean("/"+urlPath))
+	if err != nil {
+		return c.Status(404).SendString("Not Found")
+	}
+
+	err = s.locks.Unlock(c.Context(), file, token, userUUID)
+	switch {
+	case errors.Is(err, services.ErrLockTokenMismatch):
+		return c.Status(409).SendString("Lock token does not apply to this resource")
+	case errors.Is(err, services.ErrLockNotHeld):
+		return c.Status(403).SendString("Lock is held by another user")
+	case err != nil:
+		return c.Status(500).SendString(err.Error())
+	}
+	return c.SendStatus(204)
+}
+
+// lockDiscovery lists the locks covering a resource
+func lockDiscovery(locks []*models.Lock) *lockDiscoveryProp {
+	d := &lockDiscoveryProp{}
+	for _, lock := range locks {
+		active := activeLock{
+			LockType:  lockType{Write: &struct{}{}},
+			Depth:     "0",
+			Timeout:   fmt.Sprintf("Second-%d", max(int64(time.Until(lock.ExpiresAt)/time.Second), 0)),
+			LockToken: &href{Href: lock.Token},
+			LockRoot:  &href{Href: lock.Root},
+		}
+		if lock.Scope == models.LockShared {
+			active.LockScope.Shared = &struct{}{}
+		} else {
+			active.LockScope.Exclusive = &struct{}{}
+		}
+		if lock.Infinite {
+			active.Depth = "infinity"
+		}
+		if lock.Owner != "" {
+			active.Owner = &ownerProp{InnerXML: lock.Owner}
+		}
+		d.ActiveLocks = append(d.ActiveLocks, active)
+	}
+	return d
+}
+
+// supportedLocks is the supportedlock property of every resource
+var supportedLocks = &supportedLockProp{
+	LockEntries: []lockEntry{
+		{LockScope: lockScope{Exclusive: &struct{}{}}, LockType: lockType{Write: &struct{}{}}},
+		{LockScope: lockScope{Shared: &struct{}{}}, LockType: lockType{Write: &struct{}{}}},
+	},
+}
+
+// sendLockDiscovery answers a LOCK request with the lock it took or refreshed
+func sendLockDiscovery(c *fiber.Ctx, status int, lock *models.Lock) error {
+	xmlData, err := xml.MarshalIndent(lockResponse{LockDiscovery: lockDiscovery([]*models.Lock{lock})}, "", "  ")
+	if err != nil {
+		return c.Status(500).SendString(err.Error())
+	}
+	c.Set("Content-Type", "application/xml; charset=utf-8")
+	return c.Status(status).Send(append([]byte(xml.Header), xmlData...))
+}
+
+// lockResponse is the body of a LOCK response
+type lockResponse struct {
+	LockDiscovery *lockDiscoveryProp
+}
+
+func (l lockResponse) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	start.Name.Local = "D:prop"
+	start.Attr = []xml.Attr{{Name: xml.Name{Local: "xmlns:D"}, Value: "DAV:"}}
+	return e.EncodeElement(struct {
+		LockDiscovery *lockDiscoveryProp `xml:"D:lockdiscovery"`
+	}{l.LockDiscovery}, start)
+}
+
+type lockDiscoveryProp struct {
+	ActiveLocks []activeLock `xml:"D:activelock"`
+}
+
+type activeLock struct {
+	LockType  lockType   `xml:"D:locktype"`
+	LockScope lockScope  `xml:"D:lockscope"`
+	Depth     string     `xml:"D:depth"`
+	Owner     *ownerProp `xml:"D:owner,omitempty"`
+	Timeout   string     `xml:"D:timeout"`
+	LockToken *href      `xml:"D:locktoken"`
+	LockRoot  *href      `xml:"D:lockroot"`
+}
+
+type supportedLockProp struct {
+	LockEntries []lockEntry `xml:"D:lockentry"`
+}
+
+type lockEntry struct {
+	LockScope lockScope `xml:"D:lockscope"`
+	LockType  lockType  `xml:"D:locktype"`
+}
+
+type lockType struct {
+	Write *struct{} `xml:"D:write,omitempty"`
+}
+
+type lockScope struct {
+	Exclusive *struct{} `xml:"D:exclusive,omitempty"`
+	Shared    *struct{} `xml:"D:shared,omitempty"`
+}
+
+type ownerProp struct {
+	InnerXML string `xml:",innerxml"`
+}
+
+type href struct {
+	Href string `xml:"D:href"`
+}
+
+// hrefPath turns a URL from a Destination or If header into a path in the
+// user's WebDAV tree, decoding it
+func (s *Server) hrefPath(c *fiber.Ctx, href string) (string, error) {
+	p := strings.TrimPrefix(href, "http://"+c.Hostname())
+	p = strings.TrimPrefix(p, "https://"+c.Hostname())
+	return url.PathUnescape(strings.TrimPrefix(p, "/webdav"))
+}
@@ -0,0 +1,80 @@
+package webdav
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tessera/tessera/internal/services"
+)
+
+func TestParseIf(t *testing.T) {
+	lists, err := parseIf(`</webdav/a.txt> (<opaquelocktoken:1> ["abc"]) (Not <DAV:no-lock>)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lists) != 2 {
+		t.Fatalf("got %d lists, want 2", len(lists))
+	}
+	if lists[0].resource != "/webdav/a.txt" || lists[1].resource != "/webdav/a.txt" {
+		t.Errorf("resource tags = %q, %q", lists[0].resource, lists[1].resource)
+	}
+	first := lists[0].conditions
+	if len(first) != 2 || first[0].token != "opaquelocktoken:1" || first[1].etag != `"abc"` {
+		t.Errorf("first list = %+v", first)
+	}
+	if second := lists[1].conditions; len(second) != 1 || !second[0].not || second[0].token != "DAV:no-lock" {
+		t.Errorf("second list = %+v", second)
+	}
+	if tokens := submittedTokens(lists); len(tokens) != 2 {
+		t.Errorf("submitted tokens = %v", tokens)
+	}
+
+	for _, header := range []string{"", "()", "(<a>", "<a>", "(abc)", "([abc)"} {
+		if _, err := parseIf(header); err == nil {
+			t.Errorf("%q: expected an error", header)
+		}
+	}
+}
+
+func TestEvaluateIf(t *testing.T) {
+	state := func(string) (resourceState, error) {
+		return resourceState{tokens: []string{"opaquelocktoken:1"}, etag: `"abc"`}, nil
+	}
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{`(<opaquelocktoken:1>)`, true},
+		{`(<opaquelocktoken:2>)`, false},
+		{`(<opaquelocktoken:1> ["old"])`, false},
+		{`(<opaquelocktoken:2>) (["abc"])`, true},
+		// Submitting a token without requiring it
+		{`(<opaquelocktoken:2>) (Not <DAV:no-lock>)`, true},
+		{`(Not ["abc"])`, false},
+	}
+	for _, tt := range tests {
+		lists, err := parseIf(tt.header)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.header, err)
+		}
+		if got, _ := evaluateIf(lists, state); got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	tests := map[string]time.Duration{
+		"":                     0,
+		"Second-600":           10 * time.Minute,
+		"Infinite, Second-600": services.MaxLockTimeout,
+		"Foo, Second-60":       time.Minute,
+		"Second-999999999999":  services.MaxLockTimeout,
+		"Second-abc":           0,
+	}
+	for header, want := range tests {
+		if got := parseTimeout(header); got != want {
+			t.Errorf("%q = %v, want %v", header, got, want)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package webdav
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tessera/tessera/internal/models"
+)
+
+// maxPropertySize caps the value of a dead property, which is stored in the
+// database with the file
+const maxPropertySize = 64 * 1024
+
+var (
+	propGetLastModified     = xml.Name{Space: "DAV:", Local: "getlastmodified"}
+	propQuotaAvailableBytes = xml.Name{Space: "DAV:", Local: "quota-available-bytes"}
+	propQuotaUsedBytes      = xml.Name{Space: "DAV:", Local: "quota-used-bytes"}
+)
+
+// property is one WebDAV property of a resource. Its value is text, raw
+// innerXML, or a struct whose fields are the property's child elements; a
+// nil value renders an empty element, as PROPPATCH and propname results do.
+type property struct {
+	name  xml.Name
+	value any
+}
+
+// innerXML is a property value that is already XML, such as a dead
+// property's stored value
+type innerXML string
+
+func (p property) MarshalXML(e *xml.Encoder, _ xml.StartElement) error {
+	start := xml.StartElement{Name: p.name}
+	if p.name.Space == "DAV:" {
+		// The multistatus element binds the D prefix to DAV:
+		start.Name = xml.Name{Local: "D:" + p.name.Local}
+	}
+	switch v := p.value.(type) {
+	case nil:
+		return e.EncodeElement("", start)
+	case innerXML:
+		return e.EncodeElement(struct {
+			Inner string `xml:",innerxml"`
+		}{string(v)}, start)
+	default:
+		return e.EncodeElement(v, start)
+	}
+}
+
+// davProp returns a DAV: property
+func davProp(local string, value any) property {
+	return property{name: xml.Name{Space: "DAV:", Local: local}, value: value}
+}
+
+// statusLine formats an HTTP status for a multistatus response
+func statusLine(code int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s", code, http.StatusText(code))
+}
+
+// liveProps returns the properties the server maintains for a resource
+func liveProps(info os.FileInfo, locks []*models.Lock) []property {
+	props := []property{
+		davProp("displayname", info.Name()),
+		davProp("getlastmodified", info.ModTime().UTC().Format(http.TimeFormat)),
+		davProp("creationdate", info.ModTime().UTC().Format(time.RFC3339)),
+	}
+	if info.IsDir() {
+		props = append(props, davProp("resourcetype", &resourceType{Collection: &struct{}{}}))
+	} else {
+		props = append(props,
+			davProp("resourcetype", ""),
+			davProp("getcontentlength", strconv.FormatInt(info.Size(), 10)),
+			davProp("getcontenttype", "application/octet-stream"),
+		)
+	}
+	return append(props,
+		davProp("lockdiscovery", lockDiscovery(locks)),
+		davProp("supportedlock", supportedLocks),
+	)
+}
+
+// deadProps returns the properties clients stored on a file
+func deadProps(stored []*models.FileProperty) []property {
+	props := make([]property, len(stored))
+	for i, p := range stored {
+		props[i] = property{name: xml.Name{Space: p.Namespace, Local: p.Name}, value: innerXML(p.Value)}
+	}
+	return props
+}
+
+// quotaProps returns the RFC 4331 quota properties of a user's
+// collections. Quotas are per user, so every collection reports the same.
+// Available bytes are left out for users without a storage limit.
+func quotaProps(user *models.User) []property {
+	props := []property{
+		{name: propQuotaUsedBytes, value: strconv.FormatInt(user.StorageUsed, 10)},
+	}
+	if user.StorageLimit > 0 {
+		available := max(user.StorageLimit-user.StorageUsed, 0)
+		props = append(props, property{name: propQuotaAvailableBytes, value: strconv.FormatInt(available, 10)})
+	}
+	return props
+}
+
+// propfindRequest is the body of a PROPFIND request. An empty body asks for
+// all properties.
+type propfindRequest struct {
+	XMLName  xml.Name   `xml:"DAV: propfind"`
+	AllProp  *struct{}  `xml:"DAV: allprop"`
+	PropName *struct{}  `xml:"DAV: propname"`
+	Prop     *propNames `xml:"DAV: prop"`
+	Include  *propNames `xml:"DAV: include"`
+}
+
+type propNames struct {
+	Names []struct {
+		XMLName xml.Name
+	} `xml:",any"`
+}
+
+// parsePropfind parses a PROPFIND body
+func parsePropfind(body []byte) (*propfindRequest, error) {
+	req := &propfindRequest{}
+	if len(strings.TrimSpace(string(body))) == 0 {
+		req.AllProp = &struct{}{}
+		return req, nil
+	}
+	if err := xml.Unmarshal(body, req); err != nil {
+		return nil, err
+	}
+	if req.AllProp == nil && req.PropName == nil && req.Prop == nil {
+		return nil, fmt.Errorf("propfind names no properties")
+	}
+	return req, nil
+}
+
+// names returns the properties asked for by name, in a prop or include
+func (r *propfindRequest) names() []xml.Name {
+	var names []xml.Name
+	for _, list := range []*propNames{r.Prop, r.Include} {
+		if list == nil {
+			continue
+		}
+		for _, n := range list.Names {
+			names = append(names, n.XMLName)
+		}
+	}
+	return names
+}
+
+// wantsDead reports whether answering needs the stored dead properties
+func (r *propfindRequest) wantsDead() bool {
+	if r.Prop == nil {
+		return true
+	}
+	for _, name := range r.names() {
+		if name.Space != "DAV:" {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsQuota reports whether the quota properties were asked for; like
+// RFC 4331 says, allprop leaves them out
+func (r *propfindRequest) wantsQuota() bool {
+	for _, name := range r.names() {
+		if name == propQuotaUsedBytes || name == propQuotaAvailableBytes {
+			return true
+		}
+	}
+	return false
+}
+
+// propstats picks the properties of a resource the request asked for,
+// grouped by status
+func (r *propfindRequest) propstats(props []property, quota []property) []propstat {
+	if r.PropName != nil {
+		names := make([]property, len(props))
+		for i, p := range props {
+			names[i] = property{name: p.name}
+		}
+		return []propstat{{Prop: propList{Props: names}, Status: statusLine(200)}}
+	}
+
+	var found, missing []property
+	if r.AllProp != nil {
+		found = props
+	}
+	for _, name := range r.names() {
+		if r.AllProp != nil && !isQuota(name) && hasProp(props, name) {
+			continue // already included
+		}
+		if p, ok := findProp(props, name); ok {
+			found = append(found, p)
+		} else if p, ok := findProp(quota, name); ok {
+			found = append(found, p)
+		} else if r.Prop != nil {
+			missing = append(missing, property{name: name})
+		}
+	}
+
+	var stats []propstat
+	if len(found) > 0 || len(missing) == 0 {
+		stats = append(stats, propstat{Prop: propList{Props: found}, Status: statusLine(200)})
+	}
+	if len(missing) > 0 {
+		stats = append(stats, propstat{Prop: propList{Props: missing}, Status: statusLine(404)})
+	}
+	return stats
+}
+
+func isQuota(name xml.Name) bool {
+	return name == propQuotaUsedBytes || name == propQuotaAvailableBytes
+}
+
+func findProp(props []property, name xml.Name) (property, bool) {
+	for _, p := range props {
+		if p.name == name {
+			return p, true
+		}
+	}
+	return property{}, false
+}
+
+func hasProp(props []property, name xml.Name) bool {
+	_, ok := findProp(props, name)
+	return ok
+}
+
+// propertyUpdate is the body of a PROPPATCH request: set and remove
+// instructions, applied in order
+type propertyUpdate struct {
+	XMLName      xml.Name           `xml:"DAV: propertyupdate"`
+	Instructions []patchInstruction `xml:",any"`
+}
+
+type patchInstruction struct {
+	XMLName xml.Name
+	Prop    struct {
+		Props []struct {
+			XMLName xml.Name
+			Inner   string `xml:",innerxml"`
+		} `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+// propertyPatch is what a PROPPATCH changes once all of it is allowed
+type propertyPatch struct {
+	set      []*models.FileProperty
+	remove   []*models.FileProperty
+	modified *time.Time
+}
+
+// propResult is the outcome for one property of a PROPPATCH
+type propResult struct {
+	name   xml.Name
+	status int
+}
+
+// planPatch works out the changes a PROPPATCH makes and the status of each
+// property. A PROPPATCH is all or nothing: if any property fails, the rest
+// fail with 424 Failed Dependency and the patch is nil.
+func planPatch(update *propertyUpdate) (*propertyPatch, []propResult) {
+	var results []propResult
+	final := map[xml.Name]*models.FileProperty{} // nil for removed
+	var order []xml.Name
+	var modified *time.Time
+	failed := false
+
+	for _, inst := range update.Instructions {
+		remove := inst.XMLName.Local == "remove"
+		for _, p := range inst.Prop.Props {
+			status := 200
+			switch {
+			case p.XMLName == propGetLastModified && !remove:
+				t, err := http.ParseTime(strings.TrimSpace(p.Inner))
+				if err != nil {
+					status = 409
+				} else {
+					modified = &t
+				}
+			case p.XMLName.Space == "DAV:":
+				// Other live properties are maintained by the server
+				status = 403
+			case len(p.Inner) > maxPropertySize:
+				status = 507
+			default:
+				if _, seen := final[p.XMLName]; !seen {
+					order = append(order, p.XMLName)
+				}
+				final[p.XMLName] = nil
+				if !remove {
+					final[p.XMLName] = &models.FileProperty{Namespace: p.XMLName.Space, Name: p.XMLName.Local, Value: p.Inner}
+				}
+			}
+			failed = failed || status != 200
+			results = append(results, propResult{name: p.XMLName, status: status})
+		}
+	}
+
+	if failed {
+		for i := range results {
+			if results[i].status == 200 {
+				results[i].status = 424
+			}
+		}
+		return nil, results
+	}
+
+	patch := &propertyPatch{modified: modified}
+	for _, name := range order {
+		if p := final[name]; p != nil {
+			patch.set = append(patch.set, p)
+		} else {
+			patch.remove = append(patch.remove, &models.FileProperty{Namespace: name.Space, Name: name.Local})
+		}
+	}
+	return patch, results
+}
+
+func (s *Server) handleProppatch(c *fiber.Ctx, userID, urlPath string) error {
+	urlPath = path.Clean("/" + urlPath)
+	if urlPath == "/" {
+		return c.Status(403).SendString("The root has no properties to set")
+	}
+	res, err := s.fs.resolve(c.Context(), userID, urlPath)
+	if err != nil {
+		return c.Status(404).SendString("Not Found")
+	}
+	if res.file == nil || !res.canWrite() {
+		return forbidden(c)
+	}
+	file := res.file
+	if err := s.locks.CheckWrite(s.lockContext(c, userID), file); err != nil {
+		return locked(c, err)
+	}
+
+	var update propertyUpdate
+	if err := xml.Unmarshal(c.Body(), &update); err != nil {
+		return c.Status(400).SendString("Invalid propertyupdate")
+	}
+	for _, inst := range update.Instructions {
+		if inst.XMLName.Space != "DAV:" || (inst.XMLName.Local != "set" && inst.XMLName.Local != "remove") {
+			return c.Status(400).SendString("Invalid propertyupdate")
+		}
+	}
+
+	patch, results := planPatch(&update)
+	if patch != nil {
+		if err := s.fs.fileRepo.PatchProperties(c.Context(), file.ID, patch.set, patch.remove, patch.modified); err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
+	}
+
+	// Group the properties by status, in the order they first appear
+	var stats []propstat
+	index := map[int]int{}
+	for _, r := range results {
+		i, ok := index[r.status]
+		if !ok {
+			i = len(stats)
+			index[r.status] = i
+			stats = append(stats, propstat{Status: statusLine(r.status)})
+		}
+		stats[i].Prop.Props = append(stats[i].Prop.Props, property{name: r.name})
+	}
+
+	info := &FileInfo{name: file.Name, isDir: file.IsFolder}
+	return sendMultistatus(c, []propfindResponse{{Href: resourceHref(urlPath, info), Propstats: stats}})
+}
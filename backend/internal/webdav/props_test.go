@@ -0,0 +1,88 @@
+package webdav
+
+import (
+	"encoding/xml"
+	"testing"
+
+	"github.com/tessera/tessera/internal/models"
+)
+
+func TestPlanPatch(t *testing.T) {
+	parse := func(body string) *propertyUpdate {
+		t.Helper()
+		update := &propertyUpdate{}
+		if err := xml.Unmarshal([]byte(body), update); err != nil {
+			t.Fatal(err)
+		}
+		return update
+	}
+
+	patch, results := planPatch(parse(`<D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:z">
+		<D:set><D:prop>
+			<Z:color>red</Z:color>
+			<Z:size>1</Z:size>
+			<D:getlastmodified>Tue, 15 Nov 1994 12:45:26 GMT</D:getlastmodified>
+		</D:prop></D:set>
+		<D:remove><D:prop><Z:size/><Z:gone/></D:prop></D:remove>
+	</D:propertyupdate>`))
+	if patch == nil {
+		t.Fatalf("patch failed: %+v", results)
+	}
+	if len(patch.set) != 1 || patch.set[0].Name != "color" || patch.set[0].Value != "red" || patch.set[0].Namespace != "urn:z" {
+		t.Errorf("set = %+v", patch.set)
+	}
+	if len(patch.remove) != 2 || patch.remove[0].Name != "size" || patch.remove[1].Name != "gone" {
+		t.Errorf("remove = %+v", patch.remove)
+	}
+	if patch.modified == nil || patch.modified.Year() != 1994 {
+		t.Errorf("modified = %v", patch.modified)
+	}
+
+	// Protected properties fail the whole patch
+	patch, results = planPatch(parse(`<D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:z">
+		<D:set><D:prop><Z:color>red</Z:color><D:getcontentlength>5</D:getcontentlength></D:prop></D:set>
+	</D:propertyupdate>`))
+	if patch != nil {
+		t.Fatal("expected the patch to fail")
+	}
+	if len(results) != 2 || results[0].status != 424 || results[1].status != 403 {
+		t.Errorf("results = %+v", results)
+	}
+
+	_, results = planPatch(parse(`<D:propertyupdate xmlns:D="DAV:">
+		<D:set><D:prop><D:getlastmodified>yesterday</D:getlastmodified></D:prop></D:set>
+	</D:propertyupdate>`))
+	if len(results) != 1 || results[0].status != 409 {
+		t.Errorf("bad date: results = %+v", results)
+	}
+}
+
+func TestPropfindPropstats(t *testing.T) {
+	color := xml.Name{Space: "urn:z", Local: "color"}
+	props := []property{davProp("displayname", "a"), {name: color, value: innerXML("red")}}
+	quota := quotaProps(&models.User{StorageUsed: 10, StorageLimit: 100})
+
+	req, err := parsePropfind([]byte(`<D:propfind xmlns:D="DAV:" xmlns:Z="urn:z">
+		<D:prop><D:displayname/><Z:missing/><D:quota-used-bytes/></D:prop>
+	</D:propfind>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !req.wantsQuota() || !req.wantsDead() {
+		t.Errorf("wantsQuota = %v, wantsDead = %v", req.wantsQuota(), req.wantsDead())
+	}
+	stats := req.propstats(props, quota)
+	if len(stats) != 2 || len(stats[0].Prop.Props) != 2 || len(stats[1].Prop.Props) != 1 {
+		t.Fatalf("propstats = %+v", stats)
+	}
+	if stats[1].Status != "HTTP/1.1 404 Not Found" || stats[1].Prop.Props[0].name.Local != "missing" {
+		t.Errorf("missing propstat = %+v", stats[1])
+	}
+
+	// allprop leaves out the quota properties
+	req, _ = parsePropfind(nil)
+	stats = req.propstats(props, quota)
+	if len(stats) != 1 || len(stats[0].Prop.Props) != 2 || req.wantsQuota() {
+		t.Errorf("allprop propstats = %+v", stats)
+	}
+}
@@ -1,37 +1,71 @@
 package webdav
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
-	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 	"github.com/rs/zerolog"
+	"github.com/tessera/tessera/internal/handlers"
+	"github.com/tessera/tessera/internal/models"
 	"github.com/tessera/tessera/internal/repository"
 	"github.com/tessera/tessera/internal/services"
 	"github.com/tessera/tessera/internal/storage"
 )
 
+// authenticator checks the credentials clients send
+type authenticator interface {
+	Login(ctx context.Context, input services.LoginInput) (*models.User, *services.TokenPair, *services.PendingAuthToken, error)
+}
+
+// fileWriter writes file content, which keeps quota, versions and blobs in
+// step
+type fileWriter interface {
+	GetUser(ctx context.Context, id uuid.UUID) (*models.User, error)
+	Upload(ctx context.Context, userID, parentID, name string, reader io.Reader, size int64, mimeType string) (*models.File, error)
+	UpdateFileContent(ctx context.Context, fileID, ownerID, userID string, reader io.Reader, size int64) (*models.File, error)
+	CopyTo(ctx context.Context, source *models.File, destOwnerID uuid.UUID, destParentID *uuid.UUID, newName string) (*models.File, error)
+}
+
+// lockManager keeps the WebDAV locks on files
+type lockManager interface {
+	Lock(ctx context.Context, input services.LockInput) (*models.Lock, error)
+	Refresh(ctx context.Context, file *models.File, token string, userID uuid.UUID, timeout time.Duration) (*models.Lock, error)
+	Unlock(ctx context.Context, file *models.File, token string, userID uuid.UUID) error
+	Locks(ctx context.Context, file *models.File) ([]*models.Lock, error)
+	HasLocks(ctx context.Context, ownerID uuid.UUID) (bool, error)
+	CheckWrite(ctx context.Context, file *models.File) error
+	CheckFolder(ctx context.Context, ownerID uuid.UUID, folderID *uuid.UUID) error
+	CheckTree(ctx context.Context, file *models.File) error
+	RemoveTree(ctx context.Context, file *models.File) error
+}
+
 // Server handles WebDAV requests
 type Server struct {
 	fs          *FileSystem
-	authService *services.AuthService
-	fileService *services.FileService
+	authService authenticator
+	fileService fileWriter
+	locks       lockManager
 	log         zerolog.Logger
 }
 
 // NewServer creates a new WebDAV server
-func NewServer(fileRepo *repository.FileRepository, storage *storage.MinIOStorage, authService *services.AuthService, fileService *services.FileService, log zerolog.Logger) *Server {
+func NewServer(fileRepo *repository.FileRepository, storage storage.Storage, authService *services.AuthService, fileService *services.FileService, locks *services.LockService, changes *services.ChangeService, log zerolog.Logger) *Server {
 	return &Server{
-		fs:          NewFileSystem(fileRepo, storage, log),
+		fs:          NewFileSystem(fileRepo, storage, changes, log),
 		authService: authService,
 		fileService: fileService,
+		locks:       locks,
 		log:         log,
 	}
 }
@@ -56,19 +90,26 @@ func (s *Server) Handler() fiber.Handler {
 			return c.Status(401).SendString("Unauthorized")
 		}
 
-		urlPath := c.Path()
-
-		// Strip /webdav prefix
-		urlPath = strings.TrimPrefix(urlPath, "/webdav")
+		// Strip /webdav prefix. Paths arrive percent-encoded.
+		urlPath, err := url.PathUnescape(strings.TrimPrefix(c.Path(), "/webdav"))
+		if err != nil {
+			return c.Status(400).SendString("Invalid path")
+		}
 		if urlPath == "" {
 			urlPath = "/"
 		}
 
 		s.log.Debug().Str("method", method).Str("path", urlPath).Str("user", userID).Msg("WebDAV request")
 
+		if ok, err := s.checkIf(c, userID, urlPath); !ok {
+			return err
+		}
+
 		switch method {
 		case "PROPFIND":
 			return s.handlePropfind(c, userID, urlPath)
+		case "PROPPATCH":
+			return s.handleProppatch(c, userID, urlPath)
 		case "GET", "HEAD":
 			return s.handleGet(c, userID, urlPath)
 		case "PUT":
@@ -129,7 +170,7 @@ func (s *Server) authenticate(c *fiber.Ctx) (string, error) {
 }
 
 func (s *Server) handleOptions(c *fiber.Ctx) error {
-	c.Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, MKCOL, COPY, MOVE, LOCK, UNLOCK")
+	c.Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, PROPPATCH, MKCOL, COPY, MOVE, LOCK, UNLOCK")
 	c.Set("DAV", "1, 2")
 	c.Set("MS-Author-Via", "DAV")
 	return c.SendStatus(200)
@@ -138,6 +179,11 @@ func (s *Server) handleOptions(c *fiber.Ctx) error {
 func (s *Server) handlePropfind(c *fiber.Ctx, userID, urlPath string) error {
 	depth := c.Get("Depth", "1")
 
+	req, err := parsePropfind(c.Body())
+	if err != nil {
+		return c.Status(400).SendString("Invalid propfind")
+	}
+
 	stat, err := s.fs.Stat(c.Context(), userID, urlPath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -146,155 +192,252 @@ func (s *Server) handlePropfind(c *fiber.Ctx, userID, urlPath string) error {
 		return c.Status(500).SendString(err.Error())
 	}
 
-	responses := []propfindResponse{}
-
-	// Add the requested resource
-	responses = append(responses, s.buildPropfindResponse(urlPath, stat))
-
-	// If directory and depth > 0, add children
+	// The requested resource, and its children if it's a directory and
+	// depth > 0
+	paths := []string{urlPath}
+	infos := []os.FileInfo{stat}
 	if stat.IsDir() && depth != "0" {
 		file, err := s.fs.OpenFile(c.Context(), userID, urlPath, os.O_RDONLY, 0)
 		if err == nil {
 			defer file.Close()
 			children, _ := file.Readdir(-1)
 			for _, child := range children {
-				childPath := path.Join(urlPath, child.Name())
-				responses = append(responses, s.buildPropfindResponse(childPath, child))
+				paths = append(paths, path.Join(urlPath, child.Name()))
+				infos = append(infos, child)
 			}
 		}
 	}
 
-	// Build XML response
-	multiStatus := multistatus{
-		Responses: responses,
+	// Shared files are listed alongside the user's own, so locks and quota
+	// are those of each file's owner
+	var ids []uuid.UUID
+	hasLocks := map[uuid.UUID]bool{}
+	quota := map[uuid.UUID][]property{}
+	for _, info := range infos {
+		fi, ok := info.(*FileInfo)
+		if !ok || fi.owner == uuid.Nil {
+			continue
+		}
+		if fi.id != uuid.Nil {
+			ids = append(ids, fi.id)
+		}
+		if _, seen := hasLocks[fi.owner]; !seen {
+			// Locks are rare, so they're only looked up per file if the
+			// owner has any
+			if hasLocks[fi.owner], err = s.locks.HasLocks(c.Context(), fi.owner); err != nil {
+				return c.Status(500).SendString(err.Error())
+			}
+		}
+		if _, seen := quota[fi.owner]; !seen && fi.IsDir() && req.wantsQuota() {
+			user, err := s.fileService.GetUser(c.Context(), fi.owner)
+			if err != nil {
+				return c.Status(500).SendString(err.Error())
+			}
+			quota[fi.owner] = quotaProps(user)
+		}
 	}
 
-	xmlData, err := xml.MarshalIndent(multiStatus, "", "  ")
-	if err != nil {
-		return c.Status(500).SendString(err.Error())
+	var dead map[uuid.UUID][]*models.FileProperty
+	if req.wantsDead() && len(ids) > 0 {
+		if dead, err = s.fs.fileRepo.ListProperties(c.Context(), ids); err != nil {
+			return c.Status(500).SendString(err.Error())
+		}
 	}
 
-	c.Set("Content-Type", "application/xml; charset=utf-8")
-	return c.Status(207).Send(append([]byte(xml.Header), xmlData...))
+	responses := make([]propfindResponse, 0, len(infos))
+	for i, info := range infos {
+		var id, owner uuid.UUID
+		if fi, ok := info.(*FileInfo); ok {
+			id, owner = fi.id, fi.owner
+		}
+		var locks []*models.Lock
+		if hasLocks[owner] && id != uuid.Nil {
+			if locks, err = s.locks.Locks(c.Context(), &models.File{ID: id, OwnerID: owner}); err != nil {
+				return c.Status(500).SendString(err.Error())
+			}
+		}
+
+		props := append(liveProps(info, locks), deadProps(dead[id])...)
+		var collectionQuota []property
+		if info.IsDir() {
+			collectionQuota = quota[owner]
+		}
+		responses = append(responses, propfindResponse{
+			Href:      resourceHref(paths[i], info),
+			Propstats: req.propstats(props, collectionQuota),
+		})
+	}
+
+	return sendMultistatus(c, responses)
 }
 
-func (s *Server) buildPropfindResponse(urlPath string, info os.FileInfo) propfindResponse {
-	href := "/webdav" + urlPath
+// resourceHref returns the URL of a resource; collections end in a slash
+func resourceHref(urlPath string, info os.FileInfo) string {
+	href := pathHref(urlPath)
 	if info.IsDir() && !strings.HasSuffix(href, "/") {
 		href += "/"
 	}
+	return href
+}
 
-	props := propstat{
-		Status: "HTTP/1.1 200 OK",
-		Prop: prop{
-			DisplayName:     info.Name(),
-			GetLastModified: info.ModTime().UTC().Format(http.TimeFormat),
-			CreationDate:    info.ModTime().UTC().Format(time.RFC3339),
-		},
+// pathHref returns the URL of a path in the user's WebDAV tree, each
+// segment percent-encoded
+func pathHref(urlPath string) string {
+	segments := strings.Split(urlPath, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
 	}
+	return "/webdav" + strings.Join(segments, "/")
+}
 
-	if info.IsDir() {
-		props.Prop.ResourceType = &resourceType{Collection: &struct{}{}}
-	} else {
-		props.Prop.GetContentLength = info.Size()
-		props.Prop.GetContentType = "application/octet-stream"
+// sendMultistatus writes a 207 Multi-Status response
+func sendMultistatus(c *fiber.Ctx, responses []propfindResponse) error {
+	multiStatus := multistatus{
+		Responses: responses,
 	}
 
-	return propfindResponse{
-		Href:     href,
-		Propstat: props,
+	xmlData, err := xml.MarshalIndent(&multiStatus, "", "  ")
+	if err != nil {
+		return c.Status(500).SendString(err.Error())
 	}
+
+	c.Set("Content-Type", "application/xml; charset=utf-8")
+	return c.Status(207).Send(append([]byte(xml.Header), xmlData...))
 }
 
 func (s *Server) handleGet(c *fiber.Ctx, userID, urlPath string) error {
-	file, err := s.fs.OpenFile(c.Context(), userID, urlPath, os.O_RDONLY, 0)
+	urlPath = path.Clean("/" + urlPath)
+	if urlPath == "/" {
+		return c.Status(405).SendString("Method Not Allowed")
+	}
+
+	file, err := s.fs.resolveFile(c.Context(), userID, urlPath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return c.Status(404).SendString("Not Found")
 		}
 		return c.Status(500).SendString(err.Error())
 	}
-	defer file.Close()
 
-	stat, err := file.Stat()
-	if err != nil {
-		return c.Status(500).SendString(err.Error())
-	}
-
-	if stat.IsDir() {
+	if file.IsFolder {
 		return c.Status(405).SendString("Method Not Allowed")
 	}
 
-	c.Set("Content-Type", "application/octet-stream")
-	c.Set("Content-Length", fmt.Sprintf("%d", stat.Size()))
-	c.Set("Last-Modified", stat.ModTime().UTC().Format(http.TimeFormat))
-
-	if c.Method() == "HEAD" {
-		return c.SendStatus(200)
-	}
-
-	// Stream the file
-	_, err = io.Copy(c.Response().BodyWriter(), file)
-	return err
+	// Streams the object, with Range and conditional request support
+	return handlers.ServeContent(c, s.fs.storage, file, "", s.log)
 }
 
 func (s *Server) handlePut(c *fiber.Ctx, userID, urlPath string) error {
 	urlPath = path.Clean("/" + urlPath)
-	dir := path.Dir(urlPath)
 	fileName := path.Base(urlPath)
 
-	// Resolve parent directory
-	var parentID string
-	if dir != "/" && dir != "" {
-		parent, err := s.fs.resolveFile(c.Context(), userID, dir)
-		if err != nil {
+	// Check if file exists (update) or new (create)
+	existing, err := s.fs.resolve(c.Context(), userID, urlPath)
+	if err != nil && !os.IsNotExist(err) {
+		return c.Status(500).SendString(err.Error())
+	}
+	var parent *resource
+	if existing != nil {
+		if existing.file == nil || existing.file.IsFolder {
+			return c.Status(405).SendString("Method Not Allowed")
+		}
+		if !existing.canWrite() {
+			return forbidden(c)
+		}
+	} else {
+		parent, err = s.fs.resolve(c.Context(), userID, path.Dir(urlPath))
+		if err != nil || (parent.file != nil && !parent.file.IsFolder) {
 			return c.Status(409).SendString("Parent directory not found")
 		}
-		parentID = parent.ID.String()
+		if !parent.canWrite() {
+			return forbidden(c)
+		}
 	}
 
-	// Check if file exists (update) or new (create)
-	existingFile, _ := s.fs.resolveFile(c.Context(), userID, urlPath)
+	// Writes may change locked files if the If header submitted the tokens
+	ctx := s.lockContext(c, userID)
 
-	body := c.Body()
-	reader := strings.NewReader(string(body))
+	// The body goes straight to storage rather than being read into memory.
+	// Clients that send it chunked (macOS Finder does) have no length.
+	reader, size := handlers.RequestBodyReader(c)
 
-	if existingFile != nil {
+	// Files written into a share stay with the share's owner, and count
+	// towards their quota
+	if existing != nil {
 		// Update existing file
-		_, err := s.fileService.UpdateFileContent(c.Context(), existingFile.ID.String(), userID, reader, int64(len(body)))
+		file := existing.file
+		_, err := s.fileService.UpdateFileContent(ctx, file.ID.String(), file.OwnerID.String(), userID, reader, size)
 		if err != nil {
-			return c.Status(500).SendString(err.Error())
+			if errors.Is(err, services.ErrQuotaExceeded) {
+				return c.Status(507).SendString("Insufficient Storage")
+			}
+			return locked(c, err)
 		}
 		return c.SendStatus(204)
 	}
 
 	// Create new file
-	_, err := s.fileService.Upload(c.Context(), userID, parentID, fileName, reader, int64(len(body)), "application/octet-stream")
+	var parentID string
+	if parent.file != nil {
+		parentID = parent.file.ID.String()
+	}
+	_, err = s.fileService.Upload(ctx, parent.owner.String(), parentID, fileName, reader, size, "application/octet-stream")
 	if err != nil {
-		return c.Status(500).SendString(err.Error())
+		if errors.Is(err, services.ErrQuotaExceeded) {
+			return c.Status(507).SendString("Insufficient Storage")
+		}
+		return locked(c, err)
 	}
 
 	return c.SendStatus(201)
 }
 
 func (s *Server) handleDelete(c *fiber.Ctx, userID, urlPath string) error {
-	err := s.fs.RemoveAll(c.Context(), userID, urlPath)
+	res, err := s.fs.resolve(c.Context(), userID, path.Clean("/"+urlPath))
 	if err != nil {
-		if os.IsNotExist(err) {
-			return c.Status(404).SendString("Not Found")
-		}
-		return c.Status(500).SendString(err.Error())
+		return c.Status(404).SendString("Not Found")
+	}
+	if !res.canRemove() {
+		return forbidden(c)
+	}
+	file := res.file
+
+	// Deleting needs the locks on everything deleted and on the folder
+	// it's removed from
+	ctx := s.lockContext(c, userID)
+	if err := s.locks.CheckTree(ctx, file); err != nil {
+		return locked(c, err)
+	}
+	if err := s.locks.CheckFolder(ctx, file.OwnerID, file.ParentID); err != nil {
+		return locked(c, err)
+	}
+
+	err = s.fs.RemoveAll(c.Context(), userID, urlPath)
+	if err != nil {
+		return fsError(c, err)
+	}
+
+	// A deleted resource's locks go with it
+	if err := s.locks.RemoveTree(c.Context(), file); err != nil {
+		s.log.Warn().Err(err).Str("file_id", file.ID.String()).Msg("Failed to remove locks of deleted file")
 	}
 	return c.SendStatus(204)
 }
 
 func (s *Server) handleMkcol(c *fiber.Ctx, userID, urlPath string) error {
+	if err := s.checkParent(c, userID, urlPath); err != nil {
+		if os.IsNotExist(err) {
+			return c.Status(409).SendString("Parent directory not found")
+		}
+		return locked(c, err)
+	}
+
 	err := s.fs.Mkdir(c.Context(), userID, urlPath, 0755)
 	if err != nil {
 		if os.IsExist(err) {
 			return c.Status(405).SendString("Already exists")
 		}
-		return c.Status(500).SendString(err.Error())
+		return fsError(c, err)
 	}
 	return c.SendStatus(201)
 }
@@ -306,9 +449,10 @@ func (s *Server) handleCopy(c *fiber.Ctx, userID, urlPath string) error {
 	}
 
 	// Parse destination path
-	destPath := strings.TrimPrefix(dest, "http://"+c.Hostname())
-	destPath = strings.TrimPrefix(destPath, "https://"+c.Hostname())
-	destPath = strings.TrimPrefix(destPath, "/webdav")
+	destPath, err := s.hrefPath(c, dest)
+	if err != nil {
+		return c.Status(400).SendString("Invalid Destination header")
+	}
 
 	// Get source file
 	srcFile, err := s.fs.resolveFile(c.Context(), userID, urlPath)
@@ -319,20 +463,35 @@ func (s *Server) handleCopy(c *fiber.Ctx, userID, urlPath string) error {
 	// Resolve destination parent
 	destDir := path.Dir(destPath)
 	destName := path.Base(destPath)
+	if reservedName(destDir, destName) {
+		return forbidden(c)
+	}
 
-	var destParentID string
-	if destDir != "/" && destDir != "" {
-		parent, err := s.fs.resolveFile(c.Context(), userID, destDir)
-		if err != nil {
-			return c.Status(409).SendString("Destination parent not found")
-		}
-		destParentID = parent.ID.String()
+	parent, err := s.fs.resolve(c.Context(), userID, destDir)
+	if err != nil || (parent.file != nil && !parent.file.IsFolder) {
+		return c.Status(409).SendString("Destination parent not found")
+	}
+	if !parent.canWrite() {
+		return forbidden(c)
+	}
+	var destParentID *uuid.UUID
+	if parent.file != nil {
+		destParentID = &parent.file.ID
 	}
 
-	// Copy the file
-	_, err = s.fileService.Copy(c.Context(), srcFile.ID.String(), userID, destParentID, destName)
+	// Copy the file; the destination folder's locks are checked on upload,
+	// and the copy belongs to the destination folder's owner
+	copied, err := s.fileService.CopyTo(s.lockContext(c, userID), srcFile, parent.owner, destParentID, destName)
 	if err != nil {
-		return c.Status(500).SendString(err.Error())
+		if errors.Is(err, services.ErrQuotaExceeded) {
+			return c.Status(507).SendString("Insufficient Storage")
+		}
+		return locked(c, err)
+	}
+
+	// Dead properties are copied with the resource
+	if err := s.fs.fileRepo.CopyProperties(c.Context(), srcFile.ID, copied.ID); err != nil {
+		s.log.Warn().Err(err).Str("file_id", copied.ID.String()).Msg("Failed to copy file properties")
 	}
 
 	return c.SendStatus(201)
@@ -345,45 +504,69 @@ func (s *Server) handleMove(c *fiber.Ctx, userID, urlPath string) error {
 	}
 
 	// Parse destination path
-	destPath := strings.TrimPrefix(dest, "http://"+c.Hostname())
-	destPath = strings.TrimPrefix(destPath, "https://"+c.Hostname())
-	destPath = strings.TrimPrefix(destPath, "/webdav")
+	destPath, err := s.hrefPath(c, dest)
+	if err != nil {
+		return c.Status(400).SendString("Invalid Destination header")
+	}
 
-	err := s.fs.Rename(c.Context(), userID, urlPath, destPath)
+	res, err := s.fs.resolve(c.Context(), userID, path.Clean("/"+urlPath))
 	if err != nil {
-		if os.IsNotExist(err) {
-			return c.Status(404).SendString("Not Found")
-		}
-		return c.Status(500).SendString(err.Error())
+		return c.Status(404).SendString("Not Found")
 	}
+	if !res.canRemove() {
+		return forbidden(c)
+	}
+	file := res.file
 
-	return c.SendStatus(201)
-}
+	// Moving needs the locks on everything moved and on both folders
+	ctx := s.lockContext(c, userID)
+	if err := s.locks.CheckTree(ctx, file); err != nil {
+		return locked(c, err)
+	}
+	if err := s.locks.CheckFolder(ctx, file.OwnerID, file.ParentID); err != nil {
+		return locked(c, err)
+	}
+	if err := s.checkParent(c, userID, destPath); err != nil && !os.IsNotExist(err) {
+		return locked(c, err)
+	}
 
-func (s *Server) handleLock(c *fiber.Ctx, userID, urlPath string) error {
-	// Simple lock implementation - always succeeds
-	token := fmt.Sprintf("opaquelocktoken:%s", time.Now().UnixNano())
+	err = s.fs.Rename(c.Context(), userID, urlPath, destPath)
+	if err != nil {
+		return fsError(c, err)
+	}
 
-	lockDiscovery := lockDiscoveryResponse{
-		ActiveLock: activeLock{
-			LockType:  lockType{Write: &struct{}{}},
-			LockScope: lockScope{Exclusive: &struct{}{}},
-			Owner:     owner{Href: userID},
-			Timeout:   "Second-3600",
-			LockToken: lockTokenElem{Href: token},
-			Depth:     "infinity",
-		},
+	// Locks don't move with a resource (RFC 4918 section 7.7)
+	if err := s.locks.RemoveTree(c.Context(), file); err != nil {
+		s.log.Warn().Err(err).Str("file_id", file.ID.String()).Msg("Failed to remove locks of moved file")
 	}
+	return c.SendStatus(201)
+}
 
-	xmlData, _ := xml.MarshalIndent(lockDiscovery, "", "  ")
+// checkParent checks the locks of the folder a resource is added to or
+// removed from. A missing folder is reported as os.ErrNotExist.
+func (s *Server) checkParent(c *fiber.Ctx, userID, urlPath string) error {
+	parent, err := s.fs.resolve(c.Context(), userID, path.Dir(path.Clean("/"+urlPath)))
+	if err != nil || parent.file == nil {
+		return err
+	}
+	return s.locks.CheckWrite(s.lockContext(c, userID), parent.file)
+}
 
-	c.Set("Content-Type", "application/xml; charset=utf-8")
-	c.Set("Lock-Token", "<"+token+">")
-	return c.Status(200).Send(append([]byte(xml.Header), xmlData...))
+// forbidden answers a write the user may not make, such as to a file
+// shared with them only to view
+func forbidden(c *fiber.Ctx) error {
+	return c.Status(403).SendString("Forbidden")
 }
 
-func (s *Server) handleUnlock(c *fiber.Ctx, userID, urlPath string) error {
-	return c.SendStatus(204)
+// fsError answers a failed change to the file system
+func fsError(c *fiber.Ctx, err error) error {
+	switch {
+	case os.IsNotExist(err):
+		return c.Status(404).SendString("Not Found")
+	case errors.Is(err, errReadOnly), errors.Is(err, errCrossOwner):
+		return c.Status(403).SendString(err.Error())
+	}
+	return c.Status(500).SendString(err.Error())
 }
 
 // XML structures for WebDAV responses
@@ -402,62 +585,19 @@ func (m *multistatus) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
 }
 
 type propfindResponse struct {
-	Href     string   `xml:"D:href"`
-	Propstat propstat `xml:"D:propstat"`
+	Href      string     `xml:"D:href"`
+	Propstats []propstat `xml:"D:propstat"`
 }
 
 type propstat struct {
-	Prop   prop   `xml:"D:prop"`
-	Status string `xml:"D:status"`
+	Prop   propList `xml:"D:prop"`
+	Status string   `xml:"D:status"`
 }
 
-type prop struct {
-	DisplayName      string        `xml:"D:displayname,omitempty"`
-	GetContentLength int64         `xml:"D:getcontentlength,omitempty"`
-	GetContentType   string        `xml:"D:getcontenttype,omitempty"`
-	GetLastModified  string        `xml:"D:getlastmodified,omitempty"`
-	CreationDate     string        `xml:"D:creationdate,omitempty"`
-	ResourceType     *resourceType `xml:"D:resourcetype"`
+type propList struct {
+	Props []property `xml:",any"`
 }
 
 type resourceType struct {
 	Collection *struct{} `xml:"D:collection,omitempty"`
 }
-
-type lockDiscoveryResponse struct {
-	XMLName    xml.Name   `xml:"D:prop"`
-	Xmlns      string     `xml:"xmlns:D,attr"`
-	ActiveLock activeLock `xml:"D:lockdiscovery>D:activelock"`
-}
-
-func (l *lockDiscoveryResponse) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
-	start.Name.Local = "D:prop"
-	start.Attr = []xml.Attr{{Name: xml.Name{Local: "xmlns:D"}, Value: "DAV:"}}
-	type alias lockDiscoveryResponse
-	return e.EncodeElement((*alias)(l), start)
-}
-
-type activeLock struct {
-	LockType  lockType      `xml:"D:locktype"`
-	LockScope lockScope     `xml:"D:lockscope"`
-	Owner     owner         `xml:"D:owner"`
-	Timeout   string        `xml:"D:timeout"`
-	LockToken lockTokenElem `xml:"D:locktoken"`
-	Depth     string        `xml:"D:depth"`
-}
-
-type lockType struct {
-	Write *struct{} `xml:"D:write,omitempty"`
-}
-
-type lockScope struct {
-	Exclusive *struct{} `xml:"D:exclusive,omitempty"`
-}
-
-type owner struct {
-	Href string `xml:"D:href"`
-}
-
-type lockTokenElem struct {
-	Href string `xml:"D:href"`
-}
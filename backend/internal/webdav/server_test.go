@@ -0,0 +1,311 @@
+package webdav
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"github.com/tessera/tessera/internal/config"
+	"github.com/tessera/tessera/internal/models"
+	"github.com/tessera/tessera/internal/repository"
+	"github.com/tessera/tessera/internal/services"
+	"github.com/tessera/tessera/internal/storage"
+)
+
+// fakeFiles keeps file metadata in memory
+type fakeFiles struct {
+	files  []*models.File
+	shared map[uuid.UUID][]*models.SharedFile
+}
+
+func (r *fakeFiles) GetByID(ctx context.Context, id uuid.UUID) (*models.File, error) {
+	for _, f := range r.files {
+		if f.ID == id {
+			return f, nil
+		}
+	}
+	return nil, repository.ErrFileNotFound
+}
+
+func (r *fakeFiles) GetByName(ctx context.Context, ownerID uuid.UUID, parentID *uuid.UUID, name string) (*models.File, error) {
+	for _, f := range r.children(ownerID, parentID) {
+		if f.Name == name {
+			return f, nil
+		}
+	}
+	return nil, repository.ErrFileNotFound
+}
+
+func (r *fakeFiles) ListByParent(ctx context.Context, ownerID uuid.UUID, parentID *uuid.UUID, includeTrash bool) ([]*models.File, error) {
+	return r.children(ownerID, parentID), nil
+}
+
+// children lists the files in a folder, or at the top if parentID is nil
+func (r *fakeFiles) children(ownerID uuid.UUID, parentID *uuid.UUID) []*models.File {
+	var files []*models.File
+	for _, f := range r.files {
+		if f.OwnerID == ownerID && (f.ParentID == nil) == (parentID == nil) && (parentID == nil || *f.ParentID == *parentID) {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func (r *fakeFiles) GetSharedWithUser(ctx context.Context, userID uuid.UUID) ([]*models.SharedFile, error) {
+	return r.shared[userID], nil
+}
+
+func (r *fakeFiles) Create(ctx context.Context, file *models.File) error {
+	r.files = append(r.files, file)
+	return nil
+}
+
+func (r *fakeFiles) Update(ctx context.Context, file *models.File) error {
+	return nil
+}
+
+func (r *fakeFiles) MoveToTrash(ctx context.Context, id uuid.UUID) error {
+	return nil
+}
+
+func (r *fakeFiles) ListProperties(ctx context.Context, fileIDs []uuid.UUID) (map[uuid.UUID][]*models.FileProperty, error) {
+	return nil, nil
+}
+
+func (r *fakeFiles) PatchProperties(ctx context.Context, fileID uuid.UUID, set, remove []*models.FileProperty, modified *time.Time) error {
+	return nil
+}
+
+func (r *fakeFiles) CopyProperties(ctx context.Context, sourceID, targetID uuid.UUID) error {
+	return nil
+}
+
+// fakeWriter records content written to existing files
+type fakeWriter struct {
+	ownerID, userID string
+	content         string
+}
+
+func (w *fakeWriter) GetUser(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	return &models.User{ID: id}, nil
+}
+
+func (w *fakeWriter) Upload(ctx context.Context, userID, parentID, name string, reader io.Reader, size int64, mimeType string) (*models.File, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (w *fakeWriter) UpdateFileContent(ctx context.Context, fileID, ownerID, userID string, reader io.Reader, size int64) (*models.File, error) {
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	w.ownerID, w.userID, w.content = ownerID, userID, string(content)
+	return &models.File{}, nil
+}
+
+func (w *fakeWriter) CopyTo(ctx context.Context, source *models.File, destOwnerID uuid.UUID, destParentID *uuid.UUID, newName string) (*models.File, error) {
+	return nil, errors.New("not implemented")
+}
+
+// fakeAuth lets one user in, whatever their password
+type fakeAuth struct {
+	user *models.User
+}
+
+func (a fakeAuth) Login(ctx context.Context, input services.LoginInput) (*models.User, *services.TokenPair, *services.PendingAuthToken, error) {
+	if input.Email != a.user.Email {
+		return nil, nil, nil, services.ErrInvalidCredentials
+	}
+	return a.user, nil, nil, nil
+}
+
+// noLocks is a lock manager with no locks
+type noLocks struct{}
+
+func (noLocks) Lock(ctx context.Context, input services.LockInput) (*models.Lock, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (noLocks) Refresh(ctx context.Context, file *models.File, token string, userID uuid.UUID, timeout time.Duration) (*models.Lock, error) {
+	return nil, services.ErrLockTokenMismatch
+}
+
+func (noLocks) Unlock(ctx context.Context, file *models.File, token string, userID uuid.UUID) error {
+	return services.ErrLockTokenMismatch
+}
+
+func (noLocks) Locks(ctx context.Context, file *models.File) ([]*models.Lock, error) {
+	return nil, nil
+}
+
+func (noLocks) HasLocks(ctx context.Context, ownerID uuid.UUID) (bool, error) {
+	return false, nil
+}
+
+func (noLocks) CheckWrite(ctx context.Context, file *models.File) error {
+	return nil
+}
+
+func (noLocks) CheckFolder(ctx context.Context, ownerID uuid.UUID, folderID *uuid.UUID) error {
+	return nil
+}
+
+func (noLocks) CheckTree(ctx context.Context, file *models.File) error {
+	return nil
+}
+
+func (noLocks) RemoveTree(ctx context.Context, file *models.File) error {
+	return nil
+}
+
+func TestServerEncodedPaths(t *testing.T) {
+	ctx := context.Background()
+	store, err := storage.NewLocal(config.StorageConfig{LocalPath: t.TempDir()}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user := &models.User{ID: uuid.New(), Email: "al@example.com"}
+	owner := uuid.New()
+	files := &fakeFiles{shared: map[uuid.UUID][]*models.SharedFile{}}
+	addFile := func(ownerID uuid.UUID, parent *models.File, name, content string) *models.File {
+		f := &models.File{ID: uuid.New(), OwnerID: ownerID, Name: name, IsFolder: content == "", UpdatedAt: time.Now()}
+		if parent != nil {
+			f.ParentID = &parent.ID
+		}
+		if !f.IsFolder {
+			f.StorageKey = "files/" + f.ID.String()
+			f.Size = int64(len(content))
+			if err := store.Upload(ctx, f.StorageKey, strings.NewReader(content), f.Size, "text/plain"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		files.files = append(files.files, f)
+		return f
+	}
+
+	team := addFile(owner, nil, "Team Docs", "")
+	addFile(owner, team, "q3 plan.txt", "shared content")
+	files.shared[user.ID] = []*models.SharedFile{{
+		ID: team.ID, Name: team.Name, IsFolder: true, OwnerID: owner, OwnerName: "Bo",
+		Permission: services.PermissionView, SharedAt: time.Now(),
+	}}
+	// Made before the shared collection existed, or through the web app
+	own := addFile(user.ID, nil, SharedFolderName, "")
+	addFile(user.ID, own, "mine.txt", "own content")
+
+	s := &Server{
+		fs:          &FileSystem{fileRepo: files, storage: store, log: zerolog.Nop()},
+		authService: fakeAuth{user: user},
+		locks:       noLocks{},
+		log:         zerolog.Nop(),
+	}
+	app := fiber.New(fiber.Config{
+		RequestMethods: append([]string{fiber.MethodGet, fiber.MethodHead}, "PROPFIND", "MKCOL"),
+	})
+	app.All("/webdav/*", s.Handler())
+
+	do := func(method, target string) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest(method, target, nil)
+		req.SetBasicAuth(user.Email, "password")
+		if method == "PROPFIND" {
+			req.Header.Set("Depth", "1")
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := do("PROPFIND", "/webdav/")
+	if status != 207 {
+		t.Fatalf("PROPFIND / = %d, want 207", status)
+	}
+	for _, href := range []string{"/webdav/Shared%20with%20me/", "/webdav/Shared%20with%20me%20%28own%29/"} {
+		if !strings.Contains(body, "<D:href>"+href+"</D:href>") {
+			t.Errorf("PROPFIND / doesn't list %s:\n%s", href, body)
+		}
+	}
+
+	status, body = do("PROPFIND", "/webdav/Shared%20with%20me/")
+	if status != 207 {
+		t.Fatalf("PROPFIND shared collection = %d, want 207", status)
+	}
+	if !strings.Contains(body, "<D:href>/webdav/Shared%20with%20me/Team%20Docs/</D:href>") {
+		t.Errorf("PROPFIND shared collection doesn't list the share:\n%s", body)
+	}
+
+	status, body = do("PROPFIND", "/webdav/Shared%20with%20me/Team%20Docs/")
+	if status != 207 || !strings.Contains(body, "<D:href>/webdav/Shared%20with%20me/Team%20Docs/q3%20plan.txt</D:href>") {
+		t.Errorf("PROPFIND share = %d:\n%s", status, body)
+	}
+
+	for target, want := range map[string]string{
+		"/webdav/Shared%20with%20me/Team%20Docs/q3%20plan.txt": "shared content",
+		"/webdav/Shared%20with%20me%20%28own%29/mine.txt":      "own content",
+	} {
+		if status, body := do("GET", target); status != 200 || body != want {
+			t.Errorf("GET %s = %d %q, want 200 %q", target, status, body, want)
+		}
+	}
+
+	// The shared collection's name can't be taken
+	if status, _ := do("MKCOL", "/webdav/Shared%20with%20me"); status != 403 {
+		t.Errorf("MKCOL shared collection = %d, want 403", status)
+	}
+	if got := pathHref("/a b/c#d"); got != "/webdav/a%20b/c%23d" {
+		t.Errorf("pathHref() = %q", got)
+	}
+}
+
+func TestServerPutShared(t *testing.T) {
+	user := &models.User{ID: uuid.New(), Email: "al@example.com"}
+	owner := uuid.New()
+	team := &models.File{ID: uuid.New(), OwnerID: owner, Name: "Team Docs", IsFolder: true}
+	plan := &models.File{ID: uuid.New(), OwnerID: owner, ParentID: &team.ID, Name: "plan.txt", StorageKey: "files/plan"}
+	files := &fakeFiles{
+		files: []*models.File{team, plan},
+		shared: map[uuid.UUID][]*models.SharedFile{user.ID: {{
+			ID: team.ID, Name: team.Name, IsFolder: true, OwnerID: owner, OwnerName: "Bo",
+			Permission: services.PermissionEdit, SharedAt: time.Now(),
+		}}},
+	}
+	writer := &fakeWriter{}
+
+	s := &Server{
+		fs:          &FileSystem{fileRepo: files, log: zerolog.Nop()},
+		authService: fakeAuth{user: user},
+		fileService: writer,
+		locks:       noLocks{},
+		log:         zerolog.Nop(),
+	}
+	app := fiber.New()
+	app.All("/webdav/*", s.Handler())
+
+	req := httptest.NewRequest("PUT", "/webdav/Shared%20with%20me/Team%20Docs/plan.txt", strings.NewReader("new plan"))
+	req.SetBasicAuth(user.Email, "password")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 204 {
+		t.Fatalf("PUT = %d, want 204", resp.StatusCode)
+	}
+
+	// The owner's file is written, by the user it's shared with
+	if writer.ownerID != owner.String() || writer.userID != user.ID.String() || writer.content != "new plan" {
+		t.Errorf("wrote %q as owner %s, user %s; want owner %s, user %s", writer.content, writer.ownerID, writer.userID, owner, user.ID)
+	}
+}
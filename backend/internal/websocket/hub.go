@@ -13,17 +13,20 @@ import (
 type EventType string
 
 const (
-	EventFileCreated    EventType = "file:created"
-	EventFileUpdated    EventType = "file:updated"
-	EventFileDeleted    EventType = "file:deleted"
-	EventFileMoved      EventType = "file:moved"
-	EventFileRestored   EventType = "file:restored"
-	EventUploadStarted  EventType = "upload:started"
-	EventUploadProgress EventType = "upload:progress"
-	EventUploadComplete EventType = "upload:complete"
-	EventShareCreated   EventType = "share:created"
-	EventShareRevoked   EventType = "share:revoked"
-	EventStorageUpdated EventType = "storage:updated"
+	EventFileCreated       EventType = "file:created"
+	EventFileUpdated       EventType = "file:updated"
+	EventFileDeleted       EventType = "file:deleted"
+	EventFileMoved         EventType = "file:moved"
+	EventFileRestored      EventType = "file:restored"
+	EventUploadStarted     EventType = "upload:started"
+	EventUploadProgress    EventType = "upload:progress"
+	EventUploadComplete    EventType = "upload:complete"
+	EventShareCreated      EventType = "share:created"
+	EventShareRevoked      EventType = "share:revoked"
+	EventFileRequestUpload EventType = "file_request:upload"
+	EventStorageUpdated    EventType = "storage:updated"
+	EventCalendarReminder  EventType = "calendar:reminder"
+	EventNotification      EventType = "notification"
 )
 
 // Event represents a WebSocket event
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS dav_changes;
+
+DROP INDEX IF EXISTS idx_calendar_events_resource_name;
+DROP INDEX IF EXISTS idx_calendar_events_uid;
+ALTER TABLE calendar_events DROP COLUMN IF EXISTS resource_name;
+ALTER TABLE calendar_events DROP COLUMN IF EXISTS uid;
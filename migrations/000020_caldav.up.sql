@@ -0,0 +1,24 @@
+-- CalDAV support: stable iCalendar UIDs and resource names for calendar events
+ALTER TABLE calendar_events ADD COLUMN IF NOT EXISTS uid VARCHAR(255);
+ALTER TABLE calendar_events ADD COLUMN IF NOT EXISTS resource_name VARCHAR(255);
+
+UPDATE calendar_events SET uid = id::text WHERE uid IS NULL;
+UPDATE calendar_events SET resource_name = id::text || '.ics' WHERE resource_name IS NULL;
+
+ALTER TABLE calendar_events ALTER COLUMN uid SET NOT NULL;
+ALTER TABLE calendar_events ALTER COLUMN resource_name SET NOT NULL;
+
+CREATE UNIQUE INDEX idx_calendar_events_uid ON calendar_events(user_id, uid);
+CREATE UNIQUE INDEX idx_calendar_events_resource_name ON calendar_events(user_id, resource_name);
+
+-- Change log backing DAV sync-collection reports and collection tags
+CREATE TABLE IF NOT EXISTS dav_changes (
+    id BIGSERIAL PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    collection VARCHAR(50) NOT NULL,
+    resource_name VARCHAR(255) NOT NULL,
+    deleted BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_dav_changes_user_collection ON dav_changes(user_id, collection, id);
@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_contacts_resource_name;
+DROP INDEX IF EXISTS idx_contacts_uid;
+
+ALTER TABLE contacts DROP COLUMN IF EXISTS vcard;
+ALTER TABLE contacts DROP COLUMN IF EXISTS resource_name;
+ALTER TABLE contacts DROP COLUMN IF EXISTS uid;
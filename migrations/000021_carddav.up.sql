@@ -0,0 +1,13 @@
+-- CardDAV support: stable vCard UIDs, resource names and the client's original card
+ALTER TABLE contacts ADD COLUMN IF NOT EXISTS uid VARCHAR(255);
+ALTER TABLE contacts ADD COLUMN IF NOT EXISTS resource_name VARCHAR(255);
+ALTER TABLE contacts ADD COLUMN IF NOT EXISTS vcard TEXT;
+
+UPDATE contacts SET uid = id::text WHERE uid IS NULL;
+UPDATE contacts SET resource_name = id::text || '.vcf' WHERE resource_name IS NULL;
+
+ALTER TABLE contacts ALTER COLUMN uid SET NOT NULL;
+ALTER TABLE contacts ALTER COLUMN resource_name SET NOT NULL;
+
+CREATE UNIQUE INDEX idx_contacts_uid ON contacts(user_id, uid);
+CREATE UNIQUE INDEX idx_contacts_resource_name ON contacts(user_id, resource_name);
@@ -0,0 +1,10 @@
+DELETE FROM calendar_events WHERE series_id IS NOT NULL;
+
+DROP INDEX IF EXISTS idx_calendar_events_override;
+DROP INDEX IF EXISTS idx_calendar_events_resource_name;
+DROP INDEX IF EXISTS idx_calendar_events_uid;
+CREATE UNIQUE INDEX idx_calendar_events_uid ON calendar_events(user_id, uid);
+CREATE UNIQUE INDEX idx_calendar_events_resource_name ON calendar_events(user_id, resource_name);
+
+ALTER TABLE calendar_events DROP COLUMN IF EXISTS recurrence_id;
+ALTER TABLE calendar_events DROP COLUMN IF EXISTS series_id;
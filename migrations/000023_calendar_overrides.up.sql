@@ -0,0 +1,11 @@
+-- Per-occurrence overrides of recurring calendar events. An override is a row
+-- pointing at its series (series_id) and the original start of the occurrence
+-- it replaces (recurrence_id); it shares the series' UID and CalDAV resource.
+ALTER TABLE calendar_events ADD COLUMN IF NOT EXISTS series_id UUID REFERENCES calendar_events(id) ON DELETE CASCADE;
+ALTER TABLE calendar_events ADD COLUMN IF NOT EXISTS recurrence_id TIMESTAMP WITH TIME ZONE;
+
+DROP INDEX IF EXISTS idx_calendar_events_uid;
+DROP INDEX IF EXISTS idx_calendar_events_resource_name;
+CREATE UNIQUE INDEX idx_calendar_events_uid ON calendar_events(user_id, uid) WHERE series_id IS NULL;
+CREATE UNIQUE INDEX idx_calendar_events_resource_name ON calendar_events(user_id, resource_name) WHERE series_id IS NULL;
+CREATE UNIQUE INDEX idx_calendar_events_override ON calendar_events(series_id, recurrence_id) WHERE series_id IS NOT NULL;
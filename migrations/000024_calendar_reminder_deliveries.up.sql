@@ -0,0 +1,10 @@
+-- Calendar reminders that have been sent, so a reminder planned twice (or
+-- again after a restart) fires only once
+CREATE TABLE IF NOT EXISTS calendar_reminder_deliveries (
+    event_id UUID NOT NULL REFERENCES calendar_events(id) ON DELETE CASCADE,
+    fire_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    delivered_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (event_id, fire_at)
+);
+
+CREATE INDEX IF NOT EXISTS idx_calendar_reminder_deliveries_delivered_at ON calendar_reminder_deliveries(delivered_at);
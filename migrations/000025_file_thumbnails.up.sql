@@ -0,0 +1,13 @@
+-- Generated previews of files, one row per size. The hash of the content
+-- they were made from lets stale thumbnails be told apart after an update.
+CREATE TABLE IF NOT EXISTS file_thumbnails (
+    file_id UUID NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    size VARCHAR(16) NOT NULL,
+    storage_key VARCHAR(512) NOT NULL,
+    width INTEGER NOT NULL,
+    height INTEGER NOT NULL,
+    bytes BIGINT NOT NULL,
+    source_hash VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (file_id, size)
+);
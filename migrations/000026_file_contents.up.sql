@@ -0,0 +1,13 @@
+-- Text extracted from files for full-text search. Rows whose source_hash no
+-- longer matches the file's hash are stale and ignored until reindexed.
+CREATE TABLE IF NOT EXISTS file_contents (
+    file_id UUID PRIMARY KEY REFERENCES files(id) ON DELETE CASCADE,
+    owner_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    content TEXT NOT NULL,
+    search_vector TSVECTOR NOT NULL,
+    source_hash VARCHAR(64) NOT NULL,
+    indexed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_contents_search ON file_contents USING GIN (search_vector);
+CREATE INDEX IF NOT EXISTS idx_file_contents_owner_id ON file_contents(owner_id);
@@ -0,0 +1,9 @@
+-- WebDAV dead properties: arbitrary XML properties clients set on files with
+-- PROPPATCH. The value is the property element's inner XML.
+CREATE TABLE IF NOT EXISTS file_properties (
+    file_id UUID NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    namespace VARCHAR(512) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    value TEXT NOT NULL,
+    PRIMARY KEY (file_id, namespace, name)
+);
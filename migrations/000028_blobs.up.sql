@@ -0,0 +1,28 @@
+-- Stored file content, one row per object in storage. Files and versions
+-- with the same SHA-256 hash share one object, which is deleted when its
+-- last reference goes.
+CREATE TABLE IF NOT EXISTS blobs (
+    storage_key VARCHAR(512) PRIMARY KEY,
+    hash VARCHAR(64),
+    size BIGINT NOT NULL,
+    ref_count INTEGER NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_blobs_hash ON blobs(hash);
+CREATE INDEX IF NOT EXISTS idx_blobs_unreferenced ON blobs(storage_key) WHERE ref_count <= 0;
+
+-- Objects stored before deduplication each become a blob, referenced by the
+-- files and versions using them. Identical content stored twice stays in two
+-- objects; new uploads share whichever one they find.
+INSERT INTO blobs (storage_key, hash, size, ref_count)
+SELECT storage_key, MAX(hash), MAX(size), COUNT(*)
+FROM (
+    SELECT storage_key, hash, size FROM files
+    WHERE is_folder = false AND storage_key IS NOT NULL AND storage_key <> ''
+    UNION ALL
+    SELECT storage_key, hash, size FROM file_versions
+    WHERE storage_key <> ''
+) refs
+GROUP BY storage_key
+ON CONFLICT (storage_key) DO NOTHING;
@@ -0,0 +1,14 @@
+-- Keys encrypting stored objects at rest, one per user plus one (the nil
+-- UUID) for objects no user owns. Each is wrapped by the master key with the
+-- given ID; rotating the master key only rewraps them. Keys outlive their
+-- users, as deduplicated content may still be shared with others.
+CREATE TABLE IF NOT EXISTS data_keys (
+    id UUID PRIMARY KEY,
+    owner_id UUID NOT NULL UNIQUE,
+    wrapped_key BYTEA NOT NULL,
+    master_key_id VARCHAR(16) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    rotated_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_data_keys_master_key ON data_keys(master_key_id);
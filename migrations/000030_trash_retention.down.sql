@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_files_trashed_at;
+ALTER TABLE users DROP COLUMN IF EXISTS trash_retention_days;
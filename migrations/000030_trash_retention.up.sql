@@ -0,0 +1,5 @@
+-- Per-user override of how many days trashed files are kept before they are
+-- purged. NULL uses the system setting; 0 keeps them until emptied by hand.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS trash_retention_days INTEGER;
+
+CREATE INDEX IF NOT EXISTS idx_files_trashed_at ON files(trashed_at) WHERE is_trashed = true;
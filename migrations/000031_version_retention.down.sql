@@ -0,0 +1 @@
+ALTER TABLE file_versions DROP COLUMN IF EXISTS pinned;
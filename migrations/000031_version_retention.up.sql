@@ -0,0 +1,2 @@
+-- Pinned versions are kept whatever the version retention policy says
+ALTER TABLE file_versions ADD COLUMN IF NOT EXISTS pinned BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,5 @@
+DELETE FROM shares WHERE permission = 'upload';
+ALTER TABLE shares DROP COLUMN IF EXISTS allowed_extensions;
+ALTER TABLE shares DROP COLUMN IF EXISTS upload_count;
+ALTER TABLE shares DROP COLUMN IF EXISTS max_uploads;
+ALTER TABLE shares DROP COLUMN IF EXISTS max_upload_size;
@@ -0,0 +1,6 @@
+-- File requests are public links with the 'upload' permission on a folder,
+-- which visitors upload into without seeing its contents
+ALTER TABLE shares ADD COLUMN IF NOT EXISTS max_upload_size BIGINT;
+ALTER TABLE shares ADD COLUMN IF NOT EXISTS max_uploads INTEGER;
+ALTER TABLE shares ADD COLUMN IF NOT EXISTS upload_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE shares ADD COLUMN IF NOT EXISTS allowed_extensions TEXT[];
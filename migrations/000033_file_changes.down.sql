@@ -0,0 +1,2 @@
+ALTER TABLE users DROP COLUMN IF EXISTS changes_pruned_through;
+DROP TABLE IF EXISTS file_changes;
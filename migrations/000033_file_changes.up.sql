@@ -0,0 +1,19 @@
+-- Journal of changes to each user's files, read by sync clients through a
+-- cursor: the id of the last change they have seen. Entries older than the
+-- journal's retention are pruned; changes_pruned_through is the highest id
+-- pruned for the user, so a cursor below it can no longer be continued.
+CREATE TABLE IF NOT EXISTS file_changes (
+    id BIGSERIAL PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    file_id UUID NOT NULL,
+    parent_id UUID,
+    change_type VARCHAR(20) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    is_folder BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_changes_user ON file_changes(user_id, id);
+CREATE INDEX IF NOT EXISTS idx_file_changes_created_at ON file_changes(created_at);
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS changes_pruned_through BIGINT NOT NULL DEFAULT 0;
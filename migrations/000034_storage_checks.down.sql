@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_email_attachments_storage_key;
+DROP INDEX IF EXISTS idx_file_thumbnails_storage_key;
+DROP TABLE IF EXISTS broken_files;
+DROP TABLE IF EXISTS storage_checks;
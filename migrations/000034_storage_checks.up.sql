@@ -0,0 +1,28 @@
+-- Reports of storage consistency checks, which cross-check the database
+-- against the object store
+CREATE TABLE IF NOT EXISTS storage_checks (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    started_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    finished_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    report JSONB NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_storage_checks_started_at ON storage_checks(started_at DESC);
+
+-- Files whose stored content a check found missing or damaged. Version 0 is
+-- the file's current content. A mark only holds while the file (or version)
+-- still uses the storage key it was made for; new content clears it.
+CREATE TABLE IF NOT EXISTS broken_files (
+    file_id UUID NOT NULL REFERENCES files(id) ON DELETE CASCADE,
+    version INTEGER NOT NULL DEFAULT 0,
+    storage_key VARCHAR(512) NOT NULL,
+    reason VARCHAR(32) NOT NULL,
+    detected_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (file_id, version)
+);
+
+CREATE INDEX IF NOT EXISTS idx_broken_files_storage_key ON broken_files(storage_key);
+
+-- Checks look up every listed object among the keys in use
+CREATE INDEX IF NOT EXISTS idx_file_thumbnails_storage_key ON file_thumbnails(storage_key);
+CREATE INDEX IF NOT EXISTS idx_email_attachments_storage_key ON email_attachments(storage_key);
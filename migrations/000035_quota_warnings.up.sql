@@ -0,0 +1,13 @@
+-- The highest soft-limit threshold, in percent of the quota, a user was last
+-- warned about; 0 when they're below all of them
+ALTER TABLE users ADD COLUMN IF NOT EXISTS quota_warned_pct INT NOT NULL DEFAULT 0;
+
+-- storage_used was only ever lowered until now; set it to what users' files,
+-- versions and stored email attachments take up
+UPDATE users u SET storage_used =
+    (SELECT COALESCE(SUM(size), 0) FROM files WHERE owner_id = u.id AND is_folder = false) +
+    (SELECT COALESCE(SUM(v.size), 0) FROM file_versions v JOIN files f ON f.id = v.file_id WHERE f.owner_id = u.id) +
+    (SELECT COALESCE(SUM(a.size), 0) FROM email_attachments a
+        JOIN emails e ON e.id = a.email_id
+        JOIN email_accounts acc ON acc.id = e.account_id
+        WHERE acc.user_id = u.id AND COALESCE(a.storage_key, '') <> '');
@@ -0,0 +1,6 @@
+ALTER TABLE email_attachments DROP COLUMN IF EXISTS virus;
+
+DROP INDEX IF EXISTS idx_files_infected;
+ALTER TABLE files DROP COLUMN IF EXISTS scanned_at;
+ALTER TABLE files DROP COLUMN IF EXISTS virus;
+ALTER TABLE files DROP COLUMN IF EXISTS scan_status;
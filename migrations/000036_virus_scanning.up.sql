@@ -0,0 +1,12 @@
+-- Virus scan state of each file's current content: 'pending', 'clean',
+-- 'infected' or 'skipped' (too large for the scanner), or '' when it was
+-- stored while scanning was off. Infected files are quarantined: they can't
+-- be downloaded or shared.
+ALTER TABLE files ADD COLUMN IF NOT EXISTS scan_status VARCHAR(16) NOT NULL DEFAULT '';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS virus VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE files ADD COLUMN IF NOT EXISTS scanned_at TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS idx_files_infected ON files(scanned_at DESC) WHERE scan_status = 'infected';
+
+-- What an email attachment was found to contain; it isn't stored or served
+ALTER TABLE email_attachments ADD COLUMN IF NOT EXISTS virus VARCHAR(255) NOT NULL DEFAULT '';